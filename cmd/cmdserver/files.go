@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+var filesRoot = flag.String("files-root", baseDir, "directory /files reads and writes under")
+
+// errOutsideFilesRoot rejects paths that lead outside the files root.
+var errOutsideFilesRoot = errors.New("path escapes the files root")
+
+// initFilesRoot creates the files root and resolves it, so paths under it can
+// be compared after following symlinks.
+func initFilesRoot() error {
+	if err := os.MkdirAll(*filesRoot, 0755); err != nil {
+		return err
+	}
+	root, err := filepath.Abs(*filesRoot)
+	if err != nil {
+		return err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	*filesRoot = root
+	return nil
+}
+
+// inFilesRoot reports whether the cleaned path path is the files root or
+// under it.
+func inFilesRoot(path string) bool {
+	return path == *filesRoot || strings.HasPrefix(path, *filesRoot+"/")
+}
+
+// uploadPath resolves a path relative to the files root for writing,
+// refusing paths that lead outside it or name the root itself.
+func uploadPath(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("path is required")
+	}
+	path := filepath.Join(*filesRoot, name)
+	if path == *filesRoot || !inFilesRoot(path) {
+		return "", errOutsideFilesRoot
+	}
+	return path, nil
+}
+
+// uploadDir resolves dir, the directory an upload goes in, and creates what's
+// missing of it. Symlinks in the part that exists are followed and checked
+// against the files root before anything is created, so a symlinked
+// directory on the way can't get directories made outside the root.
+func uploadDir(dir string) (string, error) {
+	existing, missing := dir, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if errors.Is(err, fs.ErrNotExist) {
+			missing = filepath.Join(filepath.Base(existing), missing)
+			existing = filepath.Dir(existing)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if !inFilesRoot(resolved) {
+			return "", errOutsideFilesRoot
+		}
+		dir = filepath.Join(resolved, missing)
+		return dir, os.MkdirAll(dir, 0755)
+	}
+}
+
+// parseFileOwner parses an optional uid or gid query parameter; -1 leaves it
+// unchanged.
+func parseFileOwner(value string) (int, error) {
+	if value == "" {
+		return -1, nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("invalid id: %s", value)
+	}
+	return id, nil
+}
+
+// putFileHandler handles "/files" PUT requests, writing the request body to
+// the file at the "path" query parameter as it arrives. "mode" (octal,
+// default 0644), "uid" and "gid" set the file's permissions and owner.
+// Missing parent directories are created, and the file is replaced with a
+// rename once it's complete, so readers never see a partial upload.
+func putFileHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "put_file")
+	query := r.URL.Query()
+
+	path, err := uploadPath(query.Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mode := os.FileMode(0644)
+	if value := query.Get("mode"); value != "" {
+		m, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || m > 0777 {
+			http.Error(w, fmt.Sprintf("invalid mode: %s", value), http.StatusBadRequest)
+			return
+		}
+		mode = os.FileMode(m)
+	}
+	uid, err := parseFileOwner(query.Get("uid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gid, err := parseFileOwner(query.Get("gid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dir, err := uploadDir(filepath.Dir(path))
+	if errors.Is(err, errOutsideFilesRoot) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("failed to create directory")
+		http.Error(w, fmt.Sprintf("failed to create directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	path = filepath.Join(dir, filepath.Base(path))
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		http.Error(w, "path is a directory", http.StatusBadRequest)
+		return
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".upload-*")
+	if err != nil {
+		logger.WithError(err).Error("failed to create file")
+		http.Error(w, fmt.Sprintf("failed to create file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// Leaves nothing behind on failure; a no-op once renamed.
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, r.Body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil && (uid >= 0 || gid >= 0) {
+		err = tmp.Chown(uid, gid)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		logger.WithField("path", path).WithError(err).Error("failed to write file")
+		http.Error(w, fmt.Sprintf("failed to write file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	rel, _ := filepath.Rel(*filesRoot, path)
+	logger.WithFields(log.Fields{"path": path, "size": size}).Info("file uploaded")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmdserver.PutFileResponse{
+		Path: rel,
+		Size: size,
+	})
+}
+
+// writeArchive streams root, a file or directory, as a tar archive whose
+// entries are named relative to root's parent. Symlinks are archived as
+// links rather than followed, so nothing outside the files root is read. As
+// the status is sent before the walk, a failure partway through aborts the
+// connection to tell the client the archive is incomplete.
+func writeArchive(w http.ResponseWriter, root string) {
+	logger := log.WithFields(log.Fields{"api": "get_file", "path": root})
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	tw := tar.NewWriter(w)
+	parent := filepath.Dir(root)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			// Sockets, devices and the like have no content to send.
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(parent, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		// Stop at the size in the header even if the file grew since.
+		_, err = io.Copy(tw, io.LimitReader(file, header.Size))
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		logger.WithError(err).Error("failed to write archive")
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useFilesRoot points the files endpoint at a temp dir for the test.
+func useFilesRoot(t *testing.T) string {
+	t.Helper()
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := *filesRoot
+	*filesRoot = root
+	t.Cleanup(func() { *filesRoot = saved })
+	return root
+}
+
+// flakyWriter drops the connection once limit bytes of body were written.
+type flakyWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n, _ := w.ResponseWriter.Write(p[:w.limit])
+		w.limit -= n
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.limit -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func TestGetFileResumesAcrossDisconnects(t *testing.T) {
+	root := useFilesRoot(t)
+	data := make([]byte, 8<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "artifact.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every response is cut off after a megabyte or so.
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		getFileHandler(&flakyWriter{ResponseWriter: w, limit: 1<<20 + int(n)*4096}, r)
+	}))
+	defer srv.Close()
+	fileURL := srv.URL + "/files?" + url.Values{"path": {"artifact.bin"}}.Encode()
+
+	var got bytes.Buffer
+	var etag string
+	for attempt := 0; got.Len() < len(data); attempt++ {
+		if attempt > 20 {
+			t.Fatalf("download didn't finish after %d attempts, got %d of %d bytes", attempt, got.Len(), len(data))
+		}
+		req, _ := http.NewRequest(http.MethodGet, fileURL, nil)
+		if got.Len() > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", got.Len()))
+			req.Header.Set("If-Range", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		wantStatus := http.StatusOK
+		if got.Len() > 0 {
+			wantStatus = http.StatusPartialContent
+			if want := fmt.Sprintf("bytes %d-%d/%d", got.Len(), len(data)-1, len(data)); resp.Header.Get("Content-Range") != want {
+				t.Errorf("Content-Range = %q, want %q", resp.Header.Get("Content-Range"), want)
+			}
+		}
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("GET from byte %d = %d, want %d", got.Len(), resp.StatusCode, wantStatus)
+		}
+		etag = resp.Header.Get("ETag")
+		// The copy fails when the connection drops; keep what arrived.
+		io.Copy(&got, resp.Body)
+		resp.Body.Close()
+	}
+
+	if requests.Load() < 2 {
+		t.Errorf("download took %d requests, want it interrupted", requests.Load())
+	}
+	if sha256.Sum256(got.Bytes()) != sha256.Sum256(data) {
+		t.Error("reassembled download doesn't match the file")
+	}
+}
+
+func TestGetFileIfRangeAfterChange(t *testing.T) {
+	root := useFilesRoot(t)
+	file := filepath.Join(root, "artifact.bin")
+	if err := os.WriteFile(file, []byte("version one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/files?path=artifact.bin", nil)
+		req.Header = header
+		rec := httptest.NewRecorder()
+		getFileHandler(rec, req)
+		return rec
+	}
+	etag := get(http.Header{}).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	if rec := get(http.Header{"Range": {"bytes=8-"}, "If-Range": {etag}}); rec.Code != http.StatusPartialContent || rec.Body.String() != "one" {
+		t.Errorf("resume of the same file = %d %q, want 206 %q", rec.Code, rec.Body.String(), "one")
+	}
+
+	// The file changes: resuming would mix versions, so the whole file is
+	// sent instead.
+	if err := os.WriteFile(file, []byte("version two!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	rec := get(http.Header{"Range": {"bytes=8-"}, "If-Range": {etag}})
+	if rec.Code != http.StatusOK || rec.Body.String() != "version two!" {
+		t.Errorf("resume of a changed file = %d %q, want the whole new file", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("ETag") == etag {
+		t.Error("ETag didn't change with the file")
+	}
+
+	if rec := get(http.Header{"Range": {"bytes=100-"}}); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end = %d, want 416", rec.Code)
+	}
+}
+
+func TestGetFileOutsideRoot(t *testing.T) {
+	useFilesRoot(t)
+	for _, path := range []string{"../../etc/passwd", "missing"} {
+		req := httptest.NewRequest(http.MethodGet, "/files?"+url.Values{"path": {path}}.Encode(), nil)
+		rec := httptest.NewRecorder()
+		getFileHandler(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+// putFile uploads body to path through putFileHandler.
+func putFile(path string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, "/files?"+url.Values{"path": {path}}.Encode(), body)
+	rec := httptest.NewRecorder()
+	putFileHandler(rec, req)
+	return rec
+}
+
+func TestPutFileOutsideRoot(t *testing.T) {
+	root := useFilesRoot(t)
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		"",
+		".",
+		"../x",
+		"a/../../x",
+		"escape/x",
+		"escape/new/dir/x",
+	} {
+		if rec := putFile(path, bytes.NewReader([]byte("data"))); rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT %q = %d, want 400", path, rec.Code)
+		}
+	}
+	// The rejected uploads left nothing outside the root, not even
+	// directories.
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("files outside the root after rejected uploads: %v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "x")); !os.IsNotExist(err) {
+		t.Errorf("upload escaped the root: %v", err)
+	}
+
+	// Symlinks that stay inside the root are followed.
+	if err := os.Mkdir(filepath.Join(root, "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real", filepath.Join(root, "alias")); err != nil {
+		t.Fatal(err)
+	}
+	if rec := putFile("alias/new/x", bytes.NewReader([]byte("data"))); rec.Code != http.StatusOK {
+		t.Fatalf("PUT through an in-root symlink = %d %s", rec.Code, rec.Body.String())
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "real", "new", "x")); err != nil || string(data) != "data" {
+		t.Errorf("uploaded file = %q, %v, want %q", data, err, "data")
+	}
+}
+
+func TestPutFileLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uploads several hundred megabytes")
+	}
+	root := useFilesRoot(t)
+	srv := httptest.NewServer(http.HandlerFunc(putFileHandler))
+	defer srv.Close()
+
+	// The body is generated as it's sent, so neither side can hold it all.
+	const size = 384 << 20
+	block := make([]byte, 1<<20)
+	if _, err := rand.Read(block); err != nil {
+		t.Fatal(err)
+	}
+	sent := sha256.New()
+	pr, pw := io.Pipe()
+	go func() {
+		for written := 0; written < size; written += len(block) {
+			sent.Write(block)
+			if _, err := pw.Write(block); err != nil {
+				return
+			}
+			block[0]++
+		}
+		pw.Close()
+	}()
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/files?path=big/artifact.bin", pr)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT = %d, want 200", resp.StatusCode)
+	}
+
+	file, err := os.Open(filepath.Join(root, "big", "artifact.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	got := sha256.New()
+	n, err := io.Copy(got, file)
+	if err != nil || n != size {
+		t.Fatalf("uploaded file has %d bytes, %v, want %d", n, err, size)
+	}
+	if !bytes.Equal(got.Sum(nil), sent.Sum(nil)) {
+		t.Error("uploaded file doesn't match what was sent")
+	}
+	// Only the finished file is left, no temp files.
+	if entries, _ := os.ReadDir(filepath.Join(root, "big")); len(entries) != 1 {
+		t.Errorf("upload directory has %d entries, want 1", len(entries))
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+const (
+	// maxJobOutputBytes caps the output kept for each job.
+	maxJobOutputBytes = 1 << 20
+	// jobKillGracePeriod is how long a killed job gets to exit after SIGTERM
+	// before it's sent SIGKILL.
+	jobKillGracePeriod = 5 * time.Second
+)
+
+var jobTTL = flag.Duration("job-ttl", 10*time.Minute, "how long finished jobs are kept for /jobs")
+
+// jobOutput collects a job's combined output up to limit bytes, or
+// maxJobOutputBytes if limit is zero, and drops the rest.
+type jobOutput struct {
+	lock      sync.Mutex
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (o *jobOutput) Write(p []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	limit := o.limit
+	if limit == 0 {
+		limit = maxJobOutputBytes
+	}
+	room := max(limit-o.buf.Len(), 0)
+	if len(p) > room {
+		o.buf.Write(p[:room])
+		o.truncated = true
+	} else {
+		o.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (o *jobOutput) snapshot() (string, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return strings.ToValidUTF8(o.buf.String(), ""), o.truncated
+}
+
+// encoded returns the output so far in encoding, one of
+// cmdserver.OutputEncodings, and whether any was dropped.
+func (o *jobOutput) encoded(encoding string) (string, bool) {
+	if encoding != cmdserver.OutputEncodingBase64 {
+		return o.snapshot()
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return base64.StdEncoding.EncodeToString(o.buf.Bytes()), o.truncated
+}
+
+// job is a non-blocking command. Fields other than output are guarded by
+// the registry's lock.
+type job struct {
+	id        string
+	cmd       string
+	workspace string
+	startedAt time.Time
+	output    jobOutput
+	// pid leads the job's process group.
+	pid int
+	// done is closed once the job has finished.
+	done     chan struct{}
+	endedAt  time.Time
+	exitCode int
+	err      string
+	timedOut bool
+	killed   bool
+}
+
+// jobRegistry keeps non-blocking commands until jobTTL after they finish.
+type jobRegistry struct {
+	lock sync.Mutex
+	jobs map[string]*job
+}
+
+var jobs = &jobRegistry{jobs: make(map[string]*job)}
+
+// prune drops jobs that finished more than jobTTL ago. Must be called with
+// r.lock held.
+func (r *jobRegistry) prune() {
+	cutoff := time.Now().Add(-*jobTTL)
+	for id, j := range r.jobs {
+		if !j.endedAt.IsZero() && j.endedAt.Before(cutoff) {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+// add registers a new running job for cmd.
+func (r *jobRegistry) add(cmd string, workspace string) (*job, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate job id: %w", err)
+	}
+	j := &job{
+		id:        hex.EncodeToString(id),
+		cmd:       cmd,
+		workspace: workspace,
+		startedAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.prune()
+	r.jobs[j.id] = j
+	return j, nil
+}
+
+// remove drops a job that never started.
+func (r *jobRegistry) remove(j *job) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.jobs, j.id)
+}
+
+// finish records the outcome of cmd.Wait for j.
+func (r *jobRegistry) finish(j *job, err error, timedOut bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	j.endedAt = time.Now()
+	j.timedOut = timedOut
+	if err != nil {
+		j.err = err.Error()
+		j.exitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			j.exitCode = exitErr.ExitCode()
+		}
+	}
+}
+
+// apiJob must be called with r.lock held.
+func (j *job) apiJob() cmdserver.Job {
+	output, truncated := j.output.snapshot()
+	resp := cmdserver.Job{
+		ID:        j.id,
+		Cmd:       j.cmd,
+		Workspace: j.workspace,
+		State:     cmdserver.JobRunning,
+		Output:    output,
+		Truncated: truncated,
+		StartedAt: j.startedAt,
+	}
+	if !j.endedAt.IsZero() {
+		exitCode := j.exitCode
+		endedAt := j.endedAt
+		resp.State = cmdserver.JobFinished
+		resp.ExitCode = &exitCode
+		resp.Error = j.err
+		resp.TimedOut = j.timedOut
+		resp.Killed = j.killed
+		resp.EndedAt = &endedAt
+	}
+	return resp
+}
+
+// startJob starts cmd in the background as a job. cancel is called once it
+// has finished.
+func startJob(ctx context.Context, cancel context.CancelFunc, cmd *exec.Cmd, req cmdserver.RunCmdRequest) (*job, error) {
+	j, err := jobs.add(req.Cmd, req.Workspace)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = &j.output
+	cmd.Stderr = &j.output
+	if err := cmd.Start(); err != nil {
+		jobs.remove(j)
+		return nil, err
+	}
+	j.pid = cmd.Process.Pid
+
+	go func() {
+		err := cmd.Wait()
+		timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+		cancel()
+		jobs.finish(j, err, timedOut)
+		close(j.done)
+		logger := log.WithFields(log.Fields{
+			"api":      "run_cmd",
+			"job":      j.id,
+			"timedOut": timedOut,
+		})
+		if err != nil {
+			logger.Errorf("command execution failed: %v", err)
+		} else {
+			logger.Info("command completed successfully")
+		}
+	}()
+	return j, nil
+}
+
+// listJobsHandler handles "/jobs" GET requests, oldest job first.
+func listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	jobs.lock.Lock()
+	jobs.prune()
+	resp := cmdserver.ListJobsResponse{Jobs: []cmdserver.Job{}}
+	for _, j := range jobs.jobs {
+		resp.Jobs = append(resp.Jobs, j.apiJob())
+	}
+	jobs.lock.Unlock()
+	sort.Slice(resp.Jobs, func(a, b int) bool {
+		return resp.Jobs[a].StartedAt.Before(resp.Jobs[b].StartedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// getJobHandler handles "/jobs/{id}" GET requests.
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	jobs.lock.Lock()
+	jobs.prune()
+	j, ok := jobs.jobs[id]
+	var resp cmdserver.Job
+	if ok {
+		resp = j.apiJob()
+	}
+	jobs.lock.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("job not found: %s", id), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// kill stops a running job's process group: SIGTERM first, then SIGKILL if
+// it's still running after jobKillGracePeriod. It returns once the job has
+// finished.
+func (r *jobRegistry) kill(j *job) {
+	r.lock.Lock()
+	if !j.endedAt.IsZero() {
+		r.lock.Unlock()
+		return
+	}
+	j.killed = true
+	r.lock.Unlock()
+
+	logger := log.WithFields(log.Fields{"api": "kill_job", "job": j.id})
+	if err := syscall.Kill(-j.pid, syscall.SIGTERM); err != nil {
+		logger.WithError(err).Warn("failed to send SIGTERM")
+	}
+	select {
+	case <-j.done:
+		return
+	case <-time.After(jobKillGracePeriod):
+	}
+	logger.Info("job still running after SIGTERM, sending SIGKILL")
+	if err := syscall.Kill(-j.pid, syscall.SIGKILL); err != nil {
+		logger.WithError(err).Warn("failed to send SIGKILL")
+	}
+	<-j.done
+}
+
+// killJobHandler handles "/jobs/{id}" DELETE requests, responding with the
+// job's final state. Jobs that already finished are left as they are.
+func killJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	jobs.lock.Lock()
+	j, ok := jobs.jobs[id]
+	jobs.lock.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("job not found: %s", id), http.StatusNotFound)
+		return
+	}
+
+	jobs.kill(j)
+
+	jobs.lock.Lock()
+	resp := j.apiJob()
+	jobs.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -1,26 +1,70 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
 	"github.com/gorilla/mux"
 	"github.com/mattn/go-shellwords"
+	"golang.org/x/net/websocket"
 )
 
 const (
 	// Define a base directory to prevent path traversal
 	baseDir = "/tmp/server_files"
+	// workspacesDir holds per-job working directories.
+	workspacesDir = baseDir + "/" + cmdserver.WorkspacesDir
 )
 
+var (
+	maxOutputBytes  = flag.Int("max-output-bytes", 4<<20, "output kept of a blocking /cmd command, the rest is dropped")
+	maxRequestBytes = flag.Int64("max-request-bytes", 1<<20, "largest /cmd request body accepted")
+)
+
+// workspacePath returns the directory of a validated workspace.
+func workspacePath(name string) (string, error) {
+	if err := cmdserver.ValidateWorkspaceName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(workspacesDir, name), nil
+}
+
+// dirSize returns the total size of the regular files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
 // runCommandHandler handles "/cmd" POST requests.
 func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -29,14 +73,17 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		Cmd      string `json:"cmd"`
-		Blocking bool   `json:"blocking,omitempty"`
-	}
+	var req cmdserver.RunCmdRequest
 	// Block by default if not specified in the payload.
 	req.Blocking = true
 
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, *maxRequestBytes)).Decode(&req)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		log.WithField("api", "run_cmd").Error("request body too large")
+		http.Error(w, fmt.Sprintf("request body must be at most %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		log.WithField("api", "run_cmd").Error("invalid json body")
 		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
@@ -71,15 +118,65 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 	cmdName := parts[0]
 	cmdArgs := parts[1:]
 
-	// Set up environment variables
-	env := os.Environ()
-	customPath := "/usr/local/bin:/usr/bin:/bin"
-	env = append(env, "PATH="+customPath)
+	if err := cmdserver.ValidateEnv(req.Env); err != nil {
+		log.WithField("api", "run_cmd").WithError(err).Error("invalid env")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.OutputEncoding != "" && !slices.Contains(cmdserver.OutputEncodings, req.OutputEncoding) {
+		log.WithField("api", "run_cmd").Error("invalid output encoding")
+		http.Error(w, fmt.Sprintf("outputEncoding must be one of %v, got %q", cmdserver.OutputEncodings, req.OutputEncoding), http.StatusBadRequest)
+		return
+	}
+	encoding := ""
+	if req.OutputEncoding == cmdserver.OutputEncodingBase64 {
+		encoding = cmdserver.OutputEncodingBase64
+	}
 
-	// Create the command
-	cmd := exec.Command("bash", "-c", req.Cmd)
-	cmd.Env = env
-	cmd.Dir = baseDir
+	workingDir := baseDir
+	if req.Workspace != "" {
+		workingDir, err = workspacePath(req.Workspace)
+		if err != nil {
+			log.WithField("api", "run_cmd").WithError(err).Error("invalid workspace")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := os.MkdirAll(workingDir, 0755); err != nil {
+			log.WithField("api", "run_cmd").WithError(err).Error("failed to create workspace")
+			http.Error(w, fmt.Sprintf("failed to create workspace: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	workingDir, err = cmdserver.ResolveCwd(workingDir, req.Cwd)
+	if err != nil {
+		log.WithField("api", "run_cmd").WithError(err).Error("invalid cwd")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	runAs, err := lookupCommandUser(req.User)
+	if err != nil {
+		log.WithField("api", "run_cmd").WithError(err).Error("invalid user")
+		http.Error(w, err.Error(), userErrorStatus(err))
+		return
+	}
+
+	// Create the command. Commands with a timeout are killed once it passes,
+	// in the background too. Streamed commands die with their request.
+	parent := context.Background()
+	if req.Stream {
+		parent = r.Context()
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if req.TimeoutMs > 0 {
+		ctx, cancel = context.WithTimeout(parent, time.Duration(req.TimeoutMs)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	cmd := exec.CommandContext(ctx, "bash", "-c", req.Cmd)
+	cmd.Dir = workingDir
+	killProcessGroup(cmd)
+	runAs.apply(cmd, req.Env)
 
 	// Log the command execution details
 	log.WithFields(log.Fields{
@@ -90,18 +187,41 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 	}).Info("Executing command")
 
 	// Handle command execution based on blocking mode
-	if req.Blocking {
-		// Execute the command and capture the combined output in blocking mode
-		output, err := cmd.CombinedOutput()
+	if req.Stream {
+		defer cancel()
+		streamCommand(ctx, w, r, cmd, req)
+	} else if req.Blocking {
+		// Execute the command and capture the combined output in blocking
+		// mode, up to maxOutputBytes of it.
+		combined := jobOutput{limit: *maxOutputBytes}
+		cmd.Stdout = &combined
+		cmd.Stderr = &combined
+		err := cmd.Run()
+		output, truncated := combined.encoded(encoding)
+		timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+		cancel()
 		if err != nil {
 			log.WithFields(log.Fields{
-				"api":  "run_cmd",
-				"cmd":  cmdName,
-				"args": cmdArgs,
-			}).Errorf("command execution failed output: %s err: %v", string(output), err)
+				"api":      "run_cmd",
+				"cmd":      cmdName,
+				"args":     cmdArgs,
+				"timedOut": timedOut,
+			}).Errorf("command execution failed output: %s err: %v", output, err)
+			exitCode := -1
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				exitCode = exitErr.ExitCode()
+			}
 			resp := cmdserver.RunCmdResponse{
-				Error:  err.Error(),
-				Output: string(output),
+				Error:           err.Error(),
+				Output:          output,
+				OutputTruncated: truncated,
+				Encoding:        encoding,
+				ExitCode:        &exitCode,
+				TimedOut:        timedOut,
+			}
+			if timedOut {
+				resp.Error = fmt.Sprintf("command timed out after %s", time.Duration(req.TimeoutMs)*time.Millisecond)
 			}
 			writeJSON(w, resp)
 			return
@@ -112,106 +232,283 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 			"api":        "run_cmd",
 			"cmd":        cmdName,
 			"args":       cmdArgs,
-			"output":     string(output),
+			"output":     output,
 			"workingDir": cmd.Dir,
 		}).Info("command executed successfully")
 
 		// Respond with the command output
+		exitCode := 0
 		resp := cmdserver.RunCmdResponse{
-			Output: string(output),
+			Output:          output,
+			OutputTruncated: truncated,
+			Encoding:        encoding,
+			ExitCode:        &exitCode,
 		}
 		writeJSON(w, resp)
 	} else {
-		// Non-blocking mode: start the command but don't wait for it to complete
-		stdoutPipe, err := cmd.StdoutPipe()
+		// Non-blocking mode: start the command as a job and respond right
+		// away. Its output and exit code are kept for /jobs/{id}.
+		j, err := startJob(ctx, cancel, cmd, req)
 		if err != nil {
+			cancel()
 			log.WithFields(log.Fields{
 				"api":  "run_cmd",
 				"cmd":  cmdName,
 				"args": cmdArgs,
-			}).Errorf("failed to create stdout pipe: %v", err)
+			}).Errorf("failed to start command: %v", err)
 			resp := cmdserver.RunCmdResponse{
-				Error: fmt.Sprintf("failed to create stdout pipe: %v", err),
+				Error: fmt.Sprintf("failed to start command: %v", err),
 			}
 			writeJSON(w, resp)
 			return
 		}
 
-		stderrPipe, err := cmd.StderrPipe()
+		// Respond immediately with a success message
+		resp := cmdserver.RunCmdResponse{
+			Output: fmt.Sprintf("Command '%s' started in background", cmd.String()),
+			JobID:  j.id,
+		}
+		writeJSON(w, resp)
+	}
+}
+
+// killProcessGroup runs cmd in its own process group and, once its context
+// is done, kills the whole group rather than only bash, so commands it
+// started don't keep running.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Background children that escaped the group may keep the output pipe
+	// open; don't wait on them.
+	cmd.WaitDelay = time.Second
+}
+
+// runCommandBatchHandler handles "/cmd-batch" POST requests. Commands run one
+// at a time in the same working directory; when the batch timeout expires the
+// running command is killed and the results so far are returned.
+func runCommandBatchHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "run_cmd_batch")
+
+	var req cmdserver.RunCmdBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("invalid json body")
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Cmds) == 0 {
+		logger.Error("empty batch")
+		http.Error(w, "Empty batch", http.StatusBadRequest)
+		return
+	}
+
+	workingDir := baseDir
+	if req.Workspace != "" {
+		var err error
+		workingDir, err = workspacePath(req.Workspace)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"api":  "run_cmd",
-				"cmd":  cmdName,
-				"args": cmdArgs,
-			}).Errorf("failed to create stderr pipe: %v", err)
-			resp := cmdserver.RunCmdResponse{
-				Error: fmt.Sprintf("failed to create stderr pipe: %v", err),
-			}
-			writeJSON(w, resp)
+			logger.WithError(err).Error("invalid workspace")
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		// Start the command
-		if err := cmd.Start(); err != nil {
-			log.WithFields(log.Fields{
-				"api":  "run_cmd",
-				"cmd":  cmdName,
-				"args": cmdArgs,
-			}).Errorf("failed to start command: %v", err)
-			resp := cmdserver.RunCmdResponse{
-				Error: fmt.Sprintf("failed to start command: %v", err),
-			}
-			writeJSON(w, resp)
+		if err := os.MkdirAll(workingDir, 0755); err != nil {
+			logger.WithError(err).Error("failed to create workspace")
+			http.Error(w, fmt.Sprintf("failed to create workspace: %v", err), http.StatusInternalServerError)
 			return
 		}
+	}
+
+	// Batches always run as the default user.
+	runAs, err := lookupCommandUser("")
+	if err != nil {
+		logger.WithError(err).Error("invalid default user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+	if req.TimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.TimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+	maxOutput := 0
+	if req.MaxOutputBytes > 0 {
+		maxOutput = max(req.MaxOutputBytes/len(req.Cmds), 1)
+	}
+
+	resp := cmdserver.RunCmdBatchResponse{Results: []cmdserver.RunCmdBatchResult{}}
+	for _, cmdStr := range req.Cmds {
+		if ctx.Err() != nil {
+			resp.TimedOut = true
+			break
+		}
+
+		cmd := exec.CommandContext(ctx, "bash", "-c", cmdStr)
+		cmd.Dir = workingDir
+		killProcessGroup(cmd)
+		runAs.apply(cmd, nil)
 
-		// Start goroutines to handle stdout and stderr in the background
-		go func() {
-			scanner := bufio.NewScanner(stdoutPipe)
-			for scanner.Scan() {
-				log.WithFields(log.Fields{
-					"api":    "run_cmd",
-					"cmd":    cmdName,
-					"stdout": scanner.Text(),
-				}).Debug("command stdout")
+		start := time.Now()
+		output, err := cmd.CombinedOutput()
+		result := cmdserver.RunCmdBatchResult{
+			Cmd:        cmdStr,
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if maxOutput > 0 && len(output) > maxOutput {
+			output = output[:maxOutput]
+			result.Truncated = true
+		}
+		result.Output = strings.ToValidUTF8(string(output), "")
+		if err != nil {
+			result.Error = err.Error()
+			result.ExitCode = -1
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				result.ExitCode = exitErr.ExitCode()
 			}
-		}()
-
-		go func() {
-			scanner := bufio.NewScanner(stderrPipe)
-			for scanner.Scan() {
-				log.WithFields(log.Fields{
-					"api":    "run_cmd",
-					"cmd":    cmdName,
-					"stderr": scanner.Text(),
-				}).Debug("command stderr")
+			if ctx.Err() != nil {
+				result.Error = "batch timed out"
+				resp.TimedOut = true
 			}
-		}()
+		}
+		resp.Results = append(resp.Results, result)
 
-		// Start a goroutine to wait for the command to complete
-		go func() {
-			err := cmd.Wait()
-			if err != nil {
-				log.WithFields(log.Fields{
-					"api":  "run_cmd",
-					"cmd":  cmdName,
-					"args": cmdArgs,
-				}).Errorf("command execution failed: %v", err)
-			} else {
-				log.WithFields(log.Fields{
-					"api":  "run_cmd",
-					"cmd":  cmdName,
-					"args": cmdArgs,
-				}).Info("command completed successfully")
-			}
-		}()
+		if resp.TimedOut || (err != nil && req.StopOnError) {
+			break
+		}
+	}
 
-		// Respond immediately with a success message
-		resp := cmdserver.RunCmdResponse{
-			Output: fmt.Sprintf("Command '%s' started in background", cmd.String()),
+	logger.WithFields(log.Fields{
+		"cmds":     len(req.Cmds),
+		"ran":      len(resp.Results),
+		"timedOut": resp.TimedOut,
+	}).Info("batch completed")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// listWorkspacesHandler handles "/workspaces" GET requests.
+func listWorkspacesHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(workspacesDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.WithField("api", "list_workspaces").WithError(err).Error("failed to read workspaces dir")
+		http.Error(w, fmt.Sprintf("failed to read workspaces: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	resp := cmdserver.ListWorkspacesResponse{Workspaces: []cmdserver.Workspace{}}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
 		}
-		writeJSON(w, resp)
+		size, err := dirSize(filepath.Join(workspacesDir, entry.Name()))
+		if err != nil {
+			log.WithField("api", "list_workspaces").WithError(err).Warnf("failed to compute size of workspace: %s", entry.Name())
+		}
+		resp.Workspaces = append(resp.Workspaces, cmdserver.Workspace{
+			Name:      entry.Name(),
+			SizeBytes: size,
+		})
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// deleteWorkspaceHandler handles "/workspaces/{id}" DELETE requests.
+func deleteWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
+	dir, err := workspacePath(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		http.Error(w, "workspace not found", http.StatusNotFound)
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.WithField("api", "delete_workspace").WithError(err).Error("failed to delete workspace")
+		http.Error(w, fmt.Sprintf("failed to delete workspace: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// filePath resolves a path relative to the files root, refusing paths that
+// lead outside it, including through symlinks.
+func filePath(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("path is required")
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(*filesRoot, filepath.Clean("/"+name)))
+	if err != nil {
+		return "", err
+	}
+	if !inFilesRoot(resolved) {
+		return "", fs.ErrNotExist
+	}
+	return resolved, nil
+}
+
+// fileETag identifies a version of a file by its size and mtime, so a
+// download can't be resumed across a change to the file.
+func fileETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// getFileHandler handles "/files" GET requests, serving the file at the
+// "path" query parameter. Range, If-Range and the other conditional headers
+// are honored against fileETag, so large downloads can be resumed. With
+// "archive=true" the path, typically a directory, is sent as a tar stream
+// instead.
+func getFileHandler(w http.ResponseWriter, r *http.Request) {
+	archive, _ := strconv.ParseBool(r.URL.Query().Get("archive"))
+	path, err := filePath(r.URL.Query().Get("path"))
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.WithField("api", "get_file").WithError(err).Error("failed to open file")
+		http.Error(w, fmt.Sprintf("failed to open file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to stat file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if archive {
+		writeArchive(w, path)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "path is a directory; set archive=true to download it as a tar stream", http.StatusBadRequest)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.Error(w, "not a regular file", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", fileETag(info))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
 }
 
 // indexHandler handles "/" GET requests.
@@ -235,32 +532,82 @@ func writeJSON(w http.ResponseWriter, resp cmdserver.RunCmdResponse) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+const (
+	// agentProtocolVersion is the version of the host<->agent protocol this
+	// agent speaks. Bump it on incompatible changes.
+	agentProtocolVersion = 1
+	// minHostProtocolVersion is the oldest host protocol this agent works with.
+	minHostProtocolVersion = 1
+)
+
+// version is the agent build version, set with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// versionHandler reports the agent's version, protocol range and features.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	response := map[string]any{
+		"agent":           "cmdserver",
+		"version":         version,
+		"protocol":        agentProtocolVersion,
+		"minHostProtocol": minHostProtocolVersion,
+		"features":        []string{"exec", "exec-batch", "exec-timeout", "exec-jobs", "exec-stream", "exec-env", "exec-user", "exec-base64", "shell", "workspaces", "files", "file-upload", "file-archive", "metadata"},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 func main() {
+	flag.Parse()
+
 	// Ensure base directory exists.
 	err := os.MkdirAll(baseDir, os.ModePerm)
 	if err != nil {
 		log.Fatalf("Failed to create base directory: %v", err)
 	}
+	if err := initFilesRoot(); err != nil {
+		log.Fatalf("Failed to set up files root: %v", err)
+	}
+	go initMetadata()
 
 	// Initialize Gorilla Mux router.
 	router := mux.NewRouter()
 
 	// Register routes with their respective handlers.
 	router.HandleFunc("/", indexHandler).Methods(http.MethodGet)
+	router.HandleFunc("/version", versionHandler).Methods(http.MethodGet)
 	router.HandleFunc("/cmd", runCommandHandler).Methods(http.MethodPost)
+	router.HandleFunc("/cmd-batch", runCommandBatchHandler).Methods(http.MethodPost)
+	router.HandleFunc("/workspaces", listWorkspacesHandler).Methods(http.MethodGet)
+	router.HandleFunc("/workspaces/{id}", deleteWorkspaceHandler).Methods(http.MethodDelete)
+	router.HandleFunc("/files", getFileHandler).Methods(http.MethodGet)
+	router.HandleFunc("/files", putFileHandler).Methods(http.MethodPut)
+	router.HandleFunc("/jobs", listJobsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/jobs/{id}", getJobHandler).Methods(http.MethodGet)
+	router.HandleFunc("/jobs/{id}", killJobHandler).Methods(http.MethodDelete)
+	router.HandleFunc("/metadata", metadataHandler).Methods(http.MethodGet)
+	router.HandleFunc("/metadata/user-script", userScriptHandler).Methods(http.MethodGet)
+	router.Handle("/shell", websocket.Server{Handler: shellHandler}).Methods(http.MethodGet)
 
 	// Optionally, add logging middleware.
 	router.Use(loggingMiddleware)
 
 	port := "4031"
-	log.Printf("cbox-cmdserver is running on port %s...", port)
+	log.Printf("cbox-cmdserver %s is running on port %s...", version, port)
 	log.Fatal(http.ListenAndServe(":"+port, router))
 }
 
-// Optional: Middleware for logging requests.
+// Optional: Middleware for logging requests. The host's request ID, if
+// forwarded, is logged and echoed so commands can be traced back to it.
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[%s] %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+		entry := log.NewEntry(log.StandardLogger())
+		if id := r.Header.Get(requestid.Header); requestid.Valid(id) {
+			entry = entry.WithField(requestid.Field, id)
+			w.Header().Set(requestid.Header, id)
+		}
+		entry.Printf("[%s] %s %s", r.RemoteAddr, r.Method, r.URL.Path)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+// runCmd sends req to runCommandHandler and decodes its response.
+func runCmd(t *testing.T, req cmdserver.RunCmdRequest) cmdserver.RunCmdResponse {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	rec := httptest.NewRecorder()
+	runCommandHandler(rec, httptest.NewRequest(http.MethodPost, "/cmd", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /cmd = %d %s", rec.Code, rec.Body.String())
+	}
+	var resp cmdserver.RunCmdResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return resp
+}
+
+func TestRunCmdBase64Output(t *testing.T) {
+	dir := t.TempDir()
+	// NULs, invalid UTF-8 and every other byte value.
+	data := []byte("head\x00\xff\xfe\xc3\x28tail\x00")
+	for b := 0; b < 256; b++ {
+		data = append(data, byte(b))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := runCmd(t, cmdserver.RunCmdRequest{Cmd: "cat data.bin", Cwd: dir, Blocking: true, OutputEncoding: cmdserver.OutputEncodingBase64})
+	if resp.Encoding != cmdserver.OutputEncodingBase64 {
+		t.Fatalf("encoding = %q, want base64", resp.Encoding)
+	}
+	got, err := base64.StdEncoding.DecodeString(resp.Output)
+	if err != nil {
+		t.Fatalf("decoding output: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("output = %q, want %q", got, data)
+	}
+
+	// Text output stays valid JSON, at the cost of the invalid bytes.
+	resp = runCmd(t, cmdserver.RunCmdRequest{Cmd: "cat data.bin", Cwd: dir, Blocking: true})
+	if resp.Encoding != "" || !utf8.ValidString(resp.Output) {
+		t.Errorf("text output = %q with encoding %q, want valid UTF-8 without an encoding", resp.Output, resp.Encoding)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+const (
+	// metadataMountDir is where the metadata disk is mounted read-only.
+	metadataMountDir = "/run/cbox-metadata"
+	// userScriptDir keeps the user script and its outcome on the writable
+	// root, so it survives reboots and the script only runs once.
+	userScriptDir        = "/var/lib/cbox"
+	userScriptPath       = userScriptDir + "/user-script"
+	userScriptStatusPath = userScriptDir + "/user-script.json"
+	userScriptLogPath    = "/var/log/cbox-user-script.log"
+)
+
+var (
+	metadataLock sync.Mutex
+	// metadata is the VM's metadata, nil if it has none.
+	metadata map[string]any
+	// metadataLoaded is closed once metadata has been looked for.
+	metadataLoaded = make(chan struct{})
+)
+
+// findMetadataDisk returns the block device whose virtio serial marks it as
+// the metadata disk, or "" if the VM has none.
+func findMetadataDisk() string {
+	serials, _ := filepath.Glob("/sys/block/*/serial")
+	for _, serialPath := range serials {
+		serial, err := os.ReadFile(serialPath)
+		if err != nil || strings.TrimSpace(string(serial)) != cmdserver.MetadataDiskSerial {
+			continue
+		}
+		return "/dev/" + filepath.Base(filepath.Dir(serialPath))
+	}
+	return ""
+}
+
+// loadMetadata mounts the metadata disk, unless a previous run of cmdserver
+// did, and reads the metadata from it.
+func loadMetadata() (map[string]any, error) {
+	metadataPath := filepath.Join(metadataMountDir, cmdserver.MetadataFilename)
+	if _, err := os.Stat(metadataPath); err != nil {
+		device := findMetadataDisk()
+		if device == "" {
+			return nil, nil
+		}
+		if err := os.MkdirAll(metadataMountDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create metadata mount dir: %w", err)
+		}
+		if err := syscall.Mount(device, metadataMountDir, "ext4", syscall.MS_RDONLY, ""); err != nil {
+			return nil, fmt.Errorf("failed to mount metadata disk %s: %w", device, err)
+		}
+	}
+
+	data, err := os.ReadFile(metadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	var loaded map[string]any
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	return loaded, nil
+}
+
+// initMetadata loads the VM's metadata and runs its user script if this is
+// the first boot. It runs in the background so a long script doesn't hold up
+// cmdserver.
+func initMetadata() {
+	loaded, err := loadMetadata()
+	if err != nil {
+		log.WithError(err).Error("failed to load metadata")
+	}
+	metadataLock.Lock()
+	metadata = loaded
+	metadataLock.Unlock()
+	close(metadataLoaded)
+
+	script, ok := loaded[cmdserver.MetadataUserScriptKey].(string)
+	if !ok || script == "" {
+		return
+	}
+	if _, err := os.Stat(userScriptStatusPath); err == nil {
+		log.Info("user script already ran on a previous boot")
+		return
+	}
+	if err := runUserScript(script); err != nil {
+		log.WithError(err).Error("failed to run user script")
+	}
+}
+
+// runUserScript runs script once, with its combined output in
+// userScriptLogPath. Scripts without a shebang are run by /bin/sh.
+func runUserScript(script string) error {
+	if err := os.MkdirAll(userScriptDir, 0755); err != nil {
+		return fmt.Errorf("failed to create user script dir: %w", err)
+	}
+	if err := os.WriteFile(userScriptPath, []byte(script), 0700); err != nil {
+		return fmt.Errorf("failed to write user script: %w", err)
+	}
+	logFile, err := os.Create(userScriptLogPath)
+	if err != nil {
+		return fmt.Errorf("failed to create user script log: %w", err)
+	}
+	defer logFile.Close()
+
+	// Recorded before it starts so a script interrupted by a reboot isn't
+	// run a second time.
+	status := cmdserver.UserScriptStatus{
+		State:     cmdserver.UserScriptRunning,
+		StartedAt: time.Now().UTC(),
+	}
+	if err := saveUserScriptStatus(status); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(userScriptPath)
+	if !strings.HasPrefix(script, "#!") {
+		cmd = exec.Command("/bin/sh", userScriptPath)
+	}
+	cmd.Dir = baseDir
+	cmd.Env = append(os.Environ(), "PATH=/usr/local/bin:/usr/bin:/bin")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	log.Info("running user script")
+	err = cmd.Run()
+
+	endedAt := time.Now().UTC()
+	status.State = cmdserver.UserScriptFinished
+	status.EndedAt = &endedAt
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		exitCode := 0
+		status.ExitCode = &exitCode
+	case errors.As(err, &exitErr):
+		exitCode := exitErr.ExitCode()
+		status.ExitCode = &exitCode
+	default:
+		status.Error = err.Error()
+	}
+	log.WithField("exitCode", status.ExitCode).Info("user script finished")
+	return saveUserScriptStatus(status)
+}
+
+func saveUserScriptStatus(status cmdserver.UserScriptStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	tmpPath := userScriptStatusPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write user script status: %w", err)
+	}
+	return os.Rename(tmpPath, userScriptStatusPath)
+}
+
+// metadataHandler handles "/metadata" GET requests with the VM's metadata.
+func metadataHandler(w http.ResponseWriter, r *http.Request) {
+	<-metadataLoaded
+	metadataLock.Lock()
+	loaded := metadata
+	metadataLock.Unlock()
+	if loaded == nil {
+		http.Error(w, "vm has no metadata", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loaded)
+}
+
+// userScriptHandler handles "/metadata/user-script" GET requests with the
+// user script's status and output.
+func userScriptHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := os.ReadFile(userScriptStatusPath)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "user script hasn't run", http.StatusNotFound)
+		return
+	}
+	var status cmdserver.UserScriptStatus
+	if err == nil {
+		err = json.Unmarshal(data, &status)
+	}
+	if err != nil {
+		log.WithField("api", "user_script").WithError(err).Error("failed to read user script status")
+		http.Error(w, fmt.Sprintf("failed to read user script status: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if logFile, err := os.Open(userScriptLogPath); err == nil {
+		var output jobOutput
+		io.Copy(&output, logFile)
+		logFile.Close()
+		status.Output, status.Truncated = output.snapshot()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+	"golang.org/x/sys/unix"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+// openPTY returns the master and slave ends of a new pseudo-terminal.
+func openPTY() (*os.File, *os.File, error) {
+	ptmx, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open /dev/ptmx: %w", err)
+	}
+	conn, err := ptmx.SyscallConn()
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+	var ptyNum int
+	var ioctlErr error
+	err = conn.Control(func(fd uintptr) {
+		if ioctlErr = unix.IoctlSetPointerInt(int(fd), unix.TIOCSPTLCK, 0); ioctlErr != nil {
+			return
+		}
+		ptyNum, ioctlErr = unix.IoctlGetInt(int(fd), unix.TIOCGPTN)
+	})
+	if err == nil {
+		err = ioctlErr
+	}
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+	tty, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", ptyNum), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, fmt.Errorf("failed to open pty: %w", err)
+	}
+	return ptmx, tty, nil
+}
+
+// resizePTY sets the terminal size of ptmx.
+func resizePTY(ptmx *os.File, cols uint16, rows uint16) error {
+	conn, err := ptmx.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ioctlErr error
+	err = conn.Control(func(fd uintptr) {
+		ioctlErr = unix.IoctlSetWinsize(int(fd), unix.TIOCSWINSZ, &unix.Winsize{Row: rows, Col: cols})
+	})
+	if err != nil {
+		return err
+	}
+	return ioctlErr
+}
+
+// killSession kills every process in the session sid. Killing the process
+// group of the session's leader isn't enough: with job control, a shell puts
+// each job in a process group of its own. Processes forked while the session
+// is being killed are caught by the next pass.
+func killSession(sid int) {
+	for range 3 {
+		entries, err := os.ReadDir("/proc")
+		if err != nil {
+			return
+		}
+		killed := false
+		for _, entry := range entries {
+			pid, err := strconv.Atoi(entry.Name())
+			if err != nil {
+				continue
+			}
+			if processSID, err := unix.Getsid(pid); err == nil && processSID == sid {
+				syscall.Kill(pid, syscall.SIGKILL)
+				killed = true
+			}
+		}
+		if !killed {
+			return
+		}
+	}
+}
+
+// shellHandler handles "/shell" WebSocket sessions, running bash under a
+// pty as the default user. The shell and everything it started are killed
+// once the client disconnects, and the connection is closed once the shell
+// exits.
+func shellHandler(ws *websocket.Conn) {
+	logger := log.WithField("api", "shell")
+	defer ws.Close()
+
+	runAs, err := lookupCommandUser("")
+	if err != nil {
+		logger.WithError(err).Error("invalid default user")
+		return
+	}
+	ptmx, tty, err := openPTY()
+	if err != nil {
+		logger.WithError(err).Error("failed to open pty")
+		return
+	}
+	defer ptmx.Close()
+
+	cmd := exec.Command("/bin/bash", "-l")
+	cmd.Dir = baseDir
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	runAs.apply(cmd, map[string]string{"TERM": "xterm-256color"})
+	err = cmd.Start()
+	tty.Close()
+	if err != nil {
+		logger.WithError(err).Error("failed to start shell")
+		return
+	}
+	logger.WithField("pid", cmd.Process.Pid).Info("shell session started")
+	defer func() {
+		// The shell leads its own session, so this gets what it started too.
+		killSession(cmd.Process.Pid)
+		cmd.Wait()
+		logger.WithField("pid", cmd.Process.Pid).Info("shell session ended")
+	}()
+
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := ptmx.Read(buf)
+			if n > 0 {
+				frame := cmdserver.ShellFrame{PayloadType: websocket.BinaryFrame, Data: buf[:n]}
+				if cmdserver.ShellFrameCodec.Send(ws, frame) != nil {
+					return
+				}
+			}
+			if err != nil {
+				// The shell exited; unblock the receive loop.
+				ws.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		var frame cmdserver.ShellFrame
+		if err := cmdserver.ShellFrameCodec.Receive(ws, &frame); err != nil {
+			return
+		}
+		if frame.PayloadType == websocket.BinaryFrame {
+			if _, err := ptmx.Write(frame.Data); err != nil {
+				return
+			}
+			continue
+		}
+		var control cmdserver.ShellControl
+		if err := json.Unmarshal(frame.Data, &control); err != nil {
+			logger.WithError(err).Warn("invalid shell control message")
+			continue
+		}
+		if control.Type == cmdserver.ShellResize {
+			if err := resizePTY(ptmx, control.Cols, control.Rows); err != nil {
+				logger.WithError(err).Warn("failed to resize pty")
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+// dialShell opens a /shell session served by shellHandler.
+func dialShell(t *testing.T) *websocket.Conn {
+	t.Helper()
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(websocket.Server{Handler: shellHandler})
+	t.Cleanup(srv.Close)
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/shell", "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("dialing shell: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// sendShell sends frame on a shell session.
+func sendShell(t *testing.T, ws *websocket.Conn, payloadType byte, data string) {
+	t.Helper()
+	if err := cmdserver.ShellFrameCodec.Send(ws, cmdserver.ShellFrame{PayloadType: payloadType, Data: []byte(data)}); err != nil {
+		t.Fatalf("sending %q: %v", data, err)
+	}
+}
+
+// readShellUntil reads the terminal's output until it matches re, and
+// returns the match's first group.
+func readShellUntil(t *testing.T, ws *websocket.Conn, re *regexp.Regexp) string {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var output bytes.Buffer
+	for {
+		if match := re.FindSubmatch(output.Bytes()); match != nil {
+			return string(match[1])
+		}
+		var frame cmdserver.ShellFrame
+		if err := cmdserver.ShellFrameCodec.Receive(ws, &frame); err != nil {
+			t.Fatalf("reading shell output %q: %v", output.String(), err)
+		}
+		output.Write(frame.Data)
+	}
+}
+
+func TestShellResize(t *testing.T) {
+	ws := dialShell(t)
+	sendShell(t, ws, websocket.TextFrame, `{"type":"resize","cols":132,"rows":43}`)
+	// The expansion keeps the echoed command line from matching.
+	sendShell(t, ws, websocket.BinaryFrame, "echo size=$(stty size)=\r")
+	if got := readShellUntil(t, ws, regexp.MustCompile(`size=(\d+ \d+)=`)); got != "43 132" {
+		t.Errorf("stty size = %q, want 43 132", got)
+	}
+}
+
+func TestShellKilledOnDisconnect(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cmd  string
+	}{
+		{"foreground", "sh -c 'echo pid=$$=; exec sleep 600'\r"},
+		{"background", "sleep 600 & echo pid=$!=\r"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ws := dialShell(t)
+			sendShell(t, ws, websocket.BinaryFrame, tc.cmd)
+			pid, err := strconv.Atoi(readShellUntil(t, ws, regexp.MustCompile(`pid=(\d+)=`)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Nothing the shell started outlives the session.
+			ws.Close()
+			waitForExit(t, pid)
+		})
+	}
+}
+
+func TestShellClosedOnExit(t *testing.T) {
+	ws := dialShell(t)
+	sendShell(t, ws, websocket.BinaryFrame, "exit\r")
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		var frame cmdserver.ShellFrame
+		err := cmdserver.ShellFrameCodec.Receive(ws, &frame)
+		if err == nil {
+			continue
+		}
+		if strings.Contains(err.Error(), "timeout") {
+			t.Fatal("session still open after the shell exited")
+		}
+		return
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+// maxStreamLineBytes caps the data in one stream record. Longer lines are
+// split across records.
+const maxStreamLineBytes = 64 << 10
+
+// streamEncoder writes stream records to a client, flushing each one. Once a
+// write fails the rest are dropped; the command is killed through the
+// request's context.
+type streamEncoder struct {
+	lock    sync.Mutex
+	enc     *json.Encoder
+	flusher http.Flusher
+	err     error
+}
+
+func (e *streamEncoder) send(rec cmdserver.StreamRecord) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.err != nil {
+		return
+	}
+	if e.err = e.enc.Encode(rec); e.err != nil {
+		return
+	}
+	e.flusher.Flush()
+}
+
+// streamWriter sends what a command writes to one of its outputs as stream
+// records, a line at a time.
+type streamWriter struct {
+	out    *streamEncoder
+	stream string
+	buf    []byte
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.buf = append(sw.buf, p...)
+	for {
+		n := bytes.IndexByte(sw.buf, '\n') + 1
+		if n == 0 && len(sw.buf) < maxStreamLineBytes {
+			break
+		}
+		if n == 0 || n > maxStreamLineBytes {
+			n = maxStreamLineBytes
+		}
+		sw.send(sw.buf[:n])
+		sw.buf = sw.buf[n:]
+	}
+	return len(p), nil
+}
+
+// flush sends a trailing line without a newline.
+func (sw *streamWriter) flush() {
+	if len(sw.buf) > 0 {
+		sw.send(sw.buf)
+		sw.buf = nil
+	}
+}
+
+func (sw *streamWriter) send(data []byte) {
+	sw.out.send(cmdserver.StreamRecord{
+		Stream: sw.stream,
+		Data:   strings.ToValidUTF8(string(data), ""),
+	})
+}
+
+// streamCommand runs cmd, streaming its output to w as it's written and
+// finishing with a record holding its outcome. ctx must be done once the
+// client disconnects, so the command doesn't outlive the stream.
+func streamCommand(ctx context.Context, w http.ResponseWriter, r *http.Request, cmd *exec.Cmd, req cmdserver.RunCmdRequest) {
+	logger := log.WithFields(log.Fields{"api": "run_cmd", "stream": true})
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logger.Error("streaming is not supported")
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	out := &streamEncoder{enc: json.NewEncoder(w), flusher: flusher}
+	stdout := &streamWriter{out: out, stream: cmdserver.StreamStdout}
+	stderr := &streamWriter{out: out, stream: cmdserver.StreamStderr}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err := cmd.Run()
+	timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	stdout.flush()
+	stderr.flush()
+
+	if r.Context().Err() != nil {
+		logger.WithField("cmd", req.Cmd).Warn("client disconnected, killed command")
+		return
+	}
+
+	exitCode := 0
+	done := cmdserver.StreamRecord{Done: true, ExitCode: &exitCode, TimedOut: timedOut}
+	if err != nil {
+		exitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		done.Error = err.Error()
+		if timedOut {
+			done.Error = fmt.Sprintf("command timed out after %s", time.Duration(req.TimeoutMs)*time.Millisecond)
+		}
+	}
+	logger.WithFields(log.Fields{
+		"cmd":      req.Cmd,
+		"exitCode": exitCode,
+		"timedOut": timedOut,
+	}).Info("streamed command finished")
+	out.send(done)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+// streamCmd posts a streamed req to runCommandHandler, served over HTTP so
+// the client can go away, and returns the response's records as they come.
+func streamCmd(t *testing.T, ctx context.Context, req cmdserver.RunCmdRequest) <-chan cmdserver.StreamRecord {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(runCommandHandler))
+	t.Cleanup(srv.Close)
+	req.Stream = true
+	body, _ := json.Marshal(req)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/cmd", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatalf("POST /cmd: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("POST /cmd = %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	records := make(chan cmdserver.StreamRecord)
+	go func() {
+		defer close(records)
+		defer resp.Body.Close()
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var rec cmdserver.StreamRecord
+			if err := dec.Decode(&rec); err != nil {
+				return
+			}
+			records <- rec
+		}
+	}()
+	return records
+}
+
+// streamOutput collects a streamed command's output by stream, until its
+// final record.
+func streamOutput(t *testing.T, records <-chan cmdserver.StreamRecord) (map[string][]string, cmdserver.StreamRecord) {
+	t.Helper()
+	output := make(map[string][]string)
+	for rec := range records {
+		if rec.Done {
+			if _, ok := <-records; ok {
+				t.Error("records after the final one")
+			}
+			return output, rec
+		}
+		output[rec.Stream] = append(output[rec.Stream], rec.Data)
+	}
+	t.Fatal("stream ended without a final record")
+	return nil, cmdserver.StreamRecord{}
+}
+
+// waitForExit waits for the process pid to be gone, or a zombie whose
+// parent hasn't reaped it.
+func waitForExit(t *testing.T, pid int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		// The state follows the parenthesized command name.
+		if err != nil || strings.HasPrefix(strings.TrimSpace(string(stat[bytes.LastIndexByte(stat, ')')+1:])), "Z") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("process %d still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamCmd(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		req      cmdserver.RunCmdRequest
+		stdout   []string
+		stderr   []string
+		exitCode int
+		errMsg   string
+		timedOut bool
+	}{
+		{
+			name:   "lines",
+			req:    cmdserver.RunCmdRequest{Cmd: "echo one; echo two; echo err >&2; printf partial"},
+			stdout: []string{"one\n", "two\n", "partial"},
+			stderr: []string{"err\n"},
+		},
+		{
+			name:     "exit code",
+			req:      cmdserver.RunCmdRequest{Cmd: "echo failing; exit 3"},
+			stdout:   []string{"failing\n"},
+			exitCode: 3,
+			errMsg:   "exit status 3",
+		},
+		{
+			name:     "timeout",
+			req:      cmdserver.RunCmdRequest{Cmd: "echo started; sleep 30", TimeoutMs: 100},
+			stdout:   []string{"started\n"},
+			exitCode: -1,
+			errMsg:   "command timed out after 100ms",
+			timedOut: true,
+		},
+		{
+			// Lines past maxStreamLineBytes are split across records.
+			name:   "long line",
+			req:    cmdserver.RunCmdRequest{Cmd: fmt.Sprintf("head -c %d /dev/zero | tr '\\0' a; echo", maxStreamLineBytes+10)},
+			stdout: []string{strings.Repeat("a", maxStreamLineBytes), strings.Repeat("a", 10) + "\n"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			output, done := streamOutput(t, streamCmd(t, context.Background(), tc.req))
+			if got, want := strings.Join(output[cmdserver.StreamStdout], "|"), strings.Join(tc.stdout, "|"); got != want {
+				t.Errorf("stdout records = %q, want %q", output[cmdserver.StreamStdout], tc.stdout)
+			}
+			if got, want := strings.Join(output[cmdserver.StreamStderr], "|"), strings.Join(tc.stderr, "|"); got != want {
+				t.Errorf("stderr records = %q, want %q", output[cmdserver.StreamStderr], tc.stderr)
+			}
+			// The final record carries the exit code.
+			if done.ExitCode == nil || *done.ExitCode != tc.exitCode || done.Error != tc.errMsg || done.TimedOut != tc.timedOut {
+				t.Errorf("final record = %+v, want exit code %d, error %q, timed out %t", done, tc.exitCode, tc.errMsg, tc.timedOut)
+			}
+		})
+	}
+}
+
+func TestStreamCmdKilledOnDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	records := streamCmd(t, ctx, cmdserver.RunCmdRequest{Cmd: "sleep 600 & echo pid=$!; wait"})
+	rec := <-records
+	match := regexp.MustCompile(`^pid=(\d+)\n$`).FindStringSubmatch(rec.Data)
+	if match == nil {
+		t.Fatalf("first record = %+v, want the sleep's PID", rec)
+	}
+	pid, _ := strconv.Atoi(match[1])
+
+	// The command doesn't outlive the client.
+	cancel()
+	waitForExit(t, pid)
+	for rec := range records {
+		if rec.Done {
+			t.Errorf("final record %+v sent to a client that went away", rec)
+		}
+	}
+}
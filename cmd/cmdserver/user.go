@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+var (
+	defaultUser = flag.String("default-user", "", "user commands run as unless their request names one, empty for cmdserver's own")
+	pinUser     = flag.Bool("pin-user", false, "reject commands naming a user other than -default-user")
+)
+
+// errUserPinned is returned for commands naming a user other than the one
+// -pin-user pins them to.
+var errUserPinned = errors.New("commands can only run as the default user")
+
+// commandUser is a user commands are run as.
+type commandUser struct {
+	credential *syscall.Credential
+	// env is HOME, USER and LOGNAME for the user.
+	env map[string]string
+}
+
+// lookupCommandUser returns the user a command naming name runs as, or nil
+// to run it as cmdserver's own user.
+func lookupCommandUser(name string) (*commandUser, error) {
+	if name == "" {
+		name = *defaultUser
+	} else if *pinUser && name != *defaultUser {
+		return nil, errUserPinned
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		var unknown user.UnknownUserError
+		if errors.As(err, &unknown) {
+			return nil, fmt.Errorf("unknown user %q", name)
+		}
+		return nil, fmt.Errorf("failed to look up user %q: %w", name, err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid of user %q: %s", name, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid of user %q: %s", name, u.Gid)
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up groups of user %q: %w", name, err)
+	}
+	groups := make([]uint32, 0, len(groupIDs))
+	for _, groupID := range groupIDs {
+		group, err := strconv.ParseUint(groupID, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group of user %q: %s", name, groupID)
+		}
+		groups = append(groups, uint32(group))
+	}
+
+	return &commandUser{
+		credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups},
+		env: map[string]string{
+			"HOME":    u.HomeDir,
+			"USER":    u.Username,
+			"LOGNAME": u.Username,
+		},
+	}, nil
+}
+
+// userErrorStatus returns the HTTP status for an error from
+// lookupCommandUser.
+func userErrorStatus(err error) int {
+	if errors.Is(err, errUserPinned) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// apply makes cmd, already set up by killProcessGroup, run as u with env
+// added to its environment. env wins over u's HOME, USER and LOGNAME. A nil
+// u only sets the environment.
+func (u *commandUser) apply(cmd *exec.Cmd, env map[string]string) {
+	if u == nil {
+		cmd.Env = cmdserver.CommandEnv(env)
+		return
+	}
+	userEnv := maps.Clone(u.env)
+	maps.Copy(userEnv, env)
+	cmd.Env = cmdserver.CommandEnv(userEnv)
+	cmd.SysProcAttr.Credential = u.credential
+}
@@ -0,0 +1,277 @@
+// Command cbox-fakechv is a stand-in for cloud-hypervisor that serves the
+// subset of its REST API used by cbox-restserver on --api-socket, without
+// running a guest. Point chv_bin at it to exercise the restserver's VM
+// lifecycle on hosts without KVM.
+//
+// Behavior is configured through environment variables, which the restserver
+// passes through when it spawns the VMM:
+//
+//	CBOX_FAKECHV_BOOT_DELAY  delay vm.boot by this duration, e.g. "5s"
+//	CBOX_FAKECHV_FAIL        comma-separated endpoints that return 500, e.g. "vm.create,vm.boot"
+//	CBOX_FAKECHV_EXIT_AFTER  exit with status 1 this long after startup, simulating a crash
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const apiPrefix = "/api/v1/"
+
+// VM states as reported by cloud-hypervisor in vm.info.
+const (
+	stateCreated  = "Created"
+	stateRunning  = "Running"
+	stateShutdown = "Shutdown"
+	statePaused   = "Paused"
+)
+
+type fakeVMM struct {
+	lock      sync.Mutex
+	config    json.RawMessage
+	state     string
+	bootDelay time.Duration
+	failing   map[string]bool
+	// disks holds the IDs of hot-plugged disks, numbered from diskSeq.
+	disks   map[string]bool
+	diskSeq int
+}
+
+func newFakeVMM() *fakeVMM {
+	f := &fakeVMM{failing: make(map[string]bool), disks: make(map[string]bool)}
+	if delay := os.Getenv("CBOX_FAKECHV_BOOT_DELAY"); delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			log.Fatalf("invalid CBOX_FAKECHV_BOOT_DELAY: %v", err)
+		}
+		f.bootDelay = d
+	}
+	for _, endpoint := range strings.Split(os.Getenv("CBOX_FAKECHV_FAIL"), ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			f.failing[endpoint] = true
+		}
+	}
+	return f
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// transition moves the VM to state if it's currently in one of from.
+func (f *fakeVMM) transition(w http.ResponseWriter, state string, from ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, s := range from {
+		if f.state == s {
+			f.state = state
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, "invalid state transition from "+f.state+" to "+state, http.StatusInternalServerError)
+}
+
+func (f *fakeVMM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	endpoint := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	log.WithFields(log.Fields{"method": r.Method, "endpoint": endpoint}).Info("request")
+
+	if f.failing[endpoint] {
+		http.Error(w, "injected failure for "+endpoint, http.StatusInternalServerError)
+		return
+	}
+
+	switch endpoint {
+	case "vmm.ping":
+		writeJSON(w, map[string]any{
+			"build_version": "fake",
+			"version":       "fake",
+			"pid":           os.Getpid(),
+		})
+	case "vmm.shutdown":
+		w.WriteHeader(http.StatusNoContent)
+		go func() {
+			// Give the response time to flush before exiting.
+			time.Sleep(10 * time.Millisecond)
+			os.Exit(0)
+		}()
+	case "vm.create":
+		config, err := io.ReadAll(r.Body)
+		if err != nil || !json.Valid(config) {
+			http.Error(w, "invalid VmConfig", http.StatusBadRequest)
+			return
+		}
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.state != "" {
+			http.Error(w, "VM already created", http.StatusInternalServerError)
+			return
+		}
+		f.config = config
+		f.state = stateCreated
+		w.WriteHeader(http.StatusNoContent)
+	case "vm.boot":
+		time.Sleep(f.bootDelay)
+		f.transition(w, stateRunning, stateCreated, stateShutdown)
+	case "vm.shutdown":
+		f.transition(w, stateShutdown, stateRunning, statePaused)
+	case "vm.reboot":
+		f.transition(w, stateRunning, stateRunning)
+	case "vm.pause":
+		f.transition(w, statePaused, stateRunning)
+	case "vm.resume":
+		f.transition(w, stateRunning, statePaused)
+	case "vm.delete":
+		f.lock.Lock()
+		f.config = nil
+		f.state = ""
+		f.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case "vm.info":
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.state == "" {
+			http.Error(w, "VM not created", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]any{
+			"config": f.config,
+			"state":  f.state,
+		})
+	case "vm.counters":
+		writeJSON(w, map[string]any{})
+	case "vm.add-disk":
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		id := fmt.Sprintf("_disk%d", f.diskSeq)
+		f.diskSeq++
+		f.disks[id] = true
+		writeJSON(w, map[string]any{
+			"id":  id,
+			"bdf": fmt.Sprintf("0000:00:%02x.0", 0x10+f.diskSeq),
+		})
+	case "vm.remove-device":
+		var req struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if !f.disks[req.ID] {
+			http.Error(w, "unknown device "+req.ID, http.StatusInternalServerError)
+			return
+		}
+		delete(f.disks, req.ID)
+		w.WriteHeader(http.StatusNoContent)
+	case "vm.snapshot":
+		f.snapshot(w, r)
+	case "vm.restore":
+		f.restore(w, r)
+	default:
+		http.Error(w, "not implemented by fakechv: "+endpoint, http.StatusNotImplemented)
+	}
+}
+
+// snapshot writes the VM config and empty stand-ins for the device state
+// and memory to the destination dir, as cloud-hypervisor would.
+func (f *fakeVMM) snapshot(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DestinationURL string `json:"destination_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !strings.HasPrefix(req.DestinationURL, "file://") {
+		http.Error(w, "invalid VmSnapshotConfig", http.StatusBadRequest)
+		return
+	}
+	dir := strings.TrimPrefix(req.DestinationURL, "file://")
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.state != statePaused {
+		http.Error(w, "VM is not paused", http.StatusInternalServerError)
+		return
+	}
+	files := map[string][]byte{
+		"config.json":   f.config,
+		"state.json":    []byte("{}"),
+		"memory-ranges": nil,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restore loads the VM config from a snapshot dir, leaving the VM paused.
+func (f *fakeVMM) restore(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SourceURL string `json:"source_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !strings.HasPrefix(req.SourceURL, "file://") {
+		http.Error(w, "invalid RestoreConfig", http.StatusBadRequest)
+		return
+	}
+	dir := strings.TrimPrefix(req.SourceURL, "file://")
+	config, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil || !json.Valid(config) {
+		http.Error(w, "invalid snapshot config", http.StatusInternalServerError)
+		return
+	}
+	for _, name := range []string{"state.json", "memory-ranges"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.state != "" {
+		http.Error(w, "VM already created", http.StatusInternalServerError)
+		return
+	}
+	f.config = config
+	f.state = statePaused
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func main() {
+	apiSocket := flag.String("api-socket", "", "Path of the API unix socket")
+	flag.Parse()
+	if *apiSocket == "" {
+		log.Fatal("--api-socket is required")
+	}
+
+	if exitAfter := os.Getenv("CBOX_FAKECHV_EXIT_AFTER"); exitAfter != "" {
+		d, err := time.ParseDuration(exitAfter)
+		if err != nil {
+			log.Fatalf("invalid CBOX_FAKECHV_EXIT_AFTER: %v", err)
+		}
+		time.AfterFunc(d, func() {
+			log.Error("exiting to simulate a crash")
+			os.Exit(1)
+		})
+	}
+
+	listener, err := net.Listen("unix", *apiSocket)
+	if err != nil {
+		log.Fatalf("failed to listen on %s: %v", *apiSocket, err)
+	}
+	log.Printf("cbox-fakechv listening on %s", *apiSocket)
+	log.Fatal(http.Serve(listener, newFakeVMM()))
+}
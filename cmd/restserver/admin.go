@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+// adminTokenID returns the ID recorded for the admin token r carries as a
+// bearer token: its index in admin_tokens.
+func (s *restServer) adminTokenID(r *http.Request) (string, bool) {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	for i, token := range s.adminTokens {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			return fmt.Sprintf("admin_tokens[%d]", i), true
+		}
+	}
+	return "", false
+}
+
+// adminAuth wraps handler so it only runs for requests with one of
+// adminTokens as a bearer token.
+func (s *restServer) adminAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.adminTokenID(r); !ok {
+			sendErrorResponse(w, http.StatusUnauthorized, "invalid or missing admin token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// auditLog logs every request with its outcome, including rejected ones.
+func auditLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.WithContext(r.Context()).WithFields(log.Fields{
+			"audit":      true,
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"remoteAddr": r.RemoteAddr,
+			"status":     rec.status,
+			"duration":   time.Since(start),
+		}).Info("admin request")
+	})
+}
+
+// newAdminServer returns the admin listener's server, or nil if admin_port
+// isn't set. Its routes are the admin and public classes, behind admin token
+// authentication and audit logging.
+func newAdminServer(s *restServer, serverConfig *config.ServerConfig) *http.Server {
+	if serverConfig.AdminPort == "" {
+		return nil
+	}
+
+	// admin_tokens replace api_tokens roles on this listener.
+	adminREST := &restServer{
+		vmServer:       s.vmServer,
+		sessionManager: s.sessionManager,
+		adminTokens:    serverConfig.AdminTokens,
+		audit:          s.audit,
+	}
+	adminREST.ready.Store(true)
+	adminSrv := &http.Server{
+		Addr:    serverConfig.AdminHost + ":" + serverConfig.AdminPort,
+		Handler: requestLog(auditLog(newRouter(adminREST, routePublic, routeAdmin))),
+	}
+	go func() {
+		log.Printf("cbox-restserver admin listening on: %s", adminSrv.Addr)
+		if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start admin server: %v", err)
+		}
+	}()
+	return adminSrv
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+// newTestRESTServer returns a ready REST server without a VM server, which
+// is enough for routes that don't touch VMs.
+func newTestRESTServer(t *testing.T) *restServer {
+	t.Helper()
+	audit, err := newAuditLogger(&config.ServerConfig{AuditLogCapacity: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &restServer{audit: audit}
+	s.ready.Store(true)
+	return s
+}
+
+// serve sends a request to handler with token as a bearer token, if set, and
+// returns the response's status.
+func serve(handler http.Handler, method, path, token string) int {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestAdminListenerRoutes(t *testing.T) {
+	s := newTestRESTServer(t)
+	// The main listener's routes with an admin listener configured.
+	main := newRouter(s, routePublic, routeTenant)
+	adminREST := newTestRESTServer(t)
+	adminREST.adminTokens = []string{"secret", "other"}
+	admin := newRouter(adminREST, routePublic, routeAdmin)
+
+	for _, tc := range []struct {
+		name    string
+		handler http.Handler
+		path    string
+		token   string
+		want    int
+	}{
+		{"admin route on the main listener", main, "/v1/audit", "", http.StatusNotFound},
+		{"public route on the main listener", main, "/v1/ready", "", http.StatusOK},
+		{"admin route", admin, "/v1/audit", "secret", http.StatusOK},
+		{"second admin token", admin, "/v1/audit", "other", http.StatusOK},
+		{"public route", admin, "/v1/ready", "secret", http.StatusOK},
+		{"tenant route on the admin listener", admin, "/v1/profiles", "secret", http.StatusNotFound},
+		{"no token", admin, "/v1/audit", "", http.StatusUnauthorized},
+		{"wrong token", admin, "/v1/audit", "secre", http.StatusUnauthorized},
+		{"public route without a token", admin, "/v1/ready", "", http.StatusUnauthorized},
+	} {
+		if got := serve(tc.handler, "GET", tc.path, tc.token); got != tc.want {
+			t.Errorf("%s: GET %s = %d, want %d", tc.name, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestAdminAuthWithoutTokens(t *testing.T) {
+	admin := newRouter(newTestRESTServer(t), routePublic, routeAdmin)
+	if got := serve(admin, "GET", "/v1/audit", ""); got != http.StatusOK {
+		t.Errorf("GET /v1/audit without admin_tokens = %d, want 200", got)
+	}
+}
+
+func TestAdminCallsAudited(t *testing.T) {
+	s := newTestRESTServer(t)
+	s.adminTokens = []string{"secret", "other"}
+	// Wrapped like newRouter wraps admin routes.
+	rt := route{routeAdmin, permAdmin, "POST", "/v1/admin/faults", func(w http.ResponseWriter, r *http.Request) {}}
+	handler := s.auditRoute(rt, s.authorize(rt.perm, rt.handler))
+
+	for _, token := range []string{"", "wrong", "other"} {
+		serve(handler, "POST", "/v1/admin/faults", token)
+	}
+	entries := s.audit.query("", time.Time{}, 10)
+	if len(entries) != 3 {
+		t.Fatalf("audit entries = %+v, want 3", entries)
+	}
+	// Newest first.
+	for i, want := range []struct {
+		outcome   string
+		status    int
+		principal string
+	}{
+		{auditOutcomeSuccess, http.StatusOK, "admin_tokens[1]"},
+		{auditOutcomeDenied, http.StatusUnauthorized, ""},
+		{auditOutcomeDenied, http.StatusUnauthorized, ""},
+	} {
+		if entry := entries[i]; entry.Outcome != want.outcome || entry.Status != want.status || entry.Principal != want.principal {
+			t.Errorf("entry %d = %+v, want %s %d by %q", i, entry, want.outcome, want.status, want.principal)
+		}
+	}
+}
+
+func TestNewAdminServerDisabled(t *testing.T) {
+	if srv := newAdminServer(newTestRESTServer(t), &config.ServerConfig{}); srv != nil {
+		t.Errorf("newAdminServer without admin_port = %v, want nil", srv)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
+)
+
+const (
+	// auditBufferSize is how many entries can wait for the audit log
+	// writer before new ones are dropped.
+	auditBufferSize = 1024
+	// defaultAuditQueryLimit is how many entries /v1/audit returns unless
+	// asked otherwise.
+	defaultAuditQueryLimit = 100
+
+	// auditMethodGRPC is the method of gRPC calls' entries.
+	auditMethodGRPC = "GRPC"
+
+	auditOutcomeSuccess = "success"
+	auditOutcomeFailure = "failure"
+	auditOutcomeDenied  = "denied"
+)
+
+// auditEntry records an audited API call. It's written to the audit log as
+// a JSON line.
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"requestId"`
+	RemoteAddr string    `json:"remoteAddr"`
+	// Principal is the ID of the api_tokens entry the call was made with,
+	// or admin_tokens[i] for the admin token at index i.
+	Principal string `json:"principal,omitempty"`
+	Method    string `json:"method"`
+	Route     string `json:"route"`
+	Path      string `json:"path"`
+	VMName    string `json:"vmName,omitempty"`
+	// Status is the HTTP status, or the gRPC code of gRPC calls.
+	Status   int           `json:"status"`
+	Outcome  string        `json:"outcome"`
+	Duration time.Duration `json:"durationNs"`
+}
+
+// auditLogger records audited API calls without blocking them: entries are
+// kept in a ring buffer for /v1/audit and handed to a goroutine writing them
+// to the audit log, or dropped and counted if it falls behind.
+type auditLogger struct {
+	entries chan auditEntry
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	lock     sync.Mutex
+	capacity int
+	recent   []auditEntry
+	// next is where the next entry goes once recent is full.
+	next int
+	// closed is set once entries is closed.
+	closed bool
+}
+
+// newAuditLogger returns a logger set up by the audit_log_* config.
+func newAuditLogger(serverConfig *config.ServerConfig) (*auditLogger, error) {
+	a := &auditLogger{capacity: serverConfig.AuditLogCapacity}
+	var w io.WriteCloser
+	switch serverConfig.AuditLogPath {
+	case "":
+		return a, nil
+	case "-":
+		w = nopCloser{os.Stdout}
+	default:
+		file, err := openRotatingFile(serverConfig.AuditLogPath, serverConfig.AuditLogMaxSizeInMB*1024*1024, serverConfig.AuditLogMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		w = file
+	}
+	a.entries = make(chan auditEntry, auditBufferSize)
+	a.done = make(chan struct{})
+	go a.write(w)
+	return a, nil
+}
+
+// write writes entries to w until the logger is closed.
+func (a *auditLogger) write(w io.WriteCloser) {
+	defer close(a.done)
+	defer w.Close()
+	encoder := json.NewEncoder(w)
+	for entry := range a.entries {
+		if err := encoder.Encode(entry); err != nil {
+			log.WithError(err).Error("Failed to write audit log entry")
+		}
+	}
+}
+
+// record adds entry to the ring buffer and queues it for the audit log.
+func (a *auditLogger) record(entry auditEntry) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.capacity > 0 {
+		if len(a.recent) < a.capacity {
+			a.recent = append(a.recent, entry)
+		} else {
+			a.recent[a.next] = entry
+			a.next = (a.next + 1) % a.capacity
+		}
+	}
+
+	if a.entries == nil || a.closed {
+		return
+	}
+	select {
+	case a.entries <- entry:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// query returns up to limit entries for vmName, or every VM if it's empty,
+// made at or after since, newest first.
+func (a *auditLogger) query(vmName string, since time.Time, limit int) []auditEntry {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var matches []auditEntry
+	// Newest first: walk back from the entry before next.
+	n := len(a.recent)
+	for i := range n {
+		entry := a.recent[((a.next-1-i)%n+n)%n]
+		if entry.Time.Before(since) {
+			// Entries are recorded in about the order they finish, so
+			// older ones may still follow a long request.
+			continue
+		}
+		if vmName != "" && entry.VMName != vmName {
+			continue
+		}
+		matches = append(matches, entry)
+		if len(matches) == limit {
+			break
+		}
+	}
+	return matches
+}
+
+// close flushes queued entries to the audit log and closes it. Calls that
+// finish later, like long-lived shells, are only kept in memory.
+func (a *auditLogger) close() {
+	if a.entries == nil {
+		return
+	}
+	a.lock.Lock()
+	a.closed = true
+	close(a.entries)
+	a.lock.Unlock()
+	<-a.done
+}
+
+// auditedRoute returns whether calls to rt are audited: those that change
+// something, and those that need vms:exec, like opening a shell.
+func auditedRoute(rt route) bool {
+	return rt.method != http.MethodGet || rt.perm == permExec
+}
+
+type auditVMNameKey struct{}
+
+// setAuditVMName sets the VM recorded for an audited call whose VM isn't in
+// its path, like a start request.
+func setAuditVMName(ctx context.Context, vmName string) {
+	if name, ok := ctx.Value(auditVMNameKey{}).(*string); ok {
+		*name = vmName
+	}
+}
+
+// auditRoute wraps the handler of rt so its calls are audited, including
+// those rejected before it runs.
+func (s *restServer) auditRoute(rt route, handler http.HandlerFunc) http.HandlerFunc {
+	if s.audit == nil || !auditedRoute(rt) {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		vmName := mux.Vars(r)["name"]
+		if rt.path != "/"+API_VERSION+"/vms/{name}" && !strings.HasPrefix(rt.path, "/"+API_VERSION+"/vms/{name}/") {
+			// Other routes' names are templates and the like.
+			vmName = ""
+		}
+		r = r.WithContext(context.WithValue(r.Context(), auditVMNameKey{}, &vmName))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r)
+
+		entry := auditEntry{
+			Time:       start.UTC(),
+			RequestID:  requestid.FromContext(r.Context()),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Route:      rt.path,
+			Path:       r.URL.Path,
+			VMName:     vmName,
+			Status:     rec.status,
+			Outcome:    auditOutcomeSuccess,
+			Duration:   time.Since(start),
+		}
+		if token, ok := s.lookupToken(r); ok {
+			entry.Principal = token.ID
+		} else if id, ok := s.adminTokenID(r); ok {
+			entry.Principal = id
+		}
+		switch {
+		case rec.status == http.StatusUnauthorized || rec.status == http.StatusForbidden:
+			entry.Outcome = auditOutcomeDenied
+		case rec.status >= 400:
+			entry.Outcome = auditOutcomeFailure
+		}
+		s.audit.record(entry)
+	}
+}
+
+// getAudit handles GET /v1/audit
+func (s *restServer) getAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var since time.Time
+	if sinceParam := query.Get("since"); sinceParam != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, sinceParam)
+		if err != nil {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("since must be an RFC 3339 time, got %q", sinceParam))
+			return
+		}
+	}
+	limit := defaultAuditQueryLimit
+	if limitParam := query.Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("limit must be a positive integer, got %q", limitParam))
+			return
+		}
+	}
+
+	resp := serverapi.AuditLogResponse{
+		Entries: []serverapi.AuditLogEntry{},
+		Dropped: serverapi.PtrInt64(int64(s.audit.dropped.Load())),
+	}
+	for _, entry := range s.audit.query(query.Get("vm"), since, limit) {
+		item := serverapi.AuditLogEntry{
+			Time:       serverapi.PtrTime(entry.Time),
+			RequestId:  serverapi.PtrString(entry.RequestID),
+			RemoteAddr: serverapi.PtrString(entry.RemoteAddr),
+			Method:     serverapi.PtrString(entry.Method),
+			Route:      serverapi.PtrString(entry.Route),
+			Path:       serverapi.PtrString(entry.Path),
+			Status:     serverapi.PtrInt32(int32(entry.Status)),
+			Outcome:    serverapi.PtrString(entry.Outcome),
+			DurationMs: serverapi.PtrInt64(entry.Duration.Milliseconds()),
+		}
+		if entry.Principal != "" {
+			item.Principal = serverapi.PtrString(entry.Principal)
+		}
+		if entry.VMName != "" {
+			item.VmName = serverapi.PtrString(entry.VMName)
+		}
+		resp.Entries = append(resp.Entries, item)
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// rotatingFile is a file that's moved aside to path.1 once writing to it
+// would take it past maxBytes, with older files shifted to path.2 and so on
+// up to maxBackups.
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write implements io.Writer. Each call is written to a single file.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			// Written past maxBytes, if the file could be reopened,
+			// rather than lost.
+			log.WithError(err).Errorf("Failed to rotate %s", f.path)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file aside and opens a new one. If that fails, the file is
+// reopened so later writes still go somewhere.
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	if err == nil {
+		err = f.shift()
+	}
+	if openErr := f.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// shift moves path to path.1, and older files along, or removes it without
+// backups.
+func (f *rotatingFile) shift() error {
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.path+".1")
+}
+
+// Close implements io.Closer.
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
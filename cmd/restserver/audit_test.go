@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+// auditAt returns an entry for vmName made at minute minutes past base.
+func auditAt(base time.Time, minute int, vmName string) auditEntry {
+	return auditEntry{
+		Time:      base.Add(time.Duration(minute) * time.Minute),
+		RequestID: fmt.Sprintf("req-%d", minute),
+		VMName:    vmName,
+	}
+}
+
+// requestIDs returns the request IDs of entries.
+func requestIDs(entries []auditEntry) string {
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.RequestID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestAuditQuery(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := &auditLogger{capacity: 4}
+	// Six entries through a ring of four: the first two are overwritten.
+	for minute := range 6 {
+		a.record(auditAt(base, minute, fmt.Sprintf("vm%d", minute%2)))
+	}
+
+	for _, tc := range []struct {
+		name   string
+		vmName string
+		since  time.Time
+		limit  int
+		want   string
+	}{
+		{"all, newest first", "", time.Time{}, 10, "req-5,req-4,req-3,req-2"},
+		{"limit", "", time.Time{}, 2, "req-5,req-4"},
+		{"vm", "vm1", time.Time{}, 10, "req-5,req-3"},
+		{"since", "", base.Add(4 * time.Minute), 10, "req-5,req-4"},
+		{"since and vm", "vm0", base.Add(3 * time.Minute), 10, "req-4"},
+		{"since after all", "", base.Add(time.Hour), 10, ""},
+		{"unknown vm", "vm9", time.Time{}, 10, ""},
+	} {
+		if got := requestIDs(a.query(tc.vmName, tc.since, tc.limit)); got != tc.want {
+			t.Errorf("%s: query = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAuditQueryBeforeWrap(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := &auditLogger{capacity: 4}
+	for minute := range 3 {
+		a.record(auditAt(base, minute, "vm1"))
+	}
+	if got, want := requestIDs(a.query("", time.Time{}, 10)), "req-2,req-1,req-0"; got != want {
+		t.Errorf("query = %q, want %q", got, want)
+	}
+}
+
+func TestAuditDropsWhenWriterBehind(t *testing.T) {
+	// No writer drains entries, as if it's stuck on a slow disk.
+	a := &auditLogger{capacity: 10, entries: make(chan auditEntry, 2)}
+	for range 5 {
+		a.record(auditEntry{Time: time.Now()})
+	}
+	if got := a.dropped.Load(); got != 3 {
+		t.Errorf("dropped = %d, want 3", got)
+	}
+	// The ring buffer keeps them all regardless.
+	if got := len(a.query("", time.Time{}, 10)); got != 5 {
+		t.Errorf("queried %d entries, want 5", got)
+	}
+}
+
+func TestGetAudit(t *testing.T) {
+	s := newTestRESTServer(t)
+	base := time.Now().UTC().Truncate(time.Second)
+	for minute := range 3 {
+		s.audit.record(auditAt(base, minute, "vm1"))
+	}
+	s.audit.dropped.Store(7)
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		want  string
+	}{
+		{"", http.StatusOK, "req-2,req-1,req-0"},
+		{"?limit=1", http.StatusOK, "req-2"},
+		{"?vm=vm2", http.StatusOK, ""},
+		{"?since=" + base.Add(time.Minute).Format(time.RFC3339), http.StatusOK, "req-2,req-1"},
+		{"?since=yesterday", http.StatusBadRequest, ""},
+		{"?limit=0", http.StatusBadRequest, ""},
+	} {
+		rec := httptest.NewRecorder()
+		s.getAudit(rec, httptest.NewRequest("GET", "/v1/audit"+tc.query, nil))
+		if rec.Code != tc.code {
+			t.Errorf("GET /v1/audit%s = %d, want %d", tc.query, rec.Code, tc.code)
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		var resp serverapi.AuditLogResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, entry := range resp.Entries {
+			ids = append(ids, entry.GetRequestId())
+		}
+		if got := strings.Join(ids, ","); got != tc.want || resp.GetDropped() != 7 {
+			t.Errorf("GET /v1/audit%s = %q dropped %d, want %q dropped 7", tc.query, got, resp.GetDropped(), tc.want)
+		}
+	}
+}
+
+// readFile returns the contents of path, or "" if it doesn't exist.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Each write goes to one file, which is rotated before it'd pass 10
+	// bytes.
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n", "ffff\n", "gggg\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	for file, want := range map[string]string{
+		path:        "gggg\n",
+		path + ".1": "eeee\nffff\n",
+		path + ".2": "cccc\ndddd\n",
+		path + ".3": "",
+	} {
+		if got := readFile(t, file); got != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(file), got, want)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("audit log mode = %v, want 0600", perm)
+	}
+}
+
+func TestRotatingFileWithoutBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := openRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if got := readFile(t, path); got != "cccc\n" {
+		t.Errorf("audit log = %q, want only the last write", got)
+	}
+	if got := readFile(t, path+".1"); got != "" {
+		t.Errorf("audit.log.1 = %q, want no backup", got)
+	}
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	// A non-empty directory where the backup goes makes the rename fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write after a failed rotation: %v", err)
+		}
+	}
+	// Nothing is lost: the file is reopened and written past its limit.
+	if got, want := readFile(t, path), "aaaa\nbbbb\ncccc\ndddd\n"; got != want {
+		t.Errorf("audit log = %q, want %q", got, want)
+	}
+
+	// Once the backup can be made, rotation picks up again.
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("eeee\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := readFile(t, path); got != "eeee\n" {
+		t.Errorf("audit log after rotating = %q, want the last write", got)
+	}
+}
+
+func TestAuditLogWritesEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := newAuditLogger(&config.ServerConfig{
+		AuditLogPath:        path,
+		AuditLogMaxSizeInMB: 1,
+		AuditLogMaxBackups:  1,
+		AuditLogCapacity:    10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.record(auditEntry{RequestID: "req-1", VMName: "vm1", Outcome: auditOutcomeSuccess})
+	a.record(auditEntry{RequestID: "req-2", VMName: "vm2", Outcome: auditOutcomeDenied})
+	a.close()
+	// Entries recorded once closed are only kept in memory.
+	a.record(auditEntry{RequestID: "req-3"})
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(readFile(t, path)), "\n") {
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("audit log line %q: %v", line, err)
+		}
+		got = append(got, entry.RequestID+":"+entry.Outcome)
+	}
+	if want := "req-1:success,req-2:denied"; strings.Join(got, ",") != want {
+		t.Errorf("audit log = %v, want %s", got, want)
+	}
+	if got := len(a.query("", time.Time{}, 10)); got != 3 {
+		t.Errorf("queried %d entries, want 3", got)
+	}
+}
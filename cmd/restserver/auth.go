@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+// permission is what a route requires of the caller's role.
+type permission string
+
+const (
+	// permNone marks routes that are never authorized: health checks, and
+	// guest callbacks, which can't carry a token.
+	permNone     permission = ""
+	permVMsRead  permission = "vms:read"
+	permVMsWrite permission = "vms:write"
+	permExec     permission = "vms:exec"
+	permAdmin    permission = "admin"
+)
+
+// rolePermissions lists what each role in api_tokens grants.
+var rolePermissions = map[string][]permission{
+	"readonly": {permVMsRead},
+	"operator": {permVMsRead, permVMsWrite, permExec},
+	"admin":    {permVMsRead, permVMsWrite, permExec, permAdmin},
+}
+
+// newTokenTable indexes api_tokens by token, rejecting unknown roles and
+// duplicates. It returns nil if no tokens are configured.
+func newTokenTable(tokens []config.APIToken) (map[string]config.APIToken, error) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	table := make(map[string]config.APIToken, len(tokens))
+	for _, token := range tokens {
+		if token.ID == "" || token.Token == "" {
+			return nil, fmt.Errorf("every token needs an id and a token")
+		}
+		if _, ok := rolePermissions[token.Role]; !ok {
+			return nil, fmt.Errorf("token %s has unknown role %q", token.ID, token.Role)
+		}
+		if _, ok := table[token.Token]; ok {
+			return nil, fmt.Errorf("token %s duplicates another token", token.ID)
+		}
+		table[token.Token] = token
+	}
+	return table, nil
+}
+
+// lookupToken finds the api token carried by r as a bearer token.
+func (s *restServer) lookupToken(r *http.Request) (config.APIToken, bool) {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return config.APIToken{}, false
+	}
+	return s.findToken(got)
+}
+
+// findToken returns the api_tokens entry of token.
+func (s *restServer) findToken(got string) (config.APIToken, bool) {
+	for token, apiToken := range s.apiTokens {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			return apiToken, true
+		}
+	}
+	return config.APIToken{}, false
+}
+
+// hasPermission reports whether r's token grants perm. Without api_tokens
+// every request does.
+func (s *restServer) hasPermission(r *http.Request, perm permission) bool {
+	if s.apiTokens == nil {
+		return true
+	}
+	token, ok := s.lookupToken(r)
+	return ok && slices.Contains(rolePermissions[token.Role], perm)
+}
+
+// authorize wraps handler so it only runs for tokens whose role grants perm,
+// or on the admin listener, for admin tokens. Without either every request
+// is let through.
+func (s *restServer) authorize(perm permission, handler http.HandlerFunc) http.HandlerFunc {
+	if len(s.adminTokens) > 0 {
+		return s.adminAuth(handler)
+	}
+	if s.apiTokens == nil || perm == permNone {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := s.lookupToken(r)
+		if !ok {
+			sendErrorResponse(w, http.StatusUnauthorized, "invalid or missing API token")
+			return
+		}
+		if !slices.Contains(rolePermissions[token.Role], perm) {
+			log.WithFields(log.Fields{
+				"tokenID":    token.ID,
+				"role":       token.Role,
+				"permission": perm,
+				"path":       r.URL.Path,
+			}).Warn("request denied")
+			sendErrorResponse(w, http.StatusForbidden, fmt.Sprintf("role %s lacks permission %s", token.Role, perm))
+			return
+		}
+		handler(w, r)
+	}
+}
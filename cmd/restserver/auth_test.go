@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/vmservicepb"
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+// testTokens has a token for each role, named after it.
+var testTokens = []config.APIToken{
+	{ID: "ci", Token: "operator", Role: "operator"},
+	{ID: "monitoring", Token: "readonly", Role: "readonly"},
+	{ID: "root", Token: "admin", Role: "admin"},
+}
+
+func TestAuthorizeRoles(t *testing.T) {
+	apiTokens, err := newTokenTable(testTokens)
+	if err != nil {
+		t.Fatalf("newTokenTable: %v", err)
+	}
+	s := &restServer{apiTokens: apiTokens}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	// Each role against every route: the route's handler runs only if the
+	// role grants its permission.
+	allowed := map[string]map[permission]bool{
+		"readonly": {permVMsRead: true},
+		"operator": {permVMsRead: true, permVMsWrite: true, permExec: true},
+		"admin":    {permVMsRead: true, permVMsWrite: true, permExec: true, permAdmin: true},
+	}
+	for _, rt := range s.routes() {
+		handler := s.authorize(rt.perm, ok)
+		for role, perms := range allowed {
+			want := http.StatusForbidden
+			if rt.perm == permNone || perms[rt.perm] {
+				want = http.StatusOK
+			}
+			if got := serve(handler, rt.method, rt.path, role); got != want {
+				t.Errorf("%s %s (%s) as %s = %d, want %d", rt.method, rt.path, rt.class, role, got, want)
+			}
+		}
+		want := http.StatusUnauthorized
+		if rt.perm == permNone {
+			want = http.StatusOK
+		}
+		if got := serve(handler, rt.method, rt.path, ""); got != want {
+			t.Errorf("%s %s (%s) without a token = %d, want %d", rt.method, rt.path, rt.class, got, want)
+		}
+		if got := serve(handler, rt.method, rt.path, "unknown"); got != want {
+			t.Errorf("%s %s (%s) with an unknown token = %d, want %d", rt.method, rt.path, rt.class, got, want)
+		}
+	}
+}
+
+func TestAuthorizeNamesMissingPermission(t *testing.T) {
+	apiTokens, err := newTokenTable(testTokens)
+	if err != nil {
+		t.Fatalf("newTokenTable: %v", err)
+	}
+	s := &restServer{apiTokens: apiTokens}
+	req := httptest.NewRequest("DELETE", "/v1/vms", nil)
+	req.Header.Set("Authorization", "Bearer operator")
+	rec := httptest.NewRecorder()
+	s.authorize(permAdmin, func(w http.ResponseWriter, r *http.Request) {})(rec, req)
+	if want := "role operator lacks permission admin"; rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("DELETE /v1/vms as operator = %d %s, want 403 naming %q", rec.Code, rec.Body.String(), want)
+	}
+}
+
+func TestAuthorizeWithoutTokens(t *testing.T) {
+	s := &restServer{}
+	handler := s.authorize(permAdmin, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	if got := serve(handler, "DELETE", "/v1/vms", ""); got != http.StatusOK {
+		t.Errorf("DELETE /v1/vms without api_tokens = %d, want 200", got)
+	}
+}
+
+func TestAuthorizeGRPC(t *testing.T) {
+	apiTokens, err := newTokenTable(testTokens)
+	if err != nil {
+		t.Fatalf("newTokenTable: %v", err)
+	}
+	s := &restServer{apiTokens: apiTokens}
+	for _, tc := range []struct {
+		method        string
+		authorization string
+		want          codes.Code
+	}{
+		{vmservicepb.VMService_ListAllVMs_FullMethodName, "Bearer readonly", codes.OK},
+		{vmservicepb.VMService_VMExec_FullMethodName, "Bearer readonly", codes.PermissionDenied},
+		{vmservicepb.VMService_VMExec_FullMethodName, "Bearer operator", codes.OK},
+		{vmservicepb.VMService_DestroyAllVMs_FullMethodName, "Bearer operator", codes.PermissionDenied},
+		{vmservicepb.VMService_DestroyAllVMs_FullMethodName, "Bearer admin", codes.OK},
+		{vmservicepb.VMService_ListVM_FullMethodName, "admin", codes.Unauthenticated},
+		{vmservicepb.VMService_ListVM_FullMethodName, "Bearer unknown", codes.Unauthenticated},
+		{"/cbox.v1.VMService/Unmapped", "Bearer admin", codes.PermissionDenied},
+	} {
+		if err := s.authorizeGRPC(context.Background(), tc.method, tc.authorization); status.Code(err) != tc.want {
+			t.Errorf("authorizeGRPC(%s, %q) = %v, want %s", tc.method, tc.authorization, err, tc.want)
+		}
+	}
+}
+
+func TestAuthorizeGRPCUnmappedWithoutTokens(t *testing.T) {
+	s := &restServer{}
+	if err := s.authorizeGRPC(context.Background(), vmservicepb.VMService_ListVM_FullMethodName, ""); err != nil {
+		t.Errorf("ListVM without api_tokens = %v, want it allowed", err)
+	}
+	if err := s.authorizeGRPC(context.Background(), "/cbox.v1.VMService/Unmapped", ""); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("unmapped method without api_tokens = %v, want PermissionDenied", err)
+	}
+}
+
+func TestGRPCMethodPermissionsCoverService(t *testing.T) {
+	// Methods without an entry are denied, so a new one has to be given
+	// the permission of its REST route.
+	desc := vmservicepb.VMService_ServiceDesc
+	var methods []string
+	for _, method := range desc.Methods {
+		methods = append(methods, method.MethodName)
+	}
+	for _, stream := range desc.Streams {
+		methods = append(methods, stream.StreamName)
+	}
+	for _, method := range methods {
+		fullMethod := "/" + desc.ServiceName + "/" + method
+		if _, ok := grpcMethodPermissions[fullMethod]; !ok {
+			t.Errorf("%s has no entry in grpcMethodPermissions", fullMethod)
+		}
+	}
+	if len(grpcMethodPermissions) != len(methods) {
+		t.Errorf("grpcMethodPermissions has %d entries for %d methods", len(grpcMethodPermissions), len(methods))
+	}
+}
+
+func TestNewTokenTable(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tokens []config.APIToken
+	}{
+		{"unknown role", []config.APIToken{{ID: "a", Token: "x", Role: "superuser"}}},
+		{"missing token", []config.APIToken{{ID: "a", Role: "admin"}}},
+		{"missing id", []config.APIToken{{Token: "x", Role: "admin"}}},
+		{"duplicate", []config.APIToken{{ID: "a", Token: "x", Role: "admin"}, {ID: "b", Token: "x", Role: "readonly"}}},
+	} {
+		if _, err := newTokenTable(tc.tokens); err == nil {
+			t.Errorf("newTokenTable with a %s succeeded", tc.name)
+		}
+	}
+	if table, err := newTokenTable(nil); err != nil || table != nil {
+		t.Errorf("newTokenTable(nil) = %v, %v, want nil", table, err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/callback"
+)
+
+const (
+	getVMInfoMethod = "cbox.getVMInfo"
+	logMethod       = "cbox.log"
+)
+
+// vmInfoResult is the result of a getVMInfoMethod callback.
+type vmInfoResult struct {
+	Name   string            `json:"name"`
+	IP     string            `json:"ip"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// logParams are the params of a logMethod callback. Level defaults to info.
+type logParams struct {
+	Level   string         `json:"level,omitempty"`
+	Message string         `json:"message"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+// registerBuiltins registers the built-in callbacks served by the REST
+// server. It's called once s.vmServer is set.
+func (s *restServer) registerBuiltins() error {
+	builtins := map[string]callback.BuiltinHandler{
+		getVMInfoMethod: s.getVMInfoCallback,
+		logMethod:       logCallback,
+	}
+	for method, handler := range builtins {
+		if err := s.sessionManager.RegisterBuiltin(method, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getVMInfoCallback returns the calling VM's name, IP and labels.
+func (s *restServer) getVMInfoCallback(ctx context.Context, vmName string, _ json.RawMessage) (json.RawMessage, error) {
+	resp, err := s.vmServer.ListVM(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	ip := resp.GetIp()
+	if addr, _, err := net.ParseCIDR(ip); err == nil {
+		ip = addr.String()
+	}
+	return json.Marshal(vmInfoResult{
+		Name:   resp.GetVmName(),
+		IP:     ip,
+		Labels: resp.GetLabels(),
+	})
+}
+
+// logCallback writes a log line on the guest's behalf, tagged with its VM.
+func logCallback(_ context.Context, vmName string, rawParams json.RawMessage) (json.RawMessage, error) {
+	var params logParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return nil, fmt.Errorf("invalid %s params: %w", logMethod, err)
+	}
+	if params.Message == "" {
+		return nil, fmt.Errorf("message is required")
+	}
+	level := log.InfoLevel
+	if params.Level != "" {
+		var err error
+		level, err = log.ParseLevel(params.Level)
+		// Guests mustn't be able to panic or exit the server.
+		if err != nil || level < log.ErrorLevel {
+			return nil, fmt.Errorf("invalid level %q, must be one of error, warn, info, debug or trace", params.Level)
+		}
+	}
+
+	fields := log.Fields{}
+	for k, v := range params.Fields {
+		fields[k] = v
+	}
+	// Set last so guests can't impersonate another VM.
+	fields["vmName"] = vmName
+	fields["source"] = "guest"
+	log.WithFields(fields).Log(level, params.Message)
+	return json.Marshal(struct{}{})
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/out/gen/vmservicepb"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
+	"github.com/abilashraghuram/cbox/pkg/server"
+)
+
+// grpcMethodPermissions is what each VMService method requires of the
+// caller's role: the permission of the matching REST route. Methods missing
+// from it are denied.
+var grpcMethodPermissions = map[string]permission{
+	vmservicepb.VMService_StartVM_FullMethodName:       permVMsWrite,
+	vmservicepb.VMService_DestroyVM_FullMethodName:     permVMsWrite,
+	vmservicepb.VMService_DestroyAllVMs_FullMethodName: permAdmin,
+	vmservicepb.VMService_ListVM_FullMethodName:        permVMsRead,
+	vmservicepb.VMService_ListAllVMs_FullMethodName:    permVMsRead,
+	vmservicepb.VMService_VMExec_FullMethodName:        permExec,
+}
+
+// grpcService serves VMService with the REST server's VM server, session
+// manager and tokens, so both APIs behave the same. Errors are returned with
+// the VM server's status codes.
+type grpcService struct {
+	vmservicepb.UnimplementedVMServiceServer
+	rest *restServer
+	// adminListener is set when admin routes are only served on the admin
+	// listener, so DestroyAllVMs isn't served over gRPC either.
+	adminListener bool
+}
+
+// newGRPCServer starts serving VMService on grpc_port, or returns nil if it
+// isn't set.
+func newGRPCServer(s *restServer, serverConfig *config.ServerConfig) (*grpc.Server, error) {
+	if serverConfig.GRPCPort == "" {
+		return nil, nil
+	}
+	addr := serverConfig.Host + ":" + serverConfig.GRPCPort
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start gRPC server: %w", err)
+	}
+
+	grpcSrv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(s.grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(s.grpcStreamInterceptor),
+	)
+	vmservicepb.RegisterVMServiceServer(grpcSrv, &grpcService{
+		rest:          s,
+		adminListener: serverConfig.AdminPort != "",
+	})
+	go func() {
+		log.Printf("cbox-restserver gRPC listening on: %s", addr)
+		if err := grpcSrv.Serve(listener); err != nil {
+			log.Fatalf("Failed to start gRPC server: %v", err)
+		}
+	}()
+	return grpcSrv, nil
+}
+
+// shutdownGRPCServer stops grpcSrv from accepting calls and waits for
+// in-flight ones until ctx is done, then cancels them. grpcSrv may be nil.
+func shutdownGRPCServer(ctx context.Context, grpcSrv *grpc.Server) {
+	if grpcSrv == nil {
+		return
+	}
+	stopped := make(chan struct{})
+	go func() {
+		grpcSrv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Warn("gRPC server didn't drain in time, cancelling its calls")
+		grpcSrv.Stop()
+		<-stopped
+	}
+}
+
+// grpcMetadata returns the first value of the call's metadata key.
+func grpcMetadata(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// grpcCallContext returns the context of a call to method: authorized like
+// the matching REST route, carrying a request ID and any lease token, and
+// logged like REST requests once the call returns. A denied call's context
+// still carries its request ID.
+func (s *restServer) grpcCallContext(ctx context.Context, method string) (context.Context, error) {
+	id := grpcMetadata(ctx, strings.ToLower(requestid.Header))
+	if !requestid.Valid(id) {
+		id = requestid.New()
+	}
+	ctx = requestid.NewContext(ctx, id)
+	grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(requestid.Header), id))
+
+	if err := s.authorizeGRPC(ctx, method, grpcMetadata(ctx, "authorization")); err != nil {
+		return ctx, err
+	}
+	if token := grpcMetadata(ctx, strings.ToLower(leaseTokenHeader)); token != "" {
+		ctx = server.WithLeaseToken(ctx, token)
+	}
+	return ctx, nil
+}
+
+// authorizeGRPC checks that authorization, the call's "Bearer <token>"
+// metadata, names a token whose role grants method's permission. Without
+// api_tokens every call to a method in grpcMethodPermissions is let through.
+func (s *restServer) authorizeGRPC(ctx context.Context, method string, authorization string) error {
+	perm, ok := grpcMethodPermissions[method]
+	if !ok {
+		log.WithContext(ctx).WithField("method", method).Warn("request denied: method has no permission")
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("no permission is defined for %s", method))
+	}
+	if s.apiTokens == nil || perm == permNone {
+		return nil
+	}
+	got, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return status.Error(codes.Unauthenticated, "invalid or missing API token")
+	}
+	token, ok := s.findToken(got)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "invalid or missing API token")
+	}
+	if !slices.Contains(rolePermissions[token.Role], perm) {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"tokenID":    token.ID,
+			"role":       token.Role,
+			"permission": perm,
+			"method":     method,
+		}).Warn("request denied")
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("role %s lacks permission %s", token.Role, perm))
+	}
+	return nil
+}
+
+// logGRPCCall logs a finished call like requestLog logs REST requests.
+func logGRPCCall(ctx context.Context, method string, start time.Time, err error) {
+	log.WithContext(ctx).WithFields(log.Fields{
+		"method":   method,
+		"code":     status.Code(err).String(),
+		"duration": time.Since(start),
+	}).Info("gRPC call")
+}
+
+// auditedGRPCMethod returns whether calls to method are audited: like
+// auditedRoute, all but those that only read. Calls to methods missing from
+// grpcMethodPermissions are audited as they're denied.
+func auditedGRPCMethod(method string) bool {
+	perm, ok := grpcMethodPermissions[method]
+	return !ok || perm != permVMsRead
+}
+
+// auditGRPC records a finished call to an audited method like auditRoute
+// records REST calls, with its gRPC code as the status.
+func (s *restServer) auditGRPC(ctx context.Context, method string, start time.Time, vmName string, err error) {
+	if s.audit == nil || !auditedGRPCMethod(method) {
+		return
+	}
+	code := status.Code(err)
+	entry := auditEntry{
+		Time:      start.UTC(),
+		RequestID: requestid.FromContext(ctx),
+		Method:    auditMethodGRPC,
+		Route:     method,
+		Path:      method,
+		VMName:    vmName,
+		Status:    int(code),
+		Outcome:   auditOutcomeSuccess,
+		Duration:  time.Since(start),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		entry.RemoteAddr = p.Addr.String()
+	}
+	if got, ok := strings.CutPrefix(grpcMetadata(ctx, "authorization"), "Bearer "); ok {
+		if token, ok := s.findToken(got); ok {
+			entry.Principal = token.ID
+		}
+	}
+	switch code {
+	case codes.OK:
+	case codes.Unauthenticated, codes.PermissionDenied:
+		entry.Outcome = auditOutcomeDenied
+	default:
+		entry.Outcome = auditOutcomeFailure
+	}
+	s.audit.record(entry)
+}
+
+func (s *restServer) grpcUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	var vmName string
+	if named, ok := req.(interface{ GetVmName() string }); ok {
+		vmName = named.GetVmName()
+	}
+	callCtx, err := s.grpcCallContext(ctx, info.FullMethod)
+	var resp any
+	if err == nil {
+		resp, err = handler(callCtx, req)
+	}
+	logGRPCCall(callCtx, info.FullMethod, start, err)
+	s.auditGRPC(callCtx, info.FullMethod, start, vmName, err)
+	return resp, err
+}
+
+func (s *restServer) grpcStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	// Set by the handler once it has read the request.
+	var vmName string
+	ctx := context.WithValue(ss.Context(), auditVMNameKey{}, &vmName)
+	callCtx, err := s.grpcCallContext(ctx, info.FullMethod)
+	if err == nil {
+		err = handler(srv, &contextServerStream{ServerStream: ss, ctx: callCtx})
+	}
+	logGRPCCall(callCtx, info.FullMethod, start, err)
+	s.auditGRPC(callCtx, info.FullMethod, start, vmName, err)
+	return err
+}
+
+// contextServerStream is a grpc.ServerStream with a replaced context.
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (st *contextServerStream) Context() context.Context {
+	return st.ctx
+}
+
+func (g *grpcService) StartVM(ctx context.Context, req *vmservicepb.StartVMRequest) (*vmservicepb.StartVMResponse, error) {
+	logger := log.WithContext(ctx).WithField("api", "grpcStartVM")
+	if req.GetVmName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Empty vm name")
+	}
+
+	startReq := &serverapi.StartVMRequest{
+		VmName:         serverapi.PtrString(req.VmName),
+		CallbackUrls:   req.CallbackUrls,
+		CpuAffinity:    req.CpuAffinity,
+		NumaNode:       req.NumaNode,
+		Idempotent:     serverapi.PtrBool(req.Idempotent),
+		StatefulSizeMb: req.StatefulSizeMb,
+		RootfsOverlay:  req.RootfsOverlay,
+
+		AllowedCallbackMethods: req.AllowedCallbackMethods,
+	}
+	if req.PreserveStatefulDisk {
+		startReq.PreserveStatefulDisk = serverapi.PtrBool(true)
+	}
+	for field, value := range map[**string]string{
+		&startReq.Kernel:            req.Kernel,
+		&startReq.Initramfs:         req.Initramfs,
+		&startReq.Rootfs:            req.Rootfs,
+		&startReq.CallbackUrl:       req.CallbackUrl,
+		&startReq.CallbackTransport: req.CallbackTransport,
+		&startReq.CallbackSubject:   req.CallbackSubject,
+		&startReq.CallbackSecret:    req.CallbackSecret,
+		&startReq.TapDevice:         req.TapDevice,
+		&startReq.ExternalIp:        req.ExternalIp,
+		&startReq.Ip:                req.Ip,
+		&startReq.ExtraKernelArgs:   req.ExtraKernelArgs,
+		&startReq.Profile:           req.Profile,
+	} {
+		if value != "" {
+			*field = serverapi.PtrString(value)
+		}
+	}
+	if len(req.Labels) > 0 {
+		startReq.Labels = &req.Labels
+	}
+	if req.BootTimeoutSeconds != 0 {
+		startReq.BootTimeoutSeconds = serverapi.PtrInt32(req.BootTimeoutSeconds)
+	}
+	for _, disk := range req.Disks {
+		apiDisk := serverapi.VmDisk{Path: disk.Path, Readonly: serverapi.PtrBool(disk.Readonly)}
+		if disk.SizeMb != 0 {
+			apiDisk.SizeMb = serverapi.PtrInt32(disk.SizeMb)
+		}
+		startReq.Disks = append(startReq.Disks, apiDisk)
+	}
+	for _, dir := range req.SharedDirs {
+		startReq.SharedDirs = append(startReq.SharedDirs, serverapi.SharedDir{
+			HostPath: dir.HostPath,
+			Tag:      dir.Tag,
+			Readonly: serverapi.PtrBool(dir.Readonly),
+		})
+	}
+
+	resp, err := g.rest.vmServer.StartVM(ctx, startReq)
+	if err != nil {
+		logger.WithField("vmName", req.VmName).WithError(err).Error("Failed to start VM")
+		return nil, err
+	}
+	g.rest.registerCallbacks(logger, startReq)
+	pbResp := &vmservicepb.StartVMResponse{
+		VmName:        resp.GetVmName(),
+		Status:        resp.GetStatus(),
+		Ip:            resp.GetIp(),
+		RequestedIp:   resp.GetRequestedIp(),
+		TapDeviceName: resp.GetTapDeviceName(),
+		Cid:           uint32(resp.GetCid()),
+		VsockPath:     resp.GetVsockPath(),
+	}
+	for _, dir := range resp.SharedDirs {
+		pbResp.SharedDirs = append(pbResp.SharedDirs, &vmservicepb.SharedDir{
+			HostPath: dir.HostPath,
+			Tag:      dir.Tag,
+			Readonly: dir.GetReadonly(),
+		})
+	}
+	return pbResp, nil
+}
+
+func (g *grpcService) DestroyVM(ctx context.Context, req *vmservicepb.DestroyVMRequest) (*vmservicepb.DestroyVMResponse, error) {
+	logger := log.WithContext(ctx).WithField("api", "grpcDestroyVM")
+	resp, err := g.rest.vmServer.DestroyVM(ctx, req.GetVmName())
+	if err != nil {
+		logger.WithField("vmName", req.GetVmName()).WithError(err).Error("Failed to destroy VM")
+		return nil, err
+	}
+	g.rest.sessionManager.RemoveSession(req.GetVmName())
+	return &vmservicepb.DestroyVMResponse{Message: resp.GetMessage()}, nil
+}
+
+func (g *grpcService) DestroyAllVMs(ctx context.Context, req *vmservicepb.DestroyAllVMsRequest) (*vmservicepb.DestroyAllVMsResponse, error) {
+	logger := log.WithContext(ctx).WithField("api", "grpcDestroyAllVMs")
+	if g.adminListener {
+		return nil, status.Error(codes.PermissionDenied, "DestroyAllVMs is only served on the admin listener")
+	}
+	resp, err := g.rest.vmServer.DestroyAllVMs(ctx, req.GetLabelSelector())
+	if err != nil {
+		logger.WithError(err).Error("Failed to destroy all VMs")
+		return nil, err
+	}
+	if !resp.GetSuccess() {
+		logger.WithField("failed", len(resp.Failed)).Warn("Failed to destroy some VMs")
+	}
+
+	out := &vmservicepb.DestroyAllVMsResponse{
+		Success:   resp.GetSuccess(),
+		Destroyed: resp.Destroyed,
+	}
+	for _, failure := range resp.Failed {
+		out.Failed = append(out.Failed, &vmservicepb.DestroyVMFailure{
+			VmName: failure.GetVmName(),
+			Error:  failure.GetError(),
+		})
+	}
+	return out, nil
+}
+
+func (g *grpcService) ListVM(ctx context.Context, req *vmservicepb.ListVMRequest) (*vmservicepb.VM, error) {
+	resp, err := g.rest.vmServer.ListVM(ctx, req.GetVmName())
+	if err != nil {
+		return nil, err
+	}
+	return &vmservicepb.VM{
+		VmName:        resp.GetVmName(),
+		Status:        resp.GetStatus(),
+		Ip:            resp.GetIp(),
+		TapDeviceName: resp.GetTapDeviceName(),
+		Labels:        resp.GetLabels(),
+		Cid:           uint32(resp.GetCid()),
+		VsockPath:     resp.GetVsockPath(),
+	}, nil
+}
+
+func (g *grpcService) ListAllVMs(ctx context.Context, req *vmservicepb.ListAllVMsRequest) (*vmservicepb.ListAllVMsResponse, error) {
+	resp, err := g.rest.vmServer.ListAllVMs(ctx, req.GetLabelSelector())
+	if err != nil {
+		return nil, err
+	}
+	out := &vmservicepb.ListAllVMsResponse{}
+	for _, vm := range resp.Vms {
+		out.Vms = append(out.Vms, &vmservicepb.VM{
+			VmName:        vm.GetVmName(),
+			Status:        vm.GetStatus(),
+			Ip:            vm.GetIp(),
+			TapDeviceName: vm.GetTapDeviceName(),
+			Labels:        vm.GetLabels(),
+			Cid:           uint32(vm.GetCid()),
+			VsockPath:     vm.GetVsockPath(),
+		})
+	}
+	return out, nil
+}
+
+// VMExec streams the command's cmdserver.StreamRecords as VMExecResponses.
+func (g *grpcService) VMExec(req *vmservicepb.VMExecRequest, stream vmservicepb.VMService_VMExecServer) error {
+	ctx := stream.Context()
+	setAuditVMName(ctx, req.GetVmName())
+	logger := log.WithContext(ctx).WithFields(log.Fields{
+		"api":    "grpcVMExec",
+		"vmName": req.GetVmName(),
+	})
+	if req.GetCmd() == "" {
+		return status.Error(codes.InvalidArgument, "Command cannot be empty")
+	}
+
+	execReq := &serverapi.VmExecRequest{Cmd: req.GetCmd()}
+	if req.GetWorkspace() != "" {
+		execReq.Workspace = serverapi.PtrString(req.GetWorkspace())
+	}
+	if req.GetTimeoutSeconds() != 0 {
+		execReq.TimeoutSeconds = serverapi.PtrInt32(req.GetTimeoutSeconds())
+	}
+	if req.GetCwd() != "" {
+		execReq.Cwd = serverapi.PtrString(req.GetCwd())
+	}
+	if len(req.GetEnv()) > 0 {
+		execReq.SetEnv(req.GetEnv())
+	}
+	if req.GetUser() != "" {
+		execReq.User = serverapi.PtrString(req.GetUser())
+	}
+	output, err := g.rest.vmServer.VMExecStream(ctx, req.GetVmName(), execReq)
+	if err != nil {
+		logger.WithError(err).Error("Failed to stream command")
+		return err
+	}
+	defer output.Close()
+
+	scanner := bufio.NewScanner(output)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		var record cmdserver.StreamRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			logger.WithError(err).Error("Invalid exec stream record")
+			return status.Error(codes.Internal, fmt.Sprintf("invalid exec stream record: %v", err))
+		}
+		resp := &vmservicepb.VMExecResponse{
+			Stream:   record.Stream,
+			Data:     []byte(record.Data),
+			Done:     record.Done,
+			Error:    record.Error,
+			TimedOut: record.TimedOut,
+		}
+		if record.ExitCode != nil {
+			exitCode := int32(*record.ExitCode)
+			resp.ExitCode = &exitCode
+		}
+		if err := stream.Send(resp); err != nil {
+			logger.WithError(err).Warn("Client went away, killing command")
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// The missing done message tells the client the stream was cut
+		// short.
+		logger.WithError(err).Error("Exec stream failed")
+		return status.Error(codes.Unavailable, fmt.Sprintf("exec stream failed: %v", err))
+	}
+	logger.WithField("cmd", req.GetCmd()).Info("Streamed command")
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/vmservicepb"
+)
+
+// newGRPCTestServer returns a REST server with testTokens and an audit log.
+func newGRPCTestServer(t *testing.T) *restServer {
+	t.Helper()
+	apiTokens, err := newTokenTable(testTokens)
+	if err != nil {
+		t.Fatalf("newTokenTable: %v", err)
+	}
+	s := newTestRESTServer(t)
+	s.apiTokens = apiTokens
+	return s
+}
+
+// bearer returns an incoming call context authorized with token.
+func bearer(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func TestGRPCUnaryAudit(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		method  string
+		token   string
+		err     error
+		audited bool
+		outcome string
+		code    codes.Code
+	}{
+		{"destroy", vmservicepb.VMService_DestroyVM_FullMethodName, "operator", nil, true, auditOutcomeSuccess, codes.OK},
+		{"failed destroy", vmservicepb.VMService_DestroyVM_FullMethodName, "operator", status.Error(codes.NotFound, "vm not found"), true, auditOutcomeFailure, codes.NotFound},
+		{"denied destroy", vmservicepb.VMService_DestroyVM_FullMethodName, "readonly", nil, true, auditOutcomeDenied, codes.PermissionDenied},
+		{"unmapped", "/cbox.v1.VMService/Unmapped", "admin", nil, true, auditOutcomeDenied, codes.PermissionDenied},
+		{"read", vmservicepb.VMService_ListVM_FullMethodName, "readonly", nil, false, "", codes.OK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newGRPCTestServer(t)
+			handled := false
+			handler := func(ctx context.Context, req any) (any, error) {
+				handled = true
+				return &vmservicepb.DestroyVMResponse{}, tc.err
+			}
+			_, err := s.grpcUnaryInterceptor(bearer(tc.token), &vmservicepb.DestroyVMRequest{VmName: "vm1"},
+				&grpc.UnaryServerInfo{FullMethod: tc.method}, handler)
+			if status.Code(err) != tc.code {
+				t.Errorf("call = %v, want %s", err, tc.code)
+			}
+			if handled != (tc.outcome != auditOutcomeDenied) {
+				t.Errorf("handler ran = %t for outcome %q", handled, tc.outcome)
+			}
+
+			entries := s.audit.query("", time.Time{}, 10)
+			if !tc.audited {
+				if len(entries) != 0 {
+					t.Errorf("audit entries = %+v, want none", entries)
+				}
+				return
+			}
+			if len(entries) != 1 {
+				t.Fatalf("audit entries = %+v, want 1", entries)
+			}
+			entry := entries[0]
+			principal := map[string]string{"operator": "ci", "readonly": "monitoring", "admin": "root"}[tc.token]
+			if entry.Method != auditMethodGRPC || entry.Route != tc.method || entry.VMName != "vm1" ||
+				entry.Principal != principal || entry.Outcome != tc.outcome || entry.Status != int(tc.code) || entry.RequestID == "" {
+				t.Errorf("audit entry = %+v, want %s of vm1 by %s with outcome %s", entry, tc.method, principal, tc.outcome)
+			}
+		})
+	}
+}
+
+// fakeServerStream is a grpc.ServerStream with only a context.
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (st *fakeServerStream) Context() context.Context {
+	return st.ctx
+}
+
+func TestGRPCStreamAudit(t *testing.T) {
+	s := newGRPCTestServer(t)
+	// Like VMExec, the handler names the VM once it has read the request.
+	handler := func(srv any, stream grpc.ServerStream) error {
+		setAuditVMName(stream.Context(), "vm1")
+		return nil
+	}
+	info := &grpc.StreamServerInfo{FullMethod: vmservicepb.VMService_VMExec_FullMethodName}
+	if err := s.grpcStreamInterceptor(nil, &fakeServerStream{ctx: bearer("operator")}, info, handler); err != nil {
+		t.Fatalf("VMExec: %v", err)
+	}
+	if err := s.grpcStreamInterceptor(nil, &fakeServerStream{ctx: bearer("readonly")}, info, handler); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("VMExec as readonly = %v, want PermissionDenied", err)
+	}
+
+	entries := s.audit.query("", time.Time{}, 10)
+	if len(entries) != 2 {
+		t.Fatalf("audit entries = %+v, want 2", entries)
+	}
+	// Newest first.
+	if denied := entries[0]; denied.Outcome != auditOutcomeDenied || denied.Principal != "monitoring" {
+		t.Errorf("denied exec entry = %+v, want denied for monitoring", denied)
+	}
+	if exec := entries[1]; exec.Outcome != auditOutcomeSuccess || exec.Principal != "ci" || exec.VMName != "vm1" {
+		t.Errorf("exec entry = %+v, want success for ci on vm1", exec)
+	}
+}
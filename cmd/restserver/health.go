@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/server"
+)
+
+const (
+	readyStatusReady    = "ready"
+	readyStatusStarting = "starting"
+)
+
+// healthCheck handles GET /v1/health, for load balancers and liveness
+// probes. It fails with 503 only once a critical dependency is broken; a
+// server still starting is alive.
+func (s *restServer) healthCheck(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		writeJSON(w, r, http.StatusOK, &serverapi.HealthResponse{
+			Status:    serverapi.PtrString(server.HealthStatusStarting),
+			Timestamp: serverapi.PtrTime(time.Now().UTC()),
+		})
+		return
+	}
+
+	resp := s.vmServer.Health()
+	code := http.StatusOK
+	if resp.GetStatus() == server.HealthStatusUnhealthy {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, r, code, resp)
+}
+
+// readyCheck handles GET /v1/ready, for readiness probes.
+func (s *restServer) readyCheck(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		writeJSON(w, r, http.StatusServiceUnavailable, &serverapi.ReadyResponse{Status: serverapi.PtrString(readyStatusStarting)})
+		return
+	}
+	writeJSON(w, r, http.StatusOK, &serverapi.ReadyResponse{Status: serverapi.PtrString(readyStatusReady)})
+}
+
+// requireReady fails requests with 503 until the server is ready.
+func (s *restServer) requireReady(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Load() {
+			w.Header().Set("Retry-After", "1")
+			sendErrorResponse(
+				w,
+				http.StatusServiceUnavailable,
+				"Server is starting")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+// internalCallbackPort is where guests' vsockserver posts HTTP callbacks on
+// its gateway, the bridge IP.
+const internalCallbackPort = "7000"
+
+// listenReusePort listens on addr with SO_REUSEPORT. Only the guest listener
+// uses it; the main listener binds plainly so a second restserver fails with
+// EADDRINUSE instead of sharing its port.
+func listenReusePort(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// newInternalServer starts the guest listener, which serves the internal
+// callback endpoint on the bridge IP so it can't be reached through the main
+// listener. It returns nil without bridge networking or with
+// disable_http_callback_endpoint set.
+func newInternalServer(s *restServer, serverConfig *config.ServerConfig) (*http.Server, error) {
+	if !serverConfig.BridgeNetworking() || serverConfig.DisableHTTPCallbackEndpoint {
+		return nil, nil
+	}
+
+	bridgeHost, _, _ := strings.Cut(serverConfig.BridgeIP, "/")
+	if serverConfig.Host == bridgeHost && serverConfig.Port == internalCallbackPort {
+		// SO_REUSEPORT would balance connections between the two listeners.
+		return nil, fmt.Errorf("host %s:%s is the guest callback listener's address, use another port or disable_http_callback_endpoint", serverConfig.Host, serverConfig.Port)
+	}
+	listener, err := listenReusePort(net.JoinHostPort(bridgeHost, internalCallbackPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for guest callbacks: %w", err)
+	}
+
+	internalSrv := &http.Server{
+		Handler: requestLog(newRouter(s, routeInternal)),
+	}
+	go func() {
+		log.Printf("cbox-restserver guest callbacks listening on: %s", listener.Addr())
+		if err := internalSrv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to serve guest callbacks: %v", err)
+		}
+	}()
+	return internalSrv, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+func TestInternalCallbackListenerOnly(t *testing.T) {
+	s := newTestRESTServer(t)
+	const path = "/v1/internal/callback"
+
+	for _, adminPort := range []string{"", "7001"} {
+		main := newRouter(s, mainRouteClasses(&config.ServerConfig{AdminPort: adminPort})...)
+		if got := serve(main, "POST", path, ""); got != http.StatusNotFound {
+			t.Errorf("POST %s on the main listener with admin_port %q = %d, want 404", path, adminPort, got)
+		}
+	}
+	// The guest listener serves it: the empty body gets as far as the
+	// handler.
+	if got := serve(newRouter(s, routeInternal), "POST", path, ""); got != http.StatusBadRequest {
+		t.Errorf("POST %s on the guest listener = %d, want 400", path, got)
+	}
+	if got := serve(newRouter(s, routeInternal), "GET", "/v1/vms", ""); got != http.StatusNotFound {
+		t.Errorf("GET /v1/vms on the guest listener = %d, want 404", got)
+	}
+}
+
+func TestNewInternalServerDisabled(t *testing.T) {
+	for name, cfg := range map[string]*config.ServerConfig{
+		"external network mode":          {NetworkMode: config.NetworkModeExternal, BridgeIP: "10.20.1.1/24"},
+		"disable_http_callback_endpoint": {NetworkMode: config.NetworkModeBridge, BridgeIP: "10.20.1.1/24", DisableHTTPCallbackEndpoint: true},
+	} {
+		srv, err := newInternalServer(newTestRESTServer(t), cfg)
+		if srv != nil || err != nil {
+			t.Errorf("%s: newInternalServer = %v, %v, want nil", name, srv, err)
+		}
+	}
+	// The main listener can't take the guest listener's address.
+	cfg := &config.ServerConfig{NetworkMode: config.NetworkModeBridge, BridgeIP: "10.20.1.1/24", Host: "10.20.1.1", Port: internalCallbackPort}
+	if _, err := newInternalServer(newTestRESTServer(t), cfg); err == nil {
+		t.Error("newInternalServer on the main listener's address succeeded")
+	}
+}
+
+// fakeCallbackRouter stands in for the VM server, with VMs attached at the
+// IPs in owners.
+type fakeCallbackRouter struct {
+	lock   sync.Mutex
+	owners map[string]string
+	// routed are the VMs of the callbacks routed.
+	routed []string
+	// beforeRoute, if set, runs before a callback is routed.
+	beforeRoute func()
+}
+
+func (f *fakeCallbackRouter) GetVMNameByIP(ip net.IP) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if owner, ok := f.owners[ip.String()]; ok {
+		return owner, nil
+	}
+	return "", fmt.Errorf("no VM found for IP %s", ip)
+}
+
+func (f *fakeCallbackRouter) RouteCallback(ctx context.Context, vmName string, method string, params json.RawMessage) (json.RawMessage, error) {
+	if f.beforeRoute != nil {
+		f.beforeRoute()
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !slices.Contains(slices.Collect(maps.Values(f.owners)), vmName) {
+		return nil, fmt.Errorf("no active callback session for VM: %s", vmName)
+	}
+	f.routed = append(f.routed, vmName)
+	return json.RawMessage(`"ok"`), nil
+}
+
+// destroy forgets the VM attached at ip.
+func (f *fakeCallbackRouter) destroy(ip string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.owners, ip)
+}
+
+// postCallback posts a callback claiming to be from vmName with params from
+// remoteAddr to the guest listener of s.
+func postCallback(s *restServer, remoteAddr string, vmName string, params string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(InternalCallbackRequest{VMName: vmName, Method: "tools/run", Params: json.RawMessage(params)})
+	req := httptest.NewRequest(http.MethodPost, "/v1/internal/callback", bytes.NewReader(body))
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	newRouter(s, routeInternal).ServeHTTP(rec, req)
+	return rec
+}
+
+// newCallbackRESTServer returns a REST server whose guest callbacks go to a
+// fakeCallbackRouter with vm1 at 10.20.1.2 and vm2 at 10.20.1.3.
+func newCallbackRESTServer(t *testing.T) (*restServer, *fakeCallbackRouter) {
+	t.Helper()
+	router := &fakeCallbackRouter{owners: map[string]string{"10.20.1.2": "vm1", "10.20.1.3": "vm2"}}
+	s := newTestRESTServer(t)
+	s.callbacks = router
+	s.maxCallbackParamsBytes = 1024
+	return s, router
+}
+
+func TestInternalCallbackOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		vmName     string
+		want       int
+	}{
+		{"bridged from the VM's IP", "10.20.1.2:41000", "vm1", http.StatusOK},
+		{"IPv4-mapped VM IP", "[::ffff:10.20.1.2]:41000", "vm1", http.StatusOK},
+		{"from another VM", "10.20.1.3:41000", "vm1", http.StatusForbidden},
+		{"NATed to the bridge IP", "10.20.1.1:41000", "vm1", http.StatusForbidden},
+		{"NATed to a host address", "192.168.1.10:41000", "vm1", http.StatusForbidden},
+		{"loopback", "127.0.0.1:41000", "vm1", http.StatusForbidden},
+		{"unparseable address", "10.20.1.2", "vm1", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, router := newCallbackRESTServer(t)
+			rec := postCallback(s, tc.remoteAddr, tc.vmName, `{}`)
+			if rec.Code != tc.want {
+				t.Errorf("callback = %d %s, want %d", rec.Code, rec.Body.String(), tc.want)
+			}
+			if routed := len(router.routed) > 0; routed != (tc.want == http.StatusOK) {
+				t.Errorf("routed = %v, want it routed only when accepted", router.routed)
+			}
+		})
+	}
+}
+
+func TestInternalCallbackVMDestroyed(t *testing.T) {
+	t.Run("before the origin check", func(t *testing.T) {
+		s, router := newCallbackRESTServer(t)
+		router.destroy("10.20.1.2")
+		if rec := postCallback(s, "10.20.1.2:41000", "vm1", `{}`); rec.Code != http.StatusForbidden {
+			t.Errorf("callback = %d, want 403", rec.Code)
+		}
+	})
+
+	t.Run("IP reused by another VM", func(t *testing.T) {
+		s, router := newCallbackRESTServer(t)
+		// vm1 is destroyed and its IP goes to vm3; a callback vm1 sent
+		// before it died must not be routed as vm3's or vm1's.
+		router.destroy("10.20.1.2")
+		router.owners["10.20.1.2"] = "vm3"
+		if rec := postCallback(s, "10.20.1.2:41000", "vm1", `{}`); rec.Code != http.StatusForbidden {
+			t.Errorf("callback = %d, want 403", rec.Code)
+		}
+		if len(router.routed) != 0 {
+			t.Errorf("routed = %v, want nothing", router.routed)
+		}
+	})
+
+	t.Run("after the origin check", func(t *testing.T) {
+		s, router := newCallbackRESTServer(t)
+		router.beforeRoute = func() { router.destroy("10.20.1.2") }
+		rec := postCallback(s, "10.20.1.2:41000", "vm1", `{}`)
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("callback = %d, want 500", rec.Code)
+		}
+		if len(router.routed) != 0 {
+			t.Errorf("routed = %v, want nothing", router.routed)
+		}
+	})
+}
+
+func TestInternalCallbackParamsLimit(t *testing.T) {
+	// A JSON string of exactly n bytes.
+	params := func(n int) string { return `"` + strings.Repeat("x", n-2) + `"` }
+	for _, tc := range []struct {
+		name   string
+		params string
+		want   int
+	}{
+		{"at the limit", params(1024), http.StatusOK},
+		{"one byte over", params(1025), http.StatusRequestEntityTooLarge},
+		{"past the body limit", params(1024 + callbackEnvelopeBytes + 1), http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, router := newCallbackRESTServer(t)
+			rec := postCallback(s, "10.20.1.2:41000", "vm1", tc.params)
+			if rec.Code != tc.want {
+				t.Errorf("callback with %d bytes of params = %d %s, want %d", len(tc.params), rec.Code, rec.Body.String(), tc.want)
+			}
+			if routed := len(router.routed) > 0; routed != (tc.want == http.StatusOK) {
+				t.Errorf("routed = %v, want it routed only when accepted", router.routed)
+			}
+		})
+	}
+}
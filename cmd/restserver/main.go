@@ -3,20 +3,37 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/abilashraghuram/cbox/out/gen/serverapi"
 	"github.com/abilashraghuram/cbox/pkg/callback"
 	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/events"
+	"github.com/abilashraghuram/cbox/pkg/faults"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
 	"github.com/abilashraghuram/cbox/pkg/server"
 )
 
@@ -31,31 +48,182 @@ func sendErrorResponse(w http.ResponseWriter, statusCode int, message string) {
 			Message: &message,
 		},
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(resp)
+	writeJSON(w, nil, statusCode, resp)
+}
+
+// sendStartVMErrorResponse sends an error response, including the
+// hypervisor log tail if the error carries one. If the host ran out of IPs or
+// CIDs it responds with 503 and a RESOURCES_EXHAUSTED code instead, and if
+// the VM already exists with 409, a VM_EXISTS code and the existing VM.
+func sendStartVMErrorResponse(w http.ResponseWriter, statusCode int, message string, err error) {
+	var existsErr *server.VMExistsError
+	if errors.As(err, &existsErr) {
+		resp := serverapi.ErrorResponse{
+			Error: &serverapi.ErrorResponseError{
+				Message: &message,
+				Code:    serverapi.PtrString("VM_EXISTS"),
+				Details: &serverapi.ErrorResponseErrorDetails{
+					Vm: existsErr.VM,
+				},
+			},
+		}
+		writeJSON(w, nil, http.StatusConflict, resp)
+		return
+	}
+
+	var exhaustedErr *server.AllocatorExhaustedError
+	if errors.As(err, &exhaustedErr) {
+		resp := serverapi.ErrorResponse{
+			Error: &serverapi.ErrorResponseError{
+				Message: &message,
+				Code:    serverapi.PtrString("RESOURCES_EXHAUSTED"),
+				Details: &serverapi.ErrorResponseErrorDetails{
+					Allocator: &exhaustedErr.Allocator,
+				},
+			},
+		}
+		writeJSON(w, nil, http.StatusServiceUnavailable, resp)
+		return
+	}
+
+	var hvErr *server.HypervisorError
+	if !errors.As(err, &hvErr) {
+		sendErrorResponse(w, statusCode, message)
+		return
+	}
+
+	resp := serverapi.ErrorResponse{
+		Error: &serverapi.ErrorResponseError{
+			Message: &message,
+			Details: &serverapi.ErrorResponseErrorDetails{
+				HypervisorLogTail: &hvErr.LogTail,
+			},
+		},
+	}
+	writeJSON(w, nil, statusCode, resp)
+}
+
+// sendVMErrorResponse sends an error response for a request to a VM. If the
+// VM was busy with an administrative operation it responds with 503, a
+// VM_BUSY code and a Retry-After header instead of statusCode. If the VM is
+// leased to someone else it responds with 423 and a VM_LEASED code. If the
+// VM's agent can't serve the request it responds with 409 and an
+// UNSUPPORTED_AGENT code.
+func sendVMErrorResponse(w http.ResponseWriter, statusCode int, message string, err error) {
+	var agentErr *server.UnsupportedAgentError
+	if errors.As(err, &agentErr) {
+		details := &serverapi.ErrorResponseErrorDetails{
+			Agent:        &agentErr.Agent,
+			AgentVersion: &agentErr.Version,
+		}
+		if agentErr.Feature != "" {
+			details.Feature = &agentErr.Feature
+		}
+		resp := serverapi.ErrorResponse{
+			Error: &serverapi.ErrorResponseError{
+				Message: &message,
+				Code:    serverapi.PtrString("UNSUPPORTED_AGENT"),
+				Details: details,
+			},
+		}
+		writeJSON(w, nil, http.StatusConflict, resp)
+		return
+	}
+
+	var leaseErr *server.LeaseHeldError
+	if errors.As(err, &leaseErr) {
+		resp := serverapi.ErrorResponse{
+			Error: &serverapi.ErrorResponseError{
+				Message: &message,
+				Code:    serverapi.PtrString("VM_LEASED"),
+				Details: &serverapi.ErrorResponseErrorDetails{
+					LeaseHolder:    &leaseErr.Holder,
+					LeaseExpiresAt: &leaseErr.ExpiresAt,
+				},
+			},
+		}
+		writeJSON(w, nil, http.StatusLocked, resp)
+		return
+	}
+
+	var busyErr *server.BusyError
+	if !errors.As(err, &busyErr) {
+		sendErrorResponse(w, statusCode, message)
+		return
+	}
+
+	waitSeconds := int32(math.Ceil(busyErr.EstimatedWait.Seconds()))
+	resp := serverapi.ErrorResponse{
+		Error: &serverapi.ErrorResponseError{
+			Message: &message,
+			Code:    serverapi.PtrString("VM_BUSY"),
+			Details: &serverapi.ErrorResponseErrorDetails{
+				Operation:            &busyErr.Operation,
+				EstimatedWaitSeconds: &waitSeconds,
+			},
+		},
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(max(waitSeconds, 1))))
+	writeJSON(w, nil, http.StatusServiceUnavailable, resp)
 }
 
 type restServer struct {
 	vmServer       *server.Server
 	sessionManager *callback.SessionManager
+	// callbacks, if set, routes guest callbacks instead of vmServer.
+	callbacks callbackRouter
+	// starter, if set, starts VMs instead of vmServer.
+	starter vmStarter
+	// disableHTTPCallback leaves out the internal HTTP callback endpoint.
+	disableHTTPCallback bool
+	// apiTokens maps bearer tokens to their role. Nil disables authorization.
+	apiTokens map[string]config.APIToken
+	// adminTokens, if set, are the only bearer tokens accepted, in place of
+	// apiTokens. Only the admin listener sets them.
+	adminTokens []string
+	// maxExecRequestBytes bounds the body of exec requests.
+	maxExecRequestBytes int64
+	// maxCallbackParamsBytes bounds the params of guest callbacks.
+	maxCallbackParamsBytes int64
+	// audit records the calls to audited routes.
+	audit *auditLogger
+	// ready is set once vmServer is, which is after the VMs of the previous
+	// run are re-adopted. Only public routes are served until then.
+	ready atomic.Bool
 }
 
-// Health check endpoint for load balancer monitoring
-func (s *restServer) healthCheck(w http.ResponseWriter, r *http.Request) {
-	response := map[string]interface{}{
-		"status":    "healthy",
-		"timestamp": time.Now().UTC().Format(time.RFC3339),
+// callbackRouter checks where guest callbacks come from and routes them.
+// *server.Server implements it.
+type callbackRouter interface {
+	GetVMNameByIP(ip net.IP) (string, error)
+	RouteCallback(ctx context.Context, vmName string, method string, params json.RawMessage) (json.RawMessage, error)
+}
+
+// guestCallbacks returns what guest callbacks are routed through.
+func (s *restServer) guestCallbacks() callbackRouter {
+	if s.callbacks != nil {
+		return s.callbacks
 	}
+	return s.vmServer
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+// vmStarter starts VMs. *server.Server implements it.
+type vmStarter interface {
+	StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error)
+	StartVMAsync(req *serverapi.StartVMRequest, onStarted func(*serverapi.StartVMResponse)) (*serverapi.Operation, error)
+}
+
+// startServer returns what VMs are started through.
+func (s *restServer) startServer() vmStarter {
+	if s.starter != nil {
+		return s.starter
+	}
+	return s.vmServer
 }
 
 // startVM handles POST /v1/vms
 func (s *restServer) startVM(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "startVM")
+	logger := log.WithContext(r.Context()).WithField("api", "startVM")
 	startTime := time.Now()
 
 	var req serverapi.StartVMRequest
@@ -68,145 +236,2122 @@ func (s *restServer) startVM(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.GetVmName() == "" {
-		logger.Error("Empty vm name")
+	if req.GetVmName() == "" {
+		logger.Error("Empty vm name")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"Empty vm name")
+		return
+	}
+
+	vmName := req.GetVmName()
+	setAuditVMName(r.Context(), vmName)
+	if req.GetAsync() {
+		op, err := s.startServer().StartVMAsync(&req, func(*serverapi.StartVMResponse) {
+			s.registerCallbacks(logger, &req)
+		})
+		if err != nil {
+			logger.WithField("vmName", vmName).WithError(err).Error("Failed to start VM")
+			sendStartVMErrorResponse(
+				w,
+				startVMErrorStatus(err),
+				fmt.Sprintf("Failed to start VM: %v", err),
+				err)
+			return
+		}
+		writeJSON(w, r, http.StatusAccepted, op)
+		return
+	}
+
+	resp, err := s.startServer().StartVM(r.Context(), &req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to start VM")
+		sendStartVMErrorResponse(
+			w,
+			startVMErrorStatus(err),
+			fmt.Sprintf("Failed to start VM: %v", err),
+			err)
+		return
+	}
+
+	s.registerCallbacks(logger, &req)
+
+	elapsedTime := time.Since(startTime)
+	logger.WithFields(log.Fields{
+		"vmName":      vmName,
+		"startupTime": elapsedTime.String(),
+	}).Info("VM started successfully")
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// startVMErrorStatus maps an error from starting a VM, synchronously or not,
+// to an HTTP status. Starts of a name that exists or is being started are
+// conflicts.
+func startVMErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.AlreadyExists, codes.FailedPrecondition:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// vmErrorStatus maps an error from a request for a single VM to an HTTP
+// status, so clients that retry on 5xx don't retry missing VMs or bad input.
+func vmErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// registerCallbacks registers the callback URLs of a started VM, if it has
+// any, with the session manager. Failures are only logged.
+func (s *restServer) registerCallbacks(logger *log.Entry, req *serverapi.StartVMRequest) {
+	vmName := req.GetVmName()
+	callbackUrls := req.GetCallbackUrls()
+	if callbackUrl := req.GetCallbackUrl(); callbackUrl != "" {
+		callbackUrls = append([]string{callbackUrl}, callbackUrls...)
+	}
+	if len(callbackUrls) == 0 {
+		return
+	}
+
+	callbackTransport := req.GetCallbackTransport()
+	if callbackTransport == "" {
+		callbackTransport = callback.TransportHTTP
+	}
+	fields := log.Fields{
+		"vmName":            vmName,
+		"callbackUrls":      callbackUrls,
+		"callbackTransport": callbackTransport,
+		"callbackSigned":    req.GetCallbackSecret() != "",
+	}
+
+	var err error
+	switch callbackTransport {
+	case callback.TransportHTTP:
+		_, err = s.sessionManager.RegisterHTTPFailoverCallback(vmName, callbackUrls, req.GetCallbackSecret(), req.GetAllowedCallbackMethods())
+	case callback.TransportNATS:
+		if len(callbackUrls) > 1 {
+			err = fmt.Errorf("callbackUrls is only supported with the http transport")
+			break
+		}
+		if req.GetCallbackSecret() != "" {
+			err = fmt.Errorf("callbackSecret is only supported with the http transport")
+			break
+		}
+		_, err = s.sessionManager.RegisterNATSCallback(vmName, callbackUrls[0], req.GetCallbackSubject(), req.GetAllowedCallbackMethods())
+	default:
+		err = fmt.Errorf("unknown callback transport: %s", callbackTransport)
+	}
+	if err != nil {
+		logger.WithFields(fields).WithError(err).Warn("Failed to register callback, callbacks will not work")
+	} else {
+		logger.WithFields(fields).Info("Registered callback for VM")
+	}
+}
+
+// callbackRegistration describes a callback session for the API. Passwords
+// in its URL are redacted; the signing secret is never returned.
+func callbackRegistration(session *callback.Session) *serverapi.CallbackRegistration {
+	callbackURL := session.CallbackURL
+	if parsed, err := url.Parse(callbackURL); err == nil {
+		callbackURL = parsed.Redacted()
+	}
+	return &serverapi.CallbackRegistration{
+		SessionId:   serverapi.PtrString(session.ID),
+		CallbackUrl: serverapi.PtrString(callbackURL),
+		Transport:   serverapi.PtrString(session.Transport),
+		Signed:      serverapi.PtrBool(session.Signed),
+
+		AllowedCallbackMethods: session.AllowedMethods,
+	}
+}
+
+// getCallback handles GET /v1/vms/{name}/callback
+func (s *restServer) getCallback(w http.ResponseWriter, r *http.Request) {
+	vmName := mux.Vars(r)["name"]
+
+	if !s.vmServer.HasVM(vmName) {
+		sendErrorResponse(
+			w,
+			http.StatusNotFound,
+			fmt.Sprintf("vm not found: %s", vmName))
+		return
+	}
+	session := s.sessionManager.GetSession(vmName)
+	if session == nil {
+		sendErrorResponse(
+			w,
+			http.StatusNotFound,
+			fmt.Sprintf("no callback registered for vm: %s", vmName))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, callbackRegistration(session))
+}
+
+// setCallback handles PUT /v1/vms/{name}/callback
+func (s *restServer) setCallback(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "setCallback")
+	vmName := mux.Vars(r)["name"]
+
+	var req serverapi.SetCallbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+	callbackURL, err := url.Parse(req.GetCallbackUrl())
+	if err != nil || (callbackURL.Scheme != "http" && callbackURL.Scheme != "https") || callbackURL.Host == "" {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"callbackUrl must be an http or https URL")
+		return
+	}
+	if !s.vmServer.HasVM(vmName) {
+		sendErrorResponse(
+			w,
+			http.StatusNotFound,
+			fmt.Sprintf("vm not found: %s", vmName))
+		return
+	}
+
+	// Replacing the receiver mustn't lift the restrictions on the guest.
+	var allowedMethods []string
+	if existing := s.sessionManager.GetSession(vmName); existing != nil {
+		allowedMethods = existing.AllowedMethods
+	}
+	session, err := s.sessionManager.RegisterHTTPCallback(vmName, req.GetCallbackUrl(), req.GetCallbackSecret(), allowedMethods)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to register callback")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to register callback: %v", err))
+		return
+	}
+	// The VM may have been destroyed, and its session removed, meanwhile.
+	if !s.vmServer.HasVM(vmName) {
+		s.sessionManager.RemoveSession(vmName)
+		sendErrorResponse(
+			w,
+			http.StatusNotFound,
+			fmt.Sprintf("vm not found: %s", vmName))
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"vmName":    vmName,
+		"sessionId": session.ID,
+	}).Info("Updated callback for VM")
+	writeJSON(w, r, http.StatusOK, callbackRegistration(session))
+}
+
+// deleteCallback handles DELETE /v1/vms/{name}/callback
+func (s *restServer) deleteCallback(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "deleteCallback")
+	vmName := mux.Vars(r)["name"]
+
+	if !s.vmServer.HasVM(vmName) {
+		sendErrorResponse(
+			w,
+			http.StatusNotFound,
+			fmt.Sprintf("vm not found: %s", vmName))
+		return
+	}
+	s.sessionManager.RemoveSession(vmName)
+
+	logger.WithField("vmName", vmName).Info("Removed callback for VM")
+	writeJSON(w, r, http.StatusOK, serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	})
+}
+
+// getCallbackQueue handles GET /v1/vms/{name}/callbacks/queue
+func (s *restServer) getCallbackQueue(w http.ResponseWriter, r *http.Request) {
+	vmName := mux.Vars(r)["name"]
+
+	if !s.vmServer.HasVM(vmName) {
+		sendErrorResponse(
+			w,
+			http.StatusNotFound,
+			fmt.Sprintf("vm not found: %s", vmName))
+		return
+	}
+
+	queue := s.sessionManager.QueueStatus(vmName)
+	resp := serverapi.CallbackQueueStatus{
+		Enabled:  serverapi.PtrBool(queue.Enabled),
+		Depth:    serverapi.PtrInt32(int32(queue.Depth)),
+		Capacity: serverapi.PtrInt32(int32(queue.Capacity)),
+		Dropped:  serverapi.PtrInt64(int64(queue.Dropped)),
+	}
+	if !queue.OldestQueuedAt.IsZero() {
+		resp.OldestAgeSeconds = serverapi.PtrInt64(int64(time.Since(queue.OldestQueuedAt).Seconds()))
+	}
+	resp.DeadLetters = []serverapi.CallbackDeadLetter{}
+	for _, letter := range queue.DeadLetters {
+		resp.DeadLetters = append(resp.DeadLetters, serverapi.CallbackDeadLetter{
+			Id:        serverapi.PtrString(letter.Request.ID),
+			Method:    serverapi.PtrString(letter.Request.Method),
+			Params:    serverapi.PtrString(string(letter.Request.Params)),
+			Attempts:  serverapi.PtrInt32(int32(letter.Attempts)),
+			Reason:    serverapi.PtrString(letter.Reason),
+			DroppedAt: serverapi.PtrTime(letter.DroppedAt),
+		})
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// defaultCallbackHistoryLimit is how many entries the callback history
+// returns without a limit parameter.
+const defaultCallbackHistoryLimit = 100
+
+// getCallbackHistory handles GET /v1/vms/{name}/callbacks/history. Entries
+// outlive their VM until they're evicted.
+func (s *restServer) getCallbackHistory(w http.ResponseWriter, r *http.Request) {
+	vmName := mux.Vars(r)["name"]
+
+	limit := defaultCallbackHistoryLimit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("limit must be a positive integer, got %q", limitParam))
+			return
+		}
+	}
+
+	entries := s.sessionManager.AuditLog(callback.AuditQuery{
+		VMName: vmName,
+		Method: r.URL.Query().Get("method"),
+		Limit:  limit,
+	})
+	resp := serverapi.CallbackHistoryResponse{
+		Entries: []serverapi.CallbackHistoryEntry{},
+	}
+	for _, entry := range entries {
+		item := serverapi.CallbackHistoryEntry{
+			Time:            serverapi.PtrTime(entry.Time),
+			Method:          serverapi.PtrString(entry.Method),
+			CallbackId:      serverapi.PtrString(entry.CallbackID),
+			ParamsSize:      serverapi.PtrInt64(int64(entry.ParamsSize)),
+			Params:          serverapi.PtrString(entry.Params),
+			ParamsTruncated: serverapi.PtrBool(entry.ParamsTruncated),
+			DurationMs:      serverapi.PtrInt64(entry.Duration.Milliseconds()),
+			Queued:          serverapi.PtrBool(entry.Queued),
+		}
+		if entry.URL != "" {
+			auditURL := entry.URL
+			if parsed, err := url.Parse(auditURL); err == nil {
+				auditURL = parsed.Redacted()
+			}
+			item.Url = serverapi.PtrString(auditURL)
+		}
+		if entry.StatusCode != 0 {
+			item.StatusCode = serverapi.PtrInt32(int32(entry.StatusCode))
+		}
+		if entry.Error != "" {
+			item.Error = serverapi.PtrString(entry.Error)
+		}
+		resp.Entries = append(resp.Entries, item)
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// getOperation handles GET /v1/operations/{id}
+func (s *restServer) getOperation(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "getOperation")
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.GetOperation(id)
+	if err != nil {
+		logger.WithField("operation", id).WithError(err).Error("Failed to get operation")
+		sendErrorResponse(
+			w,
+			vmErrorStatus(err),
+			fmt.Sprintf("Failed to get operation: %v", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// destroyVM handles DELETE /v1/vms/{name}
+func (s *restServer) destroyVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "destroyVM")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	logger.WithField("vmName", vmName).Info("Destroying VM")
+
+	ctx := leaseContext(r)
+	if breakLease, _ := strconv.ParseBool(r.URL.Query().Get("breakLease")); breakLease {
+		if !s.hasPermission(r, permAdmin) {
+			sendErrorResponse(
+				w,
+				http.StatusForbidden,
+				"breakLease requires the admin role")
+			return
+		}
+		ctx = server.WithBreakLease(ctx)
+	}
+
+	resp, err := s.vmServer.DestroyVM(ctx, vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to destroy VM")
+		sendVMErrorResponse(
+			w,
+			vmErrorStatus(err),
+			fmt.Sprintf("Failed to destroy VM: %v", err),
+			err)
+		return
+	}
+
+	// Remove callback session if exists
+	s.sessionManager.RemoveSession(vmName)
+
+	logger.WithField("vmName", vmName).Info("VM destroyed successfully")
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// destroyAllVMs handles DELETE /v1/vms
+func (s *restServer) destroyAllVMs(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "destroyAllVMs")
+	logger.Info("Destroying all VMs")
+
+	resp, err := s.vmServer.DestroyAllVMs(r.Context(), labelSelectorParam(r))
+	if err != nil {
+		logger.WithError(err).Error("Failed to destroy all VMs")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.InvalidArgument {
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to destroy all VMs: %v", err))
+		return
+	}
+	if !resp.GetSuccess() {
+		logger.WithField("failed", len(resp.Failed)).Warn("Failed to destroy some VMs")
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// labelSelectorParam returns the label selector in r's query: the
+// labelSelector parameter and every label parameter, all ANDed together.
+func labelSelectorParam(r *http.Request) string {
+	query := r.URL.Query()
+	terms := query["label"]
+	if selector := query.Get("labelSelector"); selector != "" {
+		terms = append(terms, selector)
+	}
+	return strings.Join(terms, ",")
+}
+
+// listAllVMs handles GET /v1/vms
+func (s *restServer) listAllVMs(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "listAllVMs")
+
+	resp, err := s.vmServer.ListAllVMs(r.Context(), labelSelectorParam(r))
+	if err != nil {
+		logger.WithError(err).Error("Failed to list VMs")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.InvalidArgument {
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to list VMs: %v", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// listVM handles GET /v1/vms/{name}
+func (s *restServer) listVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "listVM")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	query := r.URL.Query()
+	var wait bool
+	var timeout time.Duration
+	if v := query.Get("wait"); v != "" {
+		var err error
+		if wait, err = strconv.ParseBool(v); err != nil {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid wait: %q", v))
+			return
+		}
+	}
+	if v := query.Get("timeoutSeconds"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid timeoutSeconds: %q", v))
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	var resp *serverapi.ListVMResponse
+	var err error
+	if wait {
+		resp, err = s.vmServer.WatchVM(r.Context(), vmName, query.Get("sinceStatus"), timeout)
+		if r.Context().Err() != nil {
+			// The client went away; there's no one to respond to.
+			return
+		}
+	} else {
+		resp, err = s.vmServer.ListVM(r.Context(), vmName)
+	}
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get VM info")
+		sendErrorResponse(
+			w,
+			vmErrorStatus(err),
+			fmt.Sprintf("Failed to get VM info: %v", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// getVMByCID handles GET /v1/vms/by-cid/{cid}
+func (s *restServer) getVMByCID(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "getVMByCID")
+	cid, err := strconv.ParseUint(mux.Vars(r)["cid"], 10, 32)
+	if err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid cid: %q", mux.Vars(r)["cid"]))
+		return
+	}
+
+	vmName, err := s.vmServer.GetVMNameByCID(uint32(cid))
+	var resp *serverapi.ListVMResponse
+	if err == nil {
+		resp, err = s.vmServer.ListVM(r.Context(), vmName)
+	}
+	if err != nil {
+		logger.WithField("cid", cid).WithError(err).Error("Failed to get VM info")
+		sendErrorResponse(
+			w,
+			vmErrorStatus(err),
+			fmt.Sprintf("Failed to get VM info: %v", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// getVMStats handles GET /v1/vms/{name}/stats
+func (s *restServer) getVMStats(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "getVMStats")
+	vmName := mux.Vars(r)["name"]
+
+	resp, err := s.vmServer.GetVMStats(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get VM stats")
+		sendErrorResponse(
+			w,
+			vmErrorStatus(err),
+			fmt.Sprintf("Failed to get VM stats: %v", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// listVMStats handles GET /v1/vms/stats
+func (s *restServer) listVMStats(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "listVMStats")
+
+	resp, err := s.vmServer.GetAllVMStats(r.Context())
+	if err != nil {
+		logger.WithError(err).Error("Failed to get VM stats")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to get VM stats: %v", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+const (
+	// recordHeader opts a single exec request into recording.
+	recordHeader = "X-Cbox-Record"
+	// leaseTokenHeader carries the token of the lease on the VM a request is
+	// for.
+	leaseTokenHeader = "X-Cbox-Lease-Token"
+)
+
+// leaseContext returns r's context, carrying its lease token if it has one.
+func leaseContext(r *http.Request) context.Context {
+	if token := r.Header.Get(leaseTokenHeader); token != "" {
+		return server.WithLeaseToken(r.Context(), token)
+	}
+	return r.Context()
+}
+
+// execContext returns r's lease context, marked for recording if r asks for
+// it.
+func execContext(r *http.Request) context.Context {
+	ctx := leaseContext(r)
+	if record, _ := strconv.ParseBool(r.Header.Get(recordHeader)); record {
+		return server.WithRecording(ctx)
+	}
+	return ctx
+}
+
+// vmExec handles POST /v1/vms/{name}/exec
+func (s *restServer) vmExec(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "vmExec")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	var req serverapi.VmExecRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.maxExecRequestBytes)).Decode(&req)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		logger.WithField("vmName", vmName).WithError(err).Error("Request body too large")
+		sendErrorResponse(
+			w,
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Request body must be at most %d bytes", tooLarge.Limit))
+		return
+	}
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	if req.GetCmd() == "" {
+		logger.WithField("vmName", vmName).Error("Command cannot be empty")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"Command cannot be empty")
+		return
+	}
+
+	cmd := req.GetCmd()
+	// Default to blocking if not specified
+	blocking := true
+	if req.Blocking != nil {
+		blocking = *req.Blocking
+	}
+
+	resp, err := s.vmServer.VMExec(execContext(r), vmName, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":   vmName,
+			"cmd":      cmd,
+			"blocking": blocking,
+			"success":  false,
+		}).Error("Failed to execute command")
+		sendVMErrorResponse(
+			w,
+			vmErrorStatus(err),
+			fmt.Sprintf("Failed to execute command: %v", err),
+			err)
+		return
+	}
+
+	fields := log.Fields{
+		"vmName":   vmName,
+		"cmd":      cmd,
+		"blocking": blocking,
+		"success":  true,
+	}
+	if resp.HasExitCode() {
+		fields["exitCode"] = resp.GetExitCode()
+	}
+	if resp.HasJobId() {
+		fields["job"] = resp.GetJobId()
+	}
+	logger.WithFields(fields).Info("Successfully executed command")
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// vmExecStream handles POST /v1/vms/{name}/exec/stream, copying the
+// command's output to the client as the guest writes it.
+func (s *restServer) vmExecStream(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "vmExecStream")
+	vmName := mux.Vars(r)["name"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			"Streaming is not supported")
+		return
+	}
+
+	var req serverapi.VmExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	if req.GetCmd() == "" {
+		logger.WithField("vmName", vmName).Error("Command cannot be empty")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"Command cannot be empty")
+		return
+	}
+
+	stream, err := s.vmServer.VMExecStream(leaseContext(r), vmName, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"cmd":    req.GetCmd(),
+		}).WithError(err).Error("Failed to stream command")
+		sendVMErrorResponse(
+			w,
+			vmErrorStatus(err),
+			fmt.Sprintf("Failed to execute command: %v", err),
+			err)
+		return
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := stream.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				logger.WithField("vmName", vmName).WithError(err).Warn("Client went away, killing command")
+				return
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The status is already sent; the missing final record tells the
+			// client the stream was cut short.
+			logger.WithField("vmName", vmName).WithError(err).Error("Exec stream failed")
+			return
+		}
+	}
+	logger.WithFields(log.Fields{
+		"vmName": vmName,
+		"cmd":    req.GetCmd(),
+	}).Info("Streamed command")
+}
+
+// listExecJobs handles GET /v1/vms/{name}/exec
+func (s *restServer) listExecJobs(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "listExecJobs")
+	vmName := mux.Vars(r)["name"]
+
+	resp, err := s.vmServer.ListExecJobs(leaseContext(r), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list exec jobs")
+		sendVMErrorResponse(
+			w,
+			vmErrorStatus(err),
+			fmt.Sprintf("Failed to list exec jobs: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// getExecJob handles GET /v1/vms/{name}/exec/{jobId}
+func (s *restServer) getExecJob(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "getExecJob")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	jobID := vars["jobId"]
+
+	resp, err := s.vmServer.GetExecJob(leaseContext(r), vmName, jobID)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"job":    jobID,
+		}).WithError(err).Error("Failed to get exec job")
+		sendVMErrorResponse(
+			w,
+			vmErrorStatus(err),
+			fmt.Sprintf("Failed to get exec job: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// killExecJob handles DELETE /v1/vms/{name}/exec/{jobId}
+func (s *restServer) killExecJob(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "killExecJob")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	jobID := vars["jobId"]
+
+	resp, err := s.vmServer.KillExecJob(leaseContext(r), vmName, jobID)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"job":    jobID,
+		}).WithError(err).Error("Failed to kill exec job")
+		sendVMErrorResponse(
+			w,
+			vmErrorStatus(err),
+			fmt.Sprintf("Failed to kill exec job: %v", err),
+			err)
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"vmName": vmName,
+		"job":    jobID,
+		"killed": resp.GetKilled(),
+	}).Info("Exec job killed")
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// leaseErrorStatus maps a lease error to an HTTP status. Leases held by
+// someone else are handled by sendVMErrorResponse.
+func leaseErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// acquireLease handles POST /v1/vms/{name}/lease
+func (s *restServer) acquireLease(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "acquireLease")
+	vmName := mux.Vars(r)["name"]
+
+	var req serverapi.AcquireLeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.AcquireLease(vmName, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"holder": req.Holder,
+		}).WithError(err).Error("Failed to acquire lease")
+		sendVMErrorResponse(
+			w,
+			leaseErrorStatus(err),
+			fmt.Sprintf("Failed to acquire lease: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// renewLease handles PUT /v1/vms/{name}/lease
+func (s *restServer) renewLease(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "renewLease")
+	vmName := mux.Vars(r)["name"]
+
+	var req serverapi.RenewLeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.RenewLease(leaseContext(r), vmName, &req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to renew lease")
+		sendVMErrorResponse(
+			w,
+			leaseErrorStatus(err),
+			fmt.Sprintf("Failed to renew lease: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// releaseLease handles DELETE /v1/vms/{name}/lease
+func (s *restServer) releaseLease(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "releaseLease")
+	vmName := mux.Vars(r)["name"]
+
+	if err := s.vmServer.ReleaseLease(leaseContext(r), vmName); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to release lease")
+		sendVMErrorResponse(
+			w,
+			leaseErrorStatus(err),
+			fmt.Sprintf("Failed to release lease: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	})
+}
+
+// vmExecBatch handles POST /v1/vms/{name}/exec-batch
+func (s *restServer) vmExecBatch(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "vmExecBatch")
+	vmName := mux.Vars(r)["name"]
+
+	var req serverapi.VmExecBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.VMExecBatch(execContext(r), vmName, &req)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"cmds":   len(req.Cmds),
+		}).WithError(err).Error("Failed to execute batch")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		}
+		sendVMErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to execute batch: %v", err),
+			err)
+		return
+	}
+
+	// One entry per command, so batches show up in the logs like single execs.
+	for _, result := range resp.Results {
+		logger.WithFields(log.Fields{
+			"vmName":     vmName,
+			"cmd":        result.GetCmd(),
+			"exitCode":   result.GetExitCode(),
+			"durationMs": result.GetDurationMs(),
+			"success":    result.GetError() == "",
+		}).Info("Executed batch command")
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// execFanOut handles POST /v1/exec
+func (s *restServer) execFanOut(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "execFanOut")
+	start := time.Now()
+
+	var req serverapi.ExecFanOutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.ExecFanOut(execContext(r), &req)
+	if err != nil {
+		logger.WithError(err).Error("Failed to fan out exec")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.InvalidArgument {
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to fan out exec: %v", err))
+		return
+	}
+
+	// One audit entry for the whole fan-out rather than one per VM.
+	fields := log.Fields{
+		"audit":         true,
+		"method":        r.Method,
+		"path":          r.URL.Path,
+		"remoteAddr":    r.RemoteAddr,
+		"cmd":           req.Cmd,
+		"labelSelector": req.GetLabelSelector(),
+		"targets":       resp.Summary.GetTargets(),
+		"succeeded":     resp.Summary.GetSucceeded(),
+		"failed":        resp.Summary.GetFailed() + resp.Summary.GetErrors(),
+		"skipped":       resp.Summary.GetSkipped(),
+		"cancelled":     resp.Summary.GetCancelled(),
+		"duration":      time.Since(start),
+	}
+	if token, ok := s.lookupToken(r); ok {
+		fields["tokenID"] = token.ID
+	}
+	logger.WithFields(fields).Info("exec fan-out")
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// workspaceErrorStatus maps a workspace error to an HTTP status.
+func workspaceErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.ResourceExhausted:
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// listWorkspaces handles GET /v1/vms/{name}/workspaces
+func (s *restServer) listWorkspaces(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "listWorkspaces")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.ListWorkspaces(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list workspaces")
+		sendVMErrorResponse(
+			w,
+			workspaceErrorStatus(err),
+			fmt.Sprintf("Failed to list workspaces: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// getUserScriptStatus handles GET /v1/vms/{name}/user-script
+func (s *restServer) getUserScriptStatus(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "getUserScriptStatus")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.GetUserScriptStatus(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get user script status")
+		sendVMErrorResponse(
+			w,
+			workspaceErrorStatus(err),
+			fmt.Sprintf("Failed to get user script status: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// deleteWorkspace handles DELETE /v1/vms/{name}/workspaces/{id}
+func (s *restServer) deleteWorkspace(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "deleteWorkspace")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	workspace := vars["id"]
+
+	if err := s.vmServer.DeleteWorkspace(leaseContext(r), vmName, workspace); err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":    vmName,
+			"workspace": workspace,
+		}).WithError(err).Error("Failed to delete workspace")
+		sendVMErrorResponse(
+			w,
+			workspaceErrorStatus(err),
+			fmt.Sprintf("Failed to delete workspace: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	})
+}
+
+// getFile handles GET /v1/vms/{name}/files, streaming a guest file through
+// without buffering it. Range requests and their responses pass through
+// untouched, so interrupted downloads can be resumed. With archive=true,
+// directories are streamed as tar archives.
+func (s *restServer) getFile(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "getFile")
+	vmName := mux.Vars(r)["name"]
+	filePath := r.URL.Query().Get("path")
+	archive, _ := strconv.ParseBool(r.URL.Query().Get("archive"))
+
+	file, err := s.vmServer.VMGetFile(leaseContext(r), vmName, filePath, archive, r.Header)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"path":   filePath,
+		}).WithError(err).Error("Failed to get file")
+		sendVMErrorResponse(
+			w,
+			workspaceErrorStatus(err),
+			fmt.Sprintf("Failed to get file: %v", err),
+			err)
+		return
+	}
+	defer file.Body.Close()
+
+	for _, name := range server.GuestFileResponseHeaders {
+		if value := file.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	if file.StatusCode == http.StatusOK || file.StatusCode == http.StatusPartialContent {
+		filename := path.Base(filePath)
+		if archive {
+			filename += ".tar"
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	w.WriteHeader(file.StatusCode)
+	if _, err := io.Copy(w, file.Body); err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"path":   filePath,
+		}).WithError(err).Warn("File download interrupted")
+	}
+}
+
+// putFile handles PUT /v1/vms/{name}/files, streaming the request body into
+// a guest file without buffering it.
+func (s *restServer) putFile(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "putFile")
+	vmName := mux.Vars(r)["name"]
+	query := r.URL.Query()
+	filePath := query.Get("path")
+
+	var opts server.PutFileOptions
+	if r.ContentLength >= 0 {
+		opts.Size = &r.ContentLength
+	}
+	if v := query.Get("mode"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid mode: %s", v))
+			return
+		}
+		m := uint32(mode)
+		opts.Mode = &m
+	}
+	for name, id := range map[string]**int{"uid": &opts.UID, "gid": &opts.GID} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid %s: %s", name, v))
+			return
+		}
+		*id = &n
+	}
+
+	resp, err := s.vmServer.VMPutFile(leaseContext(r), vmName, filePath, r.Body, opts)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"path":   filePath,
+		}).WithError(err).Error("Failed to put file")
+		sendVMErrorResponse(
+			w,
+			workspaceErrorStatus(err),
+			fmt.Sprintf("Failed to put file: %v", err),
+			err)
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"vmName": vmName,
+		"path":   resp.GetPath(),
+		"size":   resp.GetSize(),
+	}).Info("Uploaded file")
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// proxy handles GET /v1/vms/{name}/proxy/{port}, upgrading the connection
+// to a raw byte stream to the guest port.
+func (s *restServer) proxy(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "proxy")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	port, err := strconv.ParseUint(vars["port"], 10, 32)
+	if err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid port: %s", vars["port"]))
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "tcp") {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"Expected \"Upgrade: tcp\" header")
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			"Connection upgrades are not supported")
+		return
+	}
+
+	proxyConn, err := s.vmServer.DialProxy(leaseContext(r), vmName, uint32(port))
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"port":   port,
+		}).WithError(err).Error("Failed to open proxy")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.PermissionDenied:
+			statusCode = http.StatusForbidden
+		case codes.ResourceExhausted:
+			statusCode = http.StatusTooManyRequests
+		case codes.Unavailable:
+			statusCode = http.StatusBadGateway
+		}
+		sendVMErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to open proxy: %v", err),
+			err)
+		return
+	}
+
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to hijack connection")
+		proxyConn.Close()
+		return
+	}
+	// Hijacked connections aren't subject to the server's deadlines.
+	conn.SetDeadline(time.Time{})
+
+	bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	if err := bufrw.Flush(); err != nil {
+		conn.Close()
+		proxyConn.Close()
+		return
+	}
+
+	// Bytes the client sent right after the request may already be buffered.
+	initial := make([]byte, bufrw.Reader.Buffered())
+	bufrw.Reader.Read(initial)
+	proxyConn.Pipe(conn, initial)
+}
+
+// shell handles GET /v1/vms/{name}/shell, upgrading the connection to a
+// WebSocket bridged to an interactive shell in the guest.
+func (s *restServer) shell(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "shell")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"Expected a WebSocket upgrade")
+		return
+	}
+
+	shell, err := s.vmServer.OpenShell(leaseContext(r), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to open shell")
+		statusCode := vmErrorStatus(err)
+		if status.Code(err) == codes.Unavailable {
+			statusCode = http.StatusBadGateway
+		}
+		sendVMErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to open shell: %v", err),
+			err)
+		return
+	}
+
+	piped := false
+	websocket.Server{Handler: func(client *websocket.Conn) {
+		piped = true
+		// Hijacked connections aren't subject to the server's deadlines.
+		client.SetDeadline(time.Time{})
+		shell.Pipe(client)
+	}}.ServeHTTP(w, r)
+	if !piped {
+		// The upgrade failed.
+		shell.Close()
+	}
+}
+
+// consoleExec handles POST /v1/vms/{name}/console-exec
+func (s *restServer) consoleExec(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "consoleExec")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	var req serverapi.ConsoleExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	if req.GetCmd() == "" {
+		logger.WithField("vmName", vmName).Error("Command cannot be empty")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"Command cannot be empty")
+		return
+	}
+
+	resp, err := s.vmServer.ConsoleExec(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to execute console command")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.PermissionDenied:
+			statusCode = http.StatusForbidden
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to execute console command: %v", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// updateAgent handles POST /v1/vms/{name}/agent-update
+func (s *restServer) updateAgent(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "updateAgent")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	agent := r.URL.Query().Get("agent")
+	version := r.URL.Query().Get("version")
+
+	resp, err := s.vmServer.UpdateAgent(r.Context(), vmName, agent, version, r.Body)
+	if err != nil {
+		logger.WithFields(log.Fields{"vmName": vmName, "agent": agent}).WithError(err).Error("Failed to update agent")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.PermissionDenied:
+			statusCode = http.StatusForbidden
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.Aborted:
+			statusCode = http.StatusConflict
+		case codes.Unavailable:
+			statusCode = http.StatusServiceUnavailable
+		}
+		sendVMErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to update agent: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// templateErrorStatus maps a template error to an HTTP status.
+func templateErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.FailedPrecondition, codes.ResourceExhausted:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// convertToTemplate handles POST /v1/vms/{name}/convert-to-template
+func (s *restServer) convertToTemplate(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "convertToTemplate")
+	vmName := mux.Vars(r)["name"]
+
+	resp, err := s.vmServer.ConvertToTemplate(leaseContext(r), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to convert VM to a template")
+		sendVMErrorResponse(
+			w,
+			templateErrorStatus(err),
+			fmt.Sprintf("Failed to convert VM to a template: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// resizeErrorStatus maps a resize error to an HTTP status.
+func resizeErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.FailedPrecondition:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// resizeVM handles PATCH /v1/vms/{name}/resize
+func (s *restServer) resizeVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "resizeVM")
+	vmName := mux.Vars(r)["name"]
+
+	var req serverapi.ResizeVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.ResizeVM(leaseContext(r), vmName, &req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to resize VM")
+		sendVMErrorResponse(
+			w,
+			resizeErrorStatus(err),
+			fmt.Sprintf("Failed to resize VM: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// diskErrorStatus maps a disk attach or detach error to an HTTP status.
+func diskErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.FailedPrecondition:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// attachDisk handles POST /v1/vms/{name}/disks
+func (s *restServer) attachDisk(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "attachDisk")
+	vmName := mux.Vars(r)["name"]
+
+	var req serverapi.AttachDiskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.AttachDisk(leaseContext(r), vmName, &req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to attach disk")
+		sendVMErrorResponse(
+			w,
+			diskErrorStatus(err),
+			fmt.Sprintf("Failed to attach disk: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// detachDisk handles DELETE /v1/vms/{name}/disks/{id}
+func (s *restServer) detachDisk(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "detachDisk")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.DetachDisk(leaseContext(r), vmName, vars["id"])
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"diskId": vars["id"],
+		}).WithError(err).Error("Failed to detach disk")
+		sendVMErrorResponse(
+			w,
+			diskErrorStatus(err),
+			fmt.Sprintf("Failed to detach disk: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// pauseErrorStatus maps a pause, resume, stop or reboot error to an HTTP
+// status.
+func pauseErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.FailedPrecondition:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// pauseVM handles POST /v1/vms/{name}/pause
+func (s *restServer) pauseVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "pauseVM")
+	vmName := mux.Vars(r)["name"]
+
+	if err := s.vmServer.PauseVM(leaseContext(r), vmName); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to pause VM")
+		sendVMErrorResponse(
+			w,
+			pauseErrorStatus(err),
+			fmt.Sprintf("Failed to pause VM: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	})
+}
+
+// rebootVM handles POST /v1/vms/{name}/reboot
+func (s *restServer) rebootVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "rebootVM")
+	vmName := mux.Vars(r)["name"]
+
+	if err := s.vmServer.RebootVM(leaseContext(r), vmName); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to reboot VM")
+		sendVMErrorResponse(
+			w,
+			pauseErrorStatus(err),
+			fmt.Sprintf("Failed to reboot VM: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	})
+}
+
+// stopVM handles POST /v1/vms/{name}/stop
+func (s *restServer) stopVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "stopVM")
+	vmName := mux.Vars(r)["name"]
+
+	if err := s.vmServer.StopVM(leaseContext(r), vmName); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to stop VM")
+		sendVMErrorResponse(
+			w,
+			pauseErrorStatus(err),
+			fmt.Sprintf("Failed to stop VM: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	})
+}
+
+// resumeVM handles POST /v1/vms/{name}/resume
+func (s *restServer) resumeVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "resumeVM")
+	vmName := mux.Vars(r)["name"]
+
+	if err := s.vmServer.ResumeVM(leaseContext(r), vmName); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to resume VM")
+		sendVMErrorResponse(
+			w,
+			pauseErrorStatus(err),
+			fmt.Sprintf("Failed to resume VM: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	})
+}
+
+// snapshotErrorStatus maps a snapshot or restore error to an HTTP status.
+func snapshotErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.FailedPrecondition:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// snapshotVM handles POST /v1/vms/{name}/snapshot
+func (s *restServer) snapshotVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "snapshotVM")
+	vmName := mux.Vars(r)["name"]
+
+	// The body is optional.
+	var req serverapi.SnapshotVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.SnapshotVM(leaseContext(r), vmName, req.GetDestDir())
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to snapshot VM")
+		sendVMErrorResponse(
+			w,
+			snapshotErrorStatus(err),
+			fmt.Sprintf("Failed to snapshot VM: %v", err),
+			err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// restoreVM handles POST /v1/vms/restore
+func (s *restServer) restoreVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "restoreVM")
+
+	var req serverapi.RestoreVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	setAuditVMName(r.Context(), req.GetVmName())
+	resp, err := s.vmServer.RestoreVM(r.Context(), req.GetVmName(), req.SnapshotDir)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName":      req.GetVmName(),
+			"snapshotDir": req.SnapshotDir,
+		}).WithError(err).Error("Failed to restore VM")
+		sendErrorResponse(
+			w,
+			snapshotErrorStatus(err),
+			fmt.Sprintf("Failed to restore VM: %v", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// hostInfo handles GET /v1/host
+func (s *restServer) hostInfo(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "hostInfo")
+
+	resp, err := s.vmServer.HostInfo()
+	if err != nil {
+		logger.WithError(err).Error("Failed to get host info")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to get host info: %v", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// listTemplates handles GET /v1/templates
+func (s *restServer) listTemplates(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "listTemplates")
+
+	resp, err := s.vmServer.ListTemplates()
+	if err != nil {
+		logger.WithError(err).Error("Failed to list templates")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to list templates: %v", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// listProfiles handles GET /v1/profiles
+func (s *restServer) listProfiles(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.vmServer.ListProfiles())
+}
+
+// deleteTemplate handles DELETE /v1/templates/{name}
+func (s *restServer) deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "deleteTemplate")
+	name := mux.Vars(r)["name"]
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+
+	if err := s.vmServer.DeleteTemplate(name, force); err != nil {
+		logger.WithField("template", name).WithError(err).Error("Failed to delete template")
+		sendErrorResponse(
+			w,
+			templateErrorStatus(err),
+			fmt.Sprintf("Failed to delete template: %v", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	})
+}
+
+// instantiateTemplate handles POST /v1/templates/{name}/instantiate
+func (s *restServer) instantiateTemplate(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "instantiateTemplate")
+	name := mux.Vars(r)["name"]
+
+	var req serverapi.InstantiateTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("template", name).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.InstantiateTemplate(r.Context(), name, &req)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to instantiate template: %v", err)
+		if resp != nil && len(resp.Vms) > 0 {
+			started := make([]string, 0, len(resp.Vms))
+			for _, vm := range resp.Vms {
+				started = append(started, vm.GetVmName())
+			}
+			msg += fmt.Sprintf(" (started: %s)", strings.Join(started, ", "))
+		}
+		logger.WithField("template", name).WithError(err).Error("Failed to instantiate template")
+		sendStartVMErrorResponse(w, templateErrorStatus(err), msg, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// listArchive handles GET /v1/archive
+func (s *restServer) listArchive(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "listArchive")
+
+	resp, err := s.vmServer.ListArchive()
+	if err != nil {
+		logger.WithError(err).Error("Failed to list archive")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to list archive: %v", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// getArchivedLogs handles GET /v1/archive/{name}/logs
+func (s *restServer) getArchivedLogs(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "getArchivedLogs")
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	logs, err := s.vmServer.GetArchivedLogs(name)
+	if err != nil {
+		logger.WithField("name", name).WithError(err).Error("Failed to get archived logs")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get archived logs: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(logs)
+}
+
+// listArtifacts handles GET /v1/vms/{name}/artifacts
+func (s *restServer) listArtifacts(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "listArtifacts")
+	vmName := mux.Vars(r)["name"]
+
+	resp, err := s.vmServer.ListArtifacts(vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list artifacts")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
 		sendErrorResponse(
 			w,
-			http.StatusBadRequest,
-			"Empty vm name")
+			statusCode,
+			fmt.Sprintf("Failed to list artifacts: %v", err))
 		return
 	}
 
-	vmName := req.GetVmName()
-	callbackUrl := req.GetCallbackUrl()
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// listRecordings handles GET /v1/vms/{name}/recordings
+func (s *restServer) listRecordings(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "listRecordings")
+	vmName := mux.Vars(r)["name"]
 
-	resp, err := s.vmServer.StartVM(r.Context(), &req)
+	resp, err := s.vmServer.ListRecordings(vmName)
 	if err != nil {
-		logger.WithField("vmName", vmName).WithError(err).Error("Failed to start VM")
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list recordings")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to start VM: %v", err))
+			statusCode,
+			fmt.Sprintf("Failed to list recordings: %v", err))
 		return
 	}
 
-	// If callbackUrl is provided, register it with the session manager
-	if callbackUrl != "" {
-		_, err := s.sessionManager.RegisterHTTPCallback(vmName, callbackUrl)
-		if err != nil {
-			logger.WithFields(log.Fields{
-				"vmName":      vmName,
-				"callbackUrl": callbackUrl,
-			}).WithError(err).Warn("Failed to register HTTP callback, callbacks will not work")
-		} else {
-			logger.WithFields(log.Fields{
-				"vmName":      vmName,
-				"callbackUrl": callbackUrl,
-			}).Info("Registered HTTP callback for VM")
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// getRecording handles GET /v1/vms/{name}/recordings/{seq}
+func (s *restServer) getRecording(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "getRecording")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.GetRecording(vmName, vars["seq"])
+	if err != nil {
+		logger.WithFields(log.Fields{"vmName": vmName, "seq": vars["seq"]}).WithError(err).Error("Failed to get recording")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
 		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get recording: %v", err))
+		return
 	}
 
-	elapsedTime := time.Since(startTime)
-	logger.WithFields(log.Fields{
-		"vmName":      vmName,
-		"startupTime": elapsedTime.String(),
-	}).Info("VM started successfully")
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	writeJSON(w, r, http.StatusOK, resp)
 }
 
-// destroyVM handles DELETE /v1/vms/{name}
-func (s *restServer) destroyVM(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "destroyVM")
+// getArtifact handles GET /v1/vms/{name}/artifacts/{artifact}
+func (s *restServer) getArtifact(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "getArtifact")
 	vars := mux.Vars(r)
 	vmName := vars["name"]
+	name := vars["artifact"]
 
-	logger.WithField("vmName", vmName).Info("Destroying VM")
-
-	// Remove callback session if exists
-	s.sessionManager.RemoveSession(vmName)
+	file, err := s.vmServer.OpenArtifact(vmName, name)
+	if err != nil {
+		logger.WithFields(log.Fields{"vmName": vmName, "artifact": name}).WithError(err).Error("Failed to open artifact")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get artifact: %v", err))
+		return
+	}
+	defer file.Close()
 
-	resp, err := s.vmServer.DestroyVM(r.Context(), vmName)
+	info, err := file.Stat()
 	if err != nil {
-		logger.WithField("vmName", vmName).WithError(err).Error("Failed to destroy VM")
 		sendErrorResponse(
 			w,
 			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to destroy VM: %v", err))
+			fmt.Sprintf("Failed to get artifact: %v", err))
 		return
 	}
-
-	logger.WithField("vmName", vmName).Info("VM destroyed successfully")
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, info.ModTime(), file)
 }
 
-// destroyAllVMs handles DELETE /v1/vms
-func (s *restServer) destroyAllVMs(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "destroyAllVMs")
-	logger.Info("Destroying all VMs")
+// getCrashBundle handles GET /v1/vms/{name}/crash-bundle
+func (s *restServer) getCrashBundle(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "getCrashBundle")
+	vmName := mux.Vars(r)["name"]
 
-	resp, err := s.vmServer.DestroyAllVMs(r.Context())
+	file, name, err := s.vmServer.OpenCrashBundle(vmName)
 	if err != nil {
-		logger.WithError(err).Error("Failed to destroy all VMs")
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to open crash bundle")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to destroy all VMs: %v", err))
+			statusCode,
+			fmt.Sprintf("Failed to get crash bundle: %v", err))
 		return
 	}
+	defer file.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
-}
-
-// listAllVMs handles GET /v1/vms
-func (s *restServer) listAllVMs(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "listAllVMs")
-
-	resp, err := s.vmServer.ListAllVMs(r.Context())
+	info, err := file.Stat()
 	if err != nil {
-		logger.WithError(err).Error("Failed to list VMs")
 		sendErrorResponse(
 			w,
 			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to list VMs: %v", err))
+			fmt.Sprintf("Failed to get crash bundle: %v", err))
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, info.ModTime(), file)
 }
 
-// listVM handles GET /v1/vms/{name}
-func (s *restServer) listVM(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "listVM")
-	vars := mux.Vars(r)
-	vmName := vars["name"]
+// defaultEventReplay is how many past events /v1/events replays on connect
+// unless ?replay= says otherwise.
+const defaultEventReplay = 100
 
-	resp, err := s.vmServer.ListVM(r.Context(), vmName)
-	if err != nil {
-		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get VM info")
+// streamEvents handles GET /v1/events, streaming VM lifecycle events as
+// Server-Sent Events until the client disconnects. The last ?replay= events,
+// or those after the Last-Event-ID a reconnecting client sends, are replayed
+// first. ?vm= limits the stream to one VM's events.
+func (s *restServer) streamEvents(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "streamEvents")
+
+	query := r.URL.Query()
+	vmName := query.Get("vm")
+	replay := defaultEventReplay
+	if v := query.Get("replay"); v != "" {
+		var err error
+		replay, err = strconv.Atoi(v)
+		if err != nil || replay < 0 {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("replay must be a non-negative integer, got %q", v))
+			return
+		}
+	}
+	var lastEventID uint64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		var err error
+		lastEventID, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid Last-Event-ID: %q", v))
+			return
+		}
+		// A reconnecting client gets everything it missed that's still
+		// kept, not just the last few events.
+		replay = math.MaxInt
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
 		sendErrorResponse(
 			w,
 			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to get VM info: %v", err))
+			"Streaming is not supported")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	// Subscribe before replaying so no event falls in between; those seen in
+	// both are skipped by ID.
+	bus := s.vmServer.Events()
+	sub := bus.Subscribe(r.Context(), events.DefaultBufferSize)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	writeEvent := func(event events.Event) bool {
+		data, err := json.Marshal(event)
+		if err != nil {
+			logger.WithError(err).Error("Failed to marshal event")
+			return true
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		return err == nil
+	}
+
+	for _, event := range bus.Replay(vmName, lastEventID, replay) {
+		if !writeEvent(event) {
+			return
+		}
+		lastEventID = event.ID
+	}
+	flusher.Flush()
+
+	for {
+		event, err := sub.Next(r.Context())
+		if err != nil {
+			return
+		}
+		// A subscriber that fell behind is dropped rather than sent a stream
+		// with gaps. It reconnects with Last-Event-ID to catch up.
+		if dropped := sub.Dropped(); dropped > 0 {
+			logger.WithField("dropped", dropped).Warn("events subscriber fell behind, closing its stream")
+			return
+		}
+		if event.ID <= lastEventID || (vmName != "" && event.VMName != vmName) {
+			continue
+		}
+
+		if !writeEvent(event) {
+			return
+		}
+		flusher.Flush()
+	}
 }
 
-// vmExec handles POST /v1/vms/{name}/exec
-func (s *restServer) vmExec(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "vmExec")
-	vars := mux.Vars(r)
-	vmName := vars["name"]
+// faultErrorStatus maps a fault administration error to an HTTP status.
+func faultErrorStatus(err error) int {
+	switch status.Code(err) {
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
 
-	var req serverapi.VmExecRequest
+// addFault handles POST /v1/admin/faults
+func (s *restServer) addFault(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "addFault")
+
+	var req serverapi.FaultRule
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		logger.WithError(err).Error("Invalid request body")
 		sendErrorResponse(
 			w,
 			http.StatusBadRequest,
@@ -214,47 +2359,63 @@ func (s *restServer) vmExec(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.GetCmd() == "" {
-		logger.WithField("vmName", vmName).Error("Command cannot be empty")
+	resp, err := s.vmServer.AddFault(&req)
+	if err != nil {
+		logger.WithError(err).Error("Failed to add fault rule")
 		sendErrorResponse(
 			w,
-			http.StatusBadRequest,
-			"Command cannot be empty")
+			faultErrorStatus(err),
+			fmt.Sprintf("Failed to add fault rule: %v", err))
 		return
 	}
 
-	cmd := req.GetCmd()
-	// Default to blocking if not specified
-	blocking := true
-	if req.Blocking != nil {
-		blocking = *req.Blocking
-	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// listFaults handles GET /v1/admin/faults
+func (s *restServer) listFaults(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "listFaults")
 
-	resp, err := s.vmServer.VMExec(r.Context(), vmName, cmd, blocking)
+	resp, err := s.vmServer.ListFaults()
 	if err != nil {
-		logger.WithFields(log.Fields{
-			"vmName":   vmName,
-			"cmd":      cmd,
-			"blocking": blocking,
-			"success":  false,
-		}).Error("Failed to execute command")
+		logger.WithError(err).Error("Failed to list fault rules")
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
-			fmt.Sprintf("Failed to execute command: %v", err))
+			faultErrorStatus(err),
+			fmt.Sprintf("Failed to list fault rules: %v", err))
 		return
 	}
 
-	logger.WithFields(log.Fields{
-		"vmName":   vmName,
-		"cmd":      cmd,
-		"blocking": blocking,
-		"success":  true,
-	}).Info("Successfully executed command")
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// getReconcileReport handles GET /v1/admin/reconcile
+func (s *restServer) getReconcileReport(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.vmServer.ReconcileReport())
 }
 
+// deleteFault handles DELETE /v1/admin/faults/{id}
+func (s *restServer) deleteFault(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithContext(r.Context()).WithField("api", "deleteFault")
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if err := s.vmServer.DeleteFault(id); err != nil {
+		logger.WithField("id", id).WithError(err).Error("Failed to delete fault rule")
+		sendErrorResponse(
+			w,
+			faultErrorStatus(err),
+			fmt.Sprintf("Failed to delete fault rule: %v", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// callbackEnvelopeBytes is how much larger than its params the body of a
+// callback request may be.
+const callbackEnvelopeBytes = 64 * 1024
+
 // InternalCallbackRequest represents a callback request from a VM
 type InternalCallbackRequest struct {
 	VMName string          `json:"vmName"`
@@ -271,44 +2432,80 @@ type InternalCallbackResponse struct {
 // handleInternalCallback handles callback requests from VMs.
 // This endpoint is called by the vsockserver running inside guest VMs.
 func (s *restServer) handleInternalCallback(w http.ResponseWriter, r *http.Request) {
-	logger := log.WithField("api", "handleInternalCallback")
+	logger := log.WithContext(r.Context()).WithField("api", "handleInternalCallback")
 
+	// The body may be a little larger than the params it carries.
+	body := http.MaxBytesReader(w, r.Body, s.maxCallbackParamsBytes+callbackEnvelopeBytes)
 	var req InternalCallbackRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
 		logger.WithError(err).Error("Invalid callback request body")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(InternalCallbackResponse{
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeJSON(w, r, http.StatusRequestEntityTooLarge, InternalCallbackResponse{
+				Error: fmt.Sprintf("callback params must not exceed %d bytes", s.maxCallbackParamsBytes),
+			})
+			return
+		}
+		writeJSON(w, r, http.StatusBadRequest, InternalCallbackResponse{
 			Error: fmt.Sprintf("Invalid request format: %v", err),
 		})
 		return
 	}
+	if int64(len(req.Params)) > s.maxCallbackParamsBytes {
+		writeJSON(w, r, http.StatusRequestEntityTooLarge, InternalCallbackResponse{
+			Error: fmt.Sprintf("callback params of %d bytes exceed the limit of %d bytes", len(req.Params), s.maxCallbackParamsBytes),
+		})
+		return
+	}
 
 	if req.VMName == "" || req.Method == "" {
 		logger.Error("Missing vmName or method in callback request")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(InternalCallbackResponse{
+		writeJSON(w, r, http.StatusBadRequest, InternalCallbackResponse{
 			Error: "vmName and method are required",
 		})
 		return
 	}
 
+	// Any guest can claim any vmName, so the callback has to come from the
+	// claimed VM's IP.
+	remoteHost, _, _ := net.SplitHostPort(r.RemoteAddr)
+	router := s.guestCallbacks()
+	owner, err := router.GetVMNameByIP(net.ParseIP(remoteHost))
+	if err != nil || owner != req.VMName {
+		logger.WithFields(log.Fields{
+			"vmName":     req.VMName,
+			"remoteAddr": r.RemoteAddr,
+			"owner":      owner,
+		}).Warn("Rejecting callback from another VM's address")
+		writeJSON(w, r, http.StatusForbidden, InternalCallbackResponse{
+			Error: fmt.Sprintf("callback for %s must come from its IP", req.VMName),
+		})
+		return
+	}
+
 	logger.WithFields(log.Fields{
 		"vmName": req.VMName,
 		"method": req.Method,
 	}).Info("Processing callback from VM")
 
-	// Route the callback to the registered HTTP callback URL
-	result, err := s.sessionManager.RouteCallback(r.Context(), req.VMName, req.Method, req.Params)
+	// Route the callback through the VM's registered transport
+	result, err := router.RouteCallback(r.Context(), req.VMName, req.Method, req.Params)
 	if err != nil {
 		logger.WithFields(log.Fields{
 			"vmName": req.VMName,
 			"method": req.Method,
 		}).WithError(err).Error("Failed to route callback")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(InternalCallbackResponse{
+		statusCode := http.StatusInternalServerError
+		var faultErr *faults.Error
+		var busyErr *server.BusyError
+		if errors.As(err, &faultErr) {
+			statusCode = faultErr.HTTPStatus
+		} else if errors.As(err, &busyErr) {
+			statusCode = http.StatusServiceUnavailable
+		} else if errors.Is(err, callback.ErrMethodNotAllowed) {
+			statusCode = http.StatusForbidden
+		}
+		writeJSON(w, r, statusCode, InternalCallbackResponse{
 			Error: fmt.Sprintf("Callback failed: %v", err),
 		})
 		return
@@ -319,94 +2516,387 @@ func (s *restServer) handleInternalCallback(w http.ResponseWriter, r *http.Reque
 		"method": req.Method,
 	}).Info("Callback completed successfully")
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(InternalCallbackResponse{
+	writeJSON(w, r, http.StatusOK, InternalCallbackResponse{
 		Result: result,
 	})
 }
 
-func main() {
-	var serverConfig *config.ServerConfig
-	var configFile string
+// routeClass groups routes by who may call them, which decides the listener
+// they're served on.
+type routeClass int
 
-	app := &cli.App{
-		Name:  "cbox-restserver",
-		Usage: "A lightweight daemon for spawning and managing cloud-hypervisor based microVMs with exec and callback support.",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:        "config",
-				Aliases:     []string{"c"},
-				Usage:       "Path to config file",
-				Destination: &configFile,
-				Value:       "./config.yaml",
-			},
-		},
-		Action: func(ctx *cli.Context) error {
-			var err error
-			serverConfig, err = config.GetServerConfig(configFile)
-			if err != nil {
-				return fmt.Errorf("server config not found: %v", err)
+const (
+	// routePublic routes are served on every listener.
+	routePublic routeClass = iota
+	// routeTenant routes make up the VM API.
+	routeTenant
+	// routeAdmin routes are destructive or expose host details. They move to
+	// the admin listener when one is configured.
+	routeAdmin
+	// routeInternal routes are called by guests.
+	routeInternal
+)
+
+func (c routeClass) String() string {
+	switch c {
+	case routePublic:
+		return "public"
+	case routeTenant:
+		return "tenant"
+	case routeAdmin:
+		return "admin"
+	case routeInternal:
+		return "internal"
+	default:
+		return "unknown"
+	}
+}
+
+type route struct {
+	class routeClass
+	// perm is what a token's role must grant when api_tokens are set.
+	perm    permission
+	method  string
+	path    string
+	handler http.HandlerFunc
+}
+
+// routes returns every REST API route with its class and permission.
+func (s *restServer) routes() []route {
+	v := "/" + API_VERSION
+	routes := []route{
+		{routeTenant, permVMsWrite, "POST", v + "/vms", s.startVM},
+		{routeTenant, permVMsWrite, "POST", v + "/vms/restore", s.restoreVM},
+		{routeTenant, permVMsWrite, "DELETE", v + "/vms/{name}", s.destroyVM},
+		{routeAdmin, permAdmin, "DELETE", v + "/vms", s.destroyAllVMs},
+		{routeTenant, permVMsRead, "GET", v + "/vms", s.listAllVMs},
+		{routeTenant, permVMsRead, "GET", v + "/vms/stats", s.listVMStats},
+		{routeTenant, permVMsRead, "GET", v + "/vms/by-cid/{cid}", s.getVMByCID},
+		{routeTenant, permVMsRead, "GET", v + "/vms/{name}", s.listVM},
+		{routeTenant, permVMsRead, "GET", v + "/vms/{name}/stats", s.getVMStats},
+		{routeTenant, permVMsWrite, "PATCH", v + "/vms/{name}/resize", s.resizeVM},
+		{routeTenant, permVMsWrite, "POST", v + "/vms/{name}/disks", s.attachDisk},
+		{routeTenant, permVMsWrite, "DELETE", v + "/vms/{name}/disks/{id}", s.detachDisk},
+		{routeTenant, permVMsWrite, "POST", v + "/vms/{name}/pause", s.pauseVM},
+		{routeTenant, permVMsWrite, "POST", v + "/vms/{name}/resume", s.resumeVM},
+		{routeTenant, permVMsWrite, "POST", v + "/vms/{name}/stop", s.stopVM},
+		{routeTenant, permVMsWrite, "POST", v + "/vms/{name}/reboot", s.rebootVM},
+		{routeTenant, permVMsWrite, "POST", v + "/vms/{name}/snapshot", s.snapshotVM},
+		{routeTenant, permVMsRead, "GET", v + "/vms/{name}/callback", s.getCallback},
+		{routeTenant, permVMsWrite, "PUT", v + "/vms/{name}/callback", s.setCallback},
+		{routeTenant, permVMsWrite, "DELETE", v + "/vms/{name}/callback", s.deleteCallback},
+		{routeTenant, permVMsRead, "GET", v + "/vms/{name}/callbacks/queue", s.getCallbackQueue},
+		{routeTenant, permVMsRead, "GET", v + "/vms/{name}/callbacks/history", s.getCallbackHistory},
+		{routeTenant, permExec, "POST", v + "/vms/{name}/lease", s.acquireLease},
+		{routeTenant, permExec, "PUT", v + "/vms/{name}/lease", s.renewLease},
+		{routeTenant, permExec, "DELETE", v + "/vms/{name}/lease", s.releaseLease},
+		{routeTenant, permExec, "POST", v + "/vms/{name}/exec", s.vmExec},
+		{routeTenant, permExec, "GET", v + "/vms/{name}/exec", s.listExecJobs},
+		{routeTenant, permExec, "POST", v + "/vms/{name}/exec/stream", s.vmExecStream},
+		{routeTenant, permExec, "GET", v + "/vms/{name}/exec/{jobId}", s.getExecJob},
+		{routeTenant, permExec, "DELETE", v + "/vms/{name}/exec/{jobId}", s.killExecJob},
+		{routeTenant, permExec, "POST", v + "/vms/{name}/exec-batch", s.vmExecBatch},
+		{routeTenant, permExec, "POST", v + "/exec", s.execFanOut},
+		{routeTenant, permVMsRead, "GET", v + "/vms/{name}/user-script", s.getUserScriptStatus},
+		{routeTenant, permVMsRead, "GET", v + "/vms/{name}/workspaces", s.listWorkspaces},
+		{routeTenant, permExec, "DELETE", v + "/vms/{name}/workspaces/{id}", s.deleteWorkspace},
+		{routeTenant, permExec, "GET", v + "/vms/{name}/files", s.getFile},
+		{routeTenant, permExec, "PUT", v + "/vms/{name}/files", s.putFile},
+		{routeTenant, permExec, "GET", v + "/vms/{name}/proxy/{port}", s.proxy},
+		{routeTenant, permExec, "GET", v + "/vms/{name}/shell", s.shell},
+		{routeAdmin, permAdmin, "POST", v + "/vms/{name}/console-exec", s.consoleExec},
+		{routeAdmin, permAdmin, "POST", v + "/vms/{name}/agent-update", s.updateAgent},
+		{routeTenant, permVMsRead, "GET", v + "/vms/{name}/artifacts", s.listArtifacts},
+		{routeTenant, permVMsRead, "GET", v + "/vms/{name}/artifacts/{artifact}", s.getArtifact},
+		{routeTenant, permVMsRead, "GET", v + "/vms/{name}/crash-bundle", s.getCrashBundle},
+		{routeTenant, permExec, "GET", v + "/vms/{name}/recordings", s.listRecordings},
+		{routeTenant, permExec, "GET", v + "/vms/{name}/recordings/{seq}", s.getRecording},
+		{routeTenant, permVMsRead, "GET", v + "/operations/{id}", s.getOperation},
+		{routeTenant, permVMsRead, "GET", v + "/events", s.streamEvents},
+		{routeTenant, permVMsRead, "GET", v + "/host", s.hostInfo},
+		{routeTenant, permVMsWrite, "POST", v + "/vms/{name}/convert-to-template", s.convertToTemplate},
+		{routeTenant, permVMsRead, "GET", v + "/profiles", s.listProfiles},
+		{routeTenant, permVMsRead, "GET", v + "/templates", s.listTemplates},
+		{routeTenant, permVMsWrite, "DELETE", v + "/templates/{name}", s.deleteTemplate},
+		{routeTenant, permVMsWrite, "POST", v + "/templates/{name}/instantiate", s.instantiateTemplate},
+		{routeTenant, permVMsRead, "GET", v + "/archive", s.listArchive},
+		{routeTenant, permVMsRead, "GET", v + "/archive/{name}/logs", s.getArchivedLogs},
+		{routeAdmin, permAdmin, "GET", v + "/audit", s.getAudit},
+		{routeAdmin, permAdmin, "POST", v + "/admin/faults", s.addFault},
+		{routeAdmin, permAdmin, "GET", v + "/admin/faults", s.listFaults},
+		{routeAdmin, permAdmin, "DELETE", v + "/admin/faults/{id}", s.deleteFault},
+		{routeAdmin, permAdmin, "GET", v + "/admin/reconcile", s.getReconcileReport},
+		{routePublic, permNone, "GET", v + "/health", s.healthCheck},
+		{routePublic, permNone, "GET", v + "/ready", s.readyCheck},
+	}
+
+	// Internal endpoint for VM callbacks (called by vsockserver in guest when
+	// the vsock callback listener is unreachable), served on the bridge IP
+	// only
+	if !s.disableHTTPCallback {
+		routes = append(routes, route{routeInternal, permNone, "POST", v + "/internal/callback", s.handleInternalCallback})
+	}
+	return routes
+}
+
+// newRouter registers the REST API routes of the given classes. Routes of
+// other classes aren't registered, so requests for them get a 404.
+func newRouter(s *restServer, classes ...routeClass) *mux.Router {
+	r := mux.NewRouter()
+	for _, rt := range s.routes() {
+		if slices.Contains(classes, rt.class) {
+			handler := s.authorize(rt.perm, rt.handler)
+			if rt.class != routePublic {
+				handler = s.requireReady(handler)
 			}
-			log.Infof("server config: %v", serverConfig)
-			return nil
-		},
+			handler = s.auditRoute(rt, handler)
+			r.HandleFunc(rt.path, handler).Methods(rt.method)
+		}
 	}
+	return r
+}
 
-	err := app.Run(os.Args)
+// mainRouteClasses returns the classes of routes the main listener serves:
+// everything but guest callbacks, and admin routes only without an admin
+// listener.
+func mainRouteClasses(serverConfig *config.ServerConfig) []routeClass {
+	if serverConfig.AdminPort != "" {
+		return []routeClass{routePublic, routeTenant}
+	}
+	return []routeClass{routePublic, routeTenant, routeAdmin}
+}
+
+// loadConfig reads the server config from configFile.
+func loadConfig(configFile string) (*config.ServerConfig, error) {
+	serverConfig, err := config.GetServerConfig(configFile)
 	if err != nil {
-		log.WithError(err).Fatal("server exited with error")
+		return nil, fmt.Errorf("failed to load server config: %w", err)
 	}
+	log.Infof("server config: %v", serverConfig)
+	return serverConfig, nil
+}
 
-	// Create the session manager for handling HTTP callback sessions
+// runServer serves the REST API until SIGINT or SIGTERM is received.
+func runServer(serverConfig *config.ServerConfig) error {
+	// Create the session manager for handling callback sessions
 	sessionManager := callback.NewSessionManager()
+	sessionManager.SetQueueConfig(callback.QueueConfig{
+		Size:   serverConfig.CallbackQueueSize,
+		MaxAge: serverConfig.CallbackQueueMaxAge,
+	})
+	sessionManager.SetAuditConfig(callback.AuditConfig{
+		Capacity:    serverConfig.CallbackAuditCapacity,
+		ParamsLimit: serverConfig.CallbackAuditParamsLimit,
+	})
+	sessionManager.SetMaxResponseSize(serverConfig.MaxCallbackResponseSizeInKB * 1024)
 
-	// Create the VM server
-	vmServer, err := server.NewServer(*serverConfig, sessionManager)
+	// Create REST server
+	apiTokens, err := newTokenTable(serverConfig.APITokens)
 	if err != nil {
-		log.Fatalf("failed to create VM server: %v", err)
+		return fmt.Errorf("invalid api_tokens: %w", err)
 	}
-
-	// Create REST server
-	s := &restServer{
-		vmServer:       vmServer,
-		sessionManager: sessionManager,
+	audit, err := newAuditLogger(serverConfig)
+	if err != nil {
+		return err
 	}
-	r := mux.NewRouter()
-
-	// Register routes
-	r.HandleFunc("/"+API_VERSION+"/vms", s.startVM).Methods("POST")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.destroyVM).Methods("DELETE")
-	r.HandleFunc("/"+API_VERSION+"/vms", s.destroyAllVMs).Methods("DELETE")
-	r.HandleFunc("/"+API_VERSION+"/vms", s.listAllVMs).Methods("GET")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.listVM).Methods("GET")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}/exec", s.vmExec).Methods("POST")
-	r.HandleFunc("/"+API_VERSION+"/health", s.healthCheck).Methods("GET")
+	defer audit.close()
+	s := &restServer{
+		sessionManager:      sessionManager,
+		disableHTTPCallback: serverConfig.DisableHTTPCallbackEndpoint,
+		apiTokens:           apiTokens,
+		maxExecRequestBytes: serverConfig.MaxExecRequestSizeInKB * 1024,
 
-	// Internal endpoint for VM callbacks (called by vsockserver in guest)
-	r.HandleFunc("/"+API_VERSION+"/internal/callback", s.handleInternalCallback).Methods("POST")
+		maxCallbackParamsBytes: serverConfig.MaxCallbackParamsSizeInKB * 1024,
+		audit:                  audit,
+	}
 
-	// Start HTTP server
+	// Start HTTP server. With an admin listener configured, admin routes are
+	// only served there. Guest callbacks are only served on the guest
+	// listener. Until the VM server is created, only health and readiness
+	// are served.
 	srv := &http.Server{
 		Addr:    serverConfig.Host + ":" + serverConfig.Port,
-		Handler: r,
+		Handler: requestLog(newRouter(s, mainRouteClasses(serverConfig)...)),
+	}
+	// Bound without SO_REUSEPORT, so a second restserver started by mistake
+	// fails here rather than splitting API traffic with this one.
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to start server: %w", err)
 	}
-
 	go func() {
 		log.Printf("cbox-restserver listening on: %s:%s", serverConfig.Host, serverConfig.Port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Failed to start server: %v", err)
 		}
 	}()
 
+	// Create the VM server, which re-adopts the VMs left running by the
+	// previous run.
+	vmServer, err := server.NewServer(*serverConfig, sessionManager)
+	if err != nil {
+		srv.Close()
+		return fmt.Errorf("failed to create VM server: %w", err)
+	}
+	s.vmServer = vmServer
+	if err := s.registerBuiltins(); err != nil {
+		srv.Close()
+		return fmt.Errorf("failed to register built-in callbacks: %w", err)
+	}
+	s.ready.Store(true)
+	log.Info("cbox-restserver ready")
+
+	internalSrv, err := newInternalServer(s, serverConfig)
+	if err != nil {
+		srv.Close()
+		return err
+	}
+	adminSrv := newAdminServer(s, serverConfig)
+	grpcSrv, err := newGRPCServer(s, serverConfig)
+	if err != nil {
+		srv.Close()
+		return err
+	}
+
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	sig := <-sigChan
+	log.WithField("signal", sig).Info("Shutting down server, signal again to exit immediately")
+	go func() {
+		sig := <-sigChan
+		log.WithField("signal", sig).Warn("Received second signal, exiting immediately")
+		os.Exit(1)
+	}()
 
-	log.Println("Shutting down server...")
-	if err := srv.Shutdown(context.Background()); err != nil {
-		log.Fatalf("Server shutdown failed: %v", err)
+	log.WithField("gracePeriod", serverConfig.ShutdownGracePeriod).Info("Draining in-flight requests")
+	ctx, cancel := context.WithTimeout(context.Background(), serverConfig.ShutdownGracePeriod)
+	defer cancel()
+	shutdownServer(ctx, "admin server", adminSrv)
+	shutdownServer(ctx, "server", srv)
+	shutdownGRPCServer(ctx, grpcSrv)
+	shutdownServer(ctx, "guest callback server", internalSrv)
+
+	log.Info("Destroying pooled VMs")
+	vmServer.DrainPool()
+	if serverConfig.DestroyVMsOnShutdown {
+		log.Info("Destroying all VMs")
+		vmServer.DestroyAllVMs(context.Background(), "")
+	} else {
+		count, err := vmServer.DetachVMs(context.Background())
+		if err != nil {
+			log.WithError(err).Warn("Failed to detach VMs")
+		}
+		log.WithField("count", count).Info("Left VMs running for the next start to adopt")
 	}
-	vmServer.DestroyAllVMs(context.Background())
+	sessionManager.Close()
 	log.Println("Server stopped")
+	return nil
+}
+
+// shutdownServer stops srv from accepting requests and waits for in-flight
+// ones until ctx is done, then closes their connections. srv may be nil.
+func shutdownServer(ctx context.Context, name string, srv *http.Server) {
+	if srv == nil {
+		return
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.WithError(err).Warnf("%s didn't drain in time, closing its connections", name)
+		srv.Close()
+	}
+}
+
+func main() {
+	var configFile string
+	// Log entries made with a request's context carry its ID.
+	log.AddHook(requestid.Hook{})
+
+	app := &cli.App{
+		Name:  "cbox-restserver",
+		Usage: "A lightweight daemon for spawning and managing cloud-hypervisor based microVMs with exec and callback support.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "config",
+				Aliases:     []string{"c"},
+				Usage:       "Path to config file",
+				Destination: &configFile,
+				Value:       "./config.yaml",
+			},
+			&cli.BoolFlag{
+				Name:  "migrate-subnet",
+				Usage: "Allow starting after bridge_subnet changed; VMs from the previous subnet must be recreated",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			serverConfig, err := loadConfig(configFile)
+			if err != nil {
+				return err
+			}
+			serverConfig.MigrateSubnet = ctx.Bool("migrate-subnet")
+			return runServer(serverConfig)
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "selftest",
+				Usage: "Boot a canary VM and check networking, exec, vsock and callbacks end to end. Must not run alongside a running cbox-restserver.",
+				Action: func(ctx *cli.Context) error {
+					serverConfig, err := loadConfig(configFile)
+					if err != nil {
+						return err
+					}
+					return runSelfTest(ctx.Context, serverConfig)
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "Inspect the server config",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "print",
+						Usage: "Print the resolved config as YAML, noting whether each value comes from the defaults, the config file or a CBOX_<KEY> environment variable",
+						Action: func(ctx *cli.Context) error {
+							serverConfig, sources, err := config.LoadServerConfig(configFile)
+							if err != nil {
+								return err
+							}
+							out, err := serverConfig.ResolvedYAML(sources)
+							if err != nil {
+								return err
+							}
+							_, err = os.Stdout.Write(out)
+							return err
+						},
+					},
+				},
+			},
+			{
+				Name:  "whoami",
+				Usage: "Print the name of the VM a cloud-hypervisor process belongs to",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:     "pid",
+						Usage:    "Pid of the cloud-hypervisor process",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					serverConfig, err := loadConfig(configFile)
+					if err != nil {
+						return err
+					}
+					vmName, err := server.LookupVMByPid(serverConfig.StateDir, ctx.Int("pid"))
+					if err != nil {
+						return err
+					}
+					fmt.Println(vmName)
+					return nil
+				},
+			},
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.WithError(err).Fatal("server exited with error")
+	}
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/server"
+)
+
+// decodeError decodes the error response rec holds.
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) *serverapi.ErrorResponseError {
+	t.Helper()
+	var resp serverapi.ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Error == nil {
+		t.Fatalf("response isn't an error response: %v", err)
+	}
+	return resp.Error
+}
+
+func TestSendStartVMErrorResponseExhausted(t *testing.T) {
+	rec := httptest.NewRecorder()
+	err := fmt.Errorf("failed to set up networking: %w", &server.AllocatorExhaustedError{Allocator: server.AllocatorCID, Capacity: 4})
+	sendStartVMErrorResponse(rec, http.StatusInternalServerError, err.Error(), err)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rec.Code)
+	}
+	resp := decodeError(t, rec)
+	if resp.GetCode() != "RESOURCES_EXHAUSTED" || resp.Details.GetAllocator() != server.AllocatorCID {
+		t.Errorf("error = %s for allocator %q, want RESOURCES_EXHAUSTED for cid", resp.GetCode(), resp.Details.GetAllocator())
+	}
+}
+
+func TestSendVMErrorResponseLeased(t *testing.T) {
+	rec := httptest.NewRecorder()
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	err := &server.LeaseHeldError{VMName: "vm1", Holder: "job-1", ExpiresAt: expiresAt}
+	sendVMErrorResponse(rec, http.StatusInternalServerError, err.Error(), err)
+
+	if rec.Code != http.StatusLocked {
+		t.Errorf("status = %d, want 423", rec.Code)
+	}
+	resp := decodeError(t, rec)
+	if resp.GetCode() != "VM_LEASED" || resp.Details.GetLeaseHolder() != "job-1" || !resp.Details.GetLeaseExpiresAt().Equal(expiresAt) {
+		t.Errorf("error = %s held by %q until %s, want VM_LEASED by job-1 until %s",
+			resp.GetCode(), resp.Details.GetLeaseHolder(), resp.Details.GetLeaseExpiresAt(), expiresAt)
+	}
+}
+
+func TestVMErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{status.Error(codes.NotFound, "vm not found"), http.StatusNotFound},
+		{fmt.Errorf("exec: %w", status.Error(codes.NotFound, "vm not found")), http.StatusNotFound},
+		{status.Error(codes.InvalidArgument, "bad request"), http.StatusBadRequest},
+		{status.Error(codes.PermissionDenied, "denied"), http.StatusForbidden},
+		{status.Error(codes.ResourceExhausted, "busy"), http.StatusTooManyRequests},
+		{status.Error(codes.Internal, "failed"), http.StatusInternalServerError},
+		{errors.New("plain error"), http.StatusInternalServerError},
+	} {
+		if got := vmErrorStatus(tc.err); got != tc.want {
+			t.Errorf("vmErrorStatus(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestStartVMErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{status.Error(codes.InvalidArgument, "bad name"), http.StatusBadRequest},
+		{status.Error(codes.AlreadyExists, "vm vm1 is already being started"), http.StatusConflict},
+		{status.Error(codes.FailedPrecondition, "vm vm1 exists"), http.StatusConflict},
+		{status.Error(codes.Internal, "failed"), http.StatusInternalServerError},
+		{errors.New("plain error"), http.StatusInternalServerError},
+	} {
+		if got := startVMErrorStatus(tc.err); got != tc.want {
+			t.Errorf("startVMErrorStatus(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+// fakeStarter starts VMs like *server.Server does for the status they map
+// to: a name is reserved while it's being started.
+type fakeStarter struct {
+	mu       sync.Mutex
+	starting map[string]bool
+	// release, if set, holds starts until it's closed.
+	release chan struct{}
+}
+
+func (f *fakeStarter) reserve(vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.starting[vmName] {
+		return status.Error(codes.AlreadyExists, fmt.Sprintf("vm %s is already being started", vmName))
+	}
+	f.starting[vmName] = true
+	return nil
+}
+
+func (f *fakeStarter) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error) {
+	if err := f.reserve(req.GetVmName()); err != nil {
+		return nil, err
+	}
+	if f.release != nil {
+		<-f.release
+	}
+	return &serverapi.StartVMResponse{}, nil
+}
+
+func (f *fakeStarter) StartVMAsync(req *serverapi.StartVMRequest, onStarted func(*serverapi.StartVMResponse)) (*serverapi.Operation, error) {
+	if err := f.reserve(req.GetVmName()); err != nil {
+		return nil, err
+	}
+	return &serverapi.Operation{}, nil
+}
+
+// postStartVM posts a start request for vmName to s.
+func postStartVM(s *restServer, vmName string, async bool) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"vmName": %q, "async": %t}`, vmName, async)
+	req := httptest.NewRequest(http.MethodPost, "/v1/vms", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.startVM(rec, req)
+	return rec
+}
+
+func TestStartVMConcurrentSameName(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		t.Run(fmt.Sprintf("async=%t", async), func(t *testing.T) {
+			starter := &fakeStarter{starting: map[string]bool{}, release: make(chan struct{})}
+			s := newTestRESTServer(t)
+			s.starter = starter
+
+			// The first start is still running when the second comes in.
+			first := make(chan *httptest.ResponseRecorder)
+			go func() { first <- postStartVM(s, "vm1", false) }()
+			for {
+				starter.mu.Lock()
+				started := starter.starting["vm1"]
+				starter.mu.Unlock()
+				if started {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if rec := postStartVM(s, "vm1", async); rec.Code != http.StatusConflict {
+				t.Errorf("second start = %d %s, want 409", rec.Code, rec.Body.String())
+			}
+			close(starter.release)
+			if rec := <-first; rec.Code != http.StatusOK {
+				t.Errorf("first start = %d %s, want 200", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/requestid"
+)
+
+// statusRecorder captures the status code written by a handler. It passes
+// flushes and hijacks through for streamed exec and the proxy.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer can't be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// requestLog gives every request an ID, honoring a valid incoming
+// X-Request-ID, and logs it with its outcome. The ID is echoed on the
+// response and carried in the request's context, so log entries made with
+// log.WithContext(r.Context()) and requests to the guest and callback
+// receivers carry it too. Requests that already have an ID keep it.
+func requestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestid.FromContext(r.Context()) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := r.Header.Get(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+		r = r.WithContext(requestid.NewContext(r.Context(), id))
+		w.Header().Set(requestid.Header, id)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		// Load balancers and probes poll the health and readiness checks,
+		// which would drown out the rest.
+		level := log.InfoLevel
+		if r.URL.Path == "/v1/health" || r.URL.Path == "/v1/ready" {
+			level = log.DebugLevel
+		}
+		log.WithContext(r.Context()).WithFields(log.Fields{
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"remoteAddr": r.RemoteAddr,
+			"status":     rec.status,
+			"duration":   time.Since(start),
+		}).Log(level, "request")
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// gzipMinBytes is the smallest response body worth compressing.
+const gzipMinBytes = 4096
+
+// encodeFailedBody is sent when a response can't be encoded.
+const encodeFailedBody = `{"error":{"code":"ENCODE_FAILED","message":"failed to encode response"}}` + "\n"
+
+var (
+	bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+	gzipPool   = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+)
+
+// acceptsGzip reports whether r's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+	return false
+}
+
+// writeJSON sends v as a JSON response with statusCode. The body is encoded
+// up front so it carries a Content-Length, and is gzipped if r accepts it and
+// it's at least gzipMinBytes. r may be nil for responses that are never
+// large, such as errors. Encoding failures are logged and sent as a 500.
+func writeJSON(w http.ResponseWriter, r *http.Request, statusCode int, v any) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Cache-Control", "no-store")
+
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		log.WithError(err).Errorf("Failed to encode %T response", v)
+		header.Set("Content-Length", strconv.Itoa(len(encodeFailedBody)))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(encodeFailedBody))
+		return
+	}
+
+	body := buf.Bytes()
+	if r != nil {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if r != nil && len(body) >= gzipMinBytes && acceptsGzip(r) {
+		zbuf := bufferPool.Get().(*bytes.Buffer)
+		zbuf.Reset()
+		defer bufferPool.Put(zbuf)
+
+		zw := gzipPool.Get().(*gzip.Writer)
+		zw.Reset(zbuf)
+		_, err := zw.Write(body)
+		if err == nil {
+			err = zw.Close()
+		}
+		gzipPool.Put(zw)
+		if err != nil {
+			log.WithError(err).Warn("Failed to gzip response, sending it uncompressed")
+		} else {
+			header.Set("Content-Encoding", "gzip")
+			body = zbuf.Bytes()
+		}
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
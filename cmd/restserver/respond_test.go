@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+)
+
+// discardWriter is a ResponseWriter that drops the body, so benchmarks only
+// count what writing the response costs.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// vmList returns a ListAllVMs response for n VMs.
+func vmList(n int) *serverapi.ListAllVMsResponse {
+	resp := &serverapi.ListAllVMsResponse{}
+	for i := 0; i < n; i++ {
+		resp.Vms = append(resp.Vms, serverapi.ListAllVMsResponseVmsInner{
+			VmName:        serverapi.PtrString(fmt.Sprintf("vm-%d", i)),
+			Status:        serverapi.PtrString("running"),
+			Ip:            serverapi.PtrString(fmt.Sprintf("10.20.%d.%d/16", i/250, i%250+2)),
+			TapDeviceName: serverapi.PtrString(fmt.Sprintf("tap%d", i)),
+			Cid:           serverapi.PtrInt64(int64(i + 3)),
+			VsockPath:     serverapi.PtrString(fmt.Sprintf("/var/lib/cbox/vm-%d/vsock.sock", i)),
+			Labels:        &map[string]string{"team": "build", "job": fmt.Sprintf("job-%d", i)},
+		})
+	}
+	return resp
+}
+
+// benchmarkWriteJSON benchmarks sending a list of n VMs to a client with
+// acceptEncoding, against encoding straight to the ResponseWriter as
+// handlers did before writeJSON.
+func benchmarkWriteJSON(b *testing.B, n int) {
+	resp := vmList(n)
+	plain := httptest.NewRequest(http.MethodGet, "/v1/vms", nil)
+	gzipped := httptest.NewRequest(http.MethodGet, "/v1/vms", nil)
+	gzipped.Header.Set("Accept-Encoding", "gzip")
+	body, _ := json.Marshal(resp)
+	w := &discardWriter{header: http.Header{}}
+
+	b.Run("encoder", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			clear(w.header)
+			json.NewEncoder(w).Encode(resp)
+		}
+	})
+	b.Run("writeJSON", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			clear(w.header)
+			writeJSON(w, plain, http.StatusOK, resp)
+		}
+	})
+	b.Run("writeJSON gzip", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			clear(w.header)
+			writeJSON(w, gzipped, http.StatusOK, resp)
+		}
+	})
+}
+
+func BenchmarkWriteJSON10VMs(b *testing.B)   { benchmarkWriteJSON(b, 10) }
+func BenchmarkWriteJSON100VMs(b *testing.B)  { benchmarkWriteJSON(b, 100) }
+func BenchmarkWriteJSON1000VMs(b *testing.B) { benchmarkWriteJSON(b, 1000) }
+
+func TestWriteJSONGzip(t *testing.T) {
+	resp := vmList(100)
+	req := httptest.NewRequest(http.MethodGet, "/v1/vms", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, resp)
+	}))
+	defer srv.Close()
+
+	// The client asks for gzip and decompresses transparently.
+	got, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer got.Body.Close()
+	if !got.Uncompressed {
+		t.Error("large response wasn't gzipped")
+	}
+	var decoded serverapi.ListAllVMsResponse
+	if err := json.NewDecoder(got.Body).Decode(&decoded); err != nil || len(decoded.Vms) != 100 {
+		t.Errorf("decoded %d VMs, %v, want 100", len(decoded.Vms), err)
+	}
+
+	rec := httptest.NewRecorder()
+	writeJSON(rec, httptest.NewRequest(http.MethodGet, "/v1/vms", nil), http.StatusOK, resp)
+	if rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Content-Length") != fmt.Sprint(rec.Body.Len()) {
+		t.Errorf("plain response headers = %v for %d bytes", rec.Header(), rec.Body.Len())
+	}
+}
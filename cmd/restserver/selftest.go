@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/callback"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/server"
+)
+
+const (
+	selfTestVMPrefix       = "cbox-selftest"
+	selfTestCallbackMethod = "selftest.ping"
+	selfTestTimeout        = 5 * time.Minute
+)
+
+// selfTestResult is the outcome of a single self-test check.
+type selfTestResult struct {
+	name     string
+	err      error
+	skipped  bool
+	duration time.Duration
+}
+
+// selfTest runs checks in order and skips the remaining ones once a check
+// that later checks depend on has failed.
+type selfTest struct {
+	results []selfTestResult
+	blocked bool
+}
+
+// check runs fn as the named check. If required is true and the check fails,
+// every following check is skipped.
+func (t *selfTest) check(name string, required bool, fn func() error) {
+	if t.blocked {
+		t.results = append(t.results, selfTestResult{name: name, skipped: true})
+		return
+	}
+
+	log.Infof("selftest: %s", name)
+	startTime := time.Now()
+	err := fn()
+	t.results = append(t.results, selfTestResult{
+		name:     name,
+		err:      err,
+		duration: time.Since(startTime),
+	})
+	if err != nil && required {
+		t.blocked = true
+	}
+}
+
+// report prints the results and returns an error if any check didn't pass.
+func (t *selfTest) report() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RESULT\tCHECK\tDURATION\tDETAILS")
+
+	passed := true
+	for _, r := range t.results {
+		result, details := "PASS", ""
+		switch {
+		case r.skipped:
+			result = "SKIP"
+			passed = false
+		case r.err != nil:
+			result, details = "FAIL", r.err.Error()
+			passed = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result, r.name, r.duration.Round(time.Millisecond), details)
+	}
+	w.Flush()
+
+	if !passed {
+		return errors.New("selftest failed")
+	}
+	fmt.Println("selftest passed")
+	return nil
+}
+
+// expectOK checks that a command printed exactly "ok".
+func expectOK(output string) error {
+	if strings.TrimSpace(output) != "ok" {
+		return fmt.Errorf("unexpected output: %q", output)
+	}
+	return nil
+}
+
+// startCallbackReceiver serves a local HTTP endpoint that answers callbacks
+// and reports the methods it received.
+func startCallbackReceiver() (string, <-chan string, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to listen for callbacks: %w", err)
+	}
+
+	received := make(chan string, 1)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req callback.CallbackRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			select {
+			case received <- req.Method:
+			default:
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(callback.CallbackResponse{
+				ID:     req.ID,
+				Result: json.RawMessage(`{"pong":true}`),
+			})
+		}),
+	}
+	go srv.Serve(listener)
+
+	stop := func() {
+		srv.Close()
+	}
+	return "http://" + listener.Addr().String() + "/", received, stop, nil
+}
+
+// runSelfTest boots a canary VM with the default image and checks each
+// capability end to end, printing a pass/fail report.
+func runSelfTest(ctx context.Context, serverConfig *config.ServerConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	t := &selfTest{}
+	sessionManager := callback.NewSessionManager()
+	sessionManager.SetMaxResponseSize(serverConfig.MaxCallbackResponseSizeInKB * 1024)
+	defer sessionManager.Close()
+
+	// Bind the API port before touching host networking so a running
+	// restserver is detected before its bridge and tap devices are reset.
+	var apiListener net.Listener
+	t.check("bind REST API port", true, func() error {
+		var err error
+		apiListener, err = net.Listen("tcp", serverConfig.Host+":"+serverConfig.Port)
+		return err
+	})
+
+	var vmServer *server.Server
+	t.check("set up host networking", true, func() error {
+		var err error
+		vmServer, err = server.NewServer(*serverConfig, sessionManager)
+		return err
+	})
+
+	// Guest callbacks reach the host through the REST API's internal
+	// callback endpoint, so serve it for the duration of the test.
+	if vmServer != nil {
+		callbackREST := &restServer{
+			vmServer:       vmServer,
+			sessionManager: sessionManager,
+
+			maxCallbackParamsBytes: serverConfig.MaxCallbackParamsSizeInKB * 1024,
+		}
+		// The callback route waits for the server to be ready, like in
+		// runServer, and the VM server is already up.
+		callbackREST.ready.Store(true)
+		srv := &http.Server{Handler: newRouter(callbackREST, routePublic, routeInternal)}
+		go srv.Serve(apiListener)
+		defer srv.Close()
+	} else if apiListener != nil {
+		apiListener.Close()
+	}
+
+	vmName := fmt.Sprintf("%s-%d", selfTestVMPrefix, time.Now().Unix())
+	t.check("boot canary VM", true, func() error {
+		_, err := vmServer.StartVM(ctx, &serverapi.StartVMRequest{
+			VmName: serverapi.PtrString(vmName),
+		})
+		return err
+	})
+	vmStarted := !t.blocked
+
+	t.check("exec over HTTP", false, func() error {
+		resp, err := vmServer.VMExec(ctx, vmName, &serverapi.VmExecRequest{Cmd: "echo ok"})
+		if err != nil {
+			return err
+		}
+		if resp.GetError() != "" {
+			return fmt.Errorf("command failed: %s", resp.GetError())
+		}
+		return expectOK(resp.GetOutput())
+	})
+
+	t.check("exec over vsock", false, func() error {
+		output, err := vmServer.VsockCommand(ctx, vmName, "echo ok")
+		if err != nil {
+			return err
+		}
+		return expectOK(output)
+	})
+
+	t.check("callback loopback", false, func() error {
+		callbackURL, received, stop, err := startCallbackReceiver()
+		if err != nil {
+			return err
+		}
+		defer stop()
+
+		if _, err := sessionManager.RegisterHTTPCallback(vmName, callbackURL, "", nil); err != nil {
+			return err
+		}
+		result, err := vmServer.VsockCommand(ctx, vmName, "CALLBACK "+selfTestCallbackMethod+" {}")
+		if err != nil {
+			return err
+		}
+		select {
+		case method := <-received:
+			if method != selfTestCallbackMethod {
+				return fmt.Errorf("receiver got unexpected method: %q", method)
+			}
+		default:
+			return errors.New("callback receiver was not called")
+		}
+		if !strings.Contains(result, "pong") {
+			return fmt.Errorf("unexpected callback result: %q", result)
+		}
+		return nil
+	})
+
+	if vmStarted {
+		t.blocked = false
+		t.check("destroy canary VM", false, func() error {
+			sessionManager.RemoveSession(vmName)
+			_, err := vmServer.DestroyVM(ctx, vmName)
+			return err
+		})
+	}
+
+	return t.report()
+}
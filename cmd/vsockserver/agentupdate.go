@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// agentProtocolVersion is the version of the host<->agent vsock protocol
+	// this agent speaks. Bump it on incompatible changes.
+	agentProtocolVersion = 1
+	// minHostProtocolVersion is the oldest host protocol this agent works with.
+	minHostProtocolVersion = 1
+
+	// agentWatchdogDelay is how long an updated agent has to be committed by
+	// the host before the guest restores the previous binary on its own.
+	agentWatchdogDelay  = 60 * time.Second
+	maxAgentBinaryBytes = 256 * 1024 * 1024
+)
+
+// version is the agent build version, set with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// agentBinaries maps the agents that can be updated to their binaries. Each
+// runs as a service named after its binary.
+var agentBinaries = map[string]string{
+	"cmdserver":   "/usr/local/bin/cbox-cmdserver",
+	"vsockserver": "/usr/local/bin/cbox-vsockserver",
+}
+
+// AgentVersion is the response to VERSION.
+type AgentVersion struct {
+	Agent           string `json:"agent"`
+	Version         string `json:"version"`
+	Protocol        int    `json:"protocol"`
+	MinHostProtocol int    `json:"minHostProtocol"`
+	// Features lists the parts of the protocol this agent serves.
+	Features []string `json:"features"`
+}
+
+func handleVersion() (string, error) {
+	out, err := json.Marshal(AgentVersion{
+		Agent:           "vsockserver",
+		Version:         version,
+		Protocol:        agentProtocolVersion,
+		MinHostProtocol: minHostProtocolVersion,
+		Features:        []string{"callback", "callback-stats", "publish", "agent-update", "vm-name", "exec", "exec-timeout", "exec-env", "workspaces", "frames"},
+	})
+	return string(out), err
+}
+
+func agentBinary(agent string) (string, error) {
+	bin, ok := agentBinaries[agent]
+	if !ok {
+		return "", fmt.Errorf("unknown agent: %s", agent)
+	}
+	return bin, nil
+}
+
+// restartScript restarts an agent's service under systemd or OpenRC.
+func restartScript(bin string) string {
+	service := bin[strings.LastIndex(bin, "/")+1:]
+	return fmt.Sprintf("if command -v systemctl >/dev/null 2>&1; then systemctl restart %[1]s; else rc-service %[1]s restart; fi", service)
+}
+
+// runDetached runs script outside this agent's service so it survives the
+// agent being restarted.
+func runDetached(script string) error {
+	launcher := `if command -v systemd-run >/dev/null 2>&1; then systemd-run --collect --quiet /bin/sh -c "$0"; else setsid /bin/sh -c "$0" >/dev/null 2>&1 & fi`
+	output, err := exec.Command("/bin/sh", "-c", launcher, script).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// restartAgent restarts an agent. Restarting this agent is deferred so the
+// response to the current command can be written first.
+func restartAgent(agent string, bin string) error {
+	if agent == "vsockserver" {
+		return runDetached("sleep 1; " + restartScript(bin))
+	}
+	output, err := exec.Command("/bin/sh", "-c", restartScript(bin)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to restart %s: %v: %s", agent, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// parseAgentUpdateCommand parses "AGENT_UPDATE <agent> <sizeBytes> <sha256>".
+func parseAgentUpdateCommand(cmd string) (agent string, size int64, digest string, err error) {
+	fields := strings.Fields(strings.TrimPrefix(cmd, "AGENT_UPDATE "))
+	if len(fields) != 3 {
+		return "", 0, "", fmt.Errorf("usage: AGENT_UPDATE <agent> <sizeBytes> <sha256>")
+	}
+	size, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size <= 0 || size > maxAgentBinaryBytes {
+		return "", 0, "", fmt.Errorf("invalid binary size: %s", fields[1])
+	}
+	return fields[0], size, strings.ToLower(fields[2]), nil
+}
+
+// handleAgentUpdate reads size bytes of a new agent binary from reader and
+// swaps it in. The previous binary is kept beside it until the host commits
+// the update, and is restored by a watchdog if that doesn't happen within
+// agentWatchdogDelay, e.g. because the new agent can't be reached.
+func handleAgentUpdate(reader *bufio.Reader, agent string, size int64, digest string) (string, error) {
+	bin, err := agentBinary(agent)
+	if err != nil {
+		// Drain the binary so the connection stays usable.
+		io.CopyN(io.Discard, reader, size)
+		return "", err
+	}
+	pending := bin + ".pending"
+	if _, err := os.Stat(pending); err == nil {
+		io.CopyN(io.Discard, reader, size)
+		return "", fmt.Errorf("an update of %s is already pending", agent)
+	}
+
+	tmp := bin + ".new"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		io.CopyN(io.Discard, reader, size)
+		return "", fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	defer os.Remove(tmp)
+	hash := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(file, hash), reader, size)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to receive binary: %w", err)
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != digest {
+		return "", fmt.Errorf("checksum mismatch: got %s, want %s", got, digest)
+	}
+
+	if err := os.Rename(bin, bin+".prev"); err != nil {
+		return "", fmt.Errorf("failed to back up %s: %w", bin, err)
+	}
+	if err := os.Rename(tmp, bin); err != nil {
+		os.Rename(bin+".prev", bin)
+		return "", fmt.Errorf("failed to replace %s: %w", bin, err)
+	}
+	if err := os.WriteFile(pending, nil, 0644); err != nil {
+		os.Rename(bin+".prev", bin)
+		return "", fmt.Errorf("failed to mark update pending: %w", err)
+	}
+
+	watchdog := fmt.Sprintf(`sleep %d; if [ -e %[2]s.pending ]; then mv -f %[2]s.prev %[2]s; rm -f %[2]s.pending; %[3]s; fi`,
+		int(agentWatchdogDelay.Seconds()), bin, restartScript(bin))
+	if err := runDetached(watchdog); err != nil {
+		rollbackBinary(bin)
+		return "", fmt.Errorf("failed to start update watchdog: %w", err)
+	}
+	if err := restartAgent(agent, bin); err != nil {
+		return "", err
+	}
+	return "OK", nil
+}
+
+// rollbackBinary restores the binary an update replaced.
+func rollbackBinary(bin string) error {
+	if err := os.Rename(bin+".prev", bin); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", bin, err)
+	}
+	return os.Remove(bin + ".pending")
+}
+
+// handleAgentCommit keeps a pending update, dropping the previous binary.
+func handleAgentCommit(agent string) (string, error) {
+	bin, err := agentBinary(agent)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Remove(bin + ".pending"); err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("no update of %s is pending", agent)
+		}
+		return "", err
+	}
+	os.Remove(bin + ".prev")
+	return "OK", nil
+}
+
+// handleAgentRollback restores the previous binary of a pending update and
+// restarts the agent.
+func handleAgentRollback(agent string) (string, error) {
+	bin, err := agentBinary(agent)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(bin + ".pending"); err != nil {
+		return "", fmt.Errorf("no update of %s is pending", agent)
+	}
+	if err := rollbackBinary(bin); err != nil {
+		return "", err
+	}
+	if err := restartAgent(agent, bin); err != nil {
+		return "", err
+	}
+	log.WithField("agent", agent).Warn("agent update rolled back")
+	return "OK", nil
+}
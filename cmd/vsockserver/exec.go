@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+// execBaseDir is cmdserver's base dir, so commands run where they would if
+// sent to cmdserver over HTTP.
+const execBaseDir = "/tmp/server_files"
+
+var commandTimeout = flag.Duration("command-timeout", 10*time.Minute, "default timeout of shell and EXEC commands, 0 for none")
+
+// handleExec runs a blocking command for the host when the guest network is
+// unusable. Format: EXEC <cmdserver.RunCmdRequest as JSON>. The response is
+// a cmdserver.RunCmdResponse as JSON, on one line. The command is killed if
+// ctx is canceled.
+func handleExec(ctx context.Context, cmd string) (string, error) {
+	var req cmdserver.RunCmdRequest
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(cmd, "EXEC ")), &req); err != nil {
+		return "", fmt.Errorf("invalid EXEC request: %w", err)
+	}
+	if strings.TrimSpace(req.Cmd) == "" {
+		return "", fmt.Errorf("empty command")
+	}
+	if req.Stream || !req.Blocking {
+		return "", fmt.Errorf("only blocking commands can be run over vsock")
+	}
+
+	workingDir := execBaseDir
+	if req.Workspace != "" {
+		if err := cmdserver.ValidateWorkspaceName(req.Workspace); err != nil {
+			return "", err
+		}
+		workingDir = filepath.Join(execBaseDir, "workspaces", req.Workspace)
+	}
+	if err := os.MkdirAll(workingDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create working dir: %w", err)
+	}
+	workingDir, err := cmdserver.ResolveCwd(workingDir, req.Cwd)
+	if err != nil {
+		return "", err
+	}
+	if err := cmdserver.ValidateEnv(req.Env); err != nil {
+		return "", err
+	}
+
+	cmdCtx, cancel, timeout := withCommandTimeout(ctx, time.Duration(req.TimeoutMs)*time.Millisecond)
+	defer cancel()
+	command := shellCommand(cmdCtx, req.Cmd, workingDir)
+	command.Env = cmdserver.CommandEnv(req.Env)
+
+	log.WithFields(log.Fields{
+		"cmd":        req.Cmd,
+		"workingDir": workingDir,
+	}).Info("Executing EXEC command")
+
+	output, err := command.CombinedOutput()
+	exitCode := 0
+	resp := cmdserver.RunCmdResponse{
+		Output:   string(output),
+		ExitCode: &exitCode,
+	}
+	if err != nil {
+		exitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		err = commandError(ctx, cmdCtx, err, timeout)
+		resp.Error = err.Error()
+		var timeoutErr *timeoutError
+		resp.TimedOut = errors.As(err, &timeoutErr)
+		log.WithField("cmd", req.Cmd).WithError(err).Warn("EXEC command failed")
+	}
+
+	out, err := json.Marshal(resp)
+	return string(out), err
+}
+
+// timeoutError is returned for commands killed at their timeout.
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("command timed out after %s", e.timeout)
+}
+
+// withCommandTimeout returns the context to run a command with a timeout in,
+// and the timeout. A zero timeout is the -command-timeout default; if that's
+// zero too, the command only stops when ctx is done.
+func withCommandTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc, time.Duration) {
+	if timeout <= 0 {
+		timeout = *commandTimeout
+	}
+	if timeout <= 0 {
+		cmdCtx, cancel := context.WithCancel(ctx)
+		return cmdCtx, cancel, 0
+	}
+	cmdCtx, cancel := context.WithTimeout(ctx, timeout)
+	return cmdCtx, cancel, timeout
+}
+
+// commandError explains why a command run in cmdCtx, derived from ctx,
+// failed with err.
+func commandError(ctx context.Context, cmdCtx context.Context, err error, timeout time.Duration) error {
+	switch {
+	case ctx.Err() != nil:
+		return fmt.Errorf("command canceled: %w", context.Cause(ctx))
+	case errors.Is(cmdCtx.Err(), context.DeadlineExceeded):
+		return &timeoutError{timeout: timeout}
+	default:
+		return err
+	}
+}
+
+// shellCommand returns a bash command for cmd, run in dir with a restricted
+// PATH. As in cmdserver, the whole process group is killed once ctx is done,
+// so nothing the command started is left running in the guest.
+func shellCommand(ctx context.Context, cmd string, dir string) *exec.Cmd {
+	command := exec.CommandContext(ctx, "/bin/bash", "-c", cmd)
+	command.Env = cmdserver.CommandEnv(nil)
+	command.Dir = dir
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	command.Cancel = func() error {
+		return syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+	}
+	command.WaitDelay = time.Second
+	return command
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+// execLine returns req as an EXEC command.
+func execLine(t *testing.T, req cmdserver.RunCmdRequest) string {
+	t.Helper()
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "EXEC " + string(data)
+}
+
+func TestHandleExec(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		req      cmdserver.RunCmdRequest
+		output   string
+		exitCode int
+		errMsg   string
+	}{
+		{"ok", cmdserver.RunCmdRequest{Cmd: "echo hi", Blocking: true}, "hi\n", 0, ""},
+		{"multiline", cmdserver.RunCmdRequest{Cmd: "echo one\necho two", Blocking: true}, "one\ntwo\n", 0, ""},
+		{"exit code", cmdserver.RunCmdRequest{Cmd: "echo out; echo err >&2; exit 3", Blocking: true}, "out\nerr\n", 3, "exit status 3"},
+		{"base dir", cmdserver.RunCmdRequest{Cmd: "pwd", Blocking: true}, execBaseDir + "\n", 0, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := handleExec(context.Background(), execLine(t, tc.req))
+			if err != nil {
+				t.Fatalf("handleExec: %v", err)
+			}
+			var resp cmdserver.RunCmdResponse
+			if err := json.Unmarshal([]byte(out), &resp); err != nil {
+				t.Fatalf("response %q: %v", out, err)
+			}
+			if strings.Contains(out, "\n") {
+				t.Errorf("response %q spans lines", out)
+			}
+			if resp.Output != tc.output || resp.ExitCode == nil || *resp.ExitCode != tc.exitCode || !strings.Contains(resp.Error, tc.errMsg) {
+				t.Errorf("response = %+v, want output %q, exit code %d, error %q", resp, tc.output, tc.exitCode, tc.errMsg)
+			}
+		})
+	}
+}
+
+func TestHandleExecInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		cmd    string
+		errMsg string
+	}{
+		{"EXEC echo hi", "invalid EXEC request"},
+		{`EXEC {"cmd":" ","blocking":true}`, "empty command"},
+		{`EXEC {"cmd":"sleep 10"}`, "only blocking commands"},
+		{`EXEC {"cmd":"echo hi","blocking":true,"stream":true}`, "only blocking commands"},
+	} {
+		if out, err := handleExec(context.Background(), tc.cmd); err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+			t.Errorf("handleExec(%s) = %q, %v, want error %q", tc.cmd, out, err, tc.errMsg)
+		}
+	}
+}
+
+func TestParseTimeoutCommand(t *testing.T) {
+	for _, tc := range []struct {
+		cmd     string
+		timeout time.Duration
+		command string
+		errMsg  string
+	}{
+		{"TIMEOUT 5s sleep 1", 5 * time.Second, "sleep 1", ""},
+		{"TIMEOUT 100ms  echo a b ", 100 * time.Millisecond, "echo a b", ""},
+		{"TIMEOUT 5s", 0, "", "usage"},
+		{"TIMEOUT 5s  ", 0, "", "usage"},
+		{"TIMEOUT soon echo hi", 0, "", "invalid TIMEOUT duration"},
+		{"TIMEOUT -1s echo hi", 0, "", "invalid TIMEOUT duration"},
+	} {
+		timeout, command, err := parseTimeoutCommand(tc.cmd)
+		if timeout != tc.timeout || command != tc.command || (err == nil) != (tc.errMsg == "") ||
+			(err != nil && !strings.Contains(err.Error(), tc.errMsg)) {
+			t.Errorf("parseTimeoutCommand(%q) = %s, %q, %v, want %s, %q, error %q", tc.cmd, timeout, command, err, tc.timeout, tc.command, tc.errMsg)
+		}
+	}
+}
+
+// waitForExit waits for the process pid to be gone, or a zombie whose
+// parent hasn't reaped it.
+func waitForExit(t *testing.T, pid int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		// The state follows the parenthesized command name.
+		if err != nil || strings.HasPrefix(strings.TrimSpace(string(stat[bytes.LastIndexByte(stat, ')')+1:])), "Z") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("process %d still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// backgroundSleep is a command that prints the PID of a sleep it leaves
+// running in its process group, then waits for it.
+const backgroundSleep = "sleep 30 & echo $!; wait"
+
+func TestRunShellTimeout(t *testing.T) {
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defaultTimeout := *commandTimeout
+	t.Cleanup(func() { *commandTimeout = defaultTimeout })
+	*commandTimeout = 200 * time.Millisecond
+
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"requested", 100 * time.Millisecond, 100 * time.Millisecond},
+		{"default", 0, 200 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Now()
+			output, err := runShell(context.Background(), backgroundSleep, tc.timeout)
+			var timeoutErr *timeoutError
+			if !errors.As(err, &timeoutErr) || timeoutErr.timeout != tc.want {
+				t.Fatalf("runShell = %v, want a timeout after %s", err, tc.want)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("runShell returned after %s", elapsed)
+			}
+			// The output so far is kept, and the whole process group is
+			// killed.
+			pid, err := strconv.Atoi(strings.TrimSpace(string(output)))
+			if err != nil {
+				t.Fatalf("output = %q, want the sleep's PID", output)
+			}
+			waitForExit(t, pid)
+		})
+	}
+}
+
+func TestHandleExecTimeout(t *testing.T) {
+	out, err := handleExec(context.Background(), execLine(t, cmdserver.RunCmdRequest{Cmd: "echo partial; sleep 30", Blocking: true, TimeoutMs: 100}))
+	if err != nil {
+		t.Fatalf("handleExec: %v", err)
+	}
+	var resp cmdserver.RunCmdResponse
+	if err := json.Unmarshal([]byte(out), &resp); err != nil {
+		t.Fatalf("response %q: %v", out, err)
+	}
+	if !resp.TimedOut || resp.Output != "partial\n" || !strings.Contains(resp.Error, "timed out after 100ms") {
+		t.Errorf("response = %+v, want a timeout with the partial output", resp)
+	}
+}
+
+func TestExecTimeoutFrame(t *testing.T) {
+	resp := handleFrame(context.Background(), `{"id":"1","type":"exec","cmd":"echo partial; sleep 30","timeoutMs":100}`)
+	if !resp.TimedOut || resp.ExitCode != nil || resp.Output != "partial\n" || !strings.Contains(resp.Error, "timed out") {
+		t.Errorf("response = %+v, want a timeout with the partial output and no exit code", resp)
+	}
+}
+
+func TestCommandCanceledOnClose(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		line func(cmd string) string
+	}{
+		{"plain-text", func(cmd string) string { return cmd }},
+		{"framed", func(cmd string) string {
+			return frame(t, requestFrame{ID: "1", Type: frameTypeExec, Cmd: cmd})
+		}},
+		{"EXEC", func(cmd string) string {
+			return execLine(t, cmdserver.RunCmdRequest{Cmd: cmd, Blocking: true})
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pidFile := filepath.Join(t.TempDir(), "pid")
+			conn, _ := connect(t)
+			send(conn, tc.line("sleep 30 & echo $! > "+pidFile+"; wait"))
+
+			var pid int
+			deadline := time.Now().Add(5 * time.Second)
+			for pid == 0 {
+				data, _ := os.ReadFile(pidFile)
+				if strings.HasSuffix(string(data), "\n") {
+					pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("command didn't start")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			// The host going away kills the command rather than leaving it
+			// running in the guest.
+			conn.Close()
+			waitForExit(t, pid)
+		})
+	}
+}
+
+func TestCommandErrorCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errConnectionClosed)
+	err := commandError(ctx, ctx, errors.New("signal: killed"), time.Minute)
+	if !errors.Is(err, errConnectionClosed) || !strings.Contains(err.Error(), "command canceled: connection closed") {
+		t.Errorf("commandError = %v, want canceled by the connection closing", err)
+	}
+}
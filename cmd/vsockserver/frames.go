@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Frame types.
+	frameTypeCommand  = "command"
+	frameTypeExec     = "exec"
+	frameTypeCallback = "callback"
+
+	// maxPipelinedFrames is how many requests a connection can have in
+	// flight before the server stops reading new ones.
+	maxPipelinedFrames = 64
+)
+
+// requestFrame is a request from a client speaking the framed protocol, one
+// JSON object per line. Unlike plain-text commands, frames can carry
+// newlines and be pipelined: responses come back in request order.
+type requestFrame struct {
+	// ID is echoed in the response.
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Cmd is a plain-text command for "command" frames, or a shell command
+	// for "exec" frames.
+	Cmd string `json:"cmd,omitempty"`
+	// Method and Params are the callback for "callback" frames.
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	// TimeoutMs overrides the -command-timeout default for "exec" frames.
+	TimeoutMs int64 `json:"timeoutMs,omitempty"`
+}
+
+// responseFrame is the response to a requestFrame.
+type responseFrame struct {
+	ID     string `json:"id"`
+	Output string `json:"output"`
+	// ExitCode is set for "exec" frames whose command ran.
+	ExitCode *int `json:"exitCode,omitempty"`
+	// TimedOut is set for "exec" frames whose command was killed at its
+	// timeout. Output has what it wrote until then.
+	TimedOut bool   `json:"timedOut,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// isFrame reports whether the first line of a connection is a request frame
+// rather than a plain-text command. Shell commands can start with "{" too,
+// but aren't valid JSON.
+func isFrame(line string) bool {
+	return strings.HasPrefix(line, "{") && json.Valid([]byte(line))
+}
+
+// serveFrames serves a connection speaking the framed protocol, starting
+// with its first line. Each request runs in its own goroutine; responses are
+// written in request order. Requests still running when the connection
+// closes are canceled through ctx.
+func serveFrames(ctx context.Context, cancel context.CancelCauseFunc, conn net.Conn, reader *bufio.Reader, first string) {
+	pending := make(chan chan responseFrame, maxPipelinedFrames)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writeFrames(conn, pending)
+	}()
+
+	line := first
+	for {
+		if line != "" {
+			result := make(chan responseFrame, 1)
+			pending <- result
+			go func(line string) {
+				result <- handleFrame(ctx, line)
+			}(line)
+		}
+
+		next, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Errorf("Error reading from connection: %v", err)
+			}
+			break
+		}
+		line = strings.TrimSpace(next)
+	}
+	cancel(errConnectionClosed)
+	close(pending)
+	<-done
+}
+
+// writeFrames writes the responses of a connection as they complete, in the
+// order of pending. If a write fails, the connection is closed so no more
+// requests are read, and the remaining responses are discarded.
+func writeFrames(conn net.Conn, pending <-chan chan responseFrame) {
+	failed := false
+	for result := range pending {
+		resp := <-result
+		if failed {
+			continue
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			data, _ = json.Marshal(responseFrame{ID: resp.ID, Error: fmt.Sprintf("failed to marshal response: %v", err)})
+		}
+		if _, err := conn.Write(append(data, '\n')); err != nil {
+			log.Errorf("Error writing response: %v", err)
+			failed = true
+			conn.Close()
+		}
+	}
+}
+
+// handleFrame runs the request in line and returns its response.
+func handleFrame(ctx context.Context, line string) responseFrame {
+	var req requestFrame
+	if err := json.Unmarshal([]byte(line), &req); err != nil {
+		return responseFrame{Error: fmt.Sprintf("invalid frame: %v", err)}
+	}
+	resp := responseFrame{ID: req.ID}
+
+	var err error
+	switch req.Type {
+	case frameTypeCommand:
+		resp.Output, err = runCommand(ctx, strings.TrimSpace(req.Cmd))
+	case frameTypeExec:
+		if strings.TrimSpace(req.Cmd) == "" {
+			err = fmt.Errorf("empty command")
+			break
+		}
+		var output []byte
+		output, err = runShell(ctx, req.Cmd, time.Duration(req.TimeoutMs)*time.Millisecond)
+		resp.Output = string(output)
+		exitCode := 0
+		var exitErr *exec.ExitError
+		var timeoutErr *timeoutError
+		switch {
+		case errors.As(err, &timeoutErr):
+			resp.TimedOut = true
+		case errors.As(err, &exitErr):
+			exitCode = exitErr.ExitCode()
+			resp.ExitCode = &exitCode
+		case err == nil:
+			resp.ExitCode = &exitCode
+		}
+	case frameTypeCallback:
+		if req.Method == "" {
+			err = fmt.Errorf("callback frame requires a method")
+			break
+		}
+		resp.Output, err = runCallback(req.Method, string(req.Params))
+	default:
+		err = fmt.Errorf("unknown frame type: %q", req.Type)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
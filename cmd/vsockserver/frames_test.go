@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// connect serves one connection over a net.Pipe and returns its client end
+// and a reader of its responses.
+func connect(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	// Shell commands run in baseDir, which main creates.
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleConnection(server)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client, bufio.NewReader(client)
+}
+
+// send writes lines to conn in the background, as net.Pipe writes block
+// until they're read.
+func send(conn net.Conn, lines ...string) {
+	go func() {
+		for _, line := range lines {
+			if _, err := fmt.Fprintln(conn, line); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// readFrame reads the next response frame from reader.
+func readFrame(t *testing.T, reader *bufio.Reader) responseFrame {
+	t.Helper()
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	var resp responseFrame
+	if err := json.Unmarshal([]byte(line), &resp); err != nil {
+		t.Fatalf("response %q isn't a frame: %v", line, err)
+	}
+	return resp
+}
+
+// frame returns req as a request line.
+func frame(t *testing.T, req requestFrame) string {
+	t.Helper()
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestIsFrame(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want bool
+	}{
+		{`{"id":"1","type":"command","cmd":"VERSION"}`, true},
+		{`{}`, true},
+		// Shell commands that look like JSON objects until they're parsed.
+		{`{ echo hi; }`, false},
+		{`{"id":"1"} && true`, false},
+		{`echo {"id":"1"}`, false},
+		{`VERSION`, false},
+		{`[1, 2]`, false},
+	} {
+		if got := isFrame(tc.line); got != tc.want {
+			t.Errorf("isFrame(%q) = %t, want %t", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestFramesPipelined(t *testing.T) {
+	conn, reader := connect(t)
+	// The first request finishes last, but is still answered first.
+	send(conn,
+		frame(t, requestFrame{ID: "slow", Type: frameTypeExec, Cmd: "sleep 0.3; echo slow"}),
+		frame(t, requestFrame{ID: "fast", Type: frameTypeExec, Cmd: "echo fast"}),
+		frame(t, requestFrame{ID: "multiline", Type: frameTypeExec, Cmd: "echo one\necho two"}),
+		frame(t, requestFrame{ID: "stats", Type: frameTypeCommand, Cmd: "CALLBACK_STATS"}),
+		"",
+		frame(t, requestFrame{ID: "failed", Type: frameTypeExec, Cmd: "echo Error: not really; exit 3"}),
+	)
+
+	for _, want := range []struct {
+		id       string
+		output   string
+		exitCode int
+	}{
+		{"slow", "slow\n", 0},
+		{"fast", "fast\n", 0},
+		{"multiline", "one\ntwo\n", 0},
+		{"stats", "", -1},
+		{"failed", "Error: not really\n", 3},
+	} {
+		resp := readFrame(t, reader)
+		if resp.ID != want.id {
+			t.Fatalf("response %+v out of order, want %s", resp, want.id)
+		}
+		if want.exitCode < 0 {
+			var stats CallbackStats
+			if err := json.Unmarshal([]byte(resp.Output), &stats); err != nil || resp.ExitCode != nil {
+				t.Errorf("%s = %+v, want callback stats without an exit code", want.id, resp)
+			}
+			continue
+		}
+		if resp.Output != want.output || resp.ExitCode == nil || *resp.ExitCode != want.exitCode {
+			t.Errorf("%s = %+v, want output %q with exit code %d", want.id, resp, want.output, want.exitCode)
+		}
+		// Output that looks like an error isn't mistaken for one.
+		if (resp.Error != "") != (want.exitCode != 0) {
+			t.Errorf("%s error = %q with exit code %d", want.id, resp.Error, want.exitCode)
+		}
+	}
+}
+
+func TestHandleFrameErrors(t *testing.T) {
+	for _, tc := range []struct {
+		line   string
+		id     string
+		errMsg string
+	}{
+		{`{"id":1}`, "", "invalid frame"},
+		{`{"id":"1","type":"shell","cmd":"true"}`, "1", `unknown frame type: "shell"`},
+		{`{"id":"2","type":"exec","cmd":"  "}`, "2", "empty command"},
+		{`{"id":"3","type":"callback"}`, "3", "callback frame requires a method"},
+		{`{"id":"4","type":"command","cmd":"AGENT_UPDATE vsockserver 10 abc"}`, "4", "requires the plain-text protocol"},
+		{`{"id":"5","type":"command","cmd":"AGENT_BOGUS"}`, "5", "unknown command"},
+	} {
+		resp := handleFrame(context.Background(), tc.line)
+		if resp.ID != tc.id || !strings.Contains(resp.Error, tc.errMsg) || resp.ExitCode != nil {
+			t.Errorf("handleFrame(%s) = %+v, want id %q and error %q", tc.line, resp, tc.id, tc.errMsg)
+		}
+	}
+}
+
+func TestPlainTextFallback(t *testing.T) {
+	conn, reader := connect(t)
+	// A shell command starting with "{" keeps the connection plain-text.
+	send(conn, "", "{ echo grouped; }", "CALLBACK_STATS", "exit 3")
+
+	var got []string
+	for range 5 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		got = append(got, line)
+	}
+	// Shell output is followed by the response's own newline, and errors
+	// can't be told from output starting with "Error:".
+	if got[0] != "grouped\n" || got[1] != "\n" {
+		t.Errorf("grouped command response = %q, want its output", got[:2])
+	}
+	var stats CallbackStats
+	if err := json.Unmarshal([]byte(got[2]), &stats); err != nil {
+		t.Errorf("CALLBACK_STATS response = %q: %v", got[2], err)
+	}
+	if got[3] != "Error: exit status 3\n" || got[4] != "Output: \n" {
+		t.Errorf("failed command response = %q", got[3:])
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// heartbeatMethod is the callback method the host records heartbeats for
+// instead of routing them on.
+const heartbeatMethod = "cbox.heartbeat"
+
+// heartbeatInterval is how often heartbeats are sent. It's set from the
+// kernel command line, where zero turns them off.
+var heartbeatInterval = 15 * time.Second
+
+// GuestStats is the guest health a heartbeat reports.
+type GuestStats struct {
+	UptimeSeconds     float64 `json:"uptimeSeconds"`
+	Load1             float64 `json:"load1"`
+	Load5             float64 `json:"load5"`
+	Load15            float64 `json:"load15"`
+	MemTotalBytes     int64   `json:"memTotalBytes"`
+	MemFreeBytes      int64   `json:"memFreeBytes"`
+	MemAvailableBytes int64   `json:"memAvailableBytes"`
+	// IntervalSeconds tells the host when to expect the next heartbeat.
+	IntervalSeconds float64 `json:"intervalSeconds"`
+}
+
+// sendHeartbeats sends a heartbeat to the host every interval, starting
+// now, so it knows the guest is alive.
+func sendHeartbeats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := sendHeartbeat(interval); err != nil {
+			log.WithError(err).Debug("Failed to send heartbeat")
+		}
+		<-ticker.C
+	}
+}
+
+// sendHeartbeat sends one heartbeat over vsock. Unlike other callbacks,
+// heartbeats don't fall back to HTTP: the next one is only interval away.
+func sendHeartbeat(interval time.Duration) error {
+	stats, err := readGuestStats()
+	if err != nil {
+		return err
+	}
+	stats.IntervalSeconds = interval.Seconds()
+	params, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("failed to marshal heartbeat: %w", err)
+	}
+
+	conn, err := dialHost(callbackVsockPort)
+	if err != nil {
+		return fmt.Errorf("vsock callback listener unavailable: %w", err)
+	}
+	defer conn.Close()
+	_, err = sendVsockCallback(conn, heartbeatMethod, string(params))
+	return err
+}
+
+// readGuestStats reads the guest's uptime, load average and memory from
+// /proc.
+func readGuestStats() (GuestStats, error) {
+	var stats GuestStats
+
+	uptime, err := readProcFields(filepath.Join(procDir, "uptime"), 1)
+	if err != nil {
+		return stats, err
+	}
+	loadavg, err := readProcFields(filepath.Join(procDir, "loadavg"), 3)
+	if err != nil {
+		return stats, err
+	}
+	values := make([]float64, 0, 4)
+	for _, field := range append(uptime, loadavg...) {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return stats, fmt.Errorf("failed to parse %q: %w", field, err)
+		}
+		values = append(values, value)
+	}
+	stats.UptimeSeconds = values[0]
+	stats.Load1, stats.Load5, stats.Load15 = values[1], values[2], values[3]
+
+	meminfoPath := filepath.Join(procDir, "meminfo")
+	meminfo, err := os.ReadFile(meminfoPath)
+	if err != nil {
+		return stats, fmt.Errorf("failed to read %s: %w", meminfoPath, err)
+	}
+	// Lines look like "MemFree:          123456 kB".
+	for _, line := range strings.Split(string(meminfo), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			stats.MemTotalBytes = kb * 1024
+		case "MemFree:":
+			stats.MemFreeBytes = kb * 1024
+		case "MemAvailable:":
+			stats.MemAvailableBytes = kb * 1024
+		}
+	}
+	return stats, nil
+}
+
+// readProcFields returns the first n whitespace separated fields of a /proc
+// file.
+func readProcFields(path string, n int) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < n {
+		return nil, fmt.Errorf("unexpected %s contents: %q", path, data)
+	}
+	return fields[:n], nil
+}
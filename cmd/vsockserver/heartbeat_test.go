@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testUptime  = "12345.67 45678.90\n"
+	testLoadavg = "0.50 0.25 0.10 1/123 4567\n"
+	testMeminfo = "MemTotal:        2048000 kB\nMemFree:          512000 kB\nMemAvailable:    1024000 kB\nBuffers:           10000 kB\n"
+)
+
+// fakeProc points procDir at a temp dir with files, until the test ends.
+func fakeProc(t *testing.T, files map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defaultDir := procDir
+	t.Cleanup(func() { procDir = defaultDir })
+	procDir = dir
+}
+
+func TestReadGuestStats(t *testing.T) {
+	fakeProc(t, map[string]string{"uptime": testUptime, "loadavg": testLoadavg, "meminfo": testMeminfo})
+	stats, err := readGuestStats()
+	if err != nil {
+		t.Fatalf("readGuestStats: %v", err)
+	}
+	want := GuestStats{
+		UptimeSeconds:     12345.67,
+		Load1:             0.5,
+		Load5:             0.25,
+		Load15:            0.1,
+		MemTotalBytes:     2048000 * 1024,
+		MemFreeBytes:      512000 * 1024,
+		MemAvailableBytes: 1024000 * 1024,
+	}
+	if stats != want {
+		t.Errorf("readGuestStats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestReadGuestStatsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		files  map[string]string
+		errMsg string
+	}{
+		{"no uptime", map[string]string{"loadavg": testLoadavg, "meminfo": testMeminfo}, "failed to read"},
+		{"short loadavg", map[string]string{"uptime": testUptime, "loadavg": "0.50 0.25\n", "meminfo": testMeminfo}, "unexpected"},
+		{"bad load", map[string]string{"uptime": testUptime, "loadavg": "0.50 high 0.10\n", "meminfo": testMeminfo}, `failed to parse "high"`},
+		{"no meminfo", map[string]string{"uptime": testUptime, "loadavg": testLoadavg}, "failed to read"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeProc(t, tc.files)
+			if _, err := readGuestStats(); err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+				t.Errorf("readGuestStats = %v, want error %q", err, tc.errMsg)
+			}
+		})
+	}
+}
+
+// fakeHost makes dialHost connect to handle over a net.Pipe, until the test
+// ends. A nil handle makes the host unreachable.
+func fakeHost(t *testing.T, handle func(port uint32, conn net.Conn)) {
+	t.Helper()
+	defaultDial := dialHost
+	t.Cleanup(func() { dialHost = defaultDial })
+	dialHost = func(port uint32) (net.Conn, error) {
+		if handle == nil {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			handle(port, server)
+		}()
+		return client, nil
+	}
+}
+
+func TestSendHeartbeat(t *testing.T) {
+	fakeProc(t, map[string]string{"uptime": testUptime, "loadavg": testLoadavg, "meminfo": testMeminfo})
+	requests := make(chan CallbackRequest, 1)
+	fakeHost(t, func(port uint32, conn net.Conn) {
+		line, err := bufio.NewReader(conn).ReadBytes('\n')
+		if err != nil || port != callbackVsockPort {
+			return
+		}
+		var req CallbackRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			return
+		}
+		requests <- req
+		fmt.Fprintln(conn, `{"result":{}}`)
+	})
+
+	if err := sendHeartbeat(15 * time.Second); err != nil {
+		t.Fatalf("sendHeartbeat: %v", err)
+	}
+	req := <-requests
+	var stats GuestStats
+	if err := json.Unmarshal(req.Params, &stats); err != nil {
+		t.Fatalf("heartbeat params %s: %v", req.Params, err)
+	}
+	// The interval tells the host when the next one is due.
+	if req.Method != heartbeatMethod || req.VMName != currentVMName() || stats.IntervalSeconds != 15 || stats.Load1 != 0.5 {
+		t.Errorf("heartbeat = %s %s %+v", req.Method, req.VMName, stats)
+	}
+}
+
+func TestSendHeartbeatErrors(t *testing.T) {
+	fakeProc(t, map[string]string{"uptime": testUptime, "loadavg": testLoadavg, "meminfo": testMeminfo})
+	for _, tc := range []struct {
+		name   string
+		handle func(port uint32, conn net.Conn)
+		errMsg string
+	}{
+		// Heartbeats don't fall back to HTTP.
+		{"host unreachable", nil, "vsock callback listener unavailable"},
+		{"rejected", func(port uint32, conn net.Conn) {
+			bufio.NewReader(conn).ReadBytes('\n')
+			fmt.Fprintln(conn, `{"error":"vm not found"}`)
+		}, "callback error: vm not found"},
+		{"closed", func(port uint32, conn net.Conn) {
+			bufio.NewReader(conn).ReadBytes('\n')
+		}, "failed to read vsock callback response"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeHost(t, tc.handle)
+			if err := sendHeartbeat(time.Second); err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+				t.Errorf("sendHeartbeat = %v, want error %q", err, tc.errMsg)
+			}
+		})
+	}
+}
+
+func TestHeartbeatIntervalFromCmdline(t *testing.T) {
+	defaultInterval, defaultGateway, defaultName := heartbeatInterval, gatewayIP, vmName
+	t.Cleanup(func() {
+		heartbeatInterval, gatewayIP, vmName = defaultInterval, defaultGateway, defaultName
+	})
+
+	for _, tc := range []struct {
+		cmdline string
+		want    time.Duration
+	}{
+		{"console=ttyS0 gateway_ip=10.20.1.1 vm_name=vm1", defaultInterval},
+		{`gateway_ip=10.20.1.1 heartbeat_interval="30s"`, 30 * time.Second},
+		// Zero turns heartbeats off.
+		{"gateway_ip=10.20.1.1 heartbeat_interval=0s", 0},
+		{"gateway_ip=10.20.1.1 heartbeat_interval=often", defaultInterval},
+		{"gateway_ip=10.20.1.1 heartbeat_interval=-5s", defaultInterval},
+	} {
+		fakeProc(t, map[string]string{"cmdline": tc.cmdline + "\n"})
+		heartbeatInterval = defaultInterval
+		if err := parseKernelCmdLine(); err != nil {
+			t.Fatalf("parseKernelCmdLine(%q): %v", tc.cmdline, err)
+		}
+		if heartbeatInterval != tc.want {
+			t.Errorf("heartbeat interval from %q = %s, want %s", tc.cmdline, heartbeatInterval, tc.want)
+		}
+	}
+}
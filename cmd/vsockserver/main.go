@@ -3,13 +3,18 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/go-systemd/daemon"
@@ -24,14 +29,66 @@ const (
 
 	// Callback configuration
 	callbackTimeout = 30 * time.Second
+	// callbackVsockPort is the host port the restserver accepts callbacks on.
+	callbackVsockPort = 4033
+	// artifactVsockPort is the host port the restserver accepts artifacts on.
+	artifactVsockPort = 4034
+	publishTimeout    = 10 * time.Minute
 )
 
+// procDir is where the kernel command line and guest stats are read from.
+var procDir = "/proc"
+
+// dialHost connects to a vsock port of the host.
+var dialHost = func(port uint32) (net.Conn, error) {
+	return vsock.Dial(vsock.Host, port, nil)
+}
+
 // Global variables set from kernel command line
 var (
 	gatewayIP string
 	vmName    string
 )
 
+// CallbackStats tracks CALLBACK outcomes as seen by this agent process. The
+// counters reset when the agent restarts, which is visible via AgentStartedAt.
+type CallbackStats struct {
+	AgentStartedAt time.Time  `json:"agentStartedAt"`
+	Sent           uint64     `json:"sent"`
+	Succeeded      uint64     `json:"succeeded"`
+	Failed         uint64     `json:"failed"`
+	LastError      string     `json:"lastError,omitempty"`
+	LastErrorAt    *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+var (
+	statsLock     sync.Mutex
+	callbackStats = CallbackStats{AgentStartedAt: time.Now().UTC()}
+)
+
+// recordCallback updates the callback counters with the outcome of a callback.
+func recordCallback(err error) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	callbackStats.Sent++
+	if err != nil {
+		callbackStats.Failed++
+		now := time.Now().UTC()
+		callbackStats.LastError = err.Error()
+		callbackStats.LastErrorAt = &now
+		return
+	}
+	callbackStats.Succeeded++
+}
+
+// getCallbackStats returns a snapshot of the callback counters.
+func getCallbackStats() CallbackStats {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	return callbackStats
+}
+
 // CallbackRequest represents an RPC callback request to the host.
 type CallbackRequest struct {
 	VMName string          `json:"vmName"`
@@ -47,9 +104,10 @@ type CallbackResponse struct {
 
 // parseKernelCmdLine parses the kernel command line to extract configuration.
 func parseKernelCmdLine() error {
-	data, err := os.ReadFile("/proc/cmdline")
+	cmdlinePath := filepath.Join(procDir, "cmdline")
+	data, err := os.ReadFile(cmdlinePath)
 	if err != nil {
-		return fmt.Errorf("failed to read /proc/cmdline: %w", err)
+		return fmt.Errorf("failed to read %s: %w", cmdlinePath, err)
 	}
 
 	cmdline := string(data)
@@ -62,6 +120,15 @@ func parseKernelCmdLine() error {
 		if strings.HasPrefix(part, "vm_name=") {
 			vmName = strings.Trim(strings.TrimPrefix(part, "vm_name="), "\"")
 		}
+		if strings.HasPrefix(part, "heartbeat_interval=") {
+			value := strings.Trim(strings.TrimPrefix(part, "heartbeat_interval="), "\"")
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval < 0 {
+				log.Warnf("Ignoring invalid heartbeat_interval %q", value)
+				continue
+			}
+			heartbeatInterval = interval
+		}
 	}
 
 	if gatewayIP == "" {
@@ -88,8 +155,64 @@ func parseKernelCmdLine() error {
 
 // handleCallback processes a CALLBACK command and sends it to the cbox-restserver.
 // The restserver is responsible for routing the callback to the registered HTTP callback URL.
+// Callbacks go over vsock so they work without guest networking; HTTP via the
+// gateway is only used if the host's vsock callback listener is unreachable.
 func handleCallback(method string, paramsJSON string) (string, error) {
-	// Always send callbacks to the cbox-restserver via the gateway
+	conn, err := dialHost(callbackVsockPort)
+	if err != nil {
+		log.WithError(err).Warn("vsock callback listener unavailable, falling back to HTTP")
+		return handleHTTPCallback(method, paramsJSON)
+	}
+	defer conn.Close()
+	log.WithFields(log.Fields{
+		"method": method,
+		"vmName": currentVMName(),
+	}).Info("Sending callback to cbox-restserver over vsock")
+	return sendVsockCallback(conn, method, paramsJSON)
+}
+
+// sendVsockCallback sends a callback as a JSON line over a vsock connection to
+// the host and waits for the JSON line response.
+func sendVsockCallback(conn net.Conn, method string, paramsJSON string) (string, error) {
+	req := CallbackRequest{
+		VMName: currentVMName(),
+		Method: method,
+	}
+	if paramsJSON != "" {
+		req.Params = json.RawMessage(paramsJSON)
+	}
+
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal callback request: %w", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(callbackTimeout))
+	if _, err := conn.Write(append(reqBody, '\n')); err != nil {
+		return "", fmt.Errorf("failed to send vsock callback: %w", err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read vsock callback response: %w", err)
+	}
+
+	var callbackResp CallbackResponse
+	if err := json.Unmarshal(line, &callbackResp); err != nil {
+		return "", fmt.Errorf("invalid vsock callback response: %w", err)
+	}
+	if callbackResp.Error != "" {
+		return "", fmt.Errorf("callback error: %s", callbackResp.Error)
+	}
+	if callbackResp.Result != nil {
+		return string(callbackResp.Result), nil
+	}
+	return "{}", nil
+}
+
+// handleHTTPCallback sends a callback to the cbox-restserver's internal HTTP
+// endpoint via the gateway.
+func handleHTTPCallback(method string, paramsJSON string) (string, error) {
 	hostIP := gatewayIP
 	if idx := strings.Index(hostIP, "/"); idx != -1 {
 		hostIP = hostIP[:idx]
@@ -98,7 +221,7 @@ func handleCallback(method string, paramsJSON string) (string, error) {
 
 	// Build the callback request
 	req := CallbackRequest{
-		VMName: vmName,
+		VMName: currentVMName(),
 		Method: method,
 	}
 
@@ -127,7 +250,7 @@ func handleCallback(method string, paramsJSON string) (string, error) {
 	log.WithFields(log.Fields{
 		"url":    url,
 		"method": method,
-		"vmName": vmName,
+		"vmName": req.VMName,
 	}).Info("Sending callback to cbox-restserver")
 
 	resp, err := client.Do(httpReq)
@@ -165,6 +288,100 @@ func handleCallback(method string, paramsJSON string) (string, error) {
 	return "{}", nil
 }
 
+// ArtifactHeader starts an artifact upload to the host. It's followed by
+// exactly SizeBytes bytes of file content.
+type ArtifactHeader struct {
+	VMName    string `json:"vmName"`
+	Name      string `json:"name"`
+	SizeBytes int64  `json:"sizeBytes"`
+}
+
+// parsePublishCommand parses a PUBLISH command line.
+// Format: PUBLISH <guest-path> [<name>]
+// The name defaults to the file's base name.
+func parsePublishCommand(cmd string) (guestPath string, name string, err error) {
+	fields := strings.Fields(strings.TrimPrefix(cmd, "PUBLISH "))
+	switch len(fields) {
+	case 1:
+		return fields[0], filepath.Base(fields[0]), nil
+	case 2:
+		return fields[0], fields[1], nil
+	default:
+		return "", "", fmt.Errorf("usage: PUBLISH <guest-path> [name]")
+	}
+}
+
+// handlePublish streams a file to the host's artifact store over vsock and
+// returns the host's result, which has the name the artifact was stored
+// under.
+func handlePublish(guestPath string, name string) (string, error) {
+	if !filepath.IsAbs(guestPath) {
+		guestPath = filepath.Join(baseDir, guestPath)
+	}
+	file, err := os.Open(guestPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open artifact: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat artifact: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", guestPath)
+	}
+
+	conn, err := dialHost(artifactVsockPort)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to the host artifact store: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(publishTimeout))
+
+	header, err := json.Marshal(ArtifactHeader{
+		VMName:    currentVMName(),
+		Name:      name,
+		SizeBytes: info.Size(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal artifact header: %w", err)
+	}
+	if _, err := conn.Write(append(header, '\n')); err != nil {
+		return "", fmt.Errorf("failed to send artifact header: %w", err)
+	}
+
+	// The host answers the header first so a rejected artifact, e.g. one over
+	// the quota, isn't uploaded.
+	reader := bufio.NewReader(conn)
+	if _, err := readArtifactResponse(reader); err != nil {
+		return "", err
+	}
+	if _, err := io.CopyN(conn, file, info.Size()); err != nil {
+		return "", fmt.Errorf("failed to send artifact: %w", err)
+	}
+	result, err := readArtifactResponse(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(result), nil
+}
+
+// readArtifactResponse reads a response frame from the host artifact store.
+func readArtifactResponse(reader *bufio.Reader) (json.RawMessage, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read artifact response: %w", err)
+	}
+	var resp CallbackResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("invalid artifact response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("publish failed: %s", resp.Error)
+	}
+	return resp.Result, nil
+}
+
 // parseCallbackCommand parses a CALLBACK command line.
 // Format: CALLBACK <method> [<params_json>]
 func parseCallbackCommand(cmd string) (method string, params string, err error) {
@@ -189,12 +406,20 @@ func parseCallbackCommand(cmd string) (method string, params string, err error)
 	return method, params, nil
 }
 
-func handleConnection(conn *vsock.Conn) {
+// errConnectionClosed cancels the commands of a connection the host closed.
+var errConnectionClosed = errors.New("connection closed")
+
+func handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	reader := bufio.NewReader(conn)
+	// Commands still running when the connection closes are canceled rather
+	// than left running in the guest.
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(errConnectionClosed)
 
-	for {
+	reader := bufio.NewReader(conn)
+	var first string
+	for first == "" {
 		// Read command from the connection
 		cmd, err := reader.ReadString('\n')
 		if err != nil {
@@ -203,100 +428,260 @@ func handleConnection(conn *vsock.Conn) {
 			}
 			return
 		}
-
 		// Trim whitespace and newline
-		cmd = strings.TrimSpace(cmd)
+		first = strings.TrimSpace(cmd)
+	}
 
-		if cmd == "" {
-			continue
-		}
+	// The first command tells framed clients from plain-text ones, which
+	// keep the connection plain-text.
+	if isFrame(first) {
+		serveFrames(ctx, cancel, conn, reader, first)
+		return
+	}
 
-		// Check if this is a CALLBACK command
-		if strings.HasPrefix(cmd, "CALLBACK ") {
-			method, params, err := parseCallbackCommand(cmd)
-			if err != nil {
-				errMsg := fmt.Sprintf("Error: %v\n", err)
-				log.WithField("cmd", cmd).WithError(err).Error("Invalid CALLBACK command")
-				conn.Write([]byte(errMsg))
-				continue
+	// Commands are read in the background so a closed connection is noticed
+	// while one runs. Reading pauses after AGENT_UPDATE, whose binary follows
+	// it on the connection.
+	commands := make(chan string)
+	resume := make(chan struct{})
+	go func() {
+		defer close(commands)
+		defer cancel(errConnectionClosed)
+		cmd := first
+		for {
+			if cmd != "" {
+				select {
+				case commands <- cmd:
+				case <-ctx.Done():
+					return
+				}
+				if strings.HasPrefix(cmd, "AGENT_UPDATE ") {
+					select {
+					case <-resume:
+					case <-ctx.Done():
+						return
+					}
+				}
 			}
 
-			log.WithFields(log.Fields{
-				"method": method,
-				"params": params,
-			}).Info("Processing CALLBACK command")
-
-			result, err := handleCallback(method, params)
+			line, err := reader.ReadString('\n')
 			if err != nil {
-				errMsg := fmt.Sprintf("Error: %v\n", err)
-				log.WithFields(log.Fields{
-					"method": method,
-					"error":  err,
-				}).Error("CALLBACK failed")
-				conn.Write([]byte(errMsg))
-				continue
+				if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+					log.Errorf("Error reading from connection: %v", err)
+				}
+				return
 			}
-
-			log.WithFields(log.Fields{
-				"method": method,
-				"result": result,
-			}).Info("CALLBACK completed successfully")
-
-			// Write the result back to the connection
-			_, err = conn.Write(append([]byte(result), '\n'))
+			cmd = strings.TrimSpace(line)
+		}
+	}()
+
+	for cmd := range commands {
+		var result string
+		var err error
+		if strings.HasPrefix(cmd, "AGENT_UPDATE ") {
+			var agent, digest string
+			var size int64
+			agent, size, digest, err = parseAgentUpdateCommand(cmd)
 			if err != nil {
-				log.Errorf("Error writing callback response: %v", err)
+				// The binary can't be framed without a valid size.
+				log.WithField("cmd", cmd).WithError(err).Error("Invalid AGENT_UPDATE command")
+				conn.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
 				return
 			}
+			result, err = handleAgentUpdate(reader, agent, size, digest)
+			if err != nil {
+				log.WithField("cmd", cmd).WithError(err).Error("Agent command failed")
+			}
+			resume <- struct{}{}
+		} else {
+			result, err = runCommand(ctx, cmd)
+		}
+		if err != nil {
+			conn.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
 			continue
 		}
 
-		// Regular command execution
-		// Set up environment variables with a restricted PATH for security
-		env := os.Environ()
-		customPath := "/usr/local/bin:/usr/bin:/bin"
-		env = append(env, "PATH="+customPath)
+		// Write the result back to the connection
+		if _, err := conn.Write(append([]byte(result), '\n')); err != nil {
+			log.Errorf("Error writing response: %v", err)
+			return
+		}
+	}
+}
 
-		// Create and configure the command
-		command := exec.Command("/bin/bash", "-c", cmd)
-		command.Env = env
-		command.Dir = baseDir
+// runCommand runs a plain-text command and returns its result. Lines that
+// aren't agent commands are run as shell commands, which are killed if ctx
+// is canceled.
+func runCommand(ctx context.Context, cmd string) (string, error) {
+	switch {
+	// Report callback counters tracked by this agent
+	case cmd == "CALLBACK_STATS":
+		stats, err := json.Marshal(getCallbackStats())
+		if err != nil {
+			log.WithError(err).Error("Failed to marshal callback stats")
+			return "", err
+		}
+		return string(stats), nil
 
-		// Log the command execution
-		log.WithFields(log.Fields{
-			"cmd":        cmd,
-			"workingDir": command.Dir,
-		}).Info("Executing command")
+	// Rename the VM, e.g. when the host hands out a pooled VM
+	case strings.HasPrefix(cmd, "VM_NAME "):
+		result, err := handleSetVMName(cmd)
+		if err != nil {
+			log.WithField("cmd", cmd).WithError(err).Error("VM_NAME failed")
+		}
+		return result, err
 
-		// Execute the command and capture output
-		output, err := command.CombinedOutput()
+	// Run a command for the host, e.g. when the guest network is down
+	case strings.HasPrefix(cmd, "EXEC "):
+		result, err := handleExec(ctx, cmd)
 		if err != nil {
-			errMsg := fmt.Sprintf("Error: %v\nOutput: %s\n", err, string(output))
-			log.WithFields(log.Fields{
-				"cmd":    cmd,
-				"error":  err,
-				"output": string(output),
-			}).Error("Command execution failed")
-			conn.Write([]byte(errMsg))
-			continue
+			log.WithError(err).Error("EXEC failed")
+		}
+		return result, err
+
+	// Agent version and update commands
+	case cmd == "VERSION" || strings.HasPrefix(cmd, "AGENT_"):
+		var result string
+		var err error
+		switch {
+		case cmd == "VERSION":
+			result, err = handleVersion()
+		case strings.HasPrefix(cmd, "AGENT_UPDATE "):
+			// Only plain-text connections can carry the binary.
+			err = fmt.Errorf("AGENT_UPDATE requires the plain-text protocol")
+		case strings.HasPrefix(cmd, "AGENT_COMMIT "):
+			result, err = handleAgentCommit(strings.TrimSpace(strings.TrimPrefix(cmd, "AGENT_COMMIT ")))
+		case strings.HasPrefix(cmd, "AGENT_ROLLBACK "):
+			result, err = handleAgentRollback(strings.TrimSpace(strings.TrimPrefix(cmd, "AGENT_ROLLBACK ")))
+		default:
+			err = fmt.Errorf("unknown command: %s", cmd)
+		}
+		if err != nil {
+			log.WithField("cmd", cmd).WithError(err).Error("Agent command failed")
+		}
+		return result, err
+
+	// Publish a file to the host's artifact store
+	case strings.HasPrefix(cmd, "PUBLISH "):
+		guestPath, name, err := parsePublishCommand(cmd)
+		if err != nil {
+			log.WithField("cmd", cmd).WithError(err).Error("PUBLISH failed")
+			return "", err
+		}
+		result, err := handlePublish(guestPath, name)
+		if err != nil {
+			log.WithField("cmd", cmd).WithError(err).Error("PUBLISH failed")
+			return "", err
+		}
+		log.WithFields(log.Fields{
+			"path":   guestPath,
+			"result": result,
+		}).Info("PUBLISH completed successfully")
+		return result, nil
+
+	// Check if this is a CALLBACK command
+	case strings.HasPrefix(cmd, "CALLBACK "):
+		method, params, err := parseCallbackCommand(cmd)
+		if err != nil {
+			log.WithField("cmd", cmd).WithError(err).Error("Invalid CALLBACK command")
+			return "", err
 		}
+		return runCallback(method, params)
+	}
 
-		// Log successful execution
+	// Regular command execution, optionally with a timeout.
+	// Format: [TIMEOUT <duration>] <command>
+	var timeout time.Duration
+	if strings.HasPrefix(cmd, "TIMEOUT ") {
+		var err error
+		if timeout, cmd, err = parseTimeoutCommand(cmd); err != nil {
+			return "", err
+		}
+	}
+	output, err := runShell(ctx, cmd, timeout)
+	if err != nil {
+		return "", fmt.Errorf("%v\nOutput: %s", err, string(output))
+	}
+	return string(output), nil
+}
+
+// runCallback sends a callback to the host and records its outcome.
+func runCallback(method string, params string) (string, error) {
+	log.WithFields(log.Fields{
+		"method": method,
+		"params": params,
+	}).Info("Processing CALLBACK command")
+
+	result, err := handleCallback(method, params)
+	recordCallback(err)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"method": method,
+			"error":  err,
+		}).Error("CALLBACK failed")
+		return "", err
+	}
+
+	log.WithFields(log.Fields{
+		"method": method,
+		"result": result,
+	}).Info("CALLBACK completed successfully")
+	return result, nil
+}
+
+// parseTimeoutCommand parses a TIMEOUT command line.
+// Format: TIMEOUT <duration> <command>
+func parseTimeoutCommand(cmd string) (time.Duration, string, error) {
+	duration, command, ok := strings.Cut(strings.TrimPrefix(cmd, "TIMEOUT "), " ")
+	command = strings.TrimSpace(command)
+	if !ok || command == "" {
+		return 0, "", fmt.Errorf("usage: TIMEOUT <duration> <command>")
+	}
+	timeout, err := time.ParseDuration(duration)
+	if err != nil || timeout <= 0 {
+		return 0, "", fmt.Errorf("invalid TIMEOUT duration: %q", duration)
+	}
+	return timeout, command, nil
+}
+
+// runShell runs cmd with bash in the base dir and returns its combined
+// output. The command is killed after timeout, or the -command-timeout
+// default if zero, or when ctx is canceled; the output so far is returned
+// with the error.
+func runShell(ctx context.Context, cmd string, timeout time.Duration) ([]byte, error) {
+	cmdCtx, cancel, timeout := withCommandTimeout(ctx, timeout)
+	defer cancel()
+	command := shellCommand(cmdCtx, cmd, baseDir)
+
+	// Log the command execution
+	log.WithFields(log.Fields{
+		"cmd":        cmd,
+		"workingDir": command.Dir,
+	}).Info("Executing command")
+
+	// Execute the command and capture output
+	output, err := command.CombinedOutput()
+	if err != nil {
+		err = commandError(ctx, cmdCtx, err, timeout)
 		log.WithFields(log.Fields{
 			"cmd":    cmd,
+			"error":  err,
 			"output": string(output),
-		}).Info("Command executed successfully")
-
-		// Write the output back to the connection
-		_, err = conn.Write(append(output, '\n'))
-		if err != nil {
-			log.Errorf("Error writing response: %v", err)
-			return
-		}
+		}).Error("Command execution failed")
+		return output, err
 	}
+
+	// Log successful execution
+	log.WithFields(log.Fields{
+		"cmd":    cmd,
+		"output": string(output),
+	}).Info("Command executed successfully")
+	return output, nil
 }
 
 func main() {
+	flag.Parse()
+
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
 		log.Fatalf("Failed to create base directory: %v", err)
 	}
@@ -306,6 +691,10 @@ func main() {
 		log.Warnf("Failed to parse kernel command line: %v", err)
 		// Continue anyway, callbacks just won't work
 	}
+	loadVMName()
+	if heartbeatInterval > 0 {
+		go sendHeartbeats(heartbeatInterval)
+	}
 
 	listener, err := vsock.Listen(uint32(port), &vsock.Config{})
 	if err != nil {
@@ -313,7 +702,7 @@ func main() {
 	}
 	defer listener.Close()
 
-	log.Printf("cbox-vsockserver listening on port %d...", port)
+	log.Printf("cbox-vsockserver %s listening on port %d...", version, port)
 	log.Printf("Gateway IP: %s, VM Name: %s", gatewayIP, vmName)
 
 	// Make other services start via systemd since we're ready to debug.
@@ -329,6 +718,6 @@ func main() {
 		}
 
 		// Handle each connection in a goroutine
-		go handleConnection(conn.(*vsock.Conn))
+		go handleConnection(conn)
 	}
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// vmNameFile keeps a name set with VM_NAME across agent restarts. It's on
+// tmpfs, so a reboot goes back to the name on the kernel command line and
+// the host sends the name again.
+const vmNameFile = "/run/cbox-vm-name"
+
+// vmNameLock guards vmName once connections are being served.
+var vmNameLock sync.RWMutex
+
+// currentVMName returns the name callbacks and artifacts are sent under.
+func currentVMName() string {
+	vmNameLock.RLock()
+	defer vmNameLock.RUnlock()
+	return vmName
+}
+
+// loadVMName picks up a name set with VM_NAME before the agent restarted,
+// which overrides the kernel command line.
+func loadVMName() {
+	data, err := os.ReadFile(vmNameFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warn("Failed to read VM name")
+		}
+		return
+	}
+	if name := strings.TrimSpace(string(data)); name != "" {
+		vmName = name
+	}
+}
+
+// handleSetVMName renames the VM as the host knows it, e.g. once a VM from
+// the host's warm pool is handed out under the name it was started with.
+// Format: VM_NAME <name>
+func handleSetVMName(cmd string) (string, error) {
+	name := strings.TrimSpace(strings.TrimPrefix(cmd, "VM_NAME "))
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return "", fmt.Errorf("usage: VM_NAME <name>")
+	}
+	if err := os.WriteFile(vmNameFile, []byte(name+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to save VM name: %w", err)
+	}
+
+	vmNameLock.Lock()
+	previous := vmName
+	vmName = name
+	vmNameLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"previousVMName": previous,
+		"vmName":         name,
+	}).Info("VM renamed")
+	out, err := json.Marshal(map[string]string{"vmName": name})
+	return string(out), err
+}
@@ -0,0 +1,86 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrMethodNotAllowed is returned for callbacks whose method isn't in the
+// session's allowed methods.
+var ErrMethodNotAllowed = errors.New("callback method not allowed")
+
+// ValidateMethodPatterns checks the patterns of an allowed methods list.
+func ValidateMethodPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return fmt.Errorf("allowed callback method patterns must not be empty")
+		}
+	}
+	return nil
+}
+
+// MatchMethod returns whether method matches pattern, in which "*" matches
+// any run of characters, including none, and "?" any single character.
+// Unlike path.Match, "*" also matches "/" and ".".
+func MatchMethod(pattern string, method string) bool {
+	// Backtracks to just after the last "*", consuming one more character
+	// of method with it each time.
+	p, m := 0, 0
+	star, starMatch := -1, 0
+	for m < len(method) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == method[m]):
+			p++
+			m++
+		case p < len(pattern) && pattern[p] == '*':
+			star, starMatch = p, m
+			p++
+		case star >= 0:
+			starMatch++
+			p, m = star+1, starMatch
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// allows returns whether the session may route method. Sessions without
+// allowed methods allow every method.
+func (s *Session) allows(method string) bool {
+	if len(s.AllowedMethods) == 0 {
+		return true
+	}
+	for _, pattern := range s.AllowedMethods {
+		if MatchMethod(pattern, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectCallback records a callback refused by the allowed methods of
+// session and returns the error handed back to the guest.
+func (m *SessionManager) rejectCallback(ctx context.Context, session *Session, method string, params json.RawMessage) error {
+	err := fmt.Errorf("%w: %s", ErrMethodNotAllowed, method)
+	m.statsLock.Lock()
+	stats, ok := m.stats[session.VMName]
+	if !ok {
+		stats = &Stats{}
+		m.stats[session.VMName] = stats
+	}
+	stats.Rejected++
+	stats.LastError = err.Error()
+	stats.LastErrorAt = time.Now().UTC()
+	m.statsLock.Unlock()
+
+	req := newCallbackRequest(session.VMName, method, params)
+	m.auditCallback(ctx, req, session.CallbackURL, time.Now(), err, false)
+	return err
+}
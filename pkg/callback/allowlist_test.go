@@ -0,0 +1,86 @@
+package callback
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMatchMethod(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		method  string
+		want    bool
+	}{
+		// Exact matches.
+		{"tools/run", "tools/run", true},
+		{"tools/run", "tools/runner", false},
+		{"tools/run", "tools/ru", false},
+		{"tools/run", "Tools/run", false},
+		{"", "", true},
+		{"", "tools/run", false},
+		// "*" matches any run of characters, "/" and "." included.
+		{"*", "", true},
+		{"*", "tools/run", true},
+		{"tools/*", "tools/run", true},
+		{"tools/*", "tools/", true},
+		{"tools/*", "tools/fs/read", true},
+		{"tools/*", "tool/run", false},
+		{"*.read", "fs.read", true},
+		{"*.read", "fs.write", false},
+		{"tools/*/read", "tools/fs/read", true},
+		{"tools/*/read", "tools/a/b/read", true},
+		{"tools/*/read", "tools/fs/write", false},
+		{"*a*b", "xaxbxab", true},
+		{"*a*b", "xaxbxa", false},
+		{"**", "anything", true},
+		// "?" matches a single character.
+		{"v?/run", "v1/run", true},
+		{"v?/run", "v10/run", false},
+		{"v?/run", "v/run", false},
+	} {
+		if got := MatchMethod(tc.pattern, tc.method); got != tc.want {
+			t.Errorf("MatchMethod(%q, %q) = %t, want %t", tc.pattern, tc.method, got, tc.want)
+		}
+	}
+}
+
+func TestValidateMethodPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		patterns []string
+		valid    bool
+	}{
+		{nil, true},
+		{[]string{"tools/run", "fs.*", "*"}, true},
+		{[]string{""}, false},
+		{[]string{"tools/*", ""}, false},
+	} {
+		if err := ValidateMethodPatterns(tc.patterns); (err == nil) != tc.valid {
+			t.Errorf("ValidateMethodPatterns(%q) = %v, want valid %t", tc.patterns, err, tc.valid)
+		}
+	}
+}
+
+func TestRouteCallbackAllowedMethods(t *testing.T) {
+	receiver, hits := newCountingReceiver(t, `"ok"`)
+	m := NewSessionManager()
+	defer m.Close()
+	if _, err := m.RegisterHTTPCallback("vm1", receiver.URL, "", []string{"tools/*", "fs.read"}); err != nil {
+		t.Fatalf("RegisterHTTPCallback: %v", err)
+	}
+
+	for _, method := range []string{"tools/run", "fs.read"} {
+		if _, err := m.RouteCallback(context.Background(), "vm1", method, nil); err != nil {
+			t.Errorf("RouteCallback(%s): %v", method, err)
+		}
+	}
+	if _, err := m.RouteCallback(context.Background(), "vm1", "fs.write", nil); !errors.Is(err, ErrMethodNotAllowed) {
+		t.Errorf("RouteCallback(fs.write) = %v, want ErrMethodNotAllowed", err)
+	}
+	if hits.Load() != 2 {
+		t.Errorf("receiver got %d callbacks, want the 2 allowed ones", hits.Load())
+	}
+	if stats := m.GetStats("vm1"); stats.Rejected != 1 {
+		t.Errorf("rejected = %d, want 1", stats.Rejected)
+	}
+}
@@ -0,0 +1,148 @@
+package callback
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// AuditConfig sizes the audit log of routed callbacks.
+type AuditConfig struct {
+	// Capacity is how many entries are kept across all VMs; the oldest are
+	// evicted first. Zero disables the audit log.
+	Capacity int
+	// ParamsLimit is how many bytes of each callback's params are kept.
+	ParamsLimit int
+}
+
+// AuditEntry records the outcome of a routed callback.
+type AuditEntry struct {
+	Time       time.Time
+	VMName     string
+	Method     string
+	CallbackID string
+	// ParamsSize is the size of the params; Params holds at most
+	// ParamsLimit bytes of them.
+	ParamsSize      int
+	Params          string
+	ParamsTruncated bool
+	// URL is where the callback was delivered, or the session's URL if it
+	// wasn't.
+	URL      string
+	Duration time.Duration
+	// StatusCode is the receiver's HTTP status, if it answered over HTTP.
+	StatusCode int
+	Error      string
+	// Queued is set for callbacks delivered from the VM's queue.
+	Queued bool
+}
+
+// AuditQuery selects entries from the audit log.
+type AuditQuery struct {
+	VMName string
+	// Method only matches entries for this method if set.
+	Method string
+	// Limit caps the number of entries returned, newest first.
+	Limit int
+}
+
+// auditLog is a ring buffer of AuditEntry.
+type auditLog struct {
+	lock    sync.Mutex
+	config  AuditConfig
+	entries []AuditEntry
+	// next is where the next entry goes once entries is full.
+	next int
+}
+
+func (l *auditLog) add(entry AuditEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.config.Capacity <= 0 {
+		return
+	}
+	if len(l.entries) < l.config.Capacity {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % l.config.Capacity
+}
+
+func (l *auditLog) query(query AuditQuery) []AuditEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var matches []AuditEntry
+	// Newest first: walk back from the entry before next.
+	n := len(l.entries)
+	for i := range n {
+		entry := l.entries[((l.next-1-i)%n+n)%n]
+		if entry.VMName != query.VMName || (query.Method != "" && entry.Method != query.Method) {
+			continue
+		}
+		matches = append(matches, entry)
+		if query.Limit > 0 && len(matches) == query.Limit {
+			break
+		}
+	}
+	return matches
+}
+
+// SetAuditConfig sizes the audit log. It must be called before callbacks are
+// routed.
+func (m *SessionManager) SetAuditConfig(config AuditConfig) {
+	m.audit.config = config
+}
+
+// AuditLog returns the audit log entries matching query.
+func (m *SessionManager) AuditLog(query AuditQuery) []AuditEntry {
+	return m.audit.query(query)
+}
+
+// auditCallback adds the outcome of delivering req to the audit log.
+func (m *SessionManager) auditCallback(ctx context.Context, req *CallbackRequest, url string, start time.Time, err error, queued bool) {
+	if m.audit.config.Capacity <= 0 {
+		return
+	}
+	entry := AuditEntry{
+		Time:       start.UTC(),
+		VMName:     req.VMName,
+		Method:     req.Method,
+		CallbackID: req.ID,
+		ParamsSize: len(req.Params),
+		Params:     string(req.Params),
+		URL:        url,
+		Duration:   time.Since(start),
+		StatusCode: statusCodeFrom(ctx),
+		Queued:     queued,
+	}
+	if limit := m.audit.config.ParamsLimit; len(entry.Params) > limit {
+		entry.Params = entry.Params[:limit]
+		entry.ParamsTruncated = true
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	m.audit.add(entry)
+}
+
+type statusCodeKey struct{}
+
+// withStatusCode returns a context in which transports can note the HTTP
+// status the receiver answered with, for the audit log.
+func withStatusCode(ctx context.Context) context.Context {
+	return context.WithValue(ctx, statusCodeKey{}, new(int))
+}
+
+func setStatusCode(ctx context.Context, statusCode int) {
+	if code, ok := ctx.Value(statusCodeKey{}).(*int); ok {
+		*code = statusCode
+	}
+}
+
+func statusCodeFrom(ctx context.Context) int {
+	if code, ok := ctx.Value(statusCodeKey{}).(*int); ok {
+		return *code
+	}
+	return 0
+}
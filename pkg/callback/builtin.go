@@ -0,0 +1,50 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// BuiltinPrefix is the method prefix reserved for callbacks handled by the
+// host itself. Methods with it are never forwarded to a VM's session, even
+// if no built-in handles them.
+const BuiltinPrefix = "cbox."
+
+// BuiltinHandler handles a built-in callback from vmName, returning the
+// result handed back to the guest.
+type BuiltinHandler func(ctx context.Context, vmName string, params json.RawMessage) (json.RawMessage, error)
+
+// RegisterBuiltin registers handler for method, which must start with
+// BuiltinPrefix. Each method can only be registered once.
+func (m *SessionManager) RegisterBuiltin(method string, handler BuiltinHandler) error {
+	if !IsBuiltin(method) || method == BuiltinPrefix {
+		return fmt.Errorf("built-in callback method %q must start with %q", method, BuiltinPrefix)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.builtins[method]; ok {
+		return fmt.Errorf("built-in callback method %q is already registered", method)
+	}
+	m.builtins[method] = handler
+	return nil
+}
+
+// IsBuiltin returns whether method is in the namespace reserved for
+// built-in callbacks.
+func IsBuiltin(method string) bool {
+	return strings.HasPrefix(method, BuiltinPrefix)
+}
+
+// routeBuiltin handles a callback in the built-in namespace. Built-ins don't
+// need a session and are never queued.
+func (m *SessionManager) routeBuiltin(ctx context.Context, vmName string, method string, params json.RawMessage) (json.RawMessage, error) {
+	m.lock.RLock()
+	handler := m.builtins[method]
+	m.lock.RUnlock()
+	if handler == nil {
+		return nil, fmt.Errorf("unknown built-in callback method: %s", method)
+	}
+	return handler(ctx, vmName, params)
+}
@@ -0,0 +1,111 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// newCountingReceiver returns an HTTP callback receiver answering every
+// callback with result and the number of callbacks it received.
+func newCountingReceiver(t *testing.T, result string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		var req CallbackRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(CallbackResponse{ID: req.ID, Result: json.RawMessage(result)})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestBuiltinTakesPrecedenceOverSession(t *testing.T) {
+	receiver, hits := newCountingReceiver(t, `"receiver"`)
+	m := NewSessionManager()
+	defer m.Close()
+	if _, err := m.RegisterHTTPCallback("vm1", receiver.URL, "", nil); err != nil {
+		t.Fatalf("RegisterHTTPCallback: %v", err)
+	}
+	var gotVM string
+	err := m.RegisterBuiltin("cbox.echo", func(ctx context.Context, vmName string, params json.RawMessage) (json.RawMessage, error) {
+		gotVM = vmName
+		return params, nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterBuiltin: %v", err)
+	}
+
+	result, err := m.RouteCallback(context.Background(), "vm1", "cbox.echo", json.RawMessage(`{"a":1}`))
+	if err != nil {
+		t.Fatalf("RouteCallback(cbox.echo): %v", err)
+	}
+	if string(result) != `{"a":1}` {
+		t.Errorf("result = %s, want the built-in's", result)
+	}
+	if gotVM != "vm1" {
+		t.Errorf("built-in got vmName %q, want vm1", gotVM)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("receiver got %d callbacks for a built-in, want 0", hits.Load())
+	}
+
+	result, err = m.RouteCallback(context.Background(), "vm1", "tools/call", nil)
+	if err != nil {
+		t.Fatalf("RouteCallback(tools/call): %v", err)
+	}
+	if string(result) != `"receiver"` || hits.Load() != 1 {
+		t.Errorf("other methods must reach the receiver, got %s after %d callbacks", result, hits.Load())
+	}
+}
+
+func TestBuiltinWithoutSession(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+	err := m.RegisterBuiltin("cbox.ping", func(context.Context, string, json.RawMessage) (json.RawMessage, error) {
+		return json.RawMessage(`"pong"`), nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterBuiltin: %v", err)
+	}
+	result, err := m.RouteCallback(context.Background(), "vm1", "cbox.ping", nil)
+	if err != nil || string(result) != `"pong"` {
+		t.Errorf("RouteCallback = %s, %v; want pong without a session", result, err)
+	}
+}
+
+func TestUnknownBuiltinIsNotForwarded(t *testing.T) {
+	receiver, hits := newCountingReceiver(t, `"receiver"`)
+	m := NewSessionManager()
+	defer m.Close()
+	if _, err := m.RegisterHTTPCallback("vm1", receiver.URL, "", nil); err != nil {
+		t.Fatalf("RegisterHTTPCallback: %v", err)
+	}
+	if _, err := m.RouteCallback(context.Background(), "vm1", "cbox.missing", nil); err == nil {
+		t.Error("RouteCallback of an unknown built-in succeeded, want an error")
+	}
+	if hits.Load() != 0 {
+		t.Errorf("receiver got %d callbacks for the reserved namespace, want 0", hits.Load())
+	}
+}
+
+func TestRegisterBuiltinErrors(t *testing.T) {
+	noop := func(context.Context, string, json.RawMessage) (json.RawMessage, error) { return nil, nil }
+	m := NewSessionManager()
+	defer m.Close()
+	if err := m.RegisterBuiltin("cbox.once", noop); err != nil {
+		t.Fatalf("RegisterBuiltin: %v", err)
+	}
+	for _, method := range []string{"cbox.once", "cbox.", "tools/call", ""} {
+		if err := m.RegisterBuiltin(method, noop); err == nil {
+			t.Errorf("RegisterBuiltin(%q) succeeded, want an error", method)
+		}
+	}
+}
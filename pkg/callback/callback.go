@@ -4,13 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/faults"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
 )
 
 const (
@@ -19,8 +24,21 @@ const (
 
 	// HTTP client timeout for HTTP callbacks
 	httpCallbackTimeout = 30 * time.Second
+
+	// Transport names accepted at registration time
+	TransportHTTP = "http"
+	TransportNATS = "nats"
+
+	// DefaultNATSSubjectTemplate is used when a NATS registration has no subject
+	DefaultNATSSubjectTemplate = "cbox.callbacks.{vmName}"
+
+	vmNamePlaceholder = "{vmName}"
 )
 
+// ErrResponseTooLarge is returned for HTTP callback responses larger than
+// the manager's max response size. The response is discarded.
+var ErrResponseTooLarge = errors.New("callback response too large")
+
 // CallbackRequest represents a callback request from the guest VM to the client.
 type CallbackRequest struct {
 	ID        string          `json:"id"`
@@ -43,59 +61,247 @@ type CallbackError struct {
 	Message string `json:"message"`
 }
 
-// Session represents an HTTP callback session for a VM.
+// Transport delivers a callback request to its destination and returns the
+// result that should be handed back to the guest.
+type Transport interface {
+	Send(ctx context.Context, req *CallbackRequest) (json.RawMessage, error)
+	Close()
+}
+
+// urlReporter is implemented by transports that deliver to one of several
+// URLs.
+type urlReporter interface {
+	deliveredURL() string
+}
+
+// Session represents a callback session for a VM.
 type Session struct {
 	ID          string
 	VMName      string
 	CallbackURL string
-	httpClient  *http.Client
+	// Transport is TransportHTTP or TransportNATS.
+	Transport string
+	// Signed is set if callbacks are signed with a secret.
+	Signed bool
+	// AllowedMethods are the patterns, as in MatchMethod, of the methods
+	// the guest may call. Empty allows every method.
+	AllowedMethods []string
+	transport      Transport
+}
+
+// Stats counts the callbacks routed for a VM on the host side. Comparing them
+// with the guest agent's counters shows whether failures happen between the
+// guest and the host or between the host and the callback receiver.
+type Stats struct {
+	Sent        uint64
+	Succeeded   uint64
+	Failed      uint64
+	LastError   string
+	LastErrorAt time.Time
+	// LastDeliveredURL is the URL that accepted the last successful callback.
+	LastDeliveredURL string
+	// Rejected counts callbacks refused by the session's allowed methods.
+	// They aren't counted as sent.
+	Rejected uint64
 }
 
 // SessionManager manages all active callback sessions.
 type SessionManager struct {
 	lock     sync.RWMutex
 	sessions map[string]*Session // keyed by vmName
+	natsPool *natsPool
+
+	// queues are only used if queueConfig enables them.
+	queueConfig QueueConfig
+	queues      map[string]*callbackQueue // keyed by vmName, guarded by lock
+
+	builtins map[string]BuiltinHandler // keyed by method, guarded by lock
+
+	statsLock sync.Mutex
+	stats     map[string]*Stats // keyed by vmName
+
+	faults *faults.Injector
+	audit  auditLog
+
+	// maxResponseBytes bounds HTTP callback responses. Zero means no limit.
+	maxResponseBytes int64
 }
 
 // NewSessionManager creates a new SessionManager.
 func NewSessionManager() *SessionManager {
 	return &SessionManager{
 		sessions: make(map[string]*Session),
+		natsPool: newNATSPool(),
+		queues:   make(map[string]*callbackQueue),
+		builtins: make(map[string]BuiltinHandler),
+		stats:    make(map[string]*Stats),
 	}
 }
 
-// RegisterHTTPCallback registers an HTTP callback URL for a VM.
-// This is called when a VM is started with a callbackUrl parameter.
-func (m *SessionManager) RegisterHTTPCallback(vmName string, callbackURL string) (*Session, error) {
+// SetMaxResponseSize bounds the body of HTTP callback responses; larger
+// responses fail the callback. Zero means no limit. It must be called before
+// sessions are registered.
+func (m *SessionManager) SetMaxResponseSize(bytes int64) {
+	m.maxResponseBytes = bytes
+}
+
+// SetFaultInjector sets the injector consulted before routing callbacks.
+func (m *SessionManager) SetFaultInjector(injector *faults.Injector) {
+	m.faults = injector
+}
+
+// recordCallback updates the callback counters for a VM. deliveredURL is the
+// URL that accepted the callback if it succeeded.
+func (m *SessionManager) recordCallback(vmName string, deliveredURL string, err error) {
+	m.statsLock.Lock()
+	defer m.statsLock.Unlock()
+
+	stats, ok := m.stats[vmName]
+	if !ok {
+		stats = &Stats{}
+		m.stats[vmName] = stats
+	}
+	stats.Sent++
+	if err != nil {
+		stats.Failed++
+		stats.LastError = err.Error()
+		stats.LastErrorAt = time.Now().UTC()
+		return
+	}
+	stats.Succeeded++
+	stats.LastDeliveredURL = deliveredURL
+}
+
+// GetStats returns a snapshot of the callback counters for a VM.
+func (m *SessionManager) GetStats(vmName string) Stats {
+	m.statsLock.Lock()
+	defer m.statsLock.Unlock()
+
+	if stats, ok := m.stats[vmName]; ok {
+		return *stats
+	}
+	return Stats{}
+}
+
+// registerSession stores a session for a VM, closing any session it replaces.
+func (m *SessionManager) registerSession(session *Session) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	// Check if session already exists for this VM
-	if existing, ok := m.sessions[vmName]; ok {
+	if existing, ok := m.sessions[session.VMName]; ok {
 		// Close the existing session
 		existing.Close()
 	}
+	m.sessions[session.VMName] = session
+}
 
+// RegisterHTTPCallback registers an HTTP callback URL for a VM.
+// This is called when a VM is started with a callbackUrl parameter.
+// Callbacks are signed with secret if it is set; see VerifySignature.
+// Callbacks for methods not in allowedMethods are refused, unless it's
+// empty.
+func (m *SessionManager) RegisterHTTPCallback(vmName string, callbackURL string, secret string, allowedMethods []string) (*Session, error) {
+	if err := ValidateMethodPatterns(allowedMethods); err != nil {
+		return nil, err
+	}
 	session := &Session{
-		ID:          fmt.Sprintf("%s-http-%d", vmName, time.Now().UnixNano()),
-		VMName:      vmName,
-		CallbackURL: callbackURL,
-		httpClient: &http.Client{
-			Timeout: httpCallbackTimeout,
-		},
+		ID:             fmt.Sprintf("%s-http-%d", vmName, time.Now().UnixNano()),
+		VMName:         vmName,
+		CallbackURL:    callbackURL,
+		Transport:      TransportHTTP,
+		Signed:         secret != "",
+		AllowedMethods: allowedMethods,
+		transport:      newHTTPTransport(callbackURL, secret, m.maxResponseBytes),
 	}
-
-	m.sessions[vmName] = session
+	m.registerSession(session)
 
 	log.WithFields(log.Fields{
 		"sessionId":   session.ID,
 		"vmName":      vmName,
 		"callbackURL": callbackURL,
+		"signed":      secret != "",
 	}).Info("HTTP callback session registered")
 
 	return session, nil
 }
 
+// RegisterHTTPFailoverCallback registers an ordered list of HTTP callback URLs
+// for a VM. Each callback is delivered to exactly one of them: the one that
+// last accepted a callback is tried first and the others are tried in order
+// if it can't be reached, with the first URL re-probed periodically.
+// Callbacks are signed with secret if it is set, and restricted to
+// allowedMethods as in RegisterHTTPCallback.
+func (m *SessionManager) RegisterHTTPFailoverCallback(vmName string, callbackURLs []string, secret string, allowedMethods []string) (*Session, error) {
+	if len(callbackURLs) == 0 {
+		return nil, fmt.Errorf("no callback URLs")
+	}
+	if len(callbackURLs) == 1 {
+		return m.RegisterHTTPCallback(vmName, callbackURLs[0], secret, allowedMethods)
+	}
+	if err := ValidateMethodPatterns(allowedMethods); err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		ID:             fmt.Sprintf("%s-http-%d", vmName, time.Now().UnixNano()),
+		VMName:         vmName,
+		CallbackURL:    callbackURLs[0],
+		Transport:      TransportHTTP,
+		Signed:         secret != "",
+		AllowedMethods: allowedMethods,
+		transport:      newFailoverTransport(callbackURLs, secret, m.maxResponseBytes),
+	}
+	m.registerSession(session)
+
+	log.WithFields(log.Fields{
+		"sessionId":    session.ID,
+		"vmName":       vmName,
+		"callbackURLs": callbackURLs,
+		"signed":       secret != "",
+	}).Info("HTTP failover callback session registered")
+
+	return session, nil
+}
+
+// RegisterNATSCallback registers a NATS publisher for a VM. Callbacks are
+// published to subjectTemplate with "{vmName}" replaced by the VM's name.
+// Connections are shared between sessions publishing to the same server.
+// Callbacks are restricted to allowedMethods as in RegisterHTTPCallback.
+func (m *SessionManager) RegisterNATSCallback(vmName string, natsURL string, subjectTemplate string, allowedMethods []string) (*Session, error) {
+	if err := ValidateMethodPatterns(allowedMethods); err != nil {
+		return nil, err
+	}
+	if subjectTemplate == "" {
+		subjectTemplate = DefaultNATSSubjectTemplate
+	}
+	subject := strings.ReplaceAll(subjectTemplate, vmNamePlaceholder, vmName)
+
+	transport, err := newNATSTransport(m.natsPool, natsURL, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NATS transport: %w", err)
+	}
+
+	session := &Session{
+		ID:             fmt.Sprintf("%s-nats-%d", vmName, time.Now().UnixNano()),
+		VMName:         vmName,
+		CallbackURL:    natsURL,
+		Transport:      TransportNATS,
+		AllowedMethods: allowedMethods,
+		transport:      transport,
+	}
+	m.registerSession(session)
+
+	log.WithFields(log.Fields{
+		"sessionId": session.ID,
+		"vmName":    vmName,
+		"natsURL":   natsURL,
+		"subject":   subject,
+	}).Info("NATS callback session registered")
+
+	return session, nil
+}
+
 // GetSession returns the session for the given VM name.
 func (m *SessionManager) GetSession(vmName string) *Session {
 	m.lock.RLock()
@@ -116,8 +322,13 @@ func (m *SessionManager) RemoveSession(vmName string) {
 	m.lock.Lock()
 	session := m.sessions[vmName]
 	delete(m.sessions, vmName)
+	m.removeQueue(vmName)
 	m.lock.Unlock()
 
+	m.statsLock.Lock()
+	delete(m.stats, vmName)
+	m.statsLock.Unlock()
+
 	if session != nil {
 		session.Close()
 		log.WithFields(log.Fields{
@@ -127,9 +338,41 @@ func (m *SessionManager) RemoveSession(vmName string) {
 	}
 }
 
-// RouteCallback routes a callback from a VM to the registered HTTP callback URL.
-func (m *SessionManager) RouteCallback(ctx context.Context, vmName string, method string, params json.RawMessage) (json.RawMessage, error) {
-	session := m.GetSession(vmName)
+// RouteCallback routes a callback from a VM through its session's transport.
+// With queueing enabled, the callback is queued instead and the guest is
+// told it was accepted. Methods in the built-in namespace are handled by
+// their registered handler instead, and aren't subject to the session's
+// allowed methods.
+func (m *SessionManager) RouteCallback(ctx context.Context, vmName string, method string, params json.RawMessage) (result json.RawMessage, err error) {
+	if IsBuiltin(method) {
+		return m.routeBuiltin(ctx, vmName, method, params)
+	}
+	if session := m.GetSession(vmName); session != nil && !session.allows(method) {
+		return nil, m.rejectCallback(ctx, session, method, params)
+	}
+	if m.queueConfig.Size > 0 {
+		return m.enqueueCallback(ctx, vmName, method, params)
+	}
+
+	req := newCallbackRequest(vmName, method, params)
+	ctx = withStatusCode(ctx)
+	start := time.Now()
+	var session *Session
+	var deliveredURL string
+	defer func() {
+		m.recordCallback(vmName, deliveredURL, err)
+		auditURL := deliveredURL
+		if auditURL == "" && session != nil {
+			auditURL = session.CallbackURL
+		}
+		m.auditCallback(ctx, req, auditURL, start, err, false)
+	}()
+
+	if err := m.faults.Apply(ctx, faults.PointCallback, vmName); err != nil {
+		return nil, err
+	}
+
+	session = m.GetSession(vmName)
 	if session == nil {
 		return nil, fmt.Errorf("no active callback session for VM: %s", vmName)
 	}
@@ -141,13 +384,51 @@ func (m *SessionManager) RouteCallback(ctx context.Context, vmName string, metho
 		defer cancel()
 	}
 
-	return session.sendCallback(ctx, vmName, method, params)
+	result, err = session.sendCallback(ctx, req)
+	if err == nil {
+		deliveredURL = session.deliveredURL()
+	}
+	return result, err
+}
+
+// Notify sends a callback raised by the host, not the guest, about vmName
+// through its session's transport. As the guest didn't send it, it skips the
+// session's allowed methods, the queue, fault injection, the VM's callback
+// stats and the audit trail.
+func (m *SessionManager) Notify(ctx context.Context, vmName string, method string, params json.RawMessage) error {
+	session := m.GetSession(vmName)
+	if session == nil {
+		return fmt.Errorf("no active callback session for VM: %s", vmName)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultCallbackTimeout)
+		defer cancel()
+	}
+	_, err := session.sendCallback(ctx, newCallbackRequest(vmName, method, params))
+	return err
+}
+
+// Close removes all sessions and closes any pooled transport connections.
+func (m *SessionManager) Close() {
+	m.lock.Lock()
+	sessions := m.sessions
+	m.sessions = make(map[string]*Session)
+	for vmName := range m.queues {
+		m.removeQueue(vmName)
+	}
+	m.lock.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+	m.natsPool.close()
 }
 
 // Close closes the session and releases resources.
 func (s *Session) Close() {
-	if s.httpClient != nil {
-		s.httpClient.CloseIdleConnections()
+	if s.transport != nil {
+		s.transport.Close()
 	}
 
 	log.WithFields(log.Fields{
@@ -156,17 +437,72 @@ func (s *Session) Close() {
 	}).Debug("Session closed")
 }
 
-// sendCallback sends a callback via HTTP POST to the callback URL.
-func (s *Session) sendCallback(ctx context.Context, vmName string, method string, params json.RawMessage) (json.RawMessage, error) {
-	// Create the callback request
-	req := &CallbackRequest{
+// deliveredURL returns the URL that accepted the session's last callback.
+func (s *Session) deliveredURL() string {
+	if reporter, ok := s.transport.(urlReporter); ok {
+		return reporter.deliveredURL()
+	}
+	return s.CallbackURL
+}
+
+// newCallbackRequest builds the request for a callback from a VM.
+func newCallbackRequest(vmName string, method string, params json.RawMessage) *CallbackRequest {
+	return &CallbackRequest{
 		ID:        fmt.Sprintf("%s-%d", vmName, time.Now().UnixNano()),
 		VMName:    vmName,
 		Method:    method,
 		Params:    params,
 		Timestamp: time.Now().Unix(),
 	}
+}
+
+// sendCallback delivers a callback request via the session's transport.
+func (s *Session) sendCallback(ctx context.Context, req *CallbackRequest) (json.RawMessage, error) {
+	vmName, method := req.VMName, req.Method
+	log.WithFields(log.Fields{
+		"sessionId":   s.ID,
+		"vmName":      vmName,
+		"method":      method,
+		"callbackURL": s.CallbackURL,
+	}).Debug("Sending callback")
+
+	result, err := s.transport.Send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"sessionId": s.ID,
+		"vmName":    vmName,
+		"method":    method,
+	}).Debug("Callback completed successfully")
+
+	return result, nil
+}
+
+// httpTransport delivers callbacks via HTTP POST to a callback URL.
+type httpTransport struct {
+	callbackURL string
+	// secret signs each request if set. It must never be logged.
+	secret string
+	// maxResponseBytes bounds the response body. Zero means no limit.
+	maxResponseBytes int64
+	httpClient       *http.Client
+}
+
+func newHTTPTransport(callbackURL string, secret string, maxResponseBytes int64) *httpTransport {
+	return &httpTransport{
+		callbackURL:      callbackURL,
+		secret:           secret,
+		maxResponseBytes: maxResponseBytes,
+		httpClient: &http.Client{
+			Timeout: httpCallbackTimeout,
+		},
+	}
+}
 
+// Send implements Transport.
+func (t *httpTransport) Send(ctx context.Context, req *CallbackRequest) (json.RawMessage, error) {
 	// Serialize the request
 	reqBody, err := json.Marshal(req)
 	if err != nil {
@@ -174,33 +510,42 @@ func (s *Session) sendCallback(ctx context.Context, vmName string, method string
 	}
 
 	// Create HTTP request
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", s.CallbackURL, bytes.NewReader(reqBody))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", t.callbackURL, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
-
-	log.WithFields(log.Fields{
-		"sessionId":   s.ID,
-		"vmName":      vmName,
-		"method":      method,
-		"callbackURL": s.CallbackURL,
-	}).Debug("Sending HTTP callback")
+	requestid.SetHeader(httpReq)
+	if t.secret != "" {
+		signRequest(httpReq, t.secret, reqBody)
+	}
 
 	// Send the request
-	resp, err := s.httpClient.Do(httpReq)
+	resp, err := t.httpClient.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("HTTP callback request failed: %w", err)
+		return nil, &deliveryError{fmt.Errorf("HTTP callback request failed: %w", err)}
 	}
 	defer resp.Body.Close()
+	setStatusCode(ctx, resp.StatusCode)
 
-	// Read the response body
-	respBody, err := io.ReadAll(resp.Body)
+	// Read the response body, one byte past the limit to detect overflow.
+	body := io.Reader(resp.Body)
+	if t.maxResponseBytes > 0 {
+		body = io.LimitReader(resp.Body, t.maxResponseBytes+1)
+	}
+	respBody, err := io.ReadAll(body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read callback response: %w", err)
 	}
+	if t.maxResponseBytes > 0 && int64(len(respBody)) > t.maxResponseBytes {
+		return nil, fmt.Errorf("%w: status %d, more than %d bytes", ErrResponseTooLarge, resp.StatusCode, t.maxResponseBytes)
+	}
 
-	// Check for HTTP errors
+	// Check for HTTP errors. A 5xx means the receiver couldn't handle the
+	// callback at all, so another URL may still succeed.
+	if resp.StatusCode >= 500 {
+		return nil, &deliveryError{fmt.Errorf("HTTP callback returned status %d: %s", resp.StatusCode, string(respBody))}
+	}
 	if resp.StatusCode >= 400 {
 		return nil, fmt.Errorf("HTTP callback returned status %d: %s", resp.StatusCode, string(respBody))
 	}
@@ -210,9 +555,8 @@ func (s *Session) sendCallback(ctx context.Context, vmName string, method string
 	if err := json.Unmarshal(respBody, &callbackResp); err != nil {
 		// If we can't parse as CallbackResponse, return the raw body as result
 		log.WithFields(log.Fields{
-			"sessionId": s.ID,
-			"vmName":    vmName,
-			"method":    method,
+			"vmName": req.VMName,
+			"method": req.Method,
 		}).Debug("Response is not in CallbackResponse format, returning raw body")
 		return respBody, nil
 	}
@@ -222,11 +566,10 @@ func (s *Session) sendCallback(ctx context.Context, vmName string, method string
 		return nil, fmt.Errorf("callback error [%d]: %s", callbackResp.Error.Code, callbackResp.Error.Message)
 	}
 
-	log.WithFields(log.Fields{
-		"sessionId": s.ID,
-		"vmName":    vmName,
-		"method":    method,
-	}).Debug("HTTP callback completed successfully")
-
 	return callbackResp.Result, nil
 }
+
+// Close implements Transport.
+func (t *httpTransport) Close() {
+	t.httpClient.CloseIdleConnections()
+}
@@ -0,0 +1,76 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifySkipsGuestPolicy(t *testing.T) {
+	receiver, hits := newCountingReceiver(t, `"ok"`)
+	m := NewSessionManager()
+	defer m.Close()
+	m.SetAuditConfig(AuditConfig{Capacity: 10})
+	m.SetQueueConfig(QueueConfig{Size: 10, MaxAge: time.Minute})
+	if _, err := m.RegisterHTTPCallback("vm1", receiver.URL, "", []string{"tools/*"}); err != nil {
+		t.Fatalf("RegisterHTTPCallback: %v", err)
+	}
+
+	// The method isn't one the guest may call, and is delivered right away
+	// rather than queued.
+	if err := m.Notify(context.Background(), "vm1", "vm.crash_bundle_ready", json.RawMessage(`{}`)); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("receiver got %d callbacks, want 1", hits.Load())
+	}
+	if stats := m.GetStats("vm1"); stats != (Stats{}) {
+		t.Errorf("stats = %+v, want the guest's callbacks only", stats)
+	}
+	if entries := m.AuditLog(AuditQuery{VMName: "vm1"}); len(entries) != 0 {
+		t.Errorf("audit log = %+v, want the guest's callbacks only", entries)
+	}
+
+	if err := m.Notify(context.Background(), "vm2", "vm.crash_bundle_ready", nil); err == nil {
+		t.Error("Notify without a session succeeded")
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	body := []byte(`{"id":"1","result":"` + strings.Repeat("x", 4000) + `"}`)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer receiver.Close()
+
+	for _, tc := range []struct {
+		name  string
+		limit int64
+		ok    bool
+	}{
+		{"at the limit", int64(len(body)), true},
+		{"one byte over", int64(len(body)) - 1, false},
+		{"no limit", 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewSessionManager()
+			defer m.Close()
+			m.SetMaxResponseSize(tc.limit)
+			if _, err := m.RegisterHTTPCallback("vm1", receiver.URL, "", nil); err != nil {
+				t.Fatalf("RegisterHTTPCallback: %v", err)
+			}
+			result, err := m.RouteCallback(context.Background(), "vm1", "tools/run", nil)
+			if tc.ok && (err != nil || len(result) != 4002) {
+				t.Errorf("RouteCallback = %d bytes, %v, want the whole result", len(result), err)
+			}
+			if !tc.ok && !errors.Is(err, ErrResponseTooLarge) {
+				t.Errorf("RouteCallback = %v, want ErrResponseTooLarge", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// primaryReprobeInterval is how long a failover transport sticks with a
+// secondary URL before trying the primary again.
+const primaryReprobeInterval = time.Minute
+
+// deliveryError is returned by a transport when a callback didn't reach a
+// receiver able to handle it, so delivering it elsewhere can't duplicate it.
+type deliveryError struct {
+	err error
+}
+
+func (e *deliveryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *deliveryError) Unwrap() error {
+	return e.err
+}
+
+// failoverTransport delivers each callback to exactly one of an ordered list
+// of HTTP URLs. It tries the URL that last succeeded first, falling back to
+// the others in order, and returns to the primary after
+// primaryReprobeInterval.
+type failoverTransport struct {
+	urls       []string
+	transports []*httpTransport
+
+	lock sync.Mutex
+	// current is the index of the URL that last accepted a callback.
+	current int
+	// primaryFailedAt is when the primary last failed a delivery.
+	primaryFailedAt time.Time
+	// lastDelivered is the URL that accepted the last callback, if any.
+	lastDelivered string
+}
+
+func newFailoverTransport(urls []string, secret string, maxResponseBytes int64) *failoverTransport {
+	t := &failoverTransport{
+		urls: urls,
+	}
+	for _, url := range urls {
+		t.transports = append(t.transports, newHTTPTransport(url, secret, maxResponseBytes))
+	}
+	return t
+}
+
+// order returns the indices of the URLs in the order they should be tried.
+func (t *failoverTransport) order() []int {
+	t.lock.Lock()
+	first := t.current
+	if first != 0 && time.Since(t.primaryFailedAt) >= primaryReprobeInterval {
+		first = 0
+	}
+	t.lock.Unlock()
+
+	order := []int{first}
+	for i := range t.urls {
+		if i != first {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// Send implements Transport.
+func (t *failoverTransport) Send(ctx context.Context, req *CallbackRequest) (json.RawMessage, error) {
+	order := t.order()
+	var errs []error
+	for _, i := range order {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+
+		result, err := t.transports[i].Send(ctx, req)
+		var delivery *deliveryError
+		if err != nil && errors.As(err, &delivery) {
+			log.WithFields(log.Fields{
+				"vmName":      req.VMName,
+				"method":      req.Method,
+				"callbackURL": t.urls[i],
+			}).WithError(err).Warn("Callback delivery failed, trying next URL")
+			errs = append(errs, fmt.Errorf("%s: %w", t.urls[i], err))
+			continue
+		}
+
+		// The receiver handled the callback, even if it answered with an
+		// error, so don't deliver it anywhere else.
+		t.lock.Lock()
+		if t.current != i {
+			log.WithFields(log.Fields{
+				"vmName":      req.VMName,
+				"callbackURL": t.urls[i],
+			}).Info("Callback delivery switched URL")
+			t.current = i
+		}
+		// The primary was just tried and failed: wait a full interval
+		// before trying it again.
+		if i != 0 && order[0] == 0 {
+			t.primaryFailedAt = time.Now()
+		}
+		t.lastDelivered = t.urls[i]
+		t.lock.Unlock()
+		return result, err
+	}
+	return nil, fmt.Errorf("callback delivery failed on all %d URLs: %w", len(t.urls), errors.Join(errs...))
+}
+
+// deliveredURL implements urlReporter.
+func (t *failoverTransport) deliveredURL() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.lastDelivered
+}
+
+// Close implements Transport.
+func (t *failoverTransport) Close() {
+	for _, transport := range t.transports {
+		transport.Close()
+	}
+}
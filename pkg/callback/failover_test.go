@@ -0,0 +1,134 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failoverReceiver is a callback receiver that answers with its name, or
+// with status while status is set.
+type failoverReceiver struct {
+	*httptest.Server
+	hits   atomic.Int32
+	status atomic.Int32
+}
+
+func newFailoverReceiver(t *testing.T, name string) *failoverReceiver {
+	t.Helper()
+	receiver := &failoverReceiver{}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receiver.hits.Add(1)
+		if status := receiver.status.Load(); status != 0 {
+			http.Error(w, "unavailable", int(status))
+			return
+		}
+		var req CallbackRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(CallbackResponse{ID: req.ID, Result: json.RawMessage(`"` + name + `"`)})
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+// routeTo routes a callback for vm1 and checks which receiver answered it.
+func routeTo(t *testing.T, m *SessionManager, want string) {
+	t.Helper()
+	result, err := m.RouteCallback(context.Background(), "vm1", "tools/call", nil)
+	if err != nil {
+		t.Fatalf("RouteCallback: %v", err)
+	}
+	if string(result) != `"`+want+`"` {
+		t.Fatalf("RouteCallback = %s, want the %s's result", result, want)
+	}
+}
+
+func TestFailoverPrimaryOutageAndRecovery(t *testing.T) {
+	primary := newFailoverReceiver(t, "primary")
+	secondary := newFailoverReceiver(t, "secondary")
+	m := NewSessionManager()
+	defer m.Close()
+	session, err := m.RegisterHTTPFailoverCallback("vm1", []string{primary.URL, secondary.URL}, "", nil)
+	if err != nil {
+		t.Fatalf("RegisterHTTPFailoverCallback: %v", err)
+	}
+
+	routeTo(t, m, "primary")
+
+	// The primary goes down: the secondary takes over.
+	primary.status.Store(http.StatusServiceUnavailable)
+	routeTo(t, m, "secondary")
+	if got := m.GetStats("vm1").LastDeliveredURL; got != secondary.URL {
+		t.Errorf("LastDeliveredURL = %s, want the secondary's", got)
+	}
+
+	// Once back, the primary isn't tried again until the re-probe interval
+	// has passed.
+	primary.status.Store(0)
+	primaryHits := primary.hits.Load()
+	routeTo(t, m, "secondary")
+	if primary.hits.Load() != primaryHits {
+		t.Error("the primary was tried again before the re-probe interval passed")
+	}
+
+	transport := session.transport.(*failoverTransport)
+	transport.lock.Lock()
+	transport.primaryFailedAt = time.Now().Add(-primaryReprobeInterval)
+	transport.lock.Unlock()
+	routeTo(t, m, "primary")
+	if got := m.GetStats("vm1").LastDeliveredURL; got != primary.URL {
+		t.Errorf("LastDeliveredURL = %s, want the primary's", got)
+	}
+}
+
+func TestFailoverDeliversOnce(t *testing.T) {
+	primary := newFailoverReceiver(t, "primary")
+	secondary := newFailoverReceiver(t, "secondary")
+	m := NewSessionManager()
+	defer m.Close()
+	if _, err := m.RegisterHTTPFailoverCallback("vm1", []string{primary.URL, secondary.URL}, "", nil); err != nil {
+		t.Fatalf("RegisterHTTPFailoverCallback: %v", err)
+	}
+
+	// The primary handled the callback and rejected it: that's the answer.
+	primary.status.Store(http.StatusBadRequest)
+	if _, err := m.RouteCallback(context.Background(), "vm1", "tools/call", nil); err == nil {
+		t.Error("RouteCallback rejected by the primary succeeded")
+	}
+	if secondary.hits.Load() != 0 {
+		t.Errorf("secondary got %d callbacks the primary handled, want 0", secondary.hits.Load())
+	}
+
+	// Both down.
+	primary.status.Store(http.StatusBadGateway)
+	secondary.status.Store(http.StatusBadGateway)
+	if _, err := m.RouteCallback(context.Background(), "vm1", "tools/call", nil); err == nil {
+		t.Error("RouteCallback with every URL down succeeded")
+	}
+	if primary.hits.Load() != 2 || secondary.hits.Load() != 1 {
+		t.Errorf("receivers got %d and %d callbacks, want each URL tried once more", primary.hits.Load(), secondary.hits.Load())
+	}
+}
+
+func TestRegisterHTTPFailoverCallbackErrors(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+	if _, err := m.RegisterHTTPFailoverCallback("vm1", nil, "", nil); err == nil {
+		t.Error("RegisterHTTPFailoverCallback without URLs succeeded")
+	}
+	// A single URL is a plain HTTP callback.
+	session, err := m.RegisterHTTPFailoverCallback("vm1", []string{"http://127.0.0.1:1"}, "", nil)
+	if err != nil {
+		t.Fatalf("RegisterHTTPFailoverCallback: %v", err)
+	}
+	if _, ok := session.transport.(*failoverTransport); ok {
+		t.Error("a single URL got a failover transport")
+	}
+}
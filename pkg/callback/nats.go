@@ -0,0 +1,160 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	natsClientName     = "cbox-restserver"
+	natsConnectTimeout = 5 * time.Second
+	natsReconnectWait  = 2 * time.Second
+)
+
+// pooledNATSConn is a NATS connection shared by every session publishing to
+// the same server.
+type pooledNATSConn struct {
+	conn *nats.Conn
+	refs int
+}
+
+// natsPool owns the NATS connections used by callback sessions, keyed by
+// server URL.
+type natsPool struct {
+	lock  sync.Mutex
+	conns map[string]*pooledNATSConn
+}
+
+func newNATSPool() *natsPool {
+	return &natsPool{
+		conns: make(map[string]*pooledNATSConn),
+	}
+}
+
+// acquire returns a connection to natsURL, dialing it if this is the first
+// user. The initial dial fails fast so bad URLs surface at registration time;
+// once connected, the client reconnects indefinitely.
+func (p *natsPool) acquire(natsURL string) (*nats.Conn, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if pooled, ok := p.conns[natsURL]; ok && !pooled.conn.IsClosed() {
+		pooled.refs++
+		return pooled.conn, nil
+	}
+
+	logger := log.WithField("natsURL", natsURL)
+	conn, err := nats.Connect(
+		natsURL,
+		nats.Name(natsClientName),
+		nats.Timeout(natsConnectTimeout),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(natsReconnectWait),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.WithError(err).Warn("NATS connection lost")
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			logger.Info("NATS connection re-established")
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS server %s: %w", natsURL, err)
+	}
+
+	p.conns[natsURL] = &pooledNATSConn{conn: conn, refs: 1}
+	return conn, nil
+}
+
+// release drops a reference to conn, a connection to natsURL, and closes it
+// once no session uses it. A conn that was closed and replaced in the pool
+// by acquire is only closed, so its users can't release the live one.
+func (p *natsPool) release(natsURL string, conn *nats.Conn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pooled, ok := p.conns[natsURL]
+	if !ok || pooled.conn != conn {
+		conn.Close()
+		return
+	}
+	pooled.refs--
+	if pooled.refs > 0 {
+		return
+	}
+	delete(p.conns, natsURL)
+	pooled.conn.Close()
+}
+
+// close closes every pooled connection regardless of outstanding references.
+func (p *natsPool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for natsURL, pooled := range p.conns {
+		pooled.conn.Close()
+		delete(p.conns, natsURL)
+	}
+}
+
+// natsTransport publishes callbacks to a NATS subject.
+type natsTransport struct {
+	pool    *natsPool
+	natsURL string
+	subject string
+	conn    *nats.Conn
+	once    sync.Once
+}
+
+func newNATSTransport(pool *natsPool, natsURL string, subject string) (*natsTransport, error) {
+	if natsURL == "" {
+		return nil, fmt.Errorf("NATS server URL is required")
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("NATS subject is required")
+	}
+
+	conn, err := pool.acquire(natsURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsTransport{
+		pool:    pool,
+		natsURL: natsURL,
+		subject: subject,
+		conn:    conn,
+	}, nil
+}
+
+// Send implements Transport. The publish is acknowledged by flushing the
+// connection, which round-trips to the server. Bus transports have no reply,
+// so the guest receives an empty result.
+func (t *natsTransport) Send(ctx context.Context, req *CallbackRequest) (json.RawMessage, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal callback request: %w", err)
+	}
+
+	if err := t.conn.Publish(t.subject, payload); err != nil {
+		return nil, &deliveryError{fmt.Errorf("NATS publish to %s failed: %w", t.subject, err)}
+	}
+
+	if err := t.conn.FlushWithContext(ctx); err != nil {
+		return nil, &deliveryError{fmt.Errorf("NATS publish to %s not acknowledged: %w", t.subject, err)}
+	}
+
+	return nil, nil
+}
+
+// Close implements Transport.
+func (t *natsTransport) Close() {
+	t.once.Do(func() {
+		t.pool.release(t.natsURL, t.conn)
+	})
+}
@@ -0,0 +1,277 @@
+package callback
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATSMsg is a message published to a fakeNATSServer.
+type fakeNATSMsg struct {
+	subject string
+	payload []byte
+}
+
+// fakeNATSServer speaks enough of the NATS client protocol for publishers:
+// it answers CONNECT and PING and records PUBs. nats-server can't be vendored
+// here, and publishing is all the callback transport does.
+type fakeNATSServer struct {
+	listener net.Listener
+	msgs     chan fakeNATSMsg
+
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func newFakeNATSServer(t *testing.T) *fakeNATSServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeNATSServer{listener: listener, msgs: make(chan fakeNATSMsg, 16)}
+	go s.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		s.dropClients()
+	})
+	return s
+}
+
+func (s *fakeNATSServer) url() string {
+	return "nats://" + s.listener.Addr().String()
+}
+
+func (s *fakeNATSServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns = append(s.conns, conn)
+		s.lock.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeNATSServer) handle(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.10.0\",\"proto\":1,\"max_payload\":1048576,\"headers\":true}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "PUB":
+			// PUB <subject> [reply-to] <size>
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			s.msgs <- fakeNATSMsg{subject: fields[1], payload: payload[:size]}
+		}
+	}
+}
+
+// dropClients closes every client connection, as a server restart would.
+func (s *fakeNATSServer) dropClients() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeNATSServer) next(t *testing.T) fakeNATSMsg {
+	t.Helper()
+	select {
+	case msg := <-s.msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message published")
+		return fakeNATSMsg{}
+	}
+}
+
+func TestNATSCallbackPublishesToSubject(t *testing.T) {
+	server := newFakeNATSServer(t)
+	m := NewSessionManager()
+	defer m.Close()
+
+	session, err := m.RegisterNATSCallback("vm1", server.url(), "", nil)
+	if err != nil {
+		t.Fatalf("RegisterNATSCallback: %v", err)
+	}
+	if session.Transport != TransportNATS {
+		t.Errorf("Transport = %q, want %q", session.Transport, TransportNATS)
+	}
+
+	result, err := m.RouteCallback(context.Background(), "vm1", "tools/call", json.RawMessage(`{"a":1}`))
+	if err != nil {
+		t.Fatalf("RouteCallback: %v", err)
+	}
+	if result != nil {
+		t.Errorf("result = %s, want none from a bus transport", result)
+	}
+	msg := server.next(t)
+	if msg.subject != "cbox.callbacks.vm1" {
+		t.Errorf("subject = %q, want the default template for vm1", msg.subject)
+	}
+	var req CallbackRequest
+	if err := json.Unmarshal(msg.payload, &req); err != nil {
+		t.Fatalf("payload isn't a CallbackRequest: %v", err)
+	}
+	if req.VMName != "vm1" || req.Method != "tools/call" || string(req.Params) != `{"a":1}` {
+		t.Errorf("published %+v", req)
+	}
+}
+
+func TestNATSCallbackCustomSubject(t *testing.T) {
+	server := newFakeNATSServer(t)
+	m := NewSessionManager()
+	defer m.Close()
+	if _, err := m.RegisterNATSCallback("vm1", server.url(), "agents.{vmName}.calls", nil); err != nil {
+		t.Fatalf("RegisterNATSCallback: %v", err)
+	}
+	if _, err := m.RouteCallback(context.Background(), "vm1", "m", nil); err != nil {
+		t.Fatalf("RouteCallback: %v", err)
+	}
+	if msg := server.next(t); msg.subject != "agents.vm1.calls" {
+		t.Errorf("subject = %q, want agents.vm1.calls", msg.subject)
+	}
+}
+
+func TestNATSCallbackRegistrationErrors(t *testing.T) {
+	// Nothing listens on a just-closed port.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadURL := "nats://" + listener.Addr().String()
+	listener.Close()
+
+	m := NewSessionManager()
+	defer m.Close()
+	if _, err := m.RegisterNATSCallback("vm1", deadURL, "", nil); err == nil {
+		t.Error("RegisterNATSCallback to an unreachable server succeeded")
+	}
+	if _, err := m.RegisterNATSCallback("vm1", "", "", nil); err == nil {
+		t.Error("RegisterNATSCallback without a URL succeeded")
+	}
+	if m.HasSession("vm1") {
+		t.Error("failed registrations left a session")
+	}
+}
+
+func TestNATSPoolSharesConnections(t *testing.T) {
+	server := newFakeNATSServer(t)
+	m := NewSessionManager()
+	defer m.Close()
+	first, err := m.RegisterNATSCallback("vm1", server.url(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.RegisterNATSCallback("vm2", server.url(), "", nil); err != nil {
+		t.Fatal(err)
+	}
+	conn := first.transport.(*natsTransport).conn
+	if second := m.GetSession("vm2").transport.(*natsTransport).conn; second != conn {
+		t.Error("sessions for the same server got different connections")
+	}
+
+	m.RemoveSession("vm1")
+	if conn.IsClosed() {
+		t.Fatal("removing one session closed the shared connection")
+	}
+	if _, err := m.RouteCallback(context.Background(), "vm2", "m", nil); err != nil {
+		t.Fatalf("RouteCallback after the other session left: %v", err)
+	}
+	server.next(t)
+	m.RemoveSession("vm2")
+	if !conn.IsClosed() {
+		t.Error("connection stayed open after its last session left")
+	}
+}
+
+func TestNATSPoolStaleReleaseKeepsLiveConnection(t *testing.T) {
+	server := newFakeNATSServer(t)
+	pool := newNATSPool()
+	defer pool.close()
+
+	stale, err := pool.acquire(server.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+	live, err := pool.acquire(server.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live == stale {
+		t.Fatal("acquire returned the closed connection")
+	}
+
+	// The holder of the replaced connection lets go of it.
+	pool.release(server.url(), stale)
+	if live.IsClosed() {
+		t.Fatal("releasing a replaced connection closed the live one")
+	}
+	pool.release(server.url(), live)
+	if !live.IsClosed() {
+		t.Error("live connection stayed open after its last release")
+	}
+}
+
+func TestNATSCallbackReconnects(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the NATS reconnect interval")
+	}
+	server := newFakeNATSServer(t)
+	m := NewSessionManager()
+	defer m.Close()
+	session, err := m.RegisterNATSCallback("vm1", server.url(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := session.transport.(*natsTransport).conn
+
+	server.dropClients()
+	deadline := time.Now().Add(natsReconnectWait + 5*time.Second)
+	for conn.Stats().Reconnects == 0 || !conn.IsConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("connection didn't reconnect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := m.RouteCallback(context.Background(), "vm1", "after-reconnect", nil); err != nil {
+		t.Fatalf("RouteCallback after reconnecting: %v", err)
+	}
+	var req CallbackRequest
+	json.Unmarshal(server.next(t).payload, &req)
+	if req.Method != "after-reconnect" {
+		t.Errorf("published %q, want after-reconnect", req.Method)
+	}
+}
@@ -0,0 +1,286 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/faults"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
+)
+
+const (
+	// queueRetryMin and queueRetryMax bound the backoff between attempts to
+	// deliver the callback at the head of a queue.
+	queueRetryMin = time.Second
+	queueRetryMax = 30 * time.Second
+	// deadLetterLimit is how many dead letters are kept per VM; the oldest
+	// are evicted first.
+	deadLetterLimit = 100
+)
+
+// QueueConfig enables store-and-forward delivery of callbacks.
+type QueueConfig struct {
+	// Size is how many callbacks can wait per VM. Zero disables queueing,
+	// so callbacks are delivered while the guest waits.
+	Size int
+	// MaxAge is how long a callback is retried for before it's moved to the
+	// VM's dead letters.
+	MaxAge time.Duration
+}
+
+// DeadLetter is a queued callback that was given up on.
+type DeadLetter struct {
+	Request   *CallbackRequest
+	Attempts  int
+	Reason    string
+	DroppedAt time.Time
+}
+
+// QueueStatus is a snapshot of a VM's callback queue.
+type QueueStatus struct {
+	Enabled  bool
+	Depth    int
+	Capacity int
+	// OldestQueuedAt is when the callback at the head of the queue was
+	// queued. It's zero for an empty queue.
+	OldestQueuedAt time.Time
+	// Dropped counts the callbacks that were rejected because the queue
+	// was full or moved to the dead letters.
+	Dropped     uint64
+	DeadLetters []DeadLetter
+}
+
+type queuedCallback struct {
+	req      *CallbackRequest
+	queuedAt time.Time
+	attempts int
+	// requestID is the ID of the request that queued the callback, forwarded
+	// when it's delivered.
+	requestID string
+}
+
+// callbackQueue holds a VM's callbacks until its dispatcher delivers them,
+// in order.
+type callbackQueue struct {
+	lock        sync.Mutex
+	items       []*queuedCallback
+	deadLetters []DeadLetter
+	dropped     uint64
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newCallbackQueue() *callbackQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &callbackQueue{
+		wake:   make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// push appends req to the queue unless it already holds size callbacks.
+func (q *callbackQueue) push(req *CallbackRequest, requestID string, size int) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.items) >= size {
+		q.dropped++
+		return false
+	}
+	q.items = append(q.items, &queuedCallback{req: req, queuedAt: time.Now(), requestID: requestID})
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (q *callbackQueue) head() *queuedCallback {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.items) == 0 {
+		return nil
+	}
+	return q.items[0]
+}
+
+// pop removes the head of the queue, moving it to the dead letters if
+// reason is set.
+func (q *callbackQueue) pop(reason string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	item := q.items[0]
+	q.items = q.items[1:]
+	if reason == "" {
+		return
+	}
+	q.dropped++
+	if len(q.deadLetters) == deadLetterLimit {
+		q.deadLetters = q.deadLetters[1:]
+	}
+	q.deadLetters = append(q.deadLetters, DeadLetter{
+		Request:   item.req,
+		Attempts:  item.attempts,
+		Reason:    reason,
+		DroppedAt: time.Now().UTC(),
+	})
+}
+
+// SetQueueConfig enables or disables store-and-forward delivery. It must be
+// called before callbacks are routed.
+func (m *SessionManager) SetQueueConfig(config QueueConfig) {
+	m.queueConfig = config
+}
+
+// enqueueCallback queues a callback for delivery by the VM's dispatcher and
+// returns the result handed to the guest straight away.
+func (m *SessionManager) enqueueCallback(ctx context.Context, vmName string, method string, params json.RawMessage) (result json.RawMessage, err error) {
+	req := newCallbackRequest(vmName, method, params)
+	defer func() {
+		if err != nil {
+			m.recordCallback(vmName, "", err)
+			m.auditCallback(ctx, req, "", time.Now(), err, true)
+		}
+	}()
+
+	if err := m.faults.Apply(ctx, faults.PointCallback, vmName); err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	if _, ok := m.sessions[vmName]; !ok {
+		m.lock.Unlock()
+		return nil, fmt.Errorf("no active callback session for VM: %s", vmName)
+	}
+	q, ok := m.queues[vmName]
+	if !ok {
+		q = newCallbackQueue()
+		m.queues[vmName] = q
+		go m.dispatch(vmName, q)
+	}
+	m.lock.Unlock()
+
+	if !q.push(req, requestid.FromContext(ctx), m.queueConfig.Size) {
+		return nil, fmt.Errorf("callback queue for VM %s is full", vmName)
+	}
+	return json.Marshal(map[string]any{
+		"queued": true,
+		"id":     req.ID,
+	})
+}
+
+// dispatch delivers the callbacks queued for a VM in order until the queue
+// is closed. Callbacks that can't reach a receiver are retried with backoff
+// until they are older than MaxAge; those the receiver rejects are not.
+func (m *SessionManager) dispatch(vmName string, q *callbackQueue) {
+	logger := log.WithField("vmName", vmName)
+	backoff := queueRetryMin
+	for {
+		item := q.head()
+		if item == nil {
+			select {
+			case <-q.wake:
+				continue
+			case <-q.ctx.Done():
+				return
+			}
+		}
+
+		if time.Since(item.queuedAt) > m.queueConfig.MaxAge {
+			err := fmt.Errorf("not delivered within %s after %d attempts", m.queueConfig.MaxAge, item.attempts)
+			logger.WithField("callbackId", item.req.ID).WithError(err).Warn("Callback moved to dead letters")
+			q.pop(err.Error())
+			m.recordCallback(vmName, "", err)
+			m.auditCallback(q.ctx, item.req, "", time.Now(), err, true)
+			continue
+		}
+
+		var err error
+		var auditURL, deliveredURL string
+		ctx := withStatusCode(q.ctx)
+		if item.requestID != "" {
+			ctx = requestid.NewContext(ctx, item.requestID)
+		}
+		start := time.Now()
+		if session := m.GetSession(vmName); session == nil {
+			// Removed in the meantime, which closes the queue too.
+			err = &deliveryError{fmt.Errorf("no active callback session for VM: %s", vmName)}
+		} else {
+			sendCtx, cancel := context.WithTimeout(ctx, defaultCallbackTimeout)
+			_, err = session.sendCallback(sendCtx, item.req)
+			cancel()
+			auditURL = session.CallbackURL
+			if err == nil {
+				deliveredURL = session.deliveredURL()
+				auditURL = deliveredURL
+			}
+		}
+		if q.ctx.Err() != nil {
+			return
+		}
+
+		var deliveryErr *deliveryError
+		if errors.As(err, &deliveryErr) {
+			item.attempts++
+			logger.WithField("callbackId", item.req.ID).WithError(err).Debugf("Callback delivery failed, retrying in %s", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-q.ctx.Done():
+				return
+			}
+			backoff = min(2*backoff, queueRetryMax)
+			continue
+		}
+		backoff = queueRetryMin
+
+		if err != nil {
+			logger.WithField("callbackId", item.req.ID).WithError(err).Warn("Callback rejected, moved to dead letters")
+			q.pop(err.Error())
+		} else {
+			q.pop("")
+		}
+		m.recordCallback(vmName, deliveredURL, err)
+		m.auditCallback(ctx, item.req, auditURL, start, err, true)
+	}
+}
+
+// QueueStatus returns a snapshot of the callback queue of a VM.
+func (m *SessionManager) QueueStatus(vmName string) QueueStatus {
+	status := QueueStatus{
+		Enabled:  m.queueConfig.Size > 0,
+		Capacity: m.queueConfig.Size,
+	}
+	m.lock.RLock()
+	q := m.queues[vmName]
+	m.lock.RUnlock()
+	if q == nil {
+		return status
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	status.Depth = len(q.items)
+	if len(q.items) > 0 {
+		status.OldestQueuedAt = q.items[0].queuedAt
+	}
+	status.Dropped = q.dropped
+	status.DeadLetters = append([]DeadLetter(nil), q.deadLetters...)
+	return status
+}
+
+// removeQueue discards the callback queue of a VM, if it has one. It must be
+// called with m.lock held.
+func (m *SessionManager) removeQueue(vmName string) {
+	if q, ok := m.queues[vmName]; ok {
+		q.cancel()
+		delete(m.queues, vmName)
+	}
+}
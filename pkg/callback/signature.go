@@ -0,0 +1,64 @@
+package callback
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the HMAC of a signed HTTP callback, as
+	// "sha256=<hex>".
+	SignatureHeader = "X-Cbox-Signature"
+	// TimestampHeader carries the Unix time a signed HTTP callback was sent
+	// at. It's covered by the signature, so a captured callback can't be
+	// replayed with a fresh timestamp.
+	TimestampHeader = "X-Cbox-Timestamp"
+
+	signaturePrefix = "sha256="
+)
+
+// Sign returns the SignatureHeader value for a callback body sent at
+// timestamp: the HMAC-SHA256 of "<timestamp>.<body>" keyed with secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks the signature headers of a callback received with
+// body. Callbacks whose timestamp is more than maxAge away from now are
+// rejected; zero disables the check. Receivers should reject requests for
+// which it returns an error.
+func VerifySignature(secret string, header http.Header, body []byte, maxAge time.Duration) error {
+	signature := header.Get(SignatureHeader)
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return fmt.Errorf("missing or malformed %s header", SignatureHeader)
+	}
+	timestamp, err := strconv.ParseInt(header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or malformed %s header", TimestampHeader)
+	}
+	if maxAge > 0 {
+		if age := time.Since(time.Unix(timestamp, 0)); age > maxAge || age < -maxAge {
+			return fmt.Errorf("callback timestamp is outside the allowed window of %s", maxAge)
+		}
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return fmt.Errorf("callback signature mismatch")
+	}
+	return nil
+}
+
+// signRequest sets the signature headers of an HTTP callback request.
+func signRequest(httpReq *http.Request, secret string, body []byte) {
+	timestamp := time.Now().Unix()
+	httpReq.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	httpReq.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+}
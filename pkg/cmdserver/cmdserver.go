@@ -1,7 +1,202 @@
 package cmdserver
 
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// WorkspacesDir is the directory, under cmdserver's base directory, that
+// holds the exec workspaces.
+const WorkspacesDir = "workspaces"
+
+// workspaceNameRegex restricts workspace names to a single path component.
+var workspaceNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// RunCmdRequest structure for JSON requests to run a command
+type RunCmdRequest struct {
+	Cmd      string `json:"cmd"`
+	Blocking bool   `json:"blocking"`
+	// Workspace runs the command in <baseDir>/workspaces/<Workspace>, creating
+	// it if needed. Empty runs it in baseDir.
+	Workspace string `json:"workspace,omitempty"`
+	// Cwd runs the command in this directory, which must exist. Relative
+	// paths are relative to the workspace, or baseDir.
+	Cwd string `json:"cwd,omitempty"`
+	// Env is added to the command's environment. PATH is only replaced if
+	// it's set here.
+	Env map[string]string `json:"env,omitempty"`
+	// User runs the command as this user, with its HOME and USER. Empty runs
+	// it as cmdserver's default user.
+	User string `json:"user,omitempty"`
+	// OutputEncoding is how a blocking command's output is put in
+	// RunCmdResponse.Output, OutputEncodingText if empty.
+	OutputEncoding string `json:"outputEncoding,omitempty"`
+	// TimeoutMs kills the command and its process group once it has run for
+	// this long. Zero lets it run until it exits.
+	TimeoutMs int64 `json:"timeoutMs,omitempty"`
+	// Stream responds with the command's output as it's written, as
+	// newline-delimited StreamRecords, instead of a RunCmdResponse. The
+	// command is killed if the client disconnects. Blocking is ignored.
+	Stream bool `json:"stream,omitempty"`
+}
+
+const (
+	// OutputEncodingText sends output as a string, with invalid UTF-8
+	// dropped.
+	OutputEncodingText = "text"
+	// OutputEncodingBase64 sends output base64 encoded, byte for byte.
+	OutputEncodingBase64 = "base64"
+)
+
+// OutputEncodings are the values RunCmdRequest.OutputEncoding accepts.
+var OutputEncodings = []string{OutputEncodingText, OutputEncodingBase64}
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// StreamRecord is one line of a streamed command's response. Output records
+// carry a line in Data, newline included; the last record has Done set and
+// the command's outcome.
+type StreamRecord struct {
+	Stream   string `json:"stream,omitempty"`
+	Data     string `json:"data,omitempty"`
+	Done     bool   `json:"done,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+	TimedOut bool   `json:"timedOut,omitempty"`
+}
+
 // RunCmdResponse structure for JSON responses from command execution
 type RunCmdResponse struct {
 	Output string `json:"output,omitempty"`
-	Error  string `json:"error,omitempty"`
+	// OutputTruncated is set if the command wrote more than cmdserver keeps,
+	// and Output holds only the start of it.
+	OutputTruncated bool `json:"outputTruncated,omitempty"`
+	// Encoding is OutputEncodingBase64 if Output is base64 encoded, and
+	// empty for text.
+	Encoding string `json:"encoding,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// ExitCode is the command's exit code, or -1 if it didn't exit normally.
+	// Unset for non-blocking commands.
+	ExitCode *int `json:"exitCode,omitempty"`
+	// TimedOut is set if a blocking command was killed at its timeout. Output
+	// holds what it wrote until then.
+	TimedOut bool `json:"timedOut,omitempty"`
+	// JobID identifies a non-blocking command at /jobs/{id}.
+	JobID string `json:"jobId,omitempty"`
+}
+
+const (
+	JobRunning  = "running"
+	JobFinished = "finished"
+)
+
+// Job is a non-blocking command and, once it's finished, its outcome.
+type Job struct {
+	ID        string `json:"id"`
+	Cmd       string `json:"cmd"`
+	Workspace string `json:"workspace,omitempty"`
+	State     string `json:"state"`
+	// Output is the combined output so far, truncated to the first MB.
+	Output    string     `json:"output"`
+	Truncated bool       `json:"truncated,omitempty"`
+	ExitCode  *int       `json:"exitCode,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	TimedOut  bool       `json:"timedOut,omitempty"`
+	Killed    bool       `json:"killed,omitempty"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+}
+
+// ListJobsResponse structure for JSON responses listing jobs
+type ListJobsResponse struct {
+	Jobs []Job `json:"jobs"`
+}
+
+// PutFileResponse structure for JSON responses to file uploads
+type PutFileResponse struct {
+	// Path is the file's path relative to the files root.
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// RunCmdBatchRequest structure for JSON requests to run commands in order
+type RunCmdBatchRequest struct {
+	Cmds []string `json:"cmds"`
+	// TimeoutMs bounds the whole batch. Commands that don't get to run before
+	// it expires are left out of the response.
+	TimeoutMs   int64  `json:"timeoutMs"`
+	StopOnError bool   `json:"stopOnError"`
+	Workspace   string `json:"workspace,omitempty"`
+	// MaxOutputBytes caps the combined output of all commands. Each command's
+	// output is truncated to an equal share of it.
+	MaxOutputBytes int `json:"maxOutputBytes"`
+}
+
+// RunCmdBatchResult is the outcome of one command in a batch.
+type RunCmdBatchResult struct {
+	Cmd        string `json:"cmd"`
+	Output     string `json:"output,omitempty"`
+	Error      string `json:"error,omitempty"`
+	ExitCode   int    `json:"exitCode"`
+	DurationMs int64  `json:"durationMs"`
+	Truncated  bool   `json:"truncated,omitempty"`
+}
+
+// RunCmdBatchResponse structure for JSON responses from batch execution
+type RunCmdBatchResponse struct {
+	Results  []RunCmdBatchResult `json:"results"`
+	TimedOut bool                `json:"timedOut,omitempty"`
+}
+
+const (
+	// MetadataDiskSerial is the serial of the read-only disk carrying a VM's
+	// metadata, by which the guest finds it.
+	MetadataDiskSerial = "cbox-metadata"
+	// MetadataFilename is the file in the metadata disk's root holding the
+	// metadata as a JSON object.
+	MetadataFilename = "metadata.json"
+	// MetadataUserScriptKey is the metadata key of a script cmdserver runs
+	// on the VM's first boot.
+	MetadataUserScriptKey = "user_script"
+)
+
+const (
+	UserScriptRunning  = "running"
+	UserScriptFinished = "finished"
+)
+
+// UserScriptStatus is the outcome of a VM's user script. A script still
+// marked running after a reboot was interrupted and isn't run again.
+type UserScriptStatus struct {
+	State string `json:"state"`
+	// Output is the combined output, truncated to the first MB.
+	Output    string     `json:"output"`
+	Truncated bool       `json:"truncated,omitempty"`
+	ExitCode  *int       `json:"exitCode,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+}
+
+// Workspace describes a workspace directory in the guest.
+type Workspace struct {
+	Name      string `json:"name"`
+	SizeBytes int64  `json:"sizeBytes"`
+}
+
+// ListWorkspacesResponse structure for JSON responses listing workspaces
+type ListWorkspacesResponse struct {
+	Workspaces []Workspace `json:"workspaces"`
+}
+
+// ValidateWorkspaceName rejects names that could escape the workspaces dir.
+func ValidateWorkspaceName(name string) error {
+	if !workspaceNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid workspace name: %q", name)
+	}
+	return nil
 }
@@ -0,0 +1,59 @@
+package cmdserver
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DefaultPath is the PATH commands run with unless their request sets one.
+const DefaultPath = "/usr/local/bin:/usr/bin:/bin"
+
+// ValidateEnv rejects environment variables that can't be passed to a
+// command.
+func ValidateEnv(env map[string]string) error {
+	for name, value := range env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("invalid environment variable name: %q", name)
+		}
+		if strings.ContainsRune(value, 0) {
+			return fmt.Errorf("environment variable %s must not contain NUL", name)
+		}
+	}
+	return nil
+}
+
+// CommandEnv returns the environment to run a command with: the agent's
+// own, DefaultPath, then env, whose entries win over both.
+func CommandEnv(env map[string]string) []string {
+	cmdEnv := append(os.Environ(), "PATH="+DefaultPath)
+	for _, name := range slices.Sorted(maps.Keys(env)) {
+		cmdEnv = append(cmdEnv, name+"="+env[name])
+	}
+	return cmdEnv
+}
+
+// ResolveCwd returns the directory to run a command in: workingDir, or cwd
+// if set, which is relative to workingDir unless absolute. It must exist.
+func ResolveCwd(workingDir string, cwd string) (string, error) {
+	if cwd == "" {
+		return workingDir, nil
+	}
+	if !filepath.IsAbs(cwd) {
+		cwd = filepath.Join(workingDir, cwd)
+	}
+	info, err := os.Stat(cwd)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("cwd %s does not exist in the guest", cwd)
+		}
+		return "", fmt.Errorf("invalid cwd %s: %w", cwd, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("cwd %s is not a directory", cwd)
+	}
+	return cwd, nil
+}
@@ -0,0 +1,105 @@
+package cmdserver
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateEnv(t *testing.T) {
+	for _, tc := range []struct {
+		env   map[string]string
+		valid bool
+	}{
+		{nil, true},
+		{map[string]string{"A": "1", "PATH": "/opt/bin", "EMPTY": ""}, true},
+		{map[string]string{"A": "x=y"}, true},
+		{map[string]string{"": "1"}, false},
+		{map[string]string{"A=B": "1"}, false},
+		{map[string]string{"A\x00": "1"}, false},
+		{map[string]string{"A": "1\x002"}, false},
+	} {
+		if err := ValidateEnv(tc.env); (err == nil) != tc.valid {
+			t.Errorf("ValidateEnv(%q) = %v, want valid %t", tc.env, err, tc.valid)
+		}
+	}
+}
+
+// runEnv runs a shell script with CommandEnv(env) in dir and returns its
+// output.
+func runEnv(t *testing.T, env map[string]string, dir string, script string) string {
+	t.Helper()
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Env = CommandEnv(env)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%s: %v", script, err)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func TestCommandEnv(t *testing.T) {
+	t.Setenv("CBOX_AGENT_VAR", "agent")
+
+	if got := runEnv(t, nil, "", `echo "$PATH $CBOX_AGENT_VAR"`); got != DefaultPath+" agent" {
+		t.Errorf("without env, command sees %q, want the default PATH and the agent's environment", got)
+	}
+	env := map[string]string{"PATH": "/opt/bin:/bin", "CBOX_AGENT_VAR": "request", "GREETING": "hello world"}
+	if got := runEnv(t, env, "", `echo "$PATH|$CBOX_AGENT_VAR|$GREETING"`); got != "/opt/bin:/bin|request|hello world" {
+		t.Errorf("with env, command sees %q, want the request's variables to win", got)
+	}
+	if got := runEnv(t, map[string]string{"A": "1"}, "", `echo "$PATH"`); got != DefaultPath {
+		t.Errorf("env without PATH gives PATH %q, want %q", got, DefaultPath)
+	}
+}
+
+func TestResolveCwd(t *testing.T) {
+	workingDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(workingDir, "sub", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(workingDir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	absolute := t.TempDir()
+
+	for _, tc := range []struct {
+		cwd     string
+		want    string
+		wantErr string
+	}{
+		{"", workingDir, ""},
+		{"sub/dir", filepath.Join(workingDir, "sub", "dir"), ""},
+		{"sub/../sub", filepath.Join(workingDir, "sub"), ""},
+		{absolute, absolute, ""},
+		{"missing", "", "does not exist in the guest"},
+		{"/nonexistent/dir", "", "does not exist in the guest"},
+		{"file", "", "is not a directory"},
+	} {
+		got, err := ResolveCwd(workingDir, tc.cwd)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("ResolveCwd(%q) = %q, %v, want an error saying %q", tc.cwd, got, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("ResolveCwd(%q) = %q, %v, want %q", tc.cwd, got, err, tc.want)
+		}
+	}
+
+	// The command runs in the resolved directory.
+	dir, err := ResolveCwd(workingDir, "sub/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runEnv(t, nil, dir, "pwd -P"); got != dir {
+		resolved, _ := filepath.EvalSymlinks(dir)
+		if got != resolved {
+			t.Errorf("command ran in %q, want %q", got, dir)
+		}
+	}
+}
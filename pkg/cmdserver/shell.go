@@ -0,0 +1,37 @@
+package cmdserver
+
+import "golang.org/x/net/websocket"
+
+// A /shell session is a WebSocket carrying the terminal's bytes in binary
+// frames both ways. Text frames from the client are ShellControl messages,
+// as JSON.
+
+// ShellResize sets the terminal's size to Cols by Rows.
+const ShellResize = "resize"
+
+// ShellControl is a control message of a /shell session.
+type ShellControl struct {
+	Type string `json:"type"`
+	Cols uint16 `json:"cols,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+}
+
+// ShellFrame is a frame of a /shell session with its payload type,
+// websocket.BinaryFrame or websocket.TextFrame.
+type ShellFrame struct {
+	PayloadType byte
+	Data        []byte
+}
+
+// ShellFrameCodec sends and receives ShellFrames as they are, so they can be
+// relayed without losing their payload type.
+var ShellFrameCodec = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		frame := v.(ShellFrame)
+		return frame.Data, frame.PayloadType, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v any) error {
+		*v.(*ShellFrame) = ShellFrame{PayloadType: payloadType, Data: data}
+		return nil
+	},
+}
@@ -2,6 +2,10 @@ package config
 
 import (
 	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -10,6 +14,29 @@ const (
 	serverConfigKey = "hostservices.restserver"
 )
 
+// APIToken is a bearer token accepted on the main listener and the role it
+// grants: "admin", "operator" or "readonly".
+type APIToken struct {
+	ID    string `mapstructure:"id"`
+	Token string `mapstructure:"token"`
+	Role  string `mapstructure:"role"`
+}
+
+// Profile is a named kernel, initramfs and rootfs combination that start
+// requests select instead of passing the paths. Unset paths and defaults fall
+// back to the server's.
+type Profile struct {
+	Kernel    string `mapstructure:"kernel" yaml:"kernel,omitempty"`
+	Initramfs string `mapstructure:"initramfs" yaml:"initramfs,omitempty"`
+	Rootfs    string `mapstructure:"rootfs" yaml:"rootfs,omitempty"`
+	// DefaultMemPercentage replaces guest_mem_percentage for the profile's
+	// VMs. Zero keeps it.
+	DefaultMemPercentage int32 `mapstructure:"default_mem_percentage" yaml:"default_mem_percentage,omitempty"`
+	// DefaultVcpus is the vCPU count of the profile's VMs. Zero sizes them
+	// from the host's CPUs as usual.
+	DefaultVcpus int32 `mapstructure:"default_vcpus" yaml:"default_vcpus,omitempty"`
+}
+
 type ServerConfig struct {
 	Host               string `mapstructure:"host"`
 	Port               string `mapstructure:"port"`
@@ -18,11 +45,199 @@ type ServerConfig struct {
 	BridgeIP           string `mapstructure:"bridge_ip"`
 	BridgeSubnet       string `mapstructure:"bridge_subnet"`
 	ChvBinPath         string `mapstructure:"chv_bin"`
+	VirtiofsdBinPath   string `mapstructure:"virtiofsd_bin"`
 	KernelPath         string `mapstructure:"kernel"`
 	RootfsPath         string `mapstructure:"rootfs"`
 	InitramfsPath      string `mapstructure:"initramfs"`
 	StatefulSizeInMB   int32  `mapstructure:"stateful_size_in_mb"`
 	GuestMemPercentage int32  `mapstructure:"guest_mem_percentage"`
+	SerialMode         string `mapstructure:"serial_mode"`
+	EnableConsoleExec  bool   `mapstructure:"enable_console_exec"`
+	// IPExclusions are IPs and CIDRs in bridge_subnet never given to VMs, on
+	// top of the bridge IP and the subnet's network and broadcast addresses.
+	IPExclusions []string `mapstructure:"ip_exclusions"`
+	// CIDRange is the inclusive range of vsock CIDs given to VMs, as
+	// "low-high".
+	CIDRange string `mapstructure:"cid_range"`
+	// MaxStatefulSizeInMB bounds the statefulSizeMb of start requests.
+	MaxStatefulSizeInMB int32 `mapstructure:"max_stateful_size_in_mb"`
+	// EnableFaultInjection allows registering fault injection rules through
+	// /v1/admin/faults. Test-only.
+	EnableFaultInjection bool `mapstructure:"enable_fault_injection"`
+	// DisableHTTPCallbackEndpoint stops serving /v1/internal/callback, which
+	// is otherwise served on port 7000 of the bridge IP. Guests then can only
+	// send callbacks over vsock.
+	DisableHTTPCallbackEndpoint bool `mapstructure:"disable_http_callback_endpoint"`
+	// DisableHypervisorLogTail leaves the cloud-hypervisor log tail out of
+	// StartVM error responses, e.g. when tenants shouldn't see host paths.
+	DisableHypervisorLogTail bool `mapstructure:"disable_hypervisor_log_tail"`
+	// ProxyAllowedPorts are the guest ports /v1/vms/{name}/proxy/{port} may
+	// connect to, along with those a VM allows with cbox/proxy-port-<port>
+	// labels. Empty allows only the labeled ones.
+	ProxyAllowedPorts []uint32      `mapstructure:"proxy_allowed_ports"`
+	ProxyIdleTimeout  time.Duration `mapstructure:"proxy_idle_timeout"`
+	MaxProxiesPerVM   int           `mapstructure:"max_proxies_per_vm"`
+	// ShellIdleTimeout closes /v1/vms/{name}/shell sessions nothing was sent
+	// over for this long.
+	ShellIdleTimeout time.Duration `mapstructure:"shell_idle_timeout"`
+	MaxShellsPerVM   int           `mapstructure:"max_shells_per_vm"`
+	// RetainDestroyedArtifacts keeps a destroyed VM's state dir (minus its
+	// stateful disk) in an archive for this long. Zero deletes it immediately.
+	RetainDestroyedArtifacts time.Duration `mapstructure:"retain_destroyed_artifacts"`
+	ArchiveQuotaInMB         int64         `mapstructure:"archive_quota_in_mb"`
+	// DisableAgentAutoRecovery stops the server from restarting a guest's
+	// cmdserver when an exec finds it down. Otherwise it's restarted if the
+	// guest's heartbeats show it's alive.
+	DisableAgentAutoRecovery bool `mapstructure:"disable_agent_auto_recovery"`
+	// AgentRestartCommand is run over vsock to restart cmdserver.
+	AgentRestartCommand string `mapstructure:"agent_restart_command"`
+	// AgentRecoveryWindow bounds how often cmdserver is restarted: after three
+	// restarts within the window the agent is reported unhealthy instead.
+	AgentRecoveryWindow time.Duration `mapstructure:"agent_recovery_window"`
+	// AdminPort enables a separate listener for admin routes, which are then
+	// no longer served on Port. AdminHost defaults to 127.0.0.1.
+	AdminHost string `mapstructure:"admin_host"`
+	AdminPort string `mapstructure:"admin_port"`
+	// AdminTokens are the bearer tokens accepted on the admin listener. Empty
+	// accepts any request.
+	AdminTokens []string `mapstructure:"admin_tokens"`
+	// GRPCPort enables the gRPC VMService on Host, authorized with the same
+	// api_tokens as the main listener. Empty disables it.
+	GRPCPort string `mapstructure:"grpc_port"`
+	// MaxTemplates caps the number of VM templates. Zero means no limit.
+	MaxTemplates int `mapstructure:"max_templates"`
+	// APITokens enables role-based authorization on the main listener. Empty
+	// leaves it unauthenticated.
+	APITokens []APIToken `mapstructure:"api_tokens"`
+	// APITokensFile is a file with more api_tokens, as an "api_tokens" list
+	// in YAML or JSON, so tokens can be kept out of the config file. They're
+	// added to APITokens when the config is loaded.
+	APITokensFile string `mapstructure:"api_tokens_file"`
+	// AuditLogPath is where API calls that change something or exec into a
+	// VM are recorded as JSON lines: a file, rotated once it reaches
+	// AuditLogMaxSizeInMB, or "-" for stdout. Empty only keeps the last
+	// AuditLogCapacity calls in memory, for /v1/audit.
+	AuditLogPath        string `mapstructure:"audit_log_path"`
+	AuditLogMaxSizeInMB int64  `mapstructure:"audit_log_max_size_in_mb"`
+	// AuditLogMaxBackups is how many rotated audit log files are kept.
+	AuditLogMaxBackups int `mapstructure:"audit_log_max_backups"`
+	// AuditLogCapacity is how many audited calls /v1/audit can return.
+	AuditLogCapacity int `mapstructure:"audit_log_capacity"`
+	// StrictCPUPinning rejects VMs whose cpuAffinity overlaps another VM's
+	// instead of only warning.
+	StrictCPUPinning bool `mapstructure:"strict_cpu_pinning"`
+	// ArtifactQuotaInMB caps the artifacts each VM can publish. Zero means no
+	// limit.
+	ArtifactQuotaInMB int64 `mapstructure:"artifact_quota_in_mb"`
+	// MaxArtifactSizeInMB bounds a single artifact. Zero means no limit.
+	MaxArtifactSizeInMB int64 `mapstructure:"max_artifact_size_in_mb"`
+	// WorkspaceQuotaInMB caps what can be uploaded through the files
+	// endpoint into each exec workspace of a VM. Zero means no limit.
+	WorkspaceQuotaInMB int64 `mapstructure:"workspace_quota_in_mb"`
+	// AllocatorWarningPercent is the IP or CID allocator occupancy at which a
+	// host.allocator_pressure event is published. Zero disables it.
+	AllocatorWarningPercent int `mapstructure:"allocator_warning_percent"`
+	// EnableAgentUpdate allows replacing guest agent binaries through
+	// /v1/vms/{name}/agent-update. Dev-only.
+	EnableAgentUpdate bool `mapstructure:"enable_agent_update"`
+	// RecordingMaxCount and RecordingMaxSizeInMB cap each VM's exec
+	// recordings; the oldest are evicted first.
+	RecordingMaxCount    int   `mapstructure:"recording_max_count"`
+	RecordingMaxSizeInMB int64 `mapstructure:"recording_max_size_in_mb"`
+	// RecordingRedactPatterns are regular expressions replaced with
+	// "<redacted>" in the strings of exec recordings.
+	RecordingRedactPatterns []string `mapstructure:"recording_redact_patterns"`
+	// NetworkMode is "bridge" to set up the bridge and firewall on the host,
+	// or "external" to leave host networking alone and only run VMs on tap
+	// devices and IPs managed by someone else.
+	NetworkMode string `mapstructure:"network_mode"`
+	// CrashBundleTimeout and CrashBundleQuotaInMB bound collecting the crash
+	// bundle of a VM whose VMM or guest died, and the space all bundles
+	// take; the oldest are evicted first.
+	CrashBundleTimeout   time.Duration `mapstructure:"crash_bundle_timeout"`
+	CrashBundleQuotaInMB int64         `mapstructure:"crash_bundle_quota_in_mb"`
+	// CrashBundleDiskMaxInMB adds the stateful disk to crash bundles if it
+	// uses at most this much space on the host. Zero leaves it out.
+	CrashBundleDiskMaxInMB int64 `mapstructure:"crash_bundle_disk_max_in_mb"`
+	// MaxVcpus is how many vCPUs a VM can be resized to. Below a VM's boot
+	// vCPUs, which includes the default of zero, vCPUs can't be added.
+	MaxVcpus int32 `mapstructure:"max_vcpus"`
+	// MemoryHotplugSizeInMB is how much memory can be added to a VM on top
+	// of its boot memory, in multiples of 128. Zero disables memory
+	// hotplug. VMs with cpuAffinity or numaNode can't be resized.
+	MemoryHotplugSizeInMB int32 `mapstructure:"memory_hotplug_size_in_mb"`
+	// OperationRetention is how long finished asynchronous operations stay
+	// queryable through /v1/operations/{id}.
+	OperationRetention time.Duration `mapstructure:"operation_retention"`
+	// MaxVMs caps the number of VMs, pooled ones included. Zero means no
+	// limit.
+	MaxVMs int `mapstructure:"max_vms"`
+	// PoolSize is how many booted VMs are kept ready for StartVM requests to
+	// claim instead of cold-starting one. Zero disables the pool.
+	PoolSize int `mapstructure:"pool_size"`
+	// CallbackQueueSize enables store-and-forward callbacks: each VM's
+	// callbacks are queued, up to this many, and delivered in order with
+	// retries while the guest is told they were accepted. Zero delivers
+	// callbacks while the guest waits.
+	CallbackQueueSize int `mapstructure:"callback_queue_size"`
+	// CallbackQueueMaxAge is how long a queued callback is retried for
+	// before it's moved to the VM's dead letters.
+	CallbackQueueMaxAge time.Duration `mapstructure:"callback_queue_max_age"`
+	// CallbackAuditCapacity is how many routed callbacks are kept, across
+	// all VMs, for /v1/vms/{name}/callbacks/history. Zero disables it.
+	CallbackAuditCapacity int `mapstructure:"callback_audit_capacity"`
+	// CallbackAuditParamsLimit is how many bytes of each callback's params
+	// are kept in the history.
+	CallbackAuditParamsLimit int `mapstructure:"callback_audit_params_limit"`
+	// MaxCallbackParamsSizeInKB bounds the params of a guest callback.
+	MaxCallbackParamsSizeInKB int64 `mapstructure:"max_callback_params_size_in_kb"`
+	// MaxCallbackResponseSizeInKB bounds the response of an HTTP callback
+	// receiver; larger responses fail the callback.
+	MaxCallbackResponseSizeInKB int64 `mapstructure:"max_callback_response_size_in_kb"`
+	// ExecTransport is how blocking exec requests reach the guest unless
+	// they ask otherwise: "http" to cmdserver over the guest network, or
+	// "vsock" to vsockserver, which keeps working when the guest network is
+	// broken.
+	ExecTransport string `mapstructure:"exec_transport"`
+	// MaxExecRequestSizeInKB bounds the body of exec requests.
+	MaxExecRequestSizeInKB int64 `mapstructure:"max_exec_request_size_in_kb"`
+	// MaxConcurrentExecsPerVM bounds the execs running in a VM at once, the
+	// rest waiting their turn. Zero means no limit.
+	MaxConcurrentExecsPerVM int `mapstructure:"max_concurrent_execs_per_vm"`
+	// HeartbeatInterval is how often guests report their health, passed to
+	// them on the kernel command line. Zero turns heartbeats off.
+	HeartbeatInterval time.Duration `mapstructure:"heartbeat_interval"`
+	// ShutdownGracePeriod is how long in-flight requests get to complete on
+	// shutdown before their connections are closed.
+	ShutdownGracePeriod time.Duration `mapstructure:"shutdown_grace_period"`
+	// DestroyVMsOnShutdown destroys all VMs on shutdown. Otherwise they're
+	// left running for the next start of the server to adopt.
+	DestroyVMsOnShutdown bool `mapstructure:"destroy_vms_on_shutdown"`
+	// ChvReadyTimeout is how long a new cloud-hypervisor process gets to
+	// answer on its API socket.
+	ChvReadyTimeout time.Duration `mapstructure:"chv_ready_timeout"`
+	// CmdServerReadyTimeout is how long a booted or rebooted guest gets for
+	// its cmdserver to come up.
+	CmdServerReadyTimeout time.Duration `mapstructure:"cmdserver_ready_timeout"`
+	// ReapTimeout is how long a VM's cloud-hypervisor process gets to exit
+	// once it's shut down.
+	ReapTimeout time.Duration `mapstructure:"reap_timeout"`
+	// DestroyParallelism is how many VMs destroying all VMs destroys at
+	// once.
+	DestroyParallelism int `mapstructure:"destroy_parallelism"`
+	// RootfsOverlay runs VMs on a writable qcow2 overlay of their rootfs
+	// unless their start request says otherwise. Needs qemu-img.
+	RootfsOverlay bool `mapstructure:"rootfs_overlay"`
+	// DefaultKernelArgs are appended to every VM's kernel command line,
+	// before the extraKernelArgs of its start request.
+	DefaultKernelArgs string `mapstructure:"default_kernel_args"`
+	// Profiles are image profiles start requests can select by name. Names
+	// are lowercased when the config is loaded.
+	Profiles map[string]Profile `mapstructure:"profiles"`
+
+	// MigrateSubnet is set from the --migrate-subnet flag rather than the
+	// config file since it should only apply to a single start.
+	MigrateSubnet bool `mapstructure:"-"`
 }
 
 func (c ServerConfig) String() string {
@@ -33,11 +248,78 @@ StateDir: %s
 BridgeName: %s
 BridgeIP: %s
 BridgeSubnet: %s
+IPExclusions: %v
+CIDRange: %s
 KernelPath: %s
 ChvBinPath: %s
+VirtiofsdBinPath: %s
 InitramfsPath: %s
 StatefulSizeInMB: %d
+MaxStatefulSizeInMB: %d
 GuestMemPercentage: %d
+SerialMode: %s
+EnableConsoleExec: %t
+EnableFaultInjection: %t
+DisableHTTPCallbackEndpoint: %t
+DisableHypervisorLogTail: %t
+ProxyAllowedPorts: %v
+ProxyIdleTimeout: %s
+MaxProxiesPerVM: %d
+ShellIdleTimeout: %s
+MaxShellsPerVM: %d
+RetainDestroyedArtifacts: %s
+ArchiveQuotaInMB: %d
+DisableAgentAutoRecovery: %t
+AgentRestartCommand: %s
+AgentRecoveryWindow: %s
+AdminHost: %s
+AdminPort: %s
+AdminTokens: %d configured
+GRPCPort: %s
+MaxTemplates: %d
+APITokens: %d configured
+APITokensFile: %s
+AuditLogPath: %s
+AuditLogMaxSizeInMB: %d
+AuditLogMaxBackups: %d
+AuditLogCapacity: %d
+StrictCPUPinning: %t
+ArtifactQuotaInMB: %d
+MaxArtifactSizeInMB: %d
+WorkspaceQuotaInMB: %d
+AllocatorWarningPercent: %d
+EnableAgentUpdate: %t
+RecordingMaxCount: %d
+RecordingMaxSizeInMB: %d
+RecordingRedactPatterns: %d configured
+NetworkMode: %s
+CrashBundleTimeout: %s
+CrashBundleQuotaInMB: %d
+CrashBundleDiskMaxInMB: %d
+MaxVcpus: %d
+MemoryHotplugSizeInMB: %d
+OperationRetention: %s
+MaxVMs: %d
+PoolSize: %d
+CallbackQueueSize: %d
+CallbackQueueMaxAge: %s
+CallbackAuditCapacity: %d
+CallbackAuditParamsLimit: %d
+MaxCallbackParamsSizeInKB: %d
+MaxCallbackResponseSizeInKB: %d
+ExecTransport: %s
+MaxExecRequestSizeInKB: %d
+MaxConcurrentExecsPerVM: %d
+HeartbeatInterval: %s
+ShutdownGracePeriod: %s
+DestroyVMsOnShutdown: %t
+ChvReadyTimeout: %s
+CmdServerReadyTimeout: %s
+ReapTimeout: %s
+DestroyParallelism: %d
+RootfsOverlay: %t
+DefaultKernelArgs: %s
+Profiles: %v
 }`,
 		c.Host,
 		c.Port,
@@ -45,30 +327,149 @@ GuestMemPercentage: %d
 		c.BridgeName,
 		c.BridgeIP,
 		c.BridgeSubnet,
+		c.IPExclusions,
+		c.CIDRange,
 		c.KernelPath,
 		c.ChvBinPath,
+		c.VirtiofsdBinPath,
 		c.InitramfsPath,
 		c.StatefulSizeInMB,
+		c.MaxStatefulSizeInMB,
 		c.GuestMemPercentage,
+		c.SerialMode,
+		c.EnableConsoleExec,
+		c.EnableFaultInjection,
+		c.DisableHTTPCallbackEndpoint,
+		c.DisableHypervisorLogTail,
+		c.ProxyAllowedPorts,
+		c.ProxyIdleTimeout,
+		c.MaxProxiesPerVM,
+		c.ShellIdleTimeout,
+		c.MaxShellsPerVM,
+		c.RetainDestroyedArtifacts,
+		c.ArchiveQuotaInMB,
+		c.DisableAgentAutoRecovery,
+		c.AgentRestartCommand,
+		c.AgentRecoveryWindow,
+		c.AdminHost,
+		c.AdminPort,
+		len(c.AdminTokens),
+		c.GRPCPort,
+		c.MaxTemplates,
+		len(c.APITokens),
+		c.APITokensFile,
+		c.AuditLogPath,
+		c.AuditLogMaxSizeInMB,
+		c.AuditLogMaxBackups,
+		c.AuditLogCapacity,
+		c.StrictCPUPinning,
+		c.ArtifactQuotaInMB,
+		c.MaxArtifactSizeInMB,
+		c.WorkspaceQuotaInMB,
+		c.AllocatorWarningPercent,
+		c.EnableAgentUpdate,
+		c.RecordingMaxCount,
+		c.RecordingMaxSizeInMB,
+		len(c.RecordingRedactPatterns),
+		c.NetworkMode,
+		c.CrashBundleTimeout,
+		c.CrashBundleQuotaInMB,
+		c.CrashBundleDiskMaxInMB,
+		c.MaxVcpus,
+		c.MemoryHotplugSizeInMB,
+		c.OperationRetention,
+		c.MaxVMs,
+		c.PoolSize,
+		c.CallbackQueueSize,
+		c.CallbackQueueMaxAge,
+		c.CallbackAuditCapacity,
+		c.CallbackAuditParamsLimit,
+		c.MaxCallbackParamsSizeInKB,
+		c.MaxCallbackResponseSizeInKB,
+		c.ExecTransport,
+		c.MaxExecRequestSizeInKB,
+		c.MaxConcurrentExecsPerVM,
+		c.HeartbeatInterval,
+		c.ShutdownGracePeriod,
+		c.DestroyVMsOnShutdown,
+		c.ChvReadyTimeout,
+		c.CmdServerReadyTimeout,
+		c.ReapTimeout,
+		c.DestroyParallelism,
+		c.RootfsOverlay,
+		c.DefaultKernelArgs,
+		slices.Sorted(maps.Keys(c.Profiles)),
 	)
 }
 
+// GetServerConfig loads and validates the server config from configFile.
 func GetServerConfig(configFile string) (*ServerConfig, error) {
-	viper.SetConfigFile(configFile)
-	err := viper.ReadInConfig()
-	if err != nil {
-		return nil, fmt.Errorf("failed to read config: %v", err)
+	config, _, err := LoadServerConfig(configFile)
+	return config, err
+}
+
+// LoadServerConfig loads the server config from configFile on top of
+// DefaultServerConfig, applies CBOX_<KEY> environment overrides and validates
+// the result. It also returns where each key's value came from.
+func LoadServerConfig(configFile string) (*ServerConfig, map[string]Source, error) {
+	v := viper.New()
+	v.SetConfigFile(configFile)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read config: %v", err)
 	}
 
-	restServerConfig := viper.Sub(serverConfigKey)
+	restServerConfig := v.Sub(serverConfigKey)
 	if restServerConfig == nil {
-		return nil, fmt.Errorf("restserver configuration not found")
+		return nil, nil, fmt.Errorf("restserver configuration not found")
 	}
 
-	var result ServerConfig
+	sources := make(map[string]Source)
+	for _, field := range configFields() {
+		sources[field.key] = SourceDefault
+		if restServerConfig.IsSet(field.key) {
+			sources[field.key] = SourceFile
+		}
+		if !field.fromEnv {
+			continue
+		}
+		env := EnvVar(field.key)
+		if err := restServerConfig.BindEnv(field.key, env); err != nil {
+			return nil, nil, fmt.Errorf("failed to bind %s: %v", env, err)
+		}
+		if _, ok := os.LookupEnv(env); ok {
+			sources[field.key] = SourceEnv
+		}
+	}
+
+	result := DefaultServerConfig()
 	if err := restServerConfig.Unmarshal(&result); err != nil {
-		return nil, fmt.Errorf("error unmarshalling config: %v", err)
+		return nil, nil, fmt.Errorf("error unmarshalling config: %v", err)
+	}
+	if result.APITokensFile != "" {
+		tokens, err := loadAPITokensFile(result.APITokensFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		result.APITokens = append(result.APITokens, tokens...)
+	}
+	if err := result.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid config: %w", err)
 	}
+	return &result, sources, nil
+}
 
-	return &result, nil
+// loadAPITokensFile reads the api_tokens list of an api_tokens_file.
+func loadAPITokensFile(path string) ([]APIToken, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	// JSON is valid YAML, so files needn't have a known extension.
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read api_tokens_file: %v", err)
+	}
+	var tokens []APIToken
+	if err := v.UnmarshalKey("api_tokens", &tokens); err != nil {
+		return nil, fmt.Errorf("invalid api_tokens_file %s: %v", path, err)
+	}
+	return tokens, nil
 }
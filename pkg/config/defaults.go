@@ -0,0 +1,271 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// DefaultAgentRestartCommand works with both the OpenRC and systemd guest
+// images.
+const DefaultAgentRestartCommand = "if command -v systemctl >/dev/null; then systemctl restart cbox-cmdserver; else rc-service cbox-cmdserver restart; fi"
+
+const (
+	NetworkModeBridge   = "bridge"
+	NetworkModeExternal = "external"
+)
+
+// networkModes are the values network_mode accepts.
+var networkModes = []string{NetworkModeBridge, NetworkModeExternal}
+
+const (
+	ExecTransportHTTP  = "http"
+	ExecTransportVsock = "vsock"
+)
+
+// ExecTransports are the values exec_transport accepts.
+var ExecTransports = []string{ExecTransportHTTP, ExecTransportVsock}
+
+// BridgeNetworking reports whether the server manages the bridge and
+// firewall on the host.
+func (c *ServerConfig) BridgeNetworking() bool {
+	return c.NetworkMode == NetworkModeBridge
+}
+
+// serialModes are the cloud-hypervisor console modes serial_mode accepts.
+var serialModes = []string{"Off", "Pty", "Tty", "File", "Socket", "Null"}
+
+// DefaultServerConfig returns the values used for keys the config file and
+// environment leave unset.
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Port:                   "7000",
+		StateDir:               "./vm-state",
+		CIDRange:               "3-1000",
+		StatefulSizeInMB:       2048,
+		MaxStatefulSizeInMB:    65536,
+		VirtiofsdBinPath:       "/usr/libexec/virtiofsd",
+		GuestMemPercentage:     50,
+		SerialMode:             "Tty",
+		ProxyIdleTimeout:       5 * time.Minute,
+		MaxProxiesPerVM:        16,
+		ShellIdleTimeout:       15 * time.Minute,
+		MaxShellsPerVM:         4,
+		AgentRestartCommand:    DefaultAgentRestartCommand,
+		AgentRecoveryWindow:    10 * time.Minute,
+		AdminHost:              "127.0.0.1",
+		RecordingMaxCount:      100,
+		RecordingMaxSizeInMB:   64,
+		NetworkMode:            NetworkModeBridge,
+		CrashBundleTimeout:     30 * time.Second,
+		CrashBundleQuotaInMB:   256,
+		OperationRetention:     time.Hour,
+		CallbackQueueMaxAge:    time.Hour,
+		ExecTransport:          ExecTransportHTTP,
+		MaxExecRequestSizeInKB: 1024,
+		HeartbeatInterval:      15 * time.Second,
+		ShutdownGracePeriod:    30 * time.Second,
+		DestroyVMsOnShutdown:   true,
+		ChvReadyTimeout:        10 * time.Second,
+		ReapTimeout:            20 * time.Second,
+
+		CmdServerReadyTimeout: time.Minute,
+		DestroyParallelism:    8,
+
+		AuditLogMaxSizeInMB: 100,
+		AuditLogMaxBackups:  5,
+		AuditLogCapacity:    10000,
+
+		CallbackAuditCapacity:       1000,
+		CallbackAuditParamsLimit:    1024,
+		MaxCallbackParamsSizeInKB:   1024,
+		MaxCallbackResponseSizeInKB: 4096,
+	}
+}
+
+// Validate checks that c can be used as is, including that the files it
+// refers to are there, and returns every problem it finds joined in one
+// error. Unset values have to be filled in from DefaultServerConfig first.
+func (c *ServerConfig) Validate() error {
+	var errs []error
+	errs = append(errs, validatePort("port", c.Port, true))
+	errs = append(errs, validatePort("admin_port", c.AdminPort, false))
+	errs = append(errs, validatePort("grpc_port", c.GRPCPort, false))
+	if c.StateDir == "" {
+		errs = append(errs, fmt.Errorf("state_dir must be set"))
+	}
+	if c.StatefulSizeInMB <= 0 {
+		errs = append(errs, fmt.Errorf("stateful_size_in_mb must be positive, got %d", c.StatefulSizeInMB))
+	}
+	if c.MaxStatefulSizeInMB < c.StatefulSizeInMB {
+		errs = append(errs, fmt.Errorf("max_stateful_size_in_mb must be at least stateful_size_in_mb (%d), got %d", c.StatefulSizeInMB, c.MaxStatefulSizeInMB))
+	}
+	if c.GuestMemPercentage <= 0 || c.GuestMemPercentage > 100 {
+		errs = append(errs, fmt.Errorf("guest_mem_percentage must be between 1 and 100, got %d", c.GuestMemPercentage))
+	}
+	if !slices.Contains(serialModes, c.SerialMode) {
+		errs = append(errs, fmt.Errorf("serial_mode must be one of %v, got %q", serialModes, c.SerialMode))
+	}
+	if c.ProxyIdleTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("proxy_idle_timeout must be positive, got %s", c.ProxyIdleTimeout))
+	}
+	if c.MaxProxiesPerVM <= 0 {
+		errs = append(errs, fmt.Errorf("max_proxies_per_vm must be positive, got %d", c.MaxProxiesPerVM))
+	}
+	if c.ShellIdleTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shell_idle_timeout must be positive, got %s", c.ShellIdleTimeout))
+	}
+	if c.MaxShellsPerVM <= 0 {
+		errs = append(errs, fmt.Errorf("max_shells_per_vm must be positive, got %d", c.MaxShellsPerVM))
+	}
+	if c.RetainDestroyedArtifacts < 0 {
+		errs = append(errs, fmt.Errorf("retain_destroyed_artifacts must not be negative, got %s", c.RetainDestroyedArtifacts))
+	}
+	if c.ArchiveQuotaInMB < 0 {
+		errs = append(errs, fmt.Errorf("archive_quota_in_mb must not be negative, got %d", c.ArchiveQuotaInMB))
+	}
+	if c.AgentRestartCommand == "" {
+		errs = append(errs, fmt.Errorf("agent_restart_command must not be empty, omit it to use the default"))
+	}
+	if c.AgentRecoveryWindow <= 0 {
+		errs = append(errs, fmt.Errorf("agent_recovery_window must be positive, got %s", c.AgentRecoveryWindow))
+	}
+	if c.AdminHost == "" {
+		errs = append(errs, fmt.Errorf("admin_host must not be empty, omit it to use the default"))
+	}
+	if c.MaxTemplates < 0 {
+		errs = append(errs, fmt.Errorf("max_templates must not be negative, got %d", c.MaxTemplates))
+	}
+	if c.MaxArtifactSizeInMB < 0 {
+		errs = append(errs, fmt.Errorf("max_artifact_size_in_mb must not be negative, got %d", c.MaxArtifactSizeInMB))
+	}
+	if c.ArtifactQuotaInMB < 0 {
+		errs = append(errs, fmt.Errorf("artifact_quota_in_mb must not be negative, got %d", c.ArtifactQuotaInMB))
+	}
+	if c.WorkspaceQuotaInMB < 0 {
+		errs = append(errs, fmt.Errorf("workspace_quota_in_mb must not be negative, got %d", c.WorkspaceQuotaInMB))
+	}
+	if c.AllocatorWarningPercent < 0 || c.AllocatorWarningPercent > 100 {
+		errs = append(errs, fmt.Errorf("allocator_warning_percent must be between 0 and 100, got %d", c.AllocatorWarningPercent))
+	}
+	if c.RecordingMaxCount <= 0 {
+		errs = append(errs, fmt.Errorf("recording_max_count must be positive, got %d", c.RecordingMaxCount))
+	}
+	if c.RecordingMaxSizeInMB <= 0 {
+		errs = append(errs, fmt.Errorf("recording_max_size_in_mb must be positive, got %d", c.RecordingMaxSizeInMB))
+	}
+	if !slices.Contains(networkModes, c.NetworkMode) {
+		errs = append(errs, fmt.Errorf("network_mode must be one of %v, got %q", networkModes, c.NetworkMode))
+	}
+	if c.CrashBundleTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("crash_bundle_timeout must be positive, got %s", c.CrashBundleTimeout))
+	}
+	if c.CrashBundleQuotaInMB <= 0 {
+		errs = append(errs, fmt.Errorf("crash_bundle_quota_in_mb must be positive, got %d", c.CrashBundleQuotaInMB))
+	}
+	if c.CrashBundleDiskMaxInMB < 0 {
+		errs = append(errs, fmt.Errorf("crash_bundle_disk_max_in_mb must not be negative, got %d", c.CrashBundleDiskMaxInMB))
+	}
+	if c.MaxVcpus < 0 {
+		errs = append(errs, fmt.Errorf("max_vcpus must not be negative, got %d", c.MaxVcpus))
+	}
+	if c.MemoryHotplugSizeInMB < 0 || c.MemoryHotplugSizeInMB%128 != 0 {
+		errs = append(errs, fmt.Errorf("memory_hotplug_size_in_mb must be a non-negative multiple of 128, got %d", c.MemoryHotplugSizeInMB))
+	}
+	if c.OperationRetention <= 0 {
+		errs = append(errs, fmt.Errorf("operation_retention must be positive, got %s", c.OperationRetention))
+	}
+	if c.MaxVMs < 0 {
+		errs = append(errs, fmt.Errorf("max_vms must not be negative, got %d", c.MaxVMs))
+	}
+	if c.PoolSize < 0 {
+		errs = append(errs, fmt.Errorf("pool_size must not be negative, got %d", c.PoolSize))
+	}
+	if c.MaxVMs > 0 && c.PoolSize > c.MaxVMs {
+		errs = append(errs, fmt.Errorf("pool_size must be at most max_vms (%d), got %d", c.MaxVMs, c.PoolSize))
+	}
+	if c.PoolSize > 0 && !c.BridgeNetworking() {
+		errs = append(errs, fmt.Errorf("pool_size requires network_mode %s", NetworkModeBridge))
+	}
+	if c.CallbackQueueSize < 0 {
+		errs = append(errs, fmt.Errorf("callback_queue_size must not be negative, got %d", c.CallbackQueueSize))
+	}
+	if c.CallbackQueueSize > 0 && c.CallbackQueueMaxAge <= 0 {
+		errs = append(errs, fmt.Errorf("callback_queue_max_age must be positive, got %s", c.CallbackQueueMaxAge))
+	}
+	if c.MaxExecRequestSizeInKB < 1 {
+		errs = append(errs, fmt.Errorf("max_exec_request_size_in_kb must be at least 1, got %d", c.MaxExecRequestSizeInKB))
+	}
+	if c.MaxConcurrentExecsPerVM < 0 {
+		errs = append(errs, fmt.Errorf("max_concurrent_execs_per_vm must not be negative, got %d", c.MaxConcurrentExecsPerVM))
+	}
+	if !slices.Contains(ExecTransports, c.ExecTransport) {
+		errs = append(errs, fmt.Errorf("exec_transport must be one of %v, got %q", ExecTransports, c.ExecTransport))
+	}
+	if c.AuditLogMaxSizeInMB < 1 {
+		errs = append(errs, fmt.Errorf("audit_log_max_size_in_mb must be at least 1, got %d", c.AuditLogMaxSizeInMB))
+	}
+	if c.AuditLogMaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("audit_log_max_backups must not be negative, got %d", c.AuditLogMaxBackups))
+	}
+	if c.AuditLogCapacity < 0 {
+		errs = append(errs, fmt.Errorf("audit_log_capacity must not be negative, got %d", c.AuditLogCapacity))
+	}
+	if c.CallbackAuditCapacity < 0 {
+		errs = append(errs, fmt.Errorf("callback_audit_capacity must not be negative, got %d", c.CallbackAuditCapacity))
+	}
+	if c.CallbackAuditParamsLimit < 0 {
+		errs = append(errs, fmt.Errorf("callback_audit_params_limit must not be negative, got %d", c.CallbackAuditParamsLimit))
+	}
+	if c.MaxCallbackParamsSizeInKB < 1 {
+		errs = append(errs, fmt.Errorf("max_callback_params_size_in_kb must be at least 1, got %d", c.MaxCallbackParamsSizeInKB))
+	}
+	if c.MaxCallbackResponseSizeInKB < 1 {
+		errs = append(errs, fmt.Errorf("max_callback_response_size_in_kb must be at least 1, got %d", c.MaxCallbackResponseSizeInKB))
+	}
+	if c.HeartbeatInterval < 0 {
+		errs = append(errs, fmt.Errorf("heartbeat_interval must not be negative, got %s", c.HeartbeatInterval))
+	}
+	if c.ShutdownGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("shutdown_grace_period must not be negative, got %s", c.ShutdownGracePeriod))
+	}
+	if c.ChvReadyTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("chv_ready_timeout must be positive, got %s", c.ChvReadyTimeout))
+	}
+	if c.CmdServerReadyTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("cmdserver_ready_timeout must be positive, got %s", c.CmdServerReadyTimeout))
+	}
+	if c.ReapTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("reap_timeout must be positive, got %s", c.ReapTimeout))
+	}
+	if c.DestroyParallelism < 1 {
+		errs = append(errs, fmt.Errorf("destroy_parallelism must be at least 1, got %d", c.DestroyParallelism))
+	}
+	for name, profile := range c.Profiles {
+		if name == "" {
+			errs = append(errs, fmt.Errorf("profiles must have a name"))
+		}
+		if profile.DefaultMemPercentage < 0 || profile.DefaultMemPercentage > 100 {
+			errs = append(errs, fmt.Errorf("profile %s: default_mem_percentage must be between 0 and 100, got %d", name, profile.DefaultMemPercentage))
+		}
+		if profile.DefaultVcpus < 0 {
+			errs = append(errs, fmt.Errorf("profile %s: default_vcpus must not be negative, got %d", name, profile.DefaultVcpus))
+		}
+	}
+	for _, pattern := range c.RecordingRedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("invalid recording_redact_patterns entry %q: %v", pattern, err))
+		}
+	}
+	if c.BridgeNetworking() {
+		errs = append(errs, validateBridge(c.BridgeIP, c.BridgeSubnet))
+		errs = append(errs, validateIPExclusions(c.IPExclusions)...)
+	}
+	if _, _, err := c.CIDBounds(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, c.validatePaths()...)
+	return errors.Join(errs...)
+}
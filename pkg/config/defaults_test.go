@@ -0,0 +1,138 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// requiredKeys are the keys without a default, which writeConfig sets.
+var requiredKeys = []string{"chv_bin", "bridge_ip", "bridge_subnet"}
+
+// writeConfig writes a config file whose restserver section is body plus
+// requiredKeys, with chv_bin pointing at an executable, and returns its path.
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	dir := t.TempDir()
+	chv := filepath.Join(dir, "cloud-hypervisor")
+	if err := os.WriteFile(chv, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	content := "hostservices:\n  restserver:\n" +
+		"    chv_bin: " + chv + "\n" +
+		"    bridge_ip: 10.20.1.1/24\n" +
+		"    bridge_subnet: 10.20.1.0/24\n" +
+		body
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaultServerConfig(t *testing.T) {
+	// Changing a default changes how existing deployments run; update this
+	// list along with config.yaml when that's intended.
+	want := map[string]any{
+		"port":                             "7000",
+		"state_dir":                        "./vm-state",
+		"cid_range":                        "3-1000",
+		"stateful_size_in_mb":              int32(2048),
+		"max_stateful_size_in_mb":          int32(65536),
+		"virtiofsd_bin":                    "/usr/libexec/virtiofsd",
+		"guest_mem_percentage":             int32(50),
+		"serial_mode":                      "Tty",
+		"proxy_idle_timeout":               5 * time.Minute,
+		"max_proxies_per_vm":               16,
+		"shell_idle_timeout":               15 * time.Minute,
+		"max_shells_per_vm":                4,
+		"agent_restart_command":            DefaultAgentRestartCommand,
+		"agent_recovery_window":            10 * time.Minute,
+		"admin_host":                       "127.0.0.1",
+		"recording_max_count":              100,
+		"recording_max_size_in_mb":         int64(64),
+		"network_mode":                     NetworkModeBridge,
+		"crash_bundle_timeout":             30 * time.Second,
+		"crash_bundle_quota_in_mb":         int64(256),
+		"operation_retention":              time.Hour,
+		"callback_queue_max_age":           time.Hour,
+		"exec_transport":                   ExecTransportHTTP,
+		"max_exec_request_size_in_kb":      int64(1024),
+		"heartbeat_interval":               15 * time.Second,
+		"shutdown_grace_period":            30 * time.Second,
+		"destroy_vms_on_shutdown":          true,
+		"chv_ready_timeout":                10 * time.Second,
+		"reap_timeout":                     20 * time.Second,
+		"cmdserver_ready_timeout":          time.Minute,
+		"destroy_parallelism":              8,
+		"audit_log_max_size_in_mb":         int64(100),
+		"audit_log_max_backups":            5,
+		"audit_log_capacity":               10000,
+		"callback_audit_capacity":          1000,
+		"callback_audit_params_limit":      1024,
+		"max_callback_params_size_in_kb":   int64(1024),
+		"max_callback_response_size_in_kb": int64(4096),
+	}
+
+	config, sources, err := LoadServerConfig(writeConfig(t, ""))
+	if err != nil {
+		t.Fatalf("LoadServerConfig: %v", err)
+	}
+	value := reflect.ValueOf(*config)
+	for _, field := range configFields() {
+		if slices.Contains(requiredKeys, field.key) {
+			continue
+		}
+		if sources[field.key] != SourceDefault {
+			t.Errorf("source of %s = %q, want %q", field.key, sources[field.key], SourceDefault)
+		}
+		got := value.Field(field.index).Interface()
+		expected, ok := want[field.key]
+		if !ok {
+			// Everything else defaults to its zero value.
+			if !value.Field(field.index).IsZero() {
+				t.Errorf("%s = %v, want the zero value or an entry in this test", field.key, got)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s = %#v, want %#v", field.key, got, expected)
+		}
+	}
+	for key := range want {
+		found := false
+		for _, field := range configFields() {
+			found = found || field.key == key
+		}
+		if !found {
+			t.Errorf("default for unknown key %s", key)
+		}
+	}
+}
+
+func TestLoadServerConfigSources(t *testing.T) {
+	t.Setenv(EnvVar("max_shells_per_vm"), "9")
+	config, sources, err := LoadServerConfig(writeConfig(t, "    guest_mem_percentage: 30\n"))
+	if err != nil {
+		t.Fatalf("LoadServerConfig: %v", err)
+	}
+	if config.GuestMemPercentage != 30 || sources["guest_mem_percentage"] != SourceFile {
+		t.Errorf("guest_mem_percentage = %d from %s, want 30 from the file", config.GuestMemPercentage, sources["guest_mem_percentage"])
+	}
+	if config.MaxShellsPerVM != 9 || sources["max_shells_per_vm"] != SourceEnv {
+		t.Errorf("max_shells_per_vm = %d from %s, want 9 from the environment", config.MaxShellsPerVM, sources["max_shells_per_vm"])
+	}
+	if config.Port != "7000" || sources["port"] != SourceDefault {
+		t.Errorf("port = %s from %s, want the default", config.Port, sources["port"])
+	}
+}
+
+func TestValidateRejectsUnsetDefaults(t *testing.T) {
+	var config ServerConfig
+	if err := config.Validate(); err == nil {
+		t.Error("Validate of a config without defaults succeeded")
+	}
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix prefixes the environment variables that override config keys.
+const envPrefix = "CBOX_"
+
+const redacted = "<redacted>"
+
+// Source is where a resolved config value came from.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+)
+
+// EnvVar returns the environment variable that overrides key, e.g.
+// CBOX_GUEST_MEM_PERCENTAGE for guest_mem_percentage.
+func EnvVar(key string) string {
+	return envPrefix + strings.ToUpper(key)
+}
+
+// configField is a ServerConfig field that is read from the config file.
+type configField struct {
+	key   string
+	index int
+	// fromEnv is false for values that can't be given as a single string.
+	fromEnv bool
+}
+
+// configFields lists ServerConfig's keys in declaration order.
+func configFields() []configField {
+	var fields []configField
+	t := reflect.TypeOf(ServerConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("mapstructure")
+		if key == "" || key == "-" {
+			continue
+		}
+		fieldType := t.Field(i).Type
+		collection := fieldType.Kind() == reflect.Slice || fieldType.Kind() == reflect.Map
+		fromEnv := !collection || fieldType.Elem().Kind() != reflect.Struct
+		fields = append(fields, configField{key: key, index: i, fromEnv: fromEnv})
+	}
+	return fields
+}
+
+// ResolvedYAML renders c as a config file with each key's source from
+// sources as a line comment. Tokens are redacted.
+func (c ServerConfig) ResolvedYAML(sources map[string]Source) ([]byte, error) {
+	restserver := &yaml.Node{Kind: yaml.MappingNode}
+	value := reflect.ValueOf(c)
+	for _, field := range configFields() {
+		var v any
+		switch field.key {
+		case "admin_tokens":
+			tokens := make([]string, len(c.AdminTokens))
+			for i := range tokens {
+				tokens[i] = redacted
+			}
+			v = tokens
+		case "api_tokens":
+			tokens := make([]map[string]string, len(c.APITokens))
+			for i, token := range c.APITokens {
+				tokens[i] = map[string]string{"id": token.ID, "token": redacted, "role": token.Role}
+			}
+			v = tokens
+		default:
+			v = value.Field(field.index).Interface()
+			if d, ok := v.(time.Duration); ok {
+				v = d.String()
+			}
+		}
+
+		var valueNode yaml.Node
+		if err := valueNode.Encode(v); err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", field.key, err)
+		}
+		keyNode := &yaml.Node{Kind: yaml.ScalarNode, Value: field.key}
+		if source, ok := sources[field.key]; ok {
+			// A key's line comment only lands on the key's line if its value
+			// is a block; scalars and empty collections carry their own.
+			if len(valueNode.Content) == 0 {
+				valueNode.LineComment = string(source)
+			} else {
+				keyNode.LineComment = string(source)
+			}
+		}
+		restserver.Content = append(restserver.Content, keyNode, &valueNode)
+	}
+
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	hostservices := &yaml.Node{Kind: yaml.MappingNode}
+	parent, child, _ := strings.Cut(serverConfigKey, ".")
+	hostservices.Content = []*yaml.Node{{Kind: yaml.ScalarNode, Value: child}, restserver}
+	doc.Content = []*yaml.Node{{Kind: yaml.ScalarNode, Value: parent}, hostservices}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
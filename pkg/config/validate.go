@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxCIDRangeSize bounds cid_range, whose CIDs are all kept in memory.
+const maxCIDRangeSize = 1 << 16
+
+// CIDBounds returns the lowest and highest CID of cid_range. CIDs 0 to 2 are
+// reserved for the hypervisor and host, and 2^32-1 means any CID.
+func (c *ServerConfig) CIDBounds() (low uint32, high uint32, err error) {
+	lowStr, highStr, ok := strings.Cut(c.CIDRange, "-")
+	lowCID, lowErr := strconv.ParseUint(strings.TrimSpace(lowStr), 10, 32)
+	highCID, highErr := strconv.ParseUint(strings.TrimSpace(highStr), 10, 32)
+	if !ok || lowErr != nil || highErr != nil {
+		return 0, 0, fmt.Errorf("cid_range must be a range such as 3-1000, got %q", c.CIDRange)
+	}
+	if lowCID < 3 || highCID >= 0xFFFFFFFF || lowCID > highCID {
+		return 0, 0, fmt.Errorf("cid_range must be a non-empty range from 3 to 4294967294, got %q", c.CIDRange)
+	}
+	if highCID-lowCID+1 > maxCIDRangeSize {
+		return 0, 0, fmt.Errorf("cid_range must span at most %d CIDs, got %q", maxCIDRangeSize, c.CIDRange)
+	}
+	return uint32(lowCID), uint32(highCID), nil
+}
+
+// validateIPExclusions checks that each of exclusions is an IP or CIDR.
+func validateIPExclusions(exclusions []string) []error {
+	var errs []error
+	for _, exclusion := range exclusions {
+		if net.ParseIP(exclusion) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(exclusion); err != nil {
+			errs = append(errs, fmt.Errorf("ip_exclusions entries must be IPs or CIDRs, got %q", exclusion))
+		}
+	}
+	return errs
+}
+
+// validatePort checks that port is a TCP port number. Empty ports are only
+// accepted for optional listeners.
+func validatePort(key string, port string, required bool) error {
+	if port == "" {
+		if required {
+			return fmt.Errorf("%s must be set", key)
+		}
+		return nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%s must be a port between 1 and 65535, got %q", key, port)
+	}
+	return nil
+}
+
+// validateBridge checks that bridgeIP, an address with its prefix length, is
+// inside bridgeSubnet.
+func validateBridge(bridgeIP string, bridgeSubnet string) error {
+	ip, _, err := net.ParseCIDR(bridgeIP)
+	if err != nil {
+		return fmt.Errorf("bridge_ip must be an address with a prefix length such as 10.20.1.1/24, got %q", bridgeIP)
+	}
+	_, subnet, err := net.ParseCIDR(bridgeSubnet)
+	if err != nil {
+		return fmt.Errorf("bridge_subnet must be a CIDR such as 10.20.1.0/24, got %q", bridgeSubnet)
+	}
+	if !subnet.Contains(ip) {
+		return fmt.Errorf("bridge_ip %s must be inside bridge_subnet %s", ip, subnet)
+	}
+	return nil
+}
+
+// validatePaths checks the files c refers to: that the VMM binary can be
+// run and that the default and profile images can be read. Unset images are
+// left to start requests to supply.
+func (c *ServerConfig) validatePaths() []error {
+	var errs []error
+	if c.ChvBinPath == "" {
+		errs = append(errs, fmt.Errorf("chv_bin must be set"))
+	} else if err := checkExecutable(c.ChvBinPath); err != nil {
+		errs = append(errs, fmt.Errorf("chv_bin: %w", err))
+	}
+
+	type image struct {
+		key  string
+		path string
+	}
+	images := []image{
+		{"kernel", c.KernelPath},
+		{"initramfs", c.InitramfsPath},
+		{"rootfs", c.RootfsPath},
+	}
+	for name, profile := range c.Profiles {
+		prefix := "profile " + name + " "
+		images = append(images,
+			image{prefix + "kernel", profile.Kernel},
+			image{prefix + "initramfs", profile.Initramfs},
+			image{prefix + "rootfs", profile.Rootfs})
+	}
+	for _, image := range images {
+		if image.path == "" {
+			continue
+		}
+		if err := checkReadable(image.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", image.key, err))
+		}
+	}
+	return errs
+}
+
+// checkReadable checks that path is a regular file that can be opened for
+// reading.
+func checkReadable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// checkExecutable checks that path is a regular file with an execute bit set.
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", path)
+	}
+	return nil
+}
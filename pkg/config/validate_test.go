@@ -0,0 +1,140 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns a config that passes Validate, with chv_bin and the
+// images pointing at files in a temp dir.
+func validConfig(t *testing.T) ServerConfig {
+	t.Helper()
+	dir := t.TempDir()
+	config := DefaultServerConfig()
+	config.ChvBinPath = filepath.Join(dir, "cloud-hypervisor")
+	if err := os.WriteFile(config.ChvBinPath, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config.KernelPath = filepath.Join(dir, "vmlinux")
+	if err := os.WriteFile(config.KernelPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.BridgeIP = "10.20.1.1/24"
+	config.BridgeSubnet = "10.20.1.0/24"
+	return config
+}
+
+func TestValidate(t *testing.T) {
+	base := validConfig(t)
+	if err := base.Validate(); err != nil {
+		t.Fatalf("Validate of a valid config: %v", err)
+	}
+	notExecutable := filepath.Join(t.TempDir(), "chv")
+	if err := os.WriteFile(notExecutable, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(*ServerConfig)
+		want   string
+	}{
+		{"port unset", func(c *ServerConfig) { c.Port = "" }, "port must be set"},
+		{"port out of range", func(c *ServerConfig) { c.Port = "70000" }, "port must be a port between 1 and 65535"},
+		{"admin port", func(c *ServerConfig) { c.AdminPort = "admin" }, "admin_port must be a port"},
+		{"grpc port", func(c *ServerConfig) { c.GRPCPort = "0" }, "grpc_port must be a port"},
+		{"state dir", func(c *ServerConfig) { c.StateDir = "" }, "state_dir must be set"},
+		{"stateful size", func(c *ServerConfig) { c.StatefulSizeInMB = 0 }, "stateful_size_in_mb must be positive"},
+		{"max stateful size", func(c *ServerConfig) { c.MaxStatefulSizeInMB = c.StatefulSizeInMB - 1 }, "max_stateful_size_in_mb must be at least stateful_size_in_mb"},
+		{"guest memory", func(c *ServerConfig) { c.GuestMemPercentage = 101 }, "guest_mem_percentage must be between 1 and 100"},
+		{"serial mode", func(c *ServerConfig) { c.SerialMode = "tty" }, "serial_mode must be one of"},
+		{"proxy idle timeout", func(c *ServerConfig) { c.ProxyIdleTimeout = 0 }, "proxy_idle_timeout must be positive"},
+		{"max proxies", func(c *ServerConfig) { c.MaxProxiesPerVM = 0 }, "max_proxies_per_vm must be positive"},
+		{"shell idle timeout", func(c *ServerConfig) { c.ShellIdleTimeout = -time.Second }, "shell_idle_timeout must be positive"},
+		{"max shells", func(c *ServerConfig) { c.MaxShellsPerVM = 0 }, "max_shells_per_vm must be positive"},
+		{"artifact retention", func(c *ServerConfig) { c.RetainDestroyedArtifacts = -time.Second }, "retain_destroyed_artifacts must not be negative"},
+		{"archive quota", func(c *ServerConfig) { c.ArchiveQuotaInMB = -1 }, "archive_quota_in_mb must not be negative"},
+		{"agent restart command", func(c *ServerConfig) { c.AgentRestartCommand = "" }, "agent_restart_command must not be empty"},
+		{"agent recovery window", func(c *ServerConfig) { c.AgentRecoveryWindow = 0 }, "agent_recovery_window must be positive"},
+		{"admin host", func(c *ServerConfig) { c.AdminHost = "" }, "admin_host must not be empty"},
+		{"max templates", func(c *ServerConfig) { c.MaxTemplates = -1 }, "max_templates must not be negative"},
+		{"max artifact size", func(c *ServerConfig) { c.MaxArtifactSizeInMB = -1 }, "max_artifact_size_in_mb must not be negative"},
+		{"artifact quota", func(c *ServerConfig) { c.ArtifactQuotaInMB = -1 }, "artifact_quota_in_mb must not be negative"},
+		{"workspace quota", func(c *ServerConfig) { c.WorkspaceQuotaInMB = -1 }, "workspace_quota_in_mb must not be negative"},
+		{"allocator warning", func(c *ServerConfig) { c.AllocatorWarningPercent = 101 }, "allocator_warning_percent must be between 0 and 100"},
+		{"recording count", func(c *ServerConfig) { c.RecordingMaxCount = 0 }, "recording_max_count must be positive"},
+		{"recording size", func(c *ServerConfig) { c.RecordingMaxSizeInMB = 0 }, "recording_max_size_in_mb must be positive"},
+		{"network mode", func(c *ServerConfig) { c.NetworkMode = "host" }, "network_mode must be one of"},
+		{"crash bundle timeout", func(c *ServerConfig) { c.CrashBundleTimeout = 0 }, "crash_bundle_timeout must be positive"},
+		{"crash bundle quota", func(c *ServerConfig) { c.CrashBundleQuotaInMB = 0 }, "crash_bundle_quota_in_mb must be positive"},
+		{"crash bundle disk", func(c *ServerConfig) { c.CrashBundleDiskMaxInMB = -1 }, "crash_bundle_disk_max_in_mb must not be negative"},
+		{"max vcpus", func(c *ServerConfig) { c.MaxVcpus = -1 }, "max_vcpus must not be negative"},
+		{"memory hotplug", func(c *ServerConfig) { c.MemoryHotplugSizeInMB = 100 }, "memory_hotplug_size_in_mb must be a non-negative multiple of 128"},
+		{"operation retention", func(c *ServerConfig) { c.OperationRetention = 0 }, "operation_retention must be positive"},
+		{"max vms", func(c *ServerConfig) { c.MaxVMs = -1 }, "max_vms must not be negative"},
+		{"pool size", func(c *ServerConfig) { c.PoolSize = -1 }, "pool_size must not be negative"},
+		{"pool above max vms", func(c *ServerConfig) { c.MaxVMs, c.PoolSize = 2, 3 }, "pool_size must be at most max_vms"},
+		{"pool without bridge", func(c *ServerConfig) { c.NetworkMode, c.PoolSize = NetworkModeExternal, 1 }, "pool_size requires network_mode bridge"},
+		{"callback queue size", func(c *ServerConfig) { c.CallbackQueueSize = -1 }, "callback_queue_size must not be negative"},
+		{"callback queue age", func(c *ServerConfig) { c.CallbackQueueSize, c.CallbackQueueMaxAge = 10, 0 }, "callback_queue_max_age must be positive"},
+		{"exec request size", func(c *ServerConfig) { c.MaxExecRequestSizeInKB = 0 }, "max_exec_request_size_in_kb must be at least 1"},
+		{"concurrent execs", func(c *ServerConfig) { c.MaxConcurrentExecsPerVM = -1 }, "max_concurrent_execs_per_vm must not be negative"},
+		{"exec transport", func(c *ServerConfig) { c.ExecTransport = "ssh" }, "exec_transport must be one of"},
+		{"audit log size", func(c *ServerConfig) { c.AuditLogMaxSizeInMB = 0 }, "audit_log_max_size_in_mb must be at least 1"},
+		{"audit log backups", func(c *ServerConfig) { c.AuditLogMaxBackups = -1 }, "audit_log_max_backups must not be negative"},
+		{"audit log capacity", func(c *ServerConfig) { c.AuditLogCapacity = -1 }, "audit_log_capacity must not be negative"},
+		{"callback audit capacity", func(c *ServerConfig) { c.CallbackAuditCapacity = -1 }, "callback_audit_capacity must not be negative"},
+		{"callback audit params", func(c *ServerConfig) { c.CallbackAuditParamsLimit = -1 }, "callback_audit_params_limit must not be negative"},
+		{"callback params size", func(c *ServerConfig) { c.MaxCallbackParamsSizeInKB = 0 }, "max_callback_params_size_in_kb must be at least 1"},
+		{"callback response size", func(c *ServerConfig) { c.MaxCallbackResponseSizeInKB = 0 }, "max_callback_response_size_in_kb must be at least 1"},
+		{"heartbeat interval", func(c *ServerConfig) { c.HeartbeatInterval = -time.Second }, "heartbeat_interval must not be negative"},
+		{"shutdown grace period", func(c *ServerConfig) { c.ShutdownGracePeriod = -time.Second }, "shutdown_grace_period must not be negative"},
+		{"chv ready timeout", func(c *ServerConfig) { c.ChvReadyTimeout = 0 }, "chv_ready_timeout must be positive"},
+		{"cmdserver ready timeout", func(c *ServerConfig) { c.CmdServerReadyTimeout = 0 }, "cmdserver_ready_timeout must be positive"},
+		{"reap timeout", func(c *ServerConfig) { c.ReapTimeout = 0 }, "reap_timeout must be positive"},
+		{"destroy parallelism", func(c *ServerConfig) { c.DestroyParallelism = 0 }, "destroy_parallelism must be at least 1"},
+		{"profile name", func(c *ServerConfig) { c.Profiles = map[string]Profile{"": {}} }, "profiles must have a name"},
+		{"profile memory", func(c *ServerConfig) { c.Profiles = map[string]Profile{"big": {DefaultMemPercentage: 101}} }, "profile big: default_mem_percentage must be between 0 and 100"},
+		{"profile vcpus", func(c *ServerConfig) { c.Profiles = map[string]Profile{"big": {DefaultVcpus: -1}} }, "profile big: default_vcpus must not be negative"},
+		{"redact pattern", func(c *ServerConfig) { c.RecordingRedactPatterns = []string{"("} }, `invalid recording_redact_patterns entry "("`},
+		{"bridge ip", func(c *ServerConfig) { c.BridgeIP = "10.20.1.1" }, "bridge_ip must be an address with a prefix length"},
+		{"bridge subnet", func(c *ServerConfig) { c.BridgeSubnet = "10.20.1.0" }, "bridge_subnet must be a CIDR"},
+		{"bridge ip outside subnet", func(c *ServerConfig) { c.BridgeIP = "10.20.2.1/24" }, "bridge_ip 10.20.2.1 must be inside bridge_subnet 10.20.1.0/24"},
+		{"ip exclusions", func(c *ServerConfig) { c.IPExclusions = []string{"10.20.1"} }, `ip_exclusions entries must be IPs or CIDRs, got "10.20.1"`},
+		{"cid range syntax", func(c *ServerConfig) { c.CIDRange = "3..1000" }, "cid_range must be a range such as 3-1000"},
+		{"cid range reserved", func(c *ServerConfig) { c.CIDRange = "2-1000" }, "cid_range must be a non-empty range from 3 to 4294967294"},
+		{"cid range size", func(c *ServerConfig) { c.CIDRange = "3-100000" }, "cid_range must span at most 65536 CIDs"},
+		{"chv bin unset", func(c *ServerConfig) { c.ChvBinPath = "" }, "chv_bin must be set"},
+		{"chv bin missing", func(c *ServerConfig) { c.ChvBinPath = "/nonexistent/chv" }, "chv_bin: stat /nonexistent/chv"},
+		{"chv bin not executable", func(c *ServerConfig) { c.ChvBinPath = notExecutable }, "chv_bin: " + notExecutable + " is not an executable file"},
+		{"kernel missing", func(c *ServerConfig) { c.KernelPath = "/nonexistent/vmlinux" }, "kernel: stat /nonexistent/vmlinux"},
+		{"initramfs not a file", func(c *ServerConfig) { c.InitramfsPath = t.TempDir() }, "is not a regular file"},
+		{"profile rootfs", func(c *ServerConfig) { c.Profiles = map[string]Profile{"big": {Rootfs: "/nonexistent/rootfs"}} }, "profile big rootfs: stat /nonexistent/rootfs"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := base
+			tc.modify(&config)
+			err := config.Validate()
+			if err == nil {
+				t.Fatalf("Validate succeeded, want %q", tc.want)
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Validate = %q, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateExternalNetworkSkipsBridge(t *testing.T) {
+	config := validConfig(t)
+	config.NetworkMode = NetworkModeExternal
+	config.BridgeIP = ""
+	config.BridgeSubnet = ""
+	config.IPExclusions = []string{"not an IP"}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate in external network mode: %v", err)
+	}
+}
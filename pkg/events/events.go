@@ -0,0 +1,262 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types published by the server.
+const (
+	TypeVMCreated            = "vm.created"
+	TypeVMBooted             = "vm.booted"
+	TypeVMProvisioningFailed = "vm.provisioning_failed"
+	TypeVMDestroyed          = "vm.destroyed"
+	TypeVMAgentRecovered     = "vm.agent_recovered"
+	TypeVMAgentUnhealthy     = "vm.agent_unhealthy"
+	TypeVMArtifactPublished  = "vm.artifact_published"
+	TypeVMAgentUpdated       = "vm.agent_updated"
+	TypeVMLeaseAcquired      = "vm.lease_acquired"
+	TypeVMLeaseReleased      = "vm.lease_released"
+	TypeVMLeaseBroken        = "vm.lease_broken"
+	TypeVMCrashed            = "vm.crashed"
+	TypeVMCrashBundleReady   = "vm.crash_bundle_ready"
+	TypeVMPaused             = "vm.paused"
+	TypeVMResumed            = "vm.resumed"
+	TypeVMSnapshotted        = "vm.snapshotted"
+	TypeVMRestored           = "vm.restored"
+	TypeVMResized            = "vm.resized"
+	TypeVMDiskAttached       = "vm.disk_attached"
+	TypeVMDiskDetached       = "vm.disk_detached"
+	TypeVMStopped            = "vm.stopped"
+	TypeVMRebooted           = "vm.rebooted"
+	TypeVMAdopted            = "vm.adopted"
+	TypeVMExecStarted        = "vm.exec_started"
+	TypeVMExecFinished       = "vm.exec_finished"
+	TypeVMCallbackRouted     = "vm.callback_routed"
+	TypeVMHeartbeatMissed    = "vm.heartbeat_missed"
+	// TypeHostAllocatorPressure isn't tied to a VM.
+	TypeHostAllocatorPressure = "host.allocator_pressure"
+)
+
+// DefaultBufferSize is the number of events a subscriber can fall behind by
+// before the oldest ones are dropped.
+const DefaultBufferSize = 256
+
+// historySize is the number of past events kept for Recent.
+const historySize = 1024
+
+// ErrClosed is returned by Subscription.Next once the subscription is closed.
+var ErrClosed = errors.New("subscription closed")
+
+// Event is a single notification published on the Bus.
+type Event struct {
+	ID     uint64    `json:"id"`
+	Type   string    `json:"type"`
+	VMName string    `json:"vmName,omitempty"`
+	Time   time.Time `json:"time"`
+	Data   any       `json:"data,omitempty"`
+}
+
+// Bus fans events out to subscribers. Publish never blocks: each subscriber
+// has a bounded ring buffer, and a subscriber that falls behind loses its
+// oldest events instead of slowing the publisher down.
+type Bus struct {
+	lock   sync.RWMutex
+	subs   map[*Subscription]struct{}
+	nextID atomic.Uint64
+
+	historyLock sync.Mutex
+	// history holds the last historySize events, oldest first.
+	history []Event
+}
+
+// NewBus creates an empty Bus.
+func NewBus() *Bus {
+	return &Bus{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns the event an ID and timestamp and delivers it to every
+// subscriber.
+func (b *Bus) Publish(eventType string, vmName string, data any) Event {
+	event := Event{
+		ID:     b.nextID.Add(1),
+		Type:   eventType,
+		VMName: vmName,
+		Time:   time.Now().UTC(),
+		Data:   data,
+	}
+
+	b.historyLock.Lock()
+	if len(b.history) == historySize {
+		b.history = append(b.history[:0], b.history[1:]...)
+	}
+	b.history = append(b.history, event)
+	b.historyLock.Unlock()
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for sub := range b.subs {
+		sub.push(event)
+	}
+	return event
+}
+
+// Recent returns up to the last n events published for vmName, oldest first.
+// Only the bus's most recent events are searched.
+func (b *Bus) Recent(vmName string, n int) []Event {
+	b.historyLock.Lock()
+	defer b.historyLock.Unlock()
+
+	var recent []Event
+	for i := len(b.history) - 1; i >= 0 && len(recent) < n; i-- {
+		if b.history[i].VMName == vmName {
+			recent = append(recent, b.history[i])
+		}
+	}
+	slices.Reverse(recent)
+	return recent
+}
+
+// Replay returns up to the last n events published after the one with ID
+// afterID, for vmName or for all VMs if it's empty, oldest first. Only the
+// bus's most recent events are searched.
+func (b *Bus) Replay(vmName string, afterID uint64, n int) []Event {
+	b.historyLock.Lock()
+	defer b.historyLock.Unlock()
+
+	var replay []Event
+	for i := len(b.history) - 1; i >= 0 && len(replay) < n; i-- {
+		event := b.history[i]
+		if event.ID <= afterID {
+			break
+		}
+		if vmName == "" || event.VMName == vmName {
+			replay = append(replay, event)
+		}
+	}
+	slices.Reverse(replay)
+	return replay
+}
+
+// Subscribe registers a subscriber with room for bufferSize undelivered
+// events. The subscription is closed when ctx is done, so tying it to an
+// HTTP request's context unregisters it when the client disconnects.
+func (b *Bus) Subscribe(ctx context.Context, bufferSize int) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	sub := &Subscription{
+		bus:    b,
+		buf:    make([]Event, bufferSize),
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	b.lock.Lock()
+	b.subs[sub] = struct{}{}
+	b.lock.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Close()
+		case <-sub.done:
+		}
+	}()
+	return sub
+}
+
+// Subscribers returns the number of registered subscribers.
+func (b *Bus) Subscribers() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.subs)
+}
+
+// Subscription receives events from a Bus.
+type Subscription struct {
+	bus *Bus
+
+	lock    sync.Mutex
+	buf     []Event
+	head    int
+	size    int
+	dropped uint64
+
+	notify    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// push appends an event, overwriting the oldest one if the buffer is full.
+func (s *Subscription) push(event Event) {
+	s.lock.Lock()
+	if s.size == len(s.buf) {
+		s.head = (s.head + 1) % len(s.buf)
+		s.size--
+		s.dropped++
+	}
+	s.buf[(s.head+s.size)%len(s.buf)] = event
+	s.size++
+	s.lock.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscription) pop() (Event, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.size == 0 {
+		return Event{}, false
+	}
+	event := s.buf[s.head]
+	s.buf[s.head] = Event{}
+	s.head = (s.head + 1) % len(s.buf)
+	s.size--
+	return event, true
+}
+
+// Next returns the next buffered event, waiting until one is published, ctx
+// is done or the subscription is closed.
+func (s *Subscription) Next(ctx context.Context) (Event, error) {
+	for {
+		if event, ok := s.pop(); ok {
+			return event, nil
+		}
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return Event{}, ErrClosed
+		case <-ctx.Done():
+			return Event{}, ctx.Err()
+		}
+	}
+}
+
+// Dropped returns how many events were discarded because the subscriber fell
+// behind.
+func (s *Subscription) Dropped() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropped
+}
+
+// Close unregisters the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		s.bus.lock.Lock()
+		delete(s.bus.subs, s)
+		s.bus.lock.Unlock()
+		close(s.done)
+	})
+}
@@ -0,0 +1,167 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionDropsOldest(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(context.Background(), 3)
+	defer sub.Close()
+	for i := range 5 {
+		bus.Publish(TypeVMCreated, fmt.Sprintf("vm%d", i), nil)
+	}
+
+	for _, want := range []string{"vm2", "vm3", "vm4"} {
+		event, err := sub.Next(context.Background())
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if event.VMName != want {
+			t.Errorf("Next = %s, want %s", event.VMName, want)
+		}
+	}
+	if dropped := sub.Dropped(); dropped != 2 {
+		t.Errorf("Dropped = %d, want 2", dropped)
+	}
+}
+
+func TestPublishDoesNotWaitForSubscribers(t *testing.T) {
+	bus := NewBus()
+	// Never read from.
+	sub := bus.Subscribe(context.Background(), 1)
+	defer sub.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 10000 {
+			bus.Publish(TypeVMBooted, "vm1", nil)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Publish blocked on a subscriber that doesn't read")
+	}
+	if dropped := sub.Dropped(); dropped != 9999 {
+		t.Errorf("Dropped = %d, want 9999", dropped)
+	}
+}
+
+func TestConcurrentPublishAndSubscribe(t *testing.T) {
+	bus := NewBus()
+	const publishers, perPublisher = 4, 500
+
+	// A subscriber with room for everything sees every event once.
+	all := bus.Subscribe(context.Background(), publishers*perPublisher)
+	defer all.Close()
+
+	var wg sync.WaitGroup
+	for p := range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perPublisher {
+				bus.Publish(TypeVMExecStarted, fmt.Sprintf("vm%d", p), nil)
+			}
+		}()
+	}
+	// Subscribers coming and going while events are published.
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				sub := bus.Subscribe(ctx, 4)
+				sub.Next(ctx)
+				cancel()
+				sub.Close()
+			}
+		}()
+	}
+	// Readers of the history while it's written.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			bus.Recent("vm0", 10)
+			bus.Replay("", 0, 10)
+		}
+	}()
+	wg.Wait()
+
+	seen := make(map[uint64]bool)
+	for range publishers * perPublisher {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		event, err := all.Next(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Next after %d events: %v", len(seen), err)
+		}
+		if seen[event.ID] {
+			t.Fatalf("event %d delivered twice", event.ID)
+		}
+		seen[event.ID] = true
+	}
+	if all.Dropped() != 0 {
+		t.Errorf("Dropped = %d, want 0", all.Dropped())
+	}
+	if n := bus.Subscribers(); n != 1 {
+		t.Errorf("Subscribers = %d, want only the one still open", n)
+	}
+}
+
+func TestSubscriptionClosedWithContext(t *testing.T) {
+	bus := NewBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := bus.Subscribe(ctx, 0)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := sub.Next(context.Background())
+		errs <- err
+	}()
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("Next = %v, want ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Next didn't return once the subscription's context was done")
+	}
+	if n := bus.Subscribers(); n != 0 {
+		t.Errorf("Subscribers = %d after the context was done, want 0", n)
+	}
+	// Closing again is harmless.
+	sub.Close()
+}
+
+func TestRecentAndReplay(t *testing.T) {
+	bus := NewBus()
+	var ids []uint64
+	for _, vmName := range []string{"vm1", "vm2", "vm1", "vm1", "vm2"} {
+		ids = append(ids, bus.Publish(TypeVMBooted, vmName, nil).ID)
+	}
+
+	recent := bus.Recent("vm1", 2)
+	if len(recent) != 2 || recent[0].ID != ids[2] || recent[1].ID != ids[3] {
+		t.Errorf("Recent(vm1, 2) = %+v, want the last two of vm1, oldest first", recent)
+	}
+
+	replay := bus.Replay("", ids[2], 10)
+	if len(replay) != 2 || replay[0].ID != ids[3] || replay[1].ID != ids[4] {
+		t.Errorf("Replay after %d = %+v, want the two after it", ids[2], replay)
+	}
+	replay = bus.Replay("vm2", 0, 10)
+	if len(replay) != 2 || replay[0].ID != ids[1] || replay[1].ID != ids[4] {
+		t.Errorf("Replay(vm2) = %+v, want vm2's events", replay)
+	}
+}
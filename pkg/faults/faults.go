@@ -0,0 +1,274 @@
+package faults
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Interception points where faults can be injected.
+const (
+	PointStartVM  = "startVM"
+	PointExec     = "exec"
+	PointCallback = "callback"
+)
+
+// Fault actions.
+const (
+	ActionFail  = "fail"
+	ActionDelay = "delay"
+)
+
+const defaultCallbackHTTPStatus = http.StatusBadGateway
+
+// Rule describes a fault to inject at an interception point.
+type Rule struct {
+	ID     string
+	Point  string
+	VMName string // empty matches every VM
+	Action string
+
+	// Code is the gRPC status code returned by "fail" rules.
+	Code codes.Code
+	// HTTPStatus is returned to the guest by "fail" rules on callbacks.
+	HTTPStatus int
+	Message    string
+	Delay      time.Duration
+
+	// Remaining is the number of matches left before the rule expires; zero
+	// means unlimited.
+	Remaining int
+	// ExpiresAt is when the rule expires; the zero time means never.
+	ExpiresAt time.Time
+}
+
+func (r *Rule) expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && now.After(r.ExpiresAt)
+}
+
+// Error is returned by Apply when a "fail" rule matches.
+type Error struct {
+	RuleID     string
+	Code       codes.Code
+	HTTPStatus int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("injected fault %s: %s", e.RuleID, e.Message)
+}
+
+// GRPCStatus lets status.Code and status.FromError see the injected code.
+func (e *Error) GRPCStatus() *status.Status {
+	return status.New(e.Code, e.Error())
+}
+
+// ParseCode parses a gRPC code name such as "RESOURCES_EXHAUSTED".
+func ParseCode(name string) (codes.Code, error) {
+	var code codes.Code
+	if err := code.UnmarshalJSON([]byte(strconv.Quote(name))); err != nil {
+		return 0, err
+	}
+	return code, nil
+}
+
+// CodeName returns the name ParseCode accepts for code, e.g.
+// "RESOURCE_EXHAUSTED".
+func CodeName(code codes.Code) string {
+	if code == codes.Canceled {
+		return "CANCELLED"
+	}
+	var name strings.Builder
+	prev := ' '
+	for _, r := range code.String() {
+		if unicode.IsUpper(r) && unicode.IsLower(prev) {
+			name.WriteByte('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+		prev = r
+	}
+	return name.String()
+}
+
+// Injector holds fault rules and applies them at interception points. It is
+// inert unless enabled: Apply is a no-op and rules can't be added.
+type Injector struct {
+	enabled bool
+
+	lock   sync.Mutex
+	rules  []*Rule
+	nextID int
+}
+
+// NewInjector creates an Injector.
+func NewInjector(enabled bool) *Injector {
+	return &Injector{enabled: enabled}
+}
+
+// Enabled reports whether fault injection is enabled.
+func (i *Injector) Enabled() bool {
+	return i != nil && i.enabled
+}
+
+// Add validates and registers a rule, returning it with its ID assigned.
+func (i *Injector) Add(rule Rule) (Rule, error) {
+	if !i.Enabled() {
+		return Rule{}, fmt.Errorf("fault injection is disabled")
+	}
+
+	switch rule.Point {
+	case PointStartVM, PointExec, PointCallback:
+	default:
+		return Rule{}, fmt.Errorf("unknown interception point: %q", rule.Point)
+	}
+	switch rule.Action {
+	case ActionFail:
+		if rule.Code == codes.OK {
+			rule.Code = codes.Unavailable
+		}
+		if rule.HTTPStatus == 0 {
+			rule.HTTPStatus = defaultCallbackHTTPStatus
+		}
+		if rule.Message == "" {
+			rule.Message = fmt.Sprintf("%s failed", rule.Point)
+		}
+	case ActionDelay:
+		if rule.Delay <= 0 {
+			return Rule{}, fmt.Errorf("delay rules need a positive delay")
+		}
+	default:
+		return Rule{}, fmt.Errorf("unknown action: %q", rule.Action)
+	}
+	if rule.Remaining < 0 {
+		return Rule{}, fmt.Errorf("count must not be negative")
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.nextID++
+	rule.ID = fmt.Sprintf("fault-%d", i.nextID)
+	i.rules = append(i.rules, &rule)
+
+	log.WithFields(log.Fields{
+		"id":     rule.ID,
+		"point":  rule.Point,
+		"vmName": rule.VMName,
+		"action": rule.Action,
+	}).Warn("fault injection rule added")
+	return rule, nil
+}
+
+// List returns the rules that haven't expired.
+func (i *Injector) List() []Rule {
+	if !i.Enabled() {
+		return nil
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.pruneLocked(time.Now())
+	rules := make([]Rule, 0, len(i.rules))
+	for _, rule := range i.rules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+// Delete removes a rule, reporting whether it existed.
+func (i *Injector) Delete(id string) bool {
+	if !i.Enabled() {
+		return false
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	for idx, rule := range i.rules {
+		if rule.ID == id {
+			i.rules = append(i.rules[:idx], i.rules[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Injector) pruneLocked(now time.Time) {
+	rules := i.rules[:0]
+	for _, rule := range i.rules {
+		if !rule.expired(now) {
+			rules = append(rules, rule)
+		}
+	}
+	i.rules = rules
+}
+
+// match consumes one use of the first rule matching point and vmName.
+func (i *Injector) match(point string, vmName string) *Rule {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.pruneLocked(time.Now())
+	for idx, rule := range i.rules {
+		if rule.Point != point || (rule.VMName != "" && rule.VMName != vmName) {
+			continue
+		}
+		matched := *rule
+		if rule.Remaining > 0 {
+			rule.Remaining--
+			if rule.Remaining == 0 {
+				i.rules = append(i.rules[:idx], i.rules[idx+1:]...)
+			}
+		}
+		return &matched
+	}
+	return nil
+}
+
+// Apply injects the first matching fault for point and vmName. Delay rules
+// sleep and return nil; fail rules return an *Error.
+func (i *Injector) Apply(ctx context.Context, point string, vmName string) error {
+	if !i.Enabled() {
+		return nil
+	}
+
+	rule := i.match(point, vmName)
+	if rule == nil {
+		return nil
+	}
+
+	logger := log.WithFields(log.Fields{
+		"id":     rule.ID,
+		"point":  point,
+		"vmName": vmName,
+		"action": rule.Action,
+	})
+	logger.Warn("injecting fault")
+
+	switch rule.Action {
+	case ActionDelay:
+		select {
+		case <-time.After(rule.Delay):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	default:
+		return &Error{
+			RuleID:     rule.ID,
+			Code:       rule.Code,
+			HTTPStatus: rule.HTTPStatus,
+			Message:    rule.Message,
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package faults
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDisabledInjectorIsInert(t *testing.T) {
+	i := NewInjector(false)
+	if _, err := i.Add(Rule{Point: PointExec, Action: ActionFail}); err == nil {
+		t.Error("Add on a disabled injector succeeded")
+	}
+	if err := i.Apply(context.Background(), PointExec, "vm1"); err != nil {
+		t.Errorf("Apply on a disabled injector = %v, want nil", err)
+	}
+	var nilInjector *Injector
+	if err := nilInjector.Apply(context.Background(), PointExec, "vm1"); err != nil {
+		t.Errorf("Apply on a nil injector = %v, want nil", err)
+	}
+}
+
+func TestAddValidatesRules(t *testing.T) {
+	i := NewInjector(true)
+	for _, rule := range []Rule{
+		{Point: "reboot", Action: ActionFail},
+		{Point: PointExec, Action: "explode"},
+		{Point: PointExec, Action: ActionDelay},
+		{Point: PointExec, Action: ActionFail, Remaining: -1},
+	} {
+		if _, err := i.Add(rule); err == nil {
+			t.Errorf("Add(%+v) succeeded", rule)
+		}
+	}
+	if rules := i.List(); len(rules) != 0 {
+		t.Errorf("List = %+v after only invalid rules", rules)
+	}
+}
+
+func TestFailRule(t *testing.T) {
+	i := NewInjector(true)
+	rule, err := i.Add(Rule{Point: PointStartVM, Action: ActionFail, Code: codes.ResourceExhausted, Remaining: 2})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	for n := 0; n < 2; n++ {
+		err := i.Apply(context.Background(), PointStartVM, "vm1")
+		var fault *Error
+		if !errors.As(err, &fault) || fault.RuleID != rule.ID {
+			t.Fatalf("Apply #%d = %v, want the injected fault", n+1, err)
+		}
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("status code = %s, want ResourceExhausted", status.Code(err))
+		}
+	}
+	// The rule expired after its count.
+	if err := i.Apply(context.Background(), PointStartVM, "vm1"); err != nil {
+		t.Errorf("Apply after the count ran out = %v, want nil", err)
+	}
+	if rules := i.List(); len(rules) != 0 {
+		t.Errorf("List = %+v, want the rule gone", rules)
+	}
+}
+
+func TestFailRuleDefaults(t *testing.T) {
+	i := NewInjector(true)
+	if _, err := i.Add(Rule{Point: PointCallback, VMName: "vm2", Action: ActionFail}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	// Only vm2's callbacks fail.
+	if err := i.Apply(context.Background(), PointCallback, "vm1"); err != nil {
+		t.Errorf("Apply for another VM = %v, want nil", err)
+	}
+	if err := i.Apply(context.Background(), PointExec, "vm2"); err != nil {
+		t.Errorf("Apply at another point = %v, want nil", err)
+	}
+	err := i.Apply(context.Background(), PointCallback, "vm2")
+	var fault *Error
+	if !errors.As(err, &fault) {
+		t.Fatalf("Apply = %v, want the injected fault", err)
+	}
+	if fault.HTTPStatus != http.StatusBadGateway || fault.Code != codes.Unavailable {
+		t.Errorf("fault = HTTP %d, %s, want 502, Unavailable", fault.HTTPStatus, fault.Code)
+	}
+	// Without a count the rule keeps matching.
+	if err := i.Apply(context.Background(), PointCallback, "vm2"); !errors.As(err, &fault) {
+		t.Errorf("second Apply = %v, want the injected fault", err)
+	}
+}
+
+func TestDelayRule(t *testing.T) {
+	i := NewInjector(true)
+	if _, err := i.Add(Rule{Point: PointExec, VMName: "vm1", Action: ActionDelay, Delay: 50 * time.Millisecond}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	start := time.Now()
+	if err := i.Apply(context.Background(), PointExec, "vm1"); err != nil {
+		t.Errorf("Apply = %v, want nil", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Apply returned after %s, want it delayed by 50ms", elapsed)
+	}
+
+	// A canceled caller isn't held for the whole delay.
+	if _, err := i.Add(Rule{Point: PointExec, VMName: "vm2", Action: ActionDelay, Delay: time.Hour}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := i.Apply(ctx, PointExec, "vm2"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Apply with a deadline = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestRuleTTL(t *testing.T) {
+	i := NewInjector(true)
+	if _, err := i.Add(Rule{Point: PointExec, Action: ActionFail, ExpiresAt: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := i.Apply(context.Background(), PointExec, "vm1"); err != nil {
+		t.Errorf("Apply of an expired rule = %v, want nil", err)
+	}
+	if rules := i.List(); len(rules) != 0 {
+		t.Errorf("List = %+v, want the expired rule pruned", rules)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	i := NewInjector(true)
+	rule, err := i.Add(Rule{Point: PointExec, Action: ActionFail})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if !i.Delete(rule.ID) {
+		t.Fatal("Delete of an existing rule = false")
+	}
+	if i.Delete(rule.ID) {
+		t.Error("second Delete = true")
+	}
+	if err := i.Apply(context.Background(), PointExec, "vm1"); err != nil {
+		t.Errorf("Apply after Delete = %v, want nil", err)
+	}
+}
+
+func TestCodeNames(t *testing.T) {
+	for code := codes.OK; code <= codes.Unauthenticated; code++ {
+		parsed, err := ParseCode(CodeName(code))
+		if err != nil || parsed != code {
+			t.Errorf("ParseCode(CodeName(%s)) = %s, %v", code, parsed, err)
+		}
+	}
+	if CodeName(codes.ResourceExhausted) != "RESOURCE_EXHAUSTED" {
+		t.Errorf("CodeName(ResourceExhausted) = %s", CodeName(codes.ResourceExhausted))
+	}
+	if _, err := ParseCode("NOT_A_CODE"); err == nil {
+		t.Error("ParseCode of an unknown name succeeded")
+	}
+}
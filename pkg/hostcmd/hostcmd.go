@@ -0,0 +1,122 @@
+// Package hostcmd runs host binaries such as ip, iptables and sysctl and
+// reports their failures consistently.
+package hostcmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Runner runs host binaries. Tests replace it with SetRunner to exercise
+// networking and disk setup without touching the host.
+type Runner interface {
+	// Output runs name with args and returns its stdout. Failures are
+	// reported as an *Error.
+	Output(name string, args ...string) ([]byte, error)
+	// LookPath finds name like exec.LookPath.
+	LookPath(name string) (string, error)
+}
+
+var (
+	runnerLock sync.RWMutex
+	runner     Runner = execRunner{}
+)
+
+// SetRunner makes Output, Run and LookPath use r until the returned func is
+// called.
+func SetRunner(r Runner) (restore func()) {
+	runnerLock.Lock()
+	defer runnerLock.Unlock()
+	previous := runner
+	runner = r
+	return func() {
+		runnerLock.Lock()
+		defer runnerLock.Unlock()
+		runner = previous
+	}
+}
+
+func currentRunner() Runner {
+	runnerLock.RLock()
+	defer runnerLock.RUnlock()
+	return runner
+}
+
+// Error is a failed run of a host binary.
+type Error struct {
+	Name string
+	Args []string
+	// ExitCode is -1 if the binary didn't run or was killed by a signal.
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s %s", e.Name, strings.Join(e.Args, " "))
+	if errors.Is(e.Err, exec.ErrNotFound) {
+		return fmt.Sprintf("%s: %s is not installed", msg, e.Name)
+	}
+	if e.ExitCode >= 0 {
+		msg = fmt.Sprintf("%s: exit code %d", msg, e.ExitCode)
+	} else {
+		msg = fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+	if e.Stderr != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Stderr)
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Output runs name with args and returns its stdout.
+func Output(name string, args ...string) ([]byte, error) {
+	return currentRunner().Output(name, args...)
+}
+
+// Run runs name with args, discarding its stdout.
+func Run(name string, args ...string) error {
+	_, err := Output(name, args...)
+	return err
+}
+
+// LookPath finds name in the PATH.
+func LookPath(name string) (string, error) {
+	return currentRunner().LookPath(name)
+}
+
+// execRunner runs binaries on the host.
+type execRunner struct{}
+
+func (execRunner) Output(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		cmdErr := &Error{
+			Name:     name,
+			Args:     args,
+			ExitCode: -1,
+			Stderr:   strings.TrimSpace(stderr.String()),
+			Err:      err,
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			cmdErr.ExitCode = exitErr.ExitCode()
+		}
+		return output, cmdErr
+	}
+	return output, nil
+}
+
+func (execRunner) LookPath(name string) (string, error) {
+	return exec.LookPath(name)
+}
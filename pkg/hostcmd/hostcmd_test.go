@@ -0,0 +1,59 @@
+package hostcmd
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+type stubRunner struct {
+	ran []string
+}
+
+func (r *stubRunner) Output(name string, args ...string) ([]byte, error) {
+	r.ran = append(r.ran, name)
+	return []byte("stub"), nil
+}
+
+func (r *stubRunner) LookPath(name string) (string, error) {
+	return "/stub/" + name, nil
+}
+
+func TestSetRunner(t *testing.T) {
+	stub := &stubRunner{}
+	restore := SetRunner(stub)
+	output, err := Output("ip", "link")
+	if err != nil || string(output) != "stub" {
+		t.Errorf("Output = %q, %v; want the stub's output", output, err)
+	}
+	if err := Run("iptables"); err != nil {
+		t.Errorf("Run = %v", err)
+	}
+	if p, _ := LookPath("ip"); p != "/stub/ip" {
+		t.Errorf("LookPath = %q, want the stub's", p)
+	}
+	if len(stub.ran) != 2 {
+		t.Errorf("stub ran %v, want ip and iptables", stub.ran)
+	}
+
+	restore()
+	if _, ok := currentRunner().(execRunner); !ok {
+		t.Error("restore didn't put the host runner back")
+	}
+}
+
+func TestOutputError(t *testing.T) {
+	_, err := Output("sh", "-c", "echo oops >&2; exit 3")
+	var cmdErr *Error
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("Output = %v, want an *Error", err)
+	}
+	if cmdErr.ExitCode != 3 || cmdErr.Stderr != "oops" {
+		t.Errorf("Error = exit code %d, stderr %q; want 3 and oops", cmdErr.ExitCode, cmdErr.Stderr)
+	}
+
+	_, err = Output("cbox-no-such-binary")
+	if !errors.Is(err, exec.ErrNotFound) || !errors.As(err, &cmdErr) || cmdErr.ExitCode != -1 {
+		t.Errorf("Output of a missing binary = %v, want a not found *Error", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Package replay holds the format of exec recordings made by the server and
+// a fake cmdserver that plays them back, so client code that talks to
+// cmdserver can be tested deterministically against real guest exchanges.
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TransportHTTP is the transport of requests sent to cmdserver over the
+// bridge.
+const TransportHTTP = "http"
+
+// Recording is one exchange between the server and a guest's cmdserver.
+type Recording struct {
+	Seq        int       `json:"seq"`
+	VMName     string    `json:"vmName"`
+	RecordedAt time.Time `json:"recordedAt"`
+	Transport  string    `json:"transport"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	// Request is the JSON body sent to cmdserver.
+	Request json.RawMessage `json:"request,omitempty"`
+	// StatusCode and Response are unset if the request failed in transport,
+	// in which case Error is set. Bodies that aren't JSON, such as plain text
+	// errors, are kept in ResponseText instead of Response.
+	StatusCode   int             `json:"statusCode,omitempty"`
+	Response     json.RawMessage `json:"response,omitempty"`
+	ResponseText string          `json:"responseText,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	DurationMs   int64           `json:"durationMs"`
+	// Truncated is set if cmdserver truncated any command output.
+	Truncated bool `json:"truncated,omitempty"`
+	// Redacted is set if the redaction policy changed the request or
+	// response, in which case replay doesn't compare request bodies.
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// Load reads a recording from a file.
+func Load(path string) (*Recording, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec Recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("invalid recording %s: %w", path, err)
+	}
+	return &rec, nil
+}
+
+// LoadDir reads every recording in dir, ordered by Seq.
+func LoadDir(dir string) ([]*Recording, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var recs []*Recording
+	for _, path := range paths {
+		rec, err := Load(path)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Seq < recs[j].Seq })
+	return recs, nil
+}
+
+// Server is a fake cmdserver that answers requests with recordings, in
+// order. A request that doesn't match the next recording's method, path
+// and, unless it was redacted, body gets a 500 and is reported by Err.
+type Server struct {
+	*httptest.Server
+
+	lock sync.Mutex
+	recs []*Recording
+	next int
+	err  error
+}
+
+// NewServer starts a fake cmdserver replaying recs. Close it when done.
+func NewServer(recs ...*Recording) *Server {
+	s := &Server{recs: recs}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	if s.next >= len(s.recs) {
+		s.fail(w, fmt.Errorf("unexpected request %s %s after %d recordings", r.Method, r.URL.Path, len(s.recs)))
+		return
+	}
+	rec := s.recs[s.next]
+	s.next++
+	if r.Method != rec.Method || r.URL.Path != rec.Path {
+		s.fail(w, fmt.Errorf("recording %d: got %s %s, recorded %s %s", rec.Seq, r.Method, r.URL.Path, rec.Method, rec.Path))
+		return
+	}
+	if !rec.Redacted && !jsonEqual(body, rec.Request) {
+		s.fail(w, fmt.Errorf("recording %d: got request %s, recorded %s", rec.Seq, body, rec.Request))
+		return
+	}
+
+	if rec.Error != "" {
+		// Drop the connection so the client sees a transport error too.
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if rec.ResponseText != "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(rec.StatusCode)
+		io.WriteString(w, rec.ResponseText)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(rec.StatusCode)
+	w.Write(rec.Response)
+}
+
+// fail records the first mismatch. Must be called with lock held.
+func (s *Server) fail(w http.ResponseWriter, err error) {
+	if s.err == nil {
+		s.err = err
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// Err returns the first request that didn't match, or an error if some
+// recordings were never requested.
+func (s *Server) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.next < len(s.recs) {
+		return fmt.Errorf("%d of %d recordings were not replayed", len(s.recs)-s.next, len(s.recs))
+	}
+	return nil
+}
+
+func jsonEqual(a, b []byte) bool {
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(bytes.TrimSpace(a), bytes.TrimSpace(b))
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
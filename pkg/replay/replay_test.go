@@ -0,0 +1,107 @@
+package replay
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func post(t *testing.T, url string, body string) (int, string) {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestServerReplaysInOrder(t *testing.T) {
+	srv := NewServer(
+		&Recording{Seq: 1, Method: "POST", Path: "/exec", Request: json.RawMessage(`{"cmd": "ls"}`), StatusCode: 200, Response: json.RawMessage(`{"output":"a"}`)},
+		&Recording{Seq: 2, Method: "POST", Path: "/exec", Request: json.RawMessage(`{"cmd":"<redacted>"}`), Redacted: true, StatusCode: 500, ResponseText: "boom"},
+	)
+	defer srv.Close()
+
+	// Request bodies compare as JSON.
+	if code, body := post(t, srv.URL+"/exec", `{"cmd":"ls"}`); code != 200 || body != `{"output":"a"}` {
+		t.Errorf("first request = %d %s, want the first recording", code, body)
+	}
+	// Redacted requests match whatever was sent.
+	if code, body := post(t, srv.URL+"/exec", `{"cmd":"cat secret"}`); code != 500 || body != "boom" {
+		t.Errorf("second request = %d %s, want the second recording", code, body)
+	}
+	if err := srv.Err(); err != nil {
+		t.Errorf("Err = %v, want nil", err)
+	}
+}
+
+func TestServerReportsMismatches(t *testing.T) {
+	recs := []*Recording{
+		{Seq: 1, Method: "POST", Path: "/exec", Request: json.RawMessage(`{"cmd":"ls"}`), StatusCode: 200, Response: json.RawMessage(`{}`)},
+		{Seq: 2, Method: "POST", Path: "/exec", Request: json.RawMessage(`{"cmd":"ls"}`), StatusCode: 200, Response: json.RawMessage(`{}`)},
+	}
+
+	srv := NewServer(recs...)
+	defer srv.Close()
+	if code, _ := post(t, srv.URL+"/exec", `{"cmd":"pwd"}`); code != http.StatusInternalServerError {
+		t.Errorf("mismatched request = %d, want 500", code)
+	}
+	if err := srv.Err(); err == nil || !strings.Contains(err.Error(), "recording 1") {
+		t.Errorf("Err = %v, want the mismatch on recording 1", err)
+	}
+
+	unused := NewServer(recs...)
+	defer unused.Close()
+	post(t, unused.URL+"/exec", `{"cmd":"ls"}`)
+	if err := unused.Err(); err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Errorf("Err = %v, want the recording never replayed", err)
+	}
+
+	extra := NewServer()
+	defer extra.Close()
+	if code, _ := post(t, extra.URL+"/exec", `{}`); code != http.StatusInternalServerError {
+		t.Errorf("request past the last recording = %d, want 500", code)
+	}
+	if extra.Err() == nil {
+		t.Error("Err = nil after a request past the last recording")
+	}
+}
+
+func TestServerReplaysTransportErrors(t *testing.T) {
+	srv := NewServer(&Recording{Seq: 1, Method: "POST", Path: "/exec", Request: json.RawMessage(`{}`), Error: "connection reset"})
+	defer srv.Close()
+	if resp, err := http.Post(srv.URL+"/exec", "application/json", strings.NewReader(`{}`)); err == nil {
+		resp.Body.Close()
+		t.Errorf("request replaying a transport error = %d, want it failed", resp.StatusCode)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, seq := range map[string]int{"000010.json": 10, "000002.json": 2} {
+		data, _ := json.Marshal(&Recording{Seq: seq, Method: "POST", Path: "/exec"})
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recs, err := LoadDir(dir)
+	if err != nil {
+		t.Fatalf("LoadDir: %v", err)
+	}
+	if len(recs) != 2 || recs[0].Seq != 2 || recs[1].Seq != 10 {
+		t.Errorf("LoadDir = %+v, want both recordings by Seq", recs)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "000011.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDir(dir); err == nil {
+		t.Error("LoadDir with an invalid recording succeeded")
+	}
+}
@@ -0,0 +1,86 @@
+// Package requestid carries the ID of a REST request through the calls it
+// makes, so its log entries, guest exec requests and callbacks can be
+// correlated.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Header carries the request ID on REST responses and on the requests
+	// made to the guest and to callback receivers. An incoming one is
+	// honored if Valid.
+	Header = "X-Request-ID"
+	// Field is the log field the ID is added as.
+	Field = "requestId"
+
+	maxLength = 128
+)
+
+type contextKey struct{}
+
+// New returns a random request ID.
+func New() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Valid reports whether id can be used as a request ID: up to 128 letters,
+// digits, '-', '_', '.' and ':', so it can't forge log lines or headers.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID ctx carries, or "".
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// SetHeader forwards the request ID of req's context, if any, in Header.
+func SetHeader(req *http.Request) {
+	if id := FromContext(req.Context()); id != "" {
+		req.Header.Set(Header, id)
+	}
+}
+
+// Hook adds the request ID of a log entry's context as Field, for entries
+// made with log.WithContext.
+type Hook struct{}
+
+func (Hook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (Hook) Fire(entry *log.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	if id := FromContext(entry.Context); id != "" {
+		entry.Data[Field] = id
+	}
+	return nil
+}
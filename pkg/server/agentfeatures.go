@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Features agents list in their version report. The host checks for them
+// before using the matching part of the protocol.
+const (
+	featureExec          = "exec"
+	featureExecBatch     = "exec-batch"
+	featureExecTimeout   = "exec-timeout"
+	featureExecJobs      = "exec-jobs"
+	featureExecStream    = "exec-stream"
+	featureExecEnv       = "exec-env"
+	featureExecUser      = "exec-user"
+	featureExecBase64    = "exec-base64"
+	featureShell         = "shell"
+	featureWorkspaces    = "workspaces"
+	featureFiles         = "files"
+	featureFileUpload    = "file-upload"
+	featureFileArchive   = "file-archive"
+	featureCallback      = "callback"
+	featureCallbackStats = "callback-stats"
+	featurePublish       = "publish"
+	featureAgentUpdate   = "agent-update"
+	featureVMName        = "vm-name"
+	featureFrames        = "frames"
+	featureMetadata      = "metadata"
+)
+
+var (
+	// preVersionAgentFeatures are assumed for agents that don't answer
+	// VERSION at all, which only served exec and callbacks.
+	preVersionAgentFeatures = map[string][]string{
+		agentCmdServer:   {featureExec},
+		agentVsockServer: {featureCallback},
+	}
+	// protocol1AgentFeatures are assumed for agents that answer VERSION
+	// without a feature list, which came before features were reported.
+	protocol1AgentFeatures = map[string][]string{
+		agentCmdServer:   {featureExec, featureExecBatch, featureWorkspaces},
+		agentVsockServer: {featureCallback, featureCallbackStats, featurePublish, featureAgentUpdate},
+	}
+)
+
+// errAgentPredatesVersion is returned by queryAgentVersion for agents that
+// answered but didn't understand the version request.
+var errAgentPredatesVersion = errors.New("agent predates VERSION")
+
+// UnsupportedAgentError is returned for requests a VM's agent can't serve,
+// either because its protocol is outside the host's supported range or
+// because it lacks the feature the request needs.
+type UnsupportedAgentError struct {
+	VMName  string
+	Agent   string
+	Version string
+	// Feature is the missing feature. Empty if the protocol is unsupported.
+	Feature string
+	Reason  string
+}
+
+func (e *UnsupportedAgentError) Error() string {
+	return fmt.Sprintf("vm %s: unsupported agent: %s", e.VMName, e.Reason)
+}
+
+func (e *UnsupportedAgentError) GRPCStatus() *status.Status {
+	return status.New(codes.FailedPrecondition, e.Error())
+}
+
+// features returns the agent's features, as reported or as assumed from
+// its protocol.
+func (v agentVersion) features() []string {
+	switch {
+	case v.legacy:
+		return preVersionAgentFeatures[v.Agent]
+	case v.Features == nil:
+		return protocol1AgentFeatures[v.Agent]
+	default:
+		return v.Features
+	}
+}
+
+// agentVersionFor returns the recorded version of one of vm's agents,
+// asking the agent for it on first contact. ok is false if the agent
+// couldn't be reached.
+func (v *vm) agentVersionFor(ctx context.Context, agent string) (version agentVersion, ok bool) {
+	v.lock.RLock()
+	version, ok = v.agents[agent]
+	v.lock.RUnlock()
+	if ok {
+		return version, true
+	}
+
+	queried, err := v.queryAgentVersion(ctx, agent)
+	if errors.Is(err, errAgentPredatesVersion) {
+		queried = &agentVersion{Agent: agent, legacy: true}
+	} else if err != nil {
+		log.WithField("vmName", v.name).WithError(err).Debugf("failed to get %s version", agent)
+		return agentVersion{}, false
+	}
+	v.setAgentVersion(*queried)
+	return *queried, true
+}
+
+// agentFeature reports whether one of vm's agents supports feature. It
+// fails with an UnsupportedAgentError if the agent's protocol is outside the
+// host's range. An agent that can't be reached is taken to support the
+// feature, so the request goes ahead and fails on its own.
+func (v *vm) agentFeature(ctx context.Context, agent string, feature string) (bool, error) {
+	version, ok := v.agentVersionFor(ctx, agent)
+	if !ok {
+		return true, nil
+	}
+	if err := version.checkCompatible(); err != nil {
+		return false, &UnsupportedAgentError{
+			VMName:  v.name,
+			Agent:   agent,
+			Version: version.Version,
+			Reason:  err.Error(),
+		}
+	}
+	return slices.Contains(version.features(), feature), nil
+}
+
+// knownAgentFeature reports whether one of vm's agents is known to support
+// feature, without asking an agent whose version isn't recorded yet.
+func (v *vm) knownAgentFeature(agent string, feature string) bool {
+	v.lock.RLock()
+	version, ok := v.agents[agent]
+	v.lock.RUnlock()
+	return ok && version.checkCompatible() == nil && slices.Contains(version.features(), feature)
+}
+
+// requireAgentFeature is agentFeature, failing with an
+// UnsupportedAgentError if the feature is missing.
+func (v *vm) requireAgentFeature(ctx context.Context, agent string, feature string) error {
+	supported, err := v.agentFeature(ctx, agent, feature)
+	if err != nil || supported {
+		return err
+	}
+	version, _ := v.agentVersionFor(ctx, agent)
+	name := agent
+	if version.Version != "" {
+		name = fmt.Sprintf("%s %s", agent, version.Version)
+	}
+	return &UnsupportedAgentError{
+		VMName:  v.name,
+		Agent:   agent,
+		Version: version.Version,
+		Feature: feature,
+		Reason:  fmt.Sprintf("%s doesn't support %s, update the VM's image", name, feature),
+	}
+}
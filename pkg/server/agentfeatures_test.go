@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+)
+
+// useGuestAgent makes vm1's cmdserver report version, or predate /version
+// if version is nil, and forgets what it reported before.
+func useGuestAgent(h *testHarness, version *agentVersion) *vm {
+	vm := h.server.getVMAtomic("vm1")
+	guest := guestFor(vm.ip.IP.String())
+	guest.lock.Lock()
+	guest.version = version
+	guest.noVersion = version == nil
+	guest.lock.Unlock()
+	vm.lock.Lock()
+	delete(vm.agents, agentCmdServer)
+	vm.lock.Unlock()
+	return vm
+}
+
+// cmdServerAgent returns how ListVM reports vm1's cmdserver.
+func cmdServerAgent(t *testing.T, h *testHarness) serverapi.AgentVersion {
+	t.Helper()
+	resp, err := h.server.ListVM(context.Background(), "vm1")
+	if err != nil {
+		t.Fatalf("ListVM: %v", err)
+	}
+	for _, agent := range resp.Agents {
+		if agent.GetAgent() == agentCmdServer {
+			return agent
+		}
+	}
+	t.Fatalf("ListVM agents = %+v, want cmdserver", resp.Agents)
+	return serverapi.AgentVersion{}
+}
+
+func TestOlderAgents(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		version *agentVersion
+		legacy  bool
+	}{
+		{name: "predates version", legacy: true},
+		{name: "predates features", version: &agentVersion{Agent: agentCmdServer, Version: "0.9", Protocol: 1, MinHostProtocol: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t, nil)
+			h.startVM("vm1")
+			useGuestAgent(h, tc.version)
+
+			// Plain exec works with every agent.
+			if _, err := h.server.VMExec(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "true"}); err != nil {
+				t.Errorf("VMExec: %v", err)
+			}
+			agent := cmdServerAgent(t, h)
+			if agent.GetLegacy() != tc.legacy || !agent.GetCompatible() {
+				t.Errorf("ListVM cmdserver = %+v, want compatible with legacy %t", agent, tc.legacy)
+			}
+			// Batches fall back to one exec per command.
+			resp, err := h.server.VMExecBatch(context.Background(), "vm1", &serverapi.VmExecBatchRequest{Cmds: []string{"a", "b"}})
+			if err != nil || len(resp.Results) != 2 {
+				t.Errorf("VMExecBatch = %+v, %v, want both commands run", resp, err)
+			}
+
+			// Newer features are refused with the one missing named.
+			var unsupported *UnsupportedAgentError
+			_, err = h.server.VMExec(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "true", Env: &map[string]string{"A": "1"}})
+			if !errors.As(err, &unsupported) || unsupported.Feature != featureExecEnv {
+				t.Errorf("VMExec with env = %v, want exec-env unsupported", err)
+			}
+			_, err = h.server.VMGetFile(context.Background(), "vm1", "out.txt", false, http.Header{})
+			if !errors.As(err, &unsupported) || unsupported.Feature != featureFiles {
+				t.Errorf("VMGetFile = %v, want files unsupported", err)
+			}
+			if status.Code(err) != codes.FailedPrecondition {
+				t.Errorf("status code = %s, want FailedPrecondition", status.Code(err))
+			}
+		})
+	}
+}
+
+func TestIncompatibleAgents(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		version *agentVersion
+	}{
+		{"too old", &agentVersion{Agent: agentCmdServer, Version: "0.1", Protocol: minAgentProtocolVersion - 1, Features: []string{featureExec}}},
+		{"too new", &agentVersion{Agent: agentCmdServer, Version: "9.0", Protocol: agentProtocolVersion + 1, MinHostProtocol: agentProtocolVersion + 1, Features: []string{featureExec}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t, nil)
+			h.startVM("vm1")
+			useGuestAgent(h, tc.version)
+
+			var unsupported *UnsupportedAgentError
+			_, err := h.server.VMExec(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "true"})
+			if !errors.As(err, &unsupported) || unsupported.Feature != "" || unsupported.Version != tc.version.Version {
+				t.Fatalf("VMExec = %v, want the agent's protocol unsupported", err)
+			}
+			if agent := cmdServerAgent(t, h); agent.GetCompatible() {
+				t.Errorf("ListVM cmdserver = %+v, want it incompatible", agent)
+			}
+		})
+	}
+}
+
+func TestNewerAgentFeatures(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	// A newer agent with features this host doesn't know is still served.
+	vm := useGuestAgent(h, &agentVersion{
+		Agent:           agentCmdServer,
+		Version:         "2.0",
+		Protocol:        agentProtocolVersion + 1,
+		MinHostProtocol: agentProtocolVersion,
+		Features:        []string{featureExec, featureExecEnv, "teleport"},
+	})
+
+	if _, err := h.server.VMExec(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "true", Env: &map[string]string{"A": "1"}}); err != nil {
+		t.Errorf("VMExec with env: %v", err)
+	}
+	if !vm.knownAgentFeature(agentCmdServer, featureExecEnv) || vm.knownAgentFeature(agentCmdServer, featureFiles) {
+		t.Error("recorded features don't match the agent's report")
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+const (
+	maxAgentRecoveries       = 3
+	agentRestartReadyTimeout = 30 * time.Second
+	agentLivenessTimeout     = 5 * time.Second
+)
+
+// agentRecovery records recent cmdserver restarts of a VM. lock is held for
+// the whole recovery so concurrent execs wait for one restart instead of
+// each triggering their own.
+type agentRecovery struct {
+	lock      sync.Mutex
+	restarts  []time.Time
+	unhealthy bool
+}
+
+// cmdServerReachable reports whether the VM's cmdserver accepts requests.
+func cmdServerReachable(ctx context.Context, vmIP string) bool {
+	ctx, cancel := context.WithTimeout(ctx, agentLivenessTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+cmdServerAddr(vmIP)+"/", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// recoverCmdServer restarts cmdserver in vm through vsockserver and waits for
+// it to come back. It gives up without restarting unless the guest's
+// heartbeats show it's alive, or if cmdserver was already restarted maxAgentRecoveries
+// times within the recovery window, in which case vm.agent_unhealthy is
+// published once.
+func (s *Server) recoverCmdServer(ctx context.Context, vm *vm) error {
+	logger := log.WithField("vmName", vm.name)
+	recovery := &vm.agentRecovery
+	recovery.lock.Lock()
+	defer recovery.lock.Unlock()
+
+	// Another exec may have restarted it while we waited for the lock.
+	if cmdServerReachable(ctx, vm.ip.IP.String()) {
+		return nil
+	}
+
+	window := s.config.AgentRecoveryWindow
+	recent := recovery.restarts[:0]
+	for _, t := range recovery.restarts {
+		if time.Since(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	recovery.restarts = recent
+	if len(recovery.restarts) >= maxAgentRecoveries {
+		if !recovery.unhealthy {
+			recovery.unhealthy = true
+			logger.Errorf("cmdserver restarted %d times within %s, not restarting again", len(recovery.restarts), window)
+			s.events.Publish(events.TypeVMAgentUnhealthy, vm.name, map[string]any{
+				"restarts": len(recovery.restarts),
+				"window":   window.String(),
+			})
+		}
+		return fmt.Errorf("cmdserver restarted %d times within %s", len(recovery.restarts), window)
+	}
+	recovery.unhealthy = false
+
+	// Heartbeats are sent by vsockserver, so a healthy guest has the agent
+	// the restart goes through running, and only cmdserver is down.
+	if health := vm.health(); health != healthHealthy {
+		return fmt.Errorf("guest heartbeat health is %s, not restarting cmdserver", health)
+	}
+
+	command := s.config.AgentRestartCommand
+	logger.Warn("cmdserver refused connection, restarting it")
+	recovery.restarts = append(recovery.restarts, time.Now())
+	if _, err := vm.vsockCommand(ctx, command); err != nil {
+		return fmt.Errorf("failed to restart cmdserver: %w", err)
+	}
+
+	readyCtx, cancel := context.WithTimeout(ctx, agentRestartReadyTimeout)
+	defer cancel()
+	if err := waitForCmdServerReady(readyCtx, vm.ip.IP.String(), vm.readyTimeout); err != nil {
+		return fmt.Errorf("cmdserver not ready after restart: %w", err)
+	}
+
+	logger.Info("cmdserver restarted")
+	s.events.Publish(events.TypeVMAgentRecovered, vm.name, map[string]any{
+		"restarts": len(recovery.restarts),
+	})
+	return nil
+}
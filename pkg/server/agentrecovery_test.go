@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+func TestExecRecoversCmdServer(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// heartbeatAge is how long ago the guest sent a heartbeat, if
+		// heartbeat is set.
+		heartbeat    bool
+		heartbeatAge time.Duration
+		wantRecover  bool
+	}{
+		{name: "healthy", heartbeat: true, wantRecover: true},
+		{name: "no heartbeats"},
+		{name: "unresponsive", heartbeat: true, heartbeatAge: time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t, func(cfg *config.ServerConfig) { cfg.AgentRestartCommand = "restart-cmdserver" })
+			sub := h.server.Events().Subscribe(context.Background(), 0)
+			defer sub.Close()
+			h.startVM("vm1")
+			vm := h.server.getVMAtomic("vm1")
+			guest := guestFor(vm.ip.IP.String())
+
+			// vsockserver restarts cmdserver when told to.
+			var restarts atomic.Int32
+			serveGuestVsock(t, vm.vsockPath, func(port uint32, conn net.Conn) {
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == "restart-cmdserver\n" {
+						restarts.Add(1)
+						if err := guest.start(); err != nil {
+							fmt.Fprintf(conn, "ERROR: %v\n", err)
+							continue
+						}
+					}
+					fmt.Fprintln(conn, "OK")
+				}
+			})
+			if tc.heartbeat {
+				if _, err := h.server.recordHeartbeat("vm1", json.RawMessage(`{"intervalSeconds": 1}`)); err != nil {
+					t.Fatal(err)
+				}
+				vm.lock.Lock()
+				vm.lastHeartbeat = time.Now().Add(-tc.heartbeatAge)
+				vm.lock.Unlock()
+			}
+
+			guest.stop()
+			resp, err := h.server.VMExec(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "echo hi"})
+			if !tc.wantRecover {
+				if err == nil {
+					t.Error("VMExec succeeded with cmdserver down")
+				}
+				if restarts.Load() != 0 {
+					t.Errorf("cmdserver restarted %d times without a healthy heartbeat", restarts.Load())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("VMExec: %v", err)
+			}
+			if want := vm.ip.IP.String() + " ran echo hi"; resp.GetOutput() != want {
+				t.Errorf("VMExec output = %q, want %q", resp.GetOutput(), want)
+			}
+			if restarts.Load() != 1 {
+				t.Errorf("cmdserver restarted %d times, want 1", restarts.Load())
+			}
+			waitForEvent(t, sub, events.TypeVMAgentRecovered, "vm1")
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+const (
+	// agentProtocolVersion is the version of the host<->agent protocol the
+	// server speaks, and minAgentProtocolVersion the oldest it still works
+	// with. The agents advertise the same pair from their side.
+	agentProtocolVersion    = 1
+	minAgentProtocolVersion = 1
+
+	opAgentUpdate = "agent-update"
+	// MaxAgentBinaryBytes bounds an uploaded agent binary.
+	MaxAgentBinaryBytes = 256 * 1024 * 1024
+	// agentUpdateVerifyTimeout is how long an updated agent has to report its
+	// new version before it's rolled back. The guest rolls back by itself
+	// after 60s if the host can't reach it to do so.
+	agentUpdateVerifyTimeout = 30 * time.Second
+	agentVersionPollInterval = time.Second
+	agentUploadTimeout       = 2 * time.Minute
+
+	agentCmdServer   = "cmdserver"
+	agentVsockServer = "vsockserver"
+)
+
+// agentVersion is how an agent reports itself, over vsock for vsockserver
+// and at /version for cmdserver.
+type agentVersion struct {
+	Agent           string `json:"agent"`
+	Version         string `json:"version"`
+	Protocol        int    `json:"protocol"`
+	MinHostProtocol int    `json:"minHostProtocol"`
+	// Features is nil for agents that came before features were reported.
+	Features []string `json:"features,omitempty"`
+	// legacy is set for agents that predate VERSION. They're still served,
+	// within preVersionAgentFeatures.
+	legacy bool
+}
+
+// compatible reports whether the agent's protocol range overlaps the host's,
+// so an old host detects a too-new agent and vice versa.
+func (v agentVersion) compatible() bool {
+	return v.checkCompatible() == nil
+}
+
+func (v agentVersion) checkCompatible() error {
+	if v.legacy {
+		return nil
+	}
+	if v.Protocol < minAgentProtocolVersion {
+		return fmt.Errorf("%s %s speaks protocol %d, the host needs at least %d", v.Agent, v.Version, v.Protocol, minAgentProtocolVersion)
+	}
+	if v.MinHostProtocol > agentProtocolVersion {
+		return fmt.Errorf("%s %s needs host protocol %d, the host speaks %d", v.Agent, v.Version, v.MinHostProtocol, agentProtocolVersion)
+	}
+	return nil
+}
+
+// queryAgentVersion asks one of vm's agents for its version.
+func (v *vm) queryAgentVersion(ctx context.Context, agent string) (*agentVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, agentLivenessTimeout)
+	defer cancel()
+
+	var out []byte
+	switch agent {
+	case agentVsockServer:
+		resp, err := v.vsockCommand(ctx, "VERSION")
+		if err != nil {
+			// Older vsockservers ran VERSION as a shell command.
+			if strings.HasPrefix(err.Error(), vsockErrorPrefix) {
+				return nil, errAgentPredatesVersion
+			}
+			return nil, err
+		}
+		out = []byte(resp)
+	case agentCmdServer:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+cmdServerAddr(v.ip.IP.String())+"/version", nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+			return nil, errAgentPredatesVersion
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		if out, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown agent: %s", agent)
+	}
+
+	var version agentVersion
+	if err := json.Unmarshal(out, &version); err != nil {
+		if agent == agentVsockServer {
+			// Older vsockservers ran VERSION as a shell command.
+			return nil, errAgentPredatesVersion
+		}
+		return nil, fmt.Errorf("invalid version response from %s: %w", agent, err)
+	}
+	return &version, nil
+}
+
+// setAgentVersion records an agent's version for ListVM.
+func (v *vm) setAgentVersion(version agentVersion) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.agents == nil {
+		v.agents = make(map[string]agentVersion)
+	}
+	v.agents[version.Agent] = version
+}
+
+// agentVersions returns the recorded agent versions sorted by agent.
+func (v *vm) agentVersions() []serverapi.AgentVersion {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	var versions []serverapi.AgentVersion
+	for _, version := range v.agents {
+		versions = append(versions, serverapi.AgentVersion{
+			Agent:      serverapi.PtrString(version.Agent),
+			Version:    serverapi.PtrString(version.Version),
+			Protocol:   serverapi.PtrInt32(int32(version.Protocol)),
+			Compatible: serverapi.PtrBool(version.compatible()),
+			Features:   slices.Clone(version.features()),
+			Legacy:     serverapi.PtrBool(version.legacy),
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].GetAgent() < versions[j].GetAgent()
+	})
+	return versions
+}
+
+// refreshAgentVersions records the versions and features of vm's agents.
+// Agents that predate VERSION are recorded as legacy; agents that can't be
+// reached are left out until first used.
+func (v *vm) refreshAgentVersions(ctx context.Context) {
+	logger := log.WithField("vmName", v.name)
+	for _, agent := range []string{agentCmdServer, agentVsockServer} {
+		version, err := v.queryAgentVersion(ctx, agent)
+		if errors.Is(err, errAgentPredatesVersion) {
+			logger.Warnf("%s predates VERSION, limiting it to %v", agent, preVersionAgentFeatures[agent])
+			version, err = &agentVersion{Agent: agent, legacy: true}, nil
+		}
+		if err != nil {
+			logger.WithError(err).Debugf("failed to get %s version", agent)
+			continue
+		}
+		if err := version.checkCompatible(); err != nil {
+			logger.Warn(err)
+		}
+		v.setAgentVersion(*version)
+	}
+}
+
+// UpdateAgent replaces one of a running VM's agents with binary, which must
+// report wantVersion once restarted. The binary is spooled to the VM's state
+// dir to be checksummed, then streamed to vsockserver, which swaps it in and
+// restarts the agent. If the new agent doesn't report wantVersion with a
+// compatible protocol within agentUpdateVerifyTimeout, the previous binary is
+// restored. Dev-mode only: disabled unless enable_agent_update is set.
+func (s *Server) UpdateAgent(ctx context.Context, vmName string, agent string, wantVersion string, binary io.Reader) (*serverapi.AgentUpdateResponse, error) {
+	if !s.config.EnableAgentUpdate {
+		return nil, status.Error(codes.PermissionDenied, "agent updates are disabled, set enable_agent_update to allow them")
+	}
+	if agent != agentCmdServer && agent != agentVsockServer {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unknown agent %q, must be %s or %s", agent, agentCmdServer, agentVsockServer))
+	}
+	if wantVersion == "" || strings.ContainsAny(wantVersion, " \n") {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid version: %q", wantVersion))
+	}
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	logger := log.WithFields(log.Fields{"vmName": vmName, "agent": agent})
+	if err := vm.requireAgentFeature(ctx, agentVsockServer, featureAgentUpdate); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(vm.stateDirPath, ".agent-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create agent binary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(binary, MaxAgentBinaryBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent binary: %w", err)
+	}
+	if size == 0 || size > MaxAgentBinaryBytes {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("agent binary must be between 1 and %d bytes", MaxAgentBinaryBytes))
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind agent binary: %w", err)
+	}
+
+	// Guest traffic would fail while the agent restarts, so queue it instead.
+	release, err := vm.gate.acquireExclusive(ctx, vmName, opAgentUpdate, agentUpdateVerifyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var previous string
+	if old, err := vm.queryAgentVersion(ctx, agent); err == nil {
+		previous = old.Version
+	}
+
+	logger.WithField("version", wantVersion).Info("updating agent")
+	if err := vm.uploadAgent(ctx, agent, tmp, size, hex.EncodeToString(hash.Sum(nil))); err != nil {
+		return nil, fmt.Errorf("failed to update %s: %w", agent, err)
+	}
+
+	version, verifyErr := vm.waitForAgentVersion(ctx, agent, wantVersion)
+	if verifyErr != nil {
+		logger.WithError(verifyErr).Warn("updated agent failed verification, rolling back")
+		if _, err := vm.vsockCommand(ctx, "AGENT_ROLLBACK "+agent); err != nil {
+			// The guest's watchdog restores the binary by itself.
+			logger.WithError(err).Warn("failed to roll back agent, leaving it to the guest")
+		} else if old, err := vm.waitForAgentVersion(ctx, agent, previous); err == nil {
+			vm.setAgentVersion(*old)
+		}
+		return nil, status.Error(codes.Aborted, fmt.Sprintf("%s rolled back: %v", agent, verifyErr))
+	}
+	if _, err := vm.vsockCommand(ctx, "AGENT_COMMIT "+agent); err != nil {
+		return nil, fmt.Errorf("failed to commit %s update: %w", agent, err)
+	}
+	vm.setAgentVersion(*version)
+
+	logger.WithFields(log.Fields{
+		"previousVersion": previous,
+		"version":         version.Version,
+	}).Info("agent updated")
+	s.events.Publish(events.TypeVMAgentUpdated, vmName, map[string]any{
+		"agent":           agent,
+		"previousVersion": previous,
+		"version":         version.Version,
+	})
+	return &serverapi.AgentUpdateResponse{
+		Agent:           serverapi.PtrString(agent),
+		PreviousVersion: serverapi.PtrString(previous),
+		Version:         serverapi.PtrString(version.Version),
+	}, nil
+}
+
+// uploadAgent streams an agent binary to vsockserver with
+// "AGENT_UPDATE <agent> <sizeBytes> <sha256>" followed by the binary.
+func (v *vm) uploadAgent(ctx context.Context, agent string, binary io.Reader, size int64, digest string) error {
+	ctx, cancel := context.WithTimeout(ctx, agentUploadTimeout)
+	defer cancel()
+
+	conn, err := dialGuestVsock(ctx, v.vsockPath, vsockServerPort)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "AGENT_UPDATE %s %d %s\n", agent, size, digest); err != nil {
+		return fmt.Errorf("failed to write vsock command: %w", err)
+	}
+	if _, err := io.CopyN(conn, binary, size); err != nil {
+		return fmt.Errorf("failed to send binary: %w", err)
+	}
+
+	resp, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read vsock response: %w", err)
+	}
+	resp = strings.TrimSuffix(resp, "\n")
+	if strings.HasPrefix(resp, vsockErrorPrefix) {
+		return fmt.Errorf("%s", resp)
+	}
+	return nil
+}
+
+// waitForAgentVersion polls agent until it reports want with a compatible
+// protocol. An empty want accepts any version.
+func (v *vm) waitForAgentVersion(ctx context.Context, agent string, want string) (*agentVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, agentUpdateVerifyTimeout)
+	defer cancel()
+
+	lastErr := fmt.Errorf("%s did not come back", agent)
+	for {
+		version, err := v.queryAgentVersion(ctx, agent)
+		switch {
+		case err != nil:
+			lastErr = fmt.Errorf("%s not reachable: %w", agent, err)
+		case want != "" && version.Version != want:
+			lastErr = fmt.Errorf("%s reports version %s, expected %s", agent, version.Version, want)
+		default:
+			if err := version.checkCompatible(); err != nil {
+				return nil, err
+			}
+			return version, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, lastErr
+		case <-time.After(agentVersionPollInterval):
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+)
+
+const (
+	archiveDirName         = "_archive"
+	archiveTimestampFormat = "20060102T150405Z"
+	maxArchivePruneDelay   = 5 * time.Minute
+	vmLogFilename          = "log"
+)
+
+// archivedVM describes a destroyed VM's state dir kept in the archive.
+type archivedVM struct {
+	name       string
+	vmName     string
+	archivedAt time.Time
+	sizeBytes  int64
+}
+
+func (s *Server) archiveDir() string {
+	return path.Join(s.config.StateDir, archiveDirName)
+}
+
+// disposeStateDir deletes a destroyed VM's state dir, or moves it into the
+// archive when retain_destroyed_artifacts is set. The stateful disk and rootfs
+// overlay are always deleted since they dwarf everything else in the dir,
+// unless the VM preserves its stateful disk, and so are the data disks cbox
+// created.
+func (s *Server) disposeStateDir(v *vm) {
+	logger := log.WithField("vmName", v.name)
+	removeDataDisks(v.dataDisks)
+	if v.preserveStatefulDisk {
+		if err := s.preserveStatefulDisk(v); err != nil {
+			logger.WithError(err).Errorf("leaving state dir in place: %s", v.stateDirPath)
+			return
+		}
+	}
+
+	if v.stateDirLink != "" {
+		if err := os.Remove(v.stateDirLink); err != nil && !os.IsNotExist(err) {
+			logger.WithError(err).Warnf("failed to remove state dir link: %s", v.stateDirLink)
+		}
+	}
+
+	if s.config.RetainDestroyedArtifacts <= 0 {
+		if err := os.RemoveAll(v.stateDirPath); err != nil {
+			logger.Warnf("Failed to delete directory %s: %v", v.stateDirPath, err)
+		}
+		return
+	}
+
+	if err := os.Remove(v.statefulDiskPath); err != nil && !os.IsNotExist(err) {
+		logger.WithError(err).Warnf("failed to remove stateful disk: %s", v.statefulDiskPath)
+	}
+	overlayPath := path.Join(v.stateDirPath, rootfsOverlayFilename)
+	if err := os.Remove(overlayPath); err != nil && !os.IsNotExist(err) {
+		logger.WithError(err).Warnf("failed to remove rootfs overlay: %s", overlayPath)
+	}
+
+	archivePath := path.Join(
+		s.archiveDir(),
+		fmt.Sprintf("%s-%s", v.name, time.Now().UTC().Format(archiveTimestampFormat)),
+	)
+	err := os.MkdirAll(s.archiveDir(), 0755)
+	if err == nil {
+		err = os.Rename(v.stateDirPath, archivePath)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("failed to archive VM state dir, deleting it instead")
+		if err := os.RemoveAll(v.stateDirPath); err != nil {
+			logger.Warnf("Failed to delete directory %s: %v", v.stateDirPath, err)
+		}
+		return
+	}
+	logger.WithField("archivePath", archivePath).Info("archived VM state dir")
+}
+
+// dirSize returns the total size of the regular files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// listArchive returns the archived VMs, oldest first.
+func (s *Server) listArchive() ([]archivedVM, error) {
+	entries, err := os.ReadDir(s.archiveDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read archive dir: %w", err)
+	}
+
+	var archived []archivedVM
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		idx := strings.LastIndex(entry.Name(), "-")
+		if idx == -1 {
+			continue
+		}
+		archivedAt, err := time.Parse(archiveTimestampFormat, entry.Name()[idx+1:])
+		if err != nil {
+			continue
+		}
+		size, err := dirSize(path.Join(s.archiveDir(), entry.Name()))
+		if err != nil {
+			log.WithError(err).Warnf("failed to compute size of archive: %s", entry.Name())
+		}
+		archived = append(archived, archivedVM{
+			name:       entry.Name(),
+			vmName:     entry.Name()[:idx],
+			archivedAt: archivedAt,
+			sizeBytes:  size,
+		})
+	}
+
+	sort.Slice(archived, func(i, j int) bool {
+		return archived[i].archivedAt.Before(archived[j].archivedAt)
+	})
+	return archived, nil
+}
+
+// pruneArchive deletes archives older than the retention period, then the
+// oldest remaining archives until the archive fits in its quota.
+func (s *Server) pruneArchive() {
+	archived, err := s.listArchive()
+	if err != nil {
+		log.WithError(err).Warn("failed to list archive for pruning")
+		return
+	}
+
+	var total int64
+	for _, a := range archived {
+		total += a.sizeBytes
+	}
+	quota := s.config.ArchiveQuotaInMB * 1024 * 1024
+
+	cutoff := time.Now().Add(-s.config.RetainDestroyedArtifacts)
+	for _, a := range archived {
+		expired := a.archivedAt.Before(cutoff)
+		overQuota := quota > 0 && total > quota
+		if !expired && !overQuota {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(s.archiveDir(), a.name)); err != nil {
+			log.WithError(err).Warnf("failed to prune archive: %s", a.name)
+			continue
+		}
+		total -= a.sizeBytes
+		log.WithFields(log.Fields{
+			"archive":   a.name,
+			"expired":   expired,
+			"overQuota": overQuota,
+		}).Info("pruned archived VM")
+	}
+}
+
+// runArchivePruner periodically prunes the archive. It only runs when
+// retain_destroyed_artifacts is set.
+func (s *Server) runArchivePruner() {
+	interval := s.config.RetainDestroyedArtifacts / 10
+	if interval > maxArchivePruneDelay {
+		interval = maxArchivePruneDelay
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.pruneArchive()
+		<-ticker.C
+	}
+}
+
+// ListArchive returns the archived state dirs of destroyed VMs.
+func (s *Server) ListArchive() (*serverapi.ListArchiveResponse, error) {
+	archived, err := s.listArchive()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list archive: %v", err)
+	}
+
+	resp := &serverapi.ListArchiveResponse{}
+	var total int64
+	for _, a := range archived {
+		resp.Archives = append(resp.Archives, serverapi.ArchivedVM{
+			Name:       serverapi.PtrString(a.name),
+			VmName:     serverapi.PtrString(a.vmName),
+			ArchivedAt: serverapi.PtrTime(a.archivedAt),
+			SizeBytes:  serverapi.PtrInt64(a.sizeBytes),
+		})
+		total += a.sizeBytes
+	}
+	resp.TotalSizeBytes = serverapi.PtrInt64(total)
+	if s.config.ArchiveQuotaInMB > 0 {
+		resp.QuotaBytes = serverapi.PtrInt64(s.config.ArchiveQuotaInMB * 1024 * 1024)
+	}
+	return resp, nil
+}
+
+// findArchive returns the archive called name, or the most recent archive of
+// the VM called name.
+func (s *Server) findArchive(name string) (*archivedVM, error) {
+	archived, err := s.listArchive()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list archive: %v", err)
+	}
+
+	var match *archivedVM
+	for i := range archived {
+		if archived[i].name == name {
+			match = &archived[i]
+			break
+		}
+		if archived[i].vmName == name {
+			// Archives are sorted oldest first, so keep the last match.
+			match = &archived[i]
+		}
+	}
+	if match == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("archive not found: %s", name))
+	}
+	return match, nil
+}
+
+// GetArchivedLogs returns the log file of an archived VM. name is either an
+// archive name or a VM name, in which case its most recent archive is used.
+func (s *Server) GetArchivedLogs(name string) ([]byte, error) {
+	match, err := s.findArchive(name)
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := os.ReadFile(path.Join(s.archiveDir(), match.name, vmLogFilename))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read archived logs: %v", err)
+	}
+	return logs, nil
+}
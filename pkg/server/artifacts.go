@@ -0,0 +1,381 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/events"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
+)
+
+const (
+	// artifactVsockPort is the host port guests publish artifacts to.
+	artifactVsockPort = 4034
+	artifactsDirName  = "artifacts"
+	// maxArtifactNameLen bounds artifact names, leaving room for a version
+	// suffix within the filesystem's name limit.
+	maxArtifactNameLen = 200
+	// artifactPublishTimeout bounds a single publish, including the upload.
+	artifactPublishTimeout = 10 * time.Minute
+	// uploadArtifactMethod is the built-in callback method guests ask the
+	// host to fetch one of their files as an artifact with, instead of
+	// publishing it.
+	uploadArtifactMethod = "cbox.uploadArtifact"
+)
+
+// artifactHeader is the newline-terminated JSON frame that starts a publish.
+// The host answers with an empty response frame if it accepts the artifact,
+// after which the guest sends exactly SizeBytes bytes of file content and the
+// host answers with the result. A rejected artifact gets an error frame
+// instead, before any content is sent.
+type artifactHeader struct {
+	VMName    string `json:"vmName,omitempty"`
+	Name      string `json:"name"`
+	SizeBytes int64  `json:"sizeBytes"`
+}
+
+// artifactResult is the result of a successful publish or upload.
+type artifactResult struct {
+	Name      string `json:"name"`
+	SizeBytes int64  `json:"sizeBytes"`
+	// Path is where the artifact is served in the REST API.
+	Path string `json:"path"`
+}
+
+// uploadArtifactParams are the params of an uploadArtifactMethod callback.
+// Path is relative to cmdserver's files root. Name defaults to the file's
+// name.
+type uploadArtifactParams struct {
+	Path string `json:"path"`
+	Name string `json:"name,omitempty"`
+}
+
+func artifactsDir(vmStateDir string) string {
+	return path.Join(vmStateDir, artifactsDirName)
+}
+
+func validateArtifactName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") || strings.HasPrefix(name, ".") {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid artifact name: %q", name))
+	}
+	if len(name) > maxArtifactNameLen {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("artifact name longer than %d bytes", maxArtifactNameLen))
+	}
+	return nil
+}
+
+// versionedArtifactName returns name, or name with a "-N" suffix before its
+// extension if an artifact by that name already exists in dir.
+func versionedArtifactName(dir string, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for version := 1; ; version++ {
+		_, err := os.Lstat(path.Join(dir, candidate))
+		if os.IsNotExist(err) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		candidate = base + "-" + strconv.Itoa(version) + ext
+	}
+}
+
+// listenArtifacts accepts artifacts published by vmName on the host side of
+// its vsock device, like listenVsockCallbacks.
+func (s *Server) listenArtifacts(vmName string, vsockPath string, vmStateDir string) (net.Listener, error) {
+	socketPath := fmt.Sprintf("%s_%d", vsockPath, artifactVsockPort)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for artifacts on %s: %w", socketPath, err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// The listener is closed when the VM is destroyed.
+				return
+			}
+			go s.handleArtifactConn(vmName, vmStateDir, conn)
+		}
+	}()
+	return listener, nil
+}
+
+func (s *Server) handleArtifactConn(vmName string, vmStateDir string, conn net.Conn) {
+	defer conn.Close()
+	logger := log.WithField("vmName", vmName)
+	conn.SetDeadline(time.Now().Add(artifactPublishTimeout))
+
+	var resp vsockCallbackResponse
+	result, err := s.receiveArtifact(vmName, vmStateDir, bufio.NewReader(conn), conn)
+	if err != nil {
+		logger.WithError(err).Warn("failed to publish artifact")
+		resp.Error = err.Error()
+	} else {
+		resp.Result, _ = json.Marshal(result)
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		logger.WithError(err).Warn("failed to write artifact response")
+	}
+}
+
+// receiveArtifact reads a publish from r and stores it in the VM's artifacts
+// dir, subject to artifact_quota_in_mb. The go-ahead frame is written to w.
+func (s *Server) receiveArtifact(vmName string, vmStateDir string, r *bufio.Reader, w io.Writer) (*artifactResult, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read artifact header: %w", err)
+	}
+	var header artifactHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, fmt.Errorf("invalid artifact header: %w", err)
+	}
+	if header.VMName != "" && header.VMName != vmName {
+		return nil, fmt.Errorf("artifact for %s received on the vsock of %s", header.VMName, vmName)
+	}
+	if err := validateArtifactName(header.Name); err != nil {
+		return nil, err
+	}
+	if header.SizeBytes < 0 {
+		return nil, fmt.Errorf("invalid artifact size: %d", header.SizeBytes)
+	}
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	// Holding the gate keeps destroy from archiving the state dir mid-upload.
+	release, err := vm.gate.acquireShared(context.Background(), vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	accept := func() error {
+		return json.NewEncoder(w).Encode(vsockCallbackResponse{})
+	}
+	return s.storeArtifact(vm, vmStateDir, header.Name, header.SizeBytes, accept, r)
+}
+
+// storeArtifact stores sizeBytes of content as artifact name of vm, or a
+// versioned name if it's taken, subject to max_artifact_size_in_mb and
+// artifact_quota_in_mb. accept is called once the artifact passes those
+// checks, before content is read. The caller holds the VM's gate.
+func (s *Server) storeArtifact(vm *vm, vmStateDir string, name string, sizeBytes int64, accept func() error, content io.Reader) (*artifactResult, error) {
+	if s.config.MaxArtifactSizeInMB > 0 && sizeBytes > s.config.MaxArtifactSizeInMB*1024*1024 {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(
+			"artifact %s of %d bytes exceeds max_artifact_size_in_mb of %d MB", name, sizeBytes, s.config.MaxArtifactSizeInMB))
+	}
+	// Serializes publishes so quota checks and name versioning don't race.
+	vm.artifactLock.Lock()
+	defer vm.artifactLock.Unlock()
+
+	dir := artifactsDir(vmStateDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create artifacts dir: %w", err)
+	}
+	if s.config.ArtifactQuotaInMB > 0 {
+		quota := s.config.ArtifactQuotaInMB * 1024 * 1024
+		used, err := dirSize(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute artifacts size: %w", err)
+		}
+		if used+sizeBytes > quota {
+			return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf(
+				"artifact %s of %d bytes exceeds the VM's artifact quota of %d bytes (%d bytes used)",
+				name, sizeBytes, quota, used))
+		}
+	}
+
+	stored, err := versionedArtifactName(dir, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pick artifact name: %w", err)
+	}
+	// Upload under a hidden name so listings never show partial artifacts.
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create artifact file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := accept(); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to accept artifact: %w", err)
+	}
+	_, err = io.CopyN(tmp, content, sizeBytes)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive artifact %s: %w", name, err)
+	}
+	if err := os.Rename(tmp.Name(), path.Join(dir, stored)); err != nil {
+		return nil, fmt.Errorf("failed to store artifact %s: %w", name, err)
+	}
+
+	log.WithFields(log.Fields{
+		"vmName":    vm.name,
+		"artifact":  stored,
+		"sizeBytes": sizeBytes,
+	}).Info("artifact published")
+	s.events.Publish(events.TypeVMArtifactPublished, vm.name, map[string]any{
+		"name":      stored,
+		"sizeBytes": sizeBytes,
+	})
+	return &artifactResult{
+		Name:      stored,
+		SizeBytes: sizeBytes,
+		Path:      fmt.Sprintf("/v1/vms/%s/artifacts/%s", url.PathEscape(vm.name), url.PathEscape(stored)),
+	}, nil
+}
+
+// uploadArtifact handles an uploadArtifactMethod callback from vmName,
+// fetching the file it names from the guest's cmdserver into its artifacts.
+// The caller holds the VM's gate.
+func (s *Server) uploadArtifact(ctx context.Context, vmName string, rawParams json.RawMessage) (json.RawMessage, error) {
+	var params uploadArtifactParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s params: %v", uploadArtifactMethod, err))
+	}
+	if params.Path == "" {
+		return nil, status.Error(codes.InvalidArgument, "path is required")
+	}
+	name := params.Name
+	if name == "" {
+		name = path.Base(params.Path)
+	}
+	if err := validateArtifactName(name); err != nil {
+		return nil, err
+	}
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if err := vm.requireAgentFeature(ctx, agentCmdServer, featureFiles); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, artifactPublishTimeout)
+	defer cancel()
+	reqURL := fmt.Sprintf("http://%s/files?%s", cmdServerAddr(vm.ip.IP.String()), url.Values{"path": {params.Path}}.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	requestid.SetHeader(req)
+	resp, err := guestFileClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", params.Path, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusNotFound:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("failed to fetch %s: %s", params.Path, strings.TrimSpace(string(body))))
+	default:
+		return nil, fmt.Errorf("failed to fetch %s: status %d", params.Path, resp.StatusCode)
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("failed to fetch %s: size unknown", params.Path)
+	}
+
+	result, err := s.storeArtifact(vm, vm.stateDirPath, name, resp.ContentLength, func() error { return nil }, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+// artifactsDirFor returns the artifacts dir of a running VM, or of its most
+// recent archive if it was destroyed.
+func (s *Server) artifactsDirFor(vmName string) (dir string, archived bool, err error) {
+	stateDir, archived, err := s.vmStateDirFor(vmName)
+	if err != nil {
+		return "", false, err
+	}
+	return artifactsDir(stateDir), archived, nil
+}
+
+// ListArtifacts returns the artifacts published by a VM. Artifacts of a
+// destroyed VM are listed from its archive for as long as it's retained.
+func (s *Server) ListArtifacts(vmName string) (*serverapi.ListArtifactsResponse, error) {
+	dir, archived, err := s.artifactsDirFor(vmName)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read artifacts dir: %w", err)
+	}
+
+	resp := &serverapi.ListArtifactsResponse{
+		Artifacts: []serverapi.Artifact{},
+		Archived:  serverapi.PtrBool(archived),
+	}
+	var total int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		resp.Artifacts = append(resp.Artifacts, serverapi.Artifact{
+			Name:        serverapi.PtrString(entry.Name()),
+			SizeBytes:   serverapi.PtrInt64(info.Size()),
+			PublishedAt: serverapi.PtrTime(info.ModTime().UTC()),
+		})
+		total += info.Size()
+	}
+	sort.Slice(resp.Artifacts, func(i, j int) bool {
+		return resp.Artifacts[i].GetPublishedAt().Before(resp.Artifacts[j].GetPublishedAt())
+	})
+	resp.TotalSizeBytes = serverapi.PtrInt64(total)
+	if s.config.ArtifactQuotaInMB > 0 {
+		resp.QuotaBytes = serverapi.PtrInt64(s.config.ArtifactQuotaInMB * 1024 * 1024)
+	}
+	return resp, nil
+}
+
+// OpenArtifact opens an artifact published by a VM for reading. The caller
+// closes the file.
+func (s *Server) OpenArtifact(vmName string, name string) (*os.File, error) {
+	if err := validateArtifactName(name); err != nil {
+		return nil, err
+	}
+	dir, _, err := s.artifactsDirFor(vmName)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path.Join(dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("artifact not found: %s", name))
+		}
+		return nil, fmt.Errorf("failed to open artifact: %w", err)
+	}
+	return file, nil
+}
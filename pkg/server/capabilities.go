@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/hostcmd"
+)
+
+// hostBinary is a binary on the host the server shells out to.
+type hostBinary struct {
+	name    string
+	feature string
+	// bridgeOnly is set for binaries only bridge networking needs. The rest
+	// are needed in every network mode, unless optional.
+	bridgeOnly bool
+	// optional is set for binaries whose feature can be unavailable without
+	// stopping the server from running VMs.
+	optional bool
+	// rootfsOverlay is set for binaries that are required when VMs run on
+	// rootfs overlays by default, and optional otherwise.
+	rootfsOverlay bool
+}
+
+var hostBinaries = []hostBinary{
+	{name: "ip", feature: "bridge networking", bridgeOnly: true},
+	{name: "iptables", feature: "bridge networking", bridgeOnly: true},
+	{name: "iptables-save", feature: "bridge networking", bridgeOnly: true},
+	{name: "sysctl", feature: "bridge networking", bridgeOnly: true},
+	{name: "truncate", feature: "stateful disks"},
+	{name: "mkfs.ext4", feature: "stateful disks"},
+	{name: "cp", feature: "templates", optional: true},
+	{name: "qemu-img", feature: "rootfs overlays", optional: true, rootfsOverlay: true},
+}
+
+// hostCapability is whether a host binary was found at startup.
+type hostCapability struct {
+	binary   string
+	feature  string
+	path     string
+	required bool
+}
+
+// probeHostCapabilities looks up the host binaries the server uses. Missing
+// binaries the config needs are reported together in one error; the others
+// only disable their feature and are logged as warnings.
+func probeHostCapabilities(cfg config.ServerConfig) ([]hostCapability, error) {
+	networkMode := cfg.NetworkMode
+	var capabilities []hostCapability
+	var missing []string
+	for _, binary := range hostBinaries {
+		capability := hostCapability{
+			binary:  binary.name,
+			feature: binary.feature,
+			required: !binary.optional && (!binary.bridgeOnly || networkMode == config.NetworkModeBridge) ||
+				binary.rootfsOverlay && cfg.RootfsOverlay,
+		}
+		capability.path, _ = hostcmd.LookPath(binary.name)
+		capabilities = append(capabilities, capability)
+		if capability.path != "" {
+			continue
+		}
+		if capability.required {
+			missing = append(missing, fmt.Sprintf("%s (%s)", binary.name, binary.feature))
+			continue
+		}
+		log.WithFields(log.Fields{
+			"binary":      binary.name,
+			"networkMode": networkMode,
+		}).Warnf("%s not found, %s unavailable", binary.name, binary.feature)
+	}
+	if len(missing) > 0 {
+		return capabilities, fmt.Errorf(
+			"host binaries required in %s network mode with this config are missing from PATH: %s",
+			networkMode,
+			strings.Join(missing, ", "))
+	}
+	return capabilities, nil
+}
+
+// hasHostBinary reports whether the host binary name was found at startup.
+func (s *Server) hasHostBinary(name string) bool {
+	return slices.ContainsFunc(s.capabilities, func(c hostCapability) bool {
+		return c.binary == name && c.path != ""
+	})
+}
+
+// apiCapabilities returns the capability report for /v1/host.
+func (s *Server) apiCapabilities() []serverapi.HostCapability {
+	capabilities := make([]serverapi.HostCapability, 0, len(s.capabilities))
+	for _, capability := range s.capabilities {
+		apiCapability := serverapi.HostCapability{
+			Binary:    serverapi.PtrString(capability.binary),
+			Feature:   serverapi.PtrString(capability.feature),
+			Available: serverapi.PtrBool(capability.path != ""),
+			Required:  serverapi.PtrBool(capability.required),
+		}
+		if capability.path != "" {
+			apiCapability.Path = serverapi.PtrString(capability.path)
+		}
+		capabilities = append(capabilities, apiCapability)
+	}
+	return capabilities
+}
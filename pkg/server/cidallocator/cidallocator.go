@@ -1,10 +1,14 @@
 package cidallocator
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 )
 
+// ErrExhausted is returned by AllocateCID when every CID is allocated.
+var ErrExhausted = errors.New("no available CIDs")
+
 // CIDAllocator manages allocation of Context IDs (CIDs) for VMs
 type CIDAllocator struct {
 	lowCID    uint32
@@ -39,7 +43,7 @@ func (a *CIDAllocator) AllocateCID() (uint32, error) {
 	defer a.mutex.Unlock()
 
 	if len(a.available) == 0 {
-		return 0, fmt.Errorf("no available CIDs in range %d-%d", a.lowCID, a.highCID)
+		return 0, fmt.Errorf("%w in range %d-%d", ErrExhausted, a.lowCID, a.highCID)
 	}
 
 	// Take the first available CID
@@ -69,6 +73,15 @@ func (a *CIDAllocator) FreeCID(cid uint32) error {
 	return nil
 }
 
+// Occupancy returns the number of allocated CIDs and the size of the range.
+func (a *CIDAllocator) Occupancy() (used int, capacity int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	capacity = int(a.highCID-a.lowCID) + 1
+	return capacity - len(a.available), capacity
+}
+
 // ClaimCID claims a specific CID from the pool of available CIDs
 func (a *CIDAllocator) ClaimCID(cid uint32) error {
 	a.mutex.Lock()
@@ -81,4 +94,4 @@ func (a *CIDAllocator) ClaimCID(cid uint32) error {
 		}
 	}
 	return fmt.Errorf("CID %d is not available", cid)
-} 
\ No newline at end of file
+}
@@ -0,0 +1,74 @@
+package cidallocator
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInvalidRange(t *testing.T) {
+	for _, r := range [][2]uint32{{0, 10}, {2, 10}, {10, 9}} {
+		if _, err := NewCIDAllocator(r[0], r[1]); err == nil {
+			t.Errorf("NewCIDAllocator(%d, %d) succeeded", r[0], r[1])
+		}
+	}
+}
+
+func TestRangeBoundaries(t *testing.T) {
+	a, err := NewCIDAllocator(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first and last CIDs of the range are handed out, nothing
+	// outside it.
+	for _, cid := range []uint32{2, 6} {
+		if err := a.ClaimCID(cid); err == nil {
+			t.Errorf("ClaimCID(%d) outside the range succeeded", cid)
+		}
+		if err := a.FreeCID(cid); err == nil {
+			t.Errorf("FreeCID(%d) outside the range succeeded", cid)
+		}
+	}
+	for _, cid := range []uint32{3, 5} {
+		if err := a.ClaimCID(cid); err != nil {
+			t.Errorf("ClaimCID(%d): %v", cid, err)
+		}
+	}
+	if err := a.ClaimCID(3); err == nil {
+		t.Error("second ClaimCID(3) succeeded")
+	}
+	if cid, err := a.AllocateCID(); err != nil || cid != 4 {
+		t.Errorf("AllocateCID = %d, %v, want 4", cid, err)
+	}
+}
+
+func TestExhaustion(t *testing.T) {
+	a, err := NewCIDAllocator(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := uint32(3); want <= 5; want++ {
+		if cid, err := a.AllocateCID(); err != nil || cid != want {
+			t.Fatalf("AllocateCID = %d, %v, want %d", cid, err, want)
+		}
+	}
+	if used, capacity := a.Occupancy(); used != 3 || capacity != 3 {
+		t.Errorf("occupancy = %d/%d, want 3/3", used, capacity)
+	}
+	if _, err := a.AllocateCID(); !errors.Is(err, ErrExhausted) {
+		t.Errorf("AllocateCID when exhausted = %v, want ErrExhausted", err)
+	}
+
+	// A freed CID is handed out again, but can't be freed twice.
+	if err := a.FreeCID(4); err != nil {
+		t.Fatalf("FreeCID: %v", err)
+	}
+	if err := a.FreeCID(4); err == nil {
+		t.Error("second FreeCID(4) succeeded")
+	}
+	if cid, err := a.AllocateCID(); err != nil || cid != 4 {
+		t.Errorf("AllocateCID after FreeCID = %d, %v, want 4", cid, err)
+	}
+	if _, err := a.AllocateCID(); !errors.Is(err, ErrExhausted) {
+		t.Errorf("AllocateCID when exhausted again = %v, want ErrExhausted", err)
+	}
+}
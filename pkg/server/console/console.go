@@ -0,0 +1,153 @@
+package console
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTimeout bounds how long Exec waits for the command to finish.
+	DefaultTimeout = 30 * time.Second
+
+	// MaxOutputBytes caps how much console output is buffered per command.
+	MaxOutputBytes = 1 << 20
+
+	sentinelPrefix = "__CBOX_CONSOLE_DONE_"
+	readChunkSize  = 4096
+)
+
+// Options control how Exec decides that a command has finished.
+type Options struct {
+	// PromptPattern, if set, ends the command when the captured output matches
+	// it. Otherwise a unique sentinel echoed after the command is used.
+	PromptPattern *regexp.Regexp
+	Timeout       time.Duration
+}
+
+// Result is the output captured for a console command.
+type Result struct {
+	Output string
+	// MatchedBy is "sentinel" or "prompt".
+	MatchedBy string
+}
+
+// Exec writes cmd to a serial console that is assumed to be attached to a
+// root shell and captures what the shell prints until the command completes.
+// This is best-effort: anything else writing to the console (kernel messages,
+// other shells) ends up in the output.
+func Exec(ctx context.Context, conn io.ReadWriteCloser, cmd string, opts Options) (*Result, error) {
+	if strings.ContainsAny(cmd, "\r\n") {
+		return nil, fmt.Errorf("console commands must be a single line")
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The sentinel is split with quotes in the command so the console's echo
+	// of the input line doesn't match; only the shell's output does.
+	id := fmt.Sprintf("%d__", time.Now().UnixNano())
+	sentinel := sentinelPrefix + id
+	line := fmt.Sprintf("%s; echo '%s''%s'\n", cmd, sentinelPrefix, id)
+	if opts.PromptPattern != nil {
+		line = cmd + "\n"
+	}
+
+	chunks := make(chan []byte)
+	readErrs := make(chan error, 1)
+	go func() {
+		for {
+			buf := make([]byte, readChunkSize)
+			n, err := conn.Read(buf)
+			if n > 0 {
+				select {
+				case chunks <- buf[:n]:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				readErrs <- err
+				return
+			}
+		}
+	}()
+	// Closing the console unblocks the reader goroutine.
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(line)); err != nil {
+		return nil, fmt.Errorf("failed to write to console: %w", err)
+	}
+
+	var captured bytes.Buffer
+	for {
+		select {
+		case chunk := <-chunks:
+			captured.Write(chunk)
+			if captured.Len() > MaxOutputBytes {
+				return nil, fmt.Errorf("console output exceeded %d bytes", MaxOutputBytes)
+			}
+			output := captured.String()
+			if opts.PromptPattern == nil {
+				if idx := strings.Index(output, sentinel); idx != -1 {
+					return &Result{
+						Output:    stripEcho(output[:idx], cmd),
+						MatchedBy: "sentinel",
+					}, nil
+				}
+				continue
+			}
+			// Only look for the prompt once the echoed command line has
+			// been printed, otherwise the prompt preceding it would match.
+			rest, ok := afterEcho(output, cmd)
+			if !ok {
+				continue
+			}
+			if loc := opts.PromptPattern.FindStringIndex(rest); loc != nil {
+				return &Result{
+					Output:    normalizeNewlines(rest[:loc[0]]),
+					MatchedBy: "prompt",
+				}, nil
+			}
+		case err := <-readErrs:
+			return nil, fmt.Errorf("console closed before command completed: %w output: %q", err, captured.String())
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for console command to complete: %w output: %q", ctx.Err(), captured.String())
+		}
+	}
+}
+
+// afterEcho returns the output following the terminal's echo of cmd. It
+// reports false until the full echoed line has been received.
+func afterEcho(output string, cmd string) (string, bool) {
+	idx := strings.Index(output, cmd)
+	if idx == -1 {
+		return "", false
+	}
+	rest := output[idx+len(cmd):]
+	nl := strings.IndexByte(rest, '\n')
+	if nl == -1 {
+		return "", false
+	}
+	return rest[nl+1:], true
+}
+
+// stripEcho removes the terminal's echo of the command line, if present.
+func stripEcho(output string, cmd string) string {
+	if rest, ok := afterEcho(output, cmd); ok {
+		output = rest
+	}
+	return normalizeNewlines(output)
+}
+
+func normalizeNewlines(s string) string {
+	return strings.ReplaceAll(s, "\r\n", "\n")
+}
@@ -0,0 +1,83 @@
+package console
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeShell is a root shell on a serial console: it echoes each line it's
+// sent, as terminals do, then prints output and runs any sentinel echo.
+func fakeShell(t *testing.T, output string) net.Conn {
+	t.Helper()
+	host, guest := net.Pipe()
+	t.Cleanup(func() { guest.Close() })
+	go func() {
+		fmt.Fprint(guest, "root# ")
+		line, err := bufio.NewReader(guest).ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		fmt.Fprintf(guest, "%s\r\n%s", line, output)
+		if i := strings.LastIndex(line, "; echo '"); i != -1 {
+			fmt.Fprintf(guest, "%s\r\n", strings.ReplaceAll(line[i+len("; echo "):], "'", ""))
+		}
+		fmt.Fprint(guest, "root# ")
+	}()
+	return host
+}
+
+func TestExecSentinel(t *testing.T) {
+	result, err := Exec(context.Background(), fakeShell(t, "hello\r\nworld\r\n"), "echo hello; echo world", Options{})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if result.Output != "hello\nworld\n" || result.MatchedBy != "sentinel" {
+		t.Errorf("Exec = %q matched by %s, want the command's output matched by sentinel", result.Output, result.MatchedBy)
+	}
+}
+
+func TestExecPrompt(t *testing.T) {
+	// The prompt printed before the command doesn't end it.
+	result, err := Exec(context.Background(), fakeShell(t, "hello\r\n"), "echo hello", Options{PromptPattern: regexp.MustCompile(`root# $`)})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if result.Output != "hello\n" || result.MatchedBy != "prompt" {
+		t.Errorf("Exec = %q matched by %s, want the command's output matched by prompt", result.Output, result.MatchedBy)
+	}
+}
+
+func TestExecFailures(t *testing.T) {
+	if _, err := Exec(context.Background(), fakeShell(t, ""), "echo a\necho b", Options{}); err == nil {
+		t.Error("Exec of a multi-line command succeeded")
+	}
+
+	// A shell that never finishes the command.
+	host, guest := net.Pipe()
+	defer guest.Close()
+	go bufio.NewReader(guest).ReadString('\n')
+	start := time.Now()
+	if _, err := Exec(context.Background(), host, "sleep 60", Options{Timeout: 100 * time.Millisecond}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Exec of a hung command = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Exec took %s to time out after 100ms", elapsed)
+	}
+
+	// A console that goes away mid-command.
+	host, guest = net.Pipe()
+	go func() {
+		bufio.NewReader(guest).ReadString('\n')
+		guest.Close()
+	}()
+	if _, err := Exec(context.Background(), host, "reboot", Options{}); err == nil || !strings.Contains(err.Error(), "console closed") {
+		t.Errorf("Exec on a closed console = %v, want it closed", err)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/server/console"
+)
+
+// openSerialConsole connects to the VM's serial console. Only the Pty and
+// Socket serial modes expose the console to the host.
+func (v *vm) openSerialConsole(ctx context.Context) (io.ReadWriteCloser, error) {
+	switch v.serialMode {
+	case serialModeSocket:
+		conn, err := net.Dial("unix", v.serialSocketPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to serial socket %s: %w", v.serialSocketPath, err)
+		}
+		return conn, nil
+	case serialModePty:
+		info, _, err := v.apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get VM info: %w", err)
+		}
+		serial := info.Config.GetSerial()
+		ptyPath := serial.GetFile()
+		if ptyPath == "" {
+			return nil, fmt.Errorf("cloud-hypervisor did not report a serial pty")
+		}
+		pty, err := os.OpenFile(ptyPath, os.O_RDWR|syscall.O_NOCTTY, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open serial pty %s: %w", ptyPath, err)
+		}
+		return pty, nil
+	default:
+		return nil, fmt.Errorf("serial mode %q does not support console access, use %s or %s", v.serialMode, serialModePty, serialModeSocket)
+	}
+}
+
+// ConsoleExec runs a command through the VM's serial console. It's a last
+// resort for when the guest agents are unreachable and assumes a root shell is
+// attached to the console, so it's disabled unless enable_console_exec is set.
+func (s *Server) ConsoleExec(ctx context.Context, vmName string, req *serverapi.ConsoleExecRequest) (*serverapi.ConsoleExecResponse, error) {
+	if !s.config.EnableConsoleExec {
+		return nil, status.Error(codes.PermissionDenied, "console-exec is disabled, set enable_console_exec to allow it")
+	}
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	opts := console.Options{
+		Timeout: time.Duration(req.GetTimeoutSeconds()) * time.Second,
+	}
+	if pattern := req.GetPromptPattern(); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid prompt pattern: %v", err)
+		}
+		opts.PromptPattern = re
+	}
+
+	vm.consoleLock.Lock()
+	defer vm.consoleLock.Unlock()
+
+	conn, err := vm.openSerialConsole(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to open serial console: %v", err)
+	}
+
+	log.WithFields(log.Fields{
+		"vmName": vmName,
+		"cmd":    req.GetCmd(),
+	}).Warn("Running command via serial console")
+
+	result, err := console.Exec(ctx, conn, req.GetCmd(), opts)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "console exec failed: %v", err)
+	}
+
+	return &serverapi.ConsoleExecResponse{
+		Output:    serverapi.PtrString(result.Output),
+		MatchedBy: serverapi.PtrString(result.MatchedBy),
+	}, nil
+}
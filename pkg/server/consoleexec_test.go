@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+// serveSerialShell serves a root shell on a VM's serial socket, which runs
+// only the sentinel echo console exec appends to commands.
+func serveSerialShell(t *testing.T, socketPath string) {
+	t.Helper()
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimSuffix(line, "\n")
+				cmd, echo, _ := strings.Cut(line, "; echo ")
+				fmt.Fprintf(conn, "%s\r\nran %s\r\n%s\r\n# ", line, cmd, strings.ReplaceAll(echo, "'", ""))
+			}()
+		}
+	}()
+}
+
+func TestConsoleExec(t *testing.T) {
+	h := newTestHarness(t, func(cfg *config.ServerConfig) {
+		cfg.SerialMode = serialModeSocket
+		cfg.EnableConsoleExec = true
+	})
+	h.startVM("vm1")
+	serveSerialShell(t, h.server.getVMAtomic("vm1").serialSocketPath)
+
+	resp, err := h.server.ConsoleExec(context.Background(), "vm1", &serverapi.ConsoleExecRequest{Cmd: "reboot"})
+	if err != nil {
+		t.Fatalf("ConsoleExec: %v", err)
+	}
+	if resp.GetOutput() != "ran reboot\n" || resp.GetMatchedBy() != "sentinel" {
+		t.Errorf("ConsoleExec = %q matched by %s, want the shell's output", resp.GetOutput(), resp.GetMatchedBy())
+	}
+
+	if _, err := h.server.ConsoleExec(context.Background(), "vm1", &serverapi.ConsoleExecRequest{Cmd: "true", PromptPattern: serverapi.PtrString("(")}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ConsoleExec with an invalid prompt = %v, want InvalidArgument", err)
+	}
+	if _, err := h.server.ConsoleExec(context.Background(), "vm2", &serverapi.ConsoleExecRequest{Cmd: "true"}); status.Code(err) != codes.NotFound {
+		t.Errorf("ConsoleExec on a missing VM = %v, want NotFound", err)
+	}
+}
+
+func TestConsoleExecUnavailable(t *testing.T) {
+	disabled := newTestHarness(t, func(cfg *config.ServerConfig) { cfg.SerialMode = serialModeSocket })
+	disabled.startVM("vm1")
+	if _, err := disabled.server.ConsoleExec(context.Background(), "vm1", &serverapi.ConsoleExecRequest{Cmd: "true"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ConsoleExec without enable_console_exec = %v, want PermissionDenied", err)
+	}
+
+	// The console isn't reachable from the host in Tty mode.
+	tty := newTestHarness(t, func(cfg *config.ServerConfig) { cfg.EnableConsoleExec = true })
+	tty.startVM("vm1")
+	if _, err := tty.server.ConsoleExec(context.Background(), "vm1", &serverapi.ConsoleExecRequest{Cmd: "true"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("ConsoleExec in Tty serial mode = %v, want FailedPrecondition", err)
+	}
+}
@@ -0,0 +1,452 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+const (
+	crashDirName         = "_crash"
+	crashBundleSuffix    = ".tar.gz"
+	crashCheckInterval   = 2 * time.Second
+	crashVMInfoTimeout   = 2 * time.Second
+	crashCallbackTimeout = 10 * time.Second
+	// crashLogMaxBytes caps the tail of the VM log put in a bundle.
+	crashLogMaxBytes = 1024 * 1024
+	// crashBundleEvents is how many of the VM's recent events a bundle holds.
+	crashBundleEvents = 100
+	// chvStateShutdown is the vm.info state of a guest that powered off.
+	chvStateShutdown = "Shutdown"
+)
+
+var errCrashBundleTooLarge = errors.New("crash bundle exceeds crash_bundle_quota_in_mb")
+
+// crashManifest is manifest.json in a crash bundle.
+type crashManifest struct {
+	VMName    string    `json:"vmName"`
+	CrashedAt time.Time `json:"crashedAt"`
+	Reason    string    `json:"reason"`
+	Files     []string  `json:"files"`
+	// Skipped holds why each file left out of the bundle is missing.
+	Skipped map[string]string `json:"skipped,omitempty"`
+}
+
+func (s *Server) crashDir() string {
+	return path.Join(s.config.StateDir, crashDirName)
+}
+
+// startCrashMonitor watches a booted VM for its VMM exiting or its guest
+// shutting down on its own, until stopCrashMonitor is called. Calling it
+// again has no effect.
+func (s *Server) startCrashMonitor(vm *vm) {
+	vm.crashMonitorStart.Do(func() {
+		vm.crashMonitor.Add(1)
+		go s.monitorCrashes(vm)
+	})
+}
+
+// stopCrashMonitor stops the VM's crash monitor, waiting for a crash bundle
+// being collected to be finished.
+func (v *vm) stopCrashMonitor() {
+	v.crashMonitorStop.Do(func() {
+		close(v.crashMonitorDone)
+	})
+	v.crashMonitor.Wait()
+}
+
+func (s *Server) monitorCrashes(vm *vm) {
+	defer vm.crashMonitor.Done()
+
+	ticker := time.NewTicker(crashCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-vm.crashMonitorDone:
+			return
+		case <-ticker.C:
+		}
+		if reason := vm.crashReason(); reason != "" {
+			s.handleCrash(vm, reason)
+			return
+		}
+	}
+}
+
+// crashReason returns why the VM is considered crashed, or "" if it isn't.
+func (v *vm) crashReason() string {
+	if processExited(v.process.Pid) {
+		return "VMM process exited"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), crashVMInfoTimeout)
+	defer cancel()
+	info, _, err := v.apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+	if err == nil && info.GetState() == chvStateShutdown && !v.shutdownExpected() {
+		return "guest shut down"
+	}
+	return ""
+}
+
+// shutdownExpected reports whether the guest is down because it's being
+// stopped or rebooted through the API, which isn't a crash.
+func (v *vm) shutdownExpected() bool {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.status == vmStatusStopped || v.status == vmStatusRebooting
+}
+
+// processExited reports whether the process with pid is gone or a zombie
+// waiting to be reaped.
+func processExited(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	// The state follows the command name, which is in parentheses and may
+	// itself contain spaces or parentheses.
+	idx := bytes.LastIndexByte(data, ')')
+	if idx == -1 || idx+2 >= len(data) {
+		return false
+	}
+	state := data[idx+2]
+	return state == 'Z' || state == 'X'
+}
+
+// handleCrash marks the VM crashed and collects its crash bundle.
+func (s *Server) handleCrash(vm *vm, reason string) {
+	logger := log.WithFields(log.Fields{"vmName": vm.name, "reason": reason})
+	logger.Error("vm crashed")
+	vm.lock.Lock()
+	vm.status = vmStatusCrashed
+	vm.lock.Unlock()
+	s.events.Publish(events.TypeVMCrashed, vm.name, map[string]any{
+		"reason": reason,
+	})
+
+	crashedAt := time.Now().UTC()
+	name, size, err := s.writeCrashBundle(vm, reason, crashedAt, s.config.CrashBundleDiskMaxInMB > 0)
+	if err != nil && s.config.CrashBundleDiskMaxInMB > 0 {
+		// The disk is by far the largest and slowest part; retry without it
+		// so the logs aren't lost with it.
+		logger.WithError(err).Warn("failed to collect crash bundle with stateful disk, retrying without")
+		name, size, err = s.writeCrashBundle(vm, reason, crashedAt, false)
+	}
+	if err != nil {
+		logger.WithError(err).Error("failed to collect crash bundle")
+		return
+	}
+	s.pruneCrashBundles(name)
+
+	logger.WithFields(log.Fields{"bundle": name, "sizeBytes": size}).Info("crash bundle ready")
+	data := map[string]any{
+		"bundle":    name,
+		"reason":    reason,
+		"sizeBytes": size,
+	}
+	s.events.Publish(events.TypeVMCrashBundleReady, vm.name, data)
+	if !s.sessionManager.HasSession(vm.name) {
+		return
+	}
+	params, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), crashCallbackTimeout)
+	defer cancel()
+	// Sent by the host, so the guest's allowed methods and callback stats
+	// don't apply.
+	if err := s.sessionManager.Notify(ctx, vm.name, events.TypeVMCrashBundleReady, params); err != nil {
+		logger.WithError(err).Warn("failed to send crash bundle callback")
+	}
+}
+
+// limitedWriter fails writes beyond remaining bytes.
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining {
+		return 0, errCrashBundleTooLarge
+	}
+	n, err := l.w.Write(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// ctxReader fails reads once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// crashBundle writes the files of a crash bundle into a tar archive.
+type crashBundle struct {
+	ctx      context.Context
+	tw       *tar.Writer
+	manifest crashManifest
+}
+
+func (b *crashBundle) skip(name string, reason string) {
+	if b.manifest.Skipped == nil {
+		b.manifest.Skipped = make(map[string]string)
+	}
+	b.manifest.Skipped[name] = reason
+}
+
+func (b *crashBundle) add(name string, size int64, r io.Reader) error {
+	if err := b.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: b.manifest.CrashedAt,
+	}); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(b.tw, ctxReader{b.ctx, r}, size); err != nil {
+		return fmt.Errorf("failed to add %s: %w", name, err)
+	}
+	b.manifest.Files = append(b.manifest.Files, name)
+	return nil
+}
+
+func (b *crashBundle) addJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.add(name, int64(len(data)), bytes.NewReader(data))
+}
+
+// addTail adds up to the last maxBytes of the file at filePath.
+func (b *crashBundle) addTail(name string, filePath string, maxBytes int64) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		b.skip(name, err.Error())
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		b.skip(name, err.Error())
+		return nil
+	}
+	offset := max(info.Size()-maxBytes, 0)
+	return b.add(name, info.Size()-offset, io.NewSectionReader(f, offset, info.Size()-offset))
+}
+
+// writeCrashBundle collects the VM's crash bundle into the crash dir,
+// returning its name and size. It gives up after crash_bundle_timeout or
+// once the bundle alone would exceed crash_bundle_quota_in_mb.
+func (s *Server) writeCrashBundle(vm *vm, reason string, crashedAt time.Time, includeDisk bool) (string, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.CrashBundleTimeout)
+	defer cancel()
+
+	if err := os.MkdirAll(s.crashDir(), 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create crash dir: %w", err)
+	}
+	name := fmt.Sprintf("%s-%s%s", vm.name, crashedAt.Format(archiveTimestampFormat), crashBundleSuffix)
+	partialPath := path.Join(s.crashDir(), "."+name+".partial")
+	f, err := os.Create(partialPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create crash bundle: %w", err)
+	}
+	defer os.Remove(partialPath)
+	defer f.Close()
+
+	gz := gzip.NewWriter(&limitedWriter{w: f, remaining: s.config.CrashBundleQuotaInMB * 1024 * 1024})
+	b := &crashBundle{
+		ctx: ctx,
+		tw:  tar.NewWriter(gz),
+		manifest: crashManifest{
+			VMName:    vm.name,
+			CrashedAt: crashedAt,
+			Reason:    reason,
+		},
+	}
+	if err := s.addCrashFiles(b, vm, includeDisk); err != nil {
+		return "", 0, err
+	}
+	if err := b.addJSON("manifest.json", b.manifest); err != nil {
+		return "", 0, err
+	}
+	if err := b.tw.Close(); err != nil {
+		return "", 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return "", 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(partialPath, path.Join(s.crashDir(), name)); err != nil {
+		return "", 0, fmt.Errorf("failed to save crash bundle: %w", err)
+	}
+	return name, info.Size(), nil
+}
+
+// addCrashFiles adds everything but the manifest to a crash bundle.
+func (s *Server) addCrashFiles(b *crashBundle, vm *vm, includeDisk bool) error {
+	// With the default Tty serial mode the guest console goes to the same
+	// log as cloud-hypervisor's own output.
+	if err := b.addTail("vmm.log", path.Join(vm.stateDirPath, vmLogFilename), crashLogMaxBytes); err != nil {
+		return err
+	}
+	if err := b.addJSON("events.json", s.events.Recent(vm.name, crashBundleEvents)); err != nil {
+		return err
+	}
+
+	if processExited(vm.process.Pid) {
+		b.skip("vminfo.json", "VMM process exited")
+	} else {
+		infoCtx, cancel := context.WithTimeout(b.ctx, crashVMInfoTimeout)
+		info, _, err := vm.apiClient.DefaultAPI.VmInfoGet(infoCtx).Execute()
+		cancel()
+		if err != nil {
+			b.skip("vminfo.json", err.Error())
+		} else if err := b.addJSON("vminfo.json", info); err != nil {
+			return err
+		}
+	}
+	b.skip("agent.log", "guest agent logs aren't shipped to the host")
+
+	const diskName = "stateful-disk.img"
+	if !includeDisk {
+		if s.config.CrashBundleDiskMaxInMB > 0 {
+			b.skip(diskName, "collecting the bundle with it failed")
+		} else {
+			b.skip(diskName, "crash_bundle_disk_max_in_mb is 0")
+		}
+		return nil
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Stat(vm.statefulDiskPath, &stat); err != nil {
+		b.skip(diskName, err.Error())
+		return nil
+	}
+	// The disk is sparse, so gate on the space it uses rather than its size.
+	if used := stat.Blocks * 512; used > s.config.CrashBundleDiskMaxInMB*1024*1024 {
+		b.skip(diskName, fmt.Sprintf("uses %d MB, more than crash_bundle_disk_max_in_mb", used/(1024*1024)))
+		return nil
+	}
+	disk, err := os.Open(vm.statefulDiskPath)
+	if err != nil {
+		b.skip(diskName, err.Error())
+		return nil
+	}
+	defer disk.Close()
+	return b.add(diskName, stat.Size, disk)
+}
+
+// crashBundleVM returns the name of the VM a crash bundle belongs to.
+func crashBundleVM(name string) (string, bool) {
+	base, ok := strings.CutSuffix(name, crashBundleSuffix)
+	if !ok {
+		return "", false
+	}
+	idx := strings.LastIndex(base, "-")
+	if idx == -1 {
+		return "", false
+	}
+	if _, err := time.Parse(archiveTimestampFormat, base[idx+1:]); err != nil {
+		return "", false
+	}
+	return base[:idx], true
+}
+
+// pruneCrashBundles evicts the oldest crash bundles until they fit in
+// crash_bundle_quota_in_mb. keep, the bundle just written, is never evicted.
+func (s *Server) pruneCrashBundles(keep string) {
+	entries, err := os.ReadDir(s.crashDir())
+	if err != nil {
+		log.WithError(err).Warn("failed to list crash bundles")
+		return
+	}
+	type bundle struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var bundles []bundle
+	var total int64
+	for _, entry := range entries {
+		if _, ok := crashBundleVM(entry.Name()); !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		bundles = append(bundles, bundle{entry.Name(), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(bundles, func(i, j int) bool {
+		return bundles[i].modTime.Before(bundles[j].modTime)
+	})
+
+	quota := s.config.CrashBundleQuotaInMB * 1024 * 1024
+	for _, b := range bundles {
+		if total <= quota {
+			break
+		}
+		if b.name == keep {
+			continue
+		}
+		if err := os.Remove(path.Join(s.crashDir(), b.name)); err != nil {
+			log.WithError(err).Warnf("failed to evict crash bundle: %s", b.name)
+			continue
+		}
+		total -= b.size
+		log.WithField("bundle", b.name).Info("evicted crash bundle")
+	}
+}
+
+// OpenCrashBundle opens the most recent crash bundle of a VM, which is kept
+// after the VM is destroyed.
+func (s *Server) OpenCrashBundle(vmName string) (*os.File, string, error) {
+	entries, err := os.ReadDir(s.crashDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, "", fmt.Errorf("failed to list crash bundles: %w", err)
+	}
+	// Names end in a sortable timestamp, so the last match is the newest.
+	var latest string
+	for _, entry := range entries {
+		if owner, ok := crashBundleVM(entry.Name()); ok && owner == vmName {
+			latest = entry.Name()
+		}
+	}
+	if latest == "" {
+		return nil, "", status.Error(codes.NotFound, fmt.Sprintf("no crash bundle for vm: %s", vmName))
+	}
+	f, err := os.Open(path.Join(s.crashDir(), latest))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open crash bundle: %w", err)
+	}
+	return f, latest, nil
+}
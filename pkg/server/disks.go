@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/chvapi"
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+const (
+	// maxDataDisks bounds the data disks of a VM.
+	maxDataDisks = 8
+	// bootDiskIDPrefix prefixes the device IDs of the data disks attached at
+	// boot. The VMM picks the IDs of hot-plugged ones.
+	bootDiskIDPrefix = "data"
+
+	opAttachDisk = "attach-disk"
+	opDetachDisk = "detach-disk"
+	// diskHotplugTimeout bounds a disk hot-plug call to the VMM.
+	diskHotplugTimeout = 30 * time.Second
+)
+
+// dataDisk is a disk attached to a VM after its rootfs and stateful disk.
+type dataDisk struct {
+	// ID is the VMM's device ID of the disk, used to detach it.
+	ID       string `json:"id,omitempty"`
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+	// SizeMB is the size the disk is created with if Created is set.
+	SizeMB int32 `json:"sizeMb,omitempty"`
+	// Created is set for disks cbox created, which are deleted along with
+	// the VM. Disks the caller provided are never deleted.
+	Created bool `json:"created,omitempty"`
+}
+
+// planDataDisks validates the data disks of a start request without creating
+// any, so a bad request fails before the VMM is spawned. Disks that don't
+// exist yet are returned with Created set.
+func planDataDisks(disks []serverapi.VmDisk) ([]dataDisk, error) {
+	if len(disks) > maxDataDisks {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("at most %d disks can be attached, got %d", maxDataDisks, len(disks)))
+	}
+	planned := make([]dataDisk, 0, len(disks))
+	seen := make(map[string]bool, len(disks))
+	for _, disk := range disks {
+		diskPath := path.Clean(disk.Path)
+		if !path.IsAbs(disk.Path) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("disk path %q must be absolute", disk.Path))
+		}
+		if seen[diskPath] {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("disk %s is listed twice", diskPath))
+		}
+		seen[diskPath] = true
+
+		planned = append(planned, dataDisk{
+			ID:       fmt.Sprintf("%s%d", bootDiskIDPrefix, len(planned)),
+			Path:     diskPath,
+			Readonly: disk.GetReadonly(),
+		})
+		info, err := os.Stat(diskPath)
+		switch {
+		case err == nil:
+			if !info.Mode().IsRegular() && info.Mode()&os.ModeDevice == 0 {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("disk %s is not a file or block device", diskPath))
+			}
+			continue
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("disk %s: %v", diskPath, err))
+		}
+
+		if disk.GetSizeMb() <= 0 {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("disk %s doesn't exist and has no sizeMb to create it with", diskPath))
+		}
+		if info, err := os.Stat(path.Dir(diskPath)); err != nil || !info.IsDir() {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("disk %s can't be created: %s is not a directory", diskPath, path.Dir(diskPath)))
+		}
+		planned[len(planned)-1].SizeMB = disk.GetSizeMb()
+		planned[len(planned)-1].Created = true
+	}
+	return planned, nil
+}
+
+// createDataDisks creates the planned disks cbox owns. On failure, the disks
+// it created are removed again.
+func createDataDisks(disks []dataDisk) (retErr error) {
+	var created []dataDisk
+	defer func() {
+		if retErr != nil {
+			removeDataDisks(created)
+		}
+	}()
+	for _, disk := range disks {
+		if !disk.Created {
+			continue
+		}
+		// Claimed exclusively so a concurrent start can't format the same
+		// path, nor this one a file created since it was planned.
+		file, err := os.OpenFile(disk.Path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to create disk %s: %w", disk.Path, err)
+		}
+		file.Close()
+		created = append(created, disk)
+		if err := createExt4Disk("data disk", disk.Path, disk.SizeMB); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeDataDisks deletes the disks cbox created, leaving the caller's.
+func removeDataDisks(disks []dataDisk) {
+	for _, disk := range disks {
+		if !disk.Created {
+			continue
+		}
+		if err := os.Remove(disk.Path); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Warnf("failed to remove data disk: %s", disk.Path)
+		}
+	}
+}
+
+// dataDiskConfigs returns the VMM's configs of disks.
+func dataDiskConfigs(disks []dataDisk, numQueues *int32) []chvapi.DiskConfig {
+	configs := make([]chvapi.DiskConfig, 0, len(disks))
+	for _, disk := range disks {
+		configs = append(configs, chvapi.DiskConfig{
+			Id:        String(disk.ID),
+			Path:      disk.Path,
+			Readonly:  Bool(disk.Readonly),
+			NumQueues: numQueues,
+		})
+	}
+	return configs
+}
+
+// apiDisks returns the VM's data disks as reported by the API.
+func (v *vm) apiDisks() []serverapi.VmDisk {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	var disks []serverapi.VmDisk
+	for _, disk := range v.dataDisks {
+		disks = append(disks, disk.api())
+	}
+	return disks
+}
+
+func (d dataDisk) api() serverapi.VmDisk {
+	disk := serverapi.VmDisk{
+		Path:     d.Path,
+		Readonly: serverapi.PtrBool(d.Readonly),
+		Created:  serverapi.PtrBool(d.Created),
+	}
+	if d.ID != "" {
+		disk.Id = serverapi.PtrString(d.ID)
+	}
+	if d.Created {
+		disk.SizeMb = serverapi.PtrInt32(d.SizeMB)
+	}
+	return disk
+}
+
+// AttachDisk hot-plugs an existing disk image or block device into a running
+// VM. The disk is never deleted by cbox.
+func (s *Server) AttachDisk(ctx context.Context, vmName string, req *serverapi.AttachDiskRequest) (*serverapi.VmDisk, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if !path.IsAbs(req.Path) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("disk path %q must be absolute", req.Path))
+	}
+	diskPath := path.Clean(req.Path)
+	info, err := os.Stat(diskPath)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("disk %s: %v", diskPath, err))
+	}
+	if !info.Mode().IsRegular() && info.Mode()&os.ModeDevice == 0 {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("disk %s is not a file or block device", diskPath))
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, diskHotplugTimeout)
+	defer cancel()
+	release, err := vm.gate.acquireExclusive(ctx, vmName, opAttachDisk, diskHotplugTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	if vm.status != vmStatusRunning {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("cannot attach disk to vm %s: vm is %s", vmName, vm.status))
+	}
+	attached := slices.ContainsFunc(vm.dataDisks, func(d dataDisk) bool { return d.Path == diskPath })
+	if attached || diskPath == vm.rootfsPath || diskPath == vm.statefulDiskPath {
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("disk %s is already attached to vm %s", diskPath, vmName))
+	}
+	if len(vm.dataDisks) >= maxDataDisks {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("vm %s already has the maximum of %d disks", vmName, maxDataDisks))
+	}
+
+	device, _, err := vm.apiClient.DefaultAPI.VmAddDiskPut(ctx).DiskConfig(chvapi.DiskConfig{
+		Path:     diskPath,
+		Readonly: Bool(req.GetReadonly()),
+	}).Execute()
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach disk: %w", err)
+	}
+	if device == nil {
+		return nil, fmt.Errorf("failed to attach disk: no device info returned")
+	}
+
+	disk := dataDisk{ID: device.Id, Path: diskPath, Readonly: req.GetReadonly()}
+	vm.dataDisks = append(vm.dataDisks, disk)
+	vm.saveRecordLogged()
+	log.WithFields(log.Fields{
+		"vmName": vmName,
+		"diskId": disk.ID,
+		"path":   disk.Path,
+	}).Info("Attached disk")
+	s.events.Publish(events.TypeVMDiskAttached, vmName, map[string]any{
+		"id":       disk.ID,
+		"path":     disk.Path,
+		"readonly": disk.Readonly,
+	})
+	apiDisk := disk.api()
+	return &apiDisk, nil
+}
+
+// DetachDisk hot-unplugs the data disk with device ID id from a running VM.
+// A disk cbox created is deleted once detached.
+func (s *Server) DetachDisk(ctx context.Context, vmName string, id string) (*serverapi.VMResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, diskHotplugTimeout)
+	defer cancel()
+	release, err := vm.gate.acquireExclusive(ctx, vmName, opDetachDisk, diskHotplugTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	i := slices.IndexFunc(vm.dataDisks, func(d dataDisk) bool { return d.ID == id })
+	if id == "" || i < 0 {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("disk %s not found on vm %s", id, vmName))
+	}
+	if vm.status != vmStatusRunning {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("cannot detach disk from vm %s: vm is %s", vmName, vm.status))
+	}
+
+	resp, err := vm.apiClient.DefaultAPI.VmRemoveDevicePut(ctx).VmRemoveDevice(chvapi.VmRemoveDevice{Id: String(id)}).Execute()
+	if err != nil {
+		return nil, fmt.Errorf("failed to detach disk: %w", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("failed to detach disk. bad status: %v", resp)
+	}
+
+	disk := vm.dataDisks[i]
+	vm.dataDisks = slices.Delete(vm.dataDisks, i, i+1)
+	vm.saveRecordLogged()
+	removeDataDisks([]dataDisk{disk})
+	log.WithFields(log.Fields{
+		"vmName": vmName,
+		"diskId": disk.ID,
+		"path":   disk.Path,
+	}).Info("Detached disk")
+	s.events.Publish(events.TypeVMDiskDetached, vmName, map[string]any{
+		"id":   disk.ID,
+		"path": disk.Path,
+	})
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+		Message: serverapi.PtrString(fmt.Sprintf("disk %s detached", id)),
+	}, nil
+}
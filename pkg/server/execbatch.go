@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+	"github.com/abilashraghuram/cbox/pkg/faults"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
+)
+
+const (
+	defaultExecBatchTimeout = 60 * time.Second
+	maxExecBatchTimeout     = 10 * time.Minute
+	maxExecBatchCmds        = 10000
+	// execBatchMaxOutputBytes caps the combined output in a batch response.
+	execBatchMaxOutputBytes = 8 * 1024 * 1024
+	// execBatchResponseMargin is how much longer than the batch timeout the
+	// host waits for the guest's response, so partial results make it back.
+	execBatchResponseMargin = 10 * time.Second
+)
+
+// VMExecBatch runs a list of commands in a VM, in order, with a single request
+// to its cmdserver.
+func (s *Server) VMExecBatch(ctx context.Context, vmName string, req *serverapi.VmExecBatchRequest) (*serverapi.VmExecBatchResponse, error) {
+	return s.execBatch(ctx, vmName, req, execBatchMaxOutputBytes)
+}
+
+// execBatch implements VMExecBatch, capping the combined output of the
+// batch at maxOutputBytes.
+func (s *Server) execBatch(ctx context.Context, vmName string, req *serverapi.VmExecBatchRequest, maxOutputBytes int) (*serverapi.VmExecBatchResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return nil, err
+	}
+	if err := s.faults.Apply(ctx, faults.PointExec, vmName); err != nil {
+		return nil, err
+	}
+	release, err := vm.gate.acquireShared(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if len(req.Cmds) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "cmds must not be empty")
+	}
+	if len(req.Cmds) > maxExecBatchCmds {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("batch has %d commands, max is %d", len(req.Cmds), maxExecBatchCmds))
+	}
+	if req.GetWorkspace() != "" {
+		if err := cmdserver.ValidateWorkspaceName(req.GetWorkspace()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	timeout := defaultExecBatchTimeout
+	if req.GetTimeoutSeconds() > 0 {
+		timeout = time.Duration(req.GetTimeoutSeconds()) * time.Second
+	}
+	if timeout > maxExecBatchTimeout {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("timeoutSeconds must be at most %d", int(maxExecBatchTimeout.Seconds())))
+	}
+
+	event := s.startExecEvent(ctx, vmName, execKindBatch)
+	resp, err := s.runExecBatch(ctx, vm, req, timeout, maxOutputBytes)
+	event.finish(execBatchResultData(resp), err)
+	return resp, err
+}
+
+// execBatchResultData returns the result of a batch for its
+// vm.exec_finished event.
+func execBatchResultData(resp *serverapi.VmExecBatchResponse) map[string]any {
+	if resp == nil {
+		return nil
+	}
+	exitCodes := make([]int32, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		exitCodes = append(exitCodes, result.GetExitCode())
+	}
+	return map[string]any{"timedOut": resp.GetTimedOut(), "exitCodes": exitCodes}
+}
+
+// runExecBatch runs a validated batch.
+func (s *Server) runExecBatch(ctx context.Context, vm *vm, req *serverapi.VmExecBatchRequest, timeout time.Duration, maxOutputBytes int) (*serverapi.VmExecBatchResponse, error) {
+	if req.GetWorkspace() != "" {
+		if err := vm.requireAgentFeature(ctx, agentCmdServer, featureWorkspaces); err != nil {
+			return nil, err
+		}
+	}
+	batchSupported, err := vm.agentFeature(ctx, agentCmdServer, featureExecBatch)
+	if err != nil {
+		return nil, err
+	}
+	if !batchSupported {
+		return s.execBatchSequential(ctx, vm, req, timeout, maxOutputBytes)
+	}
+
+	body, err := json.Marshal(cmdserver.RunCmdBatchRequest{
+		Cmds:           req.Cmds,
+		TimeoutMs:      timeout.Milliseconds(),
+		StopOnError:    req.GetStopOnError(),
+		Workspace:      req.GetWorkspace(),
+		MaxOutputBytes: maxOutputBytes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	url := "http://" + cmdServerAddr(vm.ip.IP.String()) + "/cmd-batch"
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	requestid.SetHeader(httpReq)
+
+	client := &http.Client{Timeout: timeout + execBatchResponseMargin, Transport: s.execTransport(ctx, vm)}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusBadRequest {
+			return nil, status.Error(codes.InvalidArgument, string(msg))
+		}
+		return nil, fmt.Errorf("request failed with status: %d: %s", resp.StatusCode, string(msg))
+	}
+
+	var guestResp cmdserver.RunCmdBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&guestResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	apiResp := &serverapi.VmExecBatchResponse{
+		Results:  []serverapi.VmExecBatchResult{},
+		TimedOut: serverapi.PtrBool(guestResp.TimedOut),
+	}
+	for _, result := range guestResp.Results {
+		apiResp.Results = append(apiResp.Results, serverapi.VmExecBatchResult{
+			Cmd:        serverapi.PtrString(result.Cmd),
+			Output:     serverapi.PtrString(result.Output),
+			Error:      serverapi.PtrString(result.Error),
+			ExitCode:   serverapi.PtrInt32(int32(result.ExitCode)),
+			DurationMs: serverapi.PtrInt64(result.DurationMs),
+			Truncated:  serverapi.PtrBool(result.Truncated),
+		})
+	}
+	return apiResp, nil
+}
+
+// execBatchSequential runs a batch with one /cmd request per command, for
+// cmdservers without cmd-batch. Failed commands get -1 from agents whose
+// /cmd doesn't report exit codes.
+func (s *Server) execBatchSequential(ctx context.Context, vm *vm, req *serverapi.VmExecBatchRequest, timeout time.Duration, maxOutputBytes int) (*serverapi.VmExecBatchResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	url := "http://" + cmdServerAddr(vm.ip.IP.String())
+	client := &http.Client{Transport: s.execTransport(ctx, vm)}
+	perCmdOutput := maxOutputBytes / len(req.Cmds)
+
+	apiResp := &serverapi.VmExecBatchResponse{
+		Results:  []serverapi.VmExecBatchResult{},
+		TimedOut: serverapi.PtrBool(false),
+	}
+	for _, cmd := range req.Cmds {
+		start := time.Now()
+		resp, err := vm.handleExec(ctx, client, url, cmdserver.RunCmdRequest{
+			Cmd:       cmd,
+			Blocking:  true,
+			Workspace: req.GetWorkspace(),
+		})
+		if ctx.Err() != nil {
+			apiResp.TimedOut = serverapi.PtrBool(true)
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		output := resp.GetOutput()
+		truncated := len(output) > perCmdOutput
+		if truncated {
+			output = output[:perCmdOutput]
+		}
+		exitCode := resp.GetExitCode()
+		if !resp.HasExitCode() && resp.GetError() != "" {
+			exitCode = -1
+		}
+		apiResp.Results = append(apiResp.Results, serverapi.VmExecBatchResult{
+			Cmd:        serverapi.PtrString(cmd),
+			Output:     serverapi.PtrString(output),
+			Error:      serverapi.PtrString(resp.GetError()),
+			ExitCode:   serverapi.PtrInt32(exitCode),
+			DurationMs: serverapi.PtrInt64(time.Since(start).Milliseconds()),
+			Truncated:  serverapi.PtrBool(truncated),
+		})
+		if exitCode != 0 && req.GetStopOnError() {
+			break
+		}
+	}
+	return apiResp, nil
+}
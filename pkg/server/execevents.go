@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/abilashraghuram/cbox/pkg/events"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
+)
+
+// Exec kinds reported in exec events.
+const (
+	execKindExec   = "exec"
+	execKindBatch  = "batch"
+	execKindStream = "stream"
+)
+
+// execEvent publishes the vm.exec_started and vm.exec_finished events of a
+// command. Commands aren't included since they can carry secrets; the
+// request ID correlates the events with the request's logs.
+type execEvent struct {
+	s       *Server
+	vmName  string
+	data    map[string]any
+	started time.Time
+}
+
+// startExecEvent publishes vm.exec_started for a command of the given kind.
+func (s *Server) startExecEvent(ctx context.Context, vmName string, kind string) *execEvent {
+	data := map[string]any{"kind": kind}
+	if id := requestid.FromContext(ctx); id != "" {
+		data[requestid.Field] = id
+	}
+	s.events.Publish(events.TypeVMExecStarted, vmName, data)
+	return &execEvent{s: s, vmName: vmName, data: data, started: time.Now()}
+}
+
+// finish publishes vm.exec_finished with the command's duration, err if it
+// failed, and result, which may be nil.
+func (e *execEvent) finish(result map[string]any, err error) {
+	data := map[string]any{"durationMs": time.Since(e.started).Milliseconds()}
+	for k, v := range e.data {
+		data[k] = v
+	}
+	for k, v := range result {
+		data[k] = v
+	}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	e.s.events.Publish(events.TypeVMExecFinished, e.vmName, data)
+}
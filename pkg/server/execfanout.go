@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+const (
+	defaultFanOutConcurrency = 16
+	maxFanOutConcurrency     = 64
+	// fanOutMaxOutputBytes caps each VM's output in a fan-out response.
+	fanOutMaxOutputBytes = 64 * 1024
+
+	fanOutSucceeded = "succeeded"
+	fanOutFailed    = "failed"
+	fanOutError     = "error"
+	fanOutSkipped   = "skipped"
+	fanOutCancelled = "cancelled"
+	fanOutStarted   = "started"
+)
+
+// fanOutTargets resolves the VMs a fan-out runs in, sorted by name.
+func (s *Server) fanOutTargets(req *serverapi.ExecFanOutRequest) ([]string, error) {
+	if (req.GetLabelSelector() == "") == (len(req.VmNames) == 0) {
+		return nil, status.Error(codes.InvalidArgument, "exactly one of labelSelector and vmNames is required")
+	}
+	if len(req.VmNames) > 0 {
+		names := slices.Clone(req.VmNames)
+		sort.Strings(names)
+		return slices.Compact(names), nil
+	}
+
+	selector, err := parseLabelSelector(req.GetLabelSelector())
+	if err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var names []string
+	for name, vm := range s.vms {
+		if selector.matches(vm.labels) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ExecFanOut runs a command in every VM matching a label selector or in each
+// of a list of VMs, at most maxParallel at a time. VMs that aren't running
+// are skipped. With failFast, the first failure cancels the execs still
+// running and those not started yet. Non-blocking requests only start the
+// command as a job in each VM. Per-VM failures are reported in the results,
+// which are returned both as a list and keyed by VM name, rather than as an
+// error.
+func (s *Server) ExecFanOut(ctx context.Context, req *serverapi.ExecFanOutRequest) (*serverapi.ExecFanOutResponse, error) {
+	if req.Cmd == "" {
+		return nil, status.Error(codes.InvalidArgument, "cmd must not be empty")
+	}
+	if req.GetWorkspace() != "" {
+		if err := cmdserver.ValidateWorkspaceName(req.GetWorkspace()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if time.Duration(req.GetTimeoutSeconds())*time.Second > maxExecBatchTimeout {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("timeoutSeconds must be at most %d", int(maxExecBatchTimeout.Seconds())))
+	}
+	// concurrency is the older name of maxParallel.
+	if req.HasMaxParallel() && req.HasConcurrency() && req.GetMaxParallel() != req.GetConcurrency() {
+		return nil, status.Error(codes.InvalidArgument, "maxParallel and concurrency are the same setting and must not differ")
+	}
+	concurrency := int(req.GetMaxParallel())
+	if !req.HasMaxParallel() {
+		concurrency = int(req.GetConcurrency())
+	}
+	if concurrency <= 0 {
+		concurrency = defaultFanOutConcurrency
+	}
+	if concurrency > maxFanOutConcurrency {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("maxParallel must be at most %d", maxFanOutConcurrency))
+	}
+	blocking := !req.HasBlocking() || req.GetBlocking()
+	targets, err := s.fanOutTargets(req)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	batchReq := &serverapi.VmExecBatchRequest{
+		Cmds:           []string{req.Cmd},
+		TimeoutSeconds: req.TimeoutSeconds,
+		Workspace:      req.Workspace,
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]serverapi.ExecFanOutResult, len(targets))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, name := range targets {
+		results[i].VmName = serverapi.PtrString(name)
+		if reason := s.fanOutSkipReason(ctx, name); reason != "" {
+			results[i].Status = serverapi.PtrString(fanOutSkipped)
+			results[i].Error = serverapi.PtrString(reason)
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Status = serverapi.PtrString(fanOutCancelled)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if blocking {
+				s.fanOutExec(ctx, name, batchReq, &results[i])
+			} else {
+				s.fanOutStart(ctx, name, req, &results[i])
+			}
+			if req.GetFailFast() && (results[i].GetStatus() == fanOutFailed || results[i].GetStatus() == fanOutError) {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	summary := &serverapi.ExecFanOutSummary{
+		Targets:    serverapi.PtrInt32(int32(len(targets))),
+		DurationMs: serverapi.PtrInt64(time.Since(start).Milliseconds()),
+	}
+	counts := make(map[string]int32)
+	for _, result := range results {
+		counts[result.GetStatus()]++
+	}
+	summary.Succeeded = serverapi.PtrInt32(counts[fanOutSucceeded])
+	summary.Failed = serverapi.PtrInt32(counts[fanOutFailed])
+	summary.Errors = serverapi.PtrInt32(counts[fanOutError])
+	summary.Skipped = serverapi.PtrInt32(counts[fanOutSkipped])
+	summary.Cancelled = serverapi.PtrInt32(counts[fanOutCancelled])
+	summary.Started = serverapi.PtrInt32(counts[fanOutStarted])
+	byVM := make(map[string]serverapi.ExecFanOutResult, len(results))
+	for _, result := range results {
+		byVM[result.GetVmName()] = result
+	}
+	return &serverapi.ExecFanOutResponse{Results: results, Vms: &byVM, Summary: summary}, nil
+}
+
+// fanOutSkipReason returns why vmName can't run a fan-out exec, or "" if it
+// can. VMs leased to someone else are skipped.
+func (s *Server) fanOutSkipReason(ctx context.Context, vmName string) string {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return fmt.Sprintf("vm not found: %s", vmName)
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return err.Error()
+	}
+	vm.lock.RLock()
+	defer vm.lock.RUnlock()
+	if vm.status != vmStatusRunning && vm.status != vmStatusFailedProvisioning {
+		return fmt.Sprintf("vm is %s", vm.status)
+	}
+	return ""
+}
+
+// fanOutExec runs batchReq's single command in vmName and fills in result.
+// The exec takes one of the VM's max_concurrent_execs_per_vm slots, like
+// VMExec, waiting for one for as long as ctx lasts.
+func (s *Server) fanOutExec(ctx context.Context, vmName string, batchReq *serverapi.VmExecBatchRequest, result *serverapi.ExecFanOutResult) {
+	start := time.Now()
+	resp, err := s.execBatchLimited(ctx, vmName, batchReq)
+	if err != nil {
+		result.DurationMs = serverapi.PtrInt64(time.Since(start).Milliseconds())
+		result.Error = serverapi.PtrString(err.Error())
+		if ctx.Err() != nil {
+			result.Status = serverapi.PtrString(fanOutCancelled)
+		} else {
+			result.Status = serverapi.PtrString(fanOutError)
+		}
+		return
+	}
+	if len(resp.Results) == 0 {
+		result.DurationMs = serverapi.PtrInt64(time.Since(start).Milliseconds())
+		result.Status = serverapi.PtrString(fanOutFailed)
+		result.Error = serverapi.PtrString("command timed out before it ran")
+		return
+	}
+
+	cmdResult := resp.Results[0]
+	result.Output = cmdResult.Output
+	result.Truncated = cmdResult.Truncated
+	result.ExitCode = cmdResult.ExitCode
+	result.DurationMs = cmdResult.DurationMs
+	if cmdResult.GetError() != "" || cmdResult.GetExitCode() != 0 {
+		result.Status = serverapi.PtrString(fanOutFailed)
+		if cmdResult.GetError() != "" {
+			result.Error = cmdResult.Error
+		}
+		return
+	}
+	result.Status = serverapi.PtrString(fanOutSucceeded)
+}
+
+// fanOutStart starts req's command as a background job in vmName and fills
+// in result with its job.
+func (s *Server) fanOutStart(ctx context.Context, vmName string, req *serverapi.ExecFanOutRequest, result *serverapi.ExecFanOutResult) {
+	start := time.Now()
+	execReq := &serverapi.VmExecRequest{
+		Cmd:       req.Cmd,
+		Blocking:  serverapi.PtrBool(false),
+		Workspace: req.Workspace,
+	}
+	if req.HasTimeoutSeconds() {
+		execReq.TimeoutSeconds = serverapi.PtrInt32(req.GetTimeoutSeconds())
+	}
+	resp, err := s.VMExec(ctx, vmName, execReq)
+	result.DurationMs = serverapi.PtrInt64(time.Since(start).Milliseconds())
+	if err != nil {
+		result.Error = serverapi.PtrString(err.Error())
+		if ctx.Err() != nil {
+			result.Status = serverapi.PtrString(fanOutCancelled)
+		} else {
+			result.Status = serverapi.PtrString(fanOutError)
+		}
+		return
+	}
+	result.Status = serverapi.PtrString(fanOutStarted)
+	result.JobId = resp.JobId
+}
+
+// execBatchLimited runs batchReq in vmName once the VM has an exec slot.
+func (s *Server) execBatchLimited(ctx context.Context, vmName string, batchReq *serverapi.VmExecBatchRequest) (*serverapi.VmExecBatchResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	release, err := vm.execs.acquire(ctx, vmName, s.config.MaxConcurrentExecsPerVM, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.execBatch(ctx, vmName, batchReq, fanOutMaxOutputBytes)
+}
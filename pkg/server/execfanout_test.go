@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+)
+
+func TestExecFanOutValidation(t *testing.T) {
+	s := &Server{vms: map[string]*vm{}}
+	for name, req := range map[string]*serverapi.ExecFanOutRequest{
+		"no cmd":                 {VmNames: []string{"a"}},
+		"no targets":             {Cmd: "true"},
+		"both targets":           {Cmd: "true", VmNames: []string{"a"}, LabelSelector: serverapi.PtrString("x=y")},
+		"maxParallel too large":  {Cmd: "true", VmNames: []string{"a"}, MaxParallel: serverapi.PtrInt32(maxFanOutConcurrency + 1)},
+		"concurrency too large":  {Cmd: "true", VmNames: []string{"a"}, Concurrency: serverapi.PtrInt32(maxFanOutConcurrency + 1)},
+		"conflicting parallel":   {Cmd: "true", VmNames: []string{"a"}, MaxParallel: serverapi.PtrInt32(2), Concurrency: serverapi.PtrInt32(3)},
+		"invalid workspace name": {Cmd: "true", VmNames: []string{"a"}, Workspace: serverapi.PtrString("../x")},
+	} {
+		_, err := s.ExecFanOut(context.Background(), req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: ExecFanOut = %v, want InvalidArgument", name, err)
+		}
+	}
+
+	same := &serverapi.ExecFanOutRequest{
+		Cmd:         "true",
+		VmNames:     []string{"a"},
+		MaxParallel: serverapi.PtrInt32(2),
+		Concurrency: serverapi.PtrInt32(2),
+	}
+	if _, err := s.ExecFanOut(context.Background(), same); err != nil {
+		t.Errorf("ExecFanOut with maxParallel equal to concurrency = %v", err)
+	}
+}
+
+func TestExecFanOutResultsByVM(t *testing.T) {
+	s := &Server{vms: map[string]*vm{}}
+	resp, err := s.ExecFanOut(context.Background(), &serverapi.ExecFanOutRequest{
+		Cmd:     "true",
+		VmNames: []string{"b", "a", "b"},
+	})
+	if err != nil {
+		t.Fatalf("ExecFanOut: %v", err)
+	}
+	if len(resp.Results) != 2 || resp.Results[0].GetVmName() != "a" || resp.Results[1].GetVmName() != "b" {
+		t.Fatalf("results = %+v, want a and b once each, sorted", resp.Results)
+	}
+	byVM := resp.GetVms()
+	if len(byVM) != 2 {
+		t.Fatalf("vms has %d entries, want 2", len(byVM))
+	}
+	for _, name := range []string{"a", "b"} {
+		result := byVM[name]
+		if got := result.GetStatus(); got != fanOutSkipped {
+			t.Errorf("vms[%s].status = %q, want %q for a missing VM", name, got, fanOutSkipped)
+		}
+	}
+	if resp.Summary.GetSkipped() != 2 {
+		t.Errorf("summary.skipped = %d, want 2", resp.Summary.GetSkipped())
+	}
+}
+
+func TestExecFanOutOnVMs(t *testing.T) {
+	h := newTestHarness(t, nil)
+	names := []string{"vm1", "vm2", "vm3"}
+	for _, name := range names {
+		h.startVM(name)
+	}
+	ip := func(name string) string { return h.server.getVMAtomic(name).ip.IP.String() }
+
+	resp, err := h.server.ExecFanOut(context.Background(), &serverapi.ExecFanOutRequest{
+		Cmd:         "uptime",
+		VmNames:     names,
+		MaxParallel: serverapi.PtrInt32(2),
+	})
+	if err != nil {
+		t.Fatalf("blocking ExecFanOut: %v", err)
+	}
+	byVM := resp.GetVms()
+	for _, name := range names {
+		result := byVM[name]
+		if result.GetStatus() != fanOutSucceeded || result.GetOutput() != ip(name)+" ran uptime" {
+			t.Errorf("vms[%s] = %s with output %q, want it to succeed on its own guest", name, result.GetStatus(), result.GetOutput())
+		}
+		if result.HasJobId() {
+			t.Errorf("vms[%s].jobId = %q for a blocking command", name, result.GetJobId())
+		}
+	}
+	if resp.Summary.GetSucceeded() != 3 {
+		t.Errorf("summary.succeeded = %d, want 3", resp.Summary.GetSucceeded())
+	}
+
+	resp, err = h.server.ExecFanOut(context.Background(), &serverapi.ExecFanOutRequest{
+		Cmd:      "sleep 60",
+		VmNames:  append(names, "missing"),
+		Blocking: serverapi.PtrBool(false),
+	})
+	if err != nil {
+		t.Fatalf("non-blocking ExecFanOut: %v", err)
+	}
+	byVM = resp.GetVms()
+	for _, name := range names {
+		result := byVM[name]
+		if result.GetStatus() != fanOutStarted || result.GetJobId() != "job-1" {
+			t.Errorf("vms[%s] = %s with job %q, want started as job-1", name, result.GetStatus(), result.GetJobId())
+		}
+		if cmds := guestFor(ip(name)).ranCmds(); !slices.Equal(cmds, []string{"uptime", "sleep 60"}) {
+			t.Errorf("guest of %s ran %v", name, cmds)
+		}
+	}
+	if result := byVM["missing"]; result.GetStatus() != fanOutSkipped {
+		t.Errorf("vms[missing] = %s, want %s", result.GetStatus(), fanOutSkipped)
+	}
+	if resp.Summary.GetStarted() != 3 || resp.Summary.GetSkipped() != 1 {
+		t.Errorf("summary = %d started, %d skipped; want 3 and 1", resp.Summary.GetStarted(), resp.Summary.GetSkipped())
+	}
+}
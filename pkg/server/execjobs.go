@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+// ListExecJobs returns the non-blocking exec jobs cmdserver still keeps in a
+// VM.
+func (s *Server) ListExecJobs(ctx context.Context, vmName string) (*serverapi.ListExecJobsResponse, error) {
+	var guestResp cmdserver.ListJobsResponse
+	if err := s.execJobsRequest(ctx, vmName, http.MethodGet, "/jobs", &guestResp); err != nil {
+		return nil, err
+	}
+
+	resp := &serverapi.ListExecJobsResponse{
+		Jobs: []serverapi.ExecJob{},
+	}
+	for _, job := range guestResp.Jobs {
+		resp.Jobs = append(resp.Jobs, *apiExecJob(job))
+	}
+	return resp, nil
+}
+
+// GetExecJob returns a non-blocking exec job in a VM.
+func (s *Server) GetExecJob(ctx context.Context, vmName string, jobID string) (*serverapi.ExecJob, error) {
+	if jobID == "" {
+		return nil, status.Error(codes.InvalidArgument, "job id is required")
+	}
+	var job cmdserver.Job
+	if err := s.execJobsRequest(ctx, vmName, http.MethodGet, "/jobs/"+url.PathEscape(jobID), &job); err != nil {
+		return nil, err
+	}
+	return apiExecJob(job), nil
+}
+
+// KillExecJob kills a non-blocking exec job in a VM and returns its final
+// state. Jobs that already finished are returned as they are.
+func (s *Server) KillExecJob(ctx context.Context, vmName string, jobID string) (*serverapi.ExecJob, error) {
+	if jobID == "" {
+		return nil, status.Error(codes.InvalidArgument, "job id is required")
+	}
+	var job cmdserver.Job
+	if err := s.execJobsRequest(ctx, vmName, http.MethodDelete, "/jobs/"+url.PathEscape(jobID), &job); err != nil {
+		return nil, err
+	}
+	return apiExecJob(job), nil
+}
+
+// execJobsRequest sends a method request for path to a VM's cmdserver and
+// decodes the response into resp.
+func (s *Server) execJobsRequest(ctx context.Context, vmName string, method string, path string, resp any) error {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return err
+	}
+
+	release, err := vm.gate.acquireShared(ctx, vmName)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := vm.requireAgentFeature(ctx, agentCmdServer, featureExecJobs); err != nil {
+		return err
+	}
+	body, err := vm.cmdServerRequest(ctx, method, path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, resp); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+func apiExecJob(job cmdserver.Job) *serverapi.ExecJob {
+	resp := &serverapi.ExecJob{
+		Id:        serverapi.PtrString(job.ID),
+		Cmd:       serverapi.PtrString(job.Cmd),
+		Workspace: serverapi.PtrString(job.Workspace),
+		State:     serverapi.PtrString(job.State),
+		Output:    serverapi.PtrString(job.Output),
+		Truncated: serverapi.PtrBool(job.Truncated),
+		Error:     serverapi.PtrString(job.Error),
+		TimedOut:  serverapi.PtrBool(job.TimedOut),
+		Killed:    serverapi.PtrBool(job.Killed),
+		StartedAt: serverapi.PtrTime(job.StartedAt),
+	}
+	if job.ExitCode != nil {
+		resp.ExitCode = serverapi.PtrInt32(int32(*job.ExitCode))
+	}
+	if job.EndedAt != nil {
+		resp.EndedAt = serverapi.PtrTime(*job.EndedAt)
+	}
+	return resp
+}
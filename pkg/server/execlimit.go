@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// execLimiter bounds how many execs run in a VM at once, queueing the rest
+// in arrival order. The zero value is ready to use.
+type execLimiter struct {
+	lock     sync.Mutex
+	inFlight int
+	// queue holds a channel per waiting exec, closed when it's handed a
+	// slot.
+	queue []chan struct{}
+}
+
+// acquire takes one of limit slots, waiting for one if they're all in use,
+// for up to queueTimeout if it's positive. A limit of zero or less only
+// counts the exec. The returned function gives the slot back.
+func (l *execLimiter) acquire(ctx context.Context, vmName string, limit int, queueTimeout time.Duration) (func(), error) {
+	l.lock.Lock()
+	if limit <= 0 || (l.inFlight < limit && len(l.queue) == 0) {
+		l.inFlight++
+		l.lock.Unlock()
+		return sync.OnceFunc(l.release), nil
+	}
+	ready := make(chan struct{})
+	l.queue = append(l.queue, ready)
+	l.lock.Unlock()
+
+	waitCtx := ctx
+	if queueTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, queueTimeout)
+		defer cancel()
+	}
+	select {
+	case <-ready:
+		return sync.OnceFunc(l.release), nil
+	case <-waitCtx.Done():
+	}
+
+	l.lock.Lock()
+	if i := slices.Index(l.queue, ready); i >= 0 {
+		l.queue = slices.Delete(l.queue, i, i+1)
+		l.lock.Unlock()
+	} else {
+		// Handed a slot while giving up, so it has to be passed on.
+		l.lock.Unlock()
+		l.release()
+	}
+	if ctx.Err() == nil && errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+		return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("vm %s is running %d execs, the most it runs at once, and none finished within %s", vmName, limit, queueTimeout))
+	}
+	return nil, waitCtx.Err()
+}
+
+// release hands the slot of a finished exec to the longest waiting one, or
+// frees it.
+func (l *execLimiter) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.queue) > 0 {
+		close(l.queue[0])
+		l.queue = l.queue[1:]
+		return
+	}
+	l.inFlight--
+}
+
+// counts returns the number of running and queued execs.
+func (l *execLimiter) counts() (inFlight int, queued int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.inFlight, len(l.queue)
+}
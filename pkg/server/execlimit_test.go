@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// queueExec starts acquiring a slot of l and waits until it's queued. The
+// result is sent on the returned channel.
+func queueExec(t *testing.T, ctx context.Context, l *execLimiter, limit int, queueTimeout time.Duration) <-chan error {
+	t.Helper()
+	_, queuedBefore := l.counts()
+	result := make(chan error, 1)
+	go func() {
+		_, err := l.acquire(ctx, "vm1", limit, queueTimeout)
+		result <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, queued := l.counts(); queued > queuedBefore {
+			return result
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("exec wasn't queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// checkCounts checks l's running and queued execs.
+func checkCounts(t *testing.T, l *execLimiter, wantInFlight int, wantQueued int) {
+	t.Helper()
+	if inFlight, queued := l.counts(); inFlight != wantInFlight || queued != wantQueued {
+		t.Errorf("counts = %d running, %d queued, want %d, %d", inFlight, queued, wantInFlight, wantQueued)
+	}
+}
+
+func TestExecLimiterHandsOffInOrder(t *testing.T) {
+	var l execLimiter
+	release, err := l.acquire(context.Background(), "vm1", 1, 0)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	// Each finished exec hands its slot to the longest waiting one.
+	var order []int
+	done := make(chan int)
+	var wg sync.WaitGroup
+	for i := range 3 {
+		ready := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			close(ready)
+			release, err := l.acquire(context.Background(), "vm1", 1, 0)
+			if err != nil {
+				t.Errorf("queued acquire: %v", err)
+			}
+			done <- i
+			release()
+		}()
+		<-ready
+		// Queued before the next one starts.
+		for _, queued := l.counts(); queued != i+1; _, queued = l.counts() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	checkCounts(t, &l, 1, 3)
+	release()
+	for range 3 {
+		order = append(order, <-done)
+	}
+	wg.Wait()
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("execs ran in order %v, want arrival order", order)
+		}
+	}
+	// Giving a slot back twice only frees it once.
+	release()
+	checkCounts(t, &l, 0, 0)
+}
+
+func TestExecLimiterCancelFreesQueueSlot(t *testing.T) {
+	var l execLimiter
+	release, err := l.acquire(context.Background(), "vm1", 1, 0)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := queueExec(t, ctx, &l, 1, 0)
+	later := queueExec(t, context.Background(), &l, 1, 0)
+
+	// A client that goes away leaves the queue, and the one behind it is
+	// next.
+	cancel()
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled acquire = %v, want Canceled", err)
+	}
+	checkCounts(t, &l, 1, 1)
+	release()
+	if err := <-later; err != nil {
+		t.Errorf("acquire behind the cancelled one: %v", err)
+	}
+	checkCounts(t, &l, 1, 0)
+}
+
+func TestExecLimiterQueueTimeout(t *testing.T) {
+	var l execLimiter
+	release, err := l.acquire(context.Background(), "vm1", 2, 0)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer release()
+	if _, err := l.acquire(context.Background(), "vm1", 2, 0); err != nil {
+		t.Fatalf("second acquire: %v", err)
+	}
+
+	start := time.Now()
+	_, err = l.acquire(context.Background(), "vm1", 2, 50*time.Millisecond)
+	// ResourceExhausted is what the REST API answers 429 for.
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("acquire past the queue timeout = %v, want ResourceExhausted", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("acquire gave up after %s, before the queue timeout", elapsed)
+	}
+	checkCounts(t, &l, 2, 0)
+
+	// A caller's own deadline isn't reported as the queue timing out.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx, "vm1", 2, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire past the caller's deadline = %v, want DeadlineExceeded", err)
+	}
+	checkCounts(t, &l, 2, 0)
+}
+
+func TestExecLimiterUnlimited(t *testing.T) {
+	var l execLimiter
+	var releases []func()
+	for range 5 {
+		release, err := l.acquire(context.Background(), "vm1", 0, time.Millisecond)
+		if err != nil {
+			t.Fatalf("acquire without a limit: %v", err)
+		}
+		releases = append(releases, release)
+	}
+	checkCounts(t, &l, 5, 0)
+	for _, release := range releases {
+		release()
+	}
+	checkCounts(t, &l, 0, 0)
+}
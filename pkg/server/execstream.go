@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/faults"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
+)
+
+// execStream is a streamed command's output. Closing it lets go of the VM.
+type execStream struct {
+	io.ReadCloser
+	release func()
+	event   *execEvent
+}
+
+func (st *execStream) Close() error {
+	err := st.ReadCloser.Close()
+	st.release()
+	st.event.finish(nil, nil)
+	return err
+}
+
+// VMExecStream runs a command like VMExec, but returns its output as
+// cmdserver writes it: newline-delimited cmdserver.StreamRecords, the last
+// of which holds the exit code. The command is killed if ctx is done or the
+// stream is closed before it finishes. The caller must close the stream.
+func (s *Server) VMExecStream(ctx context.Context, vmName string, req *serverapi.VmExecRequest) (io.ReadCloser, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return nil, err
+	}
+	if err := s.faults.Apply(ctx, faults.PointExec, vmName); err != nil {
+		return nil, err
+	}
+	release, err := vm.gate.acquireShared(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	event := s.startExecEvent(ctx, vmName, execKindStream)
+	body, err := s.openExecStream(ctx, vm, req)
+	if err != nil {
+		release()
+		event.finish(nil, err)
+		return nil, err
+	}
+	return &execStream{ReadCloser: body, release: release, event: event}, nil
+}
+
+func (s *Server) openExecStream(ctx context.Context, vm *vm, req *serverapi.VmExecRequest) (io.ReadCloser, error) {
+	if err := vm.requireAgentFeature(ctx, agentCmdServer, featureExecStream); err != nil {
+		return nil, err
+	}
+	if req.GetTransport() == config.ExecTransportVsock {
+		return nil, status.Error(codes.InvalidArgument, "streamed commands can't use the vsock transport")
+	}
+	if req.GetOutputEncoding() == cmdserver.OutputEncodingBase64 {
+		return nil, status.Error(codes.InvalidArgument, "streamed commands don't support base64 output")
+	}
+	cmdReq, _, err := vm.execRequest(ctx, req, agentCmdServer)
+	if err != nil {
+		return nil, err
+	}
+	cmdReq.Stream = true
+
+	// Streams last as long as their command, so there's no client timeout.
+	// They aren't recorded either, since recordings hold whole responses.
+	url := "http://" + cmdServerAddr(vm.ip.IP.String()) + "/cmd"
+	client := &http.Client{}
+	body, err := vm.execStreamRequest(ctx, client, url, cmdReq)
+	// As in VMExec, a refused connection means the command never ran.
+	if err == nil || !errors.Is(err, syscall.ECONNREFUSED) || s.config.DisableAgentAutoRecovery {
+		return body, err
+	}
+	if recoverErr := s.recoverCmdServer(ctx, vm); recoverErr != nil {
+		log.WithField("vmName", vm.name).WithError(recoverErr).Warn("cmdserver recovery failed")
+		return nil, err
+	}
+	return vm.execStreamRequest(ctx, client, url, cmdReq)
+}
+
+func (v *vm) execStreamRequest(ctx context.Context, client *http.Client, url string, reqBody cmdserver.RunCmdRequest) (io.ReadCloser, error) {
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	requestid.SetHeader(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, execStatusError(resp)
+	}
+	return resp.Body, nil
+}
+
+// execStatusError returns the error for a cmdserver /cmd response other
+// than 200. Requests cmdserver rejects, such as for a cwd that doesn't exist
+// or an unknown user, carry the reason in their body.
+func execStatusError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	msg := strings.TrimSpace(string(body))
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		return status.Error(codes.InvalidArgument, msg)
+	case http.StatusForbidden:
+		return status.Error(codes.PermissionDenied, msg)
+	default:
+		return fmt.Errorf("request failed with status: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+// readRecord reads the next record of a streamed command.
+func readRecord(t *testing.T, reader *bufio.Reader) cmdserver.StreamRecord {
+	t.Helper()
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("reading stream record: %v", err)
+	}
+	var rec cmdserver.StreamRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		t.Fatalf("stream record %q: %v", line, err)
+	}
+	return rec
+}
+
+// waitForStreams waits until the guest of vmName runs want streamed
+// commands.
+func waitForStreams(t *testing.T, h *testHarness, vmName string, want int) {
+	t.Helper()
+	guest := guestFor(h.server.getVMAtomic(vmName).ip.IP.String())
+	deadline := time.Now().Add(5 * time.Second)
+	for guest.runningStreams() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("guest runs %d streamed commands, want %d", guest.runningStreams(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestVMExecStream(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	stream, err := h.server.VMExecStream(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "exit 3"})
+	if err != nil {
+		t.Fatalf("VMExecStream: %v", err)
+	}
+	reader := bufio.NewReader(stream)
+	ip := h.server.getVMAtomic("vm1").ip.IP.String()
+	if rec := readRecord(t, reader); rec.Stream != cmdserver.StreamStdout || rec.Data != ip+" ran exit 3\n" || rec.Done {
+		t.Errorf("first record = %+v, want the command's output", rec)
+	}
+	// The stream ends with a record carrying the exit code.
+	if rec := readRecord(t, reader); !rec.Done || rec.ExitCode == nil || *rec.ExitCode != 3 {
+		t.Errorf("final record = %+v, want exit code 3", rec)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("read past the final record = %v, want EOF", err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if cmds := guestFor(ip).ranCmds(); len(cmds) != 1 || cmds[0] != "exit 3" {
+		t.Errorf("guest ran %v", cmds)
+	}
+}
+
+func TestVMExecStreamKilledOnDisconnect(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		cancel bool
+	}{
+		{"closed", false},
+		{"canceled", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t, nil)
+			h.startVM("vm1")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stream, err := h.server.VMExecStream(ctx, "vm1", &serverapi.VmExecRequest{Cmd: "wait"})
+			if err != nil {
+				t.Fatalf("VMExecStream: %v", err)
+			}
+			readRecord(t, bufio.NewReader(stream))
+			waitForStreams(t, h, "vm1", 1)
+
+			// The guest's command goes with the client.
+			if tc.cancel {
+				cancel()
+			} else {
+				stream.Close()
+			}
+			waitForStreams(t, h, "vm1", 0)
+			if tc.cancel {
+				stream.Close()
+			}
+			// And the VM is let go of.
+			if _, err := h.server.DestroyVM(context.Background(), "vm1"); err != nil {
+				t.Errorf("DestroyVM after the stream: %v", err)
+			}
+		})
+	}
+}
+
+func TestVMExecStreamInvalid(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	for _, tc := range []struct {
+		name string
+		req  *serverapi.VmExecRequest
+		code codes.Code
+	}{
+		{"vsock", &serverapi.VmExecRequest{Cmd: "true", Transport: serverapi.PtrString(config.ExecTransportVsock)}, codes.InvalidArgument},
+		{"base64", &serverapi.VmExecRequest{Cmd: "true", OutputEncoding: serverapi.PtrString(cmdserver.OutputEncodingBase64)}, codes.InvalidArgument},
+	} {
+		if _, err := h.server.VMExecStream(context.Background(), "vm1", tc.req); status.Code(err) != tc.code {
+			t.Errorf("VMExecStream with %s = %v, want %s", tc.name, err, tc.code)
+		}
+	}
+	if _, err := h.server.VMExecStream(context.Background(), "vm2", &serverapi.VmExecRequest{Cmd: "true"}); status.Code(err) != codes.NotFound {
+		t.Errorf("VMExecStream on a missing VM = %v, want NotFound", err)
+	}
+}
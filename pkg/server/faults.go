@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/faults"
+)
+
+func faultRuleToAPI(rule faults.Rule) serverapi.FaultRule {
+	apiRule := serverapi.FaultRule{
+		Id:     serverapi.PtrString(rule.ID),
+		Point:  rule.Point,
+		Action: rule.Action,
+		Count:  serverapi.PtrInt32(int32(rule.Remaining)),
+	}
+	if rule.VMName != "" {
+		apiRule.VmName = serverapi.PtrString(rule.VMName)
+	}
+	switch rule.Action {
+	case faults.ActionFail:
+		apiRule.Code = serverapi.PtrString(faults.CodeName(rule.Code))
+		apiRule.HttpStatus = serverapi.PtrInt32(int32(rule.HTTPStatus))
+		apiRule.Message = serverapi.PtrString(rule.Message)
+	case faults.ActionDelay:
+		apiRule.DelayMs = serverapi.PtrInt64(rule.Delay.Milliseconds())
+	}
+	if !rule.ExpiresAt.IsZero() {
+		apiRule.ExpiresAt = serverapi.PtrTime(rule.ExpiresAt)
+	}
+	return apiRule
+}
+
+// AddFault registers a fault injection rule.
+func (s *Server) AddFault(req *serverapi.FaultRule) (*serverapi.FaultRule, error) {
+	if !s.faults.Enabled() {
+		return nil, status.Error(codes.PermissionDenied, "fault injection is disabled")
+	}
+
+	rule := faults.Rule{
+		Point:      req.Point,
+		VMName:     req.GetVmName(),
+		Action:     req.Action,
+		HTTPStatus: int(req.GetHttpStatus()),
+		Message:    req.GetMessage(),
+		Delay:      time.Duration(req.GetDelayMs()) * time.Millisecond,
+		Remaining:  int(req.GetCount()),
+	}
+	if req.GetCode() != "" {
+		code, err := faults.ParseCode(req.GetCode())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid code: %s", req.GetCode()))
+		}
+		rule.Code = code
+	}
+	if req.GetTtlSeconds() > 0 {
+		rule.ExpiresAt = time.Now().Add(time.Duration(req.GetTtlSeconds()) * time.Second)
+	}
+
+	added, err := s.faults.Add(rule)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	resp := faultRuleToAPI(added)
+	return &resp, nil
+}
+
+// ListFaults returns the active fault injection rules.
+func (s *Server) ListFaults() (*serverapi.ListFaultsResponse, error) {
+	if !s.faults.Enabled() {
+		return nil, status.Error(codes.PermissionDenied, "fault injection is disabled")
+	}
+
+	resp := &serverapi.ListFaultsResponse{}
+	for _, rule := range s.faults.List() {
+		resp.Faults = append(resp.Faults, faultRuleToAPI(rule))
+	}
+	return resp, nil
+}
+
+// DeleteFault removes a fault injection rule.
+func (s *Server) DeleteFault(id string) error {
+	if !s.faults.Enabled() {
+		return status.Error(codes.PermissionDenied, "fault injection is disabled")
+	}
+	if !s.faults.Delete(id) {
+		return status.Error(codes.NotFound, fmt.Sprintf("fault rule not found: %s", id))
+	}
+	return nil
+}
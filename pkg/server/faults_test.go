@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/faults"
+)
+
+func enableFaults(cfg *config.ServerConfig) {
+	cfg.EnableFaultInjection = true
+}
+
+// addFault registers rule and fails the test if it's refused.
+func addFault(t *testing.T, h *testHarness, rule serverapi.FaultRule) string {
+	t.Helper()
+	added, err := h.server.AddFault(&rule)
+	if err != nil {
+		t.Fatalf("AddFault: %v", err)
+	}
+	return added.GetId()
+}
+
+func TestFaultsDisabled(t *testing.T) {
+	h := newTestHarness(t, nil)
+	_, err := h.server.AddFault(&serverapi.FaultRule{Point: faults.PointExec, Action: faults.ActionFail})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("AddFault = %v, want PermissionDenied", err)
+	}
+}
+
+func TestStartVMFault(t *testing.T) {
+	h := newTestHarness(t, enableFaults)
+	addFault(t, h, serverapi.FaultRule{
+		Point:  faults.PointStartVM,
+		Action: faults.ActionFail,
+		Code:   serverapi.PtrString("RESOURCE_EXHAUSTED"),
+		Count:  serverapi.PtrInt32(1),
+	})
+
+	_, err := h.server.StartVM(context.Background(), &serverapi.StartVMRequest{VmName: serverapi.PtrString("vm1")})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("StartVM = %v, want ResourceExhausted", err)
+	}
+	h.checkReleased()
+	// The rule was used up, so the next start goes through.
+	h.startVM("vm1")
+}
+
+func TestExecFault(t *testing.T) {
+	h := newTestHarness(t, enableFaults)
+	h.startVM("vm1")
+	h.startVM("vm2")
+	addFault(t, h, serverapi.FaultRule{
+		Point:   faults.PointExec,
+		VmName:  serverapi.PtrString("vm1"),
+		Action:  faults.ActionDelay,
+		DelayMs: serverapi.PtrInt64(200),
+	})
+	failID := addFault(t, h, serverapi.FaultRule{
+		Point:  faults.PointExec,
+		VmName: serverapi.PtrString("vm2"),
+		Action: faults.ActionFail,
+	})
+
+	start := time.Now()
+	if _, err := h.server.VMExec(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "true"}); err != nil {
+		t.Errorf("VMExec on vm1: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("VMExec on vm1 took %s, want it delayed by 200ms", elapsed)
+	}
+
+	_, err := h.server.VMExec(context.Background(), "vm2", &serverapi.VmExecRequest{Cmd: "true"})
+	var fault *faults.Error
+	if !errors.As(err, &fault) || status.Code(err) != codes.Unavailable {
+		t.Errorf("VMExec on vm2 = %v, want an injected Unavailable", err)
+	}
+
+	// Deleting the rule stops the fault.
+	if err := h.server.DeleteFault(failID); err != nil {
+		t.Fatalf("DeleteFault: %v", err)
+	}
+	if _, err := h.server.VMExec(context.Background(), "vm2", &serverapi.VmExecRequest{Cmd: "true"}); err != nil {
+		t.Errorf("VMExec on vm2 after DeleteFault: %v", err)
+	}
+	if resp, err := h.server.ListFaults(); err != nil || len(resp.Faults) != 1 {
+		t.Errorf("ListFaults = %+v, %v, want the delay rule only", resp, err)
+	}
+}
+
+func TestCallbackFault(t *testing.T) {
+	h := newTestHarness(t, enableFaults)
+	h.startVM("vm1")
+	addFault(t, h, serverapi.FaultRule{
+		Point:      faults.PointCallback,
+		VmName:     serverapi.PtrString("vm1"),
+		Action:     faults.ActionFail,
+		HttpStatus: serverapi.PtrInt32(http.StatusBadGateway),
+	})
+
+	_, err := h.server.RouteCallback(context.Background(), "vm1", "tools/run", nil)
+	var fault *faults.Error
+	if !errors.As(err, &fault) || fault.HTTPStatus != http.StatusBadGateway {
+		t.Errorf("RouteCallback = %v, want an injected 502", err)
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
+)
+
+// guestFileClient fetches guest files. It has no timeout, as downloads can
+// be many GB and are bounded by the request context instead, and doesn't
+// ask for compression, so lengths and ranges refer to the file's bytes.
+var guestFileClient = &http.Client{
+	Transport: &http.Transport{
+		DisableCompression: true,
+	},
+}
+
+// guestFileRequestHeaders are the client headers forwarded to the guest.
+var guestFileRequestHeaders = []string{
+	"Range",
+	"If-Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+// GuestFileResponseHeaders are the guest headers to pass back to clients.
+var GuestFileResponseHeaders = []string{
+	"Accept-Ranges",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"ETag",
+	"Last-Modified",
+}
+
+// GuestFile is a guest file response. Body streams the file, or the
+// requested range of it, and must be closed.
+type GuestFile struct {
+	StatusCode int
+	Header     http.Header
+	Body       io.ReadCloser
+}
+
+// VMGetFile requests the file at filePath, relative to the cmdserver's files
+// root, from a VM. The Range and conditional headers in header are
+// forwarded, and partial, not-modified and unsatisfiable-range responses are
+// returned as they are for the caller to pass on. With archive set, the
+// path, typically a directory, comes back as a tar stream instead.
+func (s *Server) VMGetFile(ctx context.Context, vmName string, filePath string, archive bool, header http.Header) (*GuestFile, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if filePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "path is required")
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return nil, err
+	}
+
+	// The gate is only held until the guest answers, so a long download
+	// doesn't hold off snapshots and other operations; those stall it instead.
+	release, err := vm.gate.acquireShared(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := vm.requireAgentFeature(ctx, agentCmdServer, featureFiles); err != nil {
+		return nil, err
+	}
+	query := url.Values{"path": {filePath}}
+	if archive {
+		if err := vm.requireAgentFeature(ctx, agentCmdServer, featureFileArchive); err != nil {
+			return nil, err
+		}
+		query.Set("archive", "true")
+	}
+	reqURL := fmt.Sprintf("http://%s/files?%s", cmdServerAddr(vm.ip.IP.String()), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	requestid.SetHeader(req)
+	for _, name := range guestFileRequestHeaders {
+		if value := header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	resp, err := guestFileClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified,
+		http.StatusPreconditionFailed, http.StatusRequestedRangeNotSatisfiable:
+		return &GuestFile{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       resp.Body,
+		}, nil
+	}
+
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		return nil, status.Error(codes.InvalidArgument, string(body))
+	case http.StatusNotFound:
+		return nil, status.Error(codes.NotFound, string(body))
+	default:
+		return nil, fmt.Errorf("request failed with status: %d: %s", resp.StatusCode, string(body))
+	}
+}
+
+// PutFileOptions are the permissions and owner to give an uploaded file.
+// Unset fields leave cmdserver's defaults: mode 0644, owned by its user.
+type PutFileOptions struct {
+	Mode *uint32
+	UID  *int
+	GID  *int
+	// Size is the length of the upload, if known, so uploads that don't
+	// fit the workspace quota are refused before anything is sent.
+	Size *int64
+}
+
+// errWorkspaceQuotaExceeded cuts off an upload that outgrew its workspace
+// quota.
+var errWorkspaceQuotaExceeded = errors.New("workspace quota exceeded")
+
+// uploadWorkspace returns the exec workspace an upload to destPath lands
+// in, or "" if it isn't a file in one.
+func uploadWorkspace(destPath string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path.Clean("/"+destPath), "/"), "/", 3)
+	if len(parts) < 3 || parts[0] != cmdserver.WorkspacesDir {
+		return ""
+	}
+	if cmdserver.ValidateWorkspaceName(parts[1]) != nil {
+		return ""
+	}
+	return parts[1]
+}
+
+// quotaReader passes on at most limit bytes of r and fails the read that
+// would go past it, so an upload of unknown length is aborted before the
+// guest can commit it.
+type quotaReader struct {
+	r        io.Reader
+	limit    int64
+	exceeded bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.limit -= int64(n)
+	if q.limit < 0 {
+		q.exceeded = true
+		return 0, errWorkspaceQuotaExceeded
+	}
+	return n, err
+}
+
+// VMPutFile writes r to the file at destPath, relative to the cmdserver's
+// files root, in a VM, replacing any file already there. r is streamed to
+// the guest as it's read rather than buffered, so any size can be uploaded.
+// Uploads into an exec workspace are bounded by workspace_quota_in_mb; the
+// file being replaced still counts against it.
+func (s *Server) VMPutFile(ctx context.Context, vmName string, destPath string, r io.Reader, opts PutFileOptions) (*serverapi.PutFileResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if destPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "path is required")
+	}
+	query := url.Values{"path": {destPath}}
+	if opts.Mode != nil {
+		if *opts.Mode > 0777 {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid mode: %o", *opts.Mode))
+		}
+		query.Set("mode", strconv.FormatUint(uint64(*opts.Mode), 8))
+	}
+	for name, id := range map[string]*int{"uid": opts.UID, "gid": opts.GID} {
+		if id == nil {
+			continue
+		}
+		if *id < 0 {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s: %d", name, *id))
+		}
+		query.Set(name, strconv.Itoa(*id))
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return nil, err
+	}
+
+	// Unlike downloads, the guest only answers once the upload is complete,
+	// so the gate is held throughout and snapshots wait for it.
+	release, err := vm.gate.acquireShared(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := vm.requireAgentFeature(ctx, agentCmdServer, featureFileUpload); err != nil {
+		return nil, err
+	}
+	var limited *quotaReader
+	if workspace := uploadWorkspace(destPath); workspace != "" && s.config.WorkspaceQuotaInMB > 0 {
+		quota := s.config.WorkspaceQuotaInMB * 1024 * 1024
+		used, err := vm.workspaceSize(ctx, workspace)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Size != nil && used+*opts.Size > quota {
+			return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf(
+				"upload of %d bytes exceeds the quota of workspace %s of %d bytes (%d bytes used)",
+				*opts.Size, workspace, quota, used))
+		}
+		limited = &quotaReader{r: r, limit: quota - used}
+		r = limited
+	}
+	reqURL := fmt.Sprintf("http://%s/files?%s", cmdServerAddr(vm.ip.IP.String()), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, reqURL, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	requestid.SetHeader(req)
+
+	resp, err := guestFileClient.Do(req)
+	if limited != nil && limited.exceeded {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf(
+			"upload exceeds the quota of workspace %s of %d MB", uploadWorkspace(destPath), s.config.WorkspaceQuotaInMB))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		switch resp.StatusCode {
+		case http.StatusBadRequest:
+			return nil, status.Error(codes.InvalidArgument, string(body))
+		case http.StatusNotFound:
+			return nil, status.Error(codes.NotFound, string(body))
+		default:
+			return nil, fmt.Errorf("request failed with status: %d: %s", resp.StatusCode, string(body))
+		}
+	}
+
+	var putResp cmdserver.PutFileResponse
+	if err := json.NewDecoder(resp.Body).Decode(&putResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &serverapi.PutFileResponse{
+		Path: serverapi.PtrString(putResp.Path),
+		Size: serverapi.PtrInt64(putResp.Size),
+	}, nil
+}
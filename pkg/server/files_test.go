@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+func TestUploadWorkspace(t *testing.T) {
+	for destPath, want := range map[string]string{
+		"workspaces/job-1/out.txt":     "job-1",
+		"/workspaces/job-1/a/b/c":      "job-1",
+		"workspaces/job-1/../job-2/x":  "job-2",
+		"workspaces/../workspaces/j/x": "j",
+		"workspaces/job-1":             "",
+		"workspaces":                   "",
+		"other/job-1/out.txt":          "",
+		"workspaces/.hidden/out.txt":   "",
+		"x/../../workspaces/job-1/out": "job-1",
+	} {
+		if got := uploadWorkspace(destPath); got != want {
+			t.Errorf("uploadWorkspace(%q) = %q, want %q", destPath, got, want)
+		}
+	}
+}
+
+func TestQuotaReader(t *testing.T) {
+	fits := &quotaReader{r: strings.NewReader("12345"), limit: 5}
+	got, err := io.ReadAll(fits)
+	if err != nil || string(got) != "12345" || fits.exceeded {
+		t.Errorf("ReadAll within the limit = %q, %v, exceeded %t", got, err, fits.exceeded)
+	}
+
+	over := &quotaReader{r: strings.NewReader("123456"), limit: 5}
+	got, err = io.ReadAll(over)
+	if !errors.Is(err, errWorkspaceQuotaExceeded) || !over.exceeded {
+		t.Fatalf("ReadAll past the limit = %v, exceeded %t; want errWorkspaceQuotaExceeded", err, over.exceeded)
+	}
+	if len(got) > 5 {
+		t.Errorf("quotaReader passed on %d bytes, want at most 5", len(got))
+	}
+}
+
+func TestVMPutFileWorkspaceQuota(t *testing.T) {
+	h := newTestHarness(t, func(cfg *config.ServerConfig) { cfg.WorkspaceQuotaInMB = 1 })
+	h.startVM("vm1")
+	guest := guestFor(h.server.getVMAtomic("vm1").ip.IP.String())
+	chunk := bytes.Repeat([]byte("x"), 700*1024)
+	put := func(destPath string, data []byte, sized bool) error {
+		var opts PutFileOptions
+		if sized {
+			size := int64(len(data))
+			opts.Size = &size
+		}
+		_, err := h.server.VMPutFile(context.Background(), "vm1", destPath, bytes.NewReader(data), opts)
+		return err
+	}
+
+	if err := put("workspaces/job/a", chunk, true); err != nil {
+		t.Fatalf("VMPutFile within the quota: %v", err)
+	}
+	if err := put("workspaces/job/b", chunk, true); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("VMPutFile of a known size past the quota = %v, want ResourceExhausted", err)
+	}
+	if err := put("workspaces/job/c", chunk, false); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("VMPutFile streamed past the quota = %v, want ResourceExhausted", err)
+	}
+	for _, name := range []string{"workspaces/job/b", "workspaces/job/c"} {
+		if _, ok := guest.file(name); ok {
+			t.Errorf("%s reached the guest", name)
+		}
+	}
+
+	// The quota is per workspace and doesn't apply outside them.
+	if err := put("workspaces/other/a", chunk, true); err != nil {
+		t.Errorf("VMPutFile to another workspace: %v", err)
+	}
+	if err := put("tmp/big", append(chunk, chunk...), false); err != nil {
+		t.Errorf("VMPutFile outside workspaces: %v", err)
+	}
+}
+
+func TestVMGetFileRange(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	data := bytes.Repeat([]byte("0123456789"), 100*1024)
+	if _, err := h.server.VMPutFile(context.Background(), "vm1", "out.bin", bytes.NewReader(data), PutFileOptions{}); err != nil {
+		t.Fatalf("VMPutFile: %v", err)
+	}
+
+	full, err := h.server.VMGetFile(context.Background(), "vm1", "out.bin", false, http.Header{})
+	if err != nil {
+		t.Fatalf("VMGetFile: %v", err)
+	}
+	full.Body.Close()
+	etag := full.Header.Get("ETag")
+
+	// The rest of the file, resumed from where a download broke off.
+	file, err := h.server.VMGetFile(context.Background(), "vm1", "out.bin", false, http.Header{
+		"Range":    {"bytes=1000-"},
+		"If-Range": {etag},
+	})
+	if err != nil {
+		t.Fatalf("VMGetFile with a range: %v", err)
+	}
+	defer file.Body.Close()
+	if file.StatusCode != http.StatusPartialContent {
+		t.Errorf("status = %d, want 206", file.StatusCode)
+	}
+	if want := fmt.Sprintf("bytes 1000-%d/%d", len(data)-1, len(data)); file.Header.Get("Content-Range") != want {
+		t.Errorf("Content-Range = %q, want %q", file.Header.Get("Content-Range"), want)
+	}
+	rest, err := io.ReadAll(file.Body)
+	if err != nil || !bytes.Equal(rest, data[1000:]) {
+		t.Errorf("body = %d bytes, %v, want the file from byte 1000", len(rest), err)
+	}
+
+	// Ranges past the end are passed back for the client to see.
+	past, err := h.server.VMGetFile(context.Background(), "vm1", "out.bin", false, http.Header{"Range": {"bytes=99999999-"}})
+	if err != nil {
+		t.Fatalf("VMGetFile past the end: %v", err)
+	}
+	past.Body.Close()
+	if past.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("status past the end = %d, want 416", past.StatusCode)
+	}
+
+	if _, err := h.server.VMGetFile(context.Background(), "vm1", "missing", false, http.Header{}); status.Code(err) != codes.NotFound {
+		t.Errorf("VMGetFile of a missing file = %v, want NotFound", err)
+	}
+}
@@ -2,11 +2,15 @@ package fountain
 
 import (
 	"fmt"
-	"os/exec"
+	"net"
+	"os"
+	"path/filepath"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"gvisor.dev/gvisor/pkg/cleanup"
+
+	"github.com/abilashraghuram/cbox/pkg/hostcmd"
 )
 
 const (
@@ -18,6 +22,9 @@ const (
 type TapDevice struct {
 	Name string
 	ID   int32
+	// External is set for devices created and owned by someone else. They
+	// are never deleted, and they don't hold an ID from the pool.
+	External bool
 }
 
 // String implements the fmt.Stringer interface.
@@ -138,22 +145,27 @@ func (f *Fountain) CreateTapDevice(id *int32) (*TapDevice, error) {
 	})
 
 	deviceName := fmt.Sprintf("tap%d", allocatedID)
-	if output, err := exec.Command(
+	if err := hostcmd.Run(
 		"ip", "tuntap", "add", "dev", deviceName, "mode", "tap",
-	).CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failed to create: %v: %s %w", deviceName, output, err)
+	); err != nil {
+		return nil, fmt.Errorf("failed to create: %v: %w", deviceName, err)
 	}
+	cleanup.Add(func() {
+		if err := hostcmd.Run("ip", "tuntap", "del", "dev", deviceName, "mode", "tap"); err != nil {
+			logger.WithError(err).Errorf("failed to delete %s during cleanup", deviceName)
+		}
+	})
 
-	if output, err := exec.Command(
+	if err := hostcmd.Run(
 		"ip", "l", "set", "dev", deviceName, "master", f.bridgeDevice,
-	).CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failed to add: %v to: %v: %s %w", deviceName, f.bridgeDevice, output, err)
+	); err != nil {
+		return nil, fmt.Errorf("failed to add: %v to: %v: %w", deviceName, f.bridgeDevice, err)
 	}
 
-	if output, err := exec.Command(
+	if err := hostcmd.Run(
 		"ip", "l", "set", deviceName, "up",
-	).CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failed to up: %v: %s %w", deviceName, output, err)
+	); err != nil {
+		return nil, fmt.Errorf("failed to up: %v: %w", deviceName, err)
 	}
 
 	cleanup.Release()
@@ -163,25 +175,75 @@ func (f *Fountain) CreateTapDevice(id *int32) (*TapDevice, error) {
 	}, nil
 }
 
-// DestroyTapDevice destroys a tap device and frees its ID.
+// AdoptTapDevice returns an externally-created tap device for use by a VM.
+// The device must exist, be down and not be attached to a bridge.
+func (f *Fountain) AdoptTapDevice(name string) (*TapDevice, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("tap device %s not found: %w", name, err)
+	}
+	if iface.Flags&net.FlagUp != 0 {
+		return nil, fmt.Errorf("tap device %s is up", name)
+	}
+	if master, err := os.Readlink(filepath.Join("/sys/class/net", name, "master")); err == nil {
+		return nil, fmt.Errorf("tap device %s is attached to %s", name, filepath.Base(master))
+	}
+
+	log.WithField("deviceName", name).Info("adopted external tap device")
+	return &TapDevice{
+		Name:     name,
+		ID:       -1,
+		External: true,
+	}, nil
+}
+
+// ReclaimTapDevice takes back a tap device created by a previous run, e.g.
+// for a VM that outlived a server restart. Its ID is claimed from the pool
+// and it's left set up as it is.
+func (f *Fountain) ReclaimTapDevice(name string) (*TapDevice, error) {
+	var id int32
+	if _, err := fmt.Sscanf(name, "tap%d", &id); err != nil || fmt.Sprintf("tap%d", id) != name {
+		return nil, fmt.Errorf("tap device %s wasn't created by the fountain", name)
+	}
+	if err := hostcmd.Run("ip", "link", "show", name); err != nil {
+		return nil, fmt.Errorf("tap device %s not found: %w", name, err)
+	}
+	if err := f.claimID(id); err != nil {
+		return nil, err
+	}
+
+	log.WithField("deviceName", name).Info("reclaimed tap device")
+	return &TapDevice{
+		Name: name,
+		ID:   id,
+	}, nil
+}
+
+// DestroyTapDevice destroys a tap device and frees its ID. External devices
+// are left in place.
 func (f *Fountain) DestroyTapDevice(device *TapDevice) error {
+	if device.External {
+		log.WithField("deviceName", device.Name).Info("leaving external tap device in place")
+		return nil
+	}
+
 	log.WithFields(log.Fields{
 		"deviceName": device.Name,
 		"deviceID":   device.ID,
 	}).Info("destroy tap device")
 
 	// Remove the tap device from the bridge
-	if err := exec.Command("ip", "link", "set", device.Name, "nomaster").Run(); err != nil {
+	if err := hostcmd.Run("ip", "link", "set", device.Name, "nomaster"); err != nil {
 		return fmt.Errorf("failed to remove %v from bridge: %w", device.Name, err)
 	}
 
 	// Bring the tap device down
-	if err := exec.Command("ip", "link", "set", device.Name, "down").Run(); err != nil {
+	if err := hostcmd.Run("ip", "link", "set", device.Name, "down"); err != nil {
 		return fmt.Errorf("failed to bring down %v: %w", device.Name, err)
 	}
 
 	// Delete the tap device
-	if err := exec.Command("ip", "tuntap", "del", "dev", device.Name, "mode", "tap").Run(); err != nil {
+	if err := hostcmd.Run("ip", "tuntap", "del", "dev", device.Name, "mode", "tap"); err != nil {
 		return fmt.Errorf("failed to delete %v: %w", device.Name, err)
 	}
 
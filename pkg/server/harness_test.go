@@ -0,0 +1,624 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/callback"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/events"
+	"github.com/abilashraghuram/cbox/pkg/hostcmd"
+)
+
+// The tests in this package that start VMs run the server against fakes: a
+// fakeRunner for the host's ip, iptables and disk tools, cmd/fakechv for
+// cloud-hypervisor and a fakeGuest cmdserver per guest IP. None of them need
+// root or KVM.
+
+func TestMain(m *testing.M) {
+	cmdServerAddr = fakeGuestAddr
+	code := m.Run()
+	if fakechv.dir != "" {
+		os.RemoveAll(fakechv.dir)
+	}
+	os.Exit(code)
+}
+
+// fakechv is cmd/fakechv, built once for all tests.
+var fakechv struct {
+	once sync.Once
+	dir  string
+	path string
+	err  error
+}
+
+func fakechvPath(t *testing.T) string {
+	t.Helper()
+	fakechv.once.Do(func() {
+		if _, err := exec.LookPath("go"); err != nil {
+			fakechv.err = err
+			return
+		}
+		if fakechv.dir, fakechv.err = os.MkdirTemp("", "fakechv"); fakechv.err != nil {
+			return
+		}
+		fakechv.path = path.Join(fakechv.dir, "cloud-hypervisor")
+		output, err := exec.Command("go", "build", "-o", fakechv.path, "github.com/abilashraghuram/cbox/cmd/fakechv").CombinedOutput()
+		if err != nil {
+			fakechv.err = fmt.Errorf("go build: %v: %s", err, output)
+		}
+	})
+	if fakechv.err != nil {
+		t.Skipf("fakechv unavailable: %v", fakechv.err)
+	}
+	return fakechv.path
+}
+
+// fakeRunner stands in for the host binaries run through hostcmd. Every
+// command succeeds with no output unless it fails through failOn or needs
+// output for the server to carry on.
+type fakeRunner struct {
+	lock     sync.Mutex
+	calls    []string
+	failures []string
+	// outputs are the outputs of commands set with respond.
+	outputs map[string]string
+}
+
+func (r *fakeRunner) Output(name string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+	r.lock.Lock()
+	failing := false
+	for _, prefix := range r.failures {
+		failing = failing || strings.HasPrefix(line, prefix)
+	}
+	if !failing {
+		r.calls = append(r.calls, line)
+	}
+	output, responds := r.outputs[line]
+	r.lock.Unlock()
+	if failing {
+		return nil, &hostcmd.Error{Name: name, Args: args, ExitCode: 1, Stderr: "injected failure"}
+	}
+	if responds {
+		return []byte(output), nil
+	}
+
+	switch {
+	case line == "ip route show default":
+		return []byte("default via 10.0.0.1 dev eth0\n"), nil
+	case line == "ip link show br0":
+		return nil, &hostcmd.Error{Name: name, Args: args, ExitCode: 1, Stderr: `Device "br0" does not exist.`}
+	case name == "iptables" && len(args) > 3 && args[2] == "-L":
+		return []byte("Chain PREROUTING (policy ACCEPT)\nnum  target     prot opt source               destination\n"), nil
+	case name == "truncate":
+		file, err := os.Create(args[len(args)-1])
+		if err != nil {
+			return nil, &hostcmd.Error{Name: name, Args: args, ExitCode: 1, Stderr: err.Error()}
+		}
+		file.Close()
+	}
+	return nil, nil
+}
+
+func (r *fakeRunner) LookPath(name string) (string, error) {
+	return "/usr/bin/" + name, nil
+}
+
+// failOn makes commands starting with prefix fail.
+func (r *fakeRunner) failOn(prefix string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures = append(r.failures, prefix)
+}
+
+// respond makes the command line output output.
+func (r *fakeRunner) respond(line string, output string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.outputs == nil {
+		r.outputs = make(map[string]string)
+	}
+	r.outputs[line] = output
+}
+
+func (r *fakeRunner) clearFailures() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures = nil
+}
+
+// ran returns how many commands starting with prefix ran successfully.
+func (r *fakeRunner) ran(prefix string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n := 0
+	for _, call := range r.calls {
+		if strings.HasPrefix(call, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// fakeGuest is the cmdserver of the guest with IP ip. It runs no commands,
+// only records them.
+type fakeGuest struct {
+	ip string
+	// addr is where the guest's cmdserver listens, even while stopped.
+	addr string
+
+	lock   sync.Mutex
+	server *httptest.Server
+	cmds   []cmdserver.RunCmdRequest
+	files  map[string][]byte
+	jobs   int
+	// version is what /version reports, if set. With noVersion set, the
+	// guest predates /version.
+	version   *agentVersion
+	noVersion bool
+	// shells is how many /shell sessions are open.
+	shells int
+	// streams is how many streamed commands are running.
+	streams int
+}
+
+// fakeGuests holds the fakeGuest of every guest IP the server has talked to.
+var fakeGuests = struct {
+	lock sync.Mutex
+	byIP map[string]*fakeGuest
+}{byIP: make(map[string]*fakeGuest)}
+
+// fakeGuestAddr replaces cmdServerAddr, starting a fakeGuest for ip on
+// first use.
+func fakeGuestAddr(ip string) string {
+	return guestFor(ip).addr
+}
+
+func guestFor(ip string) *fakeGuest {
+	fakeGuests.lock.Lock()
+	defer fakeGuests.lock.Unlock()
+	if guest, ok := fakeGuests.byIP[ip]; ok {
+		return guest
+	}
+	guest := &fakeGuest{ip: ip, files: make(map[string][]byte)}
+	guest.server = httptest.NewServer(guest)
+	guest.addr = guest.server.Listener.Addr().String()
+	fakeGuests.byIP[ip] = guest
+	return guest
+}
+
+// resetFakeGuests stops every fakeGuest, so the next test starts afresh.
+func resetFakeGuests() {
+	fakeGuests.lock.Lock()
+	defer fakeGuests.lock.Unlock()
+	for ip, guest := range fakeGuests.byIP {
+		guest.stop()
+		delete(fakeGuests.byIP, ip)
+	}
+}
+
+// stop makes the guest's cmdserver refuse connections, as if it crashed.
+func (g *fakeGuest) stop() {
+	g.lock.Lock()
+	server := g.server
+	g.lock.Unlock()
+	server.Close()
+}
+
+// start brings the stopped cmdserver back on its address.
+func (g *fakeGuest) start() error {
+	listener, err := net.Listen("tcp", g.addr)
+	if err != nil {
+		return err
+	}
+	server := httptest.NewUnstartedServer(g)
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	g.lock.Lock()
+	g.server = server
+	g.lock.Unlock()
+	return nil
+}
+
+func (g *fakeGuest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/":
+		w.WriteHeader(http.StatusOK)
+	case "/version":
+		g.lock.Lock()
+		version, noVersion := g.version, g.noVersion
+		g.lock.Unlock()
+		if noVersion {
+			http.NotFound(w, r)
+			return
+		}
+		if version != nil {
+			json.NewEncoder(w).Encode(version)
+			return
+		}
+		json.NewEncoder(w).Encode(agentVersion{
+			Agent:           agentCmdServer,
+			Version:         "fake",
+			Protocol:        agentProtocolVersion,
+			MinHostProtocol: minAgentProtocolVersion,
+			Features: []string{featureExec, featureExecBatch, featureExecTimeout, featureExecJobs,
+				featureExecEnv, featureWorkspaces, featureFiles, featureFileUpload, featureShell, featureExecStream},
+		})
+	case "/cmd":
+		var req cmdserver.RunCmdRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		g.lock.Lock()
+		g.cmds = append(g.cmds, req)
+		g.lock.Unlock()
+		if req.Stream {
+			g.serveStream(w, r, req)
+			return
+		}
+		g.lock.Lock()
+		var resp cmdserver.RunCmdResponse
+		if req.Blocking {
+			exitCode := 0
+			resp.Output = fmt.Sprintf("%s ran %s", g.ip, req.Cmd)
+			resp.ExitCode = &exitCode
+		} else {
+			g.jobs++
+			resp.JobID = fmt.Sprintf("job-%d", g.jobs)
+		}
+		g.lock.Unlock()
+		json.NewEncoder(w).Encode(resp)
+	case "/cmd-batch":
+		var req cmdserver.RunCmdBatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := cmdserver.RunCmdBatchResponse{Results: []cmdserver.RunCmdBatchResult{}}
+		g.lock.Lock()
+		for _, cmd := range req.Cmds {
+			g.cmds = append(g.cmds, cmdserver.RunCmdRequest{Cmd: cmd, Blocking: true, Workspace: req.Workspace})
+			resp.Results = append(resp.Results, cmdserver.RunCmdBatchResult{Cmd: cmd, Output: fmt.Sprintf("%s ran %s", g.ip, cmd)})
+		}
+		g.lock.Unlock()
+		json.NewEncoder(w).Encode(resp)
+	case "/workspaces":
+		sizes := make(map[string]int64)
+		g.lock.Lock()
+		for name, data := range g.files {
+			if workspace := uploadWorkspace(name); workspace != "" {
+				sizes[workspace] += int64(len(data))
+			}
+		}
+		g.lock.Unlock()
+		resp := cmdserver.ListWorkspacesResponse{Workspaces: []cmdserver.Workspace{}}
+		for name, size := range sizes {
+			resp.Workspaces = append(resp.Workspaces, cmdserver.Workspace{Name: name, SizeBytes: size})
+		}
+		json.NewEncoder(w).Encode(resp)
+	case "/files":
+		if r.Method == http.MethodGet {
+			name := r.URL.Query().Get("path")
+			g.lock.Lock()
+			data, ok := g.files[name]
+			g.lock.Unlock()
+			if !ok {
+				http.Error(w, "file not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("ETag", fmt.Sprintf(`"%x"`, len(data)))
+			http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		name := r.URL.Query().Get("path")
+		g.lock.Lock()
+		g.files[name] = data
+		g.lock.Unlock()
+		json.NewEncoder(w).Encode(cmdserver.PutFileResponse{Path: name, Size: int64(len(data))})
+	case "/shell":
+		websocket.Server{Handler: g.serveShell}.ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveStream streams the output of a command, a line saying it ran. A
+// "wait" command runs until the request is canceled, an "exit <code>" one
+// exits with code.
+func (g *fakeGuest) serveStream(w http.ResponseWriter, r *http.Request, req cmdserver.RunCmdRequest) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	enc.Encode(cmdserver.StreamRecord{Stream: cmdserver.StreamStdout, Data: fmt.Sprintf("%s ran %s\n", g.ip, req.Cmd)})
+	w.(http.Flusher).Flush()
+	if req.Cmd == "wait" {
+		g.lock.Lock()
+		g.streams++
+		g.lock.Unlock()
+		<-r.Context().Done()
+		g.lock.Lock()
+		g.streams--
+		g.lock.Unlock()
+		return
+	}
+	exitCode := 0
+	fmt.Sscanf(req.Cmd, "exit %d", &exitCode)
+	enc.Encode(cmdserver.StreamRecord{Done: true, ExitCode: &exitCode})
+}
+
+// runningStreams returns how many streamed commands the guest is running.
+func (g *fakeGuest) runningStreams() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.streams
+}
+
+// serveShell echoes the frames of a /shell session back until the client
+// disconnects or sends "exit\n".
+func (g *fakeGuest) serveShell(ws *websocket.Conn) {
+	defer ws.Close()
+	g.lock.Lock()
+	g.shells++
+	g.lock.Unlock()
+	defer func() {
+		g.lock.Lock()
+		g.shells--
+		g.lock.Unlock()
+	}()
+	for {
+		var frame cmdserver.ShellFrame
+		if err := cmdserver.ShellFrameCodec.Receive(ws, &frame); err != nil {
+			return
+		}
+		if string(frame.Data) == "exit\n" {
+			return
+		}
+		if err := cmdserver.ShellFrameCodec.Send(ws, frame); err != nil {
+			return
+		}
+	}
+}
+
+// openShells returns how many /shell sessions the guest has open.
+func (g *fakeGuest) openShells() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.shells
+}
+
+// ranCmds returns the commands the guest was asked to run.
+func (g *fakeGuest) ranCmds() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	var cmds []string
+	for _, req := range g.cmds {
+		cmds = append(cmds, req.Cmd)
+	}
+	return cmds
+}
+
+// file returns the file uploaded to the guest at name.
+func (g *fakeGuest) file(name string) ([]byte, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	data, ok := g.files[name]
+	return data, ok
+}
+
+// serveGuestVsock accepts vsock CONNECTs on a VM's vsock socket, as
+// cloud-hypervisor does for ports the guest listens on, and hands each
+// connection to handle once it's connected.
+func serveGuestVsock(t *testing.T, vsockPath string, handle func(port uint32, conn net.Conn)) {
+	t.Helper()
+	os.Remove(vsockPath)
+	listener, err := net.Listen("unix", vsockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// Read a byte at a time so nothing past the handshake is
+				// taken from handle.
+				var line []byte
+				buf := make([]byte, 1)
+				for len(line) == 0 || line[len(line)-1] != '\n' {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					line = append(line, buf[0])
+				}
+				var port uint32
+				if _, err := fmt.Sscanf(string(line), "CONNECT %d\n", &port); err != nil {
+					return
+				}
+				fmt.Fprintf(conn, "OK %d\n", port)
+				handle(port, conn)
+			}()
+		}
+	}()
+}
+
+// testHarness is a Server on fake host binaries, VMM and guests.
+type testHarness struct {
+	t      *testing.T
+	server *Server
+	runner *fakeRunner
+	config config.ServerConfig
+}
+
+// newTestHarness starts a Server in bridge network mode with its state in
+// a temp dir. configure, if set, adjusts the config first.
+func newTestHarness(t *testing.T, configure func(*config.ServerConfig)) *testHarness {
+	t.Helper()
+	cfg := config.DefaultServerConfig()
+	cfg.ChvBinPath = fakechvPath(t)
+	cfg.StateDir = t.TempDir()
+	cfg.BridgeName = "br0"
+	cfg.BridgeIP = "10.20.1.1/24"
+	cfg.BridgeSubnet = "10.20.1.0/24"
+	cfg.CIDRange = "3-300"
+	images := t.TempDir()
+	cfg.KernelPath = path.Join(images, "vmlinux")
+	cfg.RootfsPath = path.Join(images, "rootfs.img")
+	cfg.InitramfsPath = path.Join(images, "initramfs")
+	for _, image := range []string{cfg.KernelPath, cfg.RootfsPath, cfg.InitramfsPath} {
+		if err := os.WriteFile(image, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg.HeartbeatInterval = 0
+	cfg.ChvReadyTimeout = 10 * time.Second
+	cfg.CmdServerReadyTimeout = 5 * time.Second
+	cfg.ReapTimeout = 5 * time.Second
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	runner := &fakeRunner{}
+	restore := hostcmd.SetRunner(runner)
+	s, err := NewServer(cfg, callback.NewSessionManager())
+	if err != nil {
+		restore()
+		t.Fatalf("NewServer: %v", err)
+	}
+	h := &testHarness{t: t, server: s, runner: runner, config: cfg}
+	t.Cleanup(func() {
+		if _, err := h.server.DestroyAllVMs(context.Background(), ""); err != nil {
+			t.Errorf("DestroyAllVMs: %v", err)
+		}
+		restore()
+		resetFakeGuests()
+	})
+	return h
+}
+
+// restart stands in for the server restarting with its VMs left running:
+// the running Server detaches its VMs and stops watching them, and a new
+// one takes over the state dir.
+func (h *testHarness) restart() {
+	h.t.Helper()
+	if _, err := h.server.DetachVMs(context.Background()); err != nil {
+		h.t.Fatalf("DetachVMs: %v", err)
+	}
+	for _, vm := range h.server.vms {
+		vm.stopCrashMonitor()
+		vm.callbackListener.Close()
+		vm.artifactListener.Close()
+	}
+	s, err := NewServer(h.config, callback.NewSessionManager())
+	if err != nil {
+		h.t.Fatalf("NewServer after a restart: %v", err)
+	}
+	h.server = s
+}
+
+// startVM starts vmName and fails the test if it doesn't start.
+func (h *testHarness) startVM(vmName string) *serverapi.StartVMResponse {
+	h.t.Helper()
+	resp, err := h.server.StartVM(context.Background(), &serverapi.StartVMRequest{VmName: serverapi.PtrString(vmName)})
+	if err != nil {
+		h.t.Fatalf("StartVM(%s): %v", vmName, err)
+	}
+	return resp
+}
+
+// occupancy returns how many IPs and CIDs are allocated.
+func (h *testHarness) occupancy() (ips int, cids int) {
+	for _, occupancy := range h.server.network.Occupancy() {
+		switch occupancy.Name {
+		case AllocatorIP:
+			ips = occupancy.Used
+		case AllocatorCID:
+			cids = occupancy.Used
+		}
+	}
+	return ips, cids
+}
+
+// checkReleased fails the test unless no VM holds an IP, CID or state dir.
+func (h *testHarness) checkReleased() {
+	h.t.Helper()
+	if ips, cids := h.occupancy(); ips != 0 || cids != 0 {
+		h.t.Errorf("%d IPs and %d CIDs still allocated, want none", ips, cids)
+	}
+	names, err := listVMStateDirs(h.config.StateDir)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if len(names) != 0 {
+		h.t.Errorf("state dirs %v left behind", names)
+	}
+	// Only VMMs still running have pid records.
+	if links, _ := os.ReadDir(byPidDir(h.config.StateDir)); len(links) != 0 {
+		h.t.Errorf("%d by-pid links left behind", len(links))
+	}
+}
+
+// runningVMMs returns the pids of the live VMMs spawned for vmName, found by
+// the CBOX_VM_NAME spawnVMM gives them.
+func runningVMMs(vmName string) []int {
+	var pids []int
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		var pid int
+		if _, err := fmt.Sscanf(entry.Name(), "%d", &pid); err != nil {
+			continue
+		}
+		environ, err := os.ReadFile(path.Join("/proc", entry.Name(), "environ"))
+		if err != nil || processExited(pid) {
+			continue
+		}
+		for _, env := range strings.Split(string(environ), "\x00") {
+			if env == "CBOX_VM_NAME="+vmName {
+				pids = append(pids, pid)
+			}
+		}
+	}
+	return pids
+}
+
+// waitForEvent waits for an event of eventType about vmName on sub.
+func waitForEvent(t *testing.T, sub *events.Subscription, eventType string, vmName string) events.Event {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	for {
+		event, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatalf("no %s event for %s: %v", eventType, vmName, err)
+		}
+		if event.Type == eventType && event.VMName == vmName {
+			return event
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+)
+
+// Overall health statuses. HealthStatusStarting is reported by the REST
+// server until the Server is created.
+const (
+	HealthStatusHealthy   = "healthy"
+	HealthStatusDegraded  = "degraded"
+	HealthStatusUnhealthy = "unhealthy"
+	HealthStatusStarting  = "starting"
+)
+
+const (
+	healthCheckOK     = "ok"
+	healthCheckFailed = "failed"
+)
+
+// healthCheck is a dependency of the server checked by Health. check returns
+// a short reason for failing; details are logged instead, as health is served
+// without authentication.
+type healthCheck struct {
+	name string
+	// critical checks make the server unhealthy rather than degraded.
+	critical bool
+	// bridgeOnly checks are skipped in external network mode.
+	bridgeOnly bool
+	check      func(s *Server) (string, error)
+}
+
+var healthChecks = []healthCheck{
+	{name: "chv_binary", critical: true, check: (*Server).checkChvBinary},
+	{name: "bridge", critical: true, bridgeOnly: true, check: (*Server).checkBridge},
+	{name: "state_dir", critical: true, check: (*Server).checkStateDir},
+	{name: "ip_allocator", bridgeOnly: true, check: func(s *Server) (string, error) {
+		return s.checkAllocator(AllocatorIP)
+	}},
+	{name: "cid_allocator", check: func(s *Server) (string, error) {
+		return s.checkAllocator(AllocatorCID)
+	}},
+}
+
+// Health runs the health checks. The server is unhealthy if a critical one
+// fails and degraded if another one does.
+func (s *Server) Health() *serverapi.HealthResponse {
+	resp := &serverapi.HealthResponse{
+		Status:    serverapi.PtrString(HealthStatusHealthy),
+		Timestamp: serverapi.PtrTime(time.Now().UTC()),
+		Checks:    []serverapi.HealthCheck{},
+	}
+	for _, check := range healthChecks {
+		if check.bridgeOnly && !s.config.BridgeNetworking() {
+			continue
+		}
+		result := serverapi.HealthCheck{
+			Name:     serverapi.PtrString(check.name),
+			Status:   serverapi.PtrString(healthCheckOK),
+			Critical: serverapi.PtrBool(check.critical),
+		}
+		if reason, err := check.check(s); err != nil {
+			log.WithField("check", check.name).WithError(err).Warn("health check failed")
+			result.Status = serverapi.PtrString(healthCheckFailed)
+			result.Message = serverapi.PtrString(reason)
+			switch {
+			case check.critical:
+				resp.Status = serverapi.PtrString(HealthStatusUnhealthy)
+			case resp.GetStatus() == HealthStatusHealthy:
+				resp.Status = serverapi.PtrString(HealthStatusDegraded)
+			}
+		}
+		resp.Checks = append(resp.Checks, result)
+	}
+	return resp
+}
+
+// checkChvBinary checks that the cloud-hypervisor binary is an executable
+// file.
+func (s *Server) checkChvBinary() (string, error) {
+	info, err := os.Stat(s.config.ChvBinPath)
+	if err != nil {
+		return "not found", err
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return "not executable", errors.New(s.config.ChvBinPath + " is not an executable file")
+	}
+	return "", nil
+}
+
+// checkBridge checks that the bridge interface is up.
+func (s *Server) checkBridge() (string, error) {
+	iface, err := net.InterfaceByName(s.config.BridgeName)
+	if err != nil {
+		return "not found", err
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return "down", errors.New(s.config.BridgeName + " is down")
+	}
+	return "", nil
+}
+
+// checkStateDir checks that files can be created in the state dir.
+func (s *Server) checkStateDir() (string, error) {
+	file, err := os.CreateTemp(s.config.StateDir, ".health-*")
+	if err != nil {
+		return "not writable", err
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return "", nil
+}
+
+// checkAllocator checks that the allocator named name has free capacity.
+func (s *Server) checkAllocator(name string) (string, error) {
+	for _, occupancy := range s.network.Occupancy() {
+		if occupancy.Name == name && occupancy.Used >= occupancy.Capacity {
+			return "exhausted", errors.New(name + " allocator is exhausted")
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+const (
+	// heartbeatMethod is the callback method guests send heartbeats with.
+	heartbeatMethod = "cbox.heartbeat"
+	// heartbeatMissedBeats is how many heartbeats a guest can miss before
+	// it's reported unresponsive.
+	heartbeatMissedBeats = 3
+
+	healthHealthy      = "HEALTHY"
+	healthUnresponsive = "UNRESPONSIVE"
+	// healthUnknown is reported until the first heartbeat, and for guests
+	// whose agent doesn't send any.
+	healthUnknown = "UNKNOWN"
+)
+
+// guestStats is the guest health reported by a heartbeat.
+type guestStats struct {
+	UptimeSeconds     float64 `json:"uptimeSeconds"`
+	Load1             float64 `json:"load1"`
+	Load5             float64 `json:"load5"`
+	Load15            float64 `json:"load15"`
+	MemTotalBytes     int64   `json:"memTotalBytes"`
+	MemFreeBytes      int64   `json:"memFreeBytes"`
+	MemAvailableBytes int64   `json:"memAvailableBytes"`
+	// IntervalSeconds is how often the guest sends heartbeats.
+	IntervalSeconds float64 `json:"intervalSeconds"`
+}
+
+// recordHeartbeat records a heartbeat from a VM's guest.
+func (s *Server) recordHeartbeat(vmName string, params json.RawMessage) (json.RawMessage, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	var stats guestStats
+	if err := json.Unmarshal(params, &stats); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid heartbeat: %v", err))
+	}
+
+	vm.lock.Lock()
+	vm.lastHeartbeat = time.Now()
+	vm.guestStats = &stats
+	vm.heartbeatMissed = false
+	vm.lock.Unlock()
+	return json.RawMessage("{}"), nil
+}
+
+// health returns the guest's health as its heartbeats show it.
+func (v *vm) health() string {
+	v.lock.RLock()
+	lastHeartbeat, stats := v.lastHeartbeat, v.guestStats
+	v.lock.RUnlock()
+	if stats == nil {
+		return healthUnknown
+	}
+	return heartbeatHealth(time.Since(lastHeartbeat), stats)
+}
+
+// apiHeartbeat returns the VM's last heartbeat and the health derived from
+// its age.
+func (v *vm) apiHeartbeat() *serverapi.GuestHeartbeat {
+	v.lock.RLock()
+	lastHeartbeat, stats := v.lastHeartbeat, v.guestStats
+	v.lock.RUnlock()
+	if stats == nil {
+		return &serverapi.GuestHeartbeat{Health: serverapi.PtrString(healthUnknown)}
+	}
+
+	age := time.Since(lastHeartbeat)
+	health := heartbeatHealth(age, stats)
+	return &serverapi.GuestHeartbeat{
+		Health:            serverapi.PtrString(health),
+		LastHeartbeatAt:   serverapi.PtrTime(lastHeartbeat.UTC()),
+		AgeSeconds:        serverapi.PtrFloat64(age.Seconds()),
+		IntervalSeconds:   serverapi.PtrFloat64(stats.IntervalSeconds),
+		UptimeSeconds:     serverapi.PtrFloat64(stats.UptimeSeconds),
+		Load1:             serverapi.PtrFloat64(stats.Load1),
+		Load5:             serverapi.PtrFloat64(stats.Load5),
+		Load15:            serverapi.PtrFloat64(stats.Load15),
+		MemTotalBytes:     serverapi.PtrInt64(stats.MemTotalBytes),
+		MemFreeBytes:      serverapi.PtrInt64(stats.MemFreeBytes),
+		MemAvailableBytes: serverapi.PtrInt64(stats.MemAvailableBytes),
+	}
+}
+
+// heartbeatHealth returns the health of a guest whose last heartbeat, which
+// reported stats, is age old.
+func heartbeatHealth(age time.Duration, stats *guestStats) string {
+	interval := time.Duration(stats.IntervalSeconds * float64(time.Second))
+	if interval > 0 && age > heartbeatMissedBeats*interval {
+		return healthUnresponsive
+	}
+	return healthHealthy
+}
+
+// runHeartbeatMonitor publishes a vm.heartbeat_missed event when a guest
+// becomes unresponsive, once until it sends a heartbeat again.
+func (s *Server) runHeartbeatMonitor() {
+	ticker := time.NewTicker(s.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.lock.RLock()
+		vms := make([]*vm, 0, len(s.vms))
+		for _, vm := range s.vms {
+			vms = append(vms, vm)
+		}
+		s.lock.RUnlock()
+
+		for _, vm := range vms {
+			vm.lock.Lock()
+			stats, lastHeartbeat := vm.guestStats, vm.lastHeartbeat
+			age := time.Since(lastHeartbeat)
+			missed := stats != nil && !vm.heartbeatMissed && heartbeatHealth(age, stats) == healthUnresponsive
+			if missed {
+				vm.heartbeatMissed = true
+			}
+			vm.lock.Unlock()
+			if !missed {
+				continue
+			}
+
+			log.WithField("vmName", vm.name).WithField("age", age).Warn("guest missed its heartbeats")
+			s.events.Publish(events.TypeVMHeartbeatMissed, vm.name, map[string]any{
+				"lastHeartbeatAt": lastHeartbeat.UTC(),
+				"ageSeconds":      age.Seconds(),
+			})
+		}
+	}
+}
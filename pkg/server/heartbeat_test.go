@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+// sendHeartbeat sends a heartbeat with params on a vsock callback connection
+// of vmName, as its vsockserver does, and returns the response.
+func sendHeartbeat(t *testing.T, s *Server, vmName string, params string) vsockCallbackResponse {
+	t.Helper()
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.handleVsockCallbackConn(vmName, conn)
+
+	fmt.Fprintf(client, `{"vmName":%q,"method":%q,"params":%s}`+"\n", vmName, heartbeatMethod, params)
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("reading heartbeat response: %v", err)
+	}
+	var resp vsockCallbackResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		t.Fatalf("heartbeat response %q: %v", line, err)
+	}
+	return resp
+}
+
+// checkHealth checks the health ListVM reports for vmName.
+func checkHealth(t *testing.T, s *Server, vmName string, want string) {
+	t.Helper()
+	resp, err := s.ListVM(context.Background(), vmName)
+	if err != nil {
+		t.Fatalf("ListVM: %v", err)
+	}
+	if got := resp.Heartbeat.GetHealth(); got != want {
+		t.Errorf("health = %s, want %s", got, want)
+	}
+}
+
+func TestHeartbeatHealth(t *testing.T) {
+	h := newTestHarness(t, func(c *config.ServerConfig) { c.HeartbeatInterval = 10 * time.Millisecond })
+	sub := h.server.Events().Subscribe(context.Background(), 0)
+	defer sub.Close()
+	h.startVM("vm1")
+	checkHealth(t, h.server, "vm1", healthUnknown)
+
+	if resp := sendHeartbeat(t, h.server, "vm1", `{"intervalSeconds":0.2,"load1":0.5,"memFreeBytes":1024}`); resp.Error != "" {
+		t.Fatalf("heartbeat: %s", resp.Error)
+	}
+	resp, err := h.server.ListVM(context.Background(), "vm1")
+	if err != nil {
+		t.Fatalf("ListVM: %v", err)
+	}
+	if hb := resp.Heartbeat; hb.GetHealth() != healthHealthy || hb.GetLoad1() != 0.5 || hb.GetMemFreeBytes() != 1024 || hb.GetIntervalSeconds() != 0.2 {
+		t.Errorf("heartbeat = %+v, want healthy with the reported stats", hb)
+	}
+
+	// Three missed beats make the guest unresponsive, which is published
+	// once.
+	waitForEvent(t, sub, events.TypeVMHeartbeatMissed, "vm1")
+	checkHealth(t, h.server, "vm1", healthUnresponsive)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	for {
+		event, err := sub.Next(ctx)
+		if err != nil {
+			break
+		}
+		if event.Type == events.TypeVMHeartbeatMissed {
+			t.Fatalf("vm.heartbeat_missed published again: %+v", event)
+		}
+	}
+
+	// The next heartbeat makes it healthy again.
+	sendHeartbeat(t, h.server, "vm1", `{"intervalSeconds":60}`)
+	checkHealth(t, h.server, "vm1", healthHealthy)
+}
+
+func TestHeartbeatErrors(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	for _, tc := range []struct {
+		vmName string
+		params string
+		errMsg string
+	}{
+		{"vm1", `"fast"`, "invalid heartbeat"},
+		{"vm2", `{"intervalSeconds":15}`, "vm not found"},
+	} {
+		if resp := sendHeartbeat(t, h.server, tc.vmName, tc.params); !strings.Contains(resp.Error, tc.errMsg) {
+			t.Errorf("heartbeat of %s with %s = %+v, want error %q", tc.vmName, tc.params, resp, tc.errMsg)
+		}
+	}
+	checkHealth(t, h.server, "vm1", healthUnknown)
+}
+
+func TestHeartbeatHealthAge(t *testing.T) {
+	for _, tc := range []struct {
+		age      time.Duration
+		interval float64
+		want     string
+	}{
+		{time.Second, 15, healthHealthy},
+		{45 * time.Second, 15, healthHealthy},
+		{46 * time.Second, 15, healthUnresponsive},
+		// Guests that don't say when the next one is due stay healthy.
+		{time.Hour, 0, healthHealthy},
+	} {
+		if got := heartbeatHealth(tc.age, &guestStats{IntervalSeconds: tc.interval}); got != tc.want {
+			t.Errorf("health %s after a heartbeat every %gs = %s, want %s", tc.age, tc.interval, got, tc.want)
+		}
+	}
+}
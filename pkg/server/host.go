@@ -0,0 +1,56 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+)
+
+// HostInfo returns the host's CPU topology, the VMs pinned to each CPU, the
+// occupancy of the IP and CID allocators and which host binaries were found.
+func (s *Server) HostInfo() (*serverapi.HostInfoResponse, error) {
+	topo, err := readHostTopology()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &serverapi.HostInfoResponse{
+		NumaNodes:    []serverapi.HostNumaNode{},
+		Cpus:         []serverapi.HostCpu{},
+		NetworkMode:  serverapi.PtrString(s.config.NetworkMode),
+		Capabilities: s.apiCapabilities(),
+	}
+	ids := make([]int, 0, len(topo.nodes))
+	for id := range topo.nodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		resp.NumaNodes = append(resp.NumaNodes, serverapi.HostNumaNode{
+			Id:   serverapi.PtrInt32(int32(id)),
+			Cpus: serverapi.PtrString(formatCPUList(topo.nodes[id])),
+		})
+	}
+
+	pinned := s.pinnedCPUs()
+	for _, cpu := range topo.cpus {
+		hostCPU := serverapi.HostCpu{
+			Cpu: serverapi.PtrInt32(int32(cpu)),
+			Vms: pinned[cpu],
+		}
+		if node, ok := topo.nodeOf(cpu); ok {
+			hostCPU.NumaNode = serverapi.PtrInt32(int32(node))
+		}
+		resp.Cpus = append(resp.Cpus, hostCPU)
+	}
+
+	for _, occupancy := range s.network.Occupancy() {
+		resp.Allocators = append(resp.Allocators, serverapi.AllocatorOccupancy{
+			Name:     serverapi.PtrString(occupancy.Name),
+			Used:     serverapi.PtrInt32(int32(occupancy.Used)),
+			Free:     serverapi.PtrInt32(int32(occupancy.Capacity - occupancy.Used)),
+			Capacity: serverapi.PtrInt32(int32(occupancy.Capacity)),
+		})
+	}
+	return resp, nil
+}
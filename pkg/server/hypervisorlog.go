@@ -0,0 +1,91 @@
+package server
+
+import (
+	"io"
+	"os"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	hypervisorLogTailLines    = 50
+	hypervisorLogTailMaxBytes = 16 * 1024
+)
+
+// HypervisorError is a VM creation or boot failure annotated with the tail of
+// the VM's cloud-hypervisor log, which usually explains the terse API error.
+type HypervisorError struct {
+	Err     error
+	LogTail string
+}
+
+func (e *HypervisorError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HypervisorError) Unwrap() error {
+	return e.Err
+}
+
+// readLogTail returns up to the last lines lines of the file at logPath,
+// reading at most maxBytes from its end. Control characters other than
+// newlines and tabs are dropped so the tail is safe to return in JSON.
+func readLogTail(logPath string, lines int, maxBytes int64) (string, error) {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size() - maxBytes
+	if offset < 0 {
+		offset = 0
+	}
+	data, err := io.ReadAll(io.NewSectionReader(f, offset, info.Size()-offset))
+	if err != nil {
+		return "", err
+	}
+
+	tail := strings.ToValidUTF8(string(data), "")
+	if offset > 0 {
+		// Drop the partial first line.
+		if idx := strings.IndexByte(tail, '\n'); idx != -1 {
+			tail = tail[idx+1:]
+		}
+	}
+	tailLines := strings.Split(strings.TrimRight(tail, "\n"), "\n")
+	if len(tailLines) > lines {
+		tailLines = tailLines[len(tailLines)-lines:]
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+		return -1
+	}, strings.Join(tailLines, "\n")), nil
+}
+
+// withHypervisorLogTail logs the tail of the VM's cloud-hypervisor log and,
+// unless disabled in the config, attaches it to err.
+func (s *Server) withHypervisorLogTail(vmName string, logPath string, err error) error {
+	tail, readErr := readLogTail(logPath, hypervisorLogTailLines, hypervisorLogTailMaxBytes)
+	if readErr != nil || tail == "" {
+		return err
+	}
+
+	log.WithField("vmName", vmName).Errorf("cloud-hypervisor log tail:\n%s", tail)
+	if s.config.DisableHypervisorLogTail {
+		return err
+	}
+	return &HypervisorError{
+		Err:     err,
+		LogTail: tail,
+	}
+}
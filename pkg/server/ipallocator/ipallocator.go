@@ -1,15 +1,84 @@
 package ipallocator
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 )
 
+var (
+	// ErrExhausted is returned by AllocateIP when every IP is allocated.
+	ErrExhausted = errors.New("no available IPs")
+	// ErrNotInSubnet is returned for an IP outside the allocator's subnet.
+	ErrNotInSubnet = errors.New("IP is not in the subnet")
+	// ErrUnavailable is returned by AllocateSpecificIP for an IP that is
+	// already allocated or reserved, like the gateway.
+	ErrUnavailable = errors.New("IP is not available")
+)
+
 type IPAllocator struct {
 	subnet    *net.IPNet
 	available []net.IP
+	capacity  int
 	mutex     sync.Mutex
+	// exclusions are never allocated, on top of the subnet's network and
+	// broadcast addresses.
+	exclusions []*net.IPNet
+}
+
+// Option configures an IPAllocator.
+type Option func(*IPAllocator) error
+
+// WithExclusions keeps the IPs and CIDRs in exclusions from being allocated,
+// instead of the subnet's first host address, which is otherwise assumed to
+// be the gateway.
+func WithExclusions(exclusions ...string) Option {
+	return func(a *IPAllocator) error {
+		a.exclusions = []*net.IPNet{}
+		for _, exclusion := range exclusions {
+			excluded, err := ParseExclusion(exclusion)
+			if err != nil {
+				return err
+			}
+			a.exclusions = append(a.exclusions, excluded)
+		}
+		return nil
+	}
+}
+
+// ParseExclusion parses an IP or CIDR to exclude from allocation. IPs may
+// carry a prefix length, like a bridge IP, which is ignored.
+func ParseExclusion(exclusion string) (*net.IPNet, error) {
+	if ip := net.ParseIP(exclusion); ip != nil {
+		return hostNet(ip), nil
+	}
+	ip, ipNet, err := net.ParseCIDR(exclusion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP or CIDR to exclude: %q", exclusion)
+	}
+	if !ip.Equal(ipNet.IP) {
+		// An address with its prefix length rather than a network.
+		return hostNet(ip), nil
+	}
+	return ipNet, nil
+}
+
+// hostNet returns the network of ip alone.
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func (a *IPAllocator) excluded(ip net.IP) bool {
+	for _, exclusion := range a.exclusions {
+		if exclusion.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func incrementIP(ip net.IP) net.IP {
@@ -29,24 +98,37 @@ func copyIP(ip net.IP) net.IP {
 	return dup
 }
 
-func NewIPAllocator(subnetCIDR string) (*IPAllocator, error) {
+// NewIPAllocator creates an allocator of the host addresses in subnetCIDR.
+// The network and broadcast addresses are never allocated, and neither is
+// the first host address, the gateway, unless WithExclusions says otherwise.
+func NewIPAllocator(subnetCIDR string, opts ...Option) (*IPAllocator, error) {
 	_, subnet, err := net.ParseCIDR(subnetCIDR)
 	if err != nil {
 		return nil, fmt.Errorf("invalid subnet CIDR: %v", err)
 	}
 
 	allocator := &IPAllocator{
-		subnet:    subnet,
-		available: []net.IP{},
+		subnet:     subnet,
+		available:  []net.IP{},
+		exclusions: []*net.IPNet{hostNet(incrementIP(subnet.IP))},
+	}
+	for _, opt := range opts {
+		if err := opt(allocator); err != nil {
+			return nil, err
+		}
 	}
 
-	// The first one will be reserved as the gateway. Start from x.x.x.2.
-	ip := incrementIP(subnet.IP)
-
-	// Generate all available IPs in the subnet
-	for ip := incrementIP(ip); subnet.Contains(ip); ip = incrementIP(ip) {
-		allocator.available = append(allocator.available, copyIP(ip))
+	// Generate all available IPs in the subnet, between the network and
+	// broadcast addresses.
+	for ip := incrementIP(subnet.IP); subnet.Contains(ip); ip = incrementIP(ip) {
+		if !subnet.Contains(incrementIP(ip)) {
+			break
+		}
+		if !allocator.excluded(ip) {
+			allocator.available = append(allocator.available, copyIP(ip))
+		}
 	}
+	allocator.capacity = len(allocator.available)
 
 	return allocator, nil
 }
@@ -56,7 +138,7 @@ func (a *IPAllocator) AllocateIP() (*net.IPNet, error) {
 	defer a.mutex.Unlock()
 
 	if len(a.available) == 0 {
-		return nil, fmt.Errorf("no available IPs")
+		return nil, ErrExhausted
 	}
 
 	ip := a.available[0]
@@ -75,27 +157,48 @@ func (a *IPAllocator) FreeIP(ip net.IP) error {
 	if !a.subnet.Contains(ip) {
 		return fmt.Errorf("IP %v is not in the subnet", ip)
 	}
+	if a.excluded(ip) {
+		return fmt.Errorf("IP %v is excluded from allocation", ip)
+	}
 
 	a.available = append(a.available, copyIP(ip))
 	return nil
 }
 
-// ClaimIP attempts to claim a specific IP address from the pool.
-// Returns error if the IP is already allocated or not in the subnet.
-func (a *IPAllocator) ClaimIP(ip net.IP) error {
+// Occupancy returns the number of allocated IPs and the number of IPs in the
+// subnet available to guests.
+func (a *IPAllocator) Occupancy() (used int, capacity int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return max(a.capacity-len(a.available), 0), a.capacity
+}
+
+// AllocateSpecificIP allocates ip rather than the next available IP. It fails
+// with ErrNotInSubnet or ErrUnavailable.
+func (a *IPAllocator) AllocateSpecificIP(ip net.IP) (*net.IPNet, error) {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
 	if !a.subnet.Contains(ip) {
-		return fmt.Errorf("IP %v is not in the subnet", ip)
+		return nil, fmt.Errorf("%w: %v", ErrNotInSubnet, ip)
 	}
 
 	for i, availIP := range a.available {
 		if availIP.Equal(ip) {
 			// Remove this IP from available pool
 			a.available = append(a.available[:i], a.available[i+1:]...)
-			break
+			return &net.IPNet{
+				IP:   availIP,
+				Mask: a.subnet.Mask,
+			}, nil
 		}
 	}
-	return nil
+	return nil, fmt.Errorf("%w: %v", ErrUnavailable, ip)
+}
+
+// ClaimIP attempts to claim a specific IP address from the pool.
+// Returns error if the IP is already allocated or not in the subnet.
+func (a *IPAllocator) ClaimIP(ip net.IP) error {
+	_, err := a.AllocateSpecificIP(ip)
+	return err
 }
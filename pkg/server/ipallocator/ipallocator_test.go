@@ -0,0 +1,121 @@
+package ipallocator
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+// allocateAll allocates every available IP, in order.
+func allocateAll(t *testing.T, a *IPAllocator) []string {
+	t.Helper()
+	var ips []string
+	for {
+		ip, err := a.AllocateIP()
+		if errors.Is(err, ErrExhausted) {
+			return ips
+		}
+		if err != nil {
+			t.Fatalf("AllocateIP: %v", err)
+		}
+		ips = append(ips, ip.IP.String())
+	}
+}
+
+func TestDefaultExclusions(t *testing.T) {
+	a, err := NewIPAllocator("10.0.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The network, gateway and broadcast addresses are left out.
+	want := []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}
+	if got := allocateAll(t, a); !slices.Equal(got, want) {
+		t.Errorf("allocated %v, want %v", got, want)
+	}
+}
+
+func TestExclusionBoundaries(t *testing.T) {
+	a, err := NewIPAllocator("10.0.0.0/28", WithExclusions("10.0.0.1/28", "10.0.0.4/31", "10.0.0.14"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, capacity := a.Occupancy(); capacity != 10 {
+		t.Errorf("capacity = %d, want 10", capacity)
+	}
+	for _, tc := range []struct {
+		ip  string
+		err error
+	}{
+		{"10.0.0.0", ErrUnavailable},  // network
+		{"10.0.0.1", ErrUnavailable},  // the bridge IP, prefix length ignored
+		{"10.0.0.2", nil},             // just past the bridge IP
+		{"10.0.0.3", nil},             // just before the excluded range
+		{"10.0.0.4", ErrUnavailable},  // first address of the excluded range
+		{"10.0.0.5", ErrUnavailable},  // last address of the excluded range
+		{"10.0.0.6", nil},             // just past the excluded range
+		{"10.0.0.13", nil},            // just before the excluded last host
+		{"10.0.0.14", ErrUnavailable}, // the excluded last host
+		{"10.0.0.15", ErrUnavailable}, // broadcast
+		{"10.0.1.1", ErrNotInSubnet},
+	} {
+		_, err := a.AllocateSpecificIP(net.ParseIP(tc.ip).To4())
+		if !errors.Is(err, tc.err) {
+			t.Errorf("AllocateSpecificIP(%s) = %v, want %v", tc.ip, err, tc.err)
+		}
+	}
+	if err := a.FreeIP(net.ParseIP("10.0.0.4").To4()); err == nil {
+		t.Error("FreeIP of an excluded IP succeeded")
+	}
+}
+
+func TestInvalidExclusion(t *testing.T) {
+	if _, err := NewIPAllocator("10.0.0.0/28", WithExclusions("10.0.0")); err == nil {
+		t.Error("NewIPAllocator with an invalid exclusion succeeded")
+	}
+}
+
+func TestExhaustion(t *testing.T) {
+	a, err := NewIPAllocator("10.0.0.0/29", WithExclusions("10.0.0.1", "10.0.0.3/32"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := allocateAll(t, a)
+	if want := []string{"10.0.0.2", "10.0.0.4", "10.0.0.5", "10.0.0.6"}; !slices.Equal(ips, want) {
+		t.Fatalf("allocated %v, want %v", ips, want)
+	}
+	if used, capacity := a.Occupancy(); used != 4 || capacity != 4 {
+		t.Errorf("occupancy = %d/%d, want 4/4", used, capacity)
+	}
+	if _, err := a.AllocateIP(); !errors.Is(err, ErrExhausted) {
+		t.Errorf("AllocateIP when exhausted = %v, want ErrExhausted", err)
+	}
+	if _, err := a.AllocateSpecificIP(net.ParseIP("10.0.0.5").To4()); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("AllocateSpecificIP of an allocated IP = %v, want ErrUnavailable", err)
+	}
+
+	// A freed IP is handed out again.
+	if err := a.FreeIP(net.ParseIP("10.0.0.5").To4()); err != nil {
+		t.Fatalf("FreeIP: %v", err)
+	}
+	ip, err := a.AllocateIP()
+	if err != nil || ip.IP.String() != "10.0.0.5" {
+		t.Errorf("AllocateIP after FreeIP = %v, %v, want 10.0.0.5", ip, err)
+	}
+	if _, err := a.AllocateIP(); !errors.Is(err, ErrExhausted) {
+		t.Errorf("AllocateIP when exhausted again = %v, want ErrExhausted", err)
+	}
+}
+
+func TestExclusionsCoverSubnet(t *testing.T) {
+	a, err := NewIPAllocator("10.0.0.0/29", WithExclusions("10.0.0.0/29"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, capacity := a.Occupancy(); capacity != 0 {
+		t.Errorf("capacity = %d, want 0", capacity)
+	}
+	if _, err := a.AllocateIP(); !errors.Is(err, ErrExhausted) {
+		t.Errorf("AllocateIP = %v, want ErrExhausted", err)
+	}
+}
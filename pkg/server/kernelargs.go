@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// maxKernelCmdlineBytes is the longest kernel command line x86 guests take.
+const maxKernelCmdlineBytes = 2048
+
+// reservedKernelArgs are the kernel args getKernelCmdLine sets, which extra
+// args can't override.
+var reservedKernelArgs = []string{"console", "gateway_ip", "guest_ip", "vm_name", "heartbeat_interval"}
+
+// validateKernelArgs checks extra kernel args, from default_kernel_args or a
+// start request, before they're appended to the generated command line.
+func validateKernelArgs(args string) error {
+	if strings.ContainsFunc(args, unicode.IsControl) {
+		return fmt.Errorf("kernel args must not contain newlines or other control characters")
+	}
+	for _, arg := range strings.Fields(args) {
+		key, _, _ := strings.Cut(arg, "=")
+		if slices.Contains(reservedKernelArgs, key) {
+			return fmt.Errorf("kernel arg %s is set by cbox and can't be overridden", key)
+		}
+	}
+	return nil
+}
+
+// appendKernelArgs appends the non-empty of args to cmdline, space separated.
+func appendKernelArgs(cmdline string, args ...string) string {
+	for _, arg := range args {
+		if arg = strings.TrimSpace(arg); arg != "" {
+			cmdline += " " + arg
+		}
+	}
+	return cmdline
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const maxLabels = 64
+
+var (
+	labelKeyRegexp   = regexp.MustCompile(`^[A-Za-z0-9._/-]{1,63}$`)
+	labelValueRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{0,63}$`)
+)
+
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("at most %d labels are allowed", maxLabels))
+	}
+	for key, value := range labels {
+		if !labelKeyRegexp.MatchString(key) {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid label key: %q", key))
+		}
+		if !labelValueRegexp.MatchString(value) {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid value of label %s: %q", key, value))
+		}
+	}
+	return nil
+}
+
+// labelRequirement is one comma-separated term of a label selector.
+type labelRequirement struct {
+	key   string
+	value string
+	// op is "=", "!=", "exists" or "!exists".
+	op string
+}
+
+func (r labelRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.op {
+	case "=":
+		return ok && value == r.value
+	case "!=":
+		return !ok || value != r.value
+	case "exists":
+		return ok
+	default:
+		return !ok
+	}
+}
+
+// labelSelector matches VMs whose labels meet all of its requirements.
+type labelSelector []labelRequirement
+
+// parseLabelSelector parses selectors like "env=ci,tier!=db,gpu,!spot".
+func parseLabelSelector(selector string) (labelSelector, error) {
+	var sel labelSelector
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		var req labelRequirement
+		switch {
+		case term == "":
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("empty term in label selector %q", selector))
+		case strings.Contains(term, "!="):
+			req.key, req.value, _ = strings.Cut(term, "!=")
+			req.op = "!="
+		case strings.Contains(term, "="):
+			req.key, req.value, _ = strings.Cut(term, "=")
+			req.op = "="
+		case strings.HasPrefix(term, "!"):
+			req.key = strings.TrimPrefix(term, "!")
+			req.op = "!exists"
+		default:
+			req.key = term
+			req.op = "exists"
+		}
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if !labelKeyRegexp.MatchString(req.key) || !labelValueRegexp.MatchString(req.value) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid label selector term %q", term))
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for _, req := range sel {
+		if !req.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// apiLabels returns a copy of the VM's labels for API responses, or nil if
+// it has none.
+func (v *vm) apiLabels() *map[string]string {
+	if len(v.labels) == 0 {
+		return nil
+	}
+	labels := maps.Clone(v.labels)
+	return &labels
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+const (
+	defaultLeaseTTL = 15 * time.Minute
+	maxLeaseTTL     = 24 * time.Hour
+	maxLeaseHolder  = 256
+)
+
+// vmLease gives its holder exclusive use of a VM until expiresAt.
+type vmLease struct {
+	holder    string
+	token     string
+	expiresAt time.Time
+}
+
+// LeaseHeldError is returned for requests to a leased VM that don't carry
+// the lease token.
+type LeaseHeldError struct {
+	VMName    string
+	Holder    string
+	ExpiresAt time.Time
+}
+
+func (e *LeaseHeldError) Error() string {
+	return fmt.Sprintf("vm %s is leased by %s until %s", e.VMName, e.Holder, e.ExpiresAt.Format(time.RFC3339))
+}
+
+func (e *LeaseHeldError) GRPCStatus() *status.Status {
+	return status.New(codes.FailedPrecondition, e.Error())
+}
+
+type leaseTokenKey struct{}
+
+type breakLeaseKey struct{}
+
+// WithLeaseToken returns a context under which requests to a VM leased with
+// token are allowed.
+func WithLeaseToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, leaseTokenKey{}, token)
+}
+
+// WithBreakLease returns a context under which DestroyVM destroys a leased VM
+// without its token. Admin-only.
+func WithBreakLease(ctx context.Context) context.Context {
+	return context.WithValue(ctx, breakLeaseKey{}, true)
+}
+
+// activeLease returns the VM's lease, or nil if it has none or it expired.
+// Must be called with v.lock held.
+func (v *vm) activeLease() *vmLease {
+	if v.lease == nil || !time.Now().Before(v.lease.expiresAt) {
+		return nil
+	}
+	return v.lease
+}
+
+// checkLease returns a LeaseHeldError if vm is leased and ctx doesn't carry
+// the lease token.
+func checkLease(ctx context.Context, vm *vm) error {
+	vm.lock.RLock()
+	defer vm.lock.RUnlock()
+	return checkLeaseLocked(ctx, vm)
+}
+
+// checkLeaseLocked is checkLease for callers that hold vm.lock, so the
+// lease can't change between the check and their use of it.
+func checkLeaseLocked(ctx context.Context, vm *vm) error {
+	lease := vm.activeLease()
+	if lease == nil {
+		return nil
+	}
+	token, _ := ctx.Value(leaseTokenKey{}).(string)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(lease.token)) != 1 {
+		return &LeaseHeldError{VMName: vm.name, Holder: lease.holder, ExpiresAt: lease.expiresAt}
+	}
+	return nil
+}
+
+func leaseTTL(ttlSeconds int32) (time.Duration, error) {
+	if ttlSeconds == 0 {
+		return defaultLeaseTTL, nil
+	}
+	ttl := time.Duration(ttlSeconds) * time.Second
+	if ttl < 0 || ttl > maxLeaseTTL {
+		return 0, status.Error(codes.InvalidArgument, fmt.Sprintf("ttlSeconds must be between 1 and %d", int(maxLeaseTTL.Seconds())))
+	}
+	return ttl, nil
+}
+
+func (l *vmLease) apiLease(withToken bool) *serverapi.VmLease {
+	lease := &serverapi.VmLease{
+		Holder:    serverapi.PtrString(l.holder),
+		ExpiresAt: serverapi.PtrTime(l.expiresAt),
+	}
+	if withToken {
+		lease.Token = serverapi.PtrString(l.token)
+	}
+	return lease
+}
+
+// AcquireLease leases a VM to holder for ttlSeconds, or the default TTL if
+// zero. It fails with a LeaseHeldError while another lease is active, even
+// one held by the same holder; that one has to be renewed instead.
+func (s *Server) AcquireLease(vmName string, req *serverapi.AcquireLeaseRequest) (*serverapi.VmLease, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if req.Holder == "" || len(req.Holder) > maxLeaseHolder {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("holder must be between 1 and %d characters", maxLeaseHolder))
+	}
+	ttl, err := leaseTTL(req.GetTtlSeconds())
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to generate lease token: %w", err)
+	}
+
+	vm.lock.Lock()
+	if lease := vm.activeLease(); lease != nil {
+		vm.lock.Unlock()
+		return nil, &LeaseHeldError{VMName: vmName, Holder: lease.holder, ExpiresAt: lease.expiresAt}
+	}
+	vm.lease = &vmLease{
+		holder:    req.Holder,
+		token:     hex.EncodeToString(token),
+		expiresAt: time.Now().Add(ttl),
+	}
+	vm.saveRecordLogged()
+	resp := vm.lease.apiLease(true)
+	vm.lock.Unlock()
+
+	log.WithFields(log.Fields{
+		"vmName":    vmName,
+		"holder":    req.Holder,
+		"expiresAt": resp.GetExpiresAt(),
+	}).Info("vm leased")
+	s.events.Publish(events.TypeVMLeaseAcquired, vmName, map[string]any{
+		"holder":    req.Holder,
+		"expiresAt": resp.GetExpiresAt(),
+	})
+	return resp, nil
+}
+
+// RenewLease extends the VM's lease, which ctx must carry the token of, to
+// ttlSeconds from now.
+func (s *Server) RenewLease(ctx context.Context, vmName string, req *serverapi.RenewLeaseRequest) (*serverapi.VmLease, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	ttl, err := leaseTTL(req.GetTtlSeconds())
+	if err != nil {
+		return nil, err
+	}
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	if err := checkLeaseLocked(ctx, vm); err != nil {
+		return nil, err
+	}
+	lease := vm.activeLease()
+	if lease == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm %s has no active lease", vmName))
+	}
+	lease.expiresAt = time.Now().Add(ttl)
+	vm.saveRecordLogged()
+	return lease.apiLease(true), nil
+}
+
+// ReleaseLease ends the VM's lease, which ctx must carry the token of.
+// Releasing an expired lease succeeds.
+func (s *Server) ReleaseLease(ctx context.Context, vmName string) error {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	vm.lock.Lock()
+	if err := checkLeaseLocked(ctx, vm); err != nil {
+		vm.lock.Unlock()
+		return err
+	}
+	lease := vm.activeLease()
+	vm.lease = nil
+	vm.saveRecordLogged()
+	vm.lock.Unlock()
+	if lease != nil {
+		s.events.Publish(events.TypeVMLeaseReleased, vmName, map[string]any{
+			"holder": lease.holder,
+		})
+	}
+	return nil
+}
+
+// breakLease checks that a destroy under ctx may proceed despite the VM's
+// lease, recording a broken lease if ctx comes from an admin.
+func (s *Server) breakLease(ctx context.Context, vm *vm) error {
+	vm.lock.Lock()
+	err := checkLeaseLocked(ctx, vm)
+	if err == nil || ctx.Value(breakLeaseKey{}) == nil {
+		vm.lock.Unlock()
+		return err
+	}
+	lease := vm.activeLease()
+	vm.lease = nil
+	vm.saveRecordLogged()
+	vm.lock.Unlock()
+	if lease != nil {
+		log.WithFields(log.Fields{
+			"vmName": vm.name,
+			"holder": lease.holder,
+		}).Warn("breaking vm lease")
+		s.events.Publish(events.TypeVMLeaseBroken, vm.name, map[string]any{
+			"holder":    lease.holder,
+			"expiresAt": lease.expiresAt,
+		})
+	}
+	return nil
+}
+
+// apiLease returns the VM's active lease, without its token, for API
+// responses.
+func (v *vm) apiLease() *serverapi.VmLease {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	if lease := v.activeLease(); lease != nil {
+		return lease.apiLease(false)
+	}
+	return nil
+}
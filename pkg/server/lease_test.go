@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+func TestLeaseContention(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	lease, err := h.server.AcquireLease("vm1", &serverapi.AcquireLeaseRequest{Holder: "job-1"})
+	if err != nil {
+		t.Fatalf("AcquireLease: %v", err)
+	}
+	if lease.GetToken() == "" || time.Until(lease.GetExpiresAt()) <= defaultLeaseTTL-time.Minute {
+		t.Errorf("lease = %+v, want a token and the default TTL", lease)
+	}
+
+	// Another job can neither lease the VM nor use it.
+	var held *LeaseHeldError
+	if _, err := h.server.AcquireLease("vm1", &serverapi.AcquireLeaseRequest{Holder: "job-2"}); !errors.As(err, &held) || held.Holder != "job-1" {
+		t.Errorf("second AcquireLease = %v, want it held by job-1", err)
+	}
+	// Not even the same holder, which has to renew instead.
+	if _, err := h.server.AcquireLease("vm1", &serverapi.AcquireLeaseRequest{Holder: "job-1"}); !errors.As(err, &held) {
+		t.Errorf("AcquireLease by the holder = %v, want it held", err)
+	}
+	for name, ctx := range map[string]context.Context{
+		"no token":    context.Background(),
+		"wrong token": WithLeaseToken(context.Background(), "not-the-token"),
+	} {
+		if _, err := h.server.VMExec(ctx, "vm1", &serverapi.VmExecRequest{Cmd: "true"}); !errors.As(err, &held) || !held.ExpiresAt.Equal(lease.GetExpiresAt()) {
+			t.Errorf("VMExec with %s = %v, want the lease's holder and expiry", name, err)
+		}
+		if _, err := h.server.DestroyVM(ctx, "vm1"); !errors.As(err, &held) {
+			t.Errorf("DestroyVM with %s = %v, want it held", name, err)
+		}
+		if err := h.server.ReleaseLease(ctx, "vm1"); !errors.As(err, &held) {
+			t.Errorf("ReleaseLease with %s = %v, want it held", name, err)
+		}
+	}
+	if _, err := h.server.VMExec(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "true"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("status code = %s, want FailedPrecondition", status.Code(err))
+	}
+
+	// The holder can, and can release the lease for the next job.
+	ctx := WithLeaseToken(context.Background(), lease.GetToken())
+	if _, err := h.server.VMExec(ctx, "vm1", &serverapi.VmExecRequest{Cmd: "true"}); err != nil {
+		t.Errorf("VMExec with the lease token: %v", err)
+	}
+	if err := h.server.ReleaseLease(ctx, "vm1"); err != nil {
+		t.Fatalf("ReleaseLease: %v", err)
+	}
+	if _, err := h.server.AcquireLease("vm1", &serverapi.AcquireLeaseRequest{Holder: "job-2"}); err != nil {
+		t.Errorf("AcquireLease after release: %v", err)
+	}
+}
+
+func TestLeaseExpiryAndRenewal(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	lease, err := h.server.AcquireLease("vm1", &serverapi.AcquireLeaseRequest{Holder: "job-1", TtlSeconds: serverapi.PtrInt32(60)})
+	if err != nil {
+		t.Fatalf("AcquireLease: %v", err)
+	}
+	ctx := WithLeaseToken(context.Background(), lease.GetToken())
+
+	renewed, err := h.server.RenewLease(ctx, "vm1", &serverapi.RenewLeaseRequest{TtlSeconds: serverapi.PtrInt32(3600)})
+	if err != nil {
+		t.Fatalf("RenewLease: %v", err)
+	}
+	if !renewed.GetExpiresAt().After(lease.GetExpiresAt().Add(30*time.Minute)) || renewed.GetToken() != lease.GetToken() {
+		t.Errorf("renewed lease = %+v, want the same token an hour out", renewed)
+	}
+	if _, err := h.server.RenewLease(context.Background(), "vm1", &serverapi.RenewLeaseRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("RenewLease without the token = %v, want FailedPrecondition", err)
+	}
+
+	// Once expired, the VM is anyone's.
+	vm := h.server.getVMAtomic("vm1")
+	vm.lock.Lock()
+	vm.lease.expiresAt = time.Now().Add(-time.Second)
+	vm.lock.Unlock()
+	if _, err := h.server.VMExec(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "true"}); err != nil {
+		t.Errorf("VMExec after the lease expired: %v", err)
+	}
+	if _, err := h.server.RenewLease(ctx, "vm1", &serverapi.RenewLeaseRequest{}); status.Code(err) != codes.NotFound {
+		t.Errorf("RenewLease of an expired lease = %v, want NotFound", err)
+	}
+	if err := h.server.ReleaseLease(ctx, "vm1"); err != nil {
+		t.Errorf("ReleaseLease of an expired lease: %v", err)
+	}
+	if resp, err := h.server.ListVM(context.Background(), "vm1"); err != nil || resp.Lease != nil {
+		t.Errorf("ListVM lease = %+v, %v, want none", resp.GetLease(), err)
+	}
+}
+
+func TestLeaseValidation(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	for name, req := range map[string]*serverapi.AcquireLeaseRequest{
+		"no holder":    {},
+		"negative TTL": {Holder: "job-1", TtlSeconds: serverapi.PtrInt32(-1)},
+		"TTL too long": {Holder: "job-1", TtlSeconds: serverapi.PtrInt32(int32(maxLeaseTTL.Seconds()) + 1)},
+	} {
+		if _, err := h.server.AcquireLease("vm1", req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("AcquireLease with %s = %v, want InvalidArgument", name, err)
+		}
+	}
+	if _, err := h.server.AcquireLease("vm2", &serverapi.AcquireLeaseRequest{Holder: "job-1"}); status.Code(err) != codes.NotFound {
+		t.Errorf("AcquireLease on a missing VM = %v, want NotFound", err)
+	}
+}
+
+func TestBreakLease(t *testing.T) {
+	h := newTestHarness(t, nil)
+	sub := h.server.Events().Subscribe(context.Background(), 0)
+	defer sub.Close()
+	h.startVM("vm1")
+	if _, err := h.server.AcquireLease("vm1", &serverapi.AcquireLeaseRequest{Holder: "job-1"}); err != nil {
+		t.Fatalf("AcquireLease: %v", err)
+	}
+
+	if _, err := h.server.DestroyVM(WithBreakLease(context.Background()), "vm1"); err != nil {
+		t.Fatalf("DestroyVM breaking the lease: %v", err)
+	}
+	event := waitForEvent(t, sub, events.TypeVMLeaseBroken, "vm1")
+	if data, _ := event.Data.(map[string]any); data["holder"] != "job-1" {
+		t.Errorf("lease broken event = %+v, want job-1's lease", event.Data)
+	}
+}
+
+func TestLeaseSurvivesRestart(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	lease, err := h.server.AcquireLease("vm1", &serverapi.AcquireLeaseRequest{Holder: "job-1"})
+	if err != nil {
+		t.Fatalf("AcquireLease: %v", err)
+	}
+	// Saved right away, not just on shutdown.
+	record, err := loadVMRecord(h.server.getVMAtomic("vm1").stateDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Lease == nil || record.Lease.Holder != "job-1" || record.Lease.Token != lease.GetToken() {
+		t.Fatalf("vm record lease = %+v, want job-1's", record.Lease)
+	}
+	// It holds the token, so it's readable by the server's user only.
+	info, err := os.Stat(path.Join(h.server.getVMAtomic("vm1").stateDirPath, vmRecordFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("vm record mode = %v, want 0600", perm)
+	}
+
+	h.restart()
+	var held *LeaseHeldError
+	if _, err := h.server.VMExec(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "true"}); !errors.As(err, &held) || held.Holder != "job-1" {
+		t.Errorf("VMExec without the token after a restart = %v, want it held by job-1", err)
+	}
+	ctx := WithLeaseToken(context.Background(), lease.GetToken())
+	if err := h.server.ReleaseLease(ctx, "vm1"); err != nil {
+		t.Fatalf("ReleaseLease after a restart: %v", err)
+	}
+	record, err = loadVMRecord(h.server.getVMAtomic("vm1").stateDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Lease != nil {
+		t.Errorf("vm record lease = %+v after release, want none", record.Lease)
+	}
+}
+
+func TestStaleLeaseTokenRacingNewLease(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+
+	// A stale holder releasing or renewing while its lease is released and
+	// the VM leased again must never touch the new lease.
+	for range 500 {
+		lease, err := h.server.AcquireLease("vm1", &serverapi.AcquireLeaseRequest{Holder: "job-1"})
+		if err != nil {
+			t.Fatalf("AcquireLease: %v", err)
+		}
+		stale := WithLeaseToken(context.Background(), lease.GetToken())
+		var next *serverapi.VmLease
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			h.server.ReleaseLease(stale, "vm1")
+		}()
+		go func() {
+			defer wg.Done()
+			h.server.RenewLease(stale, "vm1", &serverapi.RenewLeaseRequest{})
+		}()
+		go func() {
+			defer wg.Done()
+			if err := h.server.ReleaseLease(stale, "vm1"); err != nil {
+				return
+			}
+			next, _ = h.server.AcquireLease("vm1", &serverapi.AcquireLeaseRequest{Holder: "job-2", TtlSeconds: serverapi.PtrInt32(60)})
+		}()
+		wg.Wait()
+
+		current := h.server.getVMAtomic("vm1").apiLease()
+		if next != nil && (current == nil || current.GetHolder() != "job-2" || !current.GetExpiresAt().Equal(next.GetExpiresAt())) {
+			t.Fatalf("lease = %+v after the stale holder's calls, want job-2's untouched", current)
+		}
+		if current != nil {
+			if err := h.server.ReleaseLease(WithLeaseToken(context.Background(), next.GetToken()), "vm1"); err != nil {
+				t.Fatalf("ReleaseLease: %v", err)
+			}
+		}
+	}
+}
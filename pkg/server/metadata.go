@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/chvapi"
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+	"github.com/abilashraghuram/cbox/pkg/hostcmd"
+)
+
+const (
+	// maxMetadataBytes bounds a VM's metadata as JSON.
+	maxMetadataBytes = 1 << 20
+	// metadataDiskFilename is the image in a VM's state dir carrying its
+	// metadata.
+	metadataDiskFilename = "metadata.img"
+	// metadataDiskID is the VMM's device ID of the metadata disk.
+	metadataDiskID = "metadata"
+	// metadataDiskSizeMB fits maxMetadataBytes with room for ext4's own
+	// structures.
+	metadataDiskSizeMB = 8
+)
+
+// encodeMetadata validates the metadata of a start request and returns it as
+// JSON, or nil if there is none.
+func encodeMetadata(req *serverapi.StartVMRequest) ([]byte, error) {
+	if !req.HasMetadata() {
+		return nil, nil
+	}
+	metadata := req.GetMetadata()
+	if script, ok := metadata[cmdserver.MetadataUserScriptKey]; ok {
+		if _, ok := script.(string); !ok {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("metadata %s must be a string", cmdserver.MetadataUserScriptKey))
+		}
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid metadata: %v", err))
+	}
+	if len(data) > maxMetadataBytes {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("metadata must be at most %d bytes as JSON, got %d", maxMetadataBytes, len(data)))
+	}
+	return data, nil
+}
+
+// createMetadataDisk creates an ext4 image in vmStateDir holding metadata,
+// for the guest to find by its serial. It's deleted with the state dir.
+func createMetadataDisk(vmStateDir string, metadata []byte) (chvapi.DiskConfig, error) {
+	srcDir, err := os.MkdirTemp(vmStateDir, "metadata-")
+	if err != nil {
+		return chvapi.DiskConfig{}, fmt.Errorf("failed to create metadata dir: %w", err)
+	}
+	defer os.RemoveAll(srcDir)
+	if err := os.WriteFile(path.Join(srcDir, cmdserver.MetadataFilename), metadata, 0644); err != nil {
+		return chvapi.DiskConfig{}, fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	diskPath := path.Join(vmStateDir, metadataDiskFilename)
+	if err := hostcmd.Run("truncate", "-s", fmt.Sprintf("%dM", metadataDiskSizeMB), diskPath); err != nil {
+		return chvapi.DiskConfig{}, fmt.Errorf("failed to create metadata disk: %w", err)
+	}
+	// Populated from srcDir as it's formatted, so it never has to be mounted.
+	if err := hostcmd.Run("mkfs.ext4", "-q", "-d", srcDir, diskPath); err != nil {
+		return chvapi.DiskConfig{}, fmt.Errorf("failed to format metadata disk: %w", err)
+	}
+	return chvapi.DiskConfig{
+		Id:       String(metadataDiskID),
+		Path:     diskPath,
+		Readonly: Bool(true),
+		Serial:   String(cmdserver.MetadataDiskSerial),
+	}, nil
+}
+
+// GetUserScriptStatus returns the outcome of the user script in a VM's
+// metadata.
+func (s *Server) GetUserScriptStatus(ctx context.Context, vmName string) (*serverapi.UserScriptStatus, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	release, err := vm.gate.acquireShared(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := vm.requireAgentFeature(ctx, agentCmdServer, featureMetadata); err != nil {
+		return nil, err
+	}
+	body, err := vm.cmdServerRequest(ctx, http.MethodGet, "/metadata/user-script")
+	if err != nil {
+		return nil, err
+	}
+	var script cmdserver.UserScriptStatus
+	if err := json.Unmarshal(body, &script); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	resp := &serverapi.UserScriptStatus{
+		State:     serverapi.PtrString(script.State),
+		Output:    serverapi.PtrString(script.Output),
+		Truncated: serverapi.PtrBool(script.Truncated),
+		Error:     serverapi.PtrString(script.Error),
+		StartedAt: serverapi.PtrTime(script.StartedAt),
+	}
+	if script.ExitCode != nil {
+		resp.ExitCode = serverapi.PtrInt32(int32(*script.ExitCode))
+	}
+	if script.EndedAt != nil {
+		resp.EndedAt = serverapi.PtrTime(*script.EndedAt)
+	}
+	return resp, nil
+}
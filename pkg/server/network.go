@@ -0,0 +1,593 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gvisor.dev/gvisor/pkg/cleanup"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/events"
+	"github.com/abilashraghuram/cbox/pkg/server/cidallocator"
+	"github.com/abilashraghuram/cbox/pkg/server/fountain"
+	"github.com/abilashraghuram/cbox/pkg/server/ipallocator"
+)
+
+// NetworkPlan describes the network resources a VM will be given. Planning
+// has no side effects, so a plan can be computed and discarded.
+type NetworkPlan struct {
+	// ExternalTapDevice is an existing tap device to adopt. Empty creates one.
+	ExternalTapDevice string
+	// ExternalIP is a caller-managed guest IP. Nil allocates one from the
+	// bridge subnet.
+	ExternalIP *net.IPNet
+	// IP is a bridge subnet IP to claim instead of allocating one, for a
+	// restored guest that is already configured with it.
+	IP *net.IPNet
+	// StaticIP is a bridge subnet IP the caller asked for, allocated instead
+	// of the next available one.
+	StaticIP net.IP
+	// CID is a CID to claim instead of allocating one. Zero allocates.
+	CID uint32
+	// TapDevice is a tap device already set up for the VM, taken back for a
+	// VM adopted after a restart. It overrides ExternalTapDevice.
+	TapDevice *fountain.TapDevice
+}
+
+// NetworkAttachment is the set of network resources held by a VM.
+type NetworkAttachment struct {
+	TapDevice  *fountain.TapDevice
+	IP         *net.IPNet
+	ExternalIP bool
+	CID        uint32
+}
+
+// attachmentsFilename is the registry of network attachments in the state
+// dir. It's kept up to date as VMs are attached and released, so the tap
+// devices, IPs and CIDs of VMs that outlive the server can be taken back by
+// its next run.
+const attachmentsFilename = "attachments.json"
+
+// attachmentRegistry is the content of the registry. The bridge subnet is
+// kept alongside the attachments, as IPs allocated from another subnet can't
+// be taken back.
+type attachmentRegistry struct {
+	BridgeSubnet string                      `json:"bridgeSubnet"`
+	Attachments  map[string]attachmentRecord `json:"attachments"`
+}
+
+// attachmentRecord is a NetworkAttachment in the registry.
+type attachmentRecord struct {
+	TapDevice         string `json:"tapDevice"`
+	ExternalTapDevice bool   `json:"externalTapDevice,omitempty"`
+	// IP is the guest IP in CIDR notation.
+	IP         string `json:"ip"`
+	ExternalIP bool   `json:"externalIp,omitempty"`
+	CID        uint32 `json:"cid"`
+}
+
+// plan returns the plan that takes back the attachment recorded.
+func (r attachmentRecord) plan() (*NetworkPlan, error) {
+	ip, ipNet, err := net.ParseCIDR(r.IP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid guest ip %s: %w", r.IP, err)
+	}
+	guestIP := &net.IPNet{IP: ip, Mask: ipNet.Mask}
+	plan := &NetworkPlan{
+		TapDevice: &fountain.TapDevice{
+			Name:     r.TapDevice,
+			ID:       -1,
+			External: r.ExternalTapDevice,
+		},
+		CID: r.CID,
+	}
+	if r.ExternalIP {
+		plan.ExternalIP = guestIP
+	} else {
+		plan.IP = guestIP
+	}
+	return plan, nil
+}
+
+// Allocator names reported in occupancy and exhaustion errors. AllocatorVMs
+// stands for the max_vms limit.
+const (
+	AllocatorIP  = "ip"
+	AllocatorCID = "cid"
+	AllocatorVMs = "vms"
+)
+
+// AllocatorExhaustedError is returned when a VM can't be given an IP or CID
+// because every one is in use, or can't be created at all because the
+// server is at max_vms.
+type AllocatorExhaustedError struct {
+	Allocator string
+	Capacity  int
+}
+
+func (e *AllocatorExhaustedError) Error() string {
+	return fmt.Sprintf("%s allocator exhausted: all %d in use", e.Allocator, e.Capacity)
+}
+
+func (e *AllocatorExhaustedError) GRPCStatus() *status.Status {
+	return status.New(codes.ResourceExhausted, e.Error())
+}
+
+// AllocatorOccupancy is a snapshot of an allocator's usage.
+type AllocatorOccupancy struct {
+	Name     string
+	Used     int
+	Capacity int
+}
+
+// NetworkManager owns the IP and CID allocators and the tap device fountain,
+// and tracks which VM holds which resources.
+type NetworkManager struct {
+	bridgeSubnet *net.IPNet
+	ipAllocator  *ipallocator.IPAllocator
+	cidAllocator *cidallocator.CIDAllocator
+	fountain     *fountain.Fountain
+	// bridgeNetworking is unset in external network mode, where VMs can only
+	// use tap devices and IPs managed by someone else.
+	bridgeNetworking bool
+
+	lock        sync.Mutex
+	attachments map[string]*NetworkAttachment // keyed by vmName
+	// registryPath is where attachments are persisted.
+	registryPath string
+
+	// warningPercent is the occupancy at which an allocator is reported as
+	// under pressure. Zero disables the warning.
+	warningPercent int
+	events         *events.Bus
+	pressureLock   sync.Mutex
+	// underPressure holds the allocators above warningPercent, so crossing
+	// the threshold is reported once rather than on every allocation.
+	underPressure map[string]bool
+}
+
+// NewNetworkManager creates a NetworkManager for the configured bridge.
+// Allocator pressure is published on bus.
+func NewNetworkManager(config config.ServerConfig, bus *events.Bus) (*NetworkManager, error) {
+	_, bridgeSubnet, err := net.ParseCIDR(config.BridgeSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bridge subnet: %w", err)
+	}
+
+	// The bridge IP replaces the subnet's first host address as the one
+	// reserved for the gateway.
+	exclusions := config.IPExclusions
+	if config.BridgeIP != "" {
+		exclusions = append([]string{config.BridgeIP}, exclusions...)
+	}
+	ipAllocator, err := ipallocator.NewIPAllocator(config.BridgeSubnet, ipallocator.WithExclusions(exclusions...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ip allocator: %w", err)
+	}
+
+	lowCID, highCID, err := config.CIDBounds()
+	if err != nil {
+		return nil, err
+	}
+	cidAllocator, err := cidallocator.NewCIDAllocator(lowCID, highCID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CID allocator: %w", err)
+	}
+
+	// Every VM needs an IP and a CID, so there have to be enough for
+	// max_vms, or at least one VM.
+	minAddresses := max(1, config.MaxVMs)
+	if _, capacity := ipAllocator.Occupancy(); capacity < minAddresses {
+		return nil, fmt.Errorf("bridge_subnet %s has %d usable IPs after ip_exclusions, need at least %d", config.BridgeSubnet, capacity, minAddresses)
+	}
+	if _, capacity := cidAllocator.Occupancy(); capacity < minAddresses {
+		return nil, fmt.Errorf("cid_range %s has %d CIDs, need at least %d", config.CIDRange, capacity, minAddresses)
+	}
+
+	return &NetworkManager{
+		bridgeSubnet: bridgeSubnet,
+		ipAllocator:  ipAllocator,
+		cidAllocator: cidAllocator,
+		fountain:     fountain.NewFountain(config.BridgeName),
+		attachments:  make(map[string]*NetworkAttachment),
+		registryPath: path.Join(config.StateDir, attachmentsFilename),
+
+		bridgeNetworking: config.BridgeNetworking(),
+
+		warningPercent: config.AllocatorWarningPercent,
+		events:         bus,
+		underPressure:  make(map[string]bool),
+	}, nil
+}
+
+// Occupancy returns the usage of the IP and CID allocators.
+func (m *NetworkManager) Occupancy() []AllocatorOccupancy {
+	ipUsed, ipCapacity := m.ipAllocator.Occupancy()
+	cidUsed, cidCapacity := m.cidAllocator.Occupancy()
+	return []AllocatorOccupancy{
+		{Name: AllocatorIP, Used: ipUsed, Capacity: ipCapacity},
+		{Name: AllocatorCID, Used: cidUsed, Capacity: cidCapacity},
+	}
+}
+
+// checkPressure logs and publishes a host.allocator_pressure event when an
+// allocator's occupancy rises to warningPercent. It fires again only after
+// occupancy has dropped back below the threshold.
+func (m *NetworkManager) checkPressure() {
+	if m.warningPercent <= 0 {
+		return
+	}
+
+	m.pressureLock.Lock()
+	defer m.pressureLock.Unlock()
+	for _, occupancy := range m.Occupancy() {
+		above := occupancy.Capacity > 0 && occupancy.Used*100 >= m.warningPercent*occupancy.Capacity
+		if above == m.underPressure[occupancy.Name] {
+			continue
+		}
+		m.underPressure[occupancy.Name] = above
+		if !above {
+			log.WithField("allocator", occupancy.Name).Info("allocator pressure cleared")
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"allocator": occupancy.Name,
+			"used":      occupancy.Used,
+			"capacity":  occupancy.Capacity,
+		}).Warnf("%s allocator reached %d%% occupancy", occupancy.Name, m.warningPercent)
+		if m.events != nil {
+			m.events.Publish(events.TypeHostAllocatorPressure, "", map[string]any{
+				"allocator": occupancy.Name,
+				"used":      occupancy.Used,
+				"capacity":  occupancy.Capacity,
+			})
+		}
+	}
+}
+
+// PlanAttachment validates the networking options of a StartVM request and
+// returns what Apply would do for it. It doesn't allocate anything.
+func (m *NetworkManager) PlanAttachment(req *serverapi.StartVMRequest) (*NetworkPlan, error) {
+	plan := &NetworkPlan{
+		ExternalTapDevice: req.GetTapDevice(),
+	}
+	if !m.bridgeNetworking && (req.GetTapDevice() == "" || req.GetExternalIp() == "") {
+		return nil, status.Error(codes.FailedPrecondition, "the server runs in external network mode, tapDevice and externalIp are required")
+	}
+	if req.GetIp() != "" {
+		if req.GetExternalIp() != "" {
+			return nil, status.Error(codes.InvalidArgument, "ip and externalIp are mutually exclusive")
+		}
+		ip := net.ParseIP(req.GetIp())
+		if ip == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid ip: %q", req.GetIp())
+		}
+		if !m.bridgeSubnet.Contains(ip) {
+			return nil, status.Errorf(codes.InvalidArgument, "ip %s is outside the bridge subnet %s", ip, m.bridgeSubnet)
+		}
+		plan.StaticIP = ip
+	}
+	if req.GetExternalIp() == "" {
+		return plan, nil
+	}
+	if req.GetTapDevice() == "" {
+		return nil, status.Error(codes.InvalidArgument, "externalIp requires tapDevice")
+	}
+
+	ip, ipNet, err := net.ParseCIDR(req.GetExternalIp())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "externalIp must be in CIDR notation: %v", err)
+	}
+	if m.bridgeSubnet.Contains(ip) {
+		return nil, status.Errorf(codes.InvalidArgument, "externalIp %s is inside the allocator-managed subnet %s", ip, m.bridgeSubnet)
+	}
+	if owner := m.ipOwner(ip); owner != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "externalIp %s is already used by VM %s", ip, owner)
+	}
+	plan.ExternalIP = &net.IPNet{IP: ip, Mask: ipNet.Mask}
+	return plan, nil
+}
+
+// ipOwner returns the name of the VM attached with ip, if any.
+func (m *NetworkManager) ipOwner(ip net.IP) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for vmName, attachment := range m.attachments {
+		if attachment.IP.IP.Equal(ip) {
+			return vmName
+		}
+	}
+	return ""
+}
+
+// Apply acquires the resources in plan for vmName. If any step fails, the
+// resources acquired so far are released.
+func (m *NetworkManager) Apply(vmName string, plan *NetworkPlan) (*NetworkAttachment, error) {
+	m.lock.Lock()
+	_, exists := m.attachments[vmName]
+	m.lock.Unlock()
+	if exists {
+		return nil, fmt.Errorf("vm %s already has a network attachment", vmName)
+	}
+
+	logger := log.WithField("vmName", vmName)
+	cleanup := cleanup.Make(func() {})
+	defer cleanup.Clean()
+	defer m.checkPressure()
+
+	attachment := &NetworkAttachment{}
+	var err error
+	if plan.TapDevice != nil {
+		attachment.TapDevice = plan.TapDevice
+		if !plan.TapDevice.External {
+			attachment.TapDevice, err = m.fountain.ReclaimTapDevice(plan.TapDevice.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to reclaim tap device: %w", err)
+			}
+			cleanup.Add(func() {
+				if err := m.fountain.DestroyTapDevice(attachment.TapDevice); err != nil {
+					logger.WithError(err).Errorf("failed to delete tap device: %s", attachment.TapDevice)
+				}
+			})
+		}
+	} else if plan.ExternalTapDevice != "" {
+		attachment.TapDevice, err = m.fountain.AdoptTapDevice(plan.ExternalTapDevice)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to use tap device: %v", err)
+		}
+	} else {
+		attachment.TapDevice, err = m.fountain.CreateTapDevice(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tap device: %w", err)
+		}
+		cleanup.Add(func() {
+			if err := m.fountain.DestroyTapDevice(attachment.TapDevice); err != nil {
+				logger.WithError(err).Errorf("failed to delete tap device: %s", attachment.TapDevice)
+			}
+		})
+	}
+
+	if plan.ExternalIP != nil {
+		attachment.IP = plan.ExternalIP
+		attachment.ExternalIP = true
+		logger.Infof("Using external IP: %v", attachment.IP)
+	} else if plan.StaticIP != nil {
+		attachment.IP, err = m.ipAllocator.AllocateSpecificIP(plan.StaticIP)
+		if err != nil {
+			// Checked again here, as planning doesn't hold the IP.
+			if owner := m.ipOwner(plan.StaticIP); owner != "" {
+				return nil, status.Errorf(codes.InvalidArgument, "ip %s is already used by VM %s", plan.StaticIP, owner)
+			}
+			return nil, status.Errorf(codes.InvalidArgument, "failed to allocate guest ip: %v", err)
+		}
+		logger.Infof("Allocated requested IP: %v", attachment.IP)
+		cleanup.Add(func() {
+			logger.WithField("ip", attachment.IP.String()).Info("freeing IP")
+			m.ipAllocator.FreeIP(attachment.IP.IP)
+		})
+	} else if plan.IP != nil {
+		if err := m.ipAllocator.ClaimIP(plan.IP.IP); err != nil {
+			return nil, status.Errorf(codes.AlreadyExists, "failed to claim guest ip: %v", err)
+		}
+		attachment.IP = plan.IP
+		logger.Infof("Claimed IP: %v", attachment.IP)
+		cleanup.Add(func() {
+			logger.WithField("ip", attachment.IP.String()).Info("freeing IP")
+			m.ipAllocator.FreeIP(attachment.IP.IP)
+		})
+	} else {
+		attachment.IP, err = m.ipAllocator.AllocateIP()
+		if errors.Is(err, ipallocator.ErrExhausted) {
+			_, capacity := m.ipAllocator.Occupancy()
+			return nil, &AllocatorExhaustedError{Allocator: AllocatorIP, Capacity: capacity}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error allocating guest ip: %w", err)
+		}
+		logger.Infof("Allocated IP: %v", attachment.IP)
+		cleanup.Add(func() {
+			logger.WithField("ip", attachment.IP.String()).Info("freeing IP")
+			m.ipAllocator.FreeIP(attachment.IP.IP)
+		})
+	}
+
+	if plan.CID != 0 {
+		if err := m.cidAllocator.ClaimCID(plan.CID); err != nil {
+			return nil, status.Errorf(codes.AlreadyExists, "failed to claim CID: %v", err)
+		}
+		attachment.CID = plan.CID
+	} else {
+		attachment.CID, err = m.cidAllocator.AllocateCID()
+	}
+	if errors.Is(err, cidallocator.ErrExhausted) {
+		_, capacity := m.cidAllocator.Occupancy()
+		return nil, &AllocatorExhaustedError{Allocator: AllocatorCID, Capacity: capacity}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate CID: %w", err)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, exists := m.attachments[vmName]; exists {
+		m.cidAllocator.FreeCID(attachment.CID)
+		return nil, fmt.Errorf("vm %s already has a network attachment", vmName)
+	}
+	m.attachments[vmName] = attachment
+	if err := m.saveRegistry(); err != nil {
+		delete(m.attachments, vmName)
+		m.cidAllocator.FreeCID(attachment.CID)
+		return nil, err
+	}
+
+	cleanup.Release()
+	return attachment, nil
+}
+
+// Rename moves the attachment of oldName to newName, for a VM claimed from
+// the pool.
+func (m *NetworkManager) Rename(oldName string, newName string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	attachment, ok := m.attachments[oldName]
+	if !ok {
+		return fmt.Errorf("vm %s has no network attachment", oldName)
+	}
+	if _, exists := m.attachments[newName]; exists {
+		return fmt.Errorf("vm %s already has a network attachment", newName)
+	}
+	delete(m.attachments, oldName)
+	m.attachments[newName] = attachment
+	if err := m.saveRegistry(); err != nil {
+		log.WithField("vmName", newName).WithError(err).Warn("failed to save network attachments")
+	}
+	return nil
+}
+
+// Release frees the resources attached to vmName and deletes the firewall
+// rules for its IP. Releasing a VM without an attachment, or releasing
+// twice, is a no-op.
+func (m *NetworkManager) Release(vmName string) error {
+	m.lock.Lock()
+	attachment, ok := m.attachments[vmName]
+	delete(m.attachments, vmName)
+	var finalErr error
+	if ok {
+		if err := m.saveRegistry(); err != nil {
+			finalErr = err
+		}
+	}
+	m.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if err := m.fountain.DestroyTapDevice(attachment.TapDevice); err != nil {
+		finalErr = errors.Join(finalErr, fmt.Errorf("failed to destroy the tap device: %w", err))
+	}
+	// Rules for external IPs belong to whoever manages that network.
+	if m.bridgeNetworking && !attachment.ExternalIP {
+		if err := cleanupAllIPTablesRulesForIP(attachment.IP.IP.String()); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to delete iptables rules: %w", err))
+		}
+	}
+	if !attachment.ExternalIP {
+		if err := m.ipAllocator.FreeIP(attachment.IP.IP); err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to free IP: %s: %w", attachment.IP.String(), err))
+		}
+	}
+	if err := m.cidAllocator.FreeCID(attachment.CID); err != nil {
+		finalErr = errors.Join(finalErr, fmt.Errorf("failed to free CID: %d: %w", attachment.CID, err))
+	}
+	m.checkPressure()
+	return finalErr
+}
+
+// Attachment returns the attachment of vmName, or nil if it has none.
+func (m *NetworkManager) Attachment(vmName string) *NetworkAttachment {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.attachments[vmName]
+}
+
+// attachedVMs returns the names of the VMs with an attachment.
+func (m *NetworkManager) attachedVMs() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := make([]string, 0, len(m.attachments))
+	for vmName := range m.attachments {
+		names = append(names, vmName)
+	}
+	return names
+}
+
+// Restore takes back the attachments in the registry left by the previous
+// run, claiming their tap devices, IPs and CIDs as they are. It's only
+// called when the previous run's host networking was kept for VMs being
+// adopted; attachments that can't be taken back are dropped.
+func (m *NetworkManager) Restore() error {
+	data, err := os.ReadFile(m.registryPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read network attachments: %w", err)
+	}
+	var registry attachmentRegistry
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return fmt.Errorf("failed to parse network attachments: %w", err)
+	}
+	if registry.BridgeSubnet != m.bridgeSubnet.String() {
+		log.WithFields(log.Fields{
+			"previousSubnet": registry.BridgeSubnet,
+			"attachments":    len(registry.Attachments),
+		}).Warn("dropping network attachments of another bridge subnet")
+		registry.Attachments = nil
+	}
+
+	for vmName, record := range registry.Attachments {
+		logger := log.WithField("vmName", vmName)
+		plan, err := record.plan()
+		if err == nil {
+			_, err = m.Apply(vmName, plan)
+		}
+		if err != nil {
+			logger.WithError(err).Warn("dropping network attachment of the previous run")
+			continue
+		}
+		logger.WithField("tapDevice", record.TapDevice).Info("restored network attachment")
+	}
+	// Records that weren't restored are gone from the registry.
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.saveRegistry()
+}
+
+// resetRegistry forgets the attachments of the previous run, whose host
+// networking was torn down.
+func (m *NetworkManager) resetRegistry() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.saveRegistry()
+}
+
+// saveRegistry writes the attachments to the registry. It must be called
+// with m.lock held.
+func (m *NetworkManager) saveRegistry() error {
+	registry := attachmentRegistry{
+		BridgeSubnet: m.bridgeSubnet.String(),
+		Attachments:  make(map[string]attachmentRecord, len(m.attachments)),
+	}
+	for vmName, attachment := range m.attachments {
+		registry.Attachments[vmName] = attachmentRecord{
+			TapDevice:         attachment.TapDevice.Name,
+			ExternalTapDevice: attachment.TapDevice.External,
+			IP:                attachment.IP.String(),
+			ExternalIP:        attachment.ExternalIP,
+			CID:               attachment.CID,
+		}
+	}
+	data, err := json.MarshalIndent(registry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal network attachments: %w", err)
+	}
+	// Written aside and renamed so a crash never leaves a torn registry.
+	if err := os.WriteFile(m.registryPath+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write network attachments: %w", err)
+	}
+	if err := os.Rename(m.registryPath+".tmp", m.registryPath); err != nil {
+		return fmt.Errorf("failed to write network attachments: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/events"
+	"github.com/abilashraghuram/cbox/pkg/hostcmd"
+)
+
+// newTestNetworkManager returns a NetworkManager for 10.20.1.0/24 on a
+// fakeRunner, with its registry in a temp dir.
+func newTestNetworkManager(t *testing.T, configure func(*config.ServerConfig)) (*NetworkManager, *fakeRunner) {
+	t.Helper()
+	cfg := config.DefaultServerConfig()
+	cfg.StateDir = t.TempDir()
+	cfg.BridgeName = "br0"
+	cfg.BridgeIP = "10.20.1.1/24"
+	cfg.BridgeSubnet = "10.20.1.0/24"
+	if configure != nil {
+		configure(&cfg)
+	}
+	runner := &fakeRunner{}
+	t.Cleanup(hostcmd.SetRunner(runner))
+	m, err := NewNetworkManager(cfg, events.NewBus())
+	if err != nil {
+		t.Fatalf("NewNetworkManager: %v", err)
+	}
+	return m, runner
+}
+
+func (m *NetworkManager) checkOccupancy(t *testing.T, wantIPs int, wantCIDs int) {
+	t.Helper()
+	for _, occupancy := range m.Occupancy() {
+		want := wantIPs
+		if occupancy.Name == AllocatorCID {
+			want = wantCIDs
+		}
+		if occupancy.Used != want {
+			t.Errorf("%s allocator has %d in use, want %d", occupancy.Name, occupancy.Used, want)
+		}
+	}
+}
+
+func TestPlanAttachment(t *testing.T) {
+	m, _ := newTestNetworkManager(t, nil)
+	for name, req := range map[string]*serverapi.StartVMRequest{
+		"ip outside the subnet":       {Ip: serverapi.PtrString("10.30.0.5")},
+		"invalid ip":                  {Ip: serverapi.PtrString("nope")},
+		"ip and externalIp":           {Ip: serverapi.PtrString("10.20.1.5"), ExternalIp: serverapi.PtrString("192.168.0.5/24"), TapDevice: serverapi.PtrString("ext0")},
+		"externalIp without tap":      {ExternalIp: serverapi.PtrString("192.168.0.5/24")},
+		"externalIp inside subnet":    {ExternalIp: serverapi.PtrString("10.20.1.5/24"), TapDevice: serverapi.PtrString("ext0")},
+		"externalIp without a prefix": {ExternalIp: serverapi.PtrString("192.168.0.5"), TapDevice: serverapi.PtrString("ext0")},
+	} {
+		if _, err := m.PlanAttachment(req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: PlanAttachment = %v, want InvalidArgument", name, err)
+		}
+	}
+
+	plan, err := m.PlanAttachment(&serverapi.StartVMRequest{Ip: serverapi.PtrString("10.20.1.5")})
+	if err != nil || !plan.StaticIP.Equal(net.ParseIP("10.20.1.5")) {
+		t.Errorf("PlanAttachment with ip = %+v, %v; want the static IP", plan, err)
+	}
+	plan, err = m.PlanAttachment(&serverapi.StartVMRequest{ExternalIp: serverapi.PtrString("192.168.0.5/24"), TapDevice: serverapi.PtrString("ext0")})
+	if err != nil || plan.ExternalIP.String() != "192.168.0.5/24" || plan.ExternalTapDevice != "ext0" {
+		t.Errorf("PlanAttachment with externalIp = %+v, %v", plan, err)
+	}
+	// Planning holds nothing.
+	m.checkOccupancy(t, 0, 0)
+
+	external, _ := newTestNetworkManager(t, func(cfg *config.ServerConfig) { cfg.NetworkMode = config.NetworkModeExternal })
+	if _, err := external.PlanAttachment(&serverapi.StartVMRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("PlanAttachment in external mode without a tap device = %v, want FailedPrecondition", err)
+	}
+}
+
+func TestApplyRelease(t *testing.T) {
+	m, runner := newTestNetworkManager(t, nil)
+	attachment, err := m.Apply("vm1", &NetworkPlan{})
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	m.checkOccupancy(t, 1, 1)
+	if m.Attachment("vm1") != attachment || m.ipOwner(attachment.IP.IP) != "vm1" {
+		t.Error("attachment isn't tracked for vm1")
+	}
+	if _, err := m.Apply("vm1", &NetworkPlan{}); err == nil {
+		t.Error("second Apply for vm1 succeeded")
+	}
+	m.checkOccupancy(t, 1, 1)
+
+	if err := m.Release("vm1"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	m.checkOccupancy(t, 0, 0)
+	if runner.ran("ip tuntap del dev "+attachment.TapDevice.Name) != 1 {
+		t.Errorf("tap device %s wasn't deleted", attachment.TapDevice.Name)
+	}
+	if runner.ran("iptables -t nat -L PREROUTING") != 1 {
+		t.Error("iptables rules for the IP weren't cleaned up")
+	}
+	if err := m.Release("vm1"); err != nil {
+		t.Errorf("second Release = %v, want a no-op", err)
+	}
+	if runner.ran("ip tuntap del") != 1 {
+		t.Error("second Release deleted a tap device")
+	}
+}
+
+func TestApplyRollsBack(t *testing.T) {
+	t.Run("tap device", func(t *testing.T) {
+		m, runner := newTestNetworkManager(t, nil)
+		runner.failOn("ip tuntap add")
+		if _, err := m.Apply("vm1", &NetworkPlan{}); err == nil {
+			t.Fatal("Apply succeeded")
+		}
+		m.checkOccupancy(t, 0, 0)
+	})
+
+	t.Run("static IP taken", func(t *testing.T) {
+		m, runner := newTestNetworkManager(t, nil)
+		if _, err := m.Apply("vm1", &NetworkPlan{StaticIP: net.ParseIP("10.20.1.5")}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := m.Apply("vm2", &NetworkPlan{StaticIP: net.ParseIP("10.20.1.5")})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Apply with a taken IP = %v, want InvalidArgument", err)
+		}
+		m.checkOccupancy(t, 1, 1)
+		if runner.ran("ip tuntap del") != 1 {
+			t.Error("tap device of the failed Apply wasn't deleted")
+		}
+	})
+
+	t.Run("CIDs exhausted", func(t *testing.T) {
+		m, runner := newTestNetworkManager(t, func(cfg *config.ServerConfig) { cfg.CIDRange = "3-3" })
+		if _, err := m.Apply("vm1", &NetworkPlan{}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := m.Apply("vm2", &NetworkPlan{})
+		var exhausted *AllocatorExhaustedError
+		if !errors.As(err, &exhausted) || exhausted.Allocator != AllocatorCID {
+			t.Errorf("Apply without CIDs = %v, want the CID allocator exhausted", err)
+		}
+		m.checkOccupancy(t, 1, 1)
+		if runner.ran("ip tuntap del") != 1 {
+			t.Error("tap device of the failed Apply wasn't deleted")
+		}
+	})
+
+	t.Run("registry", func(t *testing.T) {
+		m, runner := newTestNetworkManager(t, nil)
+		m.registryPath = path.Join(t.TempDir(), "missing", attachmentsFilename)
+		if _, err := m.Apply("vm1", &NetworkPlan{}); err == nil {
+			t.Fatal("Apply succeeded without saving the attachment")
+		}
+		m.checkOccupancy(t, 0, 0)
+		if m.Attachment("vm1") != nil || runner.ran("ip tuntap del") != 1 {
+			t.Error("attachment that couldn't be saved wasn't rolled back")
+		}
+	})
+}
+
+func TestRestore(t *testing.T) {
+	var stateDir string
+	previous, _ := newTestNetworkManager(t, func(cfg *config.ServerConfig) { stateDir = cfg.StateDir })
+	kept, err := previous.Apply("kept", &NetworkPlan{StaticIP: net.ParseIP("10.20.1.9")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, err := previous.Apply("gone", &NetworkPlan{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := previous.Apply("released", &NetworkPlan{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := previous.Release("released"); err != nil {
+		t.Fatal(err)
+	}
+
+	m, runner := newTestNetworkManager(t, func(cfg *config.ServerConfig) { cfg.StateDir = stateDir })
+	// The tap device of "gone" went away with the previous run.
+	runner.failOn("ip link show " + gone.TapDevice.Name)
+	if err := m.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	restored := m.Attachment("kept")
+	if restored == nil {
+		t.Fatal("attachment of kept wasn't restored")
+	}
+	if restored.IP.String() != kept.IP.String() || restored.CID != kept.CID || restored.TapDevice.Name != kept.TapDevice.Name {
+		t.Errorf("restored %+v, want %+v", restored, kept)
+	}
+	if m.Attachment("gone") != nil || m.Attachment("released") != nil {
+		t.Error("restored attachments that are gone")
+	}
+	m.checkOccupancy(t, 1, 1)
+	if runner.ran("ip tuntap add") != 0 {
+		t.Error("Restore created tap devices")
+	}
+	// The restored IP and CID aren't handed out again.
+	next, err := m.Apply("next", &NetworkPlan{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.IP.IP.Equal(kept.IP.IP) || next.CID == kept.CID || next.TapDevice.Name == kept.TapDevice.Name {
+		t.Errorf("Apply reused the restored attachment's resources: %+v", next)
+	}
+
+	// The registry was rewritten without the dropped attachment.
+	reloaded, _ := newTestNetworkManager(t, func(cfg *config.ServerConfig) { cfg.StateDir = stateDir })
+	if err := reloaded.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if names := reloaded.attachedVMs(); len(names) != 2 {
+		t.Errorf("registry holds %v, want kept and next", names)
+	}
+}
+
+func TestAllocatorExhaustionAndPressure(t *testing.T) {
+	m, _ := newTestNetworkManager(t, func(cfg *config.ServerConfig) {
+		cfg.CIDRange = "3-6"
+		cfg.AllocatorWarningPercent = 75
+	})
+
+	// Walk the CID allocator to exhaustion.
+	for i := range 4 {
+		if _, err := m.Apply(fmt.Sprintf("vm%d", i), &NetworkPlan{}); err != nil {
+			t.Fatalf("Apply vm%d: %v", i, err)
+		}
+	}
+	for range 3 {
+		_, err := m.Apply("overflow", &NetworkPlan{})
+		var exhausted *AllocatorExhaustedError
+		if !errors.As(err, &exhausted) || exhausted.Allocator != AllocatorCID || exhausted.Capacity != 4 {
+			t.Fatalf("Apply past the last CID = %v, want the cid allocator exhausted", err)
+		}
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("status code = %s, want ResourceExhausted", status.Code(err))
+		}
+	}
+	// The IP taken before the CID ran out was given back.
+	m.checkOccupancy(t, 4, 4)
+
+	for _, occupancy := range m.Occupancy() {
+		if occupancy.Name == AllocatorCID && (occupancy.Used != 4 || occupancy.Capacity != 4) {
+			t.Errorf("cid occupancy = %+v, want 4 of 4", occupancy)
+		}
+	}
+	if got := pressureEvents(m.events); len(got) != 1 || got[0]["allocator"] != AllocatorCID || got[0]["used"] != 3 {
+		t.Errorf("pressure events = %v, want one for the cid allocator at 3 of 4", got)
+	}
+
+	// Dropping below the threshold re-arms it.
+	for i := range 2 {
+		if err := m.Release(fmt.Sprintf("vm%d", i)); err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+	}
+	if _, err := m.Apply("vm0", &NetworkPlan{}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got := pressureEvents(m.events); len(got) != 2 {
+		t.Errorf("got %d pressure events after crossing the threshold again, want 2", len(got))
+	}
+}
+
+// pressureEvents returns the data of the host.allocator_pressure events
+// published on bus.
+func pressureEvents(bus *events.Bus) []map[string]any {
+	var data []map[string]any
+	for _, event := range bus.Replay("", 0, 100) {
+		if event.Type == events.TypeHostAllocatorPressure {
+			data = append(data, event.Data.(map[string]any))
+		}
+	}
+	return data
+}
+
+func TestGetVMNameByIP(t *testing.T) {
+	h := newTestHarness(t, nil)
+	ip, _, _ := net.ParseCIDR(h.startVM("vm1").GetIp())
+
+	if owner, err := h.server.GetVMNameByIP(ip); err != nil || owner != "vm1" {
+		t.Errorf("GetVMNameByIP(%s) = %q, %v, want vm1", ip, owner, err)
+	}
+	// Traffic NATed on the way to the host doesn't carry a VM's IP.
+	for _, other := range []string{"10.20.1.1", "10.0.0.1", "127.0.0.1"} {
+		if owner, err := h.server.GetVMNameByIP(net.ParseIP(other)); err == nil {
+			t.Errorf("GetVMNameByIP(%s) = %q, want no VM", other, owner)
+		}
+	}
+
+	// Once vm1 is destroyed its IP has no owner, until it's given to
+	// another VM.
+	if _, err := h.server.DestroyVM(context.Background(), "vm1"); err != nil {
+		t.Fatalf("DestroyVM: %v", err)
+	}
+	if owner, err := h.server.GetVMNameByIP(ip); err == nil {
+		t.Errorf("GetVMNameByIP(%s) after destroy = %q, want no VM", ip, owner)
+	}
+	if _, err := h.server.StartVM(context.Background(), &serverapi.StartVMRequest{VmName: serverapi.PtrString("vm2"), Ip: serverapi.PtrString(ip.String())}); err != nil {
+		t.Fatalf("StartVM(vm2): %v", err)
+	}
+	if owner, err := h.server.GetVMNameByIP(ip); err != nil || owner != "vm2" {
+		t.Errorf("GetVMNameByIP(%s) after reuse = %q, %v, want vm2", ip, owner, err)
+	}
+}
+
+func TestStaticIPRacesDynamicAllocation(t *testing.T) {
+	// 13 IPs, each wanted by a static request and, between them, the
+	// dynamic requests too.
+	m, _ := newTestNetworkManager(t, func(cfg *config.ServerConfig) {
+		cfg.BridgeIP = "10.20.1.1/28"
+		cfg.BridgeSubnet = "10.20.1.0/28"
+	})
+	const ips = 13
+
+	type result struct {
+		vmName     string
+		static     bool
+		attachment *NetworkAttachment
+		err        error
+	}
+	results := make(chan result, 2*ips)
+	var wg sync.WaitGroup
+	for i := 0; i < ips; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			vmName := fmt.Sprintf("static%d", i)
+			attachment, err := m.Apply(vmName, &NetworkPlan{StaticIP: net.IPv4(10, 20, 1, byte(i+2))})
+			results <- result{vmName, true, attachment, err}
+		}()
+		go func() {
+			defer wg.Done()
+			vmName := fmt.Sprintf("dynamic%d", i)
+			attachment, err := m.Apply(vmName, &NetworkPlan{})
+			results <- result{vmName, false, attachment, err}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	owners := map[string]string{}
+	for r := range results {
+		if r.err != nil {
+			var exhausted *AllocatorExhaustedError
+			if r.static && (status.Code(r.err) != codes.InvalidArgument || !strings.Contains(r.err.Error(), "10.20.1.")) {
+				t.Errorf("%s: Apply = %v, want InvalidArgument naming the IP", r.vmName, r.err)
+			}
+			if !r.static && !errors.As(r.err, &exhausted) {
+				t.Errorf("%s: Apply = %v, want the IP allocator exhausted", r.vmName, r.err)
+			}
+			continue
+		}
+		ip := r.attachment.IP.IP.String()
+		if owner, ok := owners[ip]; ok {
+			t.Errorf("%s assigned to both %s and %s", ip, owner, r.vmName)
+		}
+		owners[ip] = r.vmName
+		if got := m.ipOwner(r.attachment.IP.IP); got != r.vmName {
+			t.Errorf("owner of %s = %q, want %s", ip, got, r.vmName)
+		}
+	}
+	// Every IP went to exactly one VM.
+	if len(owners) != ips {
+		t.Errorf("%d IPs assigned, want all %d", len(owners), ips)
+	}
+	m.checkOccupancy(t, ips, ips)
+
+	for _, vmName := range owners {
+		if err := m.Release(vmName); err != nil {
+			t.Errorf("Release(%s): %v", vmName, err)
+		}
+	}
+	m.checkOccupancy(t, 0, 0)
+}
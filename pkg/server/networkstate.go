@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/hostcmd"
+)
+
+const networkStateFilename = "network.json"
+
+// networkState is the host networking configuration the state dir was last
+// used with.
+type networkState struct {
+	BridgeName   string `json:"bridgeName"`
+	BridgeIP     string `json:"bridgeIP"`
+	BridgeSubnet string `json:"bridgeSubnet"`
+}
+
+func loadNetworkState(stateDir string) (*networkState, error) {
+	data, err := os.ReadFile(path.Join(stateDir, networkStateFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read network state: %w", err)
+	}
+
+	var state networkState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse network state: %w", err)
+	}
+	return &state, nil
+}
+
+func saveNetworkState(stateDir string, state *networkState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal network state: %w", err)
+	}
+	if err := os.WriteFile(path.Join(stateDir, networkStateFilename), data, 0644); err != nil {
+		return fmt.Errorf("failed to write network state: %w", err)
+	}
+	return nil
+}
+
+// listVMStateDirs returns the names of the VM state dirs left in stateDir.
+func listVMStateDirs(stateDir string) ([]string, error) {
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && !reservedDirName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// firewallRuleComment is the comment the firewall rules set up for subnet
+// are tagged with, so they're told apart from rules cbox doesn't own and can
+// be deleted by it.
+func firewallRuleComment(subnet string) string {
+	return "cbox:" + subnet
+}
+
+// cleanupSubnetFirewallRules deletes the NAT and forwarding rules that
+// setupBridgeAndFirewall installed for subnet, found by their comment.
+func cleanupSubnetFirewallRules(subnet string) error {
+	comment := firewallRuleComment(subnet)
+	var finalErr error
+	for _, chain := range []struct {
+		table string
+		name  string
+	}{
+		{"nat", "POSTROUTING"},
+		{"filter", "FORWARD"},
+	} {
+		output, err := hostcmd.Output("iptables", "-t", chain.table, "-S", chain.name)
+		if err != nil {
+			finalErr = errors.Join(finalErr, fmt.Errorf("failed to list %s %s rules: %w", chain.table, chain.name, err))
+			continue
+		}
+
+		for _, rule := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(rule)
+			if len(fields) < 2 || fields[0] != "-A" {
+				continue
+			}
+			// iptables quotes comments when listing rules, but they're
+			// matched unquoted when deleting them.
+			for i := range fields {
+				fields[i] = strings.Trim(fields[i], `"`)
+			}
+			if i := slices.Index(fields, "--comment"); i == -1 || i+1 == len(fields) || fields[i+1] != comment {
+				continue
+			}
+
+			fields[0] = "-D"
+			args := append([]string{"-t", chain.table}, fields...)
+			log.Infof("deleting rule: iptables %s", strings.Join(args, " "))
+			if err := hostcmd.Run("iptables", args...); err != nil {
+				finalErr = errors.Join(finalErr, fmt.Errorf("failed to delete rule %q: %w", rule, err))
+			}
+		}
+	}
+	return finalErr
+}
+
+// checkBridgeSubnet compares the configured bridge subnet with the one the
+// state dir was last used with. A change is refused unless migration was
+// requested, in which case the old subnet's firewall rules and the network
+// attachments allocated from it are removed, and the VMs left over from the
+// old subnet are reported as needing recreation. It returns the migration,
+// or nil if the subnet didn't change.
+func checkBridgeSubnet(config config.ServerConfig) (*serverapi.SubnetMigration, error) {
+	previous, err := loadNetworkState(config.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil || previous.BridgeSubnet == config.BridgeSubnet {
+		return nil, nil
+	}
+
+	affectedVMs, err := listVMStateDirs(config.StateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VM state dirs: %w", err)
+	}
+	slices.Sort(affectedVMs)
+
+	logger := log.WithFields(log.Fields{
+		"previousSubnet":   previous.BridgeSubnet,
+		"configuredSubnet": config.BridgeSubnet,
+		"affectedVMs":      affectedVMs,
+	})
+	if !config.MigrateSubnet {
+		logger.Error("bridge subnet changed since last start, refusing to start")
+		return nil, fmt.Errorf(
+			"bridge_subnet changed from %s to %s, restart with --migrate-subnet to migrate",
+			previous.BridgeSubnet,
+			config.BridgeSubnet,
+		)
+	}
+
+	logger.Warn("migrating bridge subnet, affected VMs need to be recreated")
+	if err := cleanupSubnetFirewallRules(previous.BridgeSubnet); err != nil {
+		logger.WithError(err).Warn("failed to clean up firewall rules for previous subnet")
+	}
+	// The IPs and CIDs held in the old subnet are released with their VMs,
+	// none of which can be adopted.
+	if err := os.Remove(path.Join(config.StateDir, attachmentsFilename)); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to reset network attachments: %w", err)
+	}
+	return &serverapi.SubnetMigration{
+		PreviousSubnet: serverapi.PtrString(previous.BridgeSubnet),
+		Subnet:         serverapi.PtrString(config.BridgeSubnet),
+		AffectedVms:    affectedVMs,
+	}, nil
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/hostcmd"
+)
+
+func TestListVMStateDirsSkipsReservedDirs(t *testing.T) {
+	stateDir := t.TempDir()
+	for _, name := range []string{"vm1", "vm2", archiveDirName, templatesDirName, crashDirName, snapshotsDirName, preservedDirName, byPidDirName} {
+		if err := os.Mkdir(path.Join(stateDir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path.Join(stateDir, "network.json"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := listVMStateDirs(stateDir)
+	if err != nil {
+		t.Fatalf("listVMStateDirs: %v", err)
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"vm1", "vm2"}) {
+		t.Errorf("listVMStateDirs = %v, want [vm1 vm2]", names)
+	}
+}
+
+func TestReservedVMName(t *testing.T) {
+	for _, name := range []string{byPidDirName, archiveDirName, poolVMPrefix + "1"} {
+		if !reservedVMName(name) {
+			t.Errorf("reservedVMName(%q) = false, want true", name)
+		}
+	}
+	if reservedVMName("vm1") {
+		t.Error(`reservedVMName("vm1") = true, want false`)
+	}
+}
+
+func TestStartVMRejectsReservedNames(t *testing.T) {
+	h := newTestHarness(t, nil)
+	for _, name := range []string{"", archiveDirName, poolVMPrefix + "1"} {
+		req := &serverapi.StartVMRequest{VmName: serverapi.PtrString(name)}
+		if _, err := h.server.StartVM(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("StartVM(%q) = %v, want InvalidArgument", name, err)
+		}
+	}
+}
+
+func TestCleanupSubnetFirewallRules(t *testing.T) {
+	runner := &fakeRunner{}
+	t.Cleanup(hostcmd.SetRunner(runner))
+	runner.respond("iptables -t nat -S POSTROUTING", `-P POSTROUTING ACCEPT
+-A POSTROUTING -s 10.20.1.0/24 -o eth0 -m comment --comment "cbox:10.20.1.0/24" -j MASQUERADE
+-A POSTROUTING -s 10.20.1.0/24 -o eth0 -j MASQUERADE
+-A POSTROUTING -s 10.20.2.0/24 -o eth0 -m comment --comment "cbox:10.20.2.0/24" -j MASQUERADE
+`)
+	runner.respond("iptables -t filter -S FORWARD", `-P FORWARD DROP
+-A FORWARD -d 10.20.1.0/24 -m comment --comment cbox:10.20.1.0/24 -j ACCEPT
+-A FORWARD -s 10.20.1.0/24 -m comment --comment "cbox:10.20.1.0/24" -j ACCEPT
+-A FORWARD -s 10.20.1.0/24 -m comment --comment "someone else's" -j ACCEPT
+`)
+
+	if err := cleanupSubnetFirewallRules("10.20.1.0/24"); err != nil {
+		t.Fatalf("cleanupSubnetFirewallRules: %v", err)
+	}
+	for _, rule := range []string{
+		"iptables -t nat -D POSTROUTING -s 10.20.1.0/24 -o eth0 -m comment --comment cbox:10.20.1.0/24 -j MASQUERADE",
+		"iptables -t filter -D FORWARD -d 10.20.1.0/24 -m comment --comment cbox:10.20.1.0/24 -j ACCEPT",
+		"iptables -t filter -D FORWARD -s 10.20.1.0/24 -m comment --comment cbox:10.20.1.0/24 -j ACCEPT",
+	} {
+		if runner.ran(rule) != 1 {
+			t.Errorf("%q didn't run", rule)
+		}
+	}
+	// Rules without the subnet's comment aren't cbox's to delete.
+	if deleted := runner.ran("iptables -t nat -D") + runner.ran("iptables -t filter -D"); deleted != 3 {
+		t.Errorf("%d rules deleted, want 3", deleted)
+	}
+}
+
+func TestCheckBridgeSubnet(t *testing.T) {
+	runner := &fakeRunner{}
+	t.Cleanup(hostcmd.SetRunner(runner))
+	cfg := config.DefaultServerConfig()
+	cfg.StateDir = t.TempDir()
+	cfg.BridgeSubnet = "10.20.2.0/24"
+
+	if migration, err := checkBridgeSubnet(cfg); migration != nil || err != nil {
+		t.Errorf("checkBridgeSubnet without network state = %+v, %v; want nothing", migration, err)
+	}
+	if err := saveNetworkState(cfg.StateDir, &networkState{BridgeSubnet: "10.20.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if migration, err := checkBridgeSubnet(cfg); migration != nil || err != nil {
+		t.Errorf("checkBridgeSubnet with the same subnet = %+v, %v; want nothing", migration, err)
+	}
+
+	if err := saveNetworkState(cfg.StateDir, &networkState{BridgeSubnet: "10.20.1.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	registry := path.Join(cfg.StateDir, attachmentsFilename)
+	for _, name := range []string{"vm2", "vm1"} {
+		if err := os.Mkdir(path.Join(cfg.StateDir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(registry, []byte(`{"bridgeSubnet": "10.20.1.0/24"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := checkBridgeSubnet(cfg); err == nil {
+		t.Error("checkBridgeSubnet allowed a subnet change without --migrate-subnet")
+	}
+	if _, err := os.Stat(registry); err != nil {
+		t.Errorf("refused subnet change touched the network attachments: %v", err)
+	}
+	if runner.ran("iptables") != 0 {
+		t.Error("refused subnet change touched the firewall")
+	}
+
+	cfg.MigrateSubnet = true
+	migration, err := checkBridgeSubnet(cfg)
+	if err != nil {
+		t.Fatalf("checkBridgeSubnet: %v", err)
+	}
+	if migration.GetPreviousSubnet() != "10.20.1.0/24" || migration.GetSubnet() != "10.20.2.0/24" || !slices.Equal(migration.AffectedVms, []string{"vm1", "vm2"}) {
+		t.Errorf("migration = %+v, want 10.20.1.0/24 to 10.20.2.0/24 affecting vm1 and vm2", migration)
+	}
+	if _, err := os.Stat(registry); !os.IsNotExist(err) {
+		t.Errorf("network attachments of the previous subnet weren't reset: %v", err)
+	}
+	if runner.ran("iptables -t nat -S POSTROUTING") != 1 || runner.ran("iptables -t filter -S FORWARD") != 1 {
+		t.Error("firewall rules of the previous subnet weren't cleaned up")
+	}
+}
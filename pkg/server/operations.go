@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/callback"
+)
+
+const (
+	operationTypeStartVM = "startVM"
+
+	operationPending   = "PENDING"
+	operationRunning   = "RUNNING"
+	operationSucceeded = "SUCCEEDED"
+	operationFailed    = "FAILED"
+)
+
+// errDestroyedWhileStarting fails start operations whose VM was destroyed
+// before it finished starting.
+var errDestroyedWhileStarting = errors.New("vm was destroyed while starting")
+
+// operation is a request running in the background.
+type operation struct {
+	id         string
+	opType     string
+	vmName     string
+	labels     map[string]string
+	state      string
+	createdAt  time.Time
+	finishedAt time.Time
+	result     *serverapi.StartVMResponse
+	err        string
+	cancel     context.CancelCauseFunc
+	// done is closed once the operation has finished.
+	done chan struct{}
+}
+
+// operationStore keeps operations in memory until retention after they
+// finish.
+type operationStore struct {
+	lock      sync.Mutex
+	ops       map[string]*operation
+	retention time.Duration
+}
+
+func newOperationStore(retention time.Duration) *operationStore {
+	return &operationStore{
+		ops:       make(map[string]*operation),
+		retention: retention,
+	}
+}
+
+// prune drops operations that finished more than retention ago. Must be
+// called with st.lock held.
+func (st *operationStore) prune() {
+	cutoff := time.Now().Add(-st.retention)
+	for id, op := range st.ops {
+		if !op.finishedAt.IsZero() && op.finishedAt.Before(cutoff) {
+			delete(st.ops, id)
+		}
+	}
+}
+
+// add stores op. It fails with AlreadyExists if another operation is still
+// working on op's VM.
+func (st *operationStore) add(op *operation) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.prune()
+	if other := st.unfinished(op.vmName); other != nil {
+		return status.Error(codes.AlreadyExists, fmt.Sprintf("vm %s is already being started by operation %s", op.vmName, other.id))
+	}
+	st.ops[op.id] = op
+	return nil
+}
+
+// unfinished returns the operation still working on vmName, if any. Must be
+// called with st.lock held.
+func (st *operationStore) unfinished(vmName string) *operation {
+	for _, op := range st.ops {
+		if op.vmName == vmName && op.finishedAt.IsZero() {
+			return op
+		}
+	}
+	return nil
+}
+
+func (st *operationStore) setRunning(op *operation) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	op.state = operationRunning
+}
+
+func (st *operationStore) finish(op *operation, result *serverapi.StartVMResponse, err error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	op.finishedAt = time.Now()
+	if err != nil {
+		op.state = operationFailed
+		op.err = err.Error()
+		return
+	}
+	op.state = operationSucceeded
+	op.result = result
+}
+
+// get returns operation id as returned by the API.
+func (st *operationStore) get(id string) (*serverapi.Operation, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.prune()
+	op, ok := st.ops[id]
+	if !ok {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("operation not found: %s", id))
+	}
+	return op.apiOperation(), nil
+}
+
+// apiOperation must be called with the store's lock held.
+func (op *operation) apiOperation() *serverapi.Operation {
+	resp := &serverapi.Operation{
+		Id:        serverapi.PtrString(op.id),
+		Type:      serverapi.PtrString(op.opType),
+		VmName:    serverapi.PtrString(op.vmName),
+		State:     serverapi.PtrString(op.state),
+		CreatedAt: serverapi.PtrTime(op.createdAt),
+		Result:    op.result,
+	}
+	if !op.finishedAt.IsZero() {
+		resp.FinishedAt = serverapi.PtrTime(op.finishedAt)
+	}
+	if op.err != "" {
+		resp.Error = serverapi.PtrString(op.err)
+	}
+	return resp
+}
+
+// StartVMAsync starts a VM like StartVM, but in the background, and returns
+// the operation to poll for the result. onStarted, if set, runs once the VM
+// has started, before the operation succeeds.
+func (s *Server) StartVMAsync(req *serverapi.StartVMRequest, onStarted func(*serverapi.StartVMResponse)) (*serverapi.Operation, error) {
+	vmName := req.GetVmName()
+	if vmName == "" {
+		return nil, status.Error(codes.InvalidArgument, "vmName is required")
+	}
+	if reservedVMName(vmName) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("vmName %s is reserved", vmName))
+	}
+	if err := validateLabels(req.GetLabels()); err != nil {
+		return nil, err
+	}
+	if err := callback.ValidateMethodPatterns(req.GetAllowedCallbackMethods()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// Fail duplicates up front rather than in the operation.
+	if vm := s.getVMAtomic(vmName); vm != nil {
+		if _, err := checkExistingVM(vm, req); err != nil {
+			return nil, err
+		}
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate operation id: %w", err)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	op := &operation{
+		id:        hex.EncodeToString(id),
+		opType:    operationTypeStartVM,
+		vmName:    vmName,
+		labels:    req.GetLabels(),
+		state:     operationPending,
+		createdAt: time.Now(),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	if err := s.operations.add(op); err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	logger := log.WithFields(log.Fields{"vmName": vmName, "operation": op.id})
+	logger.Info("Starting VM asynchronously")
+
+	go func() {
+		defer close(op.done)
+		defer cancel(nil)
+		s.operations.setRunning(op)
+		resp, err := s.startVM(ctx, req, "")
+		if ctx.Err() != nil {
+			// The VM may have come up regardless; whoever canceled the
+			// operation cleans it up.
+			err = context.Cause(ctx)
+		}
+		if err != nil {
+			logger.WithError(err).Error("Async VM start failed")
+			s.operations.finish(op, nil, err)
+			return
+		}
+		if onStarted != nil {
+			onStarted(resp)
+		}
+		logger.Info("Async VM start succeeded")
+		s.operations.finish(op, resp, nil)
+	}()
+
+	s.operations.lock.Lock()
+	defer s.operations.lock.Unlock()
+	return op.apiOperation(), nil
+}
+
+// GetOperation returns an operation by ID.
+func (s *Server) GetOperation(id string) (*serverapi.Operation, error) {
+	return s.operations.get(id)
+}
+
+// cancelStartOperation cancels the operation starting vmName, if there is
+// one, and waits for it to wind down. It reports whether there was one.
+func (s *Server) cancelStartOperation(ctx context.Context, vmName string) (bool, error) {
+	s.operations.lock.Lock()
+	op := s.operations.unfinished(vmName)
+	s.operations.lock.Unlock()
+	if op == nil {
+		return false, nil
+	}
+
+	log.WithFields(log.Fields{"vmName": vmName, "operation": op.id}).Info("Canceling VM start")
+	op.cancel(errDestroyedWhileStarting)
+	select {
+	case <-op.done:
+		return true, nil
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
+
+// cancelStartOperations cancels every unfinished start operation for a VM
+// matching selector and waits for them to wind down.
+func (s *Server) cancelStartOperations(ctx context.Context, selector labelSelector) error {
+	s.operations.lock.Lock()
+	var ops []*operation
+	for _, op := range s.operations.ops {
+		if op.finishedAt.IsZero() && selector.matches(op.labels) {
+			ops = append(ops, op)
+		}
+	}
+	s.operations.lock.Unlock()
+
+	for _, op := range ops {
+		op.cancel(errDestroyedWhileStarting)
+	}
+	for _, op := range ops {
+		select {
+		case <-op.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// opGateMaxWait bounds how long traffic queues behind an operation when
+	// its context has no earlier deadline.
+	opGateMaxWait = 30 * time.Second
+
+	opDestroy = "destroy"
+)
+
+// BusyError is returned when a VM is held by an exclusive operation for
+// longer than the caller could wait.
+type BusyError struct {
+	VMName    string
+	Operation string
+	// EstimatedWait is how much longer the operation is expected to run.
+	// Zero if unknown.
+	EstimatedWait time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("vm %s is busy: %s in progress", e.VMName, e.Operation)
+}
+
+func (e *BusyError) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, e.Error())
+}
+
+// opGate serializes administrative operations on a VM (destroy, and later
+// snapshot or migrate) against guest traffic such as exec and callbacks.
+// Traffic holds the gate shared; an operation holds it exclusively and waits
+// for in-flight traffic to drain, while new traffic queues behind it.
+type opGate struct {
+	lock     sync.Mutex
+	shared   int
+	op       string
+	opStart  time.Time
+	estimate time.Duration
+	// closed is set once the VM is destroyed.
+	closed bool
+	// changed is closed and replaced whenever the gate is released.
+	changed chan struct{}
+}
+
+func newOpGate() *opGate {
+	return &opGate{changed: make(chan struct{})}
+}
+
+// notify wakes up every waiter. Must be called with lock held.
+func (g *opGate) notify() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// close fails current and future acquisitions with NotFound. Called once the
+// VM is destroyed.
+func (g *opGate) close() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.closed = true
+	g.op = ""
+	g.notify()
+}
+
+// currentOperation returns the operation holding the gate, if any.
+func (g *opGate) currentOperation() string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.op
+}
+
+// acquireShared takes the gate for guest traffic. If an operation holds it,
+// it waits until the operation ends, ctx is done or opGateMaxWait passes,
+// whichever comes first, and returns a *BusyError in the latter cases.
+func (g *opGate) acquireShared(ctx context.Context, vmName string) (func(), error) {
+	timer := time.NewTimer(opGateMaxWait)
+	defer timer.Stop()
+
+	for {
+		g.lock.Lock()
+		if g.closed {
+			g.lock.Unlock()
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+		}
+		if g.op == "" {
+			g.shared++
+			g.lock.Unlock()
+			var once sync.Once
+			return func() {
+				once.Do(func() {
+					g.lock.Lock()
+					defer g.lock.Unlock()
+					g.shared--
+					g.notify()
+				})
+			}, nil
+		}
+		changed := g.changed
+		busy := &BusyError{VMName: vmName, Operation: g.op}
+		if g.estimate > 0 {
+			busy.EstimatedWait = max(g.estimate-time.Since(g.opStart), 0)
+		}
+		g.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, busy
+		case <-timer.C:
+			return nil, busy
+		}
+	}
+}
+
+// acquireExclusive takes the gate for op, which is expected to take about
+// estimate. Traffic arriving from now on queues; traffic already in flight
+// is waited for until ctx is done.
+func (g *opGate) acquireExclusive(ctx context.Context, vmName string, op string, estimate time.Duration) (func(), error) {
+	// Claim the gate first so new traffic queues instead of starving us.
+	for {
+		g.lock.Lock()
+		if g.closed {
+			g.lock.Unlock()
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+		}
+		if g.op == "" {
+			g.op = op
+			g.opStart = time.Now()
+			g.estimate = estimate
+			g.lock.Unlock()
+			break
+		}
+		changed := g.changed
+		busy := &BusyError{VMName: vmName, Operation: g.op}
+		g.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, busy
+		}
+	}
+
+	release := func() {
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		g.op = ""
+		g.estimate = 0
+		g.notify()
+	}
+
+	for {
+		g.lock.Lock()
+		if g.shared == 0 {
+			g.lock.Unlock()
+			var once sync.Once
+			return func() { once.Do(release) }, nil
+		}
+		changed := g.changed
+		g.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			release()
+			return nil, status.Error(codes.DeadlineExceeded, fmt.Sprintf("timed out waiting for in-flight requests to vm %s before %s", vmName, op))
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+)
+
+func TestOpGateOrdering(t *testing.T) {
+	gate := newOpGate()
+	releaseExec, err := gate.acquireShared(context.Background(), "vm1")
+	if err != nil {
+		t.Fatalf("acquireShared: %v", err)
+	}
+
+	// The snapshot waits for the exec in flight.
+	snapshotAcquired := make(chan func())
+	go func() {
+		release, err := gate.acquireExclusive(context.Background(), "vm1", opSnapshot, time.Minute)
+		if err != nil {
+			t.Errorf("acquireExclusive: %v", err)
+		}
+		snapshotAcquired <- release
+	}()
+	for gate.currentOperation() != opSnapshot {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Traffic arriving now queues behind the snapshot instead of starving it.
+	execAcquired := make(chan func())
+	go func() {
+		release, err := gate.acquireShared(context.Background(), "vm1")
+		if err != nil {
+			t.Errorf("acquireShared behind the snapshot: %v", err)
+		}
+		execAcquired <- release
+	}()
+	select {
+	case <-snapshotAcquired:
+		t.Fatal("snapshot started with an exec in flight")
+	case <-execAcquired:
+		t.Fatal("exec overtook the waiting snapshot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	releaseExec()
+	// Releasing twice doesn't give back someone else's hold.
+	releaseExec()
+	releaseSnapshot := <-snapshotAcquired
+	select {
+	case <-execAcquired:
+		t.Fatal("exec ran during the snapshot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	releaseSnapshot()
+	(<-execAcquired)()
+	if op := gate.currentOperation(); op != "" {
+		t.Errorf("currentOperation = %q once everything is released, want none", op)
+	}
+}
+
+func TestOpGateBusy(t *testing.T) {
+	gate := newOpGate()
+	release, err := gate.acquireExclusive(context.Background(), "vm1", opSnapshot, time.Minute)
+	if err != nil {
+		t.Fatalf("acquireExclusive: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = gate.acquireShared(ctx, "vm1")
+	var busy *BusyError
+	if !errors.As(err, &busy) {
+		t.Fatalf("acquireShared during a snapshot = %v, want a BusyError", err)
+	}
+	if busy.Operation != opSnapshot || busy.EstimatedWait <= 0 || busy.EstimatedWait > time.Minute {
+		t.Errorf("BusyError = %+v, want the snapshot with under a minute left", busy)
+	}
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("status code = %s, want Unavailable", status.Code(err))
+	}
+}
+
+func TestOpGateReleasedOnFailure(t *testing.T) {
+	gate := newOpGate()
+	releaseExec, err := gate.acquireShared(context.Background(), "vm1")
+	if err != nil {
+		t.Fatalf("acquireShared: %v", err)
+	}
+	defer releaseExec()
+
+	// A resize that gives up waiting for the exec doesn't keep the gate.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := gate.acquireExclusive(ctx, "vm1", opResize, time.Minute); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("acquireExclusive with traffic in flight = %v, want DeadlineExceeded", err)
+	}
+	if op := gate.currentOperation(); op != "" {
+		t.Errorf("currentOperation = %q after the resize gave up, want none", op)
+	}
+	release, err := gate.acquireShared(context.Background(), "vm1")
+	if err != nil {
+		t.Fatalf("acquireShared after the resize gave up: %v", err)
+	}
+	release()
+}
+
+func TestOpGateClosed(t *testing.T) {
+	gate := newOpGate()
+	release, err := gate.acquireExclusive(context.Background(), "vm1", opDestroy, 0)
+	if err != nil {
+		t.Fatalf("acquireExclusive: %v", err)
+	}
+	waiting := make(chan error)
+	go func() {
+		_, err := gate.acquireShared(context.Background(), "vm1")
+		waiting <- err
+	}()
+	gate.close()
+	release()
+	if err := <-waiting; status.Code(err) != codes.NotFound {
+		t.Errorf("acquireShared queued behind destroy = %v, want NotFound", err)
+	}
+	if _, err := gate.acquireExclusive(context.Background(), "vm1", opSnapshot, 0); status.Code(err) != codes.NotFound {
+		t.Errorf("acquireExclusive on a destroyed VM = %v, want NotFound", err)
+	}
+}
+
+func TestVMExecDuringOperation(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	vm := h.server.getVMAtomic("vm1")
+	release, err := vm.gate.acquireExclusive(context.Background(), "vm1", opSnapshot, time.Minute)
+	if err != nil {
+		t.Fatalf("acquireExclusive: %v", err)
+	}
+
+	resp, err := h.server.ListVM(context.Background(), "vm1")
+	if err != nil {
+		t.Fatalf("ListVM: %v", err)
+	}
+	if resp.GetCurrentOperation() != opSnapshot {
+		t.Errorf("ListVM currentOperation = %q, want %s", resp.GetCurrentOperation(), opSnapshot)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var busy *BusyError
+	if _, err := h.server.VMExec(ctx, "vm1", &serverapi.VmExecRequest{Cmd: "true"}); !errors.As(err, &busy) {
+		t.Errorf("VMExec during a snapshot = %v, want a BusyError", err)
+	}
+
+	release()
+	if _, err := h.server.VMExec(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "true"}); err != nil {
+		t.Errorf("VMExec after the snapshot: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/hostcmd"
+)
+
+// rootfsOverlayFilename is the qcow2 overlay in a VM's state dir that the VM
+// writes its root to instead of the shared rootfs.
+const rootfsOverlayFilename = "rootfs-overlay.qcow2"
+
+// wantsRootfsOverlay reports whether the VM started by req runs on a rootfs
+// overlay, failing if qemu-img wasn't found to create it.
+func (s *Server) wantsRootfsOverlay(req *serverapi.StartVMRequest) (bool, error) {
+	overlay := s.config.RootfsOverlay
+	if req.HasRootfsOverlay() {
+		overlay = req.GetRootfsOverlay()
+	}
+	if overlay && !s.hasHostBinary("qemu-img") {
+		return false, status.Error(codes.FailedPrecondition, "rootfs overlays need qemu-img, which wasn't found")
+	}
+	return overlay, nil
+}
+
+// createRootfsOverlay creates a qcow2 image at overlayPath backed by the raw
+// image at rootfsPath, which is never written to.
+func createRootfsOverlay(rootfsPath string, overlayPath string) error {
+	// qemu-img resolves relative backing files against the overlay's dir.
+	backing, err := filepath.Abs(rootfsPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve rootfs path: %w", err)
+	}
+	if err := hostcmd.Run("qemu-img", "create", "-q", "-f", "qcow2", "-F", "raw", "-b", backing, overlayPath); err != nil {
+		return fmt.Errorf("failed to create rootfs overlay: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+const (
+	opPause  = "pause"
+	opResume = "resume"
+	// pauseTimeout bounds a pause or resume call to the VMM, including
+	// waiting for in-flight guest traffic to drain.
+	pauseTimeout = 10 * time.Second
+)
+
+// PauseVM pauses a running VM's vCPUs. Guest traffic to a paused VM stalls
+// until it's resumed.
+func (s *Server) PauseVM(ctx context.Context, vmName string) error {
+	return s.setPaused(ctx, vmName, true)
+}
+
+// ResumeVM resumes a paused VM.
+func (s *Server) ResumeVM(ctx context.Context, vmName string) error {
+	return s.setPaused(ctx, vmName, false)
+}
+
+func (s *Server) setPaused(ctx context.Context, vmName string, pause bool) error {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return err
+	}
+
+	op, from, to, eventType := opResume, vmStatusPaused, vmStatusRunning, events.TypeVMResumed
+	if pause {
+		op, from, to, eventType = opPause, vmStatusRunning, vmStatusPaused, events.TypeVMPaused
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pauseTimeout)
+	defer cancel()
+	release, err := vm.gate.acquireExclusive(ctx, vmName, op, pauseTimeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	if vm.status != from {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("cannot %s vm %s: vm is %s", op, vmName, vm.status))
+	}
+
+	if err := vm.pauseVMM(ctx, pause); err != nil {
+		return err
+	}
+
+	vm.status = to
+	log.Infof("Successfully %sd VM: %s", op, vmName)
+	s.events.Publish(eventType, vmName, nil)
+	return nil
+}
+
+// pauseVMM pauses or resumes the guest through the VMM's API. It leaves the
+// VM's status alone.
+func (v *vm) pauseVMM(ctx context.Context, pause bool) error {
+	op := opResume
+	var resp *http.Response
+	var err error
+	if pause {
+		op = opPause
+		resp, err = v.apiClient.DefaultAPI.PauseVM(ctx).Execute()
+	} else {
+		resp, err = v.apiClient.DefaultAPI.ResumeVM(ctx).Execute()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to %s VM: %w", op, err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed to %s VM. bad status: %v", op, resp)
+	}
+	return nil
+}
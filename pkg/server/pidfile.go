@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pidFilename  = "pid"
+	byPidDirName = "by-pid"
+)
+
+// byPidDir holds a <pid> -> <vmName> symlink per cloud-hypervisor process so
+// ops tooling can map a pid from ps or ss back to its VM.
+func byPidDir(stateDir string) string {
+	return path.Join(stateDir, byPidDirName)
+}
+
+// writePidRecords writes the VM's pid file and by-pid symlink.
+func writePidRecords(stateDir string, vmName string, pid int) error {
+	pidFile := path.Join(getVmStateDirPath(stateDir, vmName), pidFilename)
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write pid file: %w", err)
+	}
+
+	if err := os.MkdirAll(byPidDir(stateDir), 0755); err != nil {
+		return fmt.Errorf("failed to create by-pid dir: %w", err)
+	}
+	link := path.Join(byPidDir(stateDir), strconv.Itoa(pid))
+	// A leftover link for a recycled pid is stale by definition.
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale by-pid link: %w", err)
+	}
+	if err := os.Symlink(vmName, link); err != nil {
+		return fmt.Errorf("failed to create by-pid link: %w", err)
+	}
+	return nil
+}
+
+// removePidRecords removes the VM's pid file and, if it still points at the
+// VM, its by-pid symlink.
+func removePidRecords(stateDir string, vmName string, pid int) {
+	logger := log.WithField("vmName", vmName)
+
+	pidFile := path.Join(getVmStateDirPath(stateDir, vmName), pidFilename)
+	if err := os.Remove(pidFile); err != nil && !os.IsNotExist(err) {
+		logger.WithError(err).Warn("failed to remove pid file")
+	}
+
+	link := path.Join(byPidDir(stateDir), strconv.Itoa(pid))
+	if target, err := os.Readlink(link); err == nil && target == vmName {
+		if err := os.Remove(link); err != nil {
+			logger.WithError(err).Warn("failed to remove by-pid link")
+		}
+	}
+}
+
+// processExists reports whether a process with pid is running.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// cleanupStalePidRecords removes pid files and by-pid symlinks left behind by
+// VM processes that are no longer running, e.g. after a host crash.
+func cleanupStalePidRecords(stateDir string) error {
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		pidFile := path.Join(stateDir, entry.Name(), pidFilename)
+		data, err := os.ReadFile(pidFile)
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || !processExists(pid) {
+			log.WithField("vmName", entry.Name()).Info("removing stale pid file")
+			os.Remove(pidFile)
+		}
+	}
+
+	links, err := os.ReadDir(byPidDir(stateDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, link := range links {
+		pid, err := strconv.Atoi(link.Name())
+		if err != nil || !processExists(pid) {
+			log.WithField("pid", link.Name()).Info("removing stale by-pid link")
+			os.Remove(path.Join(byPidDir(stateDir), link.Name()))
+		}
+	}
+	return nil
+}
+
+// LookupVMByPid returns the name of the VM whose cloud-hypervisor process has
+// pid, using the by-pid links under stateDir.
+func LookupVMByPid(stateDir string, pid int) (string, error) {
+	vmName, err := os.Readlink(path.Join(byPidDir(stateDir), strconv.Itoa(pid)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("no VM with pid %d", pid)
+		}
+		return "", err
+	}
+	return vmName, nil
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/chvapi"
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+)
+
+const (
+	sysCPUOnlinePath = "/sys/devices/system/cpu/online"
+	sysNodeDir       = "/sys/devices/system/node"
+
+	// minPinningCHVersion is the first cloud-hypervisor major version that
+	// accepts vCPU affinity.
+	minPinningCHVersion = 20
+
+	numaMemoryZoneID = "mem0"
+)
+
+// parseCPUList parses a kernel cpulist such as "0-3,8,10-11".
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid cpulist %q", list)
+		}
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(hi)
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid cpulist %q", list)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	sort.Ints(cpus)
+	return slices.Compact(cpus), nil
+}
+
+// formatCPUList formats sorted cpus as a kernel cpulist.
+func formatCPUList(cpus []int) string {
+	var parts []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(cpus[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// hostTopology is the host's online CPUs and NUMA nodes.
+type hostTopology struct {
+	cpus  []int
+	nodes map[int][]int
+}
+
+// readHostTopology reads the host topology from sysfs. Hosts without NUMA
+// support report no nodes.
+func readHostTopology() (*hostTopology, error) {
+	data, err := os.ReadFile(sysCPUOnlinePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read online CPUs: %w", err)
+	}
+	cpus, err := parseCPUList(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse online CPUs: %w", err)
+	}
+	topo := &hostTopology{cpus: cpus, nodes: make(map[int][]int)}
+
+	entries, err := os.ReadDir(sysNodeDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return topo, nil
+		}
+		return nil, fmt.Errorf("failed to read NUMA nodes: %w", err)
+	}
+	for _, entry := range entries {
+		id, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), "node"))
+		if err != nil || !strings.HasPrefix(entry.Name(), "node") {
+			continue
+		}
+		data, err := os.ReadFile(path.Join(sysNodeDir, entry.Name(), "cpulist"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CPUs of NUMA node %d: %w", id, err)
+		}
+		nodeCPUs, err := parseCPUList(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CPUs of NUMA node %d: %w", id, err)
+		}
+		topo.nodes[id] = nodeCPUs
+	}
+	return topo, nil
+}
+
+// nodeOf returns the NUMA node cpu belongs to.
+func (t *hostTopology) nodeOf(cpu int) (int, bool) {
+	for id, cpus := range t.nodes {
+		if slices.Contains(cpus, cpu) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// pinningPlan is a VM's validated vCPU affinity and memory placement.
+type pinningPlan struct {
+	// affinity holds the host CPUs of each vCPU.
+	affinity [][]int
+	numaNode *int32
+}
+
+// pinnedCPUs maps each host CPU to the running VMs with vCPUs pinned to it.
+func (s *Server) pinnedCPUs() map[int][]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	pinned := make(map[int][]string)
+	for name, vm := range s.vms {
+		var cpus []int
+		for _, hostCPUs := range vm.cpuAffinity {
+			cpus = append(cpus, hostCPUs...)
+		}
+		sort.Ints(cpus)
+		for _, cpu := range slices.Compact(cpus) {
+			pinned[cpu] = append(pinned[cpu], name)
+		}
+	}
+	for _, names := range pinned {
+		sort.Strings(names)
+	}
+	return pinned
+}
+
+// planPinning validates req's cpuAffinity and numaNode against the host
+// topology and the pinnings of running VMs. vcpus is the VM's default vCPU
+// count; the returned count replaces it. The plan is nil if req asks for no
+// pinning.
+func (s *Server) planPinning(req *serverapi.StartVMRequest, vcpus int32) (*pinningPlan, int32, error) {
+	if len(req.GetCpuAffinity()) == 0 && !req.HasNumaNode() {
+		return nil, vcpus, nil
+	}
+	topo, err := readHostTopology()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	plan := &pinningPlan{}
+	var nodeCPUs []int
+	if req.HasNumaNode() {
+		node := req.GetNumaNode()
+		var ok bool
+		nodeCPUs, ok = topo.nodes[int(node)]
+		if !ok {
+			return nil, 0, status.Error(codes.InvalidArgument, fmt.Sprintf("host has no NUMA node %d", node))
+		}
+		plan.numaNode = &node
+	}
+
+	var sets [][]int
+	for _, list := range req.GetCpuAffinity() {
+		cpus, err := parseCPUList(list)
+		if err != nil {
+			return nil, 0, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if len(cpus) == 0 {
+			return nil, 0, status.Error(codes.InvalidArgument, "cpuAffinity entries must not be empty")
+		}
+		for _, cpu := range cpus {
+			if !slices.Contains(topo.cpus, cpu) {
+				return nil, 0, status.Error(codes.InvalidArgument, fmt.Sprintf("host CPU %d is not online", cpu))
+			}
+			if plan.numaNode != nil && !slices.Contains(nodeCPUs, cpu) {
+				log.WithField("vmName", req.GetVmName()).Warnf("host CPU %d is outside NUMA node %d that holds the guest memory", cpu, *plan.numaNode)
+			}
+		}
+		sets = append(sets, cpus)
+	}
+	switch {
+	case len(sets) > 1:
+		vcpus = int32(len(sets))
+	case len(sets) == 0 && len(nodeCPUs) > 0:
+		sets = [][]int{nodeCPUs}
+	}
+	if len(sets) == 1 {
+		for range vcpus {
+			plan.affinity = append(plan.affinity, sets[0])
+		}
+	} else {
+		plan.affinity = sets
+	}
+
+	pinned := s.pinnedCPUs()
+	var conflicts []string
+	seen := make(map[int]bool)
+	for _, cpus := range plan.affinity {
+		for _, cpu := range cpus {
+			if vms := pinned[cpu]; len(vms) > 0 && !seen[cpu] {
+				seen[cpu] = true
+				conflicts = append(conflicts, fmt.Sprintf("CPU %d (%s)", cpu, strings.Join(vms, ", ")))
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		msg := fmt.Sprintf("cpuAffinity overlaps other VMs' pinned host CPUs: %s", strings.Join(conflicts, "; "))
+		if s.config.StrictCPUPinning {
+			return nil, 0, status.Error(codes.FailedPrecondition, msg)
+		}
+		log.WithField("vmName", req.GetVmName()).Warn(msg)
+	}
+	return plan, vcpus, nil
+}
+
+// checkPinningSupport fails if the VMM is too old to apply a pinning plan.
+// Versions that can't be parsed, such as development builds, are assumed to
+// support it.
+func checkPinningSupport(ctx context.Context, apiClient *chvapi.APIClient) error {
+	resp, _, err := apiClient.DefaultAPI.VmmPingGet(ctx).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to get cloud-hypervisor version: %w", err)
+	}
+	version := resp.GetBuildVersion()
+	major, _, _ := strings.Cut(strings.TrimPrefix(version, "v"), ".")
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		log.Warnf("unrecognized cloud-hypervisor version %q, assuming it supports CPU pinning", version)
+		return nil
+	}
+	if n < minPinningCHVersion {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("cloud-hypervisor %s doesn't support CPU pinning, v%d or later is required", version, minPinningCHVersion))
+	}
+	return nil
+}
+
+// apply sets the plan's vCPU affinity and NUMA memory placement on config.
+// Memory on a host node has to be described as a memory zone, with the
+// top-level size left at zero.
+func (p *pinningPlan) apply(config *chvapi.VmConfig) {
+	for vcpu, cpus := range p.affinity {
+		affinity := chvapi.CpuAffinity{Vcpu: int32(vcpu)}
+		for _, cpu := range cpus {
+			affinity.HostCpus = append(affinity.HostCpus, int32(cpu))
+		}
+		config.Cpus.Affinity = append(config.Cpus.Affinity, affinity)
+	}
+	if p.numaNode != nil {
+		config.Memory.Zones = []chvapi.MemoryZoneConfig{
+			{Id: numaMemoryZoneID, Size: config.Memory.Size, HostNumaNode: Int32(*p.numaNode)},
+		}
+		config.Memory.Size = 0
+	}
+}
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+)
+
+const (
+	// poolVMPrefix starts the names pooled VMs run under until they're
+	// claimed. VM names with it are reserved.
+	poolVMPrefix = "_pool-"
+	// poolRetryInterval is how long the pool waits after failing to create
+	// a VM, and how often it checks for room under max_vms.
+	poolRetryInterval = 10 * time.Second
+)
+
+// vmPool keeps booted VMs ready for StartVM to claim. Pooled VMs aren't in
+// Server.vms; they run under a poolVMPrefix name until claimed, and count
+// towards max_vms.
+type vmPool struct {
+	lock sync.Mutex
+	size int
+	// ready are booted VMs whose agents are up, oldest first.
+	ready []*vm
+	// filling counts VMs being created for the pool.
+	filling int
+	seq     int
+	// unsupported is set once the guest image turns out not to support
+	// being renamed, which stops the pool from filling.
+	unsupported bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	refill chan struct{}
+	filler sync.WaitGroup
+}
+
+func newVMPool(size int) *vmPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &vmPool{
+		size:   size,
+		ctx:    ctx,
+		cancel: cancel,
+		refill: make(chan struct{}, 1),
+	}
+}
+
+// len returns the number of VMs in the pool, including those being created.
+func (p *vmPool) len() int {
+	if p == nil {
+		return 0
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.ready) + p.filling
+}
+
+// wake asks the filler to check whether the pool needs VMs.
+func (p *vmPool) wake() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// take removes the oldest ready VM from the pool, if any.
+func (p *vmPool) take() *vm {
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.ready) == 0 {
+		return nil
+	}
+	v := p.ready[0]
+	p.ready = p.ready[1:]
+	return v
+}
+
+// status returns the pool's depth as reported by ListAllVMs.
+func (p *vmPool) status() *serverapi.VMPoolStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return &serverapi.VMPoolStatus{
+		Size:        serverapi.PtrInt32(int32(p.size)),
+		Ready:       serverapi.PtrInt32(int32(len(p.ready))),
+		Filling:     serverapi.PtrInt32(int32(p.filling)),
+		Unsupported: serverapi.PtrBool(p.unsupported),
+	}
+}
+
+// startFilling reserves a slot for a new pooled VM and returns its name, or
+// "" if the pool is full or can't be filled.
+func (p *vmPool) startFilling() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.unsupported || p.ctx.Err() != nil || len(p.ready)+p.filling >= p.size {
+		return ""
+	}
+	p.filling++
+	p.seq++
+	return fmt.Sprintf("%s%d", poolVMPrefix, p.seq)
+}
+
+// doneFilling releases the slot taken by startFilling, adding v to the pool
+// if it was created.
+func (p *vmPool) doneFilling(v *vm) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.filling--
+	if v != nil {
+		p.ready = append(p.ready, v)
+	}
+}
+
+// fillPool keeps the pool at its size, within max_vms, until DrainPool is
+// called.
+func (s *Server) fillPool() {
+	defer s.pool.filler.Done()
+	for {
+		failed := false
+		for s.config.MaxVMs == 0 || s.vmCount() < s.config.MaxVMs {
+			name := s.pool.startFilling()
+			if name == "" {
+				break
+			}
+			v, err := s.createPooledVM(s.pool.ctx, name)
+			s.pool.doneFilling(v)
+			if s.pool.ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.WithField("vmName", name).WithError(err).Warn("failed to create pooled VM")
+				failed = true
+				break
+			}
+		}
+
+		var retry <-chan time.Time
+		if failed || s.config.MaxVMs > 0 {
+			retry = time.After(poolRetryInterval)
+		}
+		select {
+		case <-s.pool.ctx.Done():
+			return
+		case <-s.pool.refill:
+		case <-retry:
+		}
+	}
+}
+
+// createPooledVM creates and boots a VM for the pool, waiting for its agents
+// so a claim doesn't have to.
+func (s *Server) createPooledVM(ctx context.Context, name string) (*vm, error) {
+	logger := log.WithField("vmName", name)
+	start := time.Now()
+
+	pooled, err := s.createVM(ctx, name, s.config.KernelPath, s.config.InitramfsPath, s.config.RootfsPath, &serverapi.StartVMRequest{
+		VmName: serverapi.PtrString(name),
+	}, "")
+	if err != nil {
+		return nil, err
+	}
+	err = pooled.boot(ctx)
+	if err == nil {
+		err = waitForCmdServerReady(ctx, pooled.ip.IP.String(), pooled.readyTimeout)
+	}
+	if err == nil {
+		pooled.refreshAgentVersions(ctx)
+		err = pooled.requireAgentFeature(ctx, agentVsockServer, featureVMName)
+		var unsupportedErr *UnsupportedAgentError
+		if errors.As(err, &unsupportedErr) {
+			logger.WithError(err).Error("guest image can't be renamed, disabling the VM pool")
+			s.pool.lock.Lock()
+			s.pool.unsupported = true
+			s.pool.lock.Unlock()
+		}
+	}
+	if err != nil {
+		s.discardVM(pooled)
+		return nil, err
+	}
+
+	logger.WithField("elapsed", time.Since(start)).Info("pooled VM ready")
+	return pooled, nil
+}
+
+// discardVM destroys a VM that isn't in Server.vms, like one in the pool or
+// just taken from it.
+func (s *Server) discardVM(v *vm) {
+	logger := log.WithField("vmName", v.name)
+	logger.Info("discarding pooled VM")
+	if err := v.destroy(context.Background()); err != nil {
+		logger.WithError(err).Warn("failed to destroy pooled VM")
+	}
+	removePidRecords(s.config.StateDir, v.name, v.process.Pid)
+	s.disposeStateDir(v)
+	if err := s.network.Release(v.name); err != nil {
+		logger.WithError(err).Warn("failed to release network attachment")
+	}
+}
+
+// DrainPool stops the pool from filling and destroys the VMs in it, e.g. on
+// shutdown.
+func (s *Server) DrainPool() {
+	if s.pool == nil {
+		return
+	}
+	s.pool.cancel()
+	s.pool.filler.Wait()
+	for v := s.pool.take(); v != nil; v = s.pool.take() {
+		s.discardVM(v)
+	}
+}
+
+// vmCount returns the number of VMs, pooled ones included, as limited by
+// max_vms.
+func (s *Server) vmCount() int {
+	s.lock.RLock()
+	count := len(s.vms)
+	s.lock.RUnlock()
+	return count + s.pool.len()
+}
+
+// checkMaxVMs fails with an AllocatorExhaustedError if no VM can be added
+// under max_vms.
+func (s *Server) checkMaxVMs() error {
+	if s.config.MaxVMs > 0 && s.vmCount() >= s.config.MaxVMs {
+		return &AllocatorExhaustedError{Allocator: AllocatorVMs, Capacity: s.config.MaxVMs}
+	}
+	return nil
+}
+
+// poolServes reports whether a start request can be served by a pooled VM,
+// which was created with the server's defaults.
+func (s *Server) poolServes(req *serverapi.StartVMRequest, statefulDiskSource string) bool {
+	matchesDefault := func(value string, def string) bool {
+		return value == "" || value == def
+	}
+	return s.pool != nil &&
+		statefulDiskSource == "" &&
+		matchesDefault(req.GetKernel(), s.config.KernelPath) &&
+		matchesDefault(req.GetInitramfs(), s.config.InitramfsPath) &&
+		matchesDefault(req.GetRootfs(), s.config.RootfsPath) &&
+		req.GetTapDevice() == "" &&
+		req.GetIp() == "" &&
+		req.GetExternalIp() == "" &&
+		len(req.GetCpuAffinity()) == 0 &&
+		!req.HasNumaNode() &&
+		len(req.GetDisks()) == 0 &&
+		len(req.GetSharedDirs()) == 0 &&
+		!req.HasMetadata() &&
+		req.GetExtraKernelArgs() == "" &&
+		req.GetProfile() == "" &&
+		(!req.HasRootfsOverlay() || req.GetRootfsOverlay() == s.config.RootfsOverlay) &&
+		!req.HasStatefulSizeMb() &&
+		!req.GetPreserveStatefulDisk() &&
+		s.preservedDisk(req.GetVmName()) == ""
+}
+
+// claimPooledVM takes a VM from the pool and renames it for req, returning
+// nil if the pool can't serve req. Pooled VMs that fail to be claimed are
+// discarded and the next one is tried.
+func (s *Server) claimPooledVM(ctx context.Context, req *serverapi.StartVMRequest, statefulDiskSource string) *vm {
+	if !s.poolServes(req, statefulDiskSource) {
+		return nil
+	}
+	for {
+		pooled := s.pool.take()
+		if pooled == nil {
+			return nil
+		}
+		s.pool.wake()
+
+		logger := log.WithFields(log.Fields{"vmName": req.GetVmName(), "pooledVM": pooled.name})
+		if err := s.renamePooledVM(ctx, pooled, req); err != nil {
+			logger.WithError(err).Warn("failed to claim pooled VM")
+			s.discardVM(pooled)
+			continue
+		}
+		logger.Info("claimed pooled VM")
+		return pooled
+	}
+}
+
+// renamePooledVM gives a pooled VM the name and labels of req. Its state dir
+// is renamed; the VMM keeps using the paths it was started with, so a
+// symlink is left at the old one until the VM is destroyed.
+func (s *Server) renamePooledVM(ctx context.Context, v *vm, req *serverapi.StartVMRequest) error {
+	vmName := req.GetVmName()
+	if reason := v.crashReason(); reason != "" {
+		return fmt.Errorf("pooled VM is down: %s", reason)
+	}
+	// Renamed in the guest first, as the VM is thrown away if anything
+	// fails and the guest name only matters for callbacks.
+	if _, err := v.vsockCommand(ctx, "VM_NAME "+vmName); err != nil {
+		return fmt.Errorf("failed to rename VM in the guest: %w", err)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	oldDir := v.stateDirPath
+	newDir := getVmStateDirPath(s.config.StateDir, vmName)
+	if err := s.network.Rename(v.name, vmName); err != nil {
+		return err
+	}
+	v.name = vmName
+	// The listeners' sockets are removed from the old dir, and made again
+	// in the new one for vmName.
+	v.callbackListener.Close()
+	v.artifactListener.Close()
+	if err := os.Rename(oldDir, newDir); err != nil {
+		return fmt.Errorf("failed to rename state dir: %w", err)
+	}
+	rebase := func(p string) string {
+		if p == "" {
+			return ""
+		}
+		return path.Join(newDir, strings.TrimPrefix(p, oldDir+"/"))
+	}
+	v.stateDirPath = newDir
+	v.stateDirLink = oldDir
+	v.apiSocketPath = rebase(v.apiSocketPath)
+	v.apiClient = createApiClient(v.apiSocketPath)
+	v.vsockPath = rebase(v.vsockPath)
+	v.statefulDiskPath = rebase(v.statefulDiskPath)
+	v.serialSocketPath = rebase(v.serialSocketPath)
+	v.labels = maps.Clone(req.GetLabels())
+	if err := os.Symlink(vmName, oldDir); err != nil {
+		return fmt.Errorf("failed to link old state dir: %w", err)
+	}
+
+	var err error
+	if v.callbackListener, err = s.listenVsockCallbacks(vmName, v.vsockPath); err != nil {
+		return err
+	}
+	if v.artifactListener, err = s.listenArtifacts(vmName, v.vsockPath, newDir); err != nil {
+		return err
+	}
+	if err := writePidRecords(s.config.StateDir, vmName, v.process.Pid); err != nil {
+		return err
+	}
+	return v.saveRecord()
+}
+
+// syncGuestName tells the guest of a VM claimed from the pool its name
+// again, as it goes back to the name it was booted with when rebooted.
+func (v *vm) syncGuestName(ctx context.Context) error {
+	v.lock.RLock()
+	bootName, name := v.bootName, v.name
+	v.lock.RUnlock()
+	if bootName == name {
+		return nil
+	}
+	_, err := v.vsockCommand(ctx, "VM_NAME "+name)
+	return err
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// preservedDirName is the dir in the state dir holding the stateful disks
+// of destroyed VMs started with preserveStatefulDisk, one per VM name.
+const preservedDirName = "_preserved"
+
+func (s *Server) preservedDiskPath(vmName string) string {
+	return path.Join(s.config.StateDir, preservedDirName, vmName+".img")
+}
+
+// preservedDisk returns the path of the stateful disk preserved for vmName,
+// or "" if there is none.
+func (s *Server) preservedDisk(vmName string) string {
+	diskPath := s.preservedDiskPath(vmName)
+	if _, err := os.Stat(diskPath); err != nil {
+		return ""
+	}
+	return diskPath
+}
+
+// preserveStatefulDisk moves a destroyed VM's stateful disk out of its state
+// dir, for the next VM of the same name to reattach.
+func (s *Server) preserveStatefulDisk(v *vm) error {
+	diskPath := s.preservedDiskPath(v.name)
+	if err := os.MkdirAll(path.Dir(diskPath), 0755); err != nil {
+		return fmt.Errorf("failed to create preserved disks dir: %w", err)
+	}
+	if err := os.Rename(v.statefulDiskPath, diskPath); err != nil {
+		return fmt.Errorf("failed to preserve stateful disk: %w", err)
+	}
+	log.WithFields(log.Fields{
+		"vmName": v.name,
+		"path":   diskPath,
+	}).Info("Preserved stateful disk")
+	return nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+// lookupProfile returns the image profile a start request selects, the zero
+// profile if it selects none.
+func (s *Server) lookupProfile(name string) (config.Profile, error) {
+	if name == "" {
+		return config.Profile{}, nil
+	}
+	// Config keys, and so profile names, are lowercased when loaded.
+	profile, ok := s.config.Profiles[strings.ToLower(name)]
+	if !ok {
+		available := "none"
+		if len(s.config.Profiles) > 0 {
+			available = strings.Join(slices.Sorted(maps.Keys(s.config.Profiles)), ", ")
+		}
+		return config.Profile{}, status.Error(codes.InvalidArgument, fmt.Sprintf("unknown profile %q, available profiles: %s", name, available))
+	}
+	return profile, nil
+}
+
+// ListProfiles returns the configured image profiles, sorted by name.
+func (s *Server) ListProfiles() *serverapi.ListProfilesResponse {
+	resp := &serverapi.ListProfilesResponse{
+		Profiles: []serverapi.Profile{},
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.config.Profiles)) {
+		profile := s.config.Profiles[name]
+		resp.Profiles = append(resp.Profiles, serverapi.Profile{
+			Name:                 serverapi.PtrString(name),
+			Kernel:               serverapi.PtrString(profile.Kernel),
+			Initramfs:            serverapi.PtrString(profile.Initramfs),
+			Rootfs:               serverapi.PtrString(profile.Rootfs),
+			DefaultMemPercentage: serverapi.PtrInt32(profile.DefaultMemPercentage),
+			DefaultVcpus:         serverapi.PtrInt32(profile.DefaultVcpus),
+		})
+	}
+	return resp
+}
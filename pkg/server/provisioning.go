@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+const (
+	provisioningStepUploadFile  = "uploadFile"
+	provisioningStepRunCommand  = "runCommand"
+	provisioningStepWaitForPort = "waitForPort"
+
+	defaultProvisioningStepTimeout = 60 * time.Second
+	defaultProvisioningRetryDelay  = 1 * time.Second
+	waitForPortRetryDelay          = 100 * time.Millisecond
+)
+
+// shellQuote quotes s for safe use as a single bash word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// provisionVM runs the provisioning steps in order and returns a report. It
+// stops at the first failed step that isn't optional; later steps are reported
+// as skipped.
+func (s *Server) provisionVM(ctx context.Context, vm *vm, steps []serverapi.ProvisioningStep) *serverapi.ProvisioningReport {
+	logger := log.WithField("vmName", vm.name)
+	report := &serverapi.ProvisioningReport{
+		Success: serverapi.PtrBool(true),
+	}
+
+	failed := false
+	for i, step := range steps {
+		result := serverapi.ProvisioningStepResult{
+			Index: serverapi.PtrInt32(int32(i)),
+			Type:  serverapi.PtrString(step.GetType()),
+			Name:  serverapi.PtrString(step.GetName()),
+		}
+		if failed {
+			result.Success = serverapi.PtrBool(false)
+			result.Skipped = serverapi.PtrBool(true)
+			report.Steps = append(report.Steps, result)
+			continue
+		}
+
+		stepLogger := logger.WithFields(log.Fields{
+			"step": i,
+			"type": step.GetType(),
+			"name": step.GetName(),
+		})
+		stepLogger.Info("running provisioning step")
+
+		startTime := time.Now()
+		attempts, output, err := s.runProvisioningStep(ctx, vm, step)
+		result.Attempts = serverapi.PtrInt32(int32(attempts))
+		result.Output = serverapi.PtrString(output)
+		result.DurationMs = serverapi.PtrInt64(time.Since(startTime).Milliseconds())
+		result.Success = serverapi.PtrBool(err == nil)
+		if err != nil {
+			result.Error = serverapi.PtrString(err.Error())
+			if step.GetOptional() {
+				stepLogger.WithError(err).Warn("optional provisioning step failed")
+			} else {
+				stepLogger.WithError(err).Error("provisioning step failed")
+				failed = true
+				report.Success = serverapi.PtrBool(false)
+			}
+		}
+		report.Steps = append(report.Steps, result)
+	}
+	return report
+}
+
+// runProvisioningStep runs a single step within its timeout and returns the
+// number of attempts made and the guest output of the last attempt.
+func (s *Server) runProvisioningStep(ctx context.Context, vm *vm, step serverapi.ProvisioningStep) (int, string, error) {
+	timeout := defaultProvisioningStepTimeout
+	if step.GetTimeoutSeconds() > 0 {
+		timeout = time.Duration(step.GetTimeoutSeconds()) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch step.GetType() {
+	case provisioningStepUploadFile:
+		output, err := s.provisionUploadFile(ctx, vm, step)
+		return 1, output, err
+	case provisioningStepRunCommand:
+		return s.provisionRunCommand(ctx, vm, step)
+	case provisioningStepWaitForPort:
+		attempts, err := provisionWaitForPort(ctx, vm, step.GetPort())
+		return attempts, "", err
+	default:
+		return 0, "", fmt.Errorf("unknown provisioning step type: %q", step.GetType())
+	}
+}
+
+// provisionExec runs cmd in the guest via the cmdserver and treats a non-empty
+// error from the guest as a failure.
+func provisionExec(ctx context.Context, vm *vm, cmd string) (string, error) {
+	client := &http.Client{}
+	url := "http://" + cmdServerAddr(vm.ip.IP.String())
+	resp, err := vm.handleExec(ctx, client, url, cmdserver.RunCmdRequest{Cmd: cmd, Blocking: true})
+	if err != nil {
+		return "", err
+	}
+	if resp.GetError() != "" {
+		return resp.GetOutput(), fmt.Errorf("command failed: %s", resp.GetError())
+	}
+	return resp.GetOutput(), nil
+}
+
+func (s *Server) provisionUploadFile(ctx context.Context, vm *vm, step serverapi.ProvisioningStep) (string, error) {
+	dst := step.GetPath()
+	if dst == "" {
+		return "", fmt.Errorf("path is required for %s", provisioningStepUploadFile)
+	}
+	if _, err := base64.StdEncoding.DecodeString(step.GetContent()); err != nil {
+		return "", fmt.Errorf("content must be base64 encoded: %w", err)
+	}
+
+	cmd := fmt.Sprintf(
+		"mkdir -p %s && printf '%%s' %s | base64 -d > %s",
+		shellQuote(path.Dir(dst)),
+		shellQuote(step.GetContent()),
+		shellQuote(dst),
+	)
+	if mode := step.GetMode(); mode != "" {
+		if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+			return "", fmt.Errorf("invalid file mode %q: %w", mode, err)
+		}
+		cmd += fmt.Sprintf(" && chmod %s %s", mode, shellQuote(dst))
+	}
+	return provisionExec(ctx, vm, cmd)
+}
+
+func (s *Server) provisionRunCommand(ctx context.Context, vm *vm, step serverapi.ProvisioningStep) (int, string, error) {
+	if step.GetCmd() == "" {
+		return 0, "", fmt.Errorf("cmd is required for %s", provisioningStepRunCommand)
+	}
+	retryDelay := defaultProvisioningRetryDelay
+	if step.GetRetryDelayMs() > 0 {
+		retryDelay = time.Duration(step.GetRetryDelayMs()) * time.Millisecond
+	}
+
+	attempts := 0
+	for {
+		attempts++
+		output, err := provisionExec(ctx, vm, step.GetCmd())
+		if err == nil {
+			return attempts, output, nil
+		}
+		if attempts > int(step.GetRetries()) {
+			return attempts, output, err
+		}
+		select {
+		case <-ctx.Done():
+			return attempts, output, fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// provisionWaitForPort polls until the guest accepts TCP connections on port.
+func provisionWaitForPort(ctx context.Context, vm *vm, port int32) (int, error) {
+	if port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port for %s: %d", provisioningStepWaitForPort, port)
+	}
+
+	addr := net.JoinHostPort(vm.ip.IP.String(), strconv.Itoa(int(port)))
+	dialer := &net.Dialer{Timeout: 1 * time.Second}
+	attempts := 0
+	for {
+		attempts++
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			conn.Close()
+			return attempts, nil
+		}
+		select {
+		case <-ctx.Done():
+			return attempts, fmt.Errorf("timeout waiting for port %d: %w", port, err)
+		case <-time.After(waitForPortRetryDelay):
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	proxyDialTimeout = 10 * time.Second
+	// ProxyPortLabelPrefix followed by a port, set to "true" on a VM, allows
+	// proxying to that port of the VM in addition to proxy_allowed_ports.
+	ProxyPortLabelPrefix = "cbox/proxy-port-"
+)
+
+// proxyStats counts a VM's proxied connections and the bytes they carried.
+type proxyStats struct {
+	active         atomic.Int32
+	bytesToGuest   atomic.Uint64
+	bytesFromGuest atomic.Uint64
+}
+
+// ProxyConn is a vsock connection to a guest port that a client connection
+// can be piped to.
+type ProxyConn struct {
+	vmName      string
+	port        uint32
+	guest       net.Conn
+	stats       *proxyStats
+	idleTimeout time.Duration
+	// lastActivity is the UnixNano time bytes last moved in either direction.
+	lastActivity atomic.Int64
+	closeOnce    sync.Once
+}
+
+// proxyPortAllowed reports whether port of vm may be proxied to, as it's in
+// proxy_allowed_ports or allowed by the VM's labels.
+func (s *Server) proxyPortAllowed(vm *vm, port uint32) bool {
+	return slices.Contains(s.config.ProxyAllowedPorts, port) ||
+		vm.labels[ProxyPortLabelPrefix+strconv.FormatUint(uint64(port), 10)] == "true"
+}
+
+// DialProxy connects to port in the guest over vsock. The port must be in
+// proxy_allowed_ports or allowed by a cbox/proxy-port-<port> label of the VM,
+// and the VM must have fewer than max_proxies_per_vm proxied connections
+// open.
+func (s *Server) DialProxy(ctx context.Context, vmName string, port uint32) (*ProxyConn, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if !s.proxyPortAllowed(vm, port) {
+		return nil, status.Error(codes.PermissionDenied, fmt.Sprintf("port %d is not in proxy_allowed_ports or allowed by the labels of vm %s", port, vmName))
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return nil, err
+	}
+
+	maxProxies := s.config.MaxProxiesPerVM
+	if int(vm.proxyStats.active.Add(1)) > maxProxies {
+		vm.proxyStats.active.Add(-1)
+		return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("vm %s already has %d proxied connections", vmName, maxProxies))
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, proxyDialTimeout)
+	defer cancel()
+	guest, err := dialGuestVsock(dialCtx, vm.vsockPath, port)
+	if err != nil {
+		vm.proxyStats.active.Add(-1)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	idleTimeout := s.config.ProxyIdleTimeout
+	return &ProxyConn{
+		vmName:      vmName,
+		port:        port,
+		guest:       guest,
+		stats:       &vm.proxyStats,
+		idleTimeout: idleTimeout,
+	}, nil
+}
+
+// copy copies src to dst until either side fails or the connection is idle
+// in both directions for longer than the idle timeout. Bytes are added to
+// counter as they are copied, and the total is returned.
+func (p *ProxyConn) copy(dst net.Conn, src net.Conn, counter *atomic.Uint64) uint64 {
+	var total uint64
+	buf := make([]byte, 32*1024)
+	for {
+		src.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return total
+			}
+			total += uint64(n)
+			counter.Add(uint64(n))
+			p.lastActivity.Store(time.Now().UnixNano())
+		}
+		if err != nil {
+			// Keep waiting while the other direction is still active.
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, p.lastActivity.Load())) < p.idleTimeout {
+				continue
+			}
+			return total
+		}
+	}
+}
+
+// Pipe copies bytes between client and the guest until either side closes or
+// the connection goes idle, then closes both. initial is written to the guest
+// first, for data the client sent before the connection was handed over.
+func (p *ProxyConn) Pipe(client net.Conn, initial []byte) {
+	defer client.Close()
+	defer p.Close()
+
+	logger := log.WithFields(log.Fields{"vmName": p.vmName, "port": p.port})
+	logger.Info("proxy connection opened")
+
+	if len(initial) > 0 {
+		if _, err := p.guest.Write(initial); err != nil {
+			logger.WithError(err).Warn("failed to forward buffered client data")
+			return
+		}
+		p.stats.bytesToGuest.Add(uint64(len(initial)))
+	}
+
+	p.lastActivity.Store(time.Now().UnixNano())
+	var toGuest, fromGuest uint64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		toGuest = p.copy(p.guest, client, &p.stats.bytesToGuest)
+		// Unblock the other direction.
+		p.guest.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		fromGuest = p.copy(client, p.guest, &p.stats.bytesFromGuest)
+		client.Close()
+	}()
+	wg.Wait()
+
+	logger.WithFields(log.Fields{
+		"bytesToGuest":   toGuest,
+		"bytesFromGuest": fromGuest,
+	}).Info("proxy connection closed")
+}
+
+// Close closes the guest connection and releases the VM's proxy slot.
+func (p *ProxyConn) Close() {
+	p.closeOnce.Do(func() {
+		p.guest.Close()
+		p.stats.active.Add(-1)
+	})
+}
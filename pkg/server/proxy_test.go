@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+// holdOpen keeps proxied connections open until the proxy closes them.
+func holdOpen(port uint32, conn net.Conn) {
+	conn.Read(make([]byte, 1))
+}
+
+func TestDialProxyAllowlist(t *testing.T) {
+	h := newTestHarness(t, func(cfg *config.ServerConfig) { cfg.ProxyAllowedPorts = []uint32{22} })
+	h.startVM("plain")
+	if _, err := h.server.StartVM(context.Background(), &serverapi.StartVMRequest{
+		VmName: serverapi.PtrString("labeled"),
+		Labels: &map[string]string{ProxyPortLabelPrefix + "5432": "true", ProxyPortLabelPrefix + "6379": "false"},
+	}); err != nil {
+		t.Fatalf("StartVM: %v", err)
+	}
+	serveGuestVsock(t, h.server.getVMAtomic("plain").vsockPath, holdOpen)
+	serveGuestVsock(t, h.server.getVMAtomic("labeled").vsockPath, holdOpen)
+
+	for _, tc := range []struct {
+		vmName string
+		port   uint32
+		want   codes.Code
+	}{
+		{"plain", 22, codes.OK},
+		{"plain", 5432, codes.PermissionDenied},
+		{"labeled", 22, codes.OK},
+		{"labeled", 5432, codes.OK},
+		{"labeled", 6379, codes.PermissionDenied},
+		{"missing", 22, codes.NotFound},
+	} {
+		conn, err := h.server.DialProxy(context.Background(), tc.vmName, tc.port)
+		if status.Code(err) != tc.want {
+			t.Errorf("DialProxy(%s, %d) = %v, want %s", tc.vmName, tc.port, err, tc.want)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	// Closed connections gave back their slots.
+	for _, vmName := range []string{"plain", "labeled"} {
+		if active := h.server.getVMAtomic(vmName).proxyStats.active.Load(); active != 0 {
+			t.Errorf("%s has %d proxied connections open, want 0", vmName, active)
+		}
+	}
+}
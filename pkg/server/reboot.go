@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+const (
+	opReboot = "reboot"
+	// rebootTimeout bounds a reboot, including waiting for in-flight guest
+	// traffic to drain and for cmdserver to come back.
+	rebootTimeout = 2 * time.Minute
+)
+
+// RebootVM reboots a running VM's guest and waits for its cmdserver to be
+// reachable again. The VM is REBOOTING meanwhile. Host-side state, such as
+// its IP and callback session, is kept.
+func (s *Server) RebootVM(ctx context.Context, vmName string) error {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rebootTimeout)
+	defer cancel()
+	release, err := vm.gate.acquireExclusive(ctx, vmName, opReboot, rebootTimeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// vm.lock isn't held throughout, so ListVM shows the VM as REBOOTING.
+	vm.lock.Lock()
+	prevStatus := vm.status
+	if prevStatus != vmStatusRunning && prevStatus != vmStatusFailedProvisioning {
+		vm.lock.Unlock()
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("cannot %s vm %s: vm is %s", opReboot, vmName, prevStatus))
+	}
+	vm.status = vmStatusRebooting
+	vm.lock.Unlock()
+
+	logger := log.WithField("vmName", vmName)
+	logger.Info("Rebooting VM")
+	err = vm.reboot(ctx)
+	// Whatever happened, the guest is up again or as good as it gets; a
+	// failed provisioning still applies to it.
+	vm.lock.Lock()
+	vm.status = prevStatus
+	vm.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Successfully rebooted VM")
+	s.events.Publish(events.TypeVMRebooted, vmName, nil)
+	return nil
+}
+
+// reboot reboots the guest through the VMM's API and waits for its
+// cmdserver. It leaves the VM's status alone.
+func (v *vm) reboot(ctx context.Context) error {
+	resp, err := v.apiClient.DefaultAPI.RebootVM(ctx).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to reboot VM: %w", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed to reboot VM. bad status: %v", resp)
+	}
+	if err := waitForCmdServerReady(ctx, v.ip.IP.String(), v.readyTimeout); err != nil {
+		return fmt.Errorf("vm rebooted but cmd server is not ready: %w", err)
+	}
+	// The guest may have come back with different agents.
+	v.refreshAgentVersions(ctx)
+	if err := v.syncGuestName(ctx); err != nil {
+		log.WithField("vmName", v.name).WithError(err).Warn("failed to send the VM name to the guest")
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/replay"
+)
+
+const (
+	recordingsDirName = "recordings"
+	// RecordLabel set to "true" on a VM records every exec into it.
+	RecordLabel = "cbox/record"
+
+	recordingRedacted = "<redacted>"
+)
+
+type recordingKey struct{}
+
+// WithRecording returns a context under which execs are recorded regardless
+// of the VM's labels.
+func WithRecording(ctx context.Context) context.Context {
+	return context.WithValue(ctx, recordingKey{}, true)
+}
+
+func recordingFilename(seq int) string {
+	return fmt.Sprintf("%06d.json", seq)
+}
+
+func recordingsDir(vmStateDir string) string {
+	return path.Join(vmStateDir, recordingsDirName)
+}
+
+// compileRedactPatterns compiles recording_redact_patterns.
+func compileRedactPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recording redact pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// execTransport returns the transport for requests to vm's cmdserver made
+// under ctx: a recording one if ctx or the VM's labels ask for it, nil for
+// the default transport otherwise.
+func (s *Server) execTransport(ctx context.Context, vm *vm) http.RoundTripper {
+	if ctx.Value(recordingKey{}) == nil && vm.labels[RecordLabel] != "true" {
+		return nil
+	}
+	return &recordingTransport{s: s, vm: vm, base: http.DefaultTransport}
+}
+
+// recordingTransport saves every exchange it carries as a recording.
+type recordingTransport struct {
+	s    *Server
+	vm   *vm
+	base http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	rec := &replay.Recording{
+		VMName:     t.vm.name,
+		RecordedAt: time.Now().UTC(),
+		Transport:  replay.TransportHTTP,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Request:    reqBody,
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		var body []byte
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		rec.StatusCode = resp.StatusCode
+		if json.Valid(body) {
+			rec.Response = body
+			rec.Truncated = outputTruncated(body)
+		} else {
+			rec.ResponseText = string(body)
+		}
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	rec.DurationMs = time.Since(rec.RecordedAt).Milliseconds()
+
+	if saveErr := t.s.saveRecording(t.vm, rec); saveErr != nil {
+		log.WithField("vmName", t.vm.name).WithError(saveErr).Warn("failed to save exec recording")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// outputTruncated reports whether a cmdserver response says any output was
+// truncated.
+func outputTruncated(body []byte) bool {
+	var resp struct {
+		Results []struct {
+			Truncated bool `json:"truncated"`
+		} `json:"results"`
+	}
+	json.Unmarshal(body, &resp)
+	for _, result := range resp.Results {
+		if result.Truncated {
+			return true
+		}
+	}
+	return false
+}
+
+// redact applies recording_redact_patterns to the strings in a JSON
+// document, reporting whether anything matched.
+func (s *Server) redact(doc json.RawMessage) (json.RawMessage, bool) {
+	if len(s.redactPatterns) == 0 || len(doc) == 0 {
+		return doc, false
+	}
+	var v any
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return doc, false
+	}
+	changed := false
+	var walk func(v any) any
+	walk = func(v any) any {
+		switch v := v.(type) {
+		case string:
+			for _, re := range s.redactPatterns {
+				if re.MatchString(v) {
+					v = re.ReplaceAllString(v, recordingRedacted)
+					changed = true
+				}
+			}
+			return v
+		case []any:
+			for i := range v {
+				v[i] = walk(v[i])
+			}
+		case map[string]any:
+			for key := range v {
+				v[key] = walk(v[key])
+			}
+		}
+		return v
+	}
+	v = walk(v)
+	if !changed {
+		return doc, false
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return doc, false
+	}
+	return out, true
+}
+
+// saveRecording redacts rec and writes it as the VM's next recording, then
+// evicts the oldest recordings beyond recording_max_count or
+// recording_max_size_in_mb.
+func (s *Server) saveRecording(vm *vm, rec *replay.Recording) error {
+	var reqRedacted, respRedacted bool
+	rec.Request, reqRedacted = s.redact(rec.Request)
+	rec.Response, respRedacted = s.redact(rec.Response)
+	for _, re := range s.redactPatterns {
+		if re.MatchString(rec.ResponseText) {
+			rec.ResponseText = re.ReplaceAllString(rec.ResponseText, recordingRedacted)
+			respRedacted = true
+		}
+	}
+	rec.Redacted = reqRedacted || respRedacted
+
+	vm.recordingLock.Lock()
+	defer vm.recordingLock.Unlock()
+
+	dir := recordingsDir(vm.stateDirPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create recordings dir: %w", err)
+	}
+	vm.recordingSeq++
+	rec.Seq = vm.recordingSeq
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path.Join(dir, recordingFilename(rec.Seq)), data, 0644); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	maxBytes := s.config.RecordingMaxSizeInMB * 1024 * 1024
+	var total int64
+	sizes := make([]int64, len(entries))
+	for i, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	// ReadDir sorts by name, which is oldest first. The newest recording is
+	// always kept.
+	for i := 0; i < len(entries)-1 && (len(entries)-i > s.config.RecordingMaxCount || total > maxBytes); i++ {
+		if err := os.Remove(path.Join(dir, entries[i].Name())); err != nil {
+			return fmt.Errorf("failed to evict recording: %w", err)
+		}
+		total -= sizes[i]
+	}
+	return nil
+}
+
+// vmStateDirFor returns the state dir of a running VM, or of its most recent
+// archive if it was destroyed.
+func (s *Server) vmStateDirFor(vmName string) (dir string, archived bool, err error) {
+	if vm := s.getVMAtomic(vmName); vm != nil {
+		return vm.stateDirPath, false, nil
+	}
+	match, err := s.findArchive(vmName)
+	if err != nil {
+		return "", false, err
+	}
+	return path.Join(s.archiveDir(), match.name), true, nil
+}
+
+// ListRecordings returns the exec recordings of a VM, oldest first.
+// Recordings of a destroyed VM are listed from its archive.
+func (s *Server) ListRecordings(vmName string) (*serverapi.ListRecordingsResponse, error) {
+	stateDir, archived, err := s.vmStateDirFor(vmName)
+	if err != nil {
+		return nil, err
+	}
+	dir := recordingsDir(stateDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read recordings dir: %w", err)
+	}
+
+	resp := &serverapi.ListRecordingsResponse{
+		Recordings: []serverapi.RecordingSummary{},
+		Archived:   serverapi.PtrBool(archived),
+	}
+	for _, entry := range entries {
+		rec, err := replay.Load(path.Join(dir, entry.Name()))
+		if err != nil {
+			// Evicted since ReadDir, or being written.
+			continue
+		}
+		summary := serverapi.RecordingSummary{
+			Seq:        serverapi.PtrInt32(int32(rec.Seq)),
+			RecordedAt: serverapi.PtrTime(rec.RecordedAt),
+			Method:     serverapi.PtrString(rec.Method),
+			Path:       serverapi.PtrString(rec.Path),
+			DurationMs: serverapi.PtrInt64(rec.DurationMs),
+			Truncated:  serverapi.PtrBool(rec.Truncated),
+			Redacted:   serverapi.PtrBool(rec.Redacted),
+		}
+		if rec.StatusCode != 0 {
+			summary.StatusCode = serverapi.PtrInt32(int32(rec.StatusCode))
+		}
+		if rec.Error != "" {
+			summary.Error = serverapi.PtrString(rec.Error)
+		}
+		resp.Recordings = append(resp.Recordings, summary)
+	}
+	sort.Slice(resp.Recordings, func(i, j int) bool {
+		return resp.Recordings[i].GetSeq() < resp.Recordings[j].GetSeq()
+	})
+	return resp, nil
+}
+
+// GetRecording returns one of a VM's exec recordings.
+func (s *Server) GetRecording(vmName string, seq string) (*replay.Recording, error) {
+	n, err := strconv.Atoi(seq)
+	if err != nil || n <= 0 || strings.HasPrefix(seq, "0") {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid recording: %q", seq))
+	}
+	stateDir, _, err := s.vmStateDirFor(vmName)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := replay.Load(path.Join(recordingsDir(stateDir), recordingFilename(n)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("recording not found: %d", n))
+		}
+		return nil, fmt.Errorf("failed to load recording: %w", err)
+	}
+	return rec, nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+// recordedSeqs returns the sequence numbers of a VM's recordings.
+func recordedSeqs(t *testing.T, s *Server, vmName string) []int32 {
+	t.Helper()
+	resp, err := s.ListRecordings(vmName)
+	if err != nil {
+		t.Fatalf("ListRecordings: %v", err)
+	}
+	var seqs []int32
+	for _, rec := range resp.Recordings {
+		seqs = append(seqs, rec.GetSeq())
+	}
+	return seqs
+}
+
+func TestExecRecording(t *testing.T) {
+	h := newTestHarness(t, func(cfg *config.ServerConfig) {
+		cfg.RecordingRedactPatterns = []string{`secret-\w+`}
+	})
+	h.startVM("vm1")
+
+	// Not recorded unless asked for.
+	if _, err := h.server.VMExec(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "true"}); err != nil {
+		t.Fatalf("VMExec: %v", err)
+	}
+	if seqs := recordedSeqs(t, h.server, "vm1"); len(seqs) != 0 {
+		t.Errorf("recordings = %v without recording asked for, want none", seqs)
+	}
+
+	if _, err := h.server.VMExec(WithRecording(context.Background()), "vm1", &serverapi.VmExecRequest{Cmd: "echo secret-abc"}); err != nil {
+		t.Fatalf("VMExec: %v", err)
+	}
+	if seqs := recordedSeqs(t, h.server, "vm1"); len(seqs) != 1 || seqs[0] != 1 {
+		t.Fatalf("recordings = %v, want the one exec", seqs)
+	}
+	rec, err := h.server.GetRecording("vm1", "1")
+	if err != nil {
+		t.Fatalf("GetRecording: %v", err)
+	}
+	if rec.VMName != "vm1" || rec.StatusCode != 200 || len(rec.Response) == 0 {
+		t.Errorf("recording = %+v, want vm1's exchange with its response", rec)
+	}
+	if strings.Contains(string(rec.Request), "secret-abc") || strings.Contains(string(rec.Response), "secret-abc") || !rec.Redacted {
+		t.Errorf("recording %s -> %s isn't redacted", rec.Request, rec.Response)
+	}
+
+	for _, seq := range []string{"2", "01", "x", "-1"} {
+		if _, err := h.server.GetRecording("vm1", seq); status.Code(err) == codes.OK {
+			t.Errorf("GetRecording(%s) succeeded", seq)
+		}
+	}
+	if _, err := h.server.ListRecordings("vm2"); status.Code(err) != codes.NotFound {
+		t.Errorf("ListRecordings on a missing VM = %v, want NotFound", err)
+	}
+}
+
+func TestExecRecordingLabelAndEviction(t *testing.T) {
+	h := newTestHarness(t, func(cfg *config.ServerConfig) { cfg.RecordingMaxCount = 2 })
+	if _, err := h.server.StartVM(context.Background(), &serverapi.StartVMRequest{
+		VmName: serverapi.PtrString("vm1"),
+		Labels: &map[string]string{RecordLabel: "true"},
+	}); err != nil {
+		t.Fatalf("StartVM: %v", err)
+	}
+
+	for range 3 {
+		if _, err := h.server.VMExec(context.Background(), "vm1", &serverapi.VmExecRequest{Cmd: "true"}); err != nil {
+			t.Fatalf("VMExec: %v", err)
+		}
+	}
+	if seqs := recordedSeqs(t, h.server, "vm1"); len(seqs) != 2 || seqs[0] != 2 || seqs[1] != 3 {
+		t.Errorf("recordings = %v, want the newest two", seqs)
+	}
+}
@@ -2,21 +2,26 @@ package server
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -27,9 +32,11 @@ import (
 	"github.com/abilashraghuram/cbox/pkg/callback"
 	"github.com/abilashraghuram/cbox/pkg/cmdserver"
 	"github.com/abilashraghuram/cbox/pkg/config"
-	"github.com/abilashraghuram/cbox/pkg/server/cidallocator"
+	"github.com/abilashraghuram/cbox/pkg/events"
+	"github.com/abilashraghuram/cbox/pkg/faults"
+	"github.com/abilashraghuram/cbox/pkg/hostcmd"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
 	"github.com/abilashraghuram/cbox/pkg/server/fountain"
-	"github.com/abilashraghuram/cbox/pkg/server/ipallocator"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"gvisor.dev/gvisor/pkg/cleanup"
@@ -42,6 +49,12 @@ const (
 	vmStatusCreated vmStatus = iota
 	vmStatusRunning
 	vmStatusStopped
+	vmStatusFailedProvisioning
+	// vmStatusCrashed is a VM whose VMM exited or whose guest shut down
+	// without being asked to.
+	vmStatusCrashed
+	vmStatusPaused
+	vmStatusRebooting
 )
 
 func (status vmStatus) String() string {
@@ -52,32 +65,61 @@ func (status vmStatus) String() string {
 		return "RUNNING"
 	case vmStatusStopped:
 		return "STOPPED"
+	case vmStatusFailedProvisioning:
+		return "FAILED_PROVISIONING"
+	case vmStatusCrashed:
+		return "CRASHED"
+	case vmStatusPaused:
+		return "PAUSED"
+	case vmStatusRebooting:
+		return "REBOOTING"
 	default:
 		return "UNKNOWN"
 	}
 }
 
 const (
-	serialPortMode  = "Tty"
 	consolePortMode = "Off"
 
+	serialModePty        = "Pty"
+	serialModeSocket     = "Socket"
+	serialSocketFilename = "serial.sock"
+
 	numNetDeviceQueues      = 2
 	netDeviceQueueSizeBytes = 256
 	netDeviceId             = "_net0"
-	reapVmTimeout           = 20 * time.Second
-
-	cidAllocatorLow  = 3
-	cidAllocatorHigh = 1000
-
-	statefulDiskFilename      = "stateful.img"
-	minGuestMemoryMB          = 1024
-	maxGuestMemoryMB          = 32768
-	defaultGuestMemPercentage = 50
-
-	cmdServerReadyTimeout    = 1 * time.Minute
-	cmdServerReadyRetryDelay = 10 * time.Millisecond
+	// destroyDrainTimeout is how long destroy waits for in-flight exec and
+	// callback requests to the VM.
+	destroyDrainTimeout = 30 * time.Second
+
+	statefulDiskFilename = "stateful.img"
+	minGuestMemoryMB     = 1024
+	maxGuestMemoryMB     = 32768
+
+	// waitForCmdServerReady polls cmdserver every cmdServerReadyRetryDelay
+	// at first, backing off exponentially up to cmdServerReadyMaxRetryDelay.
+	cmdServerReadyRetryDelay    = 10 * time.Millisecond
+	cmdServerReadyMaxRetryDelay = time.Second
+	// maxBootTimeout bounds StartVM's bootTimeoutSeconds.
+	maxBootTimeout = 30 * time.Minute
+
+	// defaultExecTimeout bounds waiting for execs without a timeout; the
+	// command itself keeps running in the guest.
+	defaultExecTimeout = 30 * time.Second
+	maxExecTimeout     = 10 * time.Minute
+	// execTimeoutMargin is how much longer than an exec's own timeout the
+	// host waits, so the guest can kill the command and respond.
+	execTimeoutMargin = 5 * time.Second
+
+	cmdServerPort = "4031"
 )
 
+// cmdServerAddr is the host:port of the command server in the guest with
+// address ip. Tests point it at fake command servers.
+var cmdServerAddr = func(ip string) string {
+	return net.JoinHostPort(ip, cmdServerPort)
+}
+
 func String(s string) *string {
 	return &s
 }
@@ -99,21 +141,118 @@ type vm struct {
 	process          *os.Process
 	ip               *net.IPNet
 	tapDevice        *fountain.TapDevice
+	externalIP       bool // guest IP supplied by the caller, not the allocator
+	staticIP         bool // guest IP requested by the caller from the bridge subnet
 	status           vmStatus
 	vsockPath        string
 	cid              uint32
 	statefulDiskPath string
+	// preserveStatefulDisk keeps the stateful disk when the VM is destroyed.
+	preserveStatefulDisk bool
+	// dataDisks are the disks attached after the stateful disk, at boot or
+	// hot-plugged. Guarded by lock.
+	dataDisks []dataDisk
+	// sharedDirs are the host dirs shared over virtio-fs, each served by a
+	// virtiofsd that lives as long as the VMM.
+	sharedDirs       []sharedDir
+	serialMode       string
+	serialSocketPath string
+	// callbackListener accepts guest callbacks over vsock.
+	callbackListener net.Listener
+	proxyStats       proxyStats
+	// shells counts the VM's open shell sessions.
+	shells atomic.Int32
+	// consoleLock serializes console-exec calls so their output doesn't interleave.
+	consoleLock sync.Mutex
+	// agentRecovery tracks cmdserver restarts after failed execs.
+	agentRecovery agentRecovery
+	// gate keeps guest traffic out while an operation like destroy runs.
+	gate *opGate
+	// execs bounds the execs running at once to max_concurrent_execs_per_vm.
+	execs execLimiter
+	// Boot images, kept so the VM can be turned into a template.
+	kernelPath    string
+	initramfsPath string
+	rootfsPath    string
+	// rootfsOverlay is set when the VM writes its root to a qcow2 overlay
+	// of rootfsPath in its state dir.
+	rootfsOverlay bool
+	// kernelCmdline is the command line the VM booted with.
+	kernelCmdline string
+	// profile is the image profile the VM was started with, if any.
+	profile string
+	// template is the template the VM was instantiated from, if any.
+	template string
+	// cpuAffinity holds the host CPUs each vCPU is pinned to, if pinned.
+	cpuAffinity [][]int
+	// numaNode is the host NUMA node guest memory is allocated from, if set.
+	numaNode *int32
+	// resources is the VM's current vCPU and memory allocation. Guarded by
+	// lock.
+	resources vmResources
+	// artifactListener accepts artifacts published by the guest over vsock.
+	artifactListener net.Listener
+	// artifactLock serializes artifact publishes.
+	artifactLock sync.Mutex
+	// agents holds the guest agents' versions as last reported, keyed by
+	// agent. Guarded by lock.
+	agents map[string]agentVersion
+	// labels are set at creation and never change.
+	labels map[string]string
+	// recordingLock serializes writing exec recordings, numbered from
+	// recordingSeq.
+	recordingLock sync.Mutex
+	recordingSeq  int
+	// lease, if active, restricts exec, proxy and destroy requests to its
+	// holder. It's saved in vm.json. Guarded by lock.
+	lease *vmLease
+	// bootName is the name the VM was booted with, which differs from name
+	// once the VM is claimed from the pool.
+	bootName string
+	// stateDirLink is the state dir of a VM claimed from the pool as it was
+	// named when pooled. It links to stateDirPath, as the VMM still uses it.
+	stateDirLink string
+	// crashMonitor tracks the goroutine watching the booted VM for crashes,
+	// which stops once crashMonitorDone is closed.
+	crashMonitor      sync.WaitGroup
+	crashMonitorDone  chan struct{}
+	crashMonitorStart sync.Once
+	crashMonitorStop  sync.Once
+	// lastHeartbeat is when the guest last sent a heartbeat, reporting
+	// guestStats. Guarded by lock.
+	lastHeartbeat time.Time
+	guestStats    *guestStats
+	// heartbeatMissed is set once vm.heartbeat_missed is published, until
+	// the next heartbeat. Guarded by lock.
+	heartbeatMissed bool
+	// readyTimeout is how long the guest's cmdserver gets to come up after a
+	// boot or reboot, and reapTimeout how long the VMM gets to exit.
+	readyTimeout time.Duration
+	reapTimeout  time.Duration
 }
 
 // Server manages VMs with exec and callback capabilities.
 type Server struct {
 	lock           sync.RWMutex
 	vms            map[string]*vm
-	fountain       *fountain.Fountain
-	ipAllocator    *ipallocator.IPAllocator
-	cidAllocator   *cidallocator.CIDAllocator
+	network        *NetworkManager
 	config         config.ServerConfig
 	sessionManager *callback.SessionManager
+	faults         *faults.Injector
+	events         *events.Bus
+	// redactPatterns are recording_redact_patterns, compiled.
+	redactPatterns []*regexp.Regexp
+	// capabilities are the host binaries found at startup.
+	capabilities []hostCapability
+	operations   *operationStore
+	// pool is nil unless pool_size is set.
+	pool *vmPool
+	// starting holds the names of the VMs being started or restored.
+	// Guarded by lock.
+	starting map[string]*startReservation
+	// reconcile is what NewServer did with the previous run's leftovers.
+	// It doesn't change once NewServer returns.
+	reconcile *serverapi.ReconcileReport
 }
 
 // calculateVCPUCount returns an appropriate number of vCPUs based on host's CPU count.
@@ -134,15 +273,6 @@ func calculateVCPUCount() int32 {
 
 // calculateGuestMemorySizeInMB calculates the appropriate memory size for the guest.
 func calculateGuestMemorySizeInMB(memoryPercentage int32) (int32, error) {
-	if memoryPercentage <= 0 || memoryPercentage > 100 {
-		memoryPercentage = defaultGuestMemPercentage
-		log.Warnf(
-			"Invalid memory percentage provided: %d, using default of %d%%",
-			memoryPercentage,
-			defaultGuestMemPercentage,
-		)
-	}
-
 	var totalMemoryKB int64
 	data, err := os.ReadFile("/proc/meminfo")
 	if err != nil {
@@ -183,21 +313,21 @@ func calculateGuestMemorySizeInMB(memoryPercentage int32) (int32, error) {
 	return int32(suggestedMemoryKB / 1024), nil
 }
 
-func getKernelCmdLine(gatewayIP string, guestIP string, vmName string) string {
+func getKernelCmdLine(gatewayIP string, guestIP string, vmName string, heartbeatInterval time.Duration) string {
 	return fmt.Sprintf(
-		"console=ttyS0 gateway_ip=\"%s\" guest_ip=\"%s\" vm_name=\"%s\"",
+		"console=ttyS0 gateway_ip=\"%s\" guest_ip=\"%s\" vm_name=\"%s\" heartbeat_interval=\"%s\"",
 		gatewayIP,
 		guestIP,
 		vmName,
+		heartbeatInterval,
 	)
 }
 
 // bridgeExists checks if a bridge with the given name exists.
 func bridgeExists(bridgeName string) (bool, error) {
-	cmd := exec.Command("ip", "link", "show", "type", "bridge")
-	output, err := cmd.Output()
+	output, err := hostcmd.Output("ip", "link", "show", "type", "bridge")
 	if err != nil {
-		return false, fmt.Errorf("error executing command: %v", err)
+		return false, err
 	}
 
 	bridges := strings.Split(string(output), "\n")
@@ -209,10 +339,17 @@ func bridgeExists(bridgeName string) (bool, error) {
 	return false, nil
 }
 
+// iptablesLock serializes cleanupAllIPTablesRulesForIP, which deletes rules
+// by the line numbers it lists them with, so concurrent destroys don't delete
+// each other's rules.
+var iptablesLock sync.Mutex
+
 func cleanupAllIPTablesRulesForIP(ip string) error {
+	iptablesLock.Lock()
+	defer iptablesLock.Unlock()
+
 	log.Infof("deleting all iptables rules for IP: %s", ip)
-	cmd := exec.Command("iptables", "-t", "nat", "-L", "PREROUTING", "-n", "--line-numbers")
-	output, err := cmd.Output()
+	output, err := hostcmd.Output("iptables", "-t", "nat", "-L", "PREROUTING", "-n", "--line-numbers")
 	if err != nil {
 		return fmt.Errorf("failed to list iptables rules: %w", err)
 	}
@@ -238,16 +375,14 @@ func cleanupAllIPTablesRulesForIP(ip string) error {
 
 	var finalErr error
 	for _, ruleNum := range ruleNumbers {
-		cmd := exec.Command(
+		if err := hostcmd.Run(
 			"iptables",
 			"-t",
 			"nat",
 			"-D",
 			"PREROUTING",
 			strconv.Itoa(ruleNum),
-		)
-
-		if err := cmd.Run(); err != nil {
+		); err != nil {
 			log.Warnf("error deleting iptables rule %d for IP %s: %v", ruleNum, ip, err)
 			finalErr = errors.Join(
 				finalErr,
@@ -258,15 +393,22 @@ func cleanupAllIPTablesRulesForIP(ip string) error {
 	return finalErr
 }
 
-func cleanupTapDevices() error {
+// cleanupTapDevices deletes the tap devices left attached to bridgeName.
+// Externally-owned tap devices are never attached to the bridge, so they
+// survive.
+func cleanupTapDevices(bridgeName string) error {
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		return fmt.Errorf("failed to list interfaces: %v", err)
 	}
 
 	for _, iface := range interfaces {
+		master, err := os.Readlink(path.Join("/sys/class/net", iface.Name, "master"))
+		if err != nil || path.Base(master) != bridgeName {
+			continue
+		}
 		if strings.HasPrefix(iface.Name, "tap") {
-			if err := exec.Command("ip", "link", "delete", iface.Name).Run(); err != nil {
+			if err := hostcmd.Run("ip", "link", "delete", iface.Name); err != nil {
 				log.Warnf("failed to delete tap device %s: %v", iface.Name, err)
 			}
 			log.Infof("deleted tap device: %s", iface.Name)
@@ -276,12 +418,11 @@ func cleanupTapDevices() error {
 }
 
 func cleanupBridge() error {
-	_, err := exec.Command("ip", "link", "show", "br0").CombinedOutput()
-	if err != nil {
+	if err := hostcmd.Run("ip", "link", "show", "br0"); err != nil {
 		return nil
 	}
 
-	if err := exec.Command("ip", "link", "delete", "br0").Run(); err != nil {
+	if err := hostcmd.Run("ip", "link", "delete", "br0"); err != nil {
 		return fmt.Errorf("failed to delete bridge br0: %v", err)
 	}
 	log.Info("deleted bridge: br0")
@@ -295,9 +436,9 @@ func setupBridgeAndFirewall(
 	bridgeIP string,
 	bridgeSubnet string,
 ) error {
-	output, err := exec.Command("iptables-save").Output()
+	output, err := hostcmd.Output("iptables-save")
 	if err != nil {
-		return fmt.Errorf("failed to run iptables-save: %w", err)
+		return err
 	}
 
 	err = os.WriteFile(backupFile, output, 0644)
@@ -305,11 +446,10 @@ func setupBridgeAndFirewall(
 		return fmt.Errorf("failed to save iptables-save to: %v: %w", backupFile, err)
 	}
 
-	output, err = exec.Command("sh", "-c", "ip r | grep default | awk '{print $5}'").Output()
+	hostDefaultNetworkInterface, err := defaultRouteInterface()
 	if err != nil {
 		return fmt.Errorf("failed to get default network interface: %w", err)
 	}
-	hostDefaultNetworkInterface := strings.TrimSpace(string(output))
 
 	exists, err := bridgeExists(bridgeName)
 	if err != nil {
@@ -321,6 +461,7 @@ func setupBridgeAndFirewall(
 		return nil
 	}
 
+	comment := firewallRuleComment(bridgeSubnet)
 	commands := []struct {
 		name string
 		args []string
@@ -328,22 +469,37 @@ func setupBridgeAndFirewall(
 		{"ip", []string{"l", "add", bridgeName, "type", "bridge"}},
 		{"ip", []string{"l", "set", bridgeName, "up"}},
 		{"ip", []string{"a", "add", bridgeIP, "dev", bridgeName, "scope", "host"}},
-		{"iptables", []string{"-t", "nat", "-A", "POSTROUTING", "-s", bridgeSubnet, "-o", hostDefaultNetworkInterface, "-j", "MASQUERADE"}},
+		{"iptables", []string{"-t", "nat", "-A", "POSTROUTING", "-s", bridgeSubnet, "-o", hostDefaultNetworkInterface, "-m", "comment", "--comment", comment, "-j", "MASQUERADE"}},
 		{"sysctl", []string{"-w", fmt.Sprintf("net.ipv4.conf.%s.forwarding=1", hostDefaultNetworkInterface)}},
 		{"sysctl", []string{"-w", fmt.Sprintf("net.ipv4.conf.%s.forwarding=1", bridgeName)}},
-		{"iptables", []string{"-t", "filter", "-I", "FORWARD", "-s", bridgeSubnet, "-j", "ACCEPT"}},
-		{"iptables", []string{"-t", "filter", "-I", "FORWARD", "-d", bridgeSubnet, "-j", "ACCEPT"}},
+		{"iptables", []string{"-t", "filter", "-I", "FORWARD", "-s", bridgeSubnet, "-m", "comment", "--comment", comment, "-j", "ACCEPT"}},
+		{"iptables", []string{"-t", "filter", "-I", "FORWARD", "-d", bridgeSubnet, "-m", "comment", "--comment", comment, "-j", "ACCEPT"}},
 	}
 
 	for _, cmd := range commands {
-		if err := exec.Command(cmd.name, cmd.args...).Run(); err != nil {
-			return fmt.Errorf("failed to execute command '%s %s': %w", cmd.name, strings.Join(cmd.args, " "), err)
+		if err := hostcmd.Run(cmd.name, cmd.args...); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// defaultRouteInterface returns the interface of the host's default route.
+func defaultRouteInterface() (string, error) {
+	output, err := hostcmd.Output("ip", "route", "show", "default")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(output))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "dev" {
+			return fields[i+1], nil
+		}
+	}
+	return "", fmt.Errorf("no default route")
+}
+
 func getVmStateDirPath(stateDir string, vmName string) string {
 	return path.Join(stateDir, vmName)
 }
@@ -408,6 +564,11 @@ func reapProcess(process *os.Process, logger *log.Entry, timeout time.Duration)
 	go func() {
 		log.Info("waiting for VM process to exit")
 		_, err := process.Wait()
+		// VMMs adopted after a restart aren't our children; their new
+		// parent reaps them, so just wait for them to go.
+		if errors.Is(err, syscall.ECHILD) {
+			err = waitForProcessExit(process.Pid, timeout)
+		}
 		done <- err
 	}()
 
@@ -423,9 +584,25 @@ func reapProcess(process *os.Process, logger *log.Entry, timeout time.Duration)
 	if err != nil {
 		return fmt.Errorf("failed to kill VM process: %v", err)
 	}
+	// SIGKILL is delivered asynchronously; wait for it to land so callers
+	// don't find the VMM still running.
+	<-done
 	return fmt.Errorf("VM process was force killed after timeout")
 }
 
+// waitForProcessExit polls until the process with pid has exited, for
+// processes that can't be waited for.
+func waitForProcessExit(pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !processExited(pid) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("process %d still running", pid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
 // getIPPrefix returns the IP prefix from the given CIDR.
 func getIPPrefix(cidr string) (string, error) {
 	_, ipNet, err := net.ParseCIDR(cidr)
@@ -444,47 +621,81 @@ func getIPPrefix(cidr string) (string, error) {
 	return "", fmt.Errorf("invalid mask size: %d", ones)
 }
 
+// statefulSizeInMB returns the size of a new VM's stateful disk.
+func (s *Server) statefulSizeInMB(startReq *serverapi.StartVMRequest) int32 {
+	if startReq.HasStatefulSizeMb() {
+		return startReq.GetStatefulSizeMb()
+	}
+	return s.config.StatefulSizeInMB
+}
+
 func createStatefulDisk(path string, sizeInMB int32) error {
-	log.Infof("Creating stateful disk at %s with size %dMB", path, sizeInMB)
-	cmd := exec.Command(
+	return createExt4Disk("stateful disk", path, sizeInMB)
+}
+
+// createExt4Disk creates an ext4 formatted image of sizeInMB at path. kind
+// names the disk in logs and errors.
+func createExt4Disk(kind string, path string, sizeInMB int32) error {
+	log.Infof("Creating %s at %s with size %dMB", kind, path, sizeInMB)
+	if err := hostcmd.Run(
 		"truncate",
 		"-s",
 		fmt.Sprintf("%dM", sizeInMB),
 		path,
-	)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to create stateful disk: %w out: %s", err, string(out))
+	); err != nil {
+		return fmt.Errorf("failed to create %s: %w", kind, err)
 	}
 
-	cmd = exec.Command("mkfs.ext4", path)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to format stateful disk with ext4: %w out: %s", err, string(out))
+	if err := hostcmd.Run("mkfs.ext4", path); err != nil {
+		return fmt.Errorf("failed to format %s with ext4: %w", kind, err)
 	}
 	return nil
 }
 
-// NewServer creates a new Server instance.
-func NewServer(config config.ServerConfig, sessionManager *callback.SessionManager) (*Server, error) {
-	if err := cleanupTapDevices(); err != nil {
-		return nil, fmt.Errorf("failed to cleanup tap devices: %w", err)
+// cleanupHostNetworking deletes the bridge, tap devices and firewall rules
+// left by a previous run.
+func cleanupHostNetworking(config config.ServerConfig) error {
+	if err := cleanupTapDevices(config.BridgeName); err != nil {
+		return fmt.Errorf("failed to cleanup tap devices: %w", err)
 	}
 
 	if err := cleanupBridge(); err != nil {
-		return nil, fmt.Errorf("failed to cleanup bridge: %w", err)
+		return fmt.Errorf("failed to cleanup bridge: %w", err)
+	}
+
+	if err := cleanupSubnetFirewallRules(config.BridgeSubnet); err != nil {
+		return fmt.Errorf("failed to cleanup firewall rules: %w", err)
 	}
 
 	ipPrefix, err := getIPPrefix(config.BridgeSubnet)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get IP prefix: %w", err)
+		return fmt.Errorf("failed to get IP prefix: %w", err)
 	}
 
 	log.Infof("Cleaning up iptables rules for IP prefix: %s", ipPrefix)
 	if err := cleanupAllIPTablesRulesForIP(ipPrefix); err != nil {
-		return nil, fmt.Errorf("failed to cleanup iptables rules: %w", err)
+		return fmt.Errorf("failed to cleanup iptables rules: %w", err)
+	}
+	return nil
+}
+
+// setupHostNetworking replaces the bridge, tap devices and firewall rules left
+// by a previous run with fresh ones for config. With keepExisting set, as
+// when VMs of the previous run are being adopted, they're left in place and
+// only what's missing is set up. It returns the bridge subnet migration, if
+// the subnet changed since the previous run.
+func setupHostNetworking(config config.ServerConfig, keepExisting bool) (*serverapi.SubnetMigration, error) {
+	// Runs before anything on the host is touched so a refused subnet change
+	// leaves the previous networking intact.
+	migration, err := checkBridgeSubnet(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bridge subnet: %w", err)
 	}
 
-	if err := os.MkdirAll(config.StateDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create vm state dir: %v err: %w", config.StateDir, err)
+	if keepExisting {
+		log.Info("adopting VMs, keeping host networking of the previous run")
+	} else if err := cleanupHostNetworking(config); err != nil {
+		return nil, err
 	}
 
 	ipBackupFile := fmt.Sprintf("/tmp/iptables-backup-%s.rules", time.Now().Format(time.UnixDate))
@@ -496,26 +707,119 @@ func NewServer(config config.ServerConfig, sessionManager *callback.SessionManag
 	); err != nil {
 		return nil, fmt.Errorf("failed to setup networking on the host: %w", err)
 	}
+	return migration, nil
+}
+
+// NewServer creates a new Server instance.
+func NewServer(config config.ServerConfig, sessionManager *callback.SessionManager) (*Server, error) {
+	// The server relies on config.DefaultServerConfig having filled in
+	// unset values, as config.GetServerConfig does.
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
 
-	ipAllocator, err := ipallocator.NewIPAllocator(config.BridgeSubnet)
+	capabilities, err := probeHostCapabilities(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create ip allocator: %w", err)
+		return nil, err
 	}
 
-	cidAllocator, err := cidallocator.NewCIDAllocator(cidAllocatorLow, cidAllocatorHigh)
+	// Found before host networking is set up, which would otherwise cut
+	// VMs still running from a previous run off the network.
+	leftovers := findLeftoverVMs(config)
+	adopting := slices.ContainsFunc(leftovers, (*leftoverVM).adoptable)
+
+	report := &serverapi.ReconcileReport{}
+	if config.BridgeNetworking() {
+		if report.SubnetMigration, err = setupHostNetworking(config, adopting); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Info("external network mode, leaving host networking alone")
+	}
+
+	if err := os.MkdirAll(config.StateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create vm state dir: %v err: %w", config.StateDir, err)
+	}
+	if err := cleanupStalePidRecords(config.StateDir); err != nil {
+		log.WithError(err).Warn("failed to clean up stale pid records")
+	}
+
+	if config.BridgeNetworking() {
+		if err := saveNetworkState(config.StateDir, &networkState{
+			BridgeName:   config.BridgeName,
+			BridgeIP:     config.BridgeIP,
+			BridgeSubnet: config.BridgeSubnet,
+		}); err != nil {
+			return nil, fmt.Errorf("failed to save network state: %w", err)
+		}
+	}
+
+	bus := events.NewBus()
+	network, err := NewNetworkManager(config, bus)
+	if err != nil {
+		return nil, err
+	}
+	// The previous run's attachments only outlive it along with its host
+	// networking.
+	if adopting {
+		if err := network.Restore(); err != nil {
+			log.WithError(err).Warn("failed to restore network attachments")
+		}
+	} else if err := network.resetRegistry(); err != nil {
+		return nil, err
+	}
+
+	redactPatterns, err := compileRedactPatterns(config.RecordingRedactPatterns)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create CID allocator: %w", err)
+		return nil, err
+	}
+	if err := validateKernelArgs(config.DefaultKernelArgs); err != nil {
+		return nil, fmt.Errorf("invalid default_kernel_args: %w", err)
 	}
 
 	log.Infof("Server config: %+v", config)
-	return &Server{
+	s := &Server{
 		vms:            make(map[string]*vm),
-		fountain:       fountain.NewFountain(config.BridgeName),
-		ipAllocator:    ipAllocator,
-		cidAllocator:   cidAllocator,
+		starting:       make(map[string]*startReservation),
+		network:        network,
 		config:         config,
 		sessionManager: sessionManager,
-	}, nil
+		faults:         faults.NewInjector(config.EnableFaultInjection),
+		events:         bus,
+		redactPatterns: redactPatterns,
+		capabilities:   capabilities,
+		operations:     newOperationStore(config.OperationRetention),
+		reconcile:      report,
+	}
+	sessionManager.SetFaultInjector(s.faults)
+	if err := sessionManager.RegisterBuiltin(uploadArtifactMethod, s.uploadArtifact); err != nil {
+		return nil, err
+	}
+	s.reconcileLeftoverVMs(leftovers, adopting)
+
+	if config.PoolSize > 0 {
+		s.pool = newVMPool(config.PoolSize)
+		s.pool.filler.Add(1)
+		go s.fillPool()
+	}
+
+	if config.RetainDestroyedArtifacts > 0 {
+		go s.runArchivePruner()
+	}
+	if config.HeartbeatInterval > 0 {
+		go s.runHeartbeatMonitor()
+	}
+	return s, nil
+}
+
+// Events returns the bus VM lifecycle events are published on.
+func (s *Server) Events() *events.Bus {
+	return s.events
+}
+
+// HasVM reports whether a VM named vmName exists.
+func (s *Server) HasVM(vmName string) bool {
+	return s.getVMAtomic(vmName) != nil
 }
 
 // GetVMNameByCID returns the VM name for the given CID.
@@ -528,7 +832,16 @@ func (s *Server) GetVMNameByCID(cid uint32) (string, error) {
 			return name, nil
 		}
 	}
-	return "", fmt.Errorf("no VM found for CID %d", cid)
+	return "", status.Error(codes.NotFound, fmt.Sprintf("no VM found for CID %d", cid))
+}
+
+// GetVMNameByIP returns the name of the VM attached with ip, including VMs
+// that are still being created.
+func (s *Server) GetVMNameByIP(ip net.IP) (string, error) {
+	if vmName := s.network.ipOwner(ip); vmName != "" {
+		return vmName, nil
+	}
+	return "", fmt.Errorf("no VM found for IP %s", ip)
 }
 
 func (s *Server) getVMAtomic(vmName string) *vm {
@@ -542,13 +855,76 @@ func (s *Server) getVMAtomic(vmName string) *vm {
 	return vm
 }
 
+// bootTimeouts returns how long a VM started with startReq gets for its VMM's
+// API and then its cmdserver to come up: bootTimeoutSeconds for both if the
+// request sets it, otherwise chv_ready_timeout and cmdserver_ready_timeout.
+func (s *Server) bootTimeouts(startReq *serverapi.StartVMRequest) (chvReady time.Duration, cmdServerReady time.Duration) {
+	if seconds := startReq.GetBootTimeoutSeconds(); seconds > 0 {
+		timeout := time.Duration(seconds) * time.Second
+		return timeout, timeout
+	}
+	return s.config.ChvReadyTimeout, s.config.CmdServerReadyTimeout
+}
+
+// spawnVMM starts a VMM for vmName with its log in vmStateDir, and waits up
+// to readyTimeout for its API to come up. Steps to undo it are added to cleanup.
+func (s *Server) spawnVMM(ctx context.Context, vmName string, vmStateDir string, readyTimeout time.Duration, cleanup *cleanup.Cleanup) (string, *chvapi.APIClient, *os.Process, error) {
+	apiSocketPath := getVmSocketPath(vmStateDir, vmName)
+	apiClient := createApiClient(apiSocketPath)
+
+	logFile, err := os.Create(path.Join(vmStateDir, vmLogFilename))
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to create log file: %w", err)
+	}
+
+	// The api socket path and CBOX_VM_NAME both carry the VM name so the
+	// process can be identified from ps and /proc.
+	cmd := exec.Command(s.config.ChvBinPath, "--api-socket", apiSocketPath)
+	cmd.Env = append(os.Environ(), "CBOX_VM_NAME="+vmName)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("error spawning vm: %w", err)
+	}
+	cleanup.Add(func() {
+		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "spawnVMM"}).Info("reap VMM process")
+		reapProcess(cmd.Process, log.WithField("vmname", vmName), s.config.ReapTimeout)
+	})
+	if err := writePidRecords(s.config.StateDir, vmName, cmd.Process.Pid); err != nil {
+		return "", nil, nil, err
+	}
+	cleanup.Add(func() {
+		removePidRecords(s.config.StateDir, vmName, cmd.Process.Pid)
+	})
+
+	err = waitForServer(ctx, apiClient, readyTimeout)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("error waiting for vm: %w", err)
+	}
+	cleanup.Add(func() {
+		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "spawnVMM"}).Info("kill VMM process")
+		if err := cmd.Process.Kill(); err != nil {
+			log.WithField("vmname", vmName).Errorf("Error killing vm: %v", err)
+		}
+	})
+	log.WithField("vmname", vmName).Infof("VM started Pid:%d", cmd.Process.Pid)
+	return apiSocketPath, apiClient, cmd.Process, nil
+}
+
 func (s *Server) createVM(
 	ctx context.Context,
 	vmName string,
 	kernelPath string,
 	initramfsPath string,
 	rootfsPath string,
-) (*vm, error) {
+	startReq *serverapi.StartVMRequest,
+	statefulDiskSource string,
+) (_ *vm, retErr error) {
 	cleanup := cleanup.Make(func() {
 		log.WithFields(
 			log.Fields{
@@ -563,124 +939,219 @@ func (s *Server) createVM(
 		cleanup.Clean()
 	}()
 
+	// Validated by startVM.
+	profile, _ := s.lookupProfile(startReq.GetProfile())
+	vcpuCount := calculateVCPUCount()
+	if profile.DefaultVcpus > 0 {
+		vcpuCount = profile.DefaultVcpus
+	}
+	pinning, vcpus, err := s.planPinning(startReq, vcpuCount)
+	if err != nil {
+		return nil, err
+	}
+	dataDisks, err := planDataDisks(startReq.GetDisks())
+	if err != nil {
+		return nil, err
+	}
+	sharedDirs, err := s.planSharedDirs(startReq.GetSharedDirs())
+	if err != nil {
+		return nil, err
+	}
+	rootfsOverlay, err := s.wantsRootfsOverlay(startReq)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := encodeMetadata(startReq)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateKernelArgs(startReq.GetExtraKernelArgs()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid extraKernelArgs: %v", err))
+	}
+	preservedDisk := s.preservedDisk(vmName)
+	if preservedDisk != "" && statefulDiskSource != "" {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("vm %s has a preserved stateful disk, which can't be replaced by a template's", vmName))
+	}
+
 	vmStateDir := getVmStateDirPath(s.config.StateDir, vmName)
-	err := os.MkdirAll(vmStateDir, 0755)
+	err = os.MkdirAll(vmStateDir, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create vm state dir: %w", err)
 	}
 	cleanup.Add(func() {
-		if err := os.RemoveAll(vmStateDir); err != nil {
-			log.WithError(err).Errorf("failed to remove vm state dir: %s", vmStateDir)
-		}
+		// Archived for post-mortems when retain_destroyed_artifacts is set.
+		s.disposeStateDir(&vm{
+			name:             vmName,
+			stateDirPath:     vmStateDir,
+			statefulDiskPath: path.Join(vmStateDir, statefulDiskFilename),
+		})
 	})
 	log.Infof("CREATED: %v", vmStateDir)
 
-	apiSocketPath := getVmSocketPath(vmStateDir, vmName)
-	apiClient := createApiClient(apiSocketPath)
+	logFilePath := path.Join(vmStateDir, vmLogFilename)
+	// Runs before the cleanup stack so the log is still in place.
+	defer func() {
+		if retErr != nil {
+			retErr = s.withHypervisorLogTail(vmName, logFilePath, retErr)
+		}
+	}()
 
-	logFilePath := path.Join(vmStateDir, "log")
-	logFile, err := os.Create(logFilePath)
+	chvReadyTimeout, readyTimeout := s.bootTimeouts(startReq)
+	apiSocketPath, apiClient, process, err := s.spawnVMM(ctx, vmName, vmStateDir, chvReadyTimeout, &cleanup)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create log file: %w", err)
-	}
-
-	cmd := exec.Command(s.config.ChvBinPath, "--api-socket", apiSocketPath)
-	cmd.Stdout = logFile
-	cmd.Stderr = logFile
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true,
+		return nil, err
 	}
 
-	err = cmd.Start()
-	if err != nil {
-		return nil, fmt.Errorf("error spawning vm: %w", err)
+	if pinning != nil {
+		if err := checkPinningSupport(ctx, apiClient); err != nil {
+			return nil, err
+		}
 	}
-	cleanup.Add(func() {
-		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "createVM"}).Info("reap VMM process")
-		reapProcess(cmd.Process, log.WithField("vmname", vmName), reapVmTimeout)
-	})
 
-	err = waitForServer(ctx, apiClient, 10*time.Second)
+	networkPlan, err := s.network.PlanAttachment(startReq)
 	if err != nil {
-		return nil, fmt.Errorf("error waiting for vm: %w", err)
+		return nil, err
 	}
-	cleanup.Add(func() {
-		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "createVM"}).Info("kill VMM process")
-		if err := cmd.Process.Kill(); err != nil {
-			log.WithField("vmname", vmName).Errorf("Error killing vm: %v", err)
-		}
-	})
-	log.WithField("vmname", vmName).Infof("VM started Pid:%d", cmd.Process.Pid)
-
-	tapDevice, err := s.fountain.CreateTapDevice(nil)
+	attachment, err := s.network.Apply(vmName, networkPlan)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create tap device: %w", err)
+		return nil, err
 	}
 	cleanup.Add(func() {
-		if err := s.fountain.DestroyTapDevice(tapDevice); err != nil {
-			log.WithError(err).Errorf("failed to delete tap device: %s", tapDevice)
+		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "createVM"}).Info("releasing network attachment")
+		if err := s.network.Release(vmName); err != nil {
+			log.WithError(err).Errorf("failed to release network attachment for vm: %s", vmName)
 		}
 	})
+	tapDevice, guestIP, cid := attachment.TapDevice, attachment.IP, attachment.CID
 
-	guestIP, err := s.ipAllocator.AllocateIP()
+	vsockPath := path.Join(vmStateDir, "vsock.sock")
+	callbackListener, err := s.listenVsockCallbacks(vmName, vsockPath)
 	if err != nil {
-		return nil, fmt.Errorf("error allocating guest ip: %w", err)
+		return nil, err
 	}
-	log.Infof("Allocated IP: %v", guestIP)
 	cleanup.Add(func() {
-		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "createVM", "ip": guestIP.String()}).Info("freeing IP")
-		s.ipAllocator.FreeIP(guestIP.IP)
+		callbackListener.Close()
 	})
-
-	vsockPath := path.Join(vmStateDir, "vsock.sock")
-	cid, err := s.cidAllocator.AllocateCID()
+	artifactListener, err := s.listenArtifacts(vmName, vsockPath, vmStateDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to allocate CID: %w", err)
+		return nil, err
 	}
 	cleanup.Add(func() {
-		if err := s.cidAllocator.FreeCID(cid); err != nil {
-			log.WithError(err).Errorf("failed to free CID: %d", cid)
-		}
+		artifactListener.Close()
 	})
 
 	statefulDiskPath := path.Join(vmStateDir, statefulDiskFilename)
-	err = createStatefulDisk(statefulDiskPath, s.config.StatefulSizeInMB)
+	switch {
+	case preservedDisk != "":
+		log.WithField("vmName", vmName).Infof("Reattaching preserved stateful disk %s", preservedDisk)
+		err = os.Rename(preservedDisk, statefulDiskPath)
+	case statefulDiskSource != "":
+		err = cloneStatefulDisk(statefulDiskSource, statefulDiskPath)
+	default:
+		err = createStatefulDisk(statefulDiskPath, s.statefulSizeInMB(startReq))
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to create stateful disk: %w", err)
 	}
 	cleanup.Add(func() {
+		if preservedDisk != "" {
+			// Put back for the next attempt rather than deleted.
+			if err := os.Rename(statefulDiskPath, preservedDisk); err != nil {
+				log.WithError(err).Errorf("failed to put back preserved stateful disk: %s", preservedDisk)
+			}
+			return
+		}
 		if err := os.Remove(statefulDiskPath); err != nil {
 			log.WithError(err).Errorf("failed to remove stateful disk: %s", statefulDiskPath)
 		}
 	})
-
-	vcpus := calculateVCPUCount()
 	numBlockDeviceQueues := vcpus
-	memorySizeMB, err := calculateGuestMemorySizeInMB(s.config.GuestMemPercentage)
+	rootfsDisk := chvapi.DiskConfig{Path: rootfsPath, Readonly: Bool(true), NumQueues: &numBlockDeviceQueues}
+	if rootfsOverlay {
+		overlayPath := path.Join(vmStateDir, rootfsOverlayFilename)
+		if err := createRootfsOverlay(rootfsPath, overlayPath); err != nil {
+			return nil, err
+		}
+		cleanup.Add(func() {
+			if err := os.Remove(overlayPath); err != nil {
+				log.WithError(err).Errorf("failed to remove rootfs overlay: %s", overlayPath)
+			}
+		})
+		rootfsDisk = chvapi.DiskConfig{Path: overlayPath, NumQueues: &numBlockDeviceQueues}
+	}
+	if err := createDataDisks(dataDisks); err != nil {
+		return nil, err
+	}
+	cleanup.Add(func() {
+		removeDataDisks(dataDisks)
+	})
+	disks := append([]chvapi.DiskConfig{
+		rootfsDisk,
+		{Path: statefulDiskPath, NumQueues: &numBlockDeviceQueues},
+	}, dataDiskConfigs(dataDisks, &numBlockDeviceQueues)...)
+	if metadata != nil {
+		metadataDisk, err := createMetadataDisk(vmStateDir, metadata)
+		if err != nil {
+			return nil, err
+		}
+		disks = append(disks, metadataDisk)
+	}
+	if err := s.startVirtiofsd(vmName, vmStateDir, sharedDirs, chvReadyTimeout, &cleanup); err != nil {
+		return nil, err
+	}
+
+	memPercentage := s.config.GuestMemPercentage
+	if profile.DefaultMemPercentage > 0 {
+		memPercentage = profile.DefaultMemPercentage
+	}
+	memorySizeMB, err := calculateGuestMemorySizeInMB(memPercentage)
 	if err != nil {
 		return nil, fmt.Errorf("failed to calculate guest memory size: %w", err)
 	}
 	log.Infof("Calculated vCPUs: %d, memory size: %d MB", vcpus, memorySizeMB)
+	resources := s.planResources(vcpus, memorySizeMB, pinning != nil)
+
+	serialMode := s.config.SerialMode
+	serialConfig := chvapi.NewConsoleConfig(serialMode)
+	var serialSocketPath string
+	if serialMode == serialModeSocket {
+		serialSocketPath = path.Join(vmStateDir, serialSocketFilename)
+		serialConfig.SetSocket(serialSocketPath)
+	}
+
+	kernelCmdline := appendKernelArgs(
+		getKernelCmdLine(s.config.BridgeIP, guestIP.String(), vmName, s.config.HeartbeatInterval),
+		s.config.DefaultKernelArgs,
+		startReq.GetExtraKernelArgs())
+	if len(kernelCmdline) > maxKernelCmdlineBytes {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("kernel command line must be at most %d bytes, got %d", maxKernelCmdlineBytes, len(kernelCmdline)))
+	}
 
 	vmConfig := chvapi.VmConfig{
 		Payload: chvapi.PayloadConfig{
 			Kernel:    String(kernelPath),
-			Cmdline:   String(getKernelCmdLine(s.config.BridgeIP, guestIP.String(), vmName)),
+			Cmdline:   String(kernelCmdline),
 			Initramfs: String(initramfsPath),
 		},
-		Disks: []chvapi.DiskConfig{
-			{Path: rootfsPath, Readonly: Bool(true), NumQueues: &numBlockDeviceQueues},
-			{Path: statefulDiskPath, NumQueues: &numBlockDeviceQueues},
-		},
-		Cpus:    &chvapi.CpusConfig{BootVcpus: vcpus, MaxVcpus: vcpus},
-		Memory:  &chvapi.MemoryConfig{Size: int64(memorySizeMB) * 1024 * 1024},
-		Serial:  chvapi.NewConsoleConfig(serialPortMode),
+		Disks:   disks,
+		Cpus:    &chvapi.CpusConfig{BootVcpus: vcpus, MaxVcpus: resources.MaxVcpus},
+		Memory:  resources.memoryConfig(),
+		Serial:  serialConfig,
 		Console: chvapi.NewConsoleConfig(consolePortMode),
 		Net: []chvapi.NetConfig{
 			{Tap: String(tapDevice.Name), NumQueues: Int32(numNetDeviceQueues), QueueSize: Int32(netDeviceQueueSizeBytes), Id: String(netDeviceId)},
 		},
 		Vsock: &chvapi.VsockConfig{Cid: int64(cid), Socket: vsockPath},
 	}
+	if len(sharedDirs) > 0 {
+		// vhost-user devices like virtiofsd need guest memory they can map.
+		vmConfig.Fs = sharedDirFsConfigs(sharedDirs)
+		vmConfig.Memory.Shared = Bool(true)
+	}
+
+	if pinning != nil {
+		pinning.apply(&vmConfig)
+	}
 
 	log.Info("Calling CreateVM")
 	req := apiClient.DefaultAPI.CreateVM(ctx)
@@ -716,24 +1187,49 @@ func (s *Server) createVM(
 	}
 
 	newVM := &vm{
-		name:             vmName,
-		stateDirPath:     vmStateDir,
-		apiSocketPath:    apiSocketPath,
-		apiClient:        apiClient,
-		process:          cmd.Process,
-		ip:               guestIP,
-		tapDevice:        tapDevice,
-		status:           vmStatusRunning,
-		vsockPath:        vsockPath,
-		cid:              cid,
-		statefulDiskPath: statefulDiskPath,
+		name:                 vmName,
+		stateDirPath:         vmStateDir,
+		apiSocketPath:        apiSocketPath,
+		apiClient:            apiClient,
+		process:              process,
+		ip:                   guestIP,
+		tapDevice:            tapDevice,
+		externalIP:           attachment.ExternalIP,
+		staticIP:             networkPlan.StaticIP != nil,
+		status:               vmStatusRunning,
+		vsockPath:            vsockPath,
+		cid:                  cid,
+		statefulDiskPath:     statefulDiskPath,
+		dataDisks:            dataDisks,
+		sharedDirs:           sharedDirs,
+		preserveStatefulDisk: startReq.GetPreserveStatefulDisk(),
+		serialMode:           serialMode,
+		serialSocketPath:     serialSocketPath,
+		callbackListener:     callbackListener,
+		artifactListener:     artifactListener,
+		gate:                 newOpGate(),
+		kernelPath:           kernelPath,
+		initramfsPath:        initramfsPath,
+		rootfsPath:           rootfsPath,
+		rootfsOverlay:        rootfsOverlay,
+		kernelCmdline:        kernelCmdline,
+		profile:              strings.ToLower(startReq.GetProfile()),
+		labels:               maps.Clone(startReq.GetLabels()),
+		resources:            resources,
+		bootName:             vmName,
+		crashMonitorDone:     make(chan struct{}),
+		readyTimeout:         readyTimeout,
+		reapTimeout:          s.config.ReapTimeout,
+	}
+	if pinning != nil {
+		newVM.cpuAffinity = pinning.affinity
+		newVM.numaNode = pinning.numaNode
+	}
+	if err := newVM.saveRecord(); err != nil {
+		return nil, err
 	}
 	log.Infof("Successfully created VM: %s", vmName)
 
-	s.lock.Lock()
-	s.vms[vmName] = newVM
-	s.lock.Unlock()
-
 	cleanup.Release()
 	return newVM, nil
 }
@@ -761,6 +1257,32 @@ func (v *vm) destroy(ctx context.Context) error {
 
 	logger := log.WithField("vmName", v.name)
 
+	// A crashed VMM no longer answers its API and only needs reaping.
+	if processExited(v.process.Pid) {
+		logger.Info("VMM already exited")
+	} else if err := v.shutdownVMM(ctx); err != nil {
+		return err
+	}
+
+	err := reapProcess(v.process, logger, v.reapTimeout)
+	if err != nil {
+		logger.Warnf("failed to reap VM process: %v", err)
+	}
+	v.reapVirtiofsd()
+
+	if v.callbackListener != nil {
+		v.callbackListener.Close()
+	}
+	if v.artifactListener != nil {
+		v.artifactListener.Close()
+	}
+	return nil
+}
+
+// shutdownVMM shuts down the guest and then the VMM through its API.
+func (v *vm) shutdownVMM(ctx context.Context) error {
+	logger := log.WithField("vmName", v.name)
+
 	shutdownReq := v.apiClient.DefaultAPI.ShutdownVM(ctx)
 	resp, err := shutdownReq.Execute()
 	if err != nil {
@@ -788,89 +1310,185 @@ func (v *vm) destroy(ctx context.Context) error {
 	if resp.StatusCode >= 300 {
 		return status.Error(codes.Internal, fmt.Sprintf("failed to shutdown VMM. bad status: %v", resp))
 	}
-
-	err = reapProcess(v.process, logger, reapVmTimeout)
-	if err != nil {
-		logger.Warnf("failed to reap VM process: %v", err)
-	}
-
-	log.Infof("Deleting iptables rules for IP: %s", v.ip.String())
-	err = cleanupAllIPTablesRulesForIP(v.ip.IP.String())
-	if err != nil {
-		logger.Warnf("failed to delete iptables rules: %v", err)
-	}
-
-	err = os.RemoveAll(v.stateDirPath)
-	if err != nil {
-		log.Warnf("Failed to delete directory %s: %v", v.stateDirPath, err)
-	}
 	return nil
 }
 
 func (s *Server) destroyVM(ctx context.Context, vmName string) error {
+	return s.destroyVMWith(ctx, vmName, opDestroy, nil)
+}
+
+// destroyVMWith destroys a VM under the gate operation op. beforeDispose, if
+// set, runs once the VMM has exited and before the state dir is disposed of;
+// if it fails the state dir is left in place.
+func (s *Server) destroyVMWith(ctx context.Context, vmName string, op string, beforeDispose func(*vm) error) error {
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to destroy VM")
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
-		return fmt.Errorf("vm %s not found", vmName)
+		return status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
 
-	err := vm.destroy(ctx)
+	drainCtx, cancel := context.WithTimeout(ctx, destroyDrainTimeout)
+	release, err := vm.gate.acquireExclusive(drainCtx, vmName, op, vm.reapTimeout)
+	cancel()
 	if err != nil {
 		return fmt.Errorf("failed to destroy vm: %s: %w", vmName, err)
 	}
+	defer release()
 
-	err = s.fountain.DestroyTapDevice(vm.tapDevice)
+	// Shutting the guest down would otherwise look like a crash.
+	vm.stopCrashMonitor()
+	err = vm.destroy(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to destroy the tap device for vm: %s: %w", vmName, err)
+		return fmt.Errorf("failed to destroy vm: %s: %w", vmName, err)
 	}
+	vm.gate.close()
+	removePidRecords(s.config.StateDir, vmName, vm.process.Pid)
 
-	err = s.ipAllocator.FreeIP(vm.ip.IP)
-	if err != nil {
-		return fmt.Errorf("failed to free IP: %s: %w", vm.ip.String(), err)
+	var hookErr error
+	if beforeDispose != nil {
+		hookErr = beforeDispose(vm)
+	}
+	if hookErr != nil {
+		logger.WithError(hookErr).Errorf("leaving state dir in place: %s", vm.stateDirPath)
+	} else {
+		s.disposeStateDir(vm)
 	}
 
-	err = s.cidAllocator.FreeCID(vm.cid)
-	if err != nil {
-		log.WithError(err).Errorf("failed to free CID: %d", vm.cid)
+	if err := s.network.Release(vmName); err != nil {
+		return fmt.Errorf("failed to release network for vm: %s: %w", vmName, err)
 	}
 
 	s.lock.Lock()
 	delete(s.vms, vmName)
 	s.lock.Unlock()
-	return nil
+	// There may be room under max_vms for the pool again.
+	s.pool.wake()
+
+	s.events.Publish(events.TypeVMDestroyed, vmName, nil)
+	return hookErr
+}
+
+// VMExistsError fails a request to start a VM that already exists and isn't
+// stopped.
+type VMExistsError struct {
+	// VM is the existing VM.
+	VM *serverapi.StartVMResponse
+}
+
+func (e *VMExistsError) Error() string {
+	return fmt.Sprintf("vm %s already exists with status %s", e.VM.GetVmName(), e.VM.GetStatus())
 }
 
-// StartVM starts a new VM or boots an existing one.
+func (e *VMExistsError) GRPCStatus() *status.Status {
+	return status.New(codes.AlreadyExists, e.Error())
+}
+
+// StartVM starts a new VM or boots an existing, stopped one. A running VM is
+// returned as it is if the request is idempotent; otherwise existing VMs
+// fail with a VMExistsError.
 func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error) {
+	return s.startVM(ctx, req, "")
+}
+
+// reservedDirName reports whether name is taken by a dir the server keeps
+// next to VM state dirs.
+func reservedDirName(name string) bool {
+	switch name {
+	case archiveDirName, templatesDirName, crashDirName, snapshotsDirName, preservedDirName, byPidDirName:
+		return true
+	}
+	return false
+}
+
+// reservedVMName reports whether name can't be given to a VM, as it's a
+// reserved dir or the name of a pooled VM.
+func reservedVMName(name string) bool {
+	return reservedDirName(name) || strings.HasPrefix(name, poolVMPrefix)
+}
+
+// startVM implements StartVM. A new VM's stateful disk is cloned from
+// statefulDiskSource if set, instead of being created empty.
+func (s *Server) startVM(ctx context.Context, req *serverapi.StartVMRequest, statefulDiskSource string) (*serverapi.StartVMResponse, error) {
 	vmName := req.GetVmName()
 	if vmName == "" {
-		return nil, fmt.Errorf("vmName is required")
+		return nil, status.Error(codes.InvalidArgument, "vmName is required")
+	}
+	if reservedVMName(vmName) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("vmName %s is reserved", vmName))
+	}
+	if err := validateLabels(req.GetLabels()); err != nil {
+		return nil, err
+	}
+	if err := callback.ValidateMethodPatterns(req.GetAllowedCallbackMethods()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if size := req.GetStatefulSizeMb(); req.HasStatefulSizeMb() && (size <= 0 || size > s.config.MaxStatefulSizeInMB) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("statefulSizeMb must be between 1 and %d, got %d", s.config.MaxStatefulSizeInMB, size))
+	}
+	if seconds := req.GetBootTimeoutSeconds(); req.HasBootTimeoutSeconds() && (seconds <= 0 || time.Duration(seconds)*time.Second > maxBootTimeout) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("bootTimeoutSeconds must be between 1 and %d, got %d", int(maxBootTimeout.Seconds()), seconds))
+	}
+	profile, err := s.lookupProfile(req.GetProfile())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.faults.Apply(ctx, faults.PointStartVM, vmName); err != nil {
+		return nil, err
 	}
 	logger := log.WithField("vmName", vmName)
 
+	// Concurrent starts of a VM would each create it. Idempotent ones wait
+	// for the start in progress and then find the VM it started.
+	for {
+		release, other := s.reserveStart(vmName)
+		if other == nil {
+			defer release()
+			break
+		}
+		if !req.GetIdempotent() {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("vm %s is already being started", vmName))
+		}
+		logger.Info("Waiting for the VM start in progress")
+		select {
+		case <-other.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
 	kernelPath := req.GetKernel()
 	rootfsPath := req.GetRootfs()
 	initramfsPath := req.GetInitramfs()
 	logger.Infof("Starting VM")
 
-	if kernelPath == "" {
-		kernelPath = s.config.KernelPath
-	}
-	if rootfsPath == "" {
-		rootfsPath = s.config.RootfsPath
-	}
-	if initramfsPath == "" {
-		initramfsPath = s.config.InitramfsPath
-	}
+	kernelPath = cmp.Or(kernelPath, profile.Kernel, s.config.KernelPath)
+	rootfsPath = cmp.Or(rootfsPath, profile.Rootfs, s.config.RootfsPath)
+	initramfsPath = cmp.Or(initramfsPath, profile.Initramfs, s.config.InitramfsPath)
 
 	vm := s.getVMAtomic(vmName)
 	if vm != nil {
+		if existing, err := checkExistingVM(vm, req); existing != nil || err != nil {
+			logger.WithError(err).Info("VM already exists")
+			return existing, err
+		}
 		err := vm.boot(ctx)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to boot existing VM: %v", err)
 		}
+	} else if pooled := s.claimPooledVM(ctx, req, statefulDiskSource); pooled != nil {
+		vm = pooled
+		if err := s.registerVM(vm); err != nil {
+			s.discardVM(vm)
+			return nil, err
+		}
+		s.events.Publish(events.TypeVMCreated, vmName, map[string]any{
+			"pooled": true,
+		})
 	} else {
+		if err := s.checkMaxVMs(); err != nil {
+			return nil, err
+		}
 		cleanup := cleanup.Make(func() {
 			logger.Info("start VM clean up done")
 		})
@@ -879,19 +1497,25 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 		}()
 
 		var err error
-		vm, err = s.createVM(ctx, vmName, kernelPath, initramfsPath, rootfsPath)
+		vm, err = s.createVM(ctx, vmName, kernelPath, initramfsPath, rootfsPath, req, statefulDiskSource)
 		if err != nil {
 			logger.Errorf("failed to create VM: %v", err)
 			return nil, err
 		}
+		if err := s.registerVM(vm); err != nil {
+			s.discardVM(vm)
+			return nil, err
+		}
+		s.events.Publish(events.TypeVMCreated, vmName, nil)
 
 		cleanup.Add(func() {
 			logger.Info("shutting down VM")
-			resp, err := vm.apiClient.DefaultAPI.ShutdownVM(ctx).Execute()
+			// ctx may be why the boot failed, e.g. for async starts of VMs
+			// destroyed while booting.
+			resp, err := vm.apiClient.DefaultAPI.ShutdownVM(context.WithoutCancel(ctx)).Execute()
 			if err != nil {
 				logger.WithError(err).Errorf("failed to shutdown VM: %v", err)
-			}
-			if resp.StatusCode != 204 {
+			} else if resp.StatusCode != 204 {
 				logger.WithError(err).Errorf("failed to shutdown VM. bad status: %v", resp)
 			}
 		})
@@ -899,29 +1523,139 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 		err = vm.boot(ctx)
 		if err != nil {
 			logger.Errorf("failed to boot VM: %v", err)
-			return nil, err
+			return nil, s.withHypervisorLogTail(vmName, path.Join(vm.stateDirPath, vmLogFilename), err)
 		}
 		cleanup.Release()
 	}
+	s.events.Publish(events.TypeVMBooted, vmName, nil)
+	s.startCrashMonitor(vm)
 
 	logger.WithField("vmIP", vm.ip.IP.String()).Infof("Waiting for cmd server to be ready")
-	err := waitForCmdServerReady(ctx, vm.ip.IP.String())
+	err = waitForCmdServerReady(ctx, vm.ip.IP.String(), vm.readyTimeout)
 	if err != nil {
 		logger.WithError(err).Warnf("command server not ready")
 	}
+	vm.refreshAgentVersions(ctx)
+	if err := vm.syncGuestName(ctx); err != nil {
+		logger.WithError(err).Warn("failed to send the VM its name")
+	}
 	logger.Infof("VM ready")
 
-	return &serverapi.StartVMResponse{
-		VmName:        serverapi.PtrString(vmName),
-		Ip:            serverapi.PtrString(vm.ip.String()),
-		Status:        serverapi.PtrString(vm.status.String()),
-		TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
+	var report *serverapi.ProvisioningReport
+	if steps := req.GetProvisioning(); len(steps) > 0 {
+		logger.WithField("steps", len(steps)).Info("Provisioning VM")
+		report = s.provisionVM(ctx, vm, steps)
+		if !report.GetSuccess() {
+			logger.Error("VM provisioning failed")
+			vm.lock.Lock()
+			vm.status = vmStatusFailedProvisioning
+			vm.lock.Unlock()
+			s.events.Publish(events.TypeVMProvisioningFailed, vmName, report)
+		}
+	}
+
+	vm.lock.RLock()
+	defer vm.lock.RUnlock()
+	resp := vm.startVMResponse()
+	resp.Provisioning = report
+	return resp, nil
+}
+
+// startReservation holds a VM's name while it's being started or restored.
+type startReservation struct {
+	// done is closed once the start finishes.
+	done chan struct{}
+}
+
+// reserveStart reserves vmName for starting or restoring it. If another start
+// holds it, that start's reservation is returned instead of a release func.
+func (s *Server) reserveStart(vmName string) (func(), *startReservation) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if other, ok := s.starting[vmName]; ok {
+		return nil, other
+	}
+	reservation := &startReservation{done: make(chan struct{})}
+	s.starting[vmName] = reservation
+	return func() {
+		s.lock.Lock()
+		delete(s.starting, vmName)
+		s.lock.Unlock()
+		close(reservation.done)
 	}, nil
 }
 
+// registerVM adds a new VM to s.vms, failing if its name was taken since the
+// start request checked for it.
+func (s *Server) registerVM(v *vm) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.vms[v.name]; exists {
+		return status.Error(codes.AlreadyExists, fmt.Sprintf("vm already exists: %s", v.name))
+	}
+	s.vms[v.name] = v
+	return nil
+}
+
+// startVMResponse must be called with v.lock held.
+func (v *vm) startVMResponse() *serverapi.StartVMResponse {
+	resp := &serverapi.StartVMResponse{
+		VmName:        serverapi.PtrString(v.name),
+		Ip:            serverapi.PtrString(v.ip.String()),
+		Status:        serverapi.PtrString(v.status.String()),
+		TapDeviceName: serverapi.PtrString(v.tapDevice.Name),
+		Cid:           serverapi.PtrInt64(int64(v.cid)),
+		VsockPath:     serverapi.PtrString(v.vsockPath),
+		SharedDirs:    v.apiSharedDirs(),
+	}
+	if v.staticIP {
+		resp.RequestedIp = serverapi.PtrString(v.ip.IP.String())
+	}
+	return resp
+}
+
+// checkExistingVM decides what a start request does with vm, which already
+// has its name. Stopped VMs are booted again, so it returns nothing; running
+// ones are returned as they are to idempotent requests. Anything else fails
+// with a VMExistsError.
+func checkExistingVM(vm *vm, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error) {
+	vm.lock.RLock()
+	vmStatus := vm.status
+	existing := vm.startVMResponse()
+	vm.lock.RUnlock()
+
+	switch {
+	case vmStatus == vmStatusStopped:
+		return nil, nil
+	case vmStatus == vmStatusRunning && req.GetIdempotent():
+		return existing, nil
+	default:
+		return nil, &VMExistsError{VM: existing}
+	}
+}
+
 // DestroyVM destroys a specific VM.
 func (s *Server) DestroyVM(ctx context.Context, vmName string) (*serverapi.VMResponse, error) {
-	err := s.destroyVM(ctx, vmName)
+	if vm := s.getVMAtomic(vmName); vm != nil {
+		if err := s.breakLease(ctx, vm); err != nil {
+			return nil, err
+		}
+	}
+	// A VM that is still being started asynchronously is canceled first;
+	// it may not have got far enough to need destroying.
+	canceled, err := s.cancelStartOperation(ctx, vmName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to cancel start of vm: %s: %v", vmName, err)
+	}
+	err = s.destroyVM(ctx, vmName)
+	if status.Code(err) == codes.NotFound {
+		if canceled {
+			return &serverapi.VMResponse{
+				Success: serverapi.PtrBool(true),
+			}, nil
+		}
+		return nil, err
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to destroy vm: %s: %v", vmName, err)
 	}
@@ -931,61 +1665,117 @@ func (s *Server) DestroyVM(ctx context.Context, vmName string) (*serverapi.VMRes
 	}, nil
 }
 
-// DestroyAllVMs destroys all running VMs.
-func (s *Server) DestroyAllVMs(ctx context.Context) (*serverapi.DestroyAllVMsResponse, error) {
-	log.Infof("received request to destroy all VMs")
+// DestroyAllVMs destroys all running VMs, or only those matching
+// selectorString if it is set, destroy_parallelism at a time. VMs that fail
+// to be destroyed are listed in the response rather than failing the call.
+func (s *Server) DestroyAllVMs(ctx context.Context, selectorString string) (*serverapi.DestroyAllVMsResponse, error) {
+	var selector labelSelector
+	if selectorString != "" {
+		var err error
+		if selector, err = parseLabelSelector(selectorString); err != nil {
+			return nil, err
+		}
+	}
+	log.WithField("labelSelector", selectorString).Info("received request to destroy all VMs")
+	if err := s.cancelStartOperations(ctx, selector); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to cancel VM starts: %v", err)
+	}
 
 	s.lock.RLock()
 	vmNames := make([]string, 0, len(s.vms))
-	for name := range s.vms {
-		vmNames = append(vmNames, name)
+	for name, vm := range s.vms {
+		if selector.matches(vm.labels) {
+			vmNames = append(vmNames, name)
+		}
 	}
 	s.lock.RUnlock()
 
-	var finalErr error
-	for _, vmName := range vmNames {
-		err := s.destroyVM(ctx, vmName)
-		if err != nil {
-			log.Warnf("failed to destroy and clean up vm: %s", vmName)
-		}
-		finalErr = errors.Join(finalErr, err)
+	sort.Strings(vmNames)
+	errs := make([]error, len(vmNames))
+	sem := make(chan struct{}, s.config.DestroyParallelism)
+	var wg sync.WaitGroup
+	for i, vmName := range vmNames {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = s.destroyVM(ctx, vmName)
+		}()
 	}
+	wg.Wait()
 
-	if finalErr != nil {
-		return nil, status.Errorf(codes.Internal, "failed to destroy all VMs: %v", finalErr)
+	resp := &serverapi.DestroyAllVMsResponse{
+		Destroyed: []string{},
+		Failed:    []serverapi.DestroyVMFailure{},
 	}
-
-	return &serverapi.DestroyAllVMsResponse{
-		Success: serverapi.PtrBool(true),
-	}, nil
+	for i, vmName := range vmNames {
+		if err := errs[i]; err != nil {
+			log.WithField("vmName", vmName).WithError(err).Warn("failed to destroy and clean up vm")
+			resp.Failed = append(resp.Failed, serverapi.DestroyVMFailure{
+				VmName: serverapi.PtrString(vmName),
+				Error:  serverapi.PtrString(err.Error()),
+			})
+			continue
+		}
+		resp.Destroyed = append(resp.Destroyed, vmName)
+	}
+	resp.Success = serverapi.PtrBool(len(resp.Failed) == 0)
+	return resp, nil
 }
 
-// ListAllVMs returns information about all VMs.
-func (s *Server) ListAllVMs(ctx context.Context) (*serverapi.ListAllVMsResponse, error) {
+// ListAllVMs returns information about all VMs, or only those matching
+// selectorString if it is set.
+func (s *Server) ListAllVMs(ctx context.Context, selectorString string) (*serverapi.ListAllVMsResponse, error) {
 	resp := &serverapi.ListAllVMsResponse{}
 	var vms []serverapi.ListAllVMsResponseVmsInner
 
+	var selector labelSelector
+	if selectorString != "" {
+		var err error
+		if selector, err = parseLabelSelector(selectorString); err != nil {
+			return nil, err
+		}
+	}
+
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
 	for _, vm := range s.vms {
-		var ipString string
-		if vm.ip != nil {
-			ipString = vm.ip.String()
-		}
-
-		vmInfo := serverapi.ListAllVMsResponseVmsInner{
-			VmName:        serverapi.PtrString(vm.name),
-			Ip:            serverapi.PtrString(ipString),
-			Status:        serverapi.PtrString(vm.status.String()),
-			TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
+		if vmInfo, ok := vm.listInfo(selector); ok {
+			vms = append(vms, vmInfo)
 		}
-		vms = append(vms, vmInfo)
 	}
 	resp.Vms = vms
+	if s.pool != nil {
+		resp.Pool = s.pool.status()
+	}
 	return resp, nil
 }
 
+// listInfo returns the VM's ListAllVMs entry, or false if it doesn't match
+// selector.
+func (v *vm) listInfo(selector labelSelector) (serverapi.ListAllVMsResponseVmsInner, bool) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	if !selector.matches(v.labels) {
+		return serverapi.ListAllVMsResponseVmsInner{}, false
+	}
+	var ipString string
+	if v.ip != nil {
+		ipString = v.ip.String()
+	}
+	return serverapi.ListAllVMsResponseVmsInner{
+		VmName:        serverapi.PtrString(v.name),
+		Ip:            serverapi.PtrString(ipString),
+		Status:        serverapi.PtrString(v.status.String()),
+		TapDeviceName: serverapi.PtrString(v.tapDevice.Name),
+		Cid:           serverapi.PtrInt64(int64(v.cid)),
+		VsockPath:     serverapi.PtrString(v.vsockPath),
+		Labels:        v.apiLabels(),
+	}, true
+}
+
 // ListVM returns information about a specific VM.
 func (s *Server) ListVM(ctx context.Context, vmName string) (*serverapi.ListVMResponse, error) {
 	vm := s.getVMAtomic(vmName)
@@ -993,43 +1783,395 @@ func (s *Server) ListVM(ctx context.Context, vmName string) (*serverapi.ListVMRe
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
 
+	stats := s.sessionManager.GetStats(vmName)
+	callbackStats := &serverapi.CallbackStats{
+		Sent:      serverapi.PtrInt64(int64(stats.Sent)),
+		Succeeded: serverapi.PtrInt64(int64(stats.Succeeded)),
+		Failed:    serverapi.PtrInt64(int64(stats.Failed)),
+	}
+	if stats.LastError != "" {
+		callbackStats.LastError = serverapi.PtrString(stats.LastError)
+		callbackStats.LastErrorAt = serverapi.PtrTime(stats.LastErrorAt)
+	}
+	if stats.LastDeliveredURL != "" {
+		callbackStats.LastDeliveredUrl = serverapi.PtrString(stats.LastDeliveredURL)
+	}
+	if stats.Rejected > 0 {
+		callbackStats.Rejected = serverapi.PtrInt64(int64(stats.Rejected))
+	}
+
+	// apiDisks and the others below take vm.lock themselves, so they're
+	// called after it's released.
+	vm.lock.RLock()
 	var ipString string
 	if vm.ip != nil {
 		ipString = vm.ip.String()
 	}
+	var cpuAffinity []string
+	for _, cpus := range vm.cpuAffinity {
+		cpuAffinity = append(cpuAffinity, formatCPUList(cpus))
+	}
+	resp := &serverapi.ListVMResponse{
+		VmName:               serverapi.PtrString(vm.name),
+		Ip:                   serverapi.PtrString(ipString),
+		Status:               serverapi.PtrString(vm.status.String()),
+		TapDeviceName:        serverapi.PtrString(vm.tapDevice.Name),
+		Cid:                  serverapi.PtrInt64(int64(vm.cid)),
+		VsockPath:            serverapi.PtrString(vm.vsockPath),
+		ExternalNetworking:   serverapi.PtrBool(vm.tapDevice.External || vm.externalIP),
+		Template:             serverapi.PtrString(vm.template),
+		Labels:               vm.apiLabels(),
+		CpuAffinity:          cpuAffinity,
+		NumaNode:             vm.numaNode,
+		SharedDirs:           vm.apiSharedDirs(),
+		RootfsOverlay:        serverapi.PtrBool(vm.rootfsOverlay),
+		KernelCmdline:        serverapi.PtrString(vm.kernelCmdline),
+		Profile:              serverapi.PtrString(vm.profile),
+		PreserveStatefulDisk: serverapi.PtrBool(vm.preserveStatefulDisk),
+	}
+	vm.lock.RUnlock()
+
+	resp.CurrentOperation = serverapi.PtrString(vm.gate.currentOperation())
+	resp.Disks = vm.apiDisks()
+	resp.Resources = vm.apiResources()
+	resp.Agents = vm.agentVersions()
+	resp.Lease = vm.apiLease()
+	resp.CallbackStats = callbackStats
+	resp.Heartbeat = vm.apiHeartbeat()
+	resp.Proxy = &serverapi.ProxyStats{
+		ActiveConnections: serverapi.PtrInt32(vm.proxyStats.active.Load()),
+		BytesToGuest:      serverapi.PtrInt64(int64(vm.proxyStats.bytesToGuest.Load())),
+		BytesFromGuest:    serverapi.PtrInt64(int64(vm.proxyStats.bytesFromGuest.Load())),
+	}
+	return resp, nil
+}
 
-	return &serverapi.ListVMResponse{
-		VmName:        serverapi.PtrString(vm.name),
-		Ip:            serverapi.PtrString(ipString),
-		Status:        serverapi.PtrString(vm.status.String()),
-		TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
-	}, nil
+const (
+	opResize = "resize"
+	// resizeTimeout bounds a resize call to the VMM.
+	resizeTimeout = 30 * time.Second
+	// memoryHotplugStepMB is the granularity of ACPI memory hotplug.
+	memoryHotplugStepMB = 128
+)
+
+// vmResources is a VM's vCPU and memory allocation, and how far it can be
+// resized.
+type vmResources struct {
+	Vcpus       int32 `json:"vcpus"`
+	MaxVcpus    int32 `json:"maxVcpus"`
+	MemoryMB    int32 `json:"memoryMb"`
+	MaxMemoryMB int32 `json:"maxMemoryMb"`
+	// BootMemoryMB is the memory the VM was created with.
+	BootMemoryMB int32 `json:"bootMemoryMb"`
+}
+
+// planResources sizes a new VM's hotplug headroom from max_vcpus and
+// memory_hotplug_size_in_mb. Pinned VMs get none: their vCPU affinity and
+// memory zone only cover what they boot with.
+func (s *Server) planResources(vcpus int32, memoryMB int32, pinned bool) vmResources {
+	resources := vmResources{
+		Vcpus:        vcpus,
+		MaxVcpus:     vcpus,
+		MemoryMB:     memoryMB,
+		MaxMemoryMB:  memoryMB,
+		BootMemoryMB: memoryMB,
+	}
+	if !pinned {
+		resources.MaxVcpus = max(vcpus, s.config.MaxVcpus)
+		resources.MaxMemoryMB += s.config.MemoryHotplugSizeInMB
+	}
+	return resources
+}
+
+// memoryConfig returns the VMM memory config for booting with r.
+func (r vmResources) memoryConfig() *chvapi.MemoryConfig {
+	config := &chvapi.MemoryConfig{Size: int64(r.BootMemoryMB) * 1024 * 1024}
+	if hotplugMB := r.MaxMemoryMB - r.BootMemoryMB; hotplugMB > 0 {
+		hotplugSize := int64(hotplugMB) * 1024 * 1024
+		config.HotplugSize = &hotplugSize
+	}
+	return config
+}
+
+// apiResources returns the VM's allocation, or nil if it isn't known, as for
+// VMs restored from snapshots taken before it was tracked.
+func (v *vm) apiResources() *serverapi.VmResources {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.apiResourcesLocked()
+}
+
+// apiResourcesLocked is apiResources with v.lock held.
+func (v *vm) apiResourcesLocked() *serverapi.VmResources {
+	if v.resources.Vcpus == 0 {
+		return nil
+	}
+	return &serverapi.VmResources{
+		Vcpus:       serverapi.PtrInt32(v.resources.Vcpus),
+		MaxVcpus:    serverapi.PtrInt32(v.resources.MaxVcpus),
+		MemoryMb:    serverapi.PtrInt32(v.resources.MemoryMB),
+		MaxMemoryMb: serverapi.PtrInt32(v.resources.MaxMemoryMB),
+	}
+}
+
+// ResizeVM hotplugs vCPUs and memory into a running VM, or unplugs vCPUs,
+// within the headroom it was created with.
+func (s *Server) ResizeVM(ctx context.Context, vmName string, req *serverapi.ResizeVMRequest) (*serverapi.VmResources, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if !req.HasVcpus() && !req.HasMemoryMb() {
+		return nil, status.Error(codes.InvalidArgument, "vcpus or memoryMb is required")
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resizeTimeout)
+	defer cancel()
+	release, err := vm.gate.acquireExclusive(ctx, vmName, opResize, resizeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	if vm.status != vmStatusRunning {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("cannot resize vm %s: vm is %s", vmName, vm.status))
+	}
+	current := vm.resources
+	if current.Vcpus == 0 {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("cannot resize vm %s: its allocation is unknown", vmName))
+	}
+
+	resize := chvapi.VmResize{}
+	resized := current
+	if req.HasVcpus() {
+		vcpus := req.GetVcpus()
+		if vcpus < 1 || vcpus > current.MaxVcpus {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("vcpus must be between 1 and %d, got %d", current.MaxVcpus, vcpus))
+		}
+		resize.SetDesiredVcpus(vcpus)
+		resized.Vcpus = vcpus
+	}
+	if req.HasMemoryMb() {
+		memoryMB := req.GetMemoryMb()
+		switch {
+		case memoryMB < current.MemoryMB:
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("memory can't be removed, vm has %d MB", current.MemoryMB))
+		case memoryMB > current.MaxMemoryMB:
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("memoryMb must be at most %d, got %d", current.MaxMemoryMB, memoryMB))
+		case (memoryMB-current.BootMemoryMB)%memoryHotplugStepMB != 0:
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("memory can only be added in steps of %d MB on top of the boot memory of %d MB", memoryHotplugStepMB, current.BootMemoryMB))
+		}
+		resize.SetDesiredRam(int64(memoryMB) * 1024 * 1024)
+		resized.MemoryMB = memoryMB
+	}
+	if resized == current {
+		return vm.apiResourcesLocked(), nil
+	}
+
+	resp, err := vm.apiClient.DefaultAPI.VmResizePut(ctx).VmResize(resize).Execute()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resize VM: %w", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("failed to resize VM. bad status: %v", resp)
+	}
+
+	vm.resources = resized
+	vm.saveRecordLogged()
+	log.WithFields(log.Fields{
+		"vmName":   vmName,
+		"vcpus":    resized.Vcpus,
+		"memoryMb": resized.MemoryMB,
+	}).Info("Successfully resized VM")
+	s.events.Publish(events.TypeVMResized, vmName, map[string]any{
+		"vcpus":    resized.Vcpus,
+		"memoryMb": resized.MemoryMB,
+	})
+	return vm.apiResourcesLocked(), nil
 }
 
 // VMExec executes a command in a VM.
-func (s *Server) VMExec(ctx context.Context, vmName string, cmd string, blocking bool) (*serverapi.VmExecResponse, error) {
+func (s *Server) VMExec(ctx context.Context, vmName string, req *serverapi.VmExecRequest) (*serverapi.VmExecResponse, error) {
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
+	if err := checkLease(ctx, vm); err != nil {
+		return nil, err
+	}
+	if err := s.faults.Apply(ctx, faults.PointExec, vmName); err != nil {
+		return nil, err
+	}
+	release, err := vm.gate.acquireShared(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	var queueTimeout time.Duration
+	if req.HasQueueTimeoutSeconds() {
+		if req.GetQueueTimeoutSeconds() <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "queueTimeoutSeconds must be positive")
+		}
+		queueTimeout = time.Duration(req.GetQueueTimeoutSeconds()) * time.Second
+	}
+	releaseSlot, err := vm.execs.acquire(ctx, vmName, s.config.MaxConcurrentExecsPerVM, queueTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSlot()
+
+	// Only blocking commands can use vsock, so the server-wide default
+	// doesn't apply to others.
+	blocking := !req.HasBlocking() || req.GetBlocking()
+	transport := req.GetTransport()
+	if transport == "" && blocking {
+		transport = s.config.ExecTransport
+	}
+	switch transport {
+	case "", config.ExecTransportHTTP:
+		transport = config.ExecTransportHTTP
+	case config.ExecTransportVsock:
+		if !blocking {
+			return nil, status.Error(codes.InvalidArgument, "only blocking commands can use the vsock transport")
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "transport must be one of %v, got %q", config.ExecTransports, transport)
+	}
+
+	event := s.startExecEvent(ctx, vmName, execKindExec)
+	var resp *serverapi.VmExecResponse
+	if transport == config.ExecTransportVsock {
+		resp, err = vm.vsockExec(ctx, req)
+	} else {
+		resp, err = s.httpExec(ctx, vm, req)
+	}
+	// Background jobs are still running; they're followed through the jobs
+	// API instead.
+	if blocking || err != nil {
+		event.finish(execResultData(resp), err)
+	}
+	if err != nil {
+		return nil, err
 	}
+	resp.Transport = serverapi.PtrString(transport)
+	return resp, nil
+}
 
-	return vm.handleExec(ctx, client, url, cmd, blocking)
+// execResultData returns the result of an exec for its vm.exec_finished
+// event.
+func execResultData(resp *serverapi.VmExecResponse) map[string]any {
+	if resp == nil {
+		return nil
+	}
+	data := map[string]any{"timedOut": resp.GetTimedOut()}
+	if resp.HasExitCode() {
+		data["exitCode"] = resp.GetExitCode()
+	}
+	return data
 }
 
-func (v *vm) handleExec(ctx context.Context, client *http.Client, baseURL string, cmd string, blocking bool) (*serverapi.VmExecResponse, error) {
-	reqBody := struct {
-		Cmd      string `json:"cmd"`
-		Blocking bool   `json:"blocking"`
-	}{
-		Cmd:      cmd,
-		Blocking: blocking,
+// httpExec runs an exec request through the guest's cmdserver.
+func (s *Server) httpExec(ctx context.Context, vm *vm, req *serverapi.VmExecRequest) (*serverapi.VmExecResponse, error) {
+	cmdReq, clientTimeout, err := vm.execRequest(ctx, req, agentCmdServer)
+	if err != nil {
+		return nil, err
 	}
+	url := "http://" + cmdServerAddr(vm.ip.IP.String())
+	client := &http.Client{
+		Timeout:   clientTimeout,
+		Transport: s.execTransport(ctx, vm),
+	}
+	resp, err := vm.handleExec(ctx, client, url, cmdReq)
+	// A refused connection means the command never reached the guest, so it's
+	// safe to run it again once cmdserver is back.
+	if err == nil || !errors.Is(err, syscall.ECONNREFUSED) || s.config.DisableAgentAutoRecovery {
+		return resp, err
+	}
+	if recoverErr := s.recoverCmdServer(ctx, vm); recoverErr != nil {
+		log.WithContext(ctx).WithField("vmName", vm.name).WithError(recoverErr).Warn("cmdserver recovery failed")
+		return nil, err
+	}
+	return vm.handleExec(ctx, client, url, cmdReq)
+}
 
+// execRequest validates req and turns it into a request for agent, which
+// is cmdserver or vsockserver. It also returns how long to wait for the
+// agent's response.
+func (v *vm) execRequest(ctx context.Context, req *serverapi.VmExecRequest, agent string) (cmdserver.RunCmdRequest, time.Duration, error) {
+	// Default to blocking if not specified
+	blocking := true
+	if req.Blocking != nil {
+		blocking = *req.Blocking
+	}
+	clientTimeout := defaultExecTimeout
+	var timeout time.Duration
+	if req.HasTimeoutSeconds() {
+		timeout = time.Duration(req.GetTimeoutSeconds()) * time.Second
+		if timeout <= 0 || timeout > maxExecTimeout {
+			return cmdserver.RunCmdRequest{}, 0, status.Error(codes.InvalidArgument, fmt.Sprintf("timeoutSeconds must be between 1 and %d", int(maxExecTimeout.Seconds())))
+		}
+		if err := v.requireAgentFeature(ctx, agent, featureExecTimeout); err != nil {
+			return cmdserver.RunCmdRequest{}, 0, err
+		}
+		if blocking {
+			clientTimeout = timeout + execTimeoutMargin
+		}
+	}
+	if req.GetWorkspace() != "" {
+		if err := cmdserver.ValidateWorkspaceName(req.GetWorkspace()); err != nil {
+			return cmdserver.RunCmdRequest{}, 0, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := v.requireAgentFeature(ctx, agent, featureWorkspaces); err != nil {
+			return cmdserver.RunCmdRequest{}, 0, err
+		}
+	}
+	if req.GetCwd() != "" || len(req.GetEnv()) > 0 {
+		if err := cmdserver.ValidateEnv(req.GetEnv()); err != nil {
+			return cmdserver.RunCmdRequest{}, 0, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := v.requireAgentFeature(ctx, agent, featureExecEnv); err != nil {
+			return cmdserver.RunCmdRequest{}, 0, err
+		}
+	}
+	if req.GetUser() != "" {
+		if err := v.requireAgentFeature(ctx, agent, featureExecUser); err != nil {
+			return cmdserver.RunCmdRequest{}, 0, err
+		}
+	}
+	switch req.GetOutputEncoding() {
+	case "", cmdserver.OutputEncodingText:
+	case cmdserver.OutputEncodingBase64:
+		if err := v.requireAgentFeature(ctx, agent, featureExecBase64); err != nil {
+			return cmdserver.RunCmdRequest{}, 0, err
+		}
+	default:
+		return cmdserver.RunCmdRequest{}, 0, status.Errorf(codes.InvalidArgument, "outputEncoding must be one of %v, got %q", cmdserver.OutputEncodings, req.GetOutputEncoding())
+	}
+	if err := v.requireAgentFeature(ctx, agent, featureExec); err != nil {
+		return cmdserver.RunCmdRequest{}, 0, err
+	}
+
+	cmdReq := cmdserver.RunCmdRequest{
+		Cmd:       req.GetCmd(),
+		Blocking:  blocking,
+		Workspace: req.GetWorkspace(),
+		Cwd:       req.GetCwd(),
+		Env:       req.GetEnv(),
+		User:      req.GetUser(),
+		TimeoutMs: timeout.Milliseconds(),
+
+		OutputEncoding: req.GetOutputEncoding(),
+	}
+	return cmdReq, clientTimeout, nil
+}
+
+func (v *vm) handleExec(ctx context.Context, client *http.Client, baseURL string, reqBody cmdserver.RunCmdRequest) (*serverapi.VmExecResponse, error) {
 	body, err := json.Marshal(reqBody)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
@@ -1040,6 +2182,7 @@ func (v *vm) handleExec(ctx context.Context, client *http.Client, baseURL string
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	requestid.SetHeader(req)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -1048,7 +2191,7 @@ func (v *vm) handleExec(ctx context.Context, client *http.Client, baseURL string
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("request failed with status: %d", resp.StatusCode)
+		return nil, execStatusError(resp)
 	}
 
 	var cmdResp cmdserver.RunCmdResponse
@@ -1056,34 +2199,61 @@ func (v *vm) handleExec(ctx context.Context, client *http.Client, baseURL string
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	return &serverapi.VmExecResponse{
+	execResp := &serverapi.VmExecResponse{
 		Output: serverapi.PtrString(cmdResp.Output),
 		Error:  serverapi.PtrString(cmdResp.Error),
-	}, nil
+	}
+	if cmdResp.TimedOut {
+		execResp.TimedOut = serverapi.PtrBool(true)
+	}
+	if cmdResp.OutputTruncated {
+		execResp.OutputTruncated = serverapi.PtrBool(true)
+	}
+	if cmdResp.Encoding != "" {
+		execResp.Encoding = serverapi.PtrString(cmdResp.Encoding)
+	}
+	if cmdResp.JobID != "" {
+		execResp.JobId = serverapi.PtrString(cmdResp.JobID)
+	}
+	// Left unset for non-blocking commands and agents that don't report it.
+	if cmdResp.ExitCode != nil {
+		execResp.ExitCode = serverapi.PtrInt32(int32(*cmdResp.ExitCode))
+	}
+	return execResp, nil
 }
 
-// waitForCmdServerReady waits for the command server in the VM to be ready.
-func waitForCmdServerReady(ctx context.Context, vmIP string) error {
-	url := fmt.Sprintf("http://%s:4031/", vmIP)
+// waitForCmdServerReady waits up to timeout for the command server in the VM
+// to be ready.
+func waitForCmdServerReady(ctx context.Context, vmIP string, timeout time.Duration) error {
+	url := "http://" + cmdServerAddr(vmIP) + "/"
 	client := &http.Client{
 		Timeout: 5 * time.Second,
 	}
 
-	deadline := time.Now().Add(cmdServerReadyTimeout)
-	for time.Now().Before(deadline) {
+	readyCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	delay := cmdServerReadyRetryDelay
+	for {
+		req, err := http.NewRequestWithContext(readyCtx, http.MethodGet, url, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
 		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			resp, err := client.Get(url)
-			if err == nil {
-				resp.Body.Close()
-				if resp.StatusCode == http.StatusOK {
-					return nil
-				}
+		case <-readyCtx.Done():
+			if err := ctx.Err(); err != nil {
+				return err
 			}
-			time.Sleep(cmdServerReadyRetryDelay)
+			return fmt.Errorf("timeout waiting for cmd server to be ready after %s", timeout)
+		case <-time.After(delay):
 		}
+		delay = min(2*delay, cmdServerReadyMaxRetryDelay)
 	}
-	return fmt.Errorf("timeout waiting for cmd server to be ready")
 }
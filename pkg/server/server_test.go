@@ -0,0 +1,445 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/callback"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+func TestStartVM(t *testing.T) {
+	h := newTestHarness(t, nil)
+	sub := h.server.Events().Subscribe(context.Background(), 0)
+	defer sub.Close()
+
+	resp := h.startVM("vm1")
+	if resp.GetStatus() != vmStatusRunning.String() {
+		t.Errorf("status = %s, want %s", resp.GetStatus(), vmStatusRunning)
+	}
+	ip, _, err := net.ParseCIDR(resp.GetIp())
+	if err != nil {
+		t.Fatalf("ip %q: %v", resp.GetIp(), err)
+	}
+	_, subnet, _ := net.ParseCIDR(h.config.BridgeSubnet)
+	if !subnet.Contains(ip) || ip.Equal(net.ParseIP("10.20.1.1")) {
+		t.Errorf("ip = %s, want a guest address in %s", ip, subnet)
+	}
+	if cid := resp.GetCid(); cid < 3 || cid > 300 {
+		t.Errorf("cid = %d, want one in %s", cid, h.config.CIDRange)
+	}
+	if ips, cids := h.occupancy(); ips != 1 || cids != 1 {
+		t.Errorf("%d IPs and %d CIDs allocated, want 1 each", ips, cids)
+	}
+	if h.runner.ran("ip tuntap add dev "+resp.GetTapDeviceName()) != 1 {
+		t.Errorf("tap device %s wasn't created", resp.GetTapDeviceName())
+	}
+	if h.runner.ran("mkfs.ext4 "+path.Join(h.config.StateDir, "vm1", statefulDiskFilename)) != 1 {
+		t.Error("stateful disk wasn't formatted")
+	}
+	waitForEvent(t, sub, events.TypeVMCreated, "vm1")
+	waitForEvent(t, sub, events.TypeVMBooted, "vm1")
+
+	vm := h.server.getVMAtomic("vm1")
+	vm.lock.RLock()
+	version := vm.agents[agentCmdServer].Version
+	vm.lock.RUnlock()
+	if version != "fake" {
+		t.Errorf("cmdserver version = %q, want the fake guest's", version)
+	}
+	if pids := runningVMMs("vm1"); !slices.Equal(pids, []int{vm.process.Pid}) {
+		t.Errorf("VMMs running for vm1 = %v, want [%d]", pids, vm.process.Pid)
+	}
+}
+
+func TestStartVMCleansUpFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// env is the fakechv environment.
+		env       map[string]string
+		configure func(*config.ServerConfig)
+		failOn    string
+	}{
+		{
+			name:      "VMM not ready",
+			env:       map[string]string{"CBOX_FAKECHV_FAIL": "vmm.ping"},
+			configure: func(cfg *config.ServerConfig) { cfg.ChvReadyTimeout = time.Second; cfg.ReapTimeout = time.Second },
+		},
+		{name: "tap device", failOn: "ip tuntap add"},
+		{name: "tap device bridge", failOn: "ip l set dev"},
+		{name: "stateful disk", failOn: "mkfs.ext4"},
+		{name: "VM creation", env: map[string]string{"CBOX_FAKECHV_FAIL": "vm.create"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+			h := newTestHarness(t, tc.configure)
+			if tc.failOn != "" {
+				h.runner.failOn(tc.failOn)
+			}
+
+			_, err := h.server.StartVM(context.Background(), &serverapi.StartVMRequest{VmName: serverapi.PtrString("vm1")})
+			if err == nil {
+				t.Fatal("StartVM succeeded")
+			}
+			if h.server.HasVM("vm1") {
+				t.Error("failed VM was registered")
+			}
+			h.checkReleased()
+			if pids := runningVMMs("vm1"); len(pids) != 0 {
+				t.Errorf("VMMs %v still running", pids)
+			}
+			if created, deleted := h.runner.ran("ip tuntap add"), h.runner.ran("ip tuntap del"); created != deleted {
+				t.Errorf("%d tap devices created, %d deleted", created, deleted)
+			}
+
+			// Nothing is left that would stop the name being used again.
+			for key := range tc.env {
+				t.Setenv(key, "")
+			}
+			h.runner.clearFailures()
+			h.startVM("vm1")
+		})
+	}
+}
+
+func TestDestroyVM(t *testing.T) {
+	h := newTestHarness(t, nil)
+	resp := h.startVM("vm1")
+	pid := h.server.getVMAtomic("vm1").process.Pid
+
+	if _, err := h.server.DestroyVM(context.Background(), "vm1"); err != nil {
+		t.Fatalf("DestroyVM: %v", err)
+	}
+	if h.server.HasVM("vm1") {
+		t.Error("destroyed VM is still listed")
+	}
+	if !processExited(pid) {
+		t.Errorf("VMM %d still running", pid)
+	}
+	h.checkReleased()
+	if h.runner.ran("ip tuntap del dev "+resp.GetTapDeviceName()) != 1 {
+		t.Errorf("tap device %s wasn't deleted", resp.GetTapDeviceName())
+	}
+	if h.runner.ran("iptables -t nat -L PREROUTING") == 0 {
+		t.Error("the VM's iptables rules weren't cleaned up")
+	}
+	if _, err := h.server.DestroyVM(context.Background(), "vm1"); err == nil {
+		t.Error("destroying a destroyed VM succeeded")
+	}
+}
+
+func TestDestroyAllVMs(t *testing.T) {
+	h := newTestHarness(t, func(cfg *config.ServerConfig) { cfg.DestroyParallelism = 3 })
+	names := []string{"vm1", "vm2", "vm3", "vm4", "vm5"}
+	var pids []int
+	for _, name := range names {
+		h.startVM(name)
+		pids = append(pids, h.server.getVMAtomic(name).process.Pid)
+	}
+
+	resp, err := h.server.DestroyAllVMs(context.Background(), "")
+	if err != nil {
+		t.Fatalf("DestroyAllVMs: %v", err)
+	}
+	if !resp.GetSuccess() || !slices.Equal(resp.Destroyed, names) {
+		t.Errorf("DestroyAllVMs = destroyed %v, failed %+v; want all of %v", resp.Destroyed, resp.Failed, names)
+	}
+	for _, pid := range pids {
+		if !processExited(pid) {
+			t.Errorf("VMM %d still running", pid)
+		}
+	}
+	h.checkReleased()
+}
+
+func TestCrashDetection(t *testing.T) {
+	t.Setenv("CBOX_FAKECHV_EXIT_AFTER", "3s")
+	h := newTestHarness(t, nil)
+	sub := h.server.Events().Subscribe(context.Background(), 0)
+	defer sub.Close()
+
+	// The guest may only call tools, which doesn't stop the host telling
+	// the receiver about the crash.
+	received := make(chan callback.CallbackRequest, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req callback.CallbackRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		received <- req
+		json.NewEncoder(w).Encode(callback.CallbackResponse{ID: req.ID})
+	}))
+	defer receiver.Close()
+
+	h.startVM("vm1")
+	if _, err := h.server.sessionManager.RegisterHTTPCallback("vm1", receiver.URL, "", []string{"tools/*"}); err != nil {
+		t.Fatal(err)
+	}
+	crashed := waitForEvent(t, sub, events.TypeVMCrashed, "vm1")
+	if reason := crashed.Data.(map[string]any)["reason"]; reason != "VMM process exited" {
+		t.Errorf("crash reason = %v, want the VMM exiting", reason)
+	}
+	waitForEvent(t, sub, events.TypeVMCrashBundleReady, "vm1")
+	select {
+	case req := <-received:
+		if req.Method != events.TypeVMCrashBundleReady {
+			t.Errorf("receiver got %s, want %s", req.Method, events.TypeVMCrashBundleReady)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("crash bundle callback wasn't sent")
+	}
+	if stats := h.server.sessionManager.GetStats("vm1"); stats.Sent != 0 || stats.Rejected != 0 {
+		t.Errorf("callback stats = %+v, want the host's callback left out", stats)
+	}
+
+	vm := h.server.getVMAtomic("vm1")
+	vm.lock.RLock()
+	status := vm.status
+	vm.lock.RUnlock()
+	if status != vmStatusCrashed {
+		t.Errorf("status = %s, want %s", status, vmStatusCrashed)
+	}
+
+	// Crashed VMs are destroyed without their VMM's API.
+	if _, err := h.server.DestroyVM(context.Background(), "vm1"); err != nil {
+		t.Fatalf("DestroyVM of a crashed VM: %v", err)
+	}
+	h.checkReleased()
+}
+
+func TestVMExecRoutesToItsGuest(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	h.startVM("vm2")
+
+	for _, name := range []string{"vm1", "vm2"} {
+		resp, err := h.server.VMExec(context.Background(), name, &serverapi.VmExecRequest{Cmd: "echo " + name})
+		if err != nil {
+			t.Fatalf("VMExec(%s): %v", name, err)
+		}
+		ip := h.server.getVMAtomic(name).ip.IP.String()
+		if want := ip + " ran echo " + name; resp.GetOutput() != want {
+			t.Errorf("VMExec(%s) output = %q, want %q", name, resp.GetOutput(), want)
+		}
+		if resp.GetExitCode() != 0 || resp.GetTransport() != config.ExecTransportHTTP {
+			t.Errorf("VMExec(%s) = exit code %d over %s", name, resp.GetExitCode(), resp.GetTransport())
+		}
+		if cmds := guestFor(ip).ranCmds(); !slices.Equal(cmds, []string{"echo " + name}) {
+			t.Errorf("guest of %s ran %v, want only its own command", name, cmds)
+		}
+	}
+	if _, err := h.server.VMExec(context.Background(), "vm3", &serverapi.VmExecRequest{Cmd: "true"}); err == nil {
+		t.Error("VMExec on a missing VM succeeded")
+	}
+}
+
+func TestVMExecOverVsock(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		transport string
+		config    string
+		blocking  bool
+		want      string
+		code      codes.Code
+	}{
+		{"requested", config.ExecTransportVsock, config.ExecTransportHTTP, true, config.ExecTransportVsock, codes.OK},
+		{"server default", "", config.ExecTransportVsock, true, config.ExecTransportVsock, codes.OK},
+		{"requested http", config.ExecTransportHTTP, config.ExecTransportVsock, true, config.ExecTransportHTTP, codes.OK},
+		// Only blocking commands can go over vsock.
+		{"background default", "", config.ExecTransportVsock, false, config.ExecTransportHTTP, codes.OK},
+		{"background requested", config.ExecTransportVsock, config.ExecTransportHTTP, false, "", codes.InvalidArgument},
+		{"unknown", "ssh", config.ExecTransportHTTP, true, "", codes.InvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t, func(c *config.ServerConfig) { c.ExecTransport = tc.config })
+			h.startVM("vm1")
+			vm := h.server.getVMAtomic("vm1")
+			// The guest's vsockserver answers EXEC with a RunCmdResponse.
+			serveGuestVsock(t, vm.vsockPath, func(port uint32, conn net.Conn) {
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil || port != vsockServerPort {
+					return
+				}
+				if line == "VERSION\n" {
+					version, _ := json.Marshal(agentVersion{
+						Agent:           agentVsockServer,
+						Version:         "fake",
+						Protocol:        agentProtocolVersion,
+						MinHostProtocol: minAgentProtocolVersion,
+						Features:        []string{featureCallback, featureExec},
+					})
+					fmt.Fprintf(conn, "%s\n", version)
+					return
+				}
+				var req cmdserver.RunCmdRequest
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "EXEC ")), &req); err != nil || !req.Blocking {
+					fmt.Fprintf(conn, "Error: invalid EXEC request %q\n", line)
+					return
+				}
+				exitCode := 3
+				resp, _ := json.Marshal(cmdserver.RunCmdResponse{Output: "vsock ran " + req.Cmd, ExitCode: &exitCode})
+				fmt.Fprintf(conn, "%s\n", resp)
+			})
+
+			req := &serverapi.VmExecRequest{Cmd: "echo hi", Blocking: serverapi.PtrBool(tc.blocking)}
+			if tc.transport != "" {
+				req.Transport = serverapi.PtrString(tc.transport)
+			}
+			resp, err := h.server.VMExec(context.Background(), "vm1", req)
+			if status.Code(err) != tc.code {
+				t.Fatalf("VMExec = %v, want %s", err, tc.code)
+			}
+			if err != nil {
+				return
+			}
+			if resp.GetTransport() != tc.want {
+				t.Errorf("VMExec went over %q, want %q", resp.GetTransport(), tc.want)
+			}
+			ranOverHTTP := len(guestFor(vm.ip.IP.String()).ranCmds()) > 0
+			if ranOverHTTP != (tc.want == config.ExecTransportHTTP) {
+				t.Errorf("command ran over HTTP = %t over %s", ranOverHTTP, tc.want)
+			}
+			if tc.want == config.ExecTransportVsock && (resp.GetOutput() != "vsock ran echo hi" || resp.GetExitCode() != 3) {
+				t.Errorf("VMExec over vsock = %q with exit code %d", resp.GetOutput(), resp.GetExitCode())
+			}
+		})
+	}
+}
+
+func TestConcurrentStartVM(t *testing.T) {
+	h := newTestHarness(t, nil)
+	const n = 6
+
+	// Starts of the same name: exactly one creates the VM, the rest fail
+	// as it's already being started or exists.
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = h.server.StartVM(context.Background(), &serverapi.StartVMRequest{VmName: serverapi.PtrString("same")})
+		}()
+	}
+	wg.Wait()
+	started := 0
+	for _, err := range errs {
+		if err == nil {
+			started++
+		} else if status.Code(err) != codes.AlreadyExists {
+			t.Errorf("StartVM = %v, want AlreadyExists for the losers", err)
+		}
+	}
+	if started != 1 {
+		t.Errorf("%d starts of the same name succeeded, want 1", started)
+	}
+	if pids := runningVMMs("same"); len(pids) != 1 {
+		t.Errorf("VMMs running for the same name = %v, want 1", pids)
+	}
+
+	// Idempotent starts all get the one VM.
+	ips := make([]string, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := h.server.StartVM(context.Background(), &serverapi.StartVMRequest{
+				VmName:     serverapi.PtrString("idempotent"),
+				Idempotent: serverapi.PtrBool(true),
+			})
+			if err != nil {
+				t.Errorf("idempotent StartVM: %v", err)
+				return
+			}
+			ips[i] = resp.GetIp()
+		}()
+	}
+	wg.Wait()
+	if ips[0] == "" || slices.ContainsFunc(ips, func(ip string) bool { return ip != ips[0] }) {
+		t.Errorf("idempotent starts got IPs %v, want one VM's", ips)
+	}
+
+	// Starts of different names all get their own resources.
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := h.server.StartVM(context.Background(), &serverapi.StartVMRequest{VmName: serverapi.PtrString(fmt.Sprintf("vm%d", i))}); err != nil {
+				t.Errorf("StartVM(vm%d): %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if ips, cids := h.occupancy(); ips != n+2 || cids != n+2 {
+		t.Errorf("%d IPs and %d CIDs allocated, want %d each", ips, cids, n+2)
+	}
+
+	if _, err := h.server.DestroyAllVMs(context.Background(), ""); err != nil {
+		t.Fatalf("DestroyAllVMs: %v", err)
+	}
+	h.checkReleased()
+	if created, deleted := h.runner.ran("ip tuntap add"), h.runner.ran("ip tuntap del"); created != n+2 || deleted != created {
+		t.Errorf("%d tap devices created and %d deleted, want %d each", created, deleted, n+2)
+	}
+}
+
+func TestListVMDuringStatusChanges(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+
+	// Listing while the VM is paused and resumed must see one status or
+	// the other; run with -race, it also checks the reads are locked.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 20 {
+			if err := h.server.PauseVM(context.Background(), "vm1"); err != nil {
+				t.Errorf("PauseVM: %v", err)
+				return
+			}
+			if err := h.server.ResumeVM(context.Background(), "vm1"); err != nil {
+				t.Errorf("ResumeVM: %v", err)
+				return
+			}
+		}
+	}()
+	valid := []string{vmStatusRunning.String(), vmStatusPaused.String()}
+	for listing := true; listing; {
+		select {
+		case <-done:
+			listing = false
+		default:
+		}
+		resp, err := h.server.ListVM(context.Background(), "vm1")
+		if err != nil {
+			t.Fatalf("ListVM: %v", err)
+		}
+		if !slices.Contains(valid, resp.GetStatus()) {
+			t.Errorf("ListVM status = %q, want one of %v", resp.GetStatus(), valid)
+		}
+		all, err := h.server.ListAllVMs(context.Background(), "")
+		if err != nil {
+			t.Fatalf("ListAllVMs: %v", err)
+		}
+		if len(all.Vms) != 1 || !slices.Contains(valid, all.Vms[0].GetStatus()) {
+			t.Errorf("ListAllVMs = %+v, want vm1 running or paused", all.Vms)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+const shellDialTimeout = 10 * time.Second
+
+// ShellConn is an interactive shell session in a guest, served by its
+// cmdserver, that a client's WebSocket can be piped to.
+type ShellConn struct {
+	vmName      string
+	guest       *websocket.Conn
+	active      *atomic.Int32
+	idleTimeout time.Duration
+	closeOnce   sync.Once
+}
+
+// OpenShell starts a shell session in a VM. The VM must have fewer than
+// max_shells_per_vm sessions open.
+func (s *Server) OpenShell(ctx context.Context, vmName string) (*ShellConn, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return nil, err
+	}
+	if err := vm.requireAgentFeature(ctx, agentCmdServer, featureShell); err != nil {
+		return nil, err
+	}
+
+	maxShells := s.config.MaxShellsPerVM
+	if int(vm.shells.Add(1)) > maxShells {
+		vm.shells.Add(-1)
+		return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("vm %s already has %d shell sessions", vmName, maxShells))
+	}
+
+	config, err := websocket.NewConfig("ws://"+cmdServerAddr(vm.ip.IP.String())+"/shell", "http://localhost/")
+	if err != nil {
+		vm.shells.Add(-1)
+		return nil, fmt.Errorf("failed to configure shell connection: %w", err)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, shellDialTimeout)
+	defer cancel()
+	guest, err := config.DialContext(dialCtx)
+	if err != nil {
+		vm.shells.Add(-1)
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("failed to open shell: %v", err))
+	}
+	return &ShellConn{
+		vmName:      vmName,
+		guest:       guest,
+		active:      &vm.shells,
+		idleTimeout: s.config.ShellIdleTimeout,
+	}, nil
+}
+
+// Pipe relays frames between client and the guest's shell until either side
+// disconnects or nothing is sent either way for the idle timeout, then
+// closes both, which kills the shell.
+func (c *ShellConn) Pipe(client *websocket.Conn) {
+	defer client.Close()
+	defer c.Close()
+
+	logger := log.WithField("vmName", c.vmName)
+	logger.Info("shell session opened")
+
+	idle := time.AfterFunc(c.idleTimeout, func() {
+		logger.WithField("idleTimeout", c.idleTimeout).Info("closing idle shell session")
+		client.Close()
+		c.guest.Close()
+	})
+	defer idle.Stop()
+	relay := func(dst *websocket.Conn, src *websocket.Conn) {
+		for {
+			var frame cmdserver.ShellFrame
+			if err := cmdserver.ShellFrameCodec.Receive(src, &frame); err != nil {
+				return
+			}
+			idle.Reset(c.idleTimeout)
+			if err := cmdserver.ShellFrameCodec.Send(dst, frame); err != nil {
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relay(c.guest, client)
+		// Unblock the other direction.
+		c.guest.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		relay(client, c.guest)
+		client.Close()
+	}()
+	wg.Wait()
+	logger.Info("shell session closed")
+}
+
+// Close closes the guest connection and releases the VM's shell slot.
+func (c *ShellConn) Close() {
+	c.closeOnce.Do(func() {
+		c.guest.Close()
+		c.active.Add(-1)
+	})
+}
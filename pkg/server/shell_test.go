@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+	"github.com/abilashraghuram/cbox/pkg/config"
+)
+
+// dialShell opens a shell session in vmName through an httptest server that
+// pipes it to a WebSocket, as the restserver does.
+func dialShell(t *testing.T, h *testHarness, vmName string) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shell, err := h.server.OpenShell(r.Context(), vmName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		websocket.Server{Handler: shell.Pipe}.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	client, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("dialing shell: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// roundTrip sends frame on a shell session and checks the guest echoes it.
+func roundTrip(t *testing.T, client *websocket.Conn, frame cmdserver.ShellFrame) {
+	t.Helper()
+	if err := cmdserver.ShellFrameCodec.Send(client, frame); err != nil {
+		t.Fatalf("sending %q: %v", frame.Data, err)
+	}
+	var got cmdserver.ShellFrame
+	if err := cmdserver.ShellFrameCodec.Receive(client, &got); err != nil {
+		t.Fatalf("receiving %q: %v", frame.Data, err)
+	}
+	if got.PayloadType != frame.PayloadType || string(got.Data) != string(frame.Data) {
+		t.Errorf("echo = %+v, want %+v", got, frame)
+	}
+}
+
+// waitForClosed waits for client's session to be closed by the server.
+func waitForClosed(t *testing.T, client *websocket.Conn) {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var frame cmdserver.ShellFrame
+		err := cmdserver.ShellFrameCodec.Receive(client, &frame)
+		if err == nil {
+			continue
+		}
+		if strings.Contains(err.Error(), "timeout") {
+			t.Fatal("shell session wasn't closed")
+		}
+		return
+	}
+}
+
+// waitForShells waits until vmName has want shell sessions open, as the
+// server and its guest count them.
+func waitForShells(t *testing.T, h *testHarness, vmName string, want int) {
+	t.Helper()
+	vm := h.server.getVMAtomic(vmName)
+	guest := guestFor(vm.ip.IP.String())
+	deadline := time.Now().Add(5 * time.Second)
+	for int(vm.shells.Load()) != want || guest.openShells() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d shells, its guest %d, want %d", vmName, vm.shells.Load(), guest.openShells(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShellRelaysFrames(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	client := dialShell(t, h, "vm1")
+	waitForShells(t, h, "vm1", 1)
+
+	// Terminal bytes and control messages keep their payload types.
+	roundTrip(t, client, cmdserver.ShellFrame{PayloadType: websocket.BinaryFrame, Data: []byte("ls\r")})
+	roundTrip(t, client, cmdserver.ShellFrame{PayloadType: websocket.TextFrame, Data: []byte(`{"type":"resize","cols":80,"rows":24}`)})
+
+	// The guest ending the session closes the client's.
+	if err := cmdserver.ShellFrameCodec.Send(client, cmdserver.ShellFrame{PayloadType: websocket.BinaryFrame, Data: []byte("exit\n")}); err != nil {
+		t.Fatal(err)
+	}
+	waitForClosed(t, client)
+	waitForShells(t, h, "vm1", 0)
+}
+
+func TestShellClosedOnClientDisconnect(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	client := dialShell(t, h, "vm1")
+	roundTrip(t, client, cmdserver.ShellFrame{PayloadType: websocket.BinaryFrame, Data: []byte("sleep 600\r")})
+
+	// The guest's session, and with it the shell, goes with the client.
+	client.Close()
+	waitForShells(t, h, "vm1", 0)
+}
+
+func TestShellIdleTimeout(t *testing.T) {
+	h := newTestHarness(t, func(c *config.ServerConfig) { c.ShellIdleTimeout = 200 * time.Millisecond })
+	h.startVM("vm1")
+	client := dialShell(t, h, "vm1")
+
+	// Frames either way keep the session open past the timeout.
+	for range 5 {
+		roundTrip(t, client, cmdserver.ShellFrame{PayloadType: websocket.BinaryFrame, Data: []byte("\r")})
+		time.Sleep(100 * time.Millisecond)
+	}
+	waitForShells(t, h, "vm1", 1)
+
+	waitForClosed(t, client)
+	waitForShells(t, h, "vm1", 0)
+}
+
+func TestShellLimit(t *testing.T) {
+	h := newTestHarness(t, func(c *config.ServerConfig) { c.MaxShellsPerVM = 2 })
+	h.startVM("vm1")
+	h.startVM("vm2")
+	first := dialShell(t, h, "vm1")
+	dialShell(t, h, "vm1")
+	waitForShells(t, h, "vm1", 2)
+
+	if _, err := h.server.OpenShell(context.Background(), "vm1"); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("OpenShell past max_shells_per_vm = %v, want ResourceExhausted", err)
+	}
+	// The limit is per VM.
+	dialShell(t, h, "vm2")
+
+	// A closed session frees its slot.
+	first.Close()
+	waitForShells(t, h, "vm1", 1)
+	dialShell(t, h, "vm1")
+	waitForShells(t, h, "vm1", 2)
+}
+
+func TestShellUnsupportedAgent(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	vm := useGuestAgent(h, &agentVersion{
+		Agent:           agentCmdServer,
+		Version:         "0.9",
+		Protocol:        agentProtocolVersion,
+		MinHostProtocol: minAgentProtocolVersion,
+		Features:        []string{featureExec},
+	})
+	var unsupported *UnsupportedAgentError
+	if _, err := h.server.OpenShell(context.Background(), "vm1"); !errors.As(err, &unsupported) || unsupported.Feature != featureShell {
+		t.Fatalf("OpenShell on an agent without shells = %v, want it unsupported", err)
+	}
+	if got := vm.shells.Load(); got != 0 {
+		t.Errorf("shells = %d after a failed open, want 0", got)
+	}
+}
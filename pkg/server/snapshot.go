@@ -0,0 +1,520 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gvisor.dev/gvisor/pkg/cleanup"
+
+	"github.com/abilashraghuram/cbox/out/gen/chvapi"
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+const (
+	snapshotsDirName     = "_snapshots"
+	snapshotMetaFilename = "cbox-snapshot.json"
+	// snapshotConfigFilename is the VMM config cloud-hypervisor saves in a
+	// snapshot and reads back on restore.
+	snapshotConfigFilename = "config.json"
+	// restoreDirName is where a restored VM's rewritten snapshot config is
+	// put together, inside its state dir.
+	restoreDirName = "restore"
+	opSnapshot     = "snapshot"
+	// snapshotEstimate is how long a snapshot is expected to hold the VM,
+	// reported to traffic queued behind it.
+	snapshotEstimate = time.Minute
+)
+
+// snapshotMeta is what cbox saves next to cloud-hypervisor's own snapshot
+// files to recreate the VM around them.
+type snapshotMeta struct {
+	VMName    string    `json:"vmName"`
+	CreatedAt time.Time `json:"createdAt"`
+	// IP is the guest IP in CIDR notation. The guest keeps using it after a
+	// restore, so it's claimed again rather than reallocated.
+	IP         string `json:"ip"`
+	ExternalIP bool   `json:"externalIp,omitempty"`
+	// TapDevice is only kept for external tap devices, which are adopted
+	// again. Others are recreated.
+	TapDevice        string            `json:"tapDevice,omitempty"`
+	CID              uint32            `json:"cid"`
+	StatefulDiskPath string            `json:"statefulDiskPath"`
+	SerialMode       string            `json:"serialMode"`
+	Kernel           string            `json:"kernel"`
+	Initramfs        string            `json:"initramfs"`
+	Rootfs           string            `json:"rootfs"`
+	KernelCmdline    string            `json:"kernelCmdline,omitempty"`
+	Profile          string            `json:"profile,omitempty"`
+	Template         string            `json:"template,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	CPUAffinity      [][]int           `json:"cpuAffinity,omitempty"`
+	NUMANode         *int32            `json:"numaNode,omitempty"`
+	Resources        vmResources       `json:"resources"`
+}
+
+func (s *Server) snapshotsDir() string {
+	return path.Join(s.config.StateDir, snapshotsDirName)
+}
+
+// snapshotPath resolves dir, relative to the snapshots dir unless it's
+// absolute, and checks that it's inside the snapshots dir.
+func (s *Server) snapshotPath(dir string) (string, error) {
+	if dir == "" {
+		return "", status.Error(codes.InvalidArgument, "snapshot dir is required")
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(s.snapshotsDir(), dir)
+	}
+	dir = filepath.Clean(dir)
+	if !strings.HasPrefix(dir, s.snapshotsDir()+"/") {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("snapshot dir must be inside %s", s.snapshotsDir()))
+	}
+	return dir, nil
+}
+
+func readSnapshotMeta(dir string) (*snapshotMeta, error) {
+	data, err := os.ReadFile(path.Join(dir, snapshotMetaFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("snapshot not found: %s", dir))
+		}
+		return nil, err
+	}
+	var meta snapshotMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+// SnapshotVM saves a VM's memory, device state and stateful disk to destDir,
+// relative to the snapshots dir unless absolute. A running VM is paused for
+// the duration and resumed afterwards; a paused one is left paused.
+func (s *Server) SnapshotVM(ctx context.Context, vmName string, destDir string) (*serverapi.Snapshot, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if destDir == "" {
+		destDir = fmt.Sprintf("%s-%s", vmName, time.Now().UTC().Format(archiveTimestampFormat))
+	}
+	dir, err := s.snapshotPath(destDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return nil, err
+	}
+
+	release, err := vm.gate.acquireExclusive(ctx, vmName, opSnapshot, snapshotEstimate)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	vm.lock.RLock()
+	vmStatus := vm.status
+	rootfsOverlay := vm.rootfsOverlay
+	meta := &snapshotMeta{
+		VMName:           vmName,
+		IP:               vm.ip.String(),
+		ExternalIP:       vm.externalIP,
+		CID:              vm.cid,
+		StatefulDiskPath: vm.statefulDiskPath,
+		SerialMode:       vm.serialMode,
+		Kernel:           vm.kernelPath,
+		Initramfs:        vm.initramfsPath,
+		Rootfs:           vm.rootfsPath,
+		KernelCmdline:    vm.kernelCmdline,
+		Profile:          vm.profile,
+		Template:         vm.template,
+		Labels:           maps.Clone(vm.labels),
+		CPUAffinity:      vm.cpuAffinity,
+		NUMANode:         vm.numaNode,
+		Resources:        vm.resources,
+	}
+	if vm.tapDevice.External {
+		meta.TapDevice = vm.tapDevice.Name
+	}
+	vm.lock.RUnlock()
+	if vmStatus != vmStatusRunning && vmStatus != vmStatusFailedProvisioning && vmStatus != vmStatusPaused {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("cannot snapshot vm %s: vm is %s", vmName, vmStatus))
+	}
+	// Only the stateful disk is copied, so the overlay's writes would be lost.
+	if rootfsOverlay {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("cannot snapshot vm %s: vm runs on a rootfs overlay", vmName))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshots dir: %w", err)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if os.IsExist(err) {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("snapshot dir already exists: %s", dir))
+		}
+		return nil, fmt.Errorf("failed to create snapshot dir: %w", err)
+	}
+	cleanup := cleanup.Make(func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.WithError(err).Errorf("failed to remove snapshot dir: %s", dir)
+		}
+	})
+	defer cleanup.Clean()
+
+	logger := log.WithFields(log.Fields{
+		"vmName":      vmName,
+		"snapshotDir": dir,
+	})
+	// The disk is copied while the guest is paused so it matches memory.
+	if vmStatus != vmStatusPaused {
+		if err := vm.pauseVMM(ctx, true); err != nil {
+			return nil, err
+		}
+		defer func() {
+			// Resume even if ctx is done, or the VM would be left paused.
+			if err := vm.pauseVMM(context.Background(), false); err != nil {
+				logger.WithError(err).Error("failed to resume VM after snapshot, leaving it paused")
+				vm.lock.Lock()
+				vm.status = vmStatusPaused
+				vm.lock.Unlock()
+			}
+		}()
+	}
+
+	resp, err := vm.apiClient.DefaultAPI.VmSnapshotPut(ctx).VmSnapshotConfig(chvapi.VmSnapshotConfig{
+		DestinationUrl: String("file://" + dir),
+	}).Execute()
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot VM: %w", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("failed to snapshot VM. bad status: %v", resp)
+	}
+	if err := cloneStatefulDisk(vm.statefulDiskPath, path.Join(dir, statefulDiskFilename)); err != nil {
+		return nil, err
+	}
+
+	meta.CreatedAt = time.Now().UTC()
+	data, err := json.Marshal(meta)
+	if err == nil {
+		err = os.WriteFile(path.Join(dir, snapshotMetaFilename), data, 0644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write snapshot metadata: %w", err)
+	}
+
+	cleanup.Release()
+	logger.Info("VM snapshotted")
+	s.events.Publish(events.TypeVMSnapshotted, vmName, map[string]any{
+		"snapshotDir": dir,
+	})
+	return &serverapi.Snapshot{
+		VmName:      serverapi.PtrString(vmName),
+		SnapshotDir: serverapi.PtrString(dir),
+		CreatedAt:   serverapi.PtrTime(meta.CreatedAt),
+	}, nil
+}
+
+// snapshotRewrite holds the paths and devices a restored VM uses in place
+// of the ones saved in its snapshot.
+type snapshotRewrite struct {
+	oldStatefulDiskPath string
+	statefulDiskPath    string
+	tapDevice           string
+	vsockPath           string
+	cid                 uint32
+	serialSocketPath    string
+}
+
+// rewriteSnapshotConfig points a VMM config saved in a snapshot at the
+// restored VM's stateful disk, tap device and sockets. Fields cbox doesn't
+// know about are kept as they are.
+func rewriteSnapshotConfig(data []byte, rw snapshotRewrite) ([]byte, error) {
+	// Numbers are kept as written, so large ones like memory sizes survive.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var config map[string]any
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot config: %w", err)
+	}
+	disks, _ := config["disks"].([]any)
+	for _, disk := range disks {
+		if disk, ok := disk.(map[string]any); ok && disk["path"] == rw.oldStatefulDiskPath {
+			disk["path"] = rw.statefulDiskPath
+		}
+	}
+	nets, _ := config["net"].([]any)
+	for _, netConfig := range nets {
+		if netConfig, ok := netConfig.(map[string]any); ok && netConfig["id"] == netDeviceId {
+			netConfig["tap"] = rw.tapDevice
+		}
+	}
+	if vsock, ok := config["vsock"].(map[string]any); ok {
+		vsock["socket"] = rw.vsockPath
+		vsock["cid"] = rw.cid
+	}
+	if serial, ok := config["serial"].(map[string]any); ok && rw.serialSocketPath != "" {
+		serial["socket"] = rw.serialSocketPath
+	}
+	return json.Marshal(config)
+}
+
+// prepareRestoreDir lays out a snapshot for restoring into vmStateDir: the
+// VMM config is rewritten per rw, and the other snapshot files are linked
+// rather than copied, since guest memory can be large.
+func prepareRestoreDir(snapshotDir string, vmStateDir string, rw snapshotRewrite) (string, error) {
+	restoreDir := path.Join(vmStateDir, restoreDirName)
+	if err := os.Mkdir(restoreDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create restore dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(snapshotDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read snapshot dir: %w", err)
+	}
+	for _, entry := range entries {
+		switch entry.Name() {
+		case snapshotMetaFilename, statefulDiskFilename:
+			continue
+		case snapshotConfigFilename:
+			data, err := os.ReadFile(path.Join(snapshotDir, entry.Name()))
+			if err != nil {
+				return "", fmt.Errorf("failed to read snapshot config: %w", err)
+			}
+			data, err = rewriteSnapshotConfig(data, rw)
+			if err != nil {
+				return "", err
+			}
+			if err := os.WriteFile(path.Join(restoreDir, entry.Name()), data, 0644); err != nil {
+				return "", fmt.Errorf("failed to write snapshot config: %w", err)
+			}
+		default:
+			if err := os.Symlink(path.Join(snapshotDir, entry.Name()), path.Join(restoreDir, entry.Name())); err != nil {
+				return "", fmt.Errorf("failed to link snapshot file: %w", err)
+			}
+		}
+	}
+	return restoreDir, nil
+}
+
+// RestoreVM recreates a VM from a snapshot taken by SnapshotVM, under
+// vmName, or the snapshotted VM's name if empty. The VM gets back its guest
+// IP and CID, a new tap device and a copy of the snapshot's stateful disk,
+// and is resumed. It fails with AlreadyExists if a VM with the name exists,
+// or if its IP or CID have been given to another VM since.
+func (s *Server) RestoreVM(ctx context.Context, vmName string, snapshotDir string) (_ *serverapi.StartVMResponse, retErr error) {
+	dir, err := s.snapshotPath(snapshotDir)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readSnapshotMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	if vmName == "" {
+		vmName = meta.VMName
+	}
+	if reservedVMName(vmName) || strings.ContainsRune(vmName, '/') {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid vmName: %q", vmName))
+	}
+	release, other := s.reserveStart(vmName)
+	if other != nil {
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("vm %s is already being started", vmName))
+	}
+	defer release()
+	if s.getVMAtomic(vmName) != nil {
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("vm already exists: %s", vmName))
+	}
+	if err := s.checkMaxVMs(); err != nil {
+		return nil, err
+	}
+	ip, ipNet, err := net.ParseCIDR(meta.IP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip in snapshot metadata: %w", err)
+	}
+	guestIP := &net.IPNet{IP: ip, Mask: ipNet.Mask}
+
+	logger := log.WithFields(log.Fields{
+		"vmName":      vmName,
+		"snapshotDir": dir,
+	})
+	logger.Info("Restoring VM")
+
+	cleanup := cleanup.Make(func() {
+		logger.Info("restore VM clean up done")
+	})
+	defer cleanup.Clean()
+
+	vmStateDir := getVmStateDirPath(s.config.StateDir, vmName)
+	if err := os.Mkdir(vmStateDir, 0755); err != nil {
+		if os.IsExist(err) {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("vm already exists: %s", vmName))
+		}
+		return nil, fmt.Errorf("failed to create vm state dir: %w", err)
+	}
+	cleanup.Add(func() {
+		s.disposeStateDir(&vm{
+			name:             vmName,
+			stateDirPath:     vmStateDir,
+			statefulDiskPath: path.Join(vmStateDir, statefulDiskFilename),
+		})
+	})
+
+	logFilePath := path.Join(vmStateDir, vmLogFilename)
+	// Runs before the cleanup stack so the log is still in place.
+	defer func() {
+		if retErr != nil {
+			retErr = s.withHypervisorLogTail(vmName, logFilePath, retErr)
+		}
+	}()
+
+	apiSocketPath, apiClient, process, err := s.spawnVMM(ctx, vmName, vmStateDir, s.config.ChvReadyTimeout, &cleanup)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &NetworkPlan{CID: meta.CID}
+	if meta.ExternalIP {
+		plan.ExternalTapDevice = meta.TapDevice
+		plan.ExternalIP = guestIP
+	} else {
+		plan.IP = guestIP
+	}
+	attachment, err := s.network.Apply(vmName, plan)
+	if err != nil {
+		return nil, err
+	}
+	cleanup.Add(func() {
+		if err := s.network.Release(vmName); err != nil {
+			logger.WithError(err).Error("failed to release network attachment")
+		}
+	})
+
+	vsockPath := path.Join(vmStateDir, "vsock.sock")
+	callbackListener, err := s.listenVsockCallbacks(vmName, vsockPath)
+	if err != nil {
+		return nil, err
+	}
+	cleanup.Add(func() {
+		callbackListener.Close()
+	})
+	artifactListener, err := s.listenArtifacts(vmName, vsockPath, vmStateDir)
+	if err != nil {
+		return nil, err
+	}
+	cleanup.Add(func() {
+		artifactListener.Close()
+	})
+
+	statefulDiskPath := path.Join(vmStateDir, statefulDiskFilename)
+	if err := cloneStatefulDisk(path.Join(dir, statefulDiskFilename), statefulDiskPath); err != nil {
+		return nil, err
+	}
+	var serialSocketPath string
+	if meta.SerialMode == serialModeSocket {
+		serialSocketPath = path.Join(vmStateDir, serialSocketFilename)
+	}
+
+	restoreDir, err := prepareRestoreDir(dir, vmStateDir, snapshotRewrite{
+		oldStatefulDiskPath: meta.StatefulDiskPath,
+		statefulDiskPath:    statefulDiskPath,
+		tapDevice:           attachment.TapDevice.Name,
+		vsockPath:           vsockPath,
+		cid:                 attachment.CID,
+		serialSocketPath:    serialSocketPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Only needed while the VMM reads the snapshot in.
+	defer os.RemoveAll(restoreDir)
+
+	resp, err := apiClient.DefaultAPI.VmRestorePut(ctx).RestoreConfig(chvapi.RestoreConfig{
+		SourceUrl: "file://" + restoreDir,
+	}).Execute()
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore VM: %w", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("failed to restore VM. bad status: %v", resp)
+	}
+
+	restored := &vm{
+		name:             vmName,
+		stateDirPath:     vmStateDir,
+		apiSocketPath:    apiSocketPath,
+		apiClient:        apiClient,
+		process:          process,
+		ip:               attachment.IP,
+		tapDevice:        attachment.TapDevice,
+		externalIP:       attachment.ExternalIP,
+		status:           vmStatusRunning,
+		vsockPath:        vsockPath,
+		cid:              attachment.CID,
+		statefulDiskPath: statefulDiskPath,
+		serialMode:       meta.SerialMode,
+		serialSocketPath: serialSocketPath,
+		callbackListener: callbackListener,
+		artifactListener: artifactListener,
+		gate:             newOpGate(),
+		kernelPath:       meta.Kernel,
+		initramfsPath:    meta.Initramfs,
+		rootfsPath:       meta.Rootfs,
+		kernelCmdline:    meta.KernelCmdline,
+		profile:          meta.Profile,
+		template:         meta.Template,
+		cpuAffinity:      meta.CPUAffinity,
+		numaNode:         meta.NUMANode,
+		labels:           meta.Labels,
+		resources:        meta.Resources,
+		crashMonitorDone: make(chan struct{}),
+		readyTimeout:     s.config.CmdServerReadyTimeout,
+		reapTimeout:      s.config.ReapTimeout,
+	}
+	// cloud-hypervisor restores VMs paused.
+	if err := restored.pauseVMM(ctx, false); err != nil {
+		return nil, err
+	}
+	if err := restored.saveRecord(); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	if _, exists := s.vms[vmName]; exists {
+		s.lock.Unlock()
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("vm already exists: %s", vmName))
+	}
+	s.vms[vmName] = restored
+	s.lock.Unlock()
+	cleanup.Release()
+
+	logger.WithField("vmIP", attachment.IP.String()).Info("VM restored")
+	s.events.Publish(events.TypeVMRestored, vmName, map[string]any{
+		"snapshotDir": dir,
+	})
+	s.startCrashMonitor(restored)
+	restored.refreshAgentVersions(ctx)
+
+	return &serverapi.StartVMResponse{
+		VmName:        serverapi.PtrString(vmName),
+		Ip:            serverapi.PtrString(attachment.IP.String()),
+		Status:        serverapi.PtrString(vmStatusRunning.String()),
+		TapDeviceName: serverapi.PtrString(attachment.TapDevice.Name),
+		Cid:           serverapi.PtrInt64(int64(restored.cid)),
+		VsockPath:     serverapi.PtrString(restored.vsockPath),
+	}, nil
+}
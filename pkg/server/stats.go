@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+)
+
+const (
+	// statsTimeout bounds the cloud-hypervisor API calls of collecting a
+	// VM's stats.
+	statsTimeout = 5 * time.Second
+	// clockTicksPerSecond is the unit of the CPU times in /proc/<pid>/stat.
+	// The kernel always reports them in USER_HZ, which is 100 on Linux.
+	clockTicksPerSecond = 100
+
+	sysClassNetDir = "/sys/class/net"
+)
+
+// GetVMStats returns the resource usage of a VM. Sources that can't be read
+// are listed in the stats' errors rather than failing the call.
+func (s *Server) GetVMStats(ctx context.Context, vmName string) (*serverapi.VmStats, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	return vm.stats(ctx), nil
+}
+
+// GetAllVMStats returns the resource usage of all VMs, collected
+// concurrently.
+func (s *Server) GetAllVMStats(ctx context.Context) (*serverapi.ListVMStatsResponse, error) {
+	s.lock.RLock()
+	vms := make([]*vm, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	s.lock.RUnlock()
+	sort.Slice(vms, func(i, j int) bool { return vms[i].name < vms[j].name })
+
+	resp := &serverapi.ListVMStatsResponse{Vms: make([]serverapi.VmStats, len(vms))}
+	var wg sync.WaitGroup
+	for i, vm := range vms {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp.Vms[i] = *vm.stats(ctx)
+		}()
+	}
+	wg.Wait()
+	return resp, nil
+}
+
+// stats collects the VM's stats from cloud-hypervisor and from the host.
+func (v *vm) stats(ctx context.Context) *serverapi.VmStats {
+	stats := &serverapi.VmStats{
+		VmName:      serverapi.PtrString(v.name),
+		CollectedAt: serverapi.PtrTime(time.Now().UTC()),
+	}
+	inFlight, queued := v.execs.counts()
+	stats.ExecsInFlight = serverapi.PtrInt32(int32(inFlight))
+	stats.ExecsQueued = serverapi.PtrInt32(int32(queued))
+	addError := func(source string, err error) {
+		stats.Errors = append(stats.Errors, fmt.Sprintf("%s: %v", source, err))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, statsTimeout)
+	defer cancel()
+	if info, _, err := v.apiClient.DefaultAPI.VmInfoGet(ctx).Execute(); err != nil {
+		addError("vm info", err)
+	} else {
+		if cpus := info.Config.Cpus; cpus != nil {
+			stats.Vcpus = serverapi.PtrInt32(cpus.BootVcpus)
+		}
+		if memory := info.Config.Memory; memory != nil {
+			configured := memory.Size
+			if memory.HotpluggedSize != nil {
+				configured += *memory.HotpluggedSize
+			}
+			stats.MemoryConfiguredBytes = serverapi.PtrInt64(configured)
+		}
+		stats.MemoryActualBytes = info.MemoryActualSize
+	}
+	if counters, _, err := v.apiClient.DefaultAPI.VmCountersGet(ctx).Execute(); err != nil {
+		addError("counters", err)
+	} else if counters != nil {
+		counters := map[string]map[string]int64(*counters)
+		stats.Counters = &counters
+	}
+
+	if v.process != nil {
+		if rss, err := readProcessRSS(v.process.Pid); err != nil {
+			addError("vmm rss", err)
+		} else {
+			stats.HostRssBytes = serverapi.PtrInt64(rss)
+		}
+		if cpu, err := readProcessCPUTime(v.process.Pid); err != nil {
+			addError("vmm cpu time", err)
+		} else {
+			stats.HostCpuSeconds = serverapi.PtrFloat64(cpu.Seconds())
+		}
+	}
+	if v.tapDevice != nil {
+		if network, err := readTapStats(v.tapDevice.Name); err != nil {
+			addError("tap device", err)
+		} else {
+			stats.Network = network
+		}
+	}
+	return stats
+}
+
+// readProcessRSS returns the resident memory of process pid.
+func readProcessRSS(pid int) (int64, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "VmRSS:")
+		if !ok {
+			continue
+		}
+		kb, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "kB")), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid VmRSS %q: %w", value, err)
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no VmRSS in /proc/%d/status", pid)
+}
+
+// readProcessCPUTime returns the user and system CPU time used by process
+// pid, all its threads included.
+func readProcessCPUTime(pid int) (time.Duration, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name can contain spaces and parentheses, so fields are
+	// counted from its closing parenthesis: utime and stime are the 14th
+	// and 15th fields, the 12th and 13th after it.
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	var ticks int64
+	for _, field := range fields[11:13] {
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid /proc/%d/stat: %w", pid, err)
+		}
+		ticks += n
+	}
+	return time.Duration(ticks) * time.Second / clockTicksPerSecond, nil
+}
+
+// readTapStats returns the byte and packet counts of tap device name.
+func readTapStats(name string) (*serverapi.VmNetworkStats, error) {
+	statsDir := path.Join(sysClassNetDir, name, "statistics")
+	read := func(counter string) (*int64, error) {
+		data, err := os.ReadFile(path.Join(statsDir, counter))
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", counter, err)
+		}
+		return &n, nil
+	}
+
+	network := &serverapi.VmNetworkStats{}
+	for counter, field := range map[string]**int64{
+		"rx_bytes":   &network.RxBytes,
+		"tx_bytes":   &network.TxBytes,
+		"rx_packets": &network.RxPackets,
+		"tx_packets": &network.TxPackets,
+		"rx_dropped": &network.RxDropped,
+		"tx_dropped": &network.TxDropped,
+	} {
+		n, err := read(counter)
+		if err != nil {
+			return nil, err
+		}
+		*field = n
+	}
+	return network, nil
+}
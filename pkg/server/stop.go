@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/pkg/events"
+)
+
+const (
+	opStop = "stop"
+	// stopTimeout bounds stopping a VM, including waiting for in-flight
+	// guest traffic to drain and for the VMM to settle.
+	stopTimeout = 30 * time.Second
+	// stopPollInterval is how often the VMM is asked whether the VM is down.
+	stopPollInterval = 100 * time.Millisecond
+	// chvStateRunning is the vm.info state of a booted guest.
+	chvStateRunning = "Running"
+)
+
+// StopVM shuts down a VM's guest but keeps the VMM, the state directory,
+// the stateful disk, the tap device and the IP, so a later StartVM for the
+// same name boots it again with its data and address intact. Stopping a
+// stopped VM succeeds without doing anything.
+func (s *Server) StopVM(ctx context.Context, vmName string) error {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, stopTimeout)
+	defer cancel()
+	release, err := vm.gate.acquireExclusive(ctx, vmName, opStop, stopTimeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	switch vm.status {
+	case vmStatusStopped:
+		return nil
+	case vmStatusRunning, vmStatusFailedProvisioning:
+	default:
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("cannot %s vm %s: vm is %s", opStop, vmName, vm.status))
+	}
+
+	resp, err := vm.apiClient.DefaultAPI.ShutdownVM(ctx).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to shut down VM: %w", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed to shut down VM. bad status: %v", resp)
+	}
+	if err := vm.waitForShutdown(ctx); err != nil {
+		return err
+	}
+
+	// Set while vm.lock is still held, so the crash monitor doesn't take
+	// the shutdown for a crash.
+	vm.status = vmStatusStopped
+	log.Infof("Successfully stopped VM: %s", vmName)
+	s.events.Publish(events.TypeVMStopped, vmName, nil)
+	return nil
+}
+
+// waitForShutdown waits for the VMM to report the guest is no longer
+// running.
+func (v *vm) waitForShutdown(ctx context.Context) error {
+	ticker := time.NewTicker(stopPollInterval)
+	defer ticker.Stop()
+	for {
+		info, _, err := v.apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+		if err == nil && info.GetState() != chvStateRunning {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("vm did not shut down: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/hostcmd"
+)
+
+const (
+	templatesDirName     = "_templates"
+	templateMetaFilename = "template.json"
+	opConvertToTemplate  = "convert-to-template"
+	maxInstantiateCount  = 64
+)
+
+// templateMeta is persisted next to a template's disk.
+type templateMeta struct {
+	Name      string    `json:"name"`
+	SourceVM  string    `json:"sourceVm"`
+	CreatedAt time.Time `json:"createdAt"`
+	Kernel    string    `json:"kernel"`
+	Initramfs string    `json:"initramfs"`
+	Rootfs    string    `json:"rootfs"`
+}
+
+func (s *Server) templatesDir() string {
+	return path.Join(s.config.StateDir, templatesDirName)
+}
+
+func (s *Server) templateDir(name string) string {
+	return path.Join(s.templatesDir(), name)
+}
+
+// cloneStatefulDisk copies a stateful disk, sharing extents with src where
+// the filesystem supports reflinks. The copy is writable even if src isn't.
+func cloneStatefulDisk(src string, dst string) error {
+	log.Infof("Cloning stateful disk %s to %s", src, dst)
+	if err := hostcmd.Run("cp", "--reflink=auto", "--sparse=always", src, dst); err != nil {
+		return fmt.Errorf("failed to clone stateful disk: %w", err)
+	}
+	return os.Chmod(dst, 0644)
+}
+
+func (s *Server) readTemplateMeta(name string) (*templateMeta, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid template name: %q", name))
+	}
+	data, err := os.ReadFile(path.Join(s.templateDir(name), templateMetaFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("template not found: %s", name))
+		}
+		return nil, err
+	}
+	var meta templateMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse template metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+// templateDescendants returns the running VMs instantiated from template.
+func (s *Server) templateDescendants(template string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	descendants := []string{}
+	for name, vm := range s.vms {
+		vm.lock.RLock()
+		if vm.template == template {
+			descendants = append(descendants, name)
+		}
+		vm.lock.RUnlock()
+	}
+	sort.Strings(descendants)
+	return descendants
+}
+
+func (s *Server) templateToAPI(meta *templateMeta) *serverapi.Template {
+	t := &serverapi.Template{
+		Name:        serverapi.PtrString(meta.Name),
+		SourceVm:    serverapi.PtrString(meta.SourceVM),
+		CreatedAt:   serverapi.PtrTime(meta.CreatedAt),
+		Kernel:      serverapi.PtrString(meta.Kernel),
+		Initramfs:   serverapi.PtrString(meta.Initramfs),
+		Rootfs:      serverapi.PtrString(meta.Rootfs),
+		Descendants: s.templateDescendants(meta.Name),
+	}
+	if info, err := os.Stat(path.Join(s.templateDir(meta.Name), statefulDiskFilename)); err == nil {
+		t.DiskSizeBytes = serverapi.PtrInt64(info.Size())
+	}
+	return t
+}
+
+// listTemplateNames returns the names of all templates on disk.
+func (s *Server) listTemplateNames() ([]string, error) {
+	entries, err := os.ReadDir(s.templatesDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// ConvertToTemplate stops a VM and keeps its stateful disk, read-only, as a
+// template of the same name. The VM is destroyed in the process.
+func (s *Server) ConvertToTemplate(ctx context.Context, vmName string) (*serverapi.Template, error) {
+	source := s.getVMAtomic(vmName)
+	if source == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if err := checkLease(ctx, source); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(s.templateDir(vmName)); err == nil {
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("template already exists: %s", vmName))
+	}
+	if s.config.MaxTemplates > 0 {
+		names, err := s.listTemplateNames()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list templates: %w", err)
+		}
+		if len(names) >= s.config.MaxTemplates {
+			return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("template quota of %d reached", s.config.MaxTemplates))
+		}
+	}
+
+	source.lock.RLock()
+	meta := &templateMeta{
+		Name:      vmName,
+		SourceVM:  vmName,
+		Kernel:    source.kernelPath,
+		Initramfs: source.initramfsPath,
+		Rootfs:    source.rootfsPath,
+	}
+	source.lock.RUnlock()
+
+	// Runs once the VMM has exited, so the disk is no longer written to.
+	saveTemplate := func(v *vm) error {
+		dir := s.templateDir(vmName)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create template dir: %w", err)
+		}
+		disk := path.Join(dir, statefulDiskFilename)
+		if err := os.Rename(v.statefulDiskPath, disk); err != nil {
+			os.RemoveAll(dir)
+			return fmt.Errorf("failed to move stateful disk: %w", err)
+		}
+		if err := os.Chmod(disk, 0444); err != nil {
+			log.WithError(err).Warnf("failed to make template disk read-only: %s", disk)
+		}
+
+		meta.CreatedAt = time.Now().UTC()
+		data, err := json.Marshal(meta)
+		if err == nil {
+			err = os.WriteFile(path.Join(dir, templateMetaFilename), data, 0644)
+		}
+		if err != nil {
+			// Put the disk back so it's left with the VM's state dir.
+			os.Rename(disk, v.statefulDiskPath)
+			os.RemoveAll(dir)
+			return fmt.Errorf("failed to write template metadata: %w", err)
+		}
+		return nil
+	}
+
+	if err := s.destroyVMWith(ctx, vmName, opConvertToTemplate, saveTemplate); err != nil {
+		return nil, fmt.Errorf("failed to convert vm %s to a template: %w", vmName, err)
+	}
+	log.WithField("template", vmName).Info("created template")
+	return s.templateToAPI(meta), nil
+}
+
+// ListTemplates returns all templates with their running descendants.
+func (s *Server) ListTemplates() (*serverapi.ListTemplatesResponse, error) {
+	names, err := s.listTemplateNames()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list templates: %w", err)
+	}
+
+	resp := &serverapi.ListTemplatesResponse{
+		Templates: []serverapi.Template{},
+	}
+	for _, name := range names {
+		meta, err := s.readTemplateMeta(name)
+		if err != nil {
+			log.WithError(err).Warnf("skipping template: %s", name)
+			continue
+		}
+		resp.Templates = append(resp.Templates, *s.templateToAPI(meta))
+	}
+	return resp, nil
+}
+
+// DeleteTemplate deletes a template and its disk. It refuses while VMs
+// instantiated from it are running unless force is set; those VMs have their
+// own copy of the disk and keep running either way.
+func (s *Server) DeleteTemplate(name string, force bool) error {
+	if _, err := s.readTemplateMeta(name); err != nil {
+		return err
+	}
+	if descendants := s.templateDescendants(name); len(descendants) > 0 && !force {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("template %s has %d running descendants", name, len(descendants)))
+	}
+	if err := os.RemoveAll(s.templateDir(name)); err != nil {
+		return fmt.Errorf("failed to delete template: %w", err)
+	}
+	log.WithField("template", name).Info("deleted template")
+	return nil
+}
+
+// InstantiateTemplate starts VMs from a template through the regular StartVM
+// path. If one fails, the VMs started before it are kept and returned along
+// with the error.
+func (s *Server) InstantiateTemplate(ctx context.Context, name string, req *serverapi.InstantiateTemplateRequest) (*serverapi.InstantiateTemplateResponse, error) {
+	meta, err := s.readTemplateMeta(name)
+	if err != nil {
+		return nil, err
+	}
+	if req.VmName == "" {
+		return nil, status.Error(codes.InvalidArgument, "vmName is required")
+	}
+	count := int(req.GetCount())
+	if count == 0 {
+		count = 1
+	}
+	if count < 0 || count > maxInstantiateCount {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("count must be between 1 and %d", maxInstantiateCount))
+	}
+
+	names := []string{req.VmName}
+	if count > 1 {
+		names = names[:0]
+		for i := 1; i <= count; i++ {
+			names = append(names, fmt.Sprintf("%s-%d", req.VmName, i))
+		}
+	}
+	for _, vmName := range names {
+		if s.getVMAtomic(vmName) != nil {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("vm already exists: %s", vmName))
+		}
+	}
+
+	disk := path.Join(s.templateDir(name), statefulDiskFilename)
+	resp := &serverapi.InstantiateTemplateResponse{
+		Vms: []serverapi.StartVMResponse{},
+	}
+	for _, vmName := range names {
+		startResp, err := s.startVM(ctx, &serverapi.StartVMRequest{
+			VmName:    serverapi.PtrString(vmName),
+			Kernel:    serverapi.PtrString(meta.Kernel),
+			Initramfs: serverapi.PtrString(meta.Initramfs),
+			Rootfs:    serverapi.PtrString(meta.Rootfs),
+		}, disk)
+		if err != nil {
+			return resp, fmt.Errorf("failed to start vm %s from template %s: %w", vmName, name, err)
+		}
+		if vm := s.getVMAtomic(vmName); vm != nil {
+			vm.lock.Lock()
+			vm.template = name
+			vm.saveRecordLogged()
+			vm.lock.Unlock()
+		}
+		resp.Vms = append(resp.Vms, *startResp)
+	}
+	return resp, nil
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gvisor.dev/gvisor/pkg/cleanup"
+
+	"github.com/abilashraghuram/cbox/out/gen/chvapi"
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+)
+
+const (
+	// maxSharedDirs bounds the shared dirs of a VM.
+	maxSharedDirs = 8
+	// virtiofsQueueSize is the size of the virtio-fs request queue.
+	virtiofsQueueSize = 1024
+	// virtiofsdPollInterval is how often a starting virtiofsd is checked
+	// for its socket.
+	virtiofsdPollInterval = 10 * time.Millisecond
+)
+
+// sharedDirTagRegexp matches virtio-fs tags, which are at most 36 bytes.
+var sharedDirTagRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,36}$`)
+
+// sharedDir is a host dir shared with the guest over virtio-fs, served by
+// its own virtiofsd.
+type sharedDir struct {
+	HostPath string `json:"hostPath"`
+	Tag      string `json:"tag"`
+	Readonly bool   `json:"readonly,omitempty"`
+	Socket   string `json:"socket"`
+	// Pid is virtiofsd's, so it can be reaped after the VM is adopted.
+	Pid int `json:"pid"`
+}
+
+// planSharedDirs validates the shared dirs of a start request without
+// starting virtiofsd, so a bad request fails before the VMM is spawned.
+func (s *Server) planSharedDirs(dirs []serverapi.SharedDir) ([]sharedDir, error) {
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+	if len(dirs) > maxSharedDirs {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("at most %d shared dirs are allowed, got %d", maxSharedDirs, len(dirs)))
+	}
+	if _, err := exec.LookPath(s.config.VirtiofsdBinPath); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("shared dirs need virtiofsd: %v", err))
+	}
+
+	planned := make([]sharedDir, 0, len(dirs))
+	tags := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		if !sharedDirTagRegexp.MatchString(dir.Tag) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid shared dir tag %q: must be up to 36 letters, digits, '.', '_' and '-'", dir.Tag))
+		}
+		if tags[dir.Tag] {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("shared dir tag %s is used twice", dir.Tag))
+		}
+		tags[dir.Tag] = true
+		if !path.IsAbs(dir.HostPath) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("shared dir path %q must be absolute", dir.HostPath))
+		}
+		if info, err := os.Stat(dir.HostPath); err != nil || !info.IsDir() {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("shared dir %s is not a directory", dir.HostPath))
+		}
+		planned = append(planned, sharedDir{
+			HostPath: path.Clean(dir.HostPath),
+			Tag:      dir.Tag,
+			Readonly: dir.GetReadonly(),
+		})
+	}
+	return planned, nil
+}
+
+// startVirtiofsd starts a virtiofsd for each of dirs, with its socket and
+// log in vmStateDir, and waits up to timeout for each to listen. They are
+// killed by cleanup.
+func (s *Server) startVirtiofsd(vmName string, vmStateDir string, dirs []sharedDir, timeout time.Duration, cleanup *cleanup.Cleanup) error {
+	for i := range dirs {
+		dir := &dirs[i]
+		dir.Socket = path.Join(vmStateDir, "virtiofs-"+dir.Tag+".sock")
+		logFile, err := os.Create(path.Join(vmStateDir, "virtiofsd-"+dir.Tag+".log"))
+		if err != nil {
+			return fmt.Errorf("failed to create virtiofsd log file: %w", err)
+		}
+
+		args := []string{"--socket-path", dir.Socket, "--shared-dir", dir.HostPath, "--cache", "never"}
+		if dir.Readonly {
+			args = append(args, "--readonly")
+		}
+		cmd := exec.Command(s.config.VirtiofsdBinPath, args...)
+		cmd.Env = append(os.Environ(), "CBOX_VM_NAME="+vmName)
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setpgid: true,
+		}
+		err = cmd.Start()
+		logFile.Close()
+		if err != nil {
+			return fmt.Errorf("failed to start virtiofsd for shared dir %s: %w", dir.Tag, err)
+		}
+		dir.Pid = cmd.Process.Pid
+		// Reaped as soon as it exits, so its pid is only ever polled.
+		go cmd.Wait()
+		cleanup.Add(func() {
+			log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "startVirtiofsd", "tag": dir.Tag}).Info("kill virtiofsd")
+			cmd.Process.Kill()
+		})
+
+		if err := waitForVirtiofsd(dir, timeout); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"vmname": vmName,
+			"tag":    dir.Tag,
+			"pid":    dir.Pid,
+		}).Info("virtiofsd started")
+	}
+	return nil
+}
+
+// waitForVirtiofsd waits for dir's virtiofsd to create its socket, failing
+// early if it exits.
+func waitForVirtiofsd(dir *sharedDir, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(dir.Socket); err == nil {
+			return nil
+		}
+		if processExited(dir.Pid) {
+			return fmt.Errorf("virtiofsd for shared dir %s exited, see virtiofsd-%s.log", dir.Tag, dir.Tag)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for virtiofsd for shared dir %s", timeout, dir.Tag)
+		}
+		time.Sleep(virtiofsdPollInterval)
+	}
+}
+
+// reapVirtiofsd waits for the VM's virtiofsd processes, which exit once the
+// VMM is gone, killing those that don't within the reap timeout.
+func (v *vm) reapVirtiofsd() {
+	for _, dir := range v.sharedDirs {
+		logger := log.WithFields(log.Fields{"vmName": v.name, "tag": dir.Tag})
+		// Checked by socket too, as the pid of an adopted VM's virtiofsd may
+		// have been recycled.
+		if !vmmRunning(dir.Pid, dir.Socket) {
+			continue
+		}
+		if err := waitForProcessExit(dir.Pid, v.reapTimeout); err != nil {
+			logger.Warn("virtiofsd didn't exit, killing it")
+			if err := syscall.Kill(dir.Pid, syscall.SIGKILL); err != nil {
+				logger.WithError(err).Warn("failed to kill virtiofsd")
+			}
+		}
+	}
+}
+
+// sharedDirFsConfigs returns the VMM's configs of dirs.
+func sharedDirFsConfigs(dirs []sharedDir) []chvapi.FsConfig {
+	configs := make([]chvapi.FsConfig, 0, len(dirs))
+	for _, dir := range dirs {
+		configs = append(configs, chvapi.FsConfig{
+			Tag:       dir.Tag,
+			Socket:    dir.Socket,
+			NumQueues: 1,
+			QueueSize: virtiofsQueueSize,
+		})
+	}
+	return configs
+}
+
+// apiSharedDirs returns the VM's shared dirs as reported by the API.
+func (v *vm) apiSharedDirs() []serverapi.SharedDir {
+	var dirs []serverapi.SharedDir
+	for _, dir := range v.sharedDirs {
+		dirs = append(dirs, serverapi.SharedDir{
+			HostPath: dir.HostPath,
+			Tag:      dir.Tag,
+			Readonly: serverapi.PtrBool(dir.Readonly),
+		})
+	}
+	return dirs
+}
@@ -0,0 +1,483 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/config"
+	"github.com/abilashraghuram/cbox/pkg/events"
+	"github.com/abilashraghuram/cbox/pkg/hostcmd"
+)
+
+const (
+	vmRecordFilename = "vm.json"
+	// adoptCheckTimeout bounds asking a leftover VMM for its state.
+	adoptCheckTimeout = 2 * time.Second
+	// chvStatePaused is the vm.info state of a paused guest.
+	chvStatePaused = "Paused"
+)
+
+// vmRecord is vm.json in a VM's state dir. It holds what's needed to manage
+// the VM again if the server restarts while its VMM keeps running.
+type vmRecord struct {
+	VMName        string `json:"vmName"`
+	Pid           int    `json:"pid"`
+	APISocketPath string `json:"apiSocketPath"`
+	// IP is the guest IP in CIDR notation.
+	IP                   string            `json:"ip"`
+	ExternalIP           bool              `json:"externalIp,omitempty"`
+	StaticIP             bool              `json:"staticIp,omitempty"`
+	TapDevice            string            `json:"tapDevice"`
+	ExternalTapDevice    bool              `json:"externalTapDevice,omitempty"`
+	CID                  uint32            `json:"cid"`
+	VsockPath            string            `json:"vsockPath"`
+	StatefulDiskPath     string            `json:"statefulDiskPath"`
+	DataDisks            []dataDisk        `json:"dataDisks,omitempty"`
+	SharedDirs           []sharedDir       `json:"sharedDirs,omitempty"`
+	PreserveStatefulDisk bool              `json:"preserveStatefulDisk,omitempty"`
+	SerialMode           string            `json:"serialMode"`
+	SerialSocketPath     string            `json:"serialSocketPath,omitempty"`
+	Kernel               string            `json:"kernel"`
+	Initramfs            string            `json:"initramfs"`
+	Rootfs               string            `json:"rootfs"`
+	RootfsOverlay        bool              `json:"rootfsOverlay,omitempty"`
+	KernelCmdline        string            `json:"kernelCmdline,omitempty"`
+	Profile              string            `json:"profile,omitempty"`
+	Template             string            `json:"template,omitempty"`
+	Labels               map[string]string `json:"labels,omitempty"`
+	CPUAffinity          [][]int           `json:"cpuAffinity,omitempty"`
+	NUMANode             *int32            `json:"numaNode,omitempty"`
+	Resources            vmResources       `json:"resources"`
+	// BootName and StateDirLink are set for VMs claimed from the pool.
+	BootName     string `json:"bootName,omitempty"`
+	StateDirLink string `json:"stateDirLink,omitempty"`
+	// Lease is the VM's lease when the record was saved, if any.
+	Lease *leaseRecord `json:"lease,omitempty"`
+}
+
+// leaseRecord is a vmLease in vm.json.
+type leaseRecord struct {
+	Holder    string    `json:"holder"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// saveRecord writes the VM's vm.json. It must be called with v.lock held.
+func (v *vm) saveRecord() error {
+	record := vmRecord{
+		VMName:               v.name,
+		Pid:                  v.process.Pid,
+		APISocketPath:        v.apiSocketPath,
+		IP:                   v.ip.String(),
+		ExternalIP:           v.externalIP,
+		StaticIP:             v.staticIP,
+		TapDevice:            v.tapDevice.Name,
+		ExternalTapDevice:    v.tapDevice.External,
+		CID:                  v.cid,
+		VsockPath:            v.vsockPath,
+		StatefulDiskPath:     v.statefulDiskPath,
+		DataDisks:            v.dataDisks,
+		SharedDirs:           v.sharedDirs,
+		PreserveStatefulDisk: v.preserveStatefulDisk,
+		SerialMode:           v.serialMode,
+		SerialSocketPath:     v.serialSocketPath,
+		Kernel:               v.kernelPath,
+		Initramfs:            v.initramfsPath,
+		Rootfs:               v.rootfsPath,
+		RootfsOverlay:        v.rootfsOverlay,
+		KernelCmdline:        v.kernelCmdline,
+		Profile:              v.profile,
+		Template:             v.template,
+		Labels:               v.labels,
+		CPUAffinity:          v.cpuAffinity,
+		NUMANode:             v.numaNode,
+		Resources:            v.resources,
+		StateDirLink:         v.stateDirLink,
+	}
+	if v.bootName != v.name {
+		record.BootName = v.bootName
+	}
+	if lease := v.activeLease(); lease != nil {
+		record.Lease = &leaseRecord{Holder: lease.holder, Token: lease.token, ExpiresAt: lease.expiresAt}
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal vm record: %w", err)
+	}
+	// Written aside and renamed so a crash never leaves a torn record. It
+	// carries the lease token, so only the server's user may read it.
+	recordPath := path.Join(v.stateDirPath, vmRecordFilename)
+	if err := os.WriteFile(recordPath+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to write vm record: %w", err)
+	}
+	if err := os.Rename(recordPath+".tmp", recordPath); err != nil {
+		return fmt.Errorf("failed to write vm record: %w", err)
+	}
+	return nil
+}
+
+// saveRecordLogged is saveRecord for callers that carry on regardless; a
+// stale record only matters if the server restarts.
+func (v *vm) saveRecordLogged() {
+	if err := v.saveRecord(); err != nil {
+		log.WithField("vmName", v.name).WithError(err).Warn("failed to save vm record")
+	}
+}
+
+// DetachVMs leaves all VMs running on shutdown for the next start of the
+// server to adopt, saving their records so they're up to date. VMs still
+// starting can't be adopted and are canceled. It returns the number of VMs
+// left running.
+func (s *Server) DetachVMs(ctx context.Context) (int, error) {
+	if err := s.cancelStartOperations(ctx, labelSelector{}); err != nil {
+		return 0, fmt.Errorf("failed to cancel VM starts: %w", err)
+	}
+
+	s.lock.RLock()
+	vms := make([]*vm, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	s.lock.RUnlock()
+
+	for _, vm := range vms {
+		vm.lock.Lock()
+		vm.saveRecordLogged()
+		vm.lock.Unlock()
+	}
+	return len(vms), nil
+}
+
+// ReconcileReport returns what the server did at startup with the VMs left
+// by its previous run.
+func (s *Server) ReconcileReport() *serverapi.ReconcileReport {
+	return s.reconcile
+}
+
+func loadVMRecord(vmStateDir string) (*vmRecord, error) {
+	data, err := os.ReadFile(path.Join(vmStateDir, vmRecordFilename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vm record: %w", err)
+	}
+	var record vmRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse vm record: %w", err)
+	}
+	return &record, nil
+}
+
+// leftoverVM is a VM found in the state dir at startup, left by a previous
+// run of the server.
+type leftoverVM struct {
+	stateDirPath string
+	record       *vmRecord
+	// status is what the VM is adopted with. It's unset for VMs that can't
+	// be adopted, with reason saying why.
+	status vmStatus
+	reason string
+}
+
+func (l *leftoverVM) adoptable() bool {
+	return l.reason == ""
+}
+
+// findLeftoverVMs loads the records of the VMs left in config.StateDir and
+// works out which can be adopted: those whose VMM is still running and
+// answers its API with a booted guest. Nothing is adopted once the bridge
+// subnet changed, as the guests are still configured with the old one.
+func findLeftoverVMs(config config.ServerConfig) []*leftoverVM {
+	names, err := listVMStateDirs(config.StateDir)
+	if err != nil {
+		log.WithError(err).Warn("failed to list VM state dirs")
+		return nil
+	}
+
+	subnetChanged := false
+	if config.BridgeNetworking() {
+		previous, err := loadNetworkState(config.StateDir)
+		subnetChanged = err != nil || (previous != nil && previous.BridgeSubnet != config.BridgeSubnet)
+	}
+
+	var leftovers []*leftoverVM
+	for _, name := range names {
+		stateDirPath := getVmStateDirPath(config.StateDir, name)
+		record, err := loadVMRecord(stateDirPath)
+		if err != nil {
+			// State dirs from before records were kept are left alone.
+			log.WithField("vmName", name).WithError(err).Debug("no vm record")
+			continue
+		}
+		leftover := &leftoverVM{stateDirPath: stateDirPath, record: record}
+		switch {
+		case strings.HasPrefix(record.VMName, poolVMPrefix):
+			// The new run's pool starts afresh.
+			leftover.reason = "pooled VM"
+		case subnetChanged:
+			leftover.reason = "bridge subnet changed"
+		default:
+			leftover.status, leftover.reason = checkLeftoverVMM(record)
+		}
+		leftovers = append(leftovers, leftover)
+	}
+	return leftovers
+}
+
+// checkLeftoverVMM returns the status a leftover VM can be adopted with, or
+// why it can't be.
+func checkLeftoverVMM(record *vmRecord) (vmStatus, string) {
+	if !vmmRunning(record.Pid, record.APISocketPath) {
+		return 0, "VMM process exited"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), adoptCheckTimeout)
+	defer cancel()
+	info, _, err := createApiClient(record.APISocketPath).DefaultAPI.VmInfoGet(ctx).Execute()
+	if err != nil {
+		return 0, fmt.Sprintf("VMM API not responding: %v", err)
+	}
+	switch info.GetState() {
+	case chvStateRunning:
+		return vmStatusRunning, ""
+	case chvStatePaused:
+		return vmStatusPaused, ""
+	case chvStateShutdown:
+		return vmStatusStopped, ""
+	default:
+		// The server went away while the VM was being started.
+		return 0, fmt.Sprintf("guest never booted, state %s", info.GetState())
+	}
+}
+
+// vmmRunning reports whether pid is still the VMM serving apiSocketPath, so
+// a recycled pid is never mistaken for it.
+func vmmRunning(pid int, apiSocketPath string) bool {
+	if pid <= 0 || processExited(pid) {
+		return false
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	for _, arg := range strings.Split(string(cmdline), "\x00") {
+		if arg == apiSocketPath {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileLeftoverVMs adopts the leftover VMs that can be adopted and cleans
+// up after the rest, recording both in s.reconcile. hostNetworkingKept is set
+// when the bridge, tap devices and firewall rules of the previous run were
+// left in place, so those of the VMs cleaned up have to be removed one by
+// one.
+func (s *Server) reconcileLeftoverVMs(leftovers []*leftoverVM, hostNetworkingKept bool) {
+	defer func() {
+		log.WithFields(log.Fields{
+			"adopted":         s.reconcile.Adopted,
+			"cleanedUp":       len(s.reconcile.CleanedUp),
+			"subnetMigration": s.reconcile.SubnetMigration != nil,
+		}).Info("reconciled VMs of the previous run")
+	}()
+
+	for _, leftover := range leftovers {
+		vmName := leftover.record.VMName
+		logger := log.WithField("vmName", vmName)
+		if leftover.adoptable() {
+			err := s.adoptVM(leftover)
+			if err == nil {
+				s.reconcile.Adopted = append(s.reconcile.Adopted, vmName)
+				continue
+			}
+			leftover.reason = err.Error()
+		}
+		logger.WithField("reason", leftover.reason).Warn("cleaning up leftover VM")
+		s.cleanupLeftoverVM(leftover, hostNetworkingKept)
+		s.reconcile.CleanedUp = append(s.reconcile.CleanedUp, serverapi.ReconciledVM{
+			VmName: serverapi.PtrString(vmName),
+			Reason: serverapi.PtrString(leftover.reason),
+		})
+	}
+
+	// Attachments restored for VMs whose state dir has gone since.
+	for _, vmName := range s.network.attachedVMs() {
+		if s.getVMAtomic(vmName) != nil {
+			continue
+		}
+		log.WithField("vmName", vmName).Warn("releasing network attachment without a VM")
+		if err := s.network.Release(vmName); err != nil {
+			log.WithField("vmName", vmName).WithError(err).Warn("failed to release network attachment")
+		}
+	}
+}
+
+// adoptVM takes over a leftover VM whose VMM is still running.
+func (s *Server) adoptVM(leftover *leftoverVM) error {
+	record := leftover.record
+	vmName := record.VMName
+	logger := log.WithField("vmName", vmName)
+
+	// Restored from the network registry, unless the VM was left by a run
+	// from before it was kept.
+	attachment := s.network.Attachment(vmName)
+	if attachment == nil {
+		plan, err := attachmentRecord{
+			TapDevice:         record.TapDevice,
+			ExternalTapDevice: record.ExternalTapDevice,
+			IP:                record.IP,
+			ExternalIP:        record.ExternalIP,
+			CID:               record.CID,
+		}.plan()
+		if err != nil {
+			return err
+		}
+		if attachment, err = s.network.Apply(vmName, plan); err != nil {
+			return fmt.Errorf("failed to reclaim network attachment: %w", err)
+		}
+	}
+
+	// The previous run's listeners may have left their sockets behind.
+	os.Remove(fmt.Sprintf("%s_%d", record.VsockPath, vsockCallbackPort))
+	os.Remove(fmt.Sprintf("%s_%d", record.VsockPath, artifactVsockPort))
+	callbackListener, err := s.listenVsockCallbacks(vmName, record.VsockPath)
+	if err != nil {
+		s.network.Release(vmName)
+		return err
+	}
+	artifactListener, err := s.listenArtifacts(vmName, record.VsockPath, leftover.stateDirPath)
+	if err != nil {
+		callbackListener.Close()
+		s.network.Release(vmName)
+		return err
+	}
+
+	// Always succeeds on Unix; the VMM isn't our child, so it can't be
+	// waited for.
+	process, _ := os.FindProcess(record.Pid)
+	adopted := &vm{
+		name:                 vmName,
+		stateDirPath:         leftover.stateDirPath,
+		apiSocketPath:        record.APISocketPath,
+		apiClient:            createApiClient(record.APISocketPath),
+		process:              process,
+		ip:                   attachment.IP,
+		tapDevice:            attachment.TapDevice,
+		externalIP:           attachment.ExternalIP,
+		staticIP:             record.StaticIP,
+		status:               leftover.status,
+		vsockPath:            record.VsockPath,
+		cid:                  attachment.CID,
+		statefulDiskPath:     record.StatefulDiskPath,
+		dataDisks:            record.DataDisks,
+		sharedDirs:           record.SharedDirs,
+		serialMode:           record.SerialMode,
+		preserveStatefulDisk: record.PreserveStatefulDisk,
+		serialSocketPath:     record.SerialSocketPath,
+		callbackListener:     callbackListener,
+		artifactListener:     artifactListener,
+		gate:                 newOpGate(),
+		kernelPath:           record.Kernel,
+		initramfsPath:        record.Initramfs,
+		rootfsPath:           record.Rootfs,
+		rootfsOverlay:        record.RootfsOverlay,
+		kernelCmdline:        record.KernelCmdline,
+		profile:              record.Profile,
+		template:             record.Template,
+		cpuAffinity:          record.CPUAffinity,
+		numaNode:             record.NUMANode,
+		labels:               record.Labels,
+		resources:            record.Resources,
+		bootName:             record.VMName,
+		stateDirLink:         record.StateDirLink,
+		crashMonitorDone:     make(chan struct{}),
+		readyTimeout:         s.config.CmdServerReadyTimeout,
+		reapTimeout:          s.config.ReapTimeout,
+	}
+	if record.BootName != "" {
+		adopted.bootName = record.BootName
+	}
+	if record.Lease != nil {
+		adopted.lease = &vmLease{holder: record.Lease.Holder, token: record.Lease.Token, expiresAt: record.Lease.ExpiresAt}
+	}
+	if err := writePidRecords(s.config.StateDir, vmName, record.Pid); err != nil {
+		logger.WithError(err).Warn("failed to write pid records")
+	}
+
+	s.lock.Lock()
+	s.vms[vmName] = adopted
+	s.lock.Unlock()
+
+	logger.WithFields(log.Fields{
+		"pid":    record.Pid,
+		"status": leftover.status.String(),
+		"vmIP":   attachment.IP.String(),
+	}).Info("adopted VM")
+	s.events.Publish(events.TypeVMAdopted, vmName, map[string]any{
+		"status": leftover.status.String(),
+	})
+	s.startCrashMonitor(adopted)
+	if leftover.status == vmStatusRunning {
+		go adopted.refreshAgentVersions(context.Background())
+	}
+	return nil
+}
+
+// cleanupLeftoverVM kills a leftover VM's VMM if it's still around and
+// removes what the VM left on the host.
+func (s *Server) cleanupLeftoverVM(leftover *leftoverVM, hostNetworkingKept bool) {
+	record := leftover.record
+	logger := log.WithField("vmName", record.VMName)
+
+	if vmmRunning(record.Pid, record.APISocketPath) {
+		logger.WithField("pid", record.Pid).Info("killing leftover VMM")
+		if err := syscall.Kill(record.Pid, syscall.SIGKILL); err != nil {
+			logger.WithError(err).Warn("failed to kill leftover VMM")
+		}
+	}
+	for _, dir := range record.SharedDirs {
+		if vmmRunning(dir.Pid, dir.Socket) {
+			logger.WithField("pid", dir.Pid).Info("killing leftover virtiofsd")
+			if err := syscall.Kill(dir.Pid, syscall.SIGKILL); err != nil {
+				logger.WithError(err).Warn("failed to kill leftover virtiofsd")
+			}
+		}
+	}
+	removePidRecords(s.config.StateDir, record.VMName, record.Pid)
+
+	if s.network.Attachment(record.VMName) != nil {
+		if err := s.network.Release(record.VMName); err != nil {
+			logger.WithError(err).Warn("failed to release network attachment")
+		}
+	} else if hostNetworkingKept && s.config.BridgeNetworking() {
+		// Left by a run from before the network registry was kept.
+		if !record.ExternalTapDevice {
+			if err := hostcmd.Run("ip", "link", "delete", record.TapDevice); err != nil {
+				logger.WithError(err).Warnf("failed to delete tap device %s", record.TapDevice)
+			}
+		}
+		if ip, _, err := net.ParseCIDR(record.IP); err == nil && !record.ExternalIP {
+			if err := cleanupAllIPTablesRulesForIP(ip.String()); err != nil {
+				logger.WithError(err).Warn("failed to delete iptables rules")
+			}
+		}
+	}
+
+	s.disposeStateDir(&vm{
+		name:                 record.VMName,
+		stateDirPath:         leftover.stateDirPath,
+		statefulDiskPath:     record.StatefulDiskPath,
+		dataDisks:            record.DataDisks,
+		stateDirLink:         record.StateDirLink,
+		preserveStatefulDisk: record.PreserveStatefulDisk,
+	})
+}
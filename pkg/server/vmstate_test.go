@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abilashraghuram/cbox/pkg/callback"
+)
+
+func TestRestartAdoptsVMs(t *testing.T) {
+	h := newTestHarness(t, nil)
+	kept := h.startVM("kept")
+	dead := h.startVM("dead")
+	deadVM := h.server.getVMAtomic("dead")
+	deadVM.stopCrashMonitor()
+	if err := deadVM.process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !processExited(deadVM.process.Pid); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("VMM of dead didn't exit")
+		}
+	}
+
+	h.restart()
+	if !h.server.HasVM("kept") {
+		t.Fatal("kept wasn't adopted")
+	}
+	if h.server.HasVM("dead") {
+		t.Error("dead was adopted without a VMM")
+	}
+	attachment := h.server.network.Attachment("kept")
+	if attachment == nil {
+		t.Fatal("network attachment of kept wasn't restored")
+	}
+	if attachment.IP.String() != kept.GetIp() || int64(attachment.CID) != kept.GetCid() || attachment.TapDevice.Name != kept.GetTapDeviceName() {
+		t.Errorf("restored attachment %s, CID %d, %s; want %s, CID %d, %s",
+			attachment.IP, attachment.CID, attachment.TapDevice.Name, kept.GetIp(), kept.GetCid(), kept.GetTapDeviceName())
+	}
+	report := h.server.ReconcileReport()
+	if !slices.Equal(report.Adopted, []string{"kept"}) || len(report.CleanedUp) != 1 || report.CleanedUp[0].GetVmName() != "dead" || report.SubnetMigration != nil {
+		t.Errorf("reconcile report = %+v, want kept adopted and dead cleaned up", report)
+	}
+	if h.server.network.Attachment("dead") != nil {
+		t.Error("network attachment of dead wasn't released")
+	}
+	if h.runner.ran("ip tuntap del dev "+dead.GetTapDeviceName()) != 1 {
+		t.Errorf("tap device %s of dead wasn't deleted", dead.GetTapDeviceName())
+	}
+	if ips, cids := h.occupancy(); ips != 1 || cids != 1 {
+		t.Errorf("%d IPs and %d CIDs allocated, want kept's only", ips, cids)
+	}
+
+	// The adopted VM's resources are released like any other's.
+	if _, err := h.server.DestroyVM(context.Background(), "kept"); err != nil {
+		t.Fatalf("DestroyVM of an adopted VM: %v", err)
+	}
+	h.checkReleased()
+	if h.runner.ran("ip tuntap del dev "+kept.GetTapDeviceName()) != 1 {
+		t.Errorf("tap device %s of kept wasn't deleted", kept.GetTapDeviceName())
+	}
+}
+
+func TestRestartMigratesSubnet(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	pid := h.server.getVMAtomic("vm1").process.Pid
+	if h.runner.ran("iptables -t nat -A POSTROUTING -s 10.20.1.0/24 -o eth0 -m comment --comment cbox:10.20.1.0/24 -j MASQUERADE") != 1 {
+		t.Error("firewall rules of the bridge subnet weren't tagged")
+	}
+
+	h.config.BridgeIP = "10.20.2.1/24"
+	h.config.BridgeSubnet = "10.20.2.0/24"
+	if _, err := NewServer(h.config, callback.NewSessionManager()); err == nil {
+		t.Fatal("NewServer allowed a subnet change without --migrate-subnet")
+	}
+
+	h.config.MigrateSubnet = true
+	h.restart()
+	report := h.server.ReconcileReport()
+	migration := report.SubnetMigration
+	if migration == nil || migration.GetPreviousSubnet() != "10.20.1.0/24" || !slices.Equal(migration.AffectedVms, []string{"vm1"}) {
+		t.Fatalf("subnet migration = %+v, want vm1 affected by leaving 10.20.1.0/24", migration)
+	}
+	if len(report.Adopted) != 0 || len(report.CleanedUp) != 1 || report.CleanedUp[0].GetVmName() != "vm1" {
+		t.Errorf("reconcile report = %+v, want vm1 cleaned up", report)
+	}
+	if h.server.HasVM("vm1") {
+		t.Error("VM of the previous subnet was adopted")
+	}
+	for deadline := time.Now().Add(5 * time.Second); !processExited(pid); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("VMM %d of the previous subnet still running", pid)
+		}
+	}
+	h.checkReleased()
+
+	// VMs are given IPs of the new subnet.
+	resp := h.startVM("vm1")
+	if ip, _, _ := net.ParseCIDR(resp.GetIp()); ip == nil || !strings.HasPrefix(ip.String(), "10.20.2.") {
+		t.Errorf("ip = %s, want one in 10.20.2.0/24", resp.GetIp())
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+)
+
+const (
+	vsockServerPort         = 4032
+	vsockCommandTimeout     = 30 * time.Second
+	vsockErrorPrefix        = "Error:"
+	vsockHandshakeMaxLength = 64
+)
+
+// vsockRequestFrame is a request in the vsockserver's framed protocol, one
+// JSON object per line.
+type vsockRequestFrame struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Cmd  string `json:"cmd,omitempty"`
+}
+
+// vsockResponseFrame is the vsockserver's response to a vsockRequestFrame.
+type vsockResponseFrame struct {
+	ID       string `json:"id"`
+	Output   string `json:"output"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// dialGuestVsock connects to a guest vsock port through cloud-hypervisor's
+// hybrid vsock unix socket, performing the "CONNECT <port>" handshake.
+func dialGuestVsock(ctx context.Context, vsockPath string, port uint32) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", vsockPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial vsock socket %s: %w", vsockPath, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send vsock CONNECT: %w", err)
+	}
+
+	// Read the handshake reply a byte at a time so nothing past the newline is
+	// consumed from the connection.
+	var reply []byte
+	buf := make([]byte, 1)
+	for len(reply) < vsockHandshakeMaxLength {
+		if _, err := conn.Read(buf); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to read vsock CONNECT reply: %w", err)
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		reply = append(reply, buf[0])
+	}
+	if !strings.HasPrefix(string(reply), "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("vsock CONNECT to port %d failed: %q", port, string(reply))
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// vsockCommand sends a single command line to the guest's vsockserver and
+// returns its response.
+func (v *vm) vsockCommand(ctx context.Context, line string) (string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, vsockCommandTimeout)
+		defer cancel()
+	}
+
+	conn, err := dialGuestVsock(ctx, v.vsockPath, vsockServerPort)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Framed requests can carry newlines and tell errors from output that
+	// happens to start with the error prefix. The agent's version is only
+	// known after its first plain-text VERSION request.
+	framed := v.knownAgentFeature(agentVsockServer, featureFrames)
+	request := line
+	if framed {
+		frame, err := json.Marshal(vsockRequestFrame{ID: "1", Type: "command", Cmd: line})
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal vsock command: %w", err)
+		}
+		request = string(frame)
+	}
+	if _, err := io.WriteString(conn, request+"\n"); err != nil {
+		return "", fmt.Errorf("failed to write vsock command: %w", err)
+	}
+
+	// The vsockserver terminates every response with a newline and keeps the
+	// connection open, so read until the buffered response ends with one.
+	var resp bytes.Buffer
+	buf := make([]byte, 4096)
+	for !bytes.HasSuffix(resp.Bytes(), []byte("\n")) {
+		n, err := conn.Read(buf)
+		resp.Write(buf[:n])
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", fmt.Errorf("failed to read vsock response: %w", err)
+		}
+	}
+
+	out := strings.TrimSuffix(resp.String(), "\n")
+	if framed {
+		var frame vsockResponseFrame
+		if err := json.Unmarshal([]byte(out), &frame); err != nil {
+			return "", fmt.Errorf("invalid vsock response: %w", err)
+		}
+		if frame.Error != "" {
+			return "", fmt.Errorf("%s %s", vsockErrorPrefix, frame.Error)
+		}
+		return frame.Output, nil
+	}
+	if strings.HasPrefix(out, vsockErrorPrefix) {
+		return "", fmt.Errorf("%s", out)
+	}
+	return out, nil
+}
+
+// VsockCommand sends a command line to a VM's vsockserver. Regular lines are
+// run as shell commands, "CALLBACK <method> [params]" lines are routed back
+// through the host like a guest callback.
+func (s *Server) VsockCommand(ctx context.Context, vmName string, line string) (string, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return "", status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	return vm.vsockCommand(ctx, line)
+}
+
+// vsockExec runs a blocking exec request through the guest's vsockserver,
+// which doesn't depend on the guest network.
+func (v *vm) vsockExec(ctx context.Context, req *serverapi.VmExecRequest) (*serverapi.VmExecResponse, error) {
+	cmdReq, timeout, err := v.execRequest(ctx, req, agentVsockServer)
+	if err != nil {
+		return nil, err
+	}
+	line, err := json.Marshal(cmdReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	out, err := v.vsockCommand(ctx, "EXEC "+string(line))
+	if err != nil {
+		return nil, err
+	}
+
+	var cmdResp cmdserver.RunCmdResponse
+	if err := json.Unmarshal([]byte(out), &cmdResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	resp := &serverapi.VmExecResponse{
+		Output: serverapi.PtrString(cmdResp.Output),
+		Error:  serverapi.PtrString(cmdResp.Error),
+	}
+	if cmdResp.TimedOut {
+		resp.TimedOut = serverapi.PtrBool(true)
+	}
+	if cmdResp.OutputTruncated {
+		resp.OutputTruncated = serverapi.PtrBool(true)
+	}
+	if cmdResp.ExitCode != nil {
+		resp.ExitCode = serverapi.PtrInt32(int32(*cmdResp.ExitCode))
+	}
+	return resp, nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abilashraghuram/cbox/pkg/events"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
+)
+
+// vsockCallbackPort is the host port guests connect to for callbacks.
+// cloud-hypervisor forwards guest-initiated connections to port N to the
+// unix socket "<vsockPath>_N" on the host.
+const vsockCallbackPort = 4033
+
+// callbackFrameOverheadBytes is how much larger than its params a callback
+// request frame may be.
+const callbackFrameOverheadBytes = 64 * 1024
+
+// vsockCallbackRequest is a newline-terminated JSON frame sent by the guest.
+type vsockCallbackRequest struct {
+	VMName string          `json:"vmName,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// vsockCallbackResponse is the newline-terminated JSON frame sent back.
+type vsockCallbackResponse struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// listenVsockCallbacks accepts guest callbacks for vmName on the host side of
+// its vsock device. Connections can only come from that VM, so the socket a
+// request arrives on identifies the VM.
+func (s *Server) listenVsockCallbacks(vmName string, vsockPath string) (net.Listener, error) {
+	socketPath := fmt.Sprintf("%s_%d", vsockPath, vsockCallbackPort)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for vsock callbacks on %s: %w", socketPath, err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// The listener is closed when the VM is destroyed.
+				return
+			}
+			go s.handleVsockCallbackConn(vmName, conn)
+		}
+	}()
+	return listener, nil
+}
+
+func (s *Server) handleVsockCallbackConn(vmName string, conn net.Conn) {
+	defer conn.Close()
+	logger := log.WithFields(log.Fields{"vmName": vmName, "transport": "vsock"})
+
+	scanner := bufio.NewScanner(conn)
+	maxParamsBytes := s.config.MaxCallbackParamsSizeInKB * 1024
+	scanner.Buffer(make([]byte, 64*1024), int(maxParamsBytes)+callbackFrameOverheadBytes)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req vsockCallbackRequest
+		var resp vsockCallbackResponse
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = fmt.Sprintf("invalid callback request: %v", err)
+		} else if req.Method == "" {
+			resp.Error = "method is required"
+		} else if int64(len(req.Params)) > maxParamsBytes {
+			resp.Error = fmt.Sprintf("callback params of %d bytes exceed the limit of %d bytes", len(req.Params), maxParamsBytes)
+		} else if req.VMName != "" && req.VMName != vmName {
+			logger.WithField("claimedVMName", req.VMName).Warn("rejecting callback with mismatched VM name")
+			resp.Error = fmt.Sprintf("callback for %s received on the vsock of %s", req.VMName, vmName)
+		} else {
+			if req.Method != heartbeatMethod {
+				logger.WithField("method", req.Method).Info("Processing callback from VM")
+			}
+			// Each callback gets a request ID, forwarded to the receiver.
+			ctx := requestid.NewContext(context.Background(), requestid.New())
+			result, err := s.RouteCallback(ctx, vmName, req.Method, req.Params)
+			if err != nil {
+				logger.WithField("method", req.Method).WithError(err).Error("Failed to route callback")
+				resp.Error = fmt.Sprintf("Callback failed: %v", err)
+			} else {
+				resp.Result = result
+			}
+		}
+
+		if err := encoder.Encode(resp); err != nil {
+			logger.WithError(err).Warn("failed to write callback response")
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.WithError(err).Warn("failed to read callback request")
+	}
+}
+
+// RouteCallback routes a guest callback through the session manager, holding
+// the VM's gate so it doesn't race with an operation like destroy. Callbacks
+// sent while the VM is still being created aren't gated.
+func (s *Server) RouteCallback(ctx context.Context, vmName string, method string, params json.RawMessage) (json.RawMessage, error) {
+	// Heartbeats are for the host, so they aren't gated or routed on.
+	if method == heartbeatMethod {
+		return s.recordHeartbeat(vmName, params)
+	}
+	if vm := s.getVMAtomic(vmName); vm != nil {
+		release, err := vm.gate.acquireShared(ctx, vmName)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	result, err := s.sessionManager.RouteCallback(ctx, vmName, method, params)
+	// Params and results aren't included since they can carry secrets.
+	data := map[string]any{"method": method}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	s.events.Publish(events.TypeVMCallbackRouted, vmName, data)
+	return result, err
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+)
+
+const (
+	// DefaultWatchTimeout is how long WatchVM waits if no timeout is given.
+	DefaultWatchTimeout = 30 * time.Second
+	// MaxWatchTimeout bounds how long WatchVM waits.
+	MaxWatchTimeout = 5 * time.Minute
+
+	watchBufferSize = 16
+)
+
+// watchChecked runs once WatchVM has read a VM's status, before it waits for
+// events. Tests use it to change the status in between.
+var watchChecked = func(vmName string) {}
+
+// WatchVM waits until vmName's status differs from sinceStatus or an event
+// is published for it, then returns its fresh state. With an empty
+// sinceStatus it waits for the next event. If timeout passes first, the
+// current state is returned with timedOut set. Returning early because ctx is
+// done, e.g. on client disconnect, yields ctx's error.
+func (s *Server) WatchVM(ctx context.Context, vmName string, sinceStatus string, timeout time.Duration) (*serverapi.ListVMResponse, error) {
+	if timeout <= 0 {
+		timeout = DefaultWatchTimeout
+	}
+	timeout = min(timeout, MaxWatchTimeout)
+
+	// Subscribe before reading the status so a change in between is seen as
+	// an event rather than lost.
+	sub := s.events.Subscribe(ctx, watchBufferSize)
+	defer sub.Close()
+
+	resp, err := s.ListVM(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if sinceStatus != "" && resp.GetStatus() != sinceStatus {
+		return resp, nil
+	}
+	watchChecked(vmName)
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		event, err := sub.Next(waitCtx)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				resp, err := s.ListVM(ctx, vmName)
+				if err != nil {
+					return nil, err
+				}
+				resp.TimedOut = serverapi.PtrBool(true)
+				return resp, nil
+			}
+			return nil, err
+		}
+		if event.VMName == vmName {
+			return s.ListVM(ctx, vmName)
+		}
+	}
+}
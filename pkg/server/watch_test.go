@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatchVMChangeBeforeWait(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	resp, err := h.server.ListVM(context.Background(), "vm1")
+	if err != nil {
+		t.Fatalf("ListVM: %v", err)
+	}
+	running := resp.GetStatus()
+
+	// The VM is paused after WatchVM saw it running but before it waits,
+	// which must not leave it waiting out the timeout.
+	defer func(saved func(string)) { watchChecked = saved }(watchChecked)
+	watchChecked = func(vmName string) {
+		if err := h.server.PauseVM(context.Background(), vmName); err != nil {
+			t.Errorf("PauseVM: %v", err)
+		}
+	}
+
+	start := time.Now()
+	resp, err = h.server.WatchVM(context.Background(), "vm1", running, 10*time.Second)
+	if err != nil {
+		t.Fatalf("WatchVM: %v", err)
+	}
+	if resp.GetTimedOut() || resp.GetStatus() == running {
+		t.Errorf("WatchVM = status %s, timed out %t, want the paused status", resp.GetStatus(), resp.GetTimedOut())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("WatchVM took %s, want it to return on the change", elapsed)
+	}
+}
+
+func TestWatchVMTimeoutAndDisconnect(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.startVM("vm1")
+	resp, err := h.server.ListVM(context.Background(), "vm1")
+	if err != nil {
+		t.Fatalf("ListVM: %v", err)
+	}
+	subscribers := h.server.events.Subscribers()
+
+	resp, err = h.server.WatchVM(context.Background(), "vm1", resp.GetStatus(), 50*time.Millisecond)
+	if err != nil || !resp.GetTimedOut() {
+		t.Errorf("WatchVM without a change = %+v, %v, want timed out", resp, err)
+	}
+
+	// A client that goes away stops waiting, and its waiter is dropped.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := h.server.WatchVM(ctx, "vm1", resp.GetStatus(), 10*time.Second); !errors.Is(err, context.Canceled) {
+		t.Errorf("WatchVM after disconnect = %v, want Canceled", err)
+	}
+	if got := h.server.events.Subscribers(); got != subscribers {
+		t.Errorf("%d subscribers after the watches ended, want %d", got, subscribers)
+	}
+}
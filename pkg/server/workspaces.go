@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abilashraghuram/cbox/out/gen/serverapi"
+	"github.com/abilashraghuram/cbox/pkg/cmdserver"
+	"github.com/abilashraghuram/cbox/pkg/requestid"
+)
+
+const workspaceRequestTimeout = 30 * time.Second
+
+// cmdServerRequest sends a request to the VM's cmdserver and maps its error
+// statuses to gRPC codes.
+func (v *vm) cmdServerRequest(ctx context.Context, method string, path string) ([]byte, error) {
+	url := "http://" + cmdServerAddr(v.ip.IP.String()) + path
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	requestid.SetHeader(req)
+
+	client := &http.Client{Timeout: workspaceRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusBadRequest:
+		return nil, status.Error(codes.InvalidArgument, string(body))
+	case http.StatusNotFound:
+		return nil, status.Error(codes.NotFound, string(body))
+	default:
+		return nil, fmt.Errorf("request failed with status: %d: %s", resp.StatusCode, string(body))
+	}
+}
+
+// workspaceSize returns the bytes a workspace of the VM holds, zero if it
+// doesn't exist yet. The caller holds the VM's gate.
+func (v *vm) workspaceSize(ctx context.Context, workspace string) (int64, error) {
+	if err := v.requireAgentFeature(ctx, agentCmdServer, featureWorkspaces); err != nil {
+		return 0, err
+	}
+	body, err := v.cmdServerRequest(ctx, http.MethodGet, "/workspaces")
+	if err != nil {
+		return 0, err
+	}
+	var guestResp cmdserver.ListWorkspacesResponse
+	if err := json.Unmarshal(body, &guestResp); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	for _, ws := range guestResp.Workspaces {
+		if ws.Name == workspace {
+			return ws.SizeBytes, nil
+		}
+	}
+	return 0, nil
+}
+
+// ListWorkspaces returns the exec workspaces in a VM with their sizes.
+func (s *Server) ListWorkspaces(ctx context.Context, vmName string) (*serverapi.ListWorkspacesResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	release, err := vm.gate.acquireShared(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := vm.requireAgentFeature(ctx, agentCmdServer, featureWorkspaces); err != nil {
+		return nil, err
+	}
+	body, err := vm.cmdServerRequest(ctx, http.MethodGet, "/workspaces")
+	if err != nil {
+		return nil, err
+	}
+
+	var guestResp cmdserver.ListWorkspacesResponse
+	if err := json.Unmarshal(body, &guestResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	resp := &serverapi.ListWorkspacesResponse{
+		Workspaces: []serverapi.Workspace{},
+	}
+	for _, ws := range guestResp.Workspaces {
+		resp.Workspaces = append(resp.Workspaces, serverapi.Workspace{
+			Name:      serverapi.PtrString(ws.Name),
+			SizeBytes: serverapi.PtrInt64(ws.SizeBytes),
+		})
+	}
+	return resp, nil
+}
+
+// DeleteWorkspace removes an exec workspace and its files from a VM.
+func (s *Server) DeleteWorkspace(ctx context.Context, vmName string, workspace string) error {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if err := cmdserver.ValidateWorkspaceName(workspace); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := checkLease(ctx, vm); err != nil {
+		return err
+	}
+
+	release, err := vm.gate.acquireShared(ctx, vmName)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := vm.requireAgentFeature(ctx, agentCmdServer, featureWorkspaces); err != nil {
+		return err
+	}
+	_, err = vm.cmdServerRequest(ctx, http.MethodDelete, "/workspaces/"+workspace)
+	return err
+}
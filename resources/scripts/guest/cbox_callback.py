@@ -96,6 +96,37 @@ def callback(method: str, params: Optional[dict] = None, timeout: float = 30.0)
         sock.close()
 
 
+def callback_stats(timeout: float = 5.0) -> dict:
+    """
+    Return the callback counters tracked by the local vsockserver.
+
+    The counters (sent, succeeded, failed, lastError) reset whenever the agent
+    restarts; agentStartedAt shows when that last happened.
+    """
+    try:
+        sock = socket.socket(socket.AF_VSOCK, socket.SOCK_STREAM)
+        sock.settimeout(timeout)
+        sock.connect((VSOCK_HOST_CID, VSOCK_PORT))
+    except socket.error as e:
+        raise ConnectionError(f"Failed to connect to vsock server: {e}")
+
+    try:
+        sock.sendall(b"CALLBACK_STATS\n")
+        response = b""
+        while not response.endswith(b'\n'):
+            chunk = sock.recv(4096)
+            if not chunk:
+                break
+            response += chunk
+
+        response_str = response.decode('utf-8').strip()
+        if response_str.startswith("Error:"):
+            raise RuntimeError(response_str)
+        return json.loads(response_str)
+    finally:
+        sock.close()
+
+
 def callback_async(method: str, params: Optional[dict] = None) -> None:
     """
     Make a fire-and-forget callback to the host client.